@@ -0,0 +1,165 @@
+package smtp
+
+import (
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// AuthMechanism is a SASL mechanism candidate for Client.AuthAny.
+type AuthMechanism struct {
+	// Name is the mechanism name, as advertised by the server.
+	Name string
+	// Client returns a new SASL client for the mechanism. It is only called
+	// if the mechanism is attempted.
+	Client func() sasl.Client
+	// RequireTLS prevents the mechanism from being used over an unencrypted
+	// connection. It should be set for mechanisms sending the password in
+	// clear text, such as PLAIN and LOGIN.
+	RequireTLS bool
+}
+
+// PasswordAuthMechanisms returns the PLAIN and LOGIN mechanisms, in this order
+// of preference. Both are restricted to encrypted connections. Stronger
+// mechanisms, such as SCRAM, can be prepended to the list.
+func PasswordAuthMechanisms(username, password string) []AuthMechanism {
+	return []AuthMechanism{
+		{
+			Name: sasl.Plain,
+			Client: func() sasl.Client {
+				return sasl.NewPlainClient("", username, password)
+			},
+			RequireTLS: true,
+		},
+		{
+			Name: sasl.Login,
+			Client: func() sasl.Client {
+				return NewLoginClient(username, password)
+			},
+			RequireTLS: true,
+		},
+	}
+}
+
+// NoAuthMechanismError is returned by Client.AuthAny when none of the
+// candidate mechanisms could be used.
+type NoAuthMechanismError struct {
+	// Offered lists the mechanisms advertised by the server.
+	Offered []string
+	// Insecure lists the mechanisms supported by the server which were
+	// skipped because the connection isn't encrypted.
+	Insecure []string
+	// Err is the last error returned by the server when it refused a
+	// mechanism, if any.
+	Err error
+}
+
+func (err *NoAuthMechanismError) Error() string {
+	s := "smtp: no usable authentication mechanism (server offers: " + strings.Join(err.Offered, " ") + ")"
+	if len(err.Insecure) > 0 {
+		s += ", " + strings.Join(err.Insecure, " ") + " require TLS"
+	}
+	if err.Err != nil {
+		s += ": " + err.Err.Error()
+	}
+	return s
+}
+
+func (err *NoAuthMechanismError) Unwrap() error {
+	return err.Err
+}
+
+// isMechanismRejected checks whether an AUTH error is specific to the
+// mechanism, in which case another one can be attempted. Invalid credentials
+// aren't retried with another mechanism.
+func isMechanismRejected(err error) bool {
+	smtpErr, ok := err.(*SMTPError)
+	if !ok {
+		return false
+	}
+	switch smtpErr.Code {
+	case 504, // Unrecognized authentication type
+		534, // Authentication mechanism is too weak
+		538: // Encryption required for requested authentication mechanism
+		return true
+	}
+	return false
+}
+
+// AuthAny authenticates with the first mechanism of mechs supported by the
+// server, and returns its name. Mechanisms with RequireTLS set are skipped
+// if the connection isn't encrypted. If the server refuses a mechanism, the
+// next one is attempted.
+//
+// A failed authentication closes the connection. If no mechanism could be
+// used, a *NoAuthMechanismError is returned.
+func (c *Client) AuthAny(mechs []AuthMechanism) (string, error) {
+	if err := c.hello(); err != nil {
+		return "", err
+	}
+
+	noMechErr := &NoAuthMechanismError{}
+	if _, ok := c.ext["AUTH"]; ok {
+		noMechErr.Offered = append([]string(nil), c.auth...)
+	}
+	for _, m := range mechs {
+		if !c.hasAuth(m.Name) {
+			continue
+		}
+		if m.RequireTLS && !c.tls {
+			noMechErr.Insecure = append(noMechErr.Insecure, m.Name)
+			continue
+		}
+
+		err := c.authenticateRetry(m.Client())
+		if err == nil {
+			return m.Name, nil
+		} else if !isMechanismRejected(err) {
+			c.Quit()
+			return "", err
+		}
+		noMechErr.Err = err
+	}
+	c.Quit()
+	return "", noMechErr
+}
+
+func (c *Client) hasAuth(mech string) bool {
+	if _, ok := c.ext["AUTH"]; !ok {
+		return false
+	}
+	for _, m := range c.auth {
+		if strings.EqualFold(m, mech) {
+			return true
+		}
+	}
+	return false
+}
+
+type loginClient struct {
+	username, password string
+	step               int
+}
+
+// NewLoginClient returns a client for the obsolete LOGIN mechanism, for
+// servers which don't support PLAIN. The credentials are sent in clear text.
+func NewLoginClient(username, password string) sasl.Client {
+	return &loginClient{username: username, password: password}
+}
+
+func (a *loginClient) Start() (mech string, ir []byte, err error) {
+	a.step = 0
+	return sasl.Login, nil, nil
+}
+
+func (a *loginClient) Next(challenge []byte) ([]byte, error) {
+	a.step++
+	switch a.step {
+	case 1:
+		return []byte(a.username), nil
+	case 2:
+		return []byte(a.password), nil
+	default:
+		return nil, sasl.ErrUnexpectedServerChallenge
+	}
+}
@@ -2,7 +2,9 @@ package smtp
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"time"
 )
 
 var (
@@ -10,6 +12,17 @@ var (
 	ErrAuthUnsupported = errors.New("Authentication not supported")
 )
 
+// Errors Session.Rcpt and Session.Data can return, possibly wrapped, when a
+// recipient can't receive more mail. The error message is sent to the client.
+var (
+	// ErrOverQuota is replied with 452 4.2.2, so that the client retries
+	// later.
+	ErrOverQuota = errors.New("Mailbox over quota")
+	// ErrMailboxFull is replied with 552 5.2.2, so that the message is
+	// bounced.
+	ErrMailboxFull = errors.New("Mailbox full")
+)
+
 // A SMTP server backend.
 type Backend interface {
 	// Authenticate a user. Return smtp.ErrAuthUnsupported if you don't want to
@@ -35,3 +48,176 @@ type Session interface {
 	// Set currently processed message contents and send it.
 	Data(r io.Reader) error
 }
+
+// Verifier is an optional interface backends can implement to answer VRFY
+// commands, when Server.VrfyMode is VrfyBackend.
+type Verifier interface {
+	// Verify checks that an address can receive mail. It returns nil if it
+	// can, or a SMTPError, typically with a 550 code, if it can't.
+	Verify(state *ConnectionState, addr string) error
+}
+
+// HelloChecker is an optional interface backends can implement to check the
+// HELO, EHLO or LHLO greeting, for policies which must act before MAIL.
+type HelloChecker interface {
+	// CheckHello is called with the hostname claimed by the client, also set
+	// in state, and whether ESMTP is used (EHLO or LHLO). If it returns an
+	// error, the greeting is rejected and has no effect: the client must send
+	// another one. A SMTPError is replied as-is, other errors are replied
+	// with 451 4.0.0.
+	CheckHello(state *ConnectionState, hostname string, esmtp bool) error
+}
+
+// PostmasterSession is an optional interface sessions can implement to handle
+// the special "<Postmaster>" recipient, without a domain. RFC 5321 section
+// 4.5.1 requires servers to accept it, whatever their relay policy. If
+// implemented, RcptPostmaster is called instead of Rcpt for this recipient,
+// with the address as written by the client.
+type PostmasterSession interface {
+	RcptPostmaster(to string) error
+}
+
+// NormalizedRcptSession is an optional interface sessions can implement to
+// receive both the normalized and the original form of recipient addresses,
+// when Server.RcptNormalization is set. If implemented, RcptNormalized is
+// called instead of Rcpt.
+type NormalizedRcptSession interface {
+	RcptNormalized(to, original string) error
+}
+
+// StatusCollector allows a backend to report the status of each recipient
+// in LMTP mode.
+type StatusCollector interface {
+	// SetStatus sets the status of a recipient, nil meaning success. It is
+	// safe for concurrent use, so recipients can be processed in parallel.
+	SetStatus(rcptTo string, err error)
+}
+
+// LMTPSession is an optional interface sessions can implement to report a
+// status per recipient in LMTP mode, as defined in RFC 2033 section 4.2.
+type LMTPSession interface {
+	// LMTPData is the LMTP version of Data. SetStatus should be called once
+	// per recipient accepted by Rcpt, before LMTPData returns. Recipients
+	// without a status get the error returned by LMTPData, or succeed if it
+	// is nil.
+	LMTPData(r io.Reader, status StatusCollector) error
+}
+
+// RcptLimiter is an optional interface sessions can implement to limit the
+// number of recipients of a transaction dynamically, for instance depending on
+// the sender. Once the limit is reached, RCPT is replied with 452 4.5.3, so
+// that the client sends the remaining recipients in another transaction.
+type RcptLimiter interface {
+	// RcptLimit returns the maximum number of recipients of the current
+	// transaction. It is called before each RCPT command. Zero means no
+	// limit.
+	RcptLimit() int
+}
+
+// SizeLimiter is an optional interface sessions can implement to override
+// Server.MaxMessageBytes, for instance to allow larger messages once a client
+// has authenticated. The limit is advertised with SIZE when the client sends
+// EHLO again, and enforced by MAIL and DATA.
+type SizeLimiter interface {
+	// MaxMessageBytes returns the maximum message size in bytes. Zero means
+	// no limit.
+	MaxMessageBytes() int
+}
+
+// TryResetter is an optional interface sessions can implement when
+// discarding the current message can fail, for instance because resources
+// reserved for it are held by a remote service. If implemented, TryReset is
+// called instead of Reset.
+//
+// Errors are logged. When the client sent RSET, it is replied with the error
+// if it is a SMTPError with a 4xx code, or with 451 4.3.0 otherwise. Errors
+// returned by Logout are logged too.
+type TryResetter interface {
+	TryReset() error
+}
+
+// AbortReason is the reason a transaction was aborted.
+type AbortReason int
+
+const (
+	// AbortReset means the client sent RSET.
+	AbortReset AbortReason = iota
+	// AbortHello means the client sent HELO, EHLO or LHLO, which resets the
+	// transaction.
+	AbortHello
+	// AbortStartTLS means the connection was upgraded with STARTTLS, which
+	// resets the transaction.
+	AbortStartTLS
+	// AbortDisconnect means the connection was closed: the client sent QUIT
+	// or disconnected, a timeout expired or the server was shut down.
+	AbortDisconnect
+)
+
+func (r AbortReason) String() string {
+	switch r {
+	case AbortReset:
+		return "reset"
+	case AbortHello:
+		return "hello"
+	case AbortStartTLS:
+		return "starttls"
+	case AbortDisconnect:
+		return "disconnect"
+	}
+	return fmt.Sprintf("AbortReason(%d)", int(r))
+}
+
+// TransactionSession is an optional interface sessions can implement to
+// access the transaction maintained by the server. BeginTransaction is called
+// for each MAIL command before Mail, with a transaction which is updated as
+// recipients are accepted. If Mail fails, the transaction is discarded.
+type TransactionSession interface {
+	BeginTransaction(tx *Transaction)
+}
+
+// TransactionAborter is an optional interface sessions can implement to be
+// notified when a transaction is aborted, for instance to release resources
+// reserved for it such as database rows or temporary files.
+//
+// A transaction is aborted when it ends after MAIL and before DATA, without a
+// message being submitted. Abort is called before Reset or Logout. Failures
+// during DATA are reported by the error returned by Data instead.
+type TransactionAborter interface {
+	Abort(reason AbortReason)
+}
+
+// SessionSummary describes a connection once it has ended.
+type SessionSummary struct {
+	// SessionID is the identifier of the connection, see
+	// ConnectionState.SessionID.
+	SessionID string
+	// Start is the time the connection was accepted.
+	Start time.Time
+	// Duration is the time the connection lasted.
+	Duration time.Duration
+	// Quit is set if the client sent QUIT, rather than disconnecting or
+	// being disconnected.
+	Quit bool
+
+	// Messages is the number of accepted messages. In LMTP mode, a message
+	// is accepted if at least one recipient accepted it.
+	Messages int
+	// Bytes is the total size of the accepted messages.
+	Bytes int64
+
+	// The number of MAIL, RCPT and DATA commands rejected, either by the
+	// server or by the session.
+	RejectedMail int
+	RejectedRcpt int
+	RejectedData int
+}
+
+// SessionFinalizer is an optional interface sessions can implement to be
+// notified when the connection ends, for instance to finalize accounting.
+//
+// Finalize is called once, before Logout, with the summary of the whole
+// connection, including transactions which happened before the session was
+// created with AUTH or MAIL.
+type SessionFinalizer interface {
+	Finalize(summary SessionSummary)
+}
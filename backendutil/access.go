@@ -0,0 +1,135 @@
+package backendutil
+
+import (
+	"net"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errAccessLookup = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Failed to look up access rules",
+}
+
+// AccessBackend is a backend checking clients, senders and recipients against
+// access tables, like Postfix access maps.
+//
+// Table values are actions, as accepted by PolicyError: for instance "OK",
+// "REJECT", "DEFER Try again later" or "550 5.7.1 Go away". Addresses are
+// looked up by full address, then domain, then parent domains, then local
+// part followed by "@". The null sender is looked up as "<>". Clients are
+// looked up by IP address, then IPv4 networks ("192.0.2", "192.0"). The first
+// matching key decides.
+type AccessBackend struct {
+	Backend smtp.Backend
+	// Tables checked before accepting the sender, each being optional.
+	Clients Table
+	Senders Table
+	// Recipients is checked before accepting each recipient.
+	Recipients Table
+}
+
+// Login implements the smtp.Backend interface.
+func (be *AccessBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	s, err := be.Backend.Login(state, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &accessSession{Session: s, be: be, state: state}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *AccessBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	s, err := be.Backend.AnonymousLogin(state)
+	if err != nil {
+		return nil, err
+	}
+	return &accessSession{Session: s, be: be, state: state}, nil
+}
+
+// checkAccess looks up keys in order and returns the error of the first
+// matching action.
+func checkAccess(t Table, keys []string) error {
+	if t == nil {
+		return nil
+	}
+	for _, key := range keys {
+		action, ok, err := t.Lookup(key)
+		if err != nil {
+			return errAccessLookup
+		}
+		if ok {
+			return PolicyError(action)
+		}
+	}
+	return nil
+}
+
+// addressAccessKeys returns the lookup keys of an address.
+func addressAccessKeys(addr string) []string {
+	if addr == "" {
+		return []string{"<>"}
+	}
+	addr = strings.ToLower(addr)
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		return []string{addr}
+	}
+	keys := []string{addr}
+	for domain := addr[at+1:]; domain != ""; {
+		keys = append(keys, domain)
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return append(keys, addr[:at+1])
+}
+
+// clientAccessKeys returns the lookup keys of a client address.
+func clientAccessKeys(addr net.Addr) []string {
+	if addr == nil {
+		return nil
+	}
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	keys := []string{strings.ToLower(host)}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		parts := strings.Split(ip.To4().String(), ".")
+		for i := 3; i > 0; i-- {
+			keys = append(keys, strings.Join(parts[:i], "."))
+		}
+	}
+	return keys
+}
+
+type accessSession struct {
+	smtp.Session
+
+	be    *AccessBackend
+	state *smtp.ConnectionState
+}
+
+func (s *accessSession) Mail(from string) error {
+	if s.state != nil {
+		if err := checkAccess(s.be.Clients, clientAccessKeys(s.state.RemoteAddr)); err != nil {
+			return err
+		}
+	}
+	if err := checkAccess(s.be.Senders, addressAccessKeys(from)); err != nil {
+		return err
+	}
+	return s.Session.Mail(from)
+}
+
+func (s *accessSession) Rcpt(to string) error {
+	if err := checkAccess(s.be.Recipients, addressAccessKeys(to)); err != nil {
+		return err
+	}
+	return s.Session.Rcpt(to)
+}
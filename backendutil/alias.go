@@ -0,0 +1,274 @@
+package backendutil
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// maxAliasDepth is the maximum number of times an address is rewritten.
+const maxAliasDepth = 10
+
+// Rewriter rewrites a recipient address into zero, one or more addresses.
+type Rewriter interface {
+	Rewrite(rcpt string) ([]string, error)
+}
+
+// RewriterFunc is an adapter to use a function as a Rewriter.
+type RewriterFunc func(rcpt string) ([]string, error)
+
+// Rewrite implements Rewriter.
+func (f RewriterFunc) Rewrite(rcpt string) ([]string, error) {
+	return f(rcpt)
+}
+
+// RewriteRule rewrites addresses matching a regular expression. Replacement
+// can refer to submatches as in regexp.Regexp.Expand.
+type RewriteRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// AliasMap is a Rewriter using virtual alias maps.
+//
+// An address is rewritten as follows. If PlusSeparator is set, the
+// sub-address is removed ("user+tag@example.org" becomes "user@example.org").
+// Then the first matching entry is applied: the full address in Aliases or
+// Table, the first matching rule of Rules, or the catch-all entry of the
+// domain in Aliases or Table ("@example.org"). Targets are rewritten again, up
+// to a fixed depth.
+// Addresses which don't match anything are left unchanged.
+type AliasMap struct {
+	// Aliases maps lower-case addresses, or domains prefixed with "@" for
+	// catch-all entries, to target addresses.
+	Aliases map[string][]string
+	// If not nil, Table is looked up for keys missing from Aliases. Values
+	// list targets separated by whitespace or commas.
+	Table Table
+	Rules []RewriteRule
+	// PlusSeparator is the sub-address separator, usually "+". If empty,
+	// sub-addresses are kept.
+	PlusSeparator string
+}
+
+// LoadAliasMap reads an alias map from a file. Each line contains a key and
+// targets separated by whitespace or commas. The key may end with a colon.
+// Keys enclosed in slashes are regular expressions. Empty lines and lines
+// starting with "#" are ignored. For instance:
+//
+//	postmaster@example.org: alice@example.org, bob@example.org
+//	@example.net            catch-all@example.org
+//	/^(.*)@old\.example$/   $1@example.org
+func LoadAliasMap(r io.Reader) (*AliasMap, error) {
+	m := &AliasMap{Aliases: make(map[string][]string)}
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := splitAliasTargets(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("backendutil: alias map line %v: missing target", lineno)
+		}
+		key, targets := strings.TrimSuffix(fields[0], ":"), fields[1:]
+
+		if len(key) > 2 && strings.HasPrefix(key, "/") && strings.HasSuffix(key, "/") {
+			re, err := regexp.Compile(key[1 : len(key)-1])
+			if err != nil {
+				return nil, fmt.Errorf("backendutil: alias map line %v: %v", lineno, err)
+			}
+			if len(targets) != 1 {
+				return nil, fmt.Errorf("backendutil: alias map line %v: regular expressions must have a single target", lineno)
+			}
+			m.Rules = append(m.Rules, RewriteRule{re, targets[0]})
+			continue
+		}
+
+		key = strings.ToLower(key)
+		m.Aliases[key] = append(m.Aliases[key], targets...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func splitAliasTargets(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// fold removes the sub-address of an address.
+func (m *AliasMap) fold(addr string) string {
+	if m.PlusSeparator == "" {
+		return addr
+	}
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		return addr
+	}
+	if i := strings.Index(addr[:at], m.PlusSeparator); i > 0 {
+		return addr[:i] + addr[at:]
+	}
+	return addr
+}
+
+// lookupKey looks up a lower-case key in Aliases, then in Table.
+func (m *AliasMap) lookupKey(key string) ([]string, bool, error) {
+	if targets, ok := m.Aliases[key]; ok {
+		return targets, true, nil
+	}
+	if m.Table == nil {
+		return nil, false, nil
+	}
+	v, ok, err := m.Table.Lookup(key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return splitAliasTargets(v), true, nil
+}
+
+// lookup applies the first matching entry to an address.
+func (m *AliasMap) lookup(addr string) ([]string, bool, error) {
+	key := strings.ToLower(addr)
+	if targets, ok, err := m.lookupKey(key); err != nil || ok {
+		return targets, ok, err
+	}
+	for _, rule := range m.Rules {
+		if match := rule.Pattern.FindStringSubmatchIndex(addr); match != nil {
+			dst := rule.Pattern.ExpandString(nil, rule.Replacement, addr, match)
+			return []string{string(dst)}, true, nil
+		}
+	}
+	if at := strings.LastIndexByte(key, '@'); at >= 0 {
+		return m.lookupKey(key[at:])
+	}
+	return nil, false, nil
+}
+
+// rewrite recursively rewrites an address and appends the results to out.
+// path holds the addresses being rewritten, to detect loops.
+func (m *AliasMap) rewrite(addr string, path map[string]bool, out []string) ([]string, error) {
+	addr = m.fold(addr)
+	key := strings.ToLower(addr)
+	if path[key] {
+		return nil, fmt.Errorf("backendutil: alias loop for %q", addr)
+	}
+
+	targets, ok, err := m.lookup(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || (len(targets) == 1 && strings.ToLower(targets[0]) == key) {
+		for _, rcpt := range out {
+			if strings.ToLower(rcpt) == key {
+				return out, nil
+			}
+		}
+		return append(out, addr), nil
+	}
+	if len(path) >= maxAliasDepth {
+		return nil, fmt.Errorf("backendutil: too many levels of aliases for %q", addr)
+	}
+
+	path[key] = true
+	defer delete(path, key)
+
+	for _, target := range targets {
+		if out, err = m.rewrite(target, path, out); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Rewrite implements Rewriter.
+func (m *AliasMap) Rewrite(rcpt string) ([]string, error) {
+	return m.rewrite(rcpt, make(map[string]bool), nil)
+}
+
+// RewriteBackend is a backend rewriting recipient addresses before passing
+// them to the underlying backend.
+type RewriteBackend struct {
+	Backend  smtp.Backend
+	Rewriter Rewriter
+}
+
+// Login implements the smtp.Backend interface.
+func (be *RewriteBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	s, err := be.Backend.Login(state, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &rewriteSession{Session: s, be: be}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *RewriteBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	s, err := be.Backend.AnonymousLogin(state)
+	if err != nil {
+		return nil, err
+	}
+	return &rewriteSession{Session: s, be: be}, nil
+}
+
+type rewriteSession struct {
+	smtp.Session
+
+	be *RewriteBackend
+	// Rewritten recipients of the current transaction
+	rcpts map[string]bool
+}
+
+func (s *rewriteSession) Reset() {
+	s.rcpts = nil
+	s.Session.Reset()
+}
+
+func (s *rewriteSession) Mail(from string) error {
+	s.rcpts = nil
+	return s.Session.Mail(from)
+}
+
+func (s *rewriteSession) Rcpt(to string) error {
+	targets, err := s.be.Rewriter.Rewrite(to)
+	if err != nil {
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Failed to rewrite recipient",
+		}
+	}
+	if len(targets) == 0 {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		}
+	}
+
+	if s.rcpts == nil {
+		s.rcpts = make(map[string]bool)
+	}
+	for _, target := range targets {
+		key := strings.ToLower(target)
+		if s.rcpts[key] {
+			continue
+		}
+		if err := s.Session.Rcpt(target); err != nil {
+			return err
+		}
+		s.rcpts[key] = true
+	}
+	return nil
+}
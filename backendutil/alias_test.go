@@ -0,0 +1,93 @@
+package backendutil_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.RewriteBackend{}
+
+const aliasMap = `# Test aliases
+postmaster@example.org: alice@example.org, Bob@example.org
+bob@example.org         bob@mail.example.org
+loop1@example.org       loop2@example.org
+loop2@example.org       loop1@example.org
+@example.net            catch-all@example.org
+/^(.*)@old\.example$/   $1@example.org
+`
+
+func TestAliasMap(t *testing.T) {
+	m, err := backendutil.LoadAliasMap(strings.NewReader(aliasMap))
+	if err != nil {
+		t.Fatalf("LoadAliasMap: %v", err)
+	}
+	m.PlusSeparator = "+"
+
+	tests := []struct {
+		rcpt string
+		want []string
+	}{
+		{"carol@example.org", []string{"carol@example.org"}},
+		{"Postmaster+reports@example.org", []string{"alice@example.org", "bob@mail.example.org"}},
+		{"anyone@example.net", []string{"catch-all@example.org"}},
+		{"dave@old.example", []string{"dave@example.org"}},
+	}
+	for _, test := range tests {
+		got, err := m.Rewrite(test.rcpt)
+		if err != nil {
+			t.Errorf("Rewrite(%q): %v", test.rcpt, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Rewrite(%q) = %v, want %v", test.rcpt, got, test.want)
+		}
+	}
+
+	if _, err := m.Rewrite("loop1@example.org"); err == nil {
+		t.Error("Rewrite: expected error for alias loop")
+	}
+}
+
+func TestRewriteBackend(t *testing.T) {
+	be := new(backend)
+	rbe := &backendutil.RewriteBackend{
+		Backend: be,
+		Rewriter: backendutil.RewriterFunc(func(rcpt string) ([]string, error) {
+			switch rcpt {
+			case "team@example.org":
+				return []string{"alice@example.org", "bob@example.org"}, nil
+			case "nobody@example.org":
+				return nil, nil
+			}
+			return []string{rcpt}, nil
+		}),
+	}
+
+	s, err := rbe.AnonymousLogin(nil)
+	if err != nil {
+		t.Fatalf("AnonymousLogin: %v", err)
+	}
+	if err := s.Mail("carol@example.net"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	for _, rcpt := range []string{"team@example.org", "alice@example.org"} {
+		if err := s.Rcpt(rcpt); err != nil {
+			t.Fatalf("Rcpt(%q): %v", rcpt, err)
+		}
+	}
+	if err := s.Rcpt("nobody@example.org"); err == nil {
+		t.Error("Rcpt: expected error for address rewritten to nothing")
+	}
+	if err := s.Data(strings.NewReader("Hello!\n")); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatalf("expected 1 message, got %v", len(be.anonmsgs))
+	}
+	if want := []string{"alice@example.org", "bob@example.org"}; !reflect.DeepEqual(be.anonmsgs[0].To, want) {
+		t.Errorf("To = %v, want %v", be.anonmsgs[0].To, want)
+	}
+}
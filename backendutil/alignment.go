@@ -0,0 +1,227 @@
+package backendutil
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// HeaderAlignment defines how the From header field must match the envelope
+// sender, see AlignmentBackend.
+type HeaderAlignment int
+
+const (
+	// AlignmentNone doesn't compare the From field with the envelope sender.
+	AlignmentNone HeaderAlignment = iota
+	// AlignmentRelaxed requires the same domain.
+	AlignmentRelaxed
+	// AlignmentStrict requires the same address.
+	AlignmentStrict
+)
+
+// ParseHeaderAlignment parses a header alignment, "none", "relaxed" or
+// "strict".
+func ParseHeaderAlignment(s string) (HeaderAlignment, error) {
+	switch strings.ToLower(s) {
+	case "none":
+		return AlignmentNone, nil
+	case "relaxed":
+		return AlignmentRelaxed, nil
+	case "strict":
+		return AlignmentStrict, nil
+	}
+	return 0, fmt.Errorf("backendutil: unknown header alignment %q", s)
+}
+
+var (
+	errSenderNotOwned = &smtp.SMTPError{
+		Code:         553,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Sender address rejected: not owned by the authenticated user",
+	}
+	errFromNotOwned = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "From header field rejected: not owned by the authenticated user",
+	}
+	errFromNotAligned = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "From header field doesn't match the envelope sender",
+	}
+	errFromInvalid = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      "Invalid From header field",
+	}
+	errOwnerLookup = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Failed to check sender ownership",
+	}
+)
+
+// AlignmentBackend rejects messages submitted by authenticated users with
+// sender addresses they don't own, so that compromised accounts can't spoof
+// other senders. Both the envelope sender and the addresses of the From
+// header field are checked, similar to Postfix's
+// reject_sender_login_mismatch. Anonymous sessions and null senders are
+// passed through, as are messages without a From field.
+//
+// Only the header is buffered, the body is streamed.
+type AlignmentBackend struct {
+	Backend smtp.Backend
+	// Owners maps sender addresses, or domains prefixed with "@", to the
+	// usernames allowed to send as them, separated by commas or spaces. Users
+	// can always send as their username if it's an address. If nil, users
+	// can only send as their username.
+	Owners Table
+	// Exempt lists the users allowed to send as any address, such as
+	// service accounts.
+	Exempt []string
+	// HeaderAlignment defines how the From field must match the envelope
+	// sender.
+	HeaderAlignment HeaderAlignment
+}
+
+// Login implements the smtp.Backend interface.
+func (be *AlignmentBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	s, err := be.Backend.Login(state, username, password)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range be.Exempt {
+		if strings.EqualFold(u, username) {
+			return s, nil
+		}
+	}
+	return &alignmentSession{Session: s, be: be, username: username}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *AlignmentBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return be.Backend.AnonymousLogin(state)
+}
+
+// owns checks whether a user is allowed to send as an address.
+func (be *AlignmentBackend) owns(username, addr string) (bool, error) {
+	if strings.EqualFold(username, addr) {
+		return true, nil
+	}
+	if be.Owners == nil {
+		return false, nil
+	}
+
+	addr = strings.ToLower(addr)
+	keys := []string{addr}
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		keys = append(keys, addr[i:])
+	}
+	for _, key := range keys {
+		v, ok, err := be.Owners.Lookup(key)
+		if err != nil {
+			return false, errOwnerLookup
+		} else if !ok {
+			continue
+		}
+		for _, owner := range strings.FieldsFunc(v, isOwnerSep) {
+			if strings.EqualFold(owner, username) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func isOwnerSep(r rune) bool {
+	return r == ',' || r == ' ' || r == '\t'
+}
+
+// aligned checks whether the address of the From field matches the envelope
+// sender.
+func (be *AlignmentBackend) aligned(from, envelope string) bool {
+	switch be.HeaderAlignment {
+	case AlignmentRelaxed:
+		return strings.EqualFold(addrDomain(from), addrDomain(envelope))
+	case AlignmentStrict:
+		return strings.EqualFold(from, envelope)
+	}
+	return true
+}
+
+func addrDomain(addr string) string {
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		return addr[i+1:]
+	}
+	return ""
+}
+
+type alignmentSession struct {
+	smtp.Session
+
+	be       *AlignmentBackend
+	username string
+	from     string
+}
+
+func (s *alignmentSession) Reset() {
+	s.from = ""
+	s.Session.Reset()
+}
+
+func (s *alignmentSession) Mail(from string) error {
+	if from != "" {
+		if ok, err := s.be.owns(s.username, from); err != nil {
+			return err
+		} else if !ok {
+			return errSenderNotOwned
+		}
+	}
+	if err := s.Session.Mail(from); err != nil {
+		return err
+	}
+	s.from = from
+	return nil
+}
+
+func (s *alignmentSession) Data(r io.Reader) error {
+	br := bufio.NewReader(r)
+	fields, eol, err := readHeaderFields(br)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range fields {
+		name := fieldName(field)
+		if !strings.EqualFold(name, "From") {
+			continue
+		}
+		value := strings.NewReplacer("\r", "", "\n", "").Replace(field[len(name)+1:])
+		addrs, err := mail.ParseAddressList(value)
+		if err != nil {
+			return errFromInvalid
+		}
+		for _, addr := range addrs {
+			if ok, err := s.be.owns(s.username, addr.Address); err != nil {
+				return err
+			} else if !ok {
+				return errFromNotOwned
+			}
+			if s.from != "" && !s.be.aligned(addr.Address, s.from) {
+				return errFromNotAligned
+			}
+		}
+	}
+
+	var header bytes.Buffer
+	for _, field := range fields {
+		header.WriteString(field)
+	}
+	header.WriteString(eol)
+	return s.Session.Data(io.MultiReader(&header, br))
+}
@@ -0,0 +1,111 @@
+package backendutil_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.AlignmentBackend{}
+
+func TestAlignmentBackend(t *testing.T) {
+	mem := &backendutil.MemoryBackend{
+		Auth: backendutil.UserMap{
+			"alice@example.org": "secret",
+			"bob":               "secret",
+			"mailer":            "secret",
+		}.Auth,
+		AllowAnonymous: true,
+	}
+	be := &backendutil.AlignmentBackend{
+		Backend: mem,
+		Owners: backendutil.MapTable{
+			"bob@example.org":   "bob",
+			"sales@example.org": "alice@example.org, bob",
+			"@example.net":      "bob",
+		},
+		Exempt:          []string{"mailer"},
+		HeaderAlignment: backendutil.AlignmentRelaxed,
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		from     string
+		header   string
+		code     int
+	}{
+		{name: "own address", username: "alice@example.org", from: "alice@example.org", header: "Alice <alice@example.org>"},
+		{name: "case", username: "alice@example.org", from: "Alice@Example.org", header: "ALICE@example.org"},
+		{name: "shared address", username: "alice@example.org", from: "alice@example.org", header: "sales@example.org"},
+		{name: "domain", username: "bob", from: "anything@example.net", header: "bob@example.net"},
+		{name: "null sender", username: "bob", from: "", header: "bob@example.org"},
+		{name: "no From", username: "bob", from: "bob@example.org"},
+		{name: "exempt", username: "mailer", from: "ceo@example.com", header: "ceo@example.com"},
+		{name: "spoofed sender", username: "alice@example.org", from: "bob@example.org", code: 553},
+		{name: "spoofed From", username: "alice@example.org", from: "alice@example.org", header: "bob@example.org", code: 554},
+		{name: "spoofed author", username: "bob", from: "bob@example.org", header: "bob@example.org, ceo@example.com", code: 554},
+		{name: "not aligned", username: "bob", from: "bob@example.org", header: "bob@example.net", code: 554},
+		{name: "invalid From", username: "bob", from: "bob@example.org", header: "<bob@", code: 554},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := be.Login(nil, tc.username, "secret")
+			if err != nil {
+				t.Fatalf("Login: %v", err)
+			}
+			msg := "Subject: Hi\r\n\r\nHi\r\n"
+			if tc.header != "" {
+				msg = "From: " + tc.header + "\r\n" + msg
+			}
+
+			err = s.Mail(tc.from)
+			if err == nil {
+				if err := s.Rcpt("carol@example.com"); err != nil {
+					t.Fatalf("Rcpt: %v", err)
+				}
+				err = s.Data(strings.NewReader(msg))
+			}
+			if tc.code == 0 {
+				if err != nil {
+					t.Errorf("expected the message to be accepted, got %v", err)
+				}
+			} else if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != tc.code {
+				t.Errorf("expected a %v error, got %v", tc.code, err)
+			}
+		})
+	}
+
+	// Anonymous sessions aren't checked
+	s, err := be.AnonymousLogin(nil)
+	if err != nil {
+		t.Fatalf("AnonymousLogin: %v", err)
+	}
+	if err := s.Mail("bob@example.org"); err != nil {
+		t.Errorf("anonymous Mail: %v", err)
+	}
+}
+
+func TestAlignmentBackend_strict(t *testing.T) {
+	be := &backendutil.AlignmentBackend{
+		Backend:         &backendutil.MemoryBackend{Auth: backendutil.UserMap{"bob": "secret"}.Auth},
+		Owners:          backendutil.MapTable{"@example.org": "bob"},
+		HeaderAlignment: backendutil.AlignmentStrict,
+	}
+	s, err := be.Login(nil, "bob", "secret")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if err := s.Mail("bounces@example.org"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := s.Rcpt("carol@example.com"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	err = s.Data(strings.NewReader("From: bob@example.org\r\n\r\nHi\r\n"))
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 554 {
+		t.Errorf("expected a 554 error, got %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package backendutil
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errBannedAttachment = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Message contains a banned attachment",
+}
+
+// AttachmentAction defines what AttachmentPolicy does with messages
+// containing banned attachments.
+type AttachmentAction int
+
+const (
+	// AttachmentReject rejects the message with 554 5.7.1.
+	AttachmentReject AttachmentAction = iota
+	// AttachmentStrip replaces banned attachments with a text notice.
+	AttachmentStrip
+)
+
+// ParseAttachmentAction parses an attachment action, "reject" or "strip".
+func ParseAttachmentAction(s string) (AttachmentAction, error) {
+	switch strings.ToLower(s) {
+	case "reject":
+		return AttachmentReject, nil
+	case "strip":
+		return AttachmentStrip, nil
+	}
+	return 0, fmt.Errorf("backendutil: unknown attachment action %q", s)
+}
+
+// AttachmentPolicy bans MIME parts by content type or file name extension.
+// The file name is taken from the Content-Disposition filename parameter, or
+// the Content-Type name parameter.
+//
+// Only the header of each part is buffered. The structure of messages is
+// validated as with MIMEValidator, since attachments hidden in a malformed
+// message could be missed. Transform can be used as
+// TransformBackend.TransformData.
+type AttachmentPolicy struct {
+	// ContentTypes lists the banned media types, such as
+	// "application/x-msdownload". A "type/*" entry bans all the subtypes.
+	ContentTypes []string
+	// Extensions lists the banned file name extensions, such as ".exe".
+	Extensions []string
+	// Action is applied to the banned parts. Messages whose main content is
+	// banned are always rejected.
+	Action AttachmentAction
+	// MaxDepth is the maximum nesting depth of MIME entities. If zero,
+	// DefaultMIMEMaxDepth is used.
+	MaxDepth int
+}
+
+// Transform returns a reader applying the policy to a message.
+func (p *AttachmentPolicy) Transform(r io.Reader) (io.Reader, error) {
+	maxDepth := p.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultMIMEMaxDepth
+	}
+	return &mimeReader{
+		br:       bufio.NewReader(r),
+		maxDepth: maxDepth,
+		stack:    []*mimeEntity{{inHeader: true}},
+		filter:   p.filter,
+	}, nil
+}
+
+func (p *AttachmentPolicy) filter(e *mimeEntity, depth int, eol string) ([]byte, error) {
+	filename := entityFilename(e)
+	if !p.banned(e.mediaType, filename) {
+		return nil, nil
+	}
+	if depth == 0 || p.Action != AttachmentStrip {
+		return nil, errBannedAttachment
+	}
+
+	notice := "A banned attachment was removed from this message."
+	if filename != "" {
+		notice = fmt.Sprintf("The attachment %q was removed from this message.", filename)
+	}
+	return []byte("Content-Type: text/plain; charset=utf-8" + eol + eol + notice + eol), nil
+}
+
+func (p *AttachmentPolicy) banned(mediaType, filename string) bool {
+	for _, t := range p.ContentTypes {
+		t = strings.ToLower(t)
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+
+	// Windows ignores trailing dots and spaces
+	name := strings.ToLower(strings.TrimRight(filename, ". "))
+	if name == "" {
+		return false
+	}
+	for _, ext := range p.Extensions {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// entityFilename returns the file name of a MIME entity, or an empty string.
+func entityFilename(e *mimeEntity) string {
+	var name string
+	if e.disposition != "" {
+		if _, params, err := mime.ParseMediaType(e.disposition); err == nil || err == mime.ErrInvalidMediaParameter {
+			name = params["filename"]
+		}
+	}
+	if name == "" {
+		name = e.params["name"]
+	}
+
+	// Some clients use RFC 2047 encoded-words instead of RFC 2231
+	dec := new(mime.WordDecoder)
+	if decoded, err := dec.DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	return name
+}
@@ -0,0 +1,127 @@
+package backendutil_test
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+const attachmentMessage = "Subject: Invoice\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"See attached.\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment;\r\n" +
+	" filename=\"invoice.pdf.exe.\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"TVqQAAMAAAAEAAAA\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: application/javascript; name=\"=?utf-8?q?run.js?=\"\r\n" +
+	"\r\n" +
+	"alert(1)\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hi\r\n" +
+	"--inner--\r\n" +
+	"--outer--\r\n"
+
+func TestAttachmentPolicy(t *testing.T) {
+	p := &backendutil.AttachmentPolicy{
+		ContentTypes: []string{"application/x-msdownload"},
+		Extensions:   []string{".exe", "js"},
+		Action:       backendutil.AttachmentStrip,
+	}
+	r, err := p.Transform(strings.NewReader(attachmentMessage))
+	if err != nil {
+		t.Fatalf("Transform: %v", err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+
+	want := "Subject: Invoice\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached.\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"The attachment \"invoice.pdf.exe.\" was removed from this message.\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=inner\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"The attachment \"run.js\" was removed from this message.\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hi\r\n" +
+		"--inner--\r\n" +
+		"--outer--\r\n"
+	if string(b) != want {
+		t.Errorf("Transform() = \n%v\nwant\n%v", string(b), want)
+	}
+
+	// Messages without banned parts are unchanged
+	msg := strings.Replace(attachmentMessage, ".exe", ".txt", 1)
+	msg = strings.Replace(msg, "run.js", "run.txt", 1)
+	r, _ = p.Transform(strings.NewReader(msg))
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != msg {
+		t.Errorf("Transform() = \n%v\n%v\nwant the message unchanged", string(b), err)
+	}
+}
+
+func TestAttachmentPolicy_reject(t *testing.T) {
+	tests := []struct {
+		name   string
+		action backendutil.AttachmentAction
+		msg    string
+	}{
+		{name: "attachment", action: backendutil.AttachmentReject, msg: attachmentMessage},
+		{
+			name:   "main content",
+			action: backendutil.AttachmentStrip,
+			msg:    "Content-Type: application/x-msdownload\n\nMZ\n",
+		},
+		{
+			name:   "content type wildcard",
+			action: backendutil.AttachmentReject,
+			msg:    "Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: video/mp4\n\n\n--b--\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &backendutil.AttachmentPolicy{
+				ContentTypes: []string{"application/x-msdownload", "video/*"},
+				Extensions:   []string{".exe"},
+				Action:       tc.action,
+			}
+			r, err := p.Transform(strings.NewReader(tc.msg))
+			if err != nil {
+				t.Fatalf("Transform: %v", err)
+			}
+			_, err = ioutil.ReadAll(r)
+			if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 554 {
+				t.Errorf("ReadAll: expected a 554 error, got %v", err)
+			}
+		})
+	}
+}
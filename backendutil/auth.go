@@ -0,0 +1,36 @@
+package backendutil
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errInvalidCredentials = errors.New("Invalid username or password")
+
+// UserMap maps usernames to passwords. Its Auth method can be used as the
+// Auth field of backends.
+type UserMap map[string]string
+
+// Auth checks credentials. Passwords are compared in constant time, and
+// unknown users take as long to check as known ones.
+func (m UserMap) Auth(username, password string) error {
+	want, ok := m[username]
+	// Hashing hides the length of the password from the comparison
+	wantSum := sha256.Sum256([]byte(want))
+	sum := sha256.Sum256([]byte(password))
+	if subtle.ConstantTimeCompare(wantSum[:], sum[:]) != 1 || !ok {
+		return errInvalidCredentials
+	}
+	return nil
+}
+
+// login checks credentials with the Auth field of a backend.
+func login(auth func(username, password string) error, username, password string) error {
+	if auth == nil {
+		return smtp.ErrAuthUnsupported
+	}
+	return auth(username, password)
+}
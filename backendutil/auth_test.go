@@ -0,0 +1,28 @@
+package backendutil_test
+
+import (
+	"testing"
+
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+func TestUserMap(t *testing.T) {
+	users := backendutil.UserMap{"alice": "secret", "bob": ""}
+	tests := []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "Secret", false},
+		{"alice", "secret2", false},
+		{"alice", "", false},
+		{"bob", "", true},
+		{"mallory", "", false},
+		{"mallory", "secret", false},
+	}
+	for _, tc := range tests {
+		if err := users.Auth(tc.username, tc.password); (err == nil) != tc.ok {
+			t.Errorf("Auth(%q, %q) = %v", tc.username, tc.password, err)
+		}
+	}
+}
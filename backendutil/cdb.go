@@ -0,0 +1,106 @@
+package backendutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// CDBTable is a table stored in a constant database file, as created by
+// cdbmake or "postmap cdb:". See https://cr.yp.to/cdb/cdb.txt.
+type CDBTable struct {
+	r io.ReaderAt
+	f *os.File
+}
+
+// OpenCDBTable opens a CDB file. The file isn't loaded in memory, lookups
+// read it directly.
+func OpenCDBTable(path string) (*CDBTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &CDBTable{r: f, f: f}, nil
+}
+
+// NewCDBTable creates a table reading CDB data from r.
+func NewCDBTable(r io.ReaderAt) *CDBTable {
+	return &CDBTable{r: r}
+}
+
+// Close closes the CDB file.
+func (t *CDBTable) Close() error {
+	if t.f == nil {
+		return nil
+	}
+	return t.f.Close()
+}
+
+func cdbHash(b []byte) uint32 {
+	h := uint32(5381)
+	for _, c := range b {
+		h = ((h << 5) + h) ^ uint32(c)
+	}
+	return h
+}
+
+func (t *CDBTable) readUint32Pair(off uint32) (uint32, uint32, error) {
+	var b [8]byte
+	if _, err := t.r.ReadAt(b[:], int64(off)); err != nil {
+		return 0, 0, fmt.Errorf("backendutil: failed to read CDB file: %v", err)
+	}
+	return binary.LittleEndian.Uint32(b[:4]), binary.LittleEndian.Uint32(b[4:]), nil
+}
+
+// Lookup implements Table. Postfix may store keys and values with a trailing
+// NUL byte, both forms are looked up.
+func (t *CDBTable) Lookup(key string) (string, bool, error) {
+	v, ok, err := t.lookup(key)
+	if err == nil && !ok {
+		v, ok, err = t.lookup(key + "\x00")
+	}
+	return strings.TrimSuffix(v, "\x00"), ok, err
+}
+
+func (t *CDBTable) lookup(key string) (string, bool, error) {
+	k := []byte(key)
+	h := cdbHash(k)
+
+	tablePos, slots, err := t.readUint32Pair((h % 256) * 8)
+	if err != nil || slots == 0 {
+		return "", false, err
+	}
+
+	start := (h >> 8) % slots
+	for i := uint32(0); i < slots; i++ {
+		slot := (start + i) % slots
+		slotHash, recordPos, err := t.readUint32Pair(tablePos + slot*8)
+		if err != nil {
+			return "", false, err
+		}
+		if recordPos == 0 {
+			return "", false, nil
+		}
+		if slotHash != h {
+			continue
+		}
+
+		keyLen, valueLen, err := t.readUint32Pair(recordPos)
+		if err != nil {
+			return "", false, err
+		}
+		if keyLen != uint32(len(k)) {
+			continue
+		}
+		record := make([]byte, keyLen+valueLen)
+		if _, err := t.r.ReadAt(record, int64(recordPos)+8); err != nil {
+			return "", false, fmt.Errorf("backendutil: failed to read CDB file: %v", err)
+		}
+		if string(record[:keyLen]) == key {
+			return string(record[keyLen:]), true, nil
+		}
+	}
+	return "", false, nil
+}
@@ -0,0 +1,88 @@
+package backendutil
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// poolConn is a pooled connection to a service.
+type poolConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+// dialPoolConn connects to a service.
+func dialPoolConn(network, addr string, timeout time.Duration) (*poolConn, error) {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &poolConn{Conn: conn, br: bufio.NewReader(conn)}, nil
+}
+
+// connPool keeps connections to a service open and reuses them. The zero
+// value is an empty pool.
+type connPool struct {
+	mu   sync.Mutex
+	idle []*poolConn
+}
+
+// do calls f with an idle connection, or with a new one opened with dial.
+//
+// A kept-alive connection may have been closed by the server, so if f fails
+// with a reused connection, it is called again once with a new connection.
+// The connection is returned to the pool if f succeeds, and closed otherwise.
+// Errors returned by dial are returned as-is.
+func (p *connPool) do(dial func() (*poolConn, error), f func(c *poolConn) error) error {
+	for attempt := 0; ; attempt++ {
+		c, reused, err := p.get(dial)
+		if err != nil {
+			return err
+		}
+		if err := f(c); err != nil {
+			c.Close()
+			if reused && attempt == 0 {
+				continue
+			}
+			return err
+		}
+		p.put(c)
+		return nil
+	}
+}
+
+func (p *connPool) get(dial func() (*poolConn, error)) (c *poolConn, reused bool, err error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		c = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, true, nil
+	}
+	p.mu.Unlock()
+
+	c, err = dial()
+	return c, false, err
+}
+
+func (p *connPool) put(c *poolConn) {
+	c.SetDeadline(time.Time{})
+	p.mu.Lock()
+	p.idle = append(p.idle, c)
+	p.mu.Unlock()
+}
+
+// Close closes the idle connections.
+func (p *connPool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package backendutil
+
+import (
+	"bufio"
+	"io"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ContentRouterBackend is a backend choosing the backend of each message from
+// its header, for instance to route messages by subject or mailing list.
+//
+// The sender and recipients are first checked by Default, so that invalid
+// ones are rejected before DATA. When the message header has been received,
+// Route picks the backend the message is delivered to. If it isn't Default,
+// a session is opened on that backend with the credentials of the client and
+// the transaction is replayed on it. Only the header is buffered, the body is
+// streamed to the chosen backend.
+type ContentRouterBackend struct {
+	Default smtp.Backend
+	// Route returns the backend of a message. If it returns nil, the message
+	// is delivered to Default.
+	Route func(from string, to []string, header mail.Header) (smtp.Backend, error)
+}
+
+// Login implements the smtp.Backend interface.
+func (be *ContentRouterBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	s, err := be.Default.Login(state, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &contentRouterSession{
+		Session:  s,
+		be:       be,
+		state:    state,
+		username: username,
+		password: password,
+	}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *ContentRouterBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	s, err := be.Default.AnonymousLogin(state)
+	if err != nil {
+		return nil, err
+	}
+	return &contentRouterSession{Session: s, be: be, state: state}, nil
+}
+
+var errRouteFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Failed to route message",
+}
+
+type contentRouterSession struct {
+	smtp.Session
+
+	be                 *ContentRouterBackend
+	state              *smtp.ConnectionState
+	username, password string
+	from               string
+	to                 []string
+}
+
+func (s *contentRouterSession) Reset() {
+	s.from = ""
+	s.to = nil
+	s.Session.Reset()
+}
+
+func (s *contentRouterSession) Mail(from string) error {
+	s.from = ""
+	s.to = nil
+	if err := s.Session.Mail(from); err != nil {
+		return err
+	}
+	s.from = from
+	return nil
+}
+
+func (s *contentRouterSession) Rcpt(to string) error {
+	if err := s.Session.Rcpt(to); err != nil {
+		return err
+	}
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *contentRouterSession) Data(r io.Reader) error {
+	br := bufio.NewReader(r)
+	fields, eol, err := readHeaderFields(br)
+	if err != nil {
+		return err
+	}
+	raw := strings.Join(fields, "") + eol
+
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Malformed message header",
+		}
+	}
+	target, err := s.be.Route(s.from, s.to, msg.Header)
+	if err != nil {
+		return errRouteFailed
+	}
+
+	msgReader := io.MultiReader(strings.NewReader(raw), br)
+	if target == nil || target == s.be.Default {
+		return s.Session.Data(msgReader)
+	}
+
+	// The transaction is moved to the target backend
+	s.Session.Reset()
+	return s.deliver(target, msgReader)
+}
+
+func (s *contentRouterSession) deliver(be smtp.Backend, r io.Reader) error {
+	var session smtp.Session
+	var err error
+	if s.username != "" {
+		session, err = be.Login(s.state, s.username, s.password)
+	} else {
+		session, err = be.AnonymousLogin(s.state)
+	}
+	if err != nil {
+		return err
+	}
+	defer session.Logout()
+
+	if err := session.Mail(s.from); err != nil {
+		return err
+	}
+	for _, to := range s.to {
+		if err := session.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	return session.Data(r)
+}
@@ -0,0 +1,78 @@
+package backendutil_test
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.ContentRouterBackend{}
+
+func TestContentRouterBackend(t *testing.T) {
+	inbox := &backendutil.MemoryBackend{
+		Auth:           backendutil.UserMap{"alice": "secret"}.Auth,
+		AllowAnonymous: true,
+	}
+	tickets := &backendutil.MemoryBackend{Auth: backendutil.UserMap{"alice": "secret"}.Auth}
+	be := &backendutil.ContentRouterBackend{
+		Default: inbox,
+		Route: func(from string, to []string, header mail.Header) (smtp.Backend, error) {
+			subject := header.Get("Subject")
+			switch {
+			case strings.HasPrefix(subject, "[Ticket]"):
+				return tickets, nil
+			case subject == "broken":
+				return nil, errors.New("routing table unavailable")
+			}
+			return nil, nil
+		},
+	}
+
+	s, err := be.Login(nil, "alice", "secret")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	send := func(data string) error {
+		if err := s.Mail("alice@example.org"); err != nil {
+			return err
+		}
+		if err := s.Rcpt("support@example.org"); err != nil {
+			return err
+		}
+		return s.Data(strings.NewReader(data))
+	}
+
+	ticket := "Subject: [Ticket] Printer on fire\r\n\r\nHelp!\r\n"
+	if err := send(ticket); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	if err := send("Subject: Hello\n\nHi!\n"); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	err = send("Subject: broken\n\nHi!\n")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 451 {
+		t.Errorf("Data: expected a 451 error, got %v", err)
+	}
+
+	msgs := tickets.Mailbox("support@example.org")
+	if len(msgs) != 1 || string(msgs[0].Data) != ticket || msgs[0].Username != "alice" {
+		t.Errorf("unexpected routed messages: %+v", msgs)
+	}
+	msgs = inbox.Mailbox("support@example.org")
+	if len(msgs) != 1 || string(msgs[0].Data) != "Subject: Hello\n\nHi!\n" {
+		t.Errorf("unexpected default messages: %+v", msgs)
+	}
+
+	// The routed backend doesn't accept anonymous clients
+	s, err = be.AnonymousLogin(nil)
+	if err != nil {
+		t.Fatalf("AnonymousLogin: %v", err)
+	}
+	if err := send(ticket); err != smtp.ErrAuthRequired {
+		t.Errorf("Data: expected ErrAuthRequired, got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package backendutil
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DelayedRejection is a message rejected after DATA because of a policy
+// failure detected earlier in the transaction.
+type DelayedRejection struct {
+	State *smtp.ConnectionState
+	From  string
+	To    []string
+	// The first deferred error, returned to the client.
+	Err *smtp.SMTPError
+	// The message data, truncated to MaxCaptureBytes.
+	Data      []byte
+	Truncated bool
+}
+
+// DelayRejectBackend is a backend deferring policy rejections of the sender
+// and recipients until the message has been received, so that evidence of
+// abuse can be collected before delivery is refused.
+//
+// Permanent errors returned by the wrapped backend for MAIL and RCPT commands
+// with a 5.7.x enhanced code, such as rejections by AccessBackend or
+// PolicyBackend, are remembered and the command is accepted. Other errors,
+// such as unknown recipients, are returned immediately. If an error was
+// deferred, the message is read and passed to Report, then rejected with the
+// first deferred error and never reaches the wrapped backend.
+type DelayRejectBackend struct {
+	Backend smtp.Backend
+	// If not nil, Defer replaces the default choice of deferred errors.
+	Defer func(err *smtp.SMTPError) bool
+	// Report is called with each rejected message. It may be nil.
+	Report func(r *DelayedRejection)
+	// The maximum number of bytes of rejected messages passed to Report. If
+	// zero, 1 MiB is used.
+	MaxCaptureBytes int64
+}
+
+// Login implements the smtp.Backend interface.
+func (be *DelayRejectBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	s, err := be.Backend.Login(state, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &delayRejectSession{Session: s, be: be, state: state}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *DelayRejectBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	s, err := be.Backend.AnonymousLogin(state)
+	if err != nil {
+		return nil, err
+	}
+	return &delayRejectSession{Session: s, be: be, state: state}, nil
+}
+
+func (be *DelayRejectBackend) deferred(err error) *smtp.SMTPError {
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		return nil
+	}
+	if be.Defer != nil {
+		if !be.Defer(smtpErr) {
+			return nil
+		}
+	} else if smtpErr.Code/100 != 5 || smtpErr.EnhancedCode[0] != 5 || smtpErr.EnhancedCode[1] != 7 {
+		return nil
+	}
+	return smtpErr
+}
+
+type delayRejectSession struct {
+	smtp.Session
+
+	be    *DelayRejectBackend
+	state *smtp.ConnectionState
+	from  string
+	to    []string
+	// The first deferred error of the transaction
+	err *smtp.SMTPError
+	// Whether the wrapped session accepted the sender
+	started bool
+}
+
+func (s *delayRejectSession) Reset() {
+	s.from = ""
+	s.to = nil
+	s.err = nil
+	s.started = false
+	s.Session.Reset()
+}
+
+func (s *delayRejectSession) Mail(from string) error {
+	s.from = from
+	s.to = nil
+	s.err = nil
+	s.started = false
+	if err := s.Session.Mail(from); err != nil {
+		if s.err = s.be.deferred(err); s.err == nil {
+			return err
+		}
+		return nil
+	}
+	s.started = true
+	return nil
+}
+
+func (s *delayRejectSession) Rcpt(to string) error {
+	if s.started {
+		if err := s.Session.Rcpt(to); err != nil {
+			deferred := s.be.deferred(err)
+			if deferred == nil {
+				return err
+			}
+			if s.err == nil {
+				s.err = deferred
+			}
+		}
+	}
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *delayRejectSession) Data(r io.Reader) error {
+	if s.err == nil {
+		return s.Session.Data(r)
+	}
+
+	max := s.be.MaxCaptureBytes
+	if max == 0 {
+		max = 1024 * 1024
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, max))
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return err
+	}
+
+	if s.started {
+		// Abort the transaction of the wrapped session
+		s.Session.Reset()
+		s.started = false
+	}
+	if s.be.Report != nil {
+		s.be.Report(&DelayedRejection{
+			State:     s.state,
+			From:      s.from,
+			To:        s.to,
+			Err:       s.err,
+			Data:      data,
+			Truncated: n > 0,
+		})
+	}
+	return s.err
+}
@@ -0,0 +1,77 @@
+package backendutil_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.DelayRejectBackend{}
+
+func TestDelayRejectBackend(t *testing.T) {
+	inbox := &backendutil.MemoryBackend{AllowAnonymous: true}
+	var reports []*backendutil.DelayedRejection
+	be := &backendutil.DelayRejectBackend{
+		Backend: &backendutil.AccessBackend{
+			Backend: inbox,
+			Senders: backendutil.MapTable{"spammer.example": "REJECT"},
+			Recipients: backendutil.MapTable{
+				"nobody@example.org": "550 5.1.1 No such user",
+				"trap@example.org":   "REJECT Spam trap",
+			},
+		},
+		Report: func(r *backendutil.DelayedRejection) {
+			reports = append(reports, r)
+		},
+		MaxCaptureBytes: 32,
+	}
+
+	s, err := be.AnonymousLogin(nil)
+	if err != nil {
+		t.Fatalf("AnonymousLogin: %v", err)
+	}
+	send := func(from string, to []string, data string) error {
+		if err := s.Mail(from); err != nil {
+			return err
+		}
+		for _, addr := range to {
+			if err := s.Rcpt(addr); err != nil {
+				return err
+			}
+		}
+		return s.Data(strings.NewReader(data))
+	}
+	expectCode := func(err error, code int) {
+		t.Helper()
+		if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != code {
+			t.Errorf("expected a %v error, got %v", code, err)
+		}
+	}
+
+	err = send("alice@spammer.example", []string{"bob@example.org"}, "Subject: Hi\n\nBuy now!\n")
+	expectCode(err, 554)
+	if len(reports) != 1 || reports[0].From != "alice@spammer.example" || string(reports[0].Data) != "Subject: Hi\n\nBuy now!\n" || reports[0].Truncated {
+		t.Errorf("unexpected reports: %+v", reports)
+	}
+
+	// Unknown recipients are still rejected immediately
+	err = send("carol@example.org", []string{"nobody@example.org"}, "")
+	expectCode(err, 550)
+	s.Reset()
+
+	long := "Subject: Hi\n\n" + strings.Repeat("Buy now! ", 10) + "\n"
+	err = send("carol@example.org", []string{"bob@example.org", "trap@example.org"}, long)
+	expectCode(err, 554)
+	if len(reports) != 2 || reports[1].Err.Message != "Spam trap" || len(reports[1].To) != 2 || string(reports[1].Data) != long[:32] || !reports[1].Truncated {
+		t.Errorf("unexpected reports: %+v", reports[1:])
+	}
+
+	if err := send("carol@example.org", []string{"bob@example.org"}, "Subject: Hi\n\nHello\n"); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	if msgs := inbox.Mailbox("bob@example.org"); len(msgs) != 1 || string(msgs[0].Data) != "Subject: Hi\n\nHello\n" {
+		t.Errorf("unexpected delivered messages: %+v", msgs)
+	}
+}
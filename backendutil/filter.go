@@ -0,0 +1,221 @@
+package backendutil
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/mail"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/sieve"
+)
+
+// MailboxSession is implemented by sessions able to deliver messages into a
+// specific mailbox of a recipient, for instance a Maildir++ folder.
+type MailboxSession interface {
+	smtp.Session
+
+	// RcptMailbox adds a recipient whose copy of the message is delivered
+	// into mailbox.
+	RcptMailbox(to, mailbox string) error
+}
+
+// FilterBackend is a backend running a Sieve script for each recipient before
+// passing the message to the underlying backend.
+//
+// Kept messages are delivered to the underlying session. Messages filed into
+// a mailbox are delivered with RcptMailbox if the underlying session
+// implements MailboxSession, and kept otherwise. Since a message can only be
+// refused as a whole after DATA, rejections only take effect if all the
+// recipients reject the message.
+//
+// If Quarantine is set, copies of the message rejected or discarded by the
+// script of a recipient are stored there instead of being dropped.
+type FilterBackend struct {
+	Backend smtp.Backend
+	// Script returns the script to run for a recipient, or nil if the message
+	// must be kept.
+	Script func(rcpt string) (*sieve.Script, error)
+	// Redirect forwards a message to another address. If nil, redirect
+	// actions keep the message instead.
+	Redirect func(from, to string, r io.Reader) error
+	// Quarantine stores the copies of messages which aren't delivered. It
+	// may be nil.
+	Quarantine Quarantine
+}
+
+// Login implements the smtp.Backend interface.
+func (be *FilterBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	s, err := be.Backend.Login(state, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &filterSession{Session: s, be: be, state: state}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *FilterBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	s, err := be.Backend.AnonymousLogin(state)
+	if err != nil {
+		return nil, err
+	}
+	return &filterSession{Session: s, be: be, state: state}, nil
+}
+
+type filterDelivery struct {
+	rcpt, mailbox string
+}
+
+type filterSession struct {
+	smtp.Session
+
+	be    *FilterBackend
+	state *smtp.ConnectionState
+	from  string
+	to    []string
+}
+
+func (s *filterSession) Reset() {
+	s.from = ""
+	s.to = nil
+	s.Session.Reset()
+}
+
+func (s *filterSession) Mail(from string) error {
+	s.from = ""
+	s.to = nil
+	if err := s.Session.Mail(from); err != nil {
+		return err
+	}
+	s.from = from
+	return nil
+}
+
+func (s *filterSession) Rcpt(to string) error {
+	if err := s.Session.Rcpt(to); err != nil {
+		return err
+	}
+	s.to = append(s.to, to)
+	return nil
+}
+
+var errFilterFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Failed to filter message",
+}
+
+func (s *filterSession) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var header mail.Header
+	if msg, err := mail.ReadMessage(bytes.NewReader(b)); err == nil {
+		header = msg.Header
+	}
+
+	var deliveries []filterDelivery
+	var redirects []string
+	var reject string
+	var verdicts []string
+	dropped := make(map[string][]string)
+	rejected := 0
+	changed := false
+	for _, rcpt := range s.to {
+		script, err := s.be.Script(rcpt)
+		if err != nil {
+			return errFilterFailed
+		}
+		if script == nil {
+			deliveries = append(deliveries, filterDelivery{rcpt: rcpt})
+			continue
+		}
+
+		actions := script.Execute(&sieve.Message{
+			From:   s.from,
+			To:     rcpt,
+			Header: header,
+			Size:   int64(len(b)),
+		})
+		verdict := ""
+		for _, action := range actions {
+			switch action.Type {
+			case sieve.ActionKeep:
+				deliveries = append(deliveries, filterDelivery{rcpt: rcpt})
+				continue
+			case sieve.ActionFileInto:
+				deliveries = append(deliveries, filterDelivery{rcpt, action.Mailbox})
+			case sieve.ActionRedirect:
+				if s.be.Redirect == nil {
+					deliveries = append(deliveries, filterDelivery{rcpt: rcpt})
+				} else {
+					redirects = append(redirects, action.Address)
+				}
+			case sieve.ActionReject:
+				rejected++
+				reject = action.Reason
+				verdict = "sieve: reject: " + action.Reason
+			}
+			changed = true
+		}
+		if len(actions) == 1 && actions[0].Type == sieve.ActionDiscard {
+			changed = true
+			verdict = "sieve: discard"
+		}
+		if verdict != "" {
+			if _, ok := dropped[verdict]; !ok {
+				verdicts = append(verdicts, verdict)
+			}
+			dropped[verdict] = append(dropped[verdict], rcpt)
+		}
+	}
+
+	if s.be.Quarantine != nil {
+		for _, verdict := range verdicts {
+			msg := newQuarantinedMessage(s.state, s.from, dropped[verdict], verdict, b)
+			if err := s.be.Quarantine.Put(msg); err != nil {
+				return errFilterFailed
+			}
+		}
+	}
+
+	if rejected == len(s.to) {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      reject,
+		}
+	}
+
+	for _, to := range redirects {
+		if err := s.be.Redirect(s.from, to, bytes.NewReader(b)); err != nil {
+			return errFilterFailed
+		}
+	}
+
+	if !changed {
+		return s.Session.Data(bytes.NewReader(b))
+	}
+
+	// Start a new transaction with the filtered recipients
+	s.Session.Reset()
+	if len(deliveries) == 0 {
+		return nil
+	}
+	if err := s.Session.Mail(s.from); err != nil {
+		return err
+	}
+	mboxSession, _ := s.Session.(MailboxSession)
+	for _, d := range deliveries {
+		if d.mailbox != "" && mboxSession != nil {
+			err = mboxSession.RcptMailbox(d.rcpt, d.mailbox)
+		} else {
+			err = s.Session.Rcpt(d.rcpt)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return s.Session.Data(bytes.NewReader(b))
+}
@@ -0,0 +1,82 @@
+package backendutil_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+	"github.com/emersion/go-smtp/sieve"
+)
+
+var _ smtp.Backend = &backendutil.FilterBackend{}
+
+func TestFilterBackend(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-smtp-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	script, err := sieve.Parse(`require ["fileinto", "reject"];
+if header :contains "Subject" "[SPAM]" {
+	fileinto "Junk";
+} elsif header :is "Subject" "Forward" {
+	redirect "carol@example.net";
+} elsif header :is "Subject" "Reject" {
+	reject "Not welcome here";
+}`)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	var redirected []string
+	be := &backendutil.FilterBackend{
+		Backend: &backendutil.MaildirBackend{Root: root, AllowAnonymous: true},
+		Script: func(rcpt string) (*sieve.Script, error) {
+			if rcpt == "bob@example.org" {
+				return script, nil
+			}
+			return nil, nil
+		},
+		Redirect: func(from, to string, r io.Reader) error {
+			redirected = append(redirected, to)
+			return nil
+		},
+	}
+
+	count := func(rcpt, folder string) int {
+		files, _ := ioutil.ReadDir(filepath.Join(root, rcpt, folder, "new"))
+		return len(files)
+	}
+
+	to := []string{"alice@example.org", "bob@example.org"}
+	if err := sendMessage(t, be, "eve@example.com", to, "Subject: [SPAM] Hi\n\nBuy now!\n"); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	if count("alice@example.org", "") != 1 || count("bob@example.org", ".Junk") != 1 || count("bob@example.org", "") != 0 {
+		t.Error("message not filed into the expected folders")
+	}
+
+	if err := sendMessage(t, be, "eve@example.com", []string{"bob@example.org"}, "Subject: Forward\n\nHi\n"); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	if len(redirected) != 1 || redirected[0] != "carol@example.net" || count("bob@example.org", "") != 0 {
+		t.Errorf("message not redirected: %v", redirected)
+	}
+
+	err = sendMessage(t, be, "eve@example.com", []string{"bob@example.org"}, "Subject: Reject\n\nHi\n")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 550 || smtpErr.Message != "Not welcome here" {
+		t.Errorf("Data: expected rejection, got %v", err)
+	}
+
+	if err := sendMessage(t, be, "eve@example.com", to, "Subject: Hello\n\nHi\n"); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	if count("alice@example.org", "") != 2 || count("bob@example.org", "") != 1 {
+		t.Error("message not kept")
+	}
+}
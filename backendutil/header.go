@@ -0,0 +1,268 @@
+package backendutil
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// maxHeaderBytes is the maximum size of a message header transformed by a
+// HeaderPipeline.
+const maxHeaderBytes = 1 << 20
+
+var errHeaderTooLarge = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+	Message:      "Message header too large",
+}
+
+// HeaderField is a message header field.
+type HeaderField struct {
+	Name, Value string
+}
+
+// HeaderRewrite replaces the matches of a regular expression in the values of
+// a header field. Replacement can refer to submatches, see
+// regexp.Regexp.ReplaceAllString.
+type HeaderRewrite struct {
+	Name        string
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// HeaderPipeline transforms the header of messages. Fields are removed first,
+// then rewritten and masked, then fields are added at the end of the header.
+//
+// Only the header is buffered, the body is streamed. Transform can be used as
+// TransformBackend.TransformData.
+type HeaderPipeline struct {
+	// Names of the header fields to remove, case-insensitive.
+	Remove  []string
+	Rewrite []HeaderRewrite
+	// If set, internal IP addresses in Received header fields are replaced
+	// with "masked".
+	MaskReceived bool
+	// The internal networks masked in Received header fields. If nil,
+	// private, loopback and link-local addresses are masked.
+	InternalNetworks []*net.IPNet
+	Add              []HeaderField
+	// Disclaimer is a text appended to the body of messages. It is only
+	// appended to single-part text messages which aren't base64 or
+	// quoted-printable encoded, other messages are left unchanged.
+	Disclaimer string
+}
+
+// Transform transforms a message.
+func (p *HeaderPipeline) Transform(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	fields, eol, err := readHeaderFields(br)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, field := range fields {
+		name := fieldName(field)
+		if p.removed(name) {
+			continue
+		}
+		for _, rw := range p.Rewrite {
+			if strings.EqualFold(rw.Name, name) {
+				field = name + ":" + rw.Pattern.ReplaceAllString(field[len(name)+1:], rw.Replacement)
+			}
+		}
+		if p.MaskReceived && strings.EqualFold(name, "Received") {
+			field = p.maskReceived(field)
+		}
+		out = append(out, field)
+	}
+	for _, f := range p.Add {
+		out = append(out, f.Name+": "+f.Value+eol)
+	}
+
+	var header bytes.Buffer
+	for _, field := range out {
+		header.WriteString(field)
+	}
+	header.WriteString(eol)
+
+	var body io.Reader = br
+	if p.Disclaimer != "" && disclaimable(fields) {
+		body = &disclaimerReader{r: br, disclaimer: strings.Replace(p.Disclaimer, "\n", eol, -1), eol: eol}
+	}
+	return io.MultiReader(&header, body), nil
+}
+
+func (p *HeaderPipeline) removed(name string) bool {
+	for _, k := range p.Remove {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *HeaderPipeline) internal(ip net.IP) bool {
+	if p.InternalNetworks == nil {
+		return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+	}
+	for _, n := range p.InternalNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func isAddrDelim(r rune) bool {
+	switch r {
+	case ' ', '\t', '\r', '\n', '[', ']', '(', ')', ';', '=', ',':
+		return true
+	}
+	return false
+}
+
+// maskReceived masks the internal IP addresses of a Received header field.
+func (p *HeaderPipeline) maskReceived(field string) string {
+	var sb strings.Builder
+	for len(field) > 0 {
+		i := strings.IndexFunc(field, func(r rune) bool { return !isAddrDelim(r) })
+		if i < 0 {
+			sb.WriteString(field)
+			break
+		}
+		sb.WriteString(field[:i])
+		field = field[i:]
+
+		j := strings.IndexFunc(field, isAddrDelim)
+		if j < 0 {
+			j = len(field)
+		}
+		token := field[:j]
+		field = field[j:]
+
+		addr := token
+		if len(addr) > 5 && strings.EqualFold(addr[:5], "IPv6:") {
+			addr = addr[5:]
+		}
+		if ip := net.ParseIP(addr); ip != nil && p.internal(ip) {
+			token = "masked"
+		}
+		sb.WriteString(token)
+	}
+	return sb.String()
+}
+
+// readHeaderFields reads a message header, up to and including the empty
+// line separating it from the body. Each field includes its continuation
+// lines and line endings. The line ending of the message is returned as well.
+func readHeaderFields(br *bufio.Reader) (fields []string, eol string, err error) {
+	eol = "\r\n"
+	n := 0
+	for i := 0; ; i++ {
+		line, err := br.ReadString('\n')
+		n += len(line)
+		if n > maxHeaderBytes {
+			return nil, "", errHeaderTooLarge
+		}
+		if i == 0 && line != "" && !strings.HasSuffix(line, "\r\n") {
+			eol = "\n"
+		}
+		if line == "\r\n" || line == "\n" {
+			break
+		}
+		if line != "" {
+			if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+				fields[len(fields)-1] += line
+			} else {
+				if !strings.HasSuffix(line, "\n") {
+					line += eol
+				}
+				fields = append(fields, line)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+	}
+	return fields, eol, nil
+}
+
+// fieldName returns the name of a header field.
+func fieldName(field string) string {
+	if i := strings.IndexByte(field, ':'); i >= 0 {
+		return strings.TrimRight(field[:i], " \t")
+	}
+	return strings.TrimRight(field, "\r\n")
+}
+
+// fieldValue returns the unfolded value of a header field.
+func fieldValue(field string) string {
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(field[i+1:]))
+}
+
+// disclaimable reports whether a disclaimer can be appended to the body of a
+// message.
+func disclaimable(fields []string) bool {
+	for _, field := range fields {
+		value := strings.ToLower(fieldValue(field))
+		switch strings.ToLower(fieldName(field)) {
+		case "content-type":
+			if !strings.HasPrefix(value, "text/plain") {
+				return false
+			}
+		case "content-transfer-encoding":
+			if value != "7bit" && value != "8bit" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// disclaimerReader appends a disclaimer to a message body, on its own line.
+type disclaimerReader struct {
+	r          io.Reader
+	disclaimer string
+	eol        string
+
+	last byte
+	tail io.Reader
+}
+
+func (dr *disclaimerReader) Read(p []byte) (int, error) {
+	if dr.tail != nil {
+		return dr.tail.Read(p)
+	}
+
+	n, err := dr.r.Read(p)
+	if n > 0 {
+		dr.last = p[n-1]
+	}
+	if err == io.EOF {
+		tail := dr.disclaimer
+		if dr.last != 0 && dr.last != '\n' {
+			tail = dr.eol + tail
+		}
+		if !strings.HasSuffix(tail, "\n") {
+			tail += dr.eol
+		}
+		dr.tail = strings.NewReader(tail)
+		if n > 0 {
+			return n, nil
+		}
+		return dr.tail.Read(p)
+	}
+	return n, err
+}
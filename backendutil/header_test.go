@@ -0,0 +1,87 @@
+package backendutil_test
+
+import (
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+func transformHeader(t *testing.T, p *backendutil.HeaderPipeline, msg string) string {
+	t.Helper()
+
+	r, err := p.Transform(strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("Transform: %v", err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	return string(b)
+}
+
+func TestHeaderPipeline(t *testing.T) {
+	p := &backendutil.HeaderPipeline{
+		Remove: []string{"x-mailer"},
+		Rewrite: []backendutil.HeaderRewrite{{
+			Name:        "Subject",
+			Pattern:     regexp.MustCompile(`\[SPAM\] *`),
+			Replacement: "",
+		}},
+		MaskReceived: true,
+		Add:          []backendutil.HeaderField{{"X-Relayed-By", "mx.example.org"}},
+		Disclaimer:   "--\nSent through example.org",
+	}
+
+	msg := "Received: from laptop ([192.168.1.10])\n" +
+		"\tby mx.example.org ([203.0.113.1]); Mon, 1 Jan 2024 00:00:00 +0000\n" +
+		"Received: from [IPv6:fd00::1] by relay.example.org\n" +
+		"X-Mailer: Foo 1.0\n" +
+		"Subject: [SPAM] Hello\n" +
+		"\n" +
+		"Hi!"
+	want := "Received: from laptop ([masked])\n" +
+		"\tby mx.example.org ([203.0.113.1]); Mon, 1 Jan 2024 00:00:00 +0000\n" +
+		"Received: from [masked] by relay.example.org\n" +
+		"Subject: Hello\n" +
+		"X-Relayed-By: mx.example.org\n" +
+		"\n" +
+		"Hi!\n" +
+		"--\n" +
+		"Sent through example.org\n"
+	if got := transformHeader(t, p, msg); got != want {
+		t.Errorf("Transform:\ngot:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestHeaderPipeline_internalNetworks(t *testing.T) {
+	_, n, _ := net.ParseCIDR("203.0.113.0/24")
+	p := &backendutil.HeaderPipeline{
+		MaskReceived:     true,
+		InternalNetworks: []*net.IPNet{n},
+	}
+	msg := "Received: from a (10.0.0.1) by b (203.0.113.7)\r\n\r\nHi!\r\n"
+	want := "Received: from a (10.0.0.1) by b (masked)\r\n\r\nHi!\r\n"
+	if got := transformHeader(t, p, msg); got != want {
+		t.Errorf("Transform: got %q, want %q", got, want)
+	}
+}
+
+func TestHeaderPipeline_disclaimer(t *testing.T) {
+	p := &backendutil.HeaderPipeline{Disclaimer: "Confidential"}
+
+	msg := "Content-Type: multipart/mixed; boundary=x\r\n\r\n--x\r\n\r\nHi!\r\n--x--\r\n"
+	if got := transformHeader(t, p, msg); got != msg {
+		t.Errorf("Transform: multipart message modified: %q", got)
+	}
+
+	msg = "Content-Type: text/plain; charset=utf-8\r\n\r\nHi!\r\n"
+	want := msg + "Confidential\r\n"
+	if got := transformHeader(t, p, msg); got != want {
+		t.Errorf("Transform: got %q, want %q", got, want)
+	}
+}
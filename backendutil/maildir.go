@@ -0,0 +1,286 @@
+package backendutil
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// MaildirBackend is a backend delivering messages into Maildir directories,
+// one per recipient.
+//
+// Messages are first written into the tmp directory, then atomically moved
+// into the new directory. Return-Path and Received header fields are
+// prepended to each message.
+type MaildirBackend struct {
+	// Root is the directory containing the recipients' Maildirs. It is used if
+	// Dir is nil.
+	Root string
+	// Dir returns the Maildir path for a recipient. An error rejects the
+	// recipient. If nil, the lower-cased address under Root is used.
+	Dir func(rcpt string) (string, error)
+	// The host name used in Received header fields and delivered file names.
+	// If empty, os.Hostname is used.
+	Hostname string
+
+	// Auth checks credentials, e.g. UserMap.Auth. If nil, authentication is
+	// not supported.
+	Auth func(username, password string) error
+	// If set, clients can send mail without authenticating.
+	AllowAnonymous bool
+}
+
+// Login implements the smtp.Backend interface.
+func (be *MaildirBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if err := login(be.Auth, username, password); err != nil {
+		return nil, err
+	}
+	return &maildirSession{be: be, state: state, username: username}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *MaildirBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	if !be.AllowAnonymous {
+		return nil, smtp.ErrAuthRequired
+	}
+	return &maildirSession{be: be, state: state}, nil
+}
+
+func (be *MaildirBackend) hostname() string {
+	if be.Hostname != "" {
+		return be.Hostname
+	}
+	if name, err := os.Hostname(); err == nil {
+		return name
+	}
+	return "localhost"
+}
+
+func (be *MaildirBackend) dir(rcpt string) (string, error) {
+	if be.Dir != nil {
+		return be.Dir(rcpt)
+	}
+	name := strings.ToLower(rcpt)
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\\x00") {
+		return "", fmt.Errorf("backendutil: invalid recipient %q", rcpt)
+	}
+	return filepath.Join(be.Root, name), nil
+}
+
+var errNoSuchMailbox = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "No such mailbox",
+}
+
+var maildirCounter uint64
+
+// maildirFilename returns a unique file name for a new message, as described
+// in https://cr.yp.to/proto/maildir.html.
+func maildirFilename(hostname string) string {
+	now := time.Now()
+	n := atomic.AddUint64(&maildirCounter, 1)
+	hostname = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(hostname)
+	return fmt.Sprintf("%v.M%vP%vQ%v.%v", now.Unix(), now.Nanosecond()/1000, os.Getpid(), n, hostname)
+}
+
+// writeMaildirTmp writes a message into the tmp directory of a Maildir,
+// creating it if necessary, and returns the path of the written file.
+func writeMaildirTmp(dir, filename string, header, body []byte) (string, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return "", err
+		}
+	}
+
+	tmpPath := filepath.Join(dir, "tmp", filename)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(header)
+	if err == nil {
+		_, err = f.Write(body)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+type maildirRcpt struct {
+	addr, dir string
+}
+
+type maildirSession struct {
+	be       *MaildirBackend
+	state    *smtp.ConnectionState
+	username string
+	tx       *smtp.Transaction
+	from     string
+	to       []maildirRcpt
+}
+
+func (s *maildirSession) BeginTransaction(tx *smtp.Transaction) {
+	s.tx = tx
+}
+
+func (s *maildirSession) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *maildirSession) Logout() error {
+	return nil
+}
+
+func (s *maildirSession) Mail(from string) error {
+	s.Reset()
+	s.from = from
+	return nil
+}
+
+func (s *maildirSession) Rcpt(to string) error {
+	dir, err := s.be.dir(to)
+	if err != nil {
+		return errNoSuchMailbox
+	}
+	s.to = append(s.to, maildirRcpt{to, dir})
+	return nil
+}
+
+// RcptMailbox implements MailboxSession. Mailboxes are Maildir++ folders,
+// hierarchy levels are separated with "/". Invalid mailbox names fall back to
+// the inbox.
+func (s *maildirSession) RcptMailbox(to, mailbox string) error {
+	dir, err := s.be.dir(to)
+	if err != nil {
+		return errNoSuchMailbox
+	}
+	if folder, ok := maildirFolder(mailbox); ok {
+		dir = filepath.Join(dir, folder)
+	}
+	s.to = append(s.to, maildirRcpt{to, dir})
+	return nil
+}
+
+// maildirFolder returns the Maildir++ folder name for a mailbox.
+func maildirFolder(mailbox string) (string, bool) {
+	if mailbox == "" || strings.EqualFold(mailbox, "INBOX") {
+		return "", false
+	}
+	name := strings.Replace(mailbox, "/", ".", -1)
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") || strings.Contains(name, "..") || strings.ContainsAny(name, "\\\x00") {
+		return "", false
+	}
+	return "." + name, true
+}
+
+// received formats a Received header field for a recipient.
+func (s *maildirSession) received(hostname, rcpt string, now time.Time) string {
+	var from, addr string
+	if s.state != nil {
+		from = s.state.Hostname
+		if s.state.RemoteAddr != nil {
+			addr = s.state.RemoteAddr.String()
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				addr = host
+			}
+		}
+	}
+	if from == "" {
+		from = "unknown"
+	}
+
+	with := "ESMTP"
+	if s.state != nil && s.state.TLS.HandshakeComplete {
+		with += "S"
+	}
+	if s.username != "" {
+		with += "A"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Received: from %v", from)
+	if addr != "" {
+		fmt.Fprintf(&b, " ([%v])", addr)
+	}
+	fmt.Fprintf(&b, "\n\tby %v with %v", hostname, with)
+	if s.tx != nil {
+		fmt.Fprintf(&b, " id %v", s.tx.ID)
+	}
+	fmt.Fprintf(&b, "\n\tfor <%v>; %v\n", rcpt, now.Format(time.RFC1123Z))
+	return b.String()
+}
+
+// Data delivers the message to all recipients, or to none of them: it is
+// first written into the tmp directory of every Maildir, and only moved into
+// the new directories once all writes succeeded. Otherwise, a client retrying
+// after an error would deliver duplicates to the first recipients.
+func (s *maildirSession) Data(r io.Reader) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	hostname := s.be.hostname()
+	now := time.Now()
+	tmpPaths := make([]string, 0, len(s.to))
+	filenames := make([]string, 0, len(s.to))
+	for _, rcpt := range s.to {
+		var header bytes.Buffer
+		fmt.Fprintf(&header, "Return-Path: <%v>\n", s.from)
+		header.WriteString(s.received(hostname, rcpt.addr, now))
+
+		filename := maildirFilename(hostname)
+		tmpPath, err := writeMaildirTmp(rcpt.dir, filename, header.Bytes(), body)
+		if err != nil {
+			for _, p := range tmpPaths {
+				os.Remove(p)
+			}
+			return maildirError(rcpt.addr)
+		}
+		tmpPaths = append(tmpPaths, tmpPath)
+		filenames = append(filenames, filename)
+	}
+
+	// Renaming within a directory tree doesn't fail in practice, keep going
+	// to deliver to as many recipients as possible if it does
+	var failed string
+	for i, rcpt := range s.to {
+		if err := os.Rename(tmpPaths[i], filepath.Join(rcpt.dir, "new", filenames[i])); err != nil {
+			os.Remove(tmpPaths[i])
+			if failed == "" {
+				failed = rcpt.addr
+			}
+		}
+	}
+	if failed != "" {
+		return maildirError(failed)
+	}
+	return nil
+}
+
+func maildirError(rcpt string) error {
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Failed to deliver message to <" + rcpt + ">",
+	}
+}
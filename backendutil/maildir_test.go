@@ -0,0 +1,125 @@
+package backendutil_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.MaildirBackend{}
+
+func TestMaildirBackend(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-smtp-maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	be := &backendutil.MaildirBackend{
+		Root:           root,
+		Hostname:       "mx.example.org",
+		AllowAnonymous: true,
+	}
+
+	state := &smtp.ConnectionState{
+		Hostname:   "client.example.net",
+		RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4242},
+	}
+	s, err := be.AnonymousLogin(state)
+	if err != nil {
+		t.Fatalf("AnonymousLogin: %v", err)
+	}
+	s.(smtp.TransactionSession).BeginTransaction(&smtp.Transaction{ID: "0123456789abcdef"})
+	if err := s.Mail("alice@example.net"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := s.Rcpt("../etc"); err == nil {
+		t.Error("Rcpt: expected error for invalid recipient")
+	}
+	if err := s.Rcpt("Bob@example.org"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	if err := s.Data(strings.NewReader("Subject: Hi\n\nHello Bob!\n")); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+
+	dir := filepath.Join(root, "bob@example.org")
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "tmp")); len(files) != 0 {
+		t.Errorf("tmp: expected no files, got %v", len(files))
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("new: expected 1 file, got %v", len(files))
+	}
+	if !strings.HasSuffix(files[0].Name(), ".mx.example.org") {
+		t.Errorf("unexpected file name %q", files[0].Name())
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "new", files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(b)
+	if !strings.HasPrefix(msg, "Return-Path: <alice@example.net>\nReceived: from client.example.net ([192.0.2.1])\n\tby mx.example.org with ESMTP id 0123456789abcdef\n\tfor <Bob@example.org>; ") {
+		t.Errorf("unexpected message header:\n%v", msg)
+	}
+	if !strings.HasSuffix(msg, "\nSubject: Hi\n\nHello Bob!\n") {
+		t.Errorf("unexpected message body:\n%v", msg)
+	}
+}
+
+func TestMaildirBackend_partialFailure(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-smtp-maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// A Maildir can't be created under a regular file
+	if err := ioutil.WriteFile(filepath.Join(root, "file"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	be := &backendutil.MaildirBackend{
+		Dir: func(rcpt string) (string, error) {
+			if rcpt == "broken@example.org" {
+				return filepath.Join(root, "file", "broken"), nil
+			}
+			return filepath.Join(root, rcpt), nil
+		},
+		Hostname:       "mx.example.org",
+		AllowAnonymous: true,
+	}
+
+	s, err := be.AnonymousLogin(&smtp.ConnectionState{})
+	if err != nil {
+		t.Fatalf("AnonymousLogin: %v", err)
+	}
+	if err := s.Mail("alice@example.net"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	for _, rcpt := range []string{"bob@example.org", "broken@example.org"} {
+		if err := s.Rcpt(rcpt); err != nil {
+			t.Fatalf("Rcpt(%q): %v", rcpt, err)
+		}
+	}
+	err = s.Data(strings.NewReader("Subject: Hi\n\nHello!\n"))
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 451 {
+		t.Fatalf("Data: expected a 451 error, got %v", err)
+	}
+
+	// Nothing is delivered, so that the client can retry
+	for _, sub := range []string{"tmp", "new"} {
+		if files, _ := ioutil.ReadDir(filepath.Join(root, "bob@example.org", sub)); len(files) != 0 {
+			t.Errorf("%v: expected no files, got %v", sub, len(files))
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package backendutil
+
+import (
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// MemoryMessage is a message stored by a MemoryBackend.
+type MemoryMessage struct {
+	// The user who sent the message, empty for anonymous sessions.
+	Username string
+	From     string
+	To       []string
+	Data     []byte
+	Received time.Time
+}
+
+// MemoryBackend is a backend storing messages in memory, in one mailbox per
+// recipient address. It is meant to be used in examples, tests and
+// prototypes.
+type MemoryBackend struct {
+	// Auth checks credentials, e.g. UserMap.Auth. If nil, authentication is
+	// not supported.
+	Auth func(username, password string) error
+	// If set, clients can send mail without authenticating.
+	AllowAnonymous bool
+	// The maximum size of a message, in bytes. Zero means no limit.
+	MaxMessageBytes int64
+	// The maximum total size of a mailbox, in bytes. Zero means no limit.
+	MaxMailboxBytes int64
+
+	mu        sync.Mutex
+	mailboxes map[string][]*MemoryMessage
+}
+
+// Login implements the smtp.Backend interface.
+func (be *MemoryBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if err := login(be.Auth, username, password); err != nil {
+		return nil, err
+	}
+	return &memorySession{be: be, username: username}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *MemoryBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	if !be.AllowAnonymous {
+		return nil, smtp.ErrAuthRequired
+	}
+	return &memorySession{be: be}, nil
+}
+
+// Mailbox returns the messages delivered to an address.
+func (be *MemoryBackend) Mailbox(addr string) []*MemoryMessage {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	return append([]*MemoryMessage(nil), be.mailboxes[mailboxKey(addr)]...)
+}
+
+// Mailboxes returns the sorted list of addresses which received messages.
+func (be *MemoryBackend) Mailboxes() []string {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	l := make([]string, 0, len(be.mailboxes))
+	for addr := range be.mailboxes {
+		l = append(l, addr)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// Clear removes all messages from all mailboxes.
+func (be *MemoryBackend) Clear() {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	be.mailboxes = nil
+}
+
+func (be *MemoryBackend) mailboxSize(addr string) int64 {
+	var n int64
+	for _, msg := range be.mailboxes[addr] {
+		n += int64(len(msg.Data))
+	}
+	return n
+}
+
+func (be *MemoryBackend) deliver(msg *MemoryMessage) error {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	if be.MaxMailboxBytes > 0 {
+		for _, to := range msg.To {
+			if be.mailboxSize(to)+int64(len(msg.Data)) > be.MaxMailboxBytes {
+				return smtp.ErrMailboxFull
+			}
+		}
+	}
+
+	if be.mailboxes == nil {
+		be.mailboxes = make(map[string][]*MemoryMessage)
+	}
+	for _, to := range msg.To {
+		be.mailboxes[to] = append(be.mailboxes[to], msg)
+	}
+	return nil
+}
+
+func mailboxKey(addr string) string {
+	return strings.ToLower(addr)
+}
+
+var (
+	errMessageTooLarge = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      "Maximum message size exceeded",
+	}
+)
+
+type memorySession struct {
+	be       *MemoryBackend
+	username string
+	from     string
+	to       []string
+}
+
+func (s *memorySession) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *memorySession) Logout() error {
+	return nil
+}
+
+func (s *memorySession) Mail(from string) error {
+	s.Reset()
+	s.from = from
+	return nil
+}
+
+func (s *memorySession) Rcpt(to string) error {
+	key := mailboxKey(to)
+	if s.be.MaxMailboxBytes > 0 {
+		s.be.mu.Lock()
+		full := s.be.mailboxSize(key) >= s.be.MaxMailboxBytes
+		s.be.mu.Unlock()
+		if full {
+			return smtp.ErrMailboxFull
+		}
+	}
+	s.to = append(s.to, key)
+	return nil
+}
+
+func (s *memorySession) Data(r io.Reader) error {
+	if s.be.MaxMessageBytes > 0 {
+		r = io.LimitReader(r, s.be.MaxMessageBytes+1)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if s.be.MaxMessageBytes > 0 && int64(len(b)) > s.be.MaxMessageBytes {
+		return errMessageTooLarge
+	}
+
+	return s.be.deliver(&MemoryMessage{
+		Username: s.username,
+		From:     s.from,
+		To:       append([]string(nil), s.to...),
+		Data:     b,
+		Received: time.Now(),
+	})
+}
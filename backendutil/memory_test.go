@@ -0,0 +1,66 @@
+package backendutil_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.MemoryBackend{}
+
+func TestMemoryBackend(t *testing.T) {
+	be := &backendutil.MemoryBackend{
+		Auth:            backendutil.UserMap{"alice": "secret"}.Auth,
+		MaxMessageBytes: 16,
+		MaxMailboxBytes: 20,
+	}
+
+	if _, err := be.AnonymousLogin(nil); err != smtp.ErrAuthRequired {
+		t.Fatalf("AnonymousLogin: expected ErrAuthRequired, got %v", err)
+	}
+	if _, err := be.Login(nil, "alice", "wrong"); err == nil {
+		t.Fatal("Login: expected error with invalid password")
+	}
+
+	s, err := be.Login(nil, "alice", "secret")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if err := s.Mail("alice@example.org"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := s.Rcpt("Bob@example.org"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	if err := s.Data(strings.NewReader("Hello Bob!")); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+
+	msgs := be.Mailbox("bob@example.org")
+	if len(msgs) != 1 {
+		t.Fatalf("Mailbox: expected 1 message, got %v", len(msgs))
+	}
+	if msgs[0].Username != "alice" || msgs[0].From != "alice@example.org" || string(msgs[0].Data) != "Hello Bob!" {
+		t.Errorf("Mailbox: unexpected message %+v", msgs[0])
+	}
+	if l := be.Mailboxes(); len(l) != 1 || l[0] != "bob@example.org" {
+		t.Errorf("Mailboxes = %v, want [bob@example.org]", l)
+	}
+
+	if err := s.Data(strings.NewReader("This message is too large")); err == nil {
+		t.Error("Data: expected error for message exceeding MaxMessageBytes")
+	}
+	if err := s.Data(strings.NewReader("Hello again!")); err == nil {
+		t.Error("Data: expected error for full mailbox")
+	}
+	if len(be.Mailbox("bob@example.org")) != 1 {
+		t.Error("Mailbox: rejected messages must not be stored")
+	}
+
+	be.Clear()
+	if l := be.Mailboxes(); len(l) != 0 {
+		t.Errorf("Mailboxes after Clear = %v, want none", l)
+	}
+}
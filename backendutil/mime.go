@@ -0,0 +1,401 @@
+package backendutil
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DefaultMIMEMaxDepth is the nesting depth limit of MIMEValidator if MaxDepth
+// is zero.
+const DefaultMIMEMaxDepth = 10
+
+// MIMEValidator checks the MIME structure of messages while they are
+// streamed: the syntax of header fields, the integrity of multipart
+// boundaries and the nesting depth of entities. Malformed messages are
+// rejected with 554 5.6.0, to protect downstream MIME parsers.
+//
+// Only the line being checked is buffered. Errors are returned by the reader
+// once the malformed line is read, so the underlying session must fail when
+// reading the message fails, before storing it. Transform can be used as
+// TransformBackend.TransformData.
+type MIMEValidator struct {
+	// MaxDepth is the maximum nesting depth of multipart bodies and
+	// encapsulated messages. If zero, DefaultMIMEMaxDepth is used.
+	MaxDepth int
+}
+
+// Transform returns a reader validating a message.
+func (mv *MIMEValidator) Transform(r io.Reader) (io.Reader, error) {
+	maxDepth := mv.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultMIMEMaxDepth
+	}
+	return &mimeReader{
+		br:       bufio.NewReader(r),
+		maxDepth: maxDepth,
+		stack:    []*mimeEntity{{inHeader: true}},
+	}, nil
+}
+
+func mimeError(reason string) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      "Malformed MIME message: " + reason,
+	}
+}
+
+// mimeEntity is a MIME entity being validated.
+type mimeEntity struct {
+	inHeader bool
+	hasField bool
+
+	// The value of the header field being read, if it's needed
+	field       []byte
+	fieldName   string
+	contentType string
+	encoding    string
+	disposition string
+
+	// Set once the header has been read
+	mediaType string
+	params    map[string]string
+	stripped  bool
+
+	// Set for multipart entities
+	boundary string
+	parts    int
+	closed   bool
+}
+
+func (e *mimeEntity) endField() {
+	switch e.fieldName {
+	case "content-type":
+		e.contentType = string(e.field)
+	case "content-transfer-encoding":
+		e.encoding = string(e.field)
+	case "content-disposition":
+		e.disposition = string(e.field)
+	}
+	e.fieldName = ""
+	e.field = e.field[:0]
+}
+
+// mimeFilter is called once the header of an entity has been read, with the
+// line ending of the message. It returns nil to keep the entity, or the
+// replacement of its header and body to strip it.
+type mimeFilter func(e *mimeEntity, depth int, eol string) ([]byte, error)
+
+type mimeReader struct {
+	br       *bufio.Reader
+	maxDepth int
+	// If not nil, the header of each entity is buffered until it has been
+	// read, and passed to filter
+	filter mimeFilter
+	header []byte
+
+	// The entities enclosing the current line, the innermost last
+	stack       []*mimeEntity
+	midLine     bool
+	headerBytes int
+
+	pending []byte
+	err     error
+}
+
+func (r *mimeReader) Read(b []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		line, err := r.br.ReadSlice('\n')
+		if len(line) > 0 {
+			out, verr := r.line(line, err != bufio.ErrBufferFull)
+			if verr != nil {
+				r.err = verr
+				return 0, verr
+			}
+			r.pending = out
+		}
+
+		switch err {
+		case nil, bufio.ErrBufferFull:
+		case io.EOF:
+			r.err = r.end()
+			if r.err == nil {
+				r.err = io.EOF
+			}
+			// A header without a body, buffered by the filter
+			if len(r.header) > 0 {
+				r.pending = r.header
+				r.header = nil
+			}
+		default:
+			r.err = err
+		}
+	}
+
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// line checks a line, or a part of a line if it's longer than the buffer, and
+// returns the data to output.
+func (r *mimeReader) line(raw []byte, complete bool) ([]byte, error) {
+	e := r.stack[len(r.stack)-1]
+	if !e.inHeader || r.filter == nil {
+		if err := r.check(raw, complete); err != nil {
+			return nil, err
+		}
+		if r.suppressed() {
+			return nil, nil
+		}
+		return raw, nil
+	}
+
+	wasSuppressed := r.suppressed()
+	if !wasSuppressed {
+		r.header = append(r.header, raw...)
+	}
+	if err := r.check(raw, complete); err != nil {
+		return nil, err
+	}
+	if e.inHeader && r.stack[len(r.stack)-1] == e {
+		return nil, nil
+	}
+
+	// The header has ended, or a boundary was found before its end
+	out := r.header
+	r.header = r.header[:0]
+	if wasSuppressed {
+		if e.inHeader && !r.suppressed() {
+			return raw, nil
+		}
+		return nil, nil
+	} else if e.inHeader {
+		return out, nil
+	}
+	eol := "\n"
+	if bytes.HasSuffix(raw, []byte("\r\n")) {
+		eol = "\r\n"
+	}
+	depth := len(r.stack) - 1
+	if e.mediaType == "message/rfc822" && r.stack[depth] != e {
+		depth--
+	}
+	replacement, err := r.filter(e, depth, eol)
+	if err != nil {
+		return nil, err
+	} else if replacement != nil {
+		e.stripped = true
+		r.stack = r.stack[:depth+1]
+		return replacement, nil
+	}
+	return out, nil
+}
+
+// suppressed checks whether the current line belongs to a stripped entity.
+func (r *mimeReader) suppressed() bool {
+	for _, e := range r.stack {
+		if e.stripped {
+			return true
+		}
+	}
+	return false
+}
+
+// check checks a line, or a part of a line if it's longer than the buffer.
+func (r *mimeReader) check(l []byte, complete bool) error {
+	start := !r.midLine
+	r.midLine = !complete
+	if complete {
+		l = bytes.TrimSuffix(bytes.TrimSuffix(l, []byte("\n")), []byte("\r"))
+	}
+
+	e := r.stack[len(r.stack)-1]
+	if !e.inHeader {
+		if start && complete {
+			_, err := r.boundary(l)
+			return err
+		}
+		return nil
+	}
+
+	r.headerBytes += len(l)
+	if r.headerBytes > maxHeaderBytes {
+		return errHeaderTooLarge
+	}
+
+	if !start {
+		if e.fieldName != "" {
+			e.field = append(e.field, l...)
+		}
+		return nil
+	}
+	if complete && len(l) == 0 {
+		return r.endHeader(e)
+	}
+	if l[0] == ' ' || l[0] == '\t' {
+		if !e.hasField {
+			return mimeError("header starts with a continuation line")
+		}
+		if e.fieldName != "" {
+			e.field = append(e.field, l...)
+		}
+		return nil
+	}
+	// A part may have neither a header nor a body
+	if complete && len(r.stack) > 1 {
+		if ok, err := r.boundary(l); ok || err != nil {
+			return err
+		}
+	}
+
+	e.endField()
+	i := bytes.IndexByte(l, ':')
+	if i < 0 {
+		return mimeError("invalid header field")
+	}
+	name := bytes.TrimRight(l[:i], " \t")
+	if len(name) == 0 {
+		return mimeError("invalid header field")
+	}
+	for _, c := range name {
+		if c < 33 || c > 126 {
+			return mimeError("invalid header field name")
+		}
+	}
+	e.hasField = true
+	switch k := strings.ToLower(string(name)); k {
+	case "content-type", "content-transfer-encoding", "content-disposition":
+		e.fieldName = k
+		e.field = append(e.field[:0], l[i+1:]...)
+	}
+	return nil
+}
+
+// endHeader checks the header of an entity once it has been read.
+func (r *mimeReader) endHeader(e *mimeEntity) error {
+	e.endField()
+	e.inHeader = false
+	r.headerBytes = 0
+
+	e.mediaType = "text/plain"
+	if e.contentType == "" {
+		return nil
+	}
+	mediaType, params, err := mime.ParseMediaType(e.contentType)
+	if err != nil && err != mime.ErrInvalidMediaParameter {
+		return mimeError("invalid Content-Type header field")
+	}
+	e.mediaType, e.params = mediaType, params
+	encoding := strings.ToLower(strings.TrimSpace(e.encoding))
+	identity := encoding == "" || encoding == "7bit" || encoding == "8bit" || encoding == "binary"
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		// RFC 2045 section 6.4
+		if !identity {
+			return mimeError("encoded multipart entity")
+		}
+		boundary, ok := params["boundary"]
+		if !ok || !validBoundary(boundary) {
+			return mimeError("missing or invalid multipart boundary")
+		}
+		e.boundary = boundary
+	case mediaType == "message/rfc822" && identity:
+		// The header of the encapsulated message follows
+		return r.push()
+	}
+	return nil
+}
+
+// push starts a nested entity.
+func (r *mimeReader) push() error {
+	if len(r.stack) > r.maxDepth {
+		return mimeError("nesting too deep")
+	}
+	r.stack = append(r.stack, &mimeEntity{inHeader: true})
+	return nil
+}
+
+// boundary checks whether a line is a boundary delimiter of an enclosing
+// multipart entity, and handles it. A delimiter ends all the entities nested
+// in the multipart entity.
+func (r *mimeReader) boundary(l []byte) (bool, error) {
+	if !bytes.HasPrefix(l, []byte("--")) {
+		return false, nil
+	}
+	// Delimiters may be followed by transport padding
+	l = bytes.TrimRight(l[2:], " \t")
+
+	for i := len(r.stack) - 1; i >= 0; i-- {
+		e := r.stack[i]
+		if e.boundary == "" || !bytes.HasPrefix(l, []byte(e.boundary)) {
+			continue
+		}
+		var closing bool
+		switch string(l[len(e.boundary):]) {
+		case "":
+		case "--":
+			closing = true
+		default:
+			continue
+		}
+
+		for _, nested := range r.stack[i+1:] {
+			if nested.boundary != "" && !nested.closed {
+				return true, mimeError("missing closing boundary")
+			}
+		}
+		r.stack = r.stack[:i+1]
+		if e.closed {
+			return true, mimeError("boundary after the closing boundary")
+		}
+		if closing {
+			if e.parts == 0 {
+				return true, mimeError("multipart entity without parts")
+			}
+			e.closed = true
+			return true, nil
+		}
+		e.parts++
+		return true, r.push()
+	}
+	return false, nil
+}
+
+// end checks the structure of the message once it has been read.
+func (r *mimeReader) end() error {
+	for _, e := range r.stack {
+		if e.boundary != "" && !e.closed {
+			return mimeError("missing closing boundary")
+		}
+	}
+	return nil
+}
+
+// validBoundary checks the syntax of a multipart boundary, defined in RFC 2046
+// section 5.1.1.
+func validBoundary(b string) bool {
+	if len(b) == 0 || len(b) > 70 || strings.HasSuffix(b, " ") {
+		return false
+	}
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case strings.IndexByte("'()+_,-./:=? ", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package backendutil_test
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+const mimeMultipart = "From: alice@example.org\r\n" +
+	"Content-Type: multipart/mixed;\r\n" +
+	"\tboundary=\"outer\"\r\n" +
+	"\r\n" +
+	"Preamble\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hello!\r\n" +
+	"--outer  \r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"\r\n" +
+	"Plain\r\n" +
+	"--inner\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"Subject: Forwarded\r\n" +
+	"\r\n" +
+	"--not a boundary\r\n" +
+	"--outer--\r\n" +
+	"Epilogue\r\n"
+
+func TestMIMEValidator(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    string
+		reason string
+	}{
+		{name: "simple", msg: "Subject: Hi\n\nHello!\n"},
+		{name: "header only", msg: "Subject: Hi\n"},
+		{name: "long lines", msg: "Subject: " + strings.Repeat("a", 10000) + "\n\n" + strings.Repeat("b", 10000) + "\n"},
+		{name: "multipart", msg: mimeMultipart},
+		{
+			name:   "invalid field",
+			msg:    "Subject: Hi\nNot a field\n\nHello!\n",
+			reason: "invalid header field",
+		},
+		{
+			name:   "invalid field name",
+			msg:    "Sub ject: Hi\n\nHello!\n",
+			reason: "invalid header field name",
+		},
+		{
+			name:   "continuation first",
+			msg:    " Subject: Hi\n\nHello!\n",
+			reason: "header starts with a continuation line",
+		},
+		{
+			name:   "missing boundary",
+			msg:    "Content-Type: multipart/mixed\n\n--\n",
+			reason: "missing or invalid multipart boundary",
+		},
+		{
+			name:   "invalid boundary",
+			msg:    "Content-Type: multipart/mixed; boundary=\"a<b\"\n\n--a<b\n\n--a<b--\n",
+			reason: "missing or invalid multipart boundary",
+		},
+		{
+			name:   "encoded multipart",
+			msg:    "Content-Type: multipart/mixed; boundary=b\nContent-Transfer-Encoding: base64\n\n",
+			reason: "encoded multipart entity",
+		},
+		{
+			name:   "unterminated",
+			msg:    "Content-Type: multipart/mixed; boundary=b\n\n--b\n\nHello!\n",
+			reason: "missing closing boundary",
+		},
+		{
+			name:   "unterminated nested",
+			msg:    "Content-Type: multipart/mixed; boundary=a\n\n--a\nContent-Type: multipart/mixed; boundary=b\n\n--b\n\n--a--\n",
+			reason: "missing closing boundary",
+		},
+		{
+			name:   "no parts",
+			msg:    "Content-Type: multipart/mixed; boundary=b\n\n--b--\n",
+			reason: "multipart entity without parts",
+		},
+		{
+			name:   "boundary after close",
+			msg:    "Content-Type: multipart/mixed; boundary=b\n\n--b\n\n--b--\n--b\n",
+			reason: "boundary after the closing boundary",
+		},
+		{
+			name:   "invalid part header",
+			msg:    "Content-Type: multipart/mixed; boundary=b\n\n--b\nHello!\n--b--\n",
+			reason: "invalid header field",
+		},
+		{
+			name:   "too deep",
+			msg:    strings.Repeat("Content-Type: message/rfc822\n\n", 4) + "Hello!\n",
+			reason: "nesting too deep",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mv := &backendutil.MIMEValidator{MaxDepth: 3}
+			r, err := mv.Transform(strings.NewReader(tc.msg))
+			if err != nil {
+				t.Fatalf("Transform: %v", err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if tc.reason == "" {
+				if err != nil {
+					t.Fatalf("ReadAll: %v", err)
+				}
+				if string(b) != tc.msg {
+					t.Errorf("message changed:\n%q\nwant\n%q", b, tc.msg)
+				}
+				return
+			}
+
+			smtpErr, ok := err.(*smtp.SMTPError)
+			if !ok {
+				t.Fatalf("ReadAll: expected a SMTPError, got %v", err)
+			}
+			if want := "Malformed MIME message: " + tc.reason; smtpErr.Code != 554 || smtpErr.Message != want {
+				t.Errorf("ReadAll: got %v, want 554 %v", smtpErr, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,404 @@
+package backendutil
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ObjectStore stores objects, such as an S3-compatible bucket.
+type ObjectStore interface {
+	// PutObject stores the contents of r under key. Implementations should
+	// not buffer the whole object in memory.
+	PutObject(key string, r io.Reader) error
+}
+
+// ObjectKey describes a message being stored by an ObjectBackend. It is
+// passed to the key template.
+type ObjectKey struct {
+	// A random identifier unique to the message.
+	QueueID  string
+	Time     time.Time
+	From     string
+	To       []string
+	Username string
+}
+
+// Rcpt returns the first recipient.
+func (k *ObjectKey) Rcpt() string {
+	if len(k.To) == 0 {
+		return ""
+	}
+	return k.To[0]
+}
+
+// Domain returns the domain of the first recipient.
+func (k *ObjectKey) Domain() string {
+	rcpt := k.Rcpt()
+	if i := strings.LastIndexByte(rcpt, '@'); i >= 0 {
+		return strings.ToLower(rcpt[i+1:])
+	}
+	return ""
+}
+
+// DefaultObjectKeyTemplate is the key template used by ObjectBackend if none
+// is set.
+const DefaultObjectKeyTemplate = `{{.Time.Format "2006/01/02"}}/{{.QueueID}}.eml`
+
+// ObjectBackend is a backend streaming each message to an ObjectStore, as a
+// single object. The message is not buffered in memory by the backend.
+type ObjectBackend struct {
+	Store ObjectStore
+	// KeyTemplate is a text/template executed with an *ObjectKey to generate
+	// object keys. If empty, DefaultObjectKeyTemplate is used.
+	KeyTemplate string
+
+	// Auth checks credentials, e.g. UserMap.Auth. If nil, authentication is
+	// not supported.
+	Auth func(username, password string) error
+	// If set, clients can send mail without authenticating.
+	AllowAnonymous bool
+}
+
+// Login implements the smtp.Backend interface.
+func (be *ObjectBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if err := login(be.Auth, username, password); err != nil {
+		return nil, err
+	}
+	return &objectSession{be: be, username: username}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *ObjectBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	if !be.AllowAnonymous {
+		return nil, smtp.ErrAuthRequired
+	}
+	return &objectSession{be: be}, nil
+}
+
+func (be *ObjectBackend) key(k *ObjectKey) (string, error) {
+	text := be.KeyTemplate
+	if text == "" {
+		text = DefaultObjectKeyTemplate
+	}
+	tmpl, err := template.New("key").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, k); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func newQueueID() string {
+	var b [10]byte
+	rand.Read(b[:])
+	return strings.ToUpper(hex.EncodeToString(b[:]))
+}
+
+type objectSession struct {
+	be       *ObjectBackend
+	username string
+	from     string
+	to       []string
+}
+
+func (s *objectSession) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *objectSession) Logout() error {
+	return nil
+}
+
+func (s *objectSession) Mail(from string) error {
+	s.Reset()
+	s.from = from
+	return nil
+}
+
+func (s *objectSession) Rcpt(to string) error {
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *objectSession) Data(r io.Reader) error {
+	key, err := s.be.key(&ObjectKey{
+		QueueID:  newQueueID(),
+		Time:     time.Now().UTC(),
+		From:     s.from,
+		To:       s.to,
+		Username: s.username,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.be.Store.PutObject(key, r); err != nil {
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Failed to store message",
+		}
+	}
+	return nil
+}
+
+// S3Store is an ObjectStore for S3-compatible services. Requests are signed
+// with AWS Signature Version 4.
+//
+// Objects smaller than PartSize are uploaded with a single request, larger
+// objects are uploaded part by part with a multipart upload. At most one part
+// is held in memory.
+type S3Store struct {
+	// The service endpoint, for instance "https://s3.eu-west-1.amazonaws.com".
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// If set, the bucket is part of the request path instead of the host
+	// name. Most S3-compatible services other than AWS require this.
+	PathStyle bool
+	// The size of each part of a multipart upload. If zero, 5 MiB is used,
+	// the minimum allowed by S3.
+	PartSize int
+	// The HTTP client used to send requests. If nil, http.DefaultClient is
+	// used.
+	HTTPClient *http.Client
+}
+
+var _ ObjectStore = (*S3Store)(nil)
+
+// PutObject implements ObjectStore.
+func (s *S3Store) PutObject(key string, r io.Reader) error {
+	partSize := s.PartSize
+	if partSize <= 0 {
+		partSize = 5 << 20
+	}
+
+	// Most messages are much smaller than a part, the buffer only grows as
+	// needed
+	var first bytes.Buffer
+	if _, err := first.ReadFrom(io.LimitReader(r, int64(partSize))); err != nil {
+		return err
+	}
+	if first.Len() < partSize {
+		_, err := s.do(http.MethodPut, key, nil, first.Bytes())
+		return err
+	}
+
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp, &initiate); err != nil {
+		return err
+	}
+
+	// The first part is full, its buffer is reused for the next ones
+	if err := s.uploadParts(key, initiate.UploadID, r, first.Bytes(), partSize); err != nil {
+		s.do(http.MethodDelete, key, url.Values{"uploadId": {initiate.UploadID}}, nil)
+		return err
+	}
+	return nil
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *S3Store) uploadParts(key, uploadID string, r io.Reader, buf []byte, n int) error {
+	var parts []s3Part
+	for n > 0 {
+		num := len(parts) + 1
+		query := url.Values{
+			"partNumber": {strconv.Itoa(num)},
+			"uploadId":   {uploadID},
+		}
+		req, err := s.newRequest(http.MethodPut, key, query, buf[:n])
+		if err != nil {
+			return err
+		}
+		resp, err := s.roundTrip(req)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, s3Part{num, resp.Header.Get("ETag")})
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+	}
+
+	complete, err := xml.Marshal(&struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	_, err = s.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, complete)
+	return err
+}
+
+func (s *S3Store) do(method, key string, query url.Values, body []byte) ([]byte, error) {
+	req, err := s.newRequest(method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// roundTrip sends a request and checks the response status. The response body
+// is fully read and can be read again by the caller.
+func (s *S3Store) roundTrip(req *http.Request) (*http.Response, error) {
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("backendutil: S3 request %v %v failed: %v", req.Method, req.URL.Path, resp.Status)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+func (s *S3Store) newRequest(method, key string, query url.Values, body []byte) (*http.Request, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket + "/" + key
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body, time.Now().UTC())
+	return req, nil
+}
+
+// sign signs a request with AWS Signature Version 4.
+func (s *S3Store) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	payload := hex.EncodeToString(payloadHash[:])
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payload + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v", s.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, data)
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes a string as required by AWS Signature Version 4.
+// Slashes are kept as-is unless escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query returns the canonical form of a query string.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var l []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			l = append(l, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(l, "&")
+}
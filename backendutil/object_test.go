@@ -0,0 +1,107 @@
+package backendutil_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.ObjectBackend{}
+
+// fakeS3 implements the subset of the S3 API used by S3Store.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string][][]byte
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	query := req.URL.Query()
+	uploadID := query.Get("uploadId")
+	switch {
+	case req.Method == http.MethodPost && query["uploads"] != nil:
+		uploadID = fmt.Sprintf("upload%v", len(s.uploads))
+		s.uploads[uploadID] = nil
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%v</UploadId></InitiateMultipartUploadResult>", uploadID)
+	case req.Method == http.MethodPut && uploadID != "":
+		s.uploads[uploadID] = append(s.uploads[uploadID], body)
+		w.Header().Set("ETag", fmt.Sprintf(`"%v"`, len(s.uploads[uploadID])))
+	case req.Method == http.MethodPost && uploadID != "":
+		var complete struct {
+			Parts []struct{ PartNumber int } `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil || len(complete.Parts) != len(s.uploads[uploadID]) {
+			http.Error(w, "Invalid parts", http.StatusBadRequest)
+			return
+		}
+		s.objects[req.URL.Path] = bytes.Join(s.uploads[uploadID], nil)
+	case req.Method == http.MethodPut:
+		s.objects[req.URL.Path] = body
+	default:
+		http.Error(w, "Not implemented", http.StatusNotImplemented)
+	}
+}
+
+func TestObjectBackend(t *testing.T) {
+	fake := &fakeS3{
+		objects: make(map[string][]byte),
+		uploads: make(map[string][][]byte),
+	}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	be := &backendutil.ObjectBackend{
+		Store: &backendutil.S3Store{
+			Endpoint:        ts.URL,
+			Region:          "us-east-1",
+			Bucket:          "mail",
+			AccessKeyID:     "AKID",
+			SecretAccessKey: "secret",
+			PathStyle:       true,
+			PartSize:        8,
+		},
+		KeyTemplate:    "{{.Domain}}/{{.Rcpt}}/{{.QueueID}}",
+		AllowAnonymous: true,
+	}
+
+	for _, data := range []string{"Hi!\n", "Hello, this spans several parts.\n"} {
+		if err := sendMessage(t, be, "alice@example.org", []string{"bob@Example.org"}, data); err != nil {
+			t.Fatalf("Data: %v", err)
+		}
+	}
+
+	if len(fake.objects) != 2 {
+		t.Fatalf("expected 2 objects, got %v", len(fake.objects))
+	}
+	found := make(map[string]bool)
+	for key, data := range fake.objects {
+		if !strings.HasPrefix(key, "/mail/example.org/bob@Example.org/") {
+			t.Errorf("unexpected object key %q", key)
+		}
+		found[string(data)] = true
+	}
+	if !found["Hi!\n"] || !found["Hello, this spans several parts.\n"] {
+		t.Errorf("unexpected objects %v", found)
+	}
+	if len(fake.uploads) != 1 {
+		t.Errorf("expected 1 multipart upload, got %v", len(fake.uploads))
+	}
+}
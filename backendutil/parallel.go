@@ -0,0 +1,125 @@
+package backendutil
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ParallelBackend is a backend delivering messages to each recipient
+// separately, for instance to local mailboxes. Deliveries of a message run
+// concurrently, and in LMTP mode each recipient gets its own reply, in
+// recipient order.
+type ParallelBackend struct {
+	// Deliver delivers a message to a single recipient. It must be safe for
+	// concurrent use.
+	Deliver func(from, to string, r io.Reader) error
+	// The maximum number of concurrent deliveries per message. Zero means
+	// deliveries are made one at a time.
+	MaxParallel int
+
+	// Auth checks credentials, e.g. UserMap.Auth. If nil, authentication is
+	// not supported.
+	Auth func(username, password string) error
+	// If set, clients can send mail without authenticating.
+	AllowAnonymous bool
+}
+
+// Login implements the smtp.Backend interface.
+func (be *ParallelBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if err := login(be.Auth, username, password); err != nil {
+		return nil, err
+	}
+	return &parallelSession{be: be}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *ParallelBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	if !be.AllowAnonymous {
+		return nil, smtp.ErrAuthRequired
+	}
+	return &parallelSession{be: be}, nil
+}
+
+// deliver delivers a message to all recipients, reports their statuses if
+// status is not nil, and returns the first error.
+func (be *ParallelBackend) deliver(from string, to []string, body []byte, status smtp.StatusCollector) error {
+	n := be.MaxParallel
+	if n <= 0 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	errs := make([]error, len(to))
+	var wg sync.WaitGroup
+	for i, rcpt := range to {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, rcpt string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = be.Deliver(from, rcpt, bytes.NewReader(body))
+			if status != nil {
+				status.SetStatus(rcpt, errs[i])
+			}
+		}(i, rcpt)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type parallelSession struct {
+	be   *ParallelBackend
+	from string
+	to   []string
+}
+
+func (s *parallelSession) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *parallelSession) Logout() error {
+	return nil
+}
+
+func (s *parallelSession) Mail(from string) error {
+	s.Reset()
+	s.from = from
+	return nil
+}
+
+func (s *parallelSession) Rcpt(to string) error {
+	s.to = append(s.to, to)
+	return nil
+}
+
+// Data delivers the message to all recipients, and fails if any delivery
+// fails.
+func (s *parallelSession) Data(r io.Reader) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return s.be.deliver(s.from, s.to, body, nil)
+}
+
+// LMTPData implements the smtp.LMTPSession interface.
+func (s *parallelSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.be.deliver(s.from, s.to, body, status)
+	return nil
+}
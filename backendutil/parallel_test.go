@@ -0,0 +1,92 @@
+package backendutil_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.ParallelBackend{}
+
+type statusMap struct {
+	mu       sync.Mutex
+	statuses map[string]error
+}
+
+func (m *statusMap) SetStatus(rcpt string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.statuses[rcpt] = err
+}
+
+func TestParallelBackend(t *testing.T) {
+	var active, maxActive int32
+	errFull := errors.New("mailbox full")
+	be := &backendutil.ParallelBackend{
+		MaxParallel:    2,
+		AllowAnonymous: true,
+		Deliver: func(from, to string, r io.Reader) error {
+			n := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			for {
+				max := atomic.LoadInt32(&maxActive)
+				if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+
+			if b, err := ioutil.ReadAll(r); err != nil || string(b) != "Hello!\n" {
+				t.Errorf("unexpected data: %q, %v", b, err)
+			}
+			if to == "full@example.org" {
+				return errFull
+			}
+			return nil
+		},
+	}
+
+	s, err := be.AnonymousLogin(&smtp.ConnectionState{})
+	if err != nil {
+		t.Fatalf("AnonymousLogin: %v", err)
+	}
+	rcpts := []string{"a@example.org", "b@example.org", "full@example.org", "c@example.org"}
+	if err := s.Mail("alice@example.org"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	for _, rcpt := range rcpts {
+		if err := s.Rcpt(rcpt); err != nil {
+			t.Fatalf("Rcpt: %v", err)
+		}
+	}
+
+	status := &statusMap{statuses: make(map[string]error)}
+	if err := s.(smtp.LMTPSession).LMTPData(strings.NewReader("Hello!\n"), status); err != nil {
+		t.Fatalf("LMTPData: %v", err)
+	}
+	if len(status.statuses) != len(rcpts) {
+		t.Errorf("expected %v statuses, got %v", len(rcpts), status.statuses)
+	}
+	if err := status.statuses["full@example.org"]; err != errFull {
+		t.Errorf("expected mailbox full error, got %v", err)
+	}
+	if err := status.statuses["a@example.org"]; err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+	if maxActive != 2 {
+		t.Errorf("expected 2 concurrent deliveries, got %v", maxActive)
+	}
+
+	// Outside of LMTP, any failure fails the message
+	if err := s.Data(strings.NewReader("Hello!\n")); err != errFull {
+		t.Errorf("Data: expected mailbox full error, got %v", err)
+	}
+}
@@ -0,0 +1,338 @@
+package backendutil
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Protocol states sent to policy services.
+const (
+	PolicyStateMail = "MAIL"
+	PolicyStateRcpt = "RCPT"
+	PolicyStateData = "DATA"
+)
+
+// PolicyClient queries a policy service with the Postfix policy delegation
+// protocol, as implemented by postfwd or policyd-spf. See
+// http://www.postfix.org/SMTPD_POLICY_README.html.
+//
+// Connections are kept open and reused. It is safe for concurrent use.
+type PolicyClient struct {
+	// Network is "tcp" or "unix", Addr is the server address or socket path.
+	Network string
+	Addr    string
+	// Timeout is the timeout of each query. Zero means no timeout.
+	Timeout time.Duration
+
+	pool connPool
+}
+
+// Query sends a policy request and returns the action of the reply.
+func (c *PolicyClient) Query(attrs map[string]string) (string, error) {
+	var sb strings.Builder
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := attrs[k]
+		if k == "" || strings.ContainsAny(k, "=\n") || strings.ContainsRune(v, '\n') {
+			return "", fmt.Errorf("backendutil: invalid policy attribute %q", k)
+		}
+		sb.WriteString(k + "=" + v + "\n")
+	}
+	sb.WriteString("\n")
+	req := sb.String()
+
+	var action string
+	err := c.pool.do(c.dial, func(pc *poolConn) error {
+		var err error
+		if action, err = policyQuery(pc, req, c.Timeout); err != nil {
+			return fmt.Errorf("backendutil: policy query failed: %v", err)
+		}
+		return nil
+	})
+	return action, err
+}
+
+func (c *PolicyClient) dial() (*poolConn, error) {
+	pc, err := dialPoolConn(c.Network, c.Addr, c.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("backendutil: failed to connect to policy service: %v", err)
+	}
+	return pc, nil
+}
+
+func policyQuery(pc *poolConn, req string, timeout time.Duration) (string, error) {
+	if timeout > 0 {
+		pc.SetDeadline(time.Now().Add(timeout))
+	}
+	if _, err := io.WriteString(pc, req); err != nil {
+		return "", err
+	}
+
+	var action string
+	for {
+		line, err := pc.br.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "action=") {
+			action = strings.TrimPrefix(line, "action=")
+		}
+	}
+	if action == "" {
+		return "", errors.New("missing action in reply")
+	}
+	return action, nil
+}
+
+// Close closes the idle connections.
+func (c *PolicyClient) Close() error {
+	return c.pool.Close()
+}
+
+var errPolicyFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Policy service unavailable",
+}
+
+// PolicyError converts a policy action to an error, nil meaning the
+// transaction can proceed. REJECT, DEFER, DEFER_IF_PERMIT, DEFER_IF_REJECT and
+// numeric 4xx and 5xx replies are errors, other actions such as OK and DUNNO
+// are accepted.
+func PolicyError(action string) error {
+	verb, text := action, ""
+	if i := strings.IndexAny(action, " \t"); i >= 0 {
+		verb, text = action[:i], strings.TrimSpace(action[i+1:])
+	}
+
+	if code, err := strconv.Atoi(verb); err == nil && len(verb) == 3 {
+		if code < 400 || code > 599 {
+			return nil
+		}
+		ec := smtp.EnhancedCode{code / 100, 0, 0}
+		if i := strings.IndexByte(text, ' '); i >= 0 {
+			if parsed, ok := parsePolicyEnhancedCode(text[:i], code); ok {
+				ec, text = parsed, text[i+1:]
+			}
+		} else if parsed, ok := parsePolicyEnhancedCode(text, code); ok {
+			ec, text = parsed, ""
+		}
+		if text == "" {
+			text = "Rejected by policy"
+		}
+		return &smtp.SMTPError{Code: code, EnhancedCode: ec, Message: text}
+	}
+
+	switch strings.ToUpper(verb) {
+	case "REJECT":
+		if text == "" {
+			text = "Access denied"
+		}
+		return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: text}
+	case "DEFER", "DEFER_IF_PERMIT", "DEFER_IF_REJECT":
+		if text == "" {
+			text = "Try again later"
+		}
+		return &smtp.SMTPError{Code: 450, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: text}
+	}
+	return nil
+}
+
+func parsePolicyEnhancedCode(s string, code int) (smtp.EnhancedCode, bool) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return smtp.EnhancedCode{}, false
+	}
+	var ec smtp.EnhancedCode
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return smtp.EnhancedCode{}, false
+		}
+		ec[i] = n
+	}
+	if ec[0] != code/100 {
+		return smtp.EnhancedCode{}, false
+	}
+	return ec, true
+}
+
+// PolicyBackend is a backend consulting a policy service before accepting the
+// sender, each recipient and the message data.
+type PolicyBackend struct {
+	Backend smtp.Backend
+	Client  *PolicyClient
+	// The protocol states the policy service is queried in. If nil, the
+	// service is queried for each recipient only, as with Postfix's
+	// smtpd_recipient_restrictions.
+	States []string
+	// If set, transactions proceed when the policy service can't be
+	// reached. Otherwise they are deferred.
+	FailOpen bool
+}
+
+// Login implements the smtp.Backend interface.
+func (be *PolicyBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	s, err := be.Backend.Login(state, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return be.newSession(s, state, username), nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *PolicyBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	s, err := be.Backend.AnonymousLogin(state)
+	if err != nil {
+		return nil, err
+	}
+	return be.newSession(s, state, ""), nil
+}
+
+func (be *PolicyBackend) newSession(s smtp.Session, state *smtp.ConnectionState, username string) *policySession {
+	attrs := map[string]string{
+		"request":       "smtpd_access_policy",
+		"protocol_name": "ESMTP",
+	}
+	if username != "" {
+		attrs["sasl_username"] = username
+	}
+	if state != nil {
+		attrs["helo_name"] = state.Hostname
+		if state.RemoteAddr != nil {
+			if host, _, err := net.SplitHostPort(state.RemoteAddr.String()); err == nil {
+				attrs["client_address"] = host
+			}
+		}
+		if state.TLS.HandshakeComplete {
+			attrs["encryption_protocol"] = policyTLSVersion(state.TLS.Version)
+			attrs["encryption_cipher"] = tls.CipherSuiteName(state.TLS.CipherSuite)
+		}
+	}
+	return &policySession{Session: s, be: be, attrs: attrs}
+}
+
+// policyTLSVersion formats a TLS version the way Postfix does.
+func policyTLSVersion(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	default:
+		return fmt.Sprintf("0x%04X", version)
+	}
+}
+
+func (be *PolicyBackend) queried(state string) bool {
+	if be.States == nil {
+		return state == PolicyStateRcpt
+	}
+	for _, s := range be.States {
+		if strings.EqualFold(s, state) {
+			return true
+		}
+	}
+	return false
+}
+
+type policySession struct {
+	smtp.Session
+
+	be       *PolicyBackend
+	attrs    map[string]string
+	instance string
+	from     string
+	rcpts    int
+	lastRcpt string
+}
+
+func (s *policySession) check(state string) error {
+	if !s.be.queried(state) {
+		return nil
+	}
+
+	attrs := make(map[string]string, len(s.attrs)+5)
+	for k, v := range s.attrs {
+		attrs[k] = v
+	}
+	attrs["protocol_state"] = state
+	attrs["instance"] = s.instance
+	attrs["sender"] = s.from
+	attrs["recipient"] = s.lastRcpt
+	attrs["recipient_count"] = strconv.Itoa(s.rcpts)
+
+	action, err := s.be.Client.Query(attrs)
+	if err != nil {
+		if s.be.FailOpen {
+			return nil
+		}
+		return errPolicyFailed
+	}
+	return PolicyError(action)
+}
+
+func (s *policySession) Reset() {
+	s.from = ""
+	s.rcpts = 0
+	s.lastRcpt = ""
+	s.Session.Reset()
+}
+
+func (s *policySession) Mail(from string) error {
+	// The instance identifies the transaction in the policy service
+	b := make([]byte, 8)
+	rand.Read(b)
+	s.instance = hex.EncodeToString(b)
+	s.from = from
+	s.rcpts = 0
+	s.lastRcpt = ""
+
+	if err := s.check(PolicyStateMail); err != nil {
+		return err
+	}
+	return s.Session.Mail(from)
+}
+
+func (s *policySession) Rcpt(to string) error {
+	s.lastRcpt = to
+	if err := s.check(PolicyStateRcpt); err != nil {
+		return err
+	}
+	if err := s.Session.Rcpt(to); err != nil {
+		return err
+	}
+	s.rcpts++
+	return nil
+}
+
+func (s *policySession) Data(r io.Reader) error {
+	s.lastRcpt = ""
+	if err := s.check(PolicyStateData); err != nil {
+		return err
+	}
+	return s.Session.Data(r)
+}
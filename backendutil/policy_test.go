@@ -0,0 +1,222 @@
+package backendutil_test
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.PolicyBackend{}
+
+// testPolicyServer is a fake policy service, replying with the result of a
+// function of the request attributes.
+type testPolicyServer struct {
+	l      net.Listener
+	policy func(attrs map[string]string) string
+
+	mu       sync.Mutex
+	requests []map[string]string
+	conns    int
+}
+
+func newTestPolicyServer(t *testing.T, policy func(attrs map[string]string) string) *testPolicyServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testPolicyServer{l: l, policy: policy}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *testPolicyServer) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	attrs := make(map[string]string)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line != "" {
+			kv := strings.SplitN(line, "=", 2)
+			attrs[kv[0]] = kv[1]
+			continue
+		}
+
+		s.mu.Lock()
+		s.requests = append(s.requests, attrs)
+		s.mu.Unlock()
+		c.Write([]byte("action=" + s.policy(attrs) + "\n\n"))
+		attrs = make(map[string]string)
+	}
+}
+
+func (s *testPolicyServer) Close() {
+	s.l.Close()
+}
+
+func TestPolicyBackend(t *testing.T) {
+	ps := newTestPolicyServer(t, func(attrs map[string]string) string {
+		switch {
+		case attrs["sender"] == "spammer@example.org":
+			return "REJECT Go away"
+		case attrs["recipient"] == "greylisted@example.org":
+			return "DEFER_IF_PERMIT Greylisted"
+		case attrs["recipient"] == "full@example.org":
+			return "552 5.2.2 Mailbox full"
+		case attrs["protocol_state"] == "DATA" && attrs["recipient_count"] == "0":
+			return "554 No valid recipients"
+		}
+		return "DUNNO"
+	})
+	defer ps.Close()
+
+	client := &backendutil.PolicyClient{Network: "tcp", Addr: ps.l.Addr().String()}
+	defer client.Close()
+	be := &backendutil.PolicyBackend{
+		Backend: &backendutil.MemoryBackend{AllowAnonymous: true},
+		Client:  client,
+		States:  []string{backendutil.PolicyStateMail, backendutil.PolicyStateRcpt, backendutil.PolicyStateData},
+	}
+
+	state := &smtp.ConnectionState{
+		Hostname:   "mx.example.org",
+		RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 25},
+	}
+	s, err := be.AnonymousLogin(state)
+	if err != nil {
+		t.Fatalf("AnonymousLogin: %v", err)
+	}
+
+	err = s.Mail("spammer@example.org")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 554 || smtpErr.Message != "Go away" {
+		t.Fatalf("Mail: expected a 554 error, got %v", err)
+	}
+
+	if err := s.Mail("alice@example.org"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	for rcpt, code := range map[string]int{"greylisted@example.org": 450, "full@example.org": 552} {
+		err := s.Rcpt(rcpt)
+		if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != code {
+			t.Errorf("Rcpt(%q): expected a %v error, got %v", rcpt, code, err)
+		}
+	}
+	err = s.Data(strings.NewReader("Hello!"))
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 554 {
+		t.Fatalf("Data: expected a 554 error, got %v", err)
+	}
+
+	s.Reset()
+	if err := s.Mail("alice@example.org"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := s.Rcpt("bob@example.org"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	if err := s.Data(strings.NewReader("Hello!")); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.conns != 1 {
+		t.Errorf("expected connections to be reused, got %v connections", ps.conns)
+	}
+	last := ps.requests[len(ps.requests)-1]
+	want := map[string]string{
+		"request":         "smtpd_access_policy",
+		"protocol_state":  "DATA",
+		"helo_name":       "mx.example.org",
+		"client_address":  "192.0.2.1",
+		"sender":          "alice@example.org",
+		"recipient_count": "1",
+	}
+	for k, v := range want {
+		if last[k] != v {
+			t.Errorf("expected attribute %v=%q, got %q", k, v, last[k])
+		}
+	}
+	if last["instance"] == "" || last["instance"] == ps.requests[0]["instance"] {
+		t.Errorf("expected a new instance for each transaction, got %q", last["instance"])
+	}
+}
+
+func TestPolicyBackend_unavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	for _, failOpen := range []bool{false, true} {
+		be := &backendutil.PolicyBackend{
+			Backend:  &backendutil.MemoryBackend{AllowAnonymous: true},
+			Client:   &backendutil.PolicyClient{Network: "tcp", Addr: addr},
+			FailOpen: failOpen,
+		}
+		s, err := be.AnonymousLogin(nil)
+		if err != nil {
+			t.Fatalf("AnonymousLogin: %v", err)
+		}
+		if err := s.Mail("alice@example.org"); err != nil {
+			t.Fatalf("Mail: %v", err)
+		}
+		err = s.Rcpt("bob@example.org")
+		if failOpen && err != nil {
+			t.Errorf("Rcpt with FailOpen: %v", err)
+		} else if smtpErr, ok := err.(*smtp.SMTPError); !failOpen && (!ok || smtpErr.Code != 451) {
+			t.Errorf("Rcpt: expected a 451 error, got %v", err)
+		}
+	}
+}
+
+func TestPolicyError(t *testing.T) {
+	for _, test := range []struct {
+		action  string
+		code    int
+		ec      smtp.EnhancedCode
+		message string
+	}{
+		{"OK", 0, smtp.EnhancedCode{}, ""},
+		{"DUNNO", 0, smtp.EnhancedCode{}, ""},
+		{"PREPEND X-Policy: yes", 0, smtp.EnhancedCode{}, ""},
+		{"reject", 554, smtp.EnhancedCode{5, 7, 1}, "Access denied"},
+		{"DEFER Slow down", 450, smtp.EnhancedCode{4, 7, 1}, "Slow down"},
+		{"450 4.7.25 Client host rejected", 450, smtp.EnhancedCode{4, 7, 25}, "Client host rejected"},
+		{"550 Nope", 550, smtp.EnhancedCode{5, 0, 0}, "Nope"},
+		{"550 4.1.1 Mismatch", 550, smtp.EnhancedCode{5, 0, 0}, "4.1.1 Mismatch"},
+		{"250 Fine", 0, smtp.EnhancedCode{}, ""},
+	} {
+		err := backendutil.PolicyError(test.action)
+		if test.code == 0 {
+			if err != nil {
+				t.Errorf("PolicyError(%q): expected no error, got %v", test.action, err)
+			}
+			continue
+		}
+		smtpErr, ok := err.(*smtp.SMTPError)
+		if !ok || smtpErr.Code != test.code || smtpErr.EnhancedCode != test.ec || smtpErr.Message != test.message {
+			t.Errorf("PolicyError(%q) = %#v", test.action, err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package backendutil
+
+import (
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// PostmasterBackend is a backend delivering mail sent to the postmaster and
+// abuse addresses to operator-defined destinations.
+//
+// Mail to "<Postmaster>", without a domain, and to postmaster@domain for each
+// of Domains is delivered to Postmaster. Mail to abuse@domain is delivered to
+// Abuse, if set. Destinations are passed to the underlying backend, which
+// must accept them: RFC 5321 section 4.5.1 requires servers to accept mail
+// to "<Postmaster>", even if they don't relay mail for the client.
+type PostmasterBackend struct {
+	Backend smtp.Backend
+	// Postmaster is the address mail to postmaster is delivered to. If
+	// empty, mail to postmaster is passed to the underlying backend as-is.
+	Postmaster string
+	// If not empty, Abuse is the address mail to abuse is delivered to.
+	Abuse string
+	// Domains whose postmaster and abuse addresses are redirected.
+	Domains []string
+}
+
+// Login implements the smtp.Backend interface.
+func (be *PostmasterBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	s, err := be.Backend.Login(state, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &postmasterSession{Session: s, be: be}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *PostmasterBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	s, err := be.Backend.AnonymousLogin(state)
+	if err != nil {
+		return nil, err
+	}
+	return &postmasterSession{Session: s, be: be}, nil
+}
+
+// destination returns the address mail to rcpt is delivered to, or an empty
+// string if rcpt isn't redirected.
+func (be *PostmasterBackend) destination(rcpt string) string {
+	rcpt = strings.ToLower(rcpt)
+	if rcpt == "postmaster" {
+		return be.Postmaster
+	}
+	at := strings.LastIndexByte(rcpt, '@')
+	if at < 0 {
+		return ""
+	}
+	localPart, domain := rcpt[:at], rcpt[at+1:]
+
+	var dest string
+	switch localPart {
+	case "postmaster":
+		dest = be.Postmaster
+	case "abuse":
+		dest = be.Abuse
+	}
+	if dest == "" {
+		return ""
+	}
+	for _, d := range be.Domains {
+		if strings.EqualFold(d, domain) {
+			return dest
+		}
+	}
+	return ""
+}
+
+type postmasterSession struct {
+	smtp.Session
+
+	be *PostmasterBackend
+	// Destinations already added to the current transaction
+	dests map[string]bool
+}
+
+func (s *postmasterSession) Reset() {
+	s.dests = nil
+	s.Session.Reset()
+}
+
+func (s *postmasterSession) Mail(from string) error {
+	s.dests = nil
+	return s.Session.Mail(from)
+}
+
+func (s *postmasterSession) Rcpt(to string) error {
+	dest := s.be.destination(to)
+	if dest == "" {
+		return s.Session.Rcpt(to)
+	}
+	return s.rcptDest(dest)
+}
+
+// RcptPostmaster implements the smtp.PostmasterSession interface.
+func (s *postmasterSession) RcptPostmaster(to string) error {
+	if s.be.Postmaster == "" {
+		if ps, ok := s.Session.(smtp.PostmasterSession); ok {
+			return ps.RcptPostmaster(to)
+		}
+		return s.Session.Rcpt(to)
+	}
+	return s.rcptDest(s.be.Postmaster)
+}
+
+// rcptDest adds a destination once to the current transaction, as several
+// redirected addresses may share it.
+func (s *postmasterSession) rcptDest(dest string) error {
+	key := strings.ToLower(dest)
+	if s.dests[key] {
+		return nil
+	}
+	if err := s.Session.Rcpt(dest); err != nil {
+		return err
+	}
+	if s.dests == nil {
+		s.dests = make(map[string]bool)
+	}
+	s.dests[key] = true
+	return nil
+}
@@ -0,0 +1,95 @@
+package backendutil_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.PostmasterBackend{}
+
+func TestPostmasterBackend(t *testing.T) {
+	mem := &backendutil.MemoryBackend{AllowAnonymous: true}
+	router := &backendutil.RouterBackend{
+		Domains: map[string]*backendutil.Domain{
+			"example.org": {Backend: mem},
+		},
+	}
+	be := &backendutil.PostmasterBackend{
+		Backend:    router,
+		Postmaster: "ops@example.org",
+		Abuse:      "abuse-desk@example.org",
+		Domains:    []string{"example.org", "example.net"},
+	}
+
+	s, err := be.AnonymousLogin(&smtp.ConnectionState{})
+	if err != nil {
+		t.Fatalf("AnonymousLogin: %v", err)
+	}
+	if err := s.Mail("alice@example.com"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	ps, ok := s.(smtp.PostmasterSession)
+	if !ok {
+		t.Fatal("session doesn't implement smtp.PostmasterSession")
+	}
+	if err := ps.RcptPostmaster("Postmaster"); err != nil {
+		t.Fatalf("RcptPostmaster: %v", err)
+	}
+	// example.net isn't relayed, but its postmaster and abuse addresses are
+	// redirected
+	for _, rcpt := range []string{"Postmaster@example.net", "abuse@EXAMPLE.net", "bob@example.org"} {
+		if err := s.Rcpt(rcpt); err != nil {
+			t.Fatalf("Rcpt(%q): %v", rcpt, err)
+		}
+	}
+	for _, rcpt := range []string{"carol@example.net", "abuse@example.com"} {
+		if err := s.Rcpt(rcpt); err == nil {
+			t.Errorf("Rcpt(%q): expected an error", rcpt)
+		}
+	}
+	if err := s.Data(strings.NewReader("Hello!\n")); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+
+	for rcpt, want := range map[string]int{"ops@example.org": 1, "abuse-desk@example.org": 1, "bob@example.org": 1} {
+		if n := len(mem.Mailbox(rcpt)); n != want {
+			t.Errorf("Mailbox(%q): got %v messages, want %v", rcpt, n, want)
+		}
+	}
+}
+
+func TestPostmasterBackend_abuseOnly(t *testing.T) {
+	mem := &backendutil.MemoryBackend{AllowAnonymous: true}
+	be := &backendutil.PostmasterBackend{
+		Backend: mem,
+		Abuse:   "abuse-desk@example.org",
+		Domains: []string{"example.org"},
+	}
+
+	s, err := be.AnonymousLogin(&smtp.ConnectionState{})
+	if err != nil {
+		t.Fatalf("AnonymousLogin: %v", err)
+	}
+	if err := s.Mail("alice@example.com"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	// Without a Postmaster destination, mail to postmaster isn't redirected
+	if err := s.(smtp.PostmasterSession).RcptPostmaster("Postmaster"); err != nil {
+		t.Fatalf("RcptPostmaster: %v", err)
+	}
+	if err := s.Rcpt("postmaster@example.org"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	if err := s.Data(strings.NewReader("Hello!\n")); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+
+	for rcpt, want := range map[string]int{"Postmaster": 1, "postmaster@example.org": 1, "": 0} {
+		if n := len(mem.Mailbox(rcpt)); n != want {
+			t.Errorf("Mailbox(%q): got %v messages, want %v", rcpt, n, want)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package backendutil
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ProxyBackend is a backend forwarding transactions to upstream SMTP servers,
+// to use a server as an SMTP load balancer.
+//
+// Each transaction is forwarded as it happens to one upstream server: MAIL
+// picks an upstream by weighted round-robin, then RCPT and DATA replies are
+// those of the upstream. An upstream failing to accept the sender with a
+// connection error or a temporary error is avoided for Cooldown, and the next
+// one is tried. Connections to upstreams are kept open and reused across
+// transactions and clients.
+//
+// If upstreams advertise XCLIENT, the address, port, HELO name and login of
+// the client are forwarded. Upstreams must trust the proxy to accept it.
+type ProxyBackend struct {
+	// Upstreams are the servers transactions are forwarded to. Their Addr
+	// is "host:port".
+	Upstreams []Smarthost
+	// Cooldown is the time a failing upstream is avoided for. If zero,
+	// DefaultSmarthostCooldown is used.
+	Cooldown time.Duration
+	// The maximum number of idle connections kept open per upstream. If
+	// zero, 2 is used. If negative, connections aren't reused.
+	MaxIdle int
+
+	// Dialer is used to connect to upstreams. If nil, a zero Dialer is used.
+	Dialer *smtp.Dialer
+	// TLSConfig is used for STARTTLS, which is issued if supported by the
+	// upstream.
+	TLSConfig *tls.Config
+	// If set, XCLIENT isn't used even if upstreams support it.
+	DisableXClient bool
+
+	// Auth checks credentials. If nil, authentication is not supported.
+	Auth func(username, password string) error
+	// Now returns the current time, used for the upstream cooldown. If nil,
+	// time.Now is used.
+	Now func() time.Time
+
+	balancerMu sync.Mutex
+	balancer   *smarthostBalancer
+	mu         sync.Mutex
+	idle       map[string][]*smtp.Client
+	closed     bool
+}
+
+// Login implements the smtp.Backend interface.
+func (be *ProxyBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if be.Auth == nil {
+		return nil, smtp.ErrAuthUnsupported
+	}
+	if err := be.Auth(username, password); err != nil {
+		return nil, err
+	}
+	return &proxySession{be: be, state: state, username: username}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *ProxyBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return &proxySession{be: be, state: state}, nil
+}
+
+func (be *ProxyBackend) upstreams() *smarthostBalancer {
+	be.balancerMu.Lock()
+	defer be.balancerMu.Unlock()
+
+	if be.balancer == nil || !be.balancer.configured(be.Upstreams) {
+		be.balancer = newSmarthostBalancer(be.Upstreams)
+	}
+	return be.balancer
+}
+
+func (be *ProxyBackend) cooldown() time.Duration {
+	if be.Cooldown > 0 {
+		return be.Cooldown
+	}
+	return DefaultSmarthostCooldown
+}
+
+func (be *ProxyBackend) now() time.Time {
+	if be.Now != nil {
+		return be.Now()
+	}
+	return time.Now()
+}
+
+// UpstreamStatus returns the health of the upstreams.
+func (be *ProxyBackend) UpstreamStatus() []SmarthostStatus {
+	return be.upstreams().status(be.now())
+}
+
+// CheckUpstreams connects to each upstream and updates its health. It can be
+// called periodically to detect failures and recoveries without waiting for
+// transactions.
+func (be *ProxyBackend) CheckUpstreams() {
+	b := be.upstreams()
+	var wg sync.WaitGroup
+	for _, sh := range b.hosts {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			err := be.check(addr)
+			b.record(addr, err, be.now(), be.cooldown())
+		}(sh.Addr)
+	}
+	wg.Wait()
+}
+
+func (be *ProxyBackend) check(addr string) error {
+	c, err := be.dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.Noop(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Close closes the idle connections to upstreams.
+func (be *ProxyBackend) Close() error {
+	be.mu.Lock()
+	idle := be.idle
+	be.idle = nil
+	be.closed = true
+	be.mu.Unlock()
+
+	for _, l := range idle {
+		for _, c := range l {
+			c.Quit()
+			c.Close()
+		}
+	}
+	return nil
+}
+
+func (be *ProxyBackend) dial(addr string) (*smtp.Client, error) {
+	d := be.Dialer
+	if d == nil {
+		d = &smtp.Dialer{}
+	}
+	c, err := d.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	c.TLSConfig = be.TLSConfig
+	c.StartTLSPolicy = smtp.StartTLSOpportunistic
+	return c, nil
+}
+
+// get returns an idle connection to an upstream, or nil.
+func (be *ProxyBackend) get(addr string) *smtp.Client {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	l := be.idle[addr]
+	if len(l) == 0 {
+		return nil
+	}
+	c := l[len(l)-1]
+	be.idle[addr] = l[:len(l)-1]
+	return c
+}
+
+// put resets a connection and returns it to the pool, or closes it.
+func (be *ProxyBackend) put(addr string, c *smtp.Client) {
+	maxIdle := be.MaxIdle
+	if maxIdle == 0 {
+		maxIdle = 2
+	}
+	if maxIdle < 0 || c.Reset() != nil {
+		c.Close()
+		return
+	}
+
+	be.mu.Lock()
+	if !be.closed && len(be.idle[addr]) < maxIdle {
+		if be.idle == nil {
+			be.idle = make(map[string][]*smtp.Client)
+		}
+		be.idle[addr] = append(be.idle[addr], c)
+		c = nil
+	}
+	be.mu.Unlock()
+
+	if c != nil {
+		c.Quit()
+		c.Close()
+	}
+}
+
+var errNoUpstream = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+	Message:      "No upstream server available",
+}
+
+type proxySession struct {
+	be       *ProxyBackend
+	state    *smtp.ConnectionState
+	username string
+
+	addr   string
+	client *smtp.Client
+}
+
+// xclient returns the XCLIENT attributes of the client supported by c.
+//
+// Connections are shared between clients, and XCLIENT only overrides the
+// attributes it is given, so every supported attribute is sent, unknown ones
+// as XClientUnavailable.
+func (s *proxySession) xclient(c *smtp.Client) map[string]string {
+	ok, params := c.Extension("XCLIENT")
+	if !ok || s.be.DisableXClient {
+		return nil
+	}
+
+	attrs := map[string]string{
+		smtp.XClientProto: "ESMTP",
+		smtp.XClientName:  smtp.XClientUnavailable,
+		smtp.XClientHelo:  smtp.XClientUnavailable,
+		smtp.XClientAddr:  smtp.XClientUnavailable,
+		smtp.XClientPort:  smtp.XClientUnavailable,
+		smtp.XClientLogin: smtp.XClientUnavailable,
+	}
+	if s.state != nil && s.state.Hostname != "" {
+		attrs[smtp.XClientHelo] = s.state.Hostname
+	}
+	if s.state != nil && s.state.RemoteAddr != nil {
+		if host, port, err := net.SplitHostPort(s.state.RemoteAddr.String()); err == nil {
+			if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+				host = "IPV6:" + host
+			}
+			attrs[smtp.XClientAddr] = host
+			attrs[smtp.XClientPort] = port
+		}
+	}
+	if s.username != "" {
+		attrs[smtp.XClientLogin] = s.username
+	}
+
+	supported := make(map[string]bool)
+	for _, name := range strings.Fields(params) {
+		supported[strings.ToUpper(name)] = true
+	}
+	for name := range attrs {
+		if !supported[name] {
+			delete(attrs, name)
+		}
+	}
+	return attrs
+}
+
+// open starts a transaction on an upstream. A pooled connection may have been
+// closed by the upstream in the meantime, a new one is opened in this case.
+func (s *proxySession) open(addr, from string) (c *smtp.Client, err error) {
+	reused := true
+	c = s.be.get(addr)
+	if c == nil {
+		reused = false
+		if c, err = s.be.dial(addr); err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.start(c, from)
+	if err != nil && reused {
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) {
+			c.Close()
+			if c, err = s.be.dial(addr); err != nil {
+				return nil, err
+			}
+			err = s.start(c, from)
+		}
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *proxySession) start(c *smtp.Client, from string) error {
+	// Extension sends EHLO on new connections
+	if attrs := s.xclient(c); len(attrs) > 0 {
+		if err := c.XClient(attrs); err != nil {
+			return err
+		}
+	}
+	return c.Mail(from)
+}
+
+func (s *proxySession) Reset() {
+	if s.client != nil {
+		s.be.put(s.addr, s.client)
+		s.client = nil
+	}
+}
+
+func (s *proxySession) Logout() error {
+	s.Reset()
+	return nil
+}
+
+func (s *proxySession) Mail(from string) error {
+	s.Reset()
+
+	b := s.be.upstreams()
+	var err error = errNoUpstream
+	for _, addr := range b.order(s.be.now()) {
+		var c *smtp.Client
+		c, err = s.open(addr, from)
+		b.record(addr, err, s.be.now(), s.be.cooldown())
+		if err == nil {
+			s.addr, s.client = addr, c
+			return nil
+		}
+		if isPermanent(err) {
+			return relayError(err)
+		}
+	}
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr
+	}
+	return errNoUpstream
+}
+
+func (s *proxySession) Rcpt(to string) error {
+	if s.client == nil {
+		return errNoUpstream
+	}
+	err := s.client.Rcpt(to)
+	if utf8Err, ok := err.(*smtp.SMTPUTF8RequiredError); ok {
+		return utf8Err.SMTPError()
+	}
+	return err
+}
+
+func (s *proxySession) Data(r io.Reader) error {
+	if s.client == nil {
+		return errNoUpstream
+	}
+
+	// The transaction ends with DATA, whether it succeeds or not
+	c := s.client
+	defer s.Reset()
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		// Closing the writer would forward a truncated message
+		c.Close()
+		s.client = nil
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,217 @@
+package backendutil_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+	"github.com/emersion/go-smtp/smtptest"
+)
+
+var _ smtp.Backend = &backendutil.ProxyBackend{}
+
+func TestProxyBackend(t *testing.T) {
+	up1 := smtptest.NewServer()
+	defer up1.Close()
+	up2 := smtptest.NewServer()
+	defer up2.Close()
+
+	be := &backendutil.ProxyBackend{
+		Upstreams: []backendutil.Smarthost{{Addr: up1.Addr, Weight: 2}, {Addr: up2.Addr}},
+	}
+	defer be.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := sendMessage(t, be, "alice@example.org", []string{"bob@example.com"}, "Hello!\n"); err != nil {
+			t.Fatalf("Data: %v", err)
+		}
+	}
+	msgs := up1.ExpectMessages(t, 2)
+	up2.ExpectMessages(t, 1)
+	if msgs[0].From != "alice@example.org" || msgs[0].To[0] != "bob@example.com" || string(msgs[0].Data) != "Hello!\n" {
+		t.Errorf("unexpected message: %+v", msgs[0])
+	}
+
+	// Upstream replies are forwarded as-is
+	authUp := smtptest.NewUnstartedServer()
+	authUp.AuthRequired = true
+	authUp.Start()
+	defer authUp.Close()
+	be.Upstreams = []backendutil.Smarthost{{Addr: authUp.Addr}}
+	s, err := be.AnonymousLogin(nil)
+	if err != nil {
+		t.Fatalf("AnonymousLogin: %v", err)
+	}
+	defer s.Logout()
+	err = s.Mail("alice@example.org")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code/100 != 5 {
+		t.Errorf("Mail: expected a permanent error, got %v", err)
+	}
+}
+
+func TestProxyBackend_failover(t *testing.T) {
+	up := smtptest.NewServer()
+	defer up.Close()
+
+	// Reserve an address nobody listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	be := &backendutil.ProxyBackend{
+		Upstreams: []backendutil.Smarthost{{Addr: down}, {Addr: up.Addr}},
+	}
+	defer be.Close()
+	for i := 0; i < 2; i++ {
+		if err := sendMessage(t, be, "alice@example.org", []string{"bob@example.com"}, "Hello!\n"); err != nil {
+			t.Fatalf("Data: %v", err)
+		}
+	}
+	up.ExpectMessages(t, 2)
+
+	status := be.UpstreamStatus()
+	if len(status) != 2 || status[0].Healthy || status[0].Err == nil || !status[1].Healthy {
+		t.Errorf("unexpected upstream status: %+v", status)
+	}
+
+	be.Upstreams = []backendutil.Smarthost{{Addr: down}}
+	s, err := be.AnonymousLogin(nil)
+	if err != nil {
+		t.Fatalf("AnonymousLogin: %v", err)
+	}
+	err = s.Mail("alice@example.org")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 451 {
+		t.Errorf("expected a 451 error without upstreams, got %v", err)
+	}
+}
+
+func TestProxyBackend_xclient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var (
+		mu    sync.Mutex
+		lines []string
+		conns int
+	)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns++
+			mu.Unlock()
+			go func() {
+				defer c.Close()
+				io.WriteString(c, "220 upstream ESMTP\r\n")
+				br := bufio.NewReader(c)
+				data := false
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimSuffix(line, "\r\n")
+					if data {
+						if line == "." {
+							data = false
+							io.WriteString(c, "250 Queued\r\n")
+						}
+						continue
+					}
+					mu.Lock()
+					lines = append(lines, line)
+					mu.Unlock()
+					switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+					case "EHLO":
+						io.WriteString(c, "250-upstream\r\n250 XCLIENT ADDR PORT HELO PROTO LOGIN\r\n")
+					case "XCLIENT":
+						io.WriteString(c, "220 upstream ESMTP\r\n")
+					case "DATA":
+						data = true
+						io.WriteString(c, "354 Go ahead\r\n")
+					case "QUIT":
+						io.WriteString(c, "221 Bye\r\n")
+						return
+					default:
+						io.WriteString(c, "250 OK\r\n")
+					}
+				}
+			}()
+		}
+	}()
+
+	be := &backendutil.ProxyBackend{
+		Upstreams: []backendutil.Smarthost{{Addr: l.Addr().String()}},
+		Auth: func(username, password string) error {
+			return nil
+		},
+	}
+	defer be.Close()
+
+	// The same connection is used for all clients, a client must not inherit
+	// the login of the previous one
+	for _, username := range []string{"", "alice", ""} {
+		state := &smtp.ConnectionState{
+			Hostname:   "client.example.org",
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234},
+		}
+		var s smtp.Session
+		if username == "" {
+			s, err = be.AnonymousLogin(state)
+		} else {
+			s, err = be.Login(state, username, "secret")
+		}
+		if err != nil {
+			t.Fatalf("Login: %v", err)
+		}
+		if err := s.Mail("alice@example.org"); err != nil {
+			t.Fatalf("Mail: %v", err)
+		}
+		if err := s.Rcpt("bob@example.com"); err != nil {
+			t.Fatalf("Rcpt: %v", err)
+		}
+		if err := s.Data(strings.NewReader("Hello!\n")); err != nil {
+			t.Fatalf("Data: %v", err)
+		}
+		s.Logout()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 1 {
+		t.Errorf("expected the upstream connection to be reused, got %v connections", conns)
+	}
+	var xclients []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "XCLIENT") {
+			xclients = append(xclients, line)
+		}
+	}
+	want := []string{
+		"XCLIENT ADDR=IPV6:2001:db8::1 HELO=client.example.org LOGIN=[UNAVAILABLE] PORT=1234 PROTO=ESMTP",
+		"XCLIENT ADDR=IPV6:2001:db8::1 HELO=client.example.org LOGIN=alice PORT=1234 PROTO=ESMTP",
+		"XCLIENT ADDR=IPV6:2001:db8::1 HELO=client.example.org LOGIN=[UNAVAILABLE] PORT=1234 PROTO=ESMTP",
+	}
+	if len(xclients) != len(want) {
+		t.Fatalf("unexpected XCLIENT commands: %q", xclients)
+	}
+	for i := range want {
+		if xclients[i] != want[i] {
+			t.Errorf("XCLIENT command #%v: got %q, want %q", i, xclients[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package backendutil
+
+import (
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Record is a message published to a message queue by a PublishBackend.
+type Record struct {
+	// The Kafka topic or NATS subject.
+	Topic string
+	// The partitioning key. With PartitionByDomain, this is the recipient
+	// domain.
+	Key string
+	// Envelope metadata, to be sent as Kafka record headers or NATS message
+	// headers.
+	Header map[string][]string
+	// The raw message.
+	Payload []byte
+}
+
+// Header fields set on published records.
+const (
+	RecordHeaderFrom     = "Smtp-Mail-From"
+	RecordHeaderTo       = "Smtp-Rcpt-To"
+	RecordHeaderUsername = "Smtp-Username"
+	RecordHeaderReceived = "Smtp-Received"
+)
+
+// Publisher publishes records to a message queue, such as Kafka or NATS
+// JetStream. Publish must only return once the record has been durably
+// acknowledged by the queue.
+//
+// This package doesn't depend on any queue client library: an implementation
+// is typically a thin adapter around a Kafka producer or a JetStream context.
+type Publisher interface {
+	Publish(rec *Record) error
+}
+
+// PublishBackend is a backend publishing each message to a message queue, for
+// asynchronous processing.
+type PublishBackend struct {
+	Publisher Publisher
+	// The Kafka topic or NATS subject records are published to.
+	Topic string
+	// If set, one record is published per recipient domain, listing only the
+	// recipients of that domain and keyed by the domain. Otherwise, a single
+	// record with an empty key is published.
+	PartitionByDomain bool
+
+	// Auth checks credentials, e.g. UserMap.Auth. If nil, authentication is
+	// not supported.
+	Auth func(username, password string) error
+	// If set, clients can send mail without authenticating.
+	AllowAnonymous bool
+}
+
+// Login implements the smtp.Backend interface.
+func (be *PublishBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if err := login(be.Auth, username, password); err != nil {
+		return nil, err
+	}
+	return &publishSession{be: be, username: username}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *PublishBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	if !be.AllowAnonymous {
+		return nil, smtp.ErrAuthRequired
+	}
+	return &publishSession{be: be}, nil
+}
+
+type publishSession struct {
+	be       *PublishBackend
+	username string
+	from     string
+	to       []string
+}
+
+func (s *publishSession) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *publishSession) Logout() error {
+	return nil
+}
+
+func (s *publishSession) Mail(from string) error {
+	s.Reset()
+	s.from = from
+	return nil
+}
+
+func (s *publishSession) Rcpt(to string) error {
+	s.to = append(s.to, to)
+	return nil
+}
+
+// partitions groups recipients by partitioning key.
+func (s *publishSession) partitions() ([]string, map[string][]string) {
+	if !s.be.PartitionByDomain {
+		return []string{""}, map[string][]string{"": s.to}
+	}
+
+	m := make(map[string][]string)
+	for _, to := range s.to {
+		var domain string
+		if i := strings.LastIndexByte(to, '@'); i >= 0 {
+			domain = strings.ToLower(to[i+1:])
+		}
+		m[domain] = append(m[domain], to)
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, m
+}
+
+func (s *publishSession) Data(r io.Reader) error {
+	payload, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	received := time.Now().UTC().Format(time.RFC3339)
+	keys, rcpts := s.partitions()
+	for _, key := range keys {
+		rec := &Record{
+			Topic: s.be.Topic,
+			Key:   key,
+			Header: map[string][]string{
+				RecordHeaderFrom:     {s.from},
+				RecordHeaderTo:       rcpts[key],
+				RecordHeaderReceived: {received},
+			},
+			Payload: payload,
+		}
+		if s.username != "" {
+			rec.Header[RecordHeaderUsername] = []string{s.username}
+		}
+
+		if err := s.be.Publisher.Publish(rec); err != nil {
+			return &smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+				Message:      "Failed to queue message",
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package backendutil_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.PublishBackend{}
+
+type publisherFunc func(rec *backendutil.Record) error
+
+func (f publisherFunc) Publish(rec *backendutil.Record) error {
+	return f(rec)
+}
+
+func TestPublishBackend(t *testing.T) {
+	var records []*backendutil.Record
+	be := &backendutil.PublishBackend{
+		Publisher: publisherFunc(func(rec *backendutil.Record) error {
+			records = append(records, rec)
+			return nil
+		}),
+		Topic:             "mail.incoming",
+		PartitionByDomain: true,
+		AllowAnonymous:    true,
+	}
+
+	to := []string{"bob@example.org", "carol@example.net", "dave@EXAMPLE.org"}
+	if err := sendMessage(t, be, "alice@example.com", to, "Hello!\n"); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %v", len(records))
+	}
+	if records[0].Key != "example.net" || records[1].Key != "example.org" {
+		t.Errorf("unexpected keys %q, %q", records[0].Key, records[1].Key)
+	}
+	rec := records[1]
+	if rec.Topic != "mail.incoming" {
+		t.Errorf("Topic = %q, want mail.incoming", rec.Topic)
+	}
+	if rcpts := rec.Header[backendutil.RecordHeaderTo]; len(rcpts) != 2 || rcpts[0] != "bob@example.org" || rcpts[1] != "dave@EXAMPLE.org" {
+		t.Errorf("unexpected recipients %v", rcpts)
+	}
+	if from := rec.Header[backendutil.RecordHeaderFrom]; len(from) != 1 || from[0] != "alice@example.com" {
+		t.Errorf("unexpected sender %v", from)
+	}
+	if string(rec.Payload) != "Hello!\n" {
+		t.Errorf("unexpected payload %q", rec.Payload)
+	}
+
+	be.Publisher = publisherFunc(func(rec *backendutil.Record) error {
+		return errors.New("broker unavailable")
+	})
+	err := sendMessage(t, be, "alice@example.com", to, "Hello!\n")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code/100 != 4 {
+		t.Errorf("Data: expected temporary SMTP error, got %v", err)
+	}
+}
@@ -0,0 +1,284 @@
+package backendutil
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ErrQuarantineNotFound is returned by Quarantine implementations when a
+// message doesn't exist.
+var ErrQuarantineNotFound = errors.New("backendutil: quarantined message not found")
+
+// QuarantinedMessage is a message retained for review instead of being
+// delivered.
+type QuarantinedMessage struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// The client address and HELO name, if known.
+	RemoteAddr string   `json:"remote_addr,omitempty"`
+	Hostname   string   `json:"hostname,omitempty"`
+	From       string   `json:"from"`
+	To         []string `json:"to"`
+	// Verdict explains why the message was quarantined, for instance the
+	// reason of a rejection.
+	Verdict string `json:"verdict"`
+	// The message data, not populated by Quarantine.List.
+	Data []byte `json:"-"`
+}
+
+// newQuarantinedMessage creates a quarantined message with a new ID.
+func newQuarantinedMessage(state *smtp.ConnectionState, from string, to []string, verdict string, data []byte) *QuarantinedMessage {
+	var b [8]byte
+	rand.Read(b[:])
+	msg := &QuarantinedMessage{
+		ID:      hex.EncodeToString(b[:]),
+		Time:    time.Now().UTC(),
+		From:    from,
+		To:      append([]string(nil), to...),
+		Verdict: verdict,
+		Data:    data,
+	}
+	if state != nil {
+		msg.Hostname = state.Hostname
+		if state.RemoteAddr != nil {
+			msg.RemoteAddr = state.RemoteAddr.String()
+		}
+	}
+	return msg
+}
+
+// Quarantine stores messages rejected or dropped by content filters, so that
+// operators can review and release them. It must be safe for concurrent use.
+type Quarantine interface {
+	// Put stores a message.
+	Put(msg *QuarantinedMessage) error
+	// List returns the stored messages without their data, oldest first.
+	List() ([]*QuarantinedMessage, error)
+	// Get returns a stored message with its data.
+	Get(id string) (*QuarantinedMessage, error)
+	// Delete removes a stored message.
+	Delete(id string) error
+}
+
+// ReleaseQuarantined delivers a quarantined message to its recipients through
+// a backend, then removes it from the quarantine. The message is delivered
+// with an anonymous session, so the backend must not filter it again.
+func ReleaseQuarantined(q Quarantine, id string, be smtp.Backend) error {
+	msg, err := q.Get(id)
+	if err != nil {
+		return err
+	}
+
+	s, err := be.AnonymousLogin(nil)
+	if err != nil {
+		return err
+	}
+	defer s.Logout()
+	if err := s.Mail(msg.From); err != nil {
+		return err
+	}
+	for _, to := range msg.To {
+		if err := s.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	if err := s.Data(bytes.NewReader(msg.Data)); err != nil {
+		return err
+	}
+	return q.Delete(id)
+}
+
+// MemoryQuarantine is a Quarantine keeping messages in memory.
+type MemoryQuarantine struct {
+	mu   sync.Mutex
+	msgs map[string]*QuarantinedMessage
+}
+
+// Put implements Quarantine.
+func (q *MemoryQuarantine) Put(msg *QuarantinedMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.msgs == nil {
+		q.msgs = make(map[string]*QuarantinedMessage)
+	}
+	q.msgs[msg.ID] = msg
+	return nil
+}
+
+// List implements Quarantine.
+func (q *MemoryQuarantine) List() ([]*QuarantinedMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	l := make([]*QuarantinedMessage, 0, len(q.msgs))
+	for _, msg := range q.msgs {
+		meta := *msg
+		meta.Data = nil
+		l = append(l, &meta)
+	}
+	sortQuarantined(l)
+	return l, nil
+}
+
+// Get implements Quarantine.
+func (q *MemoryQuarantine) Get(id string) (*QuarantinedMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	msg, ok := q.msgs[id]
+	if !ok {
+		return nil, ErrQuarantineNotFound
+	}
+	return msg, nil
+}
+
+// Delete implements Quarantine.
+func (q *MemoryQuarantine) Delete(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.msgs[id]; !ok {
+		return ErrQuarantineNotFound
+	}
+	delete(q.msgs, id)
+	return nil
+}
+
+// DirQuarantine is a Quarantine storing each message in a directory, as an
+// ID.eml file with its metadata in an ID.json file. The directory is created
+// if necessary.
+type DirQuarantine struct {
+	Dir string
+}
+
+func (q *DirQuarantine) path(id, ext string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return "", fmt.Errorf("backendutil: invalid quarantine ID %q", id)
+	}
+	return filepath.Join(q.Dir, id+ext), nil
+}
+
+// Put implements Quarantine.
+func (q *DirQuarantine) Put(msg *QuarantinedMessage) error {
+	emlPath, err := q.path(msg.ID, ".eml")
+	if err != nil {
+		return err
+	}
+	jsonPath, _ := q.path(msg.ID, ".json")
+	meta, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(q.Dir, 0700); err != nil {
+		return err
+	}
+	// The metadata is written last, messages without it are ignored
+	if err := writeFileAtomic(emlPath, msg.Data); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(jsonPath, meta); err != nil {
+		os.Remove(emlPath)
+		return err
+	}
+	return nil
+}
+
+// List implements Quarantine.
+func (q *DirQuarantine) List() ([]*QuarantinedMessage, error) {
+	paths, err := filepath.Glob(filepath.Join(q.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	l := make([]*QuarantinedMessage, 0, len(paths))
+	for _, path := range paths {
+		msg, err := readQuarantineMeta(path)
+		if os.IsNotExist(err) {
+			continue // Deleted concurrently
+		} else if err != nil {
+			return nil, err
+		}
+		l = append(l, msg)
+	}
+	sortQuarantined(l)
+	return l, nil
+}
+
+// Get implements Quarantine.
+func (q *DirQuarantine) Get(id string) (*QuarantinedMessage, error) {
+	jsonPath, err := q.path(id, ".json")
+	if err != nil {
+		return nil, err
+	}
+	msg, err := readQuarantineMeta(jsonPath)
+	if os.IsNotExist(err) {
+		return nil, ErrQuarantineNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	emlPath, _ := q.path(id, ".eml")
+	if msg.Data, err = ioutil.ReadFile(emlPath); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Delete implements Quarantine.
+func (q *DirQuarantine) Delete(id string) error {
+	jsonPath, err := q.path(id, ".json")
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(jsonPath); os.IsNotExist(err) {
+		return ErrQuarantineNotFound
+	} else if err != nil {
+		return err
+	}
+	emlPath, _ := q.path(id, ".eml")
+	return os.Remove(emlPath)
+}
+
+func readQuarantineMeta(path string) (*QuarantinedMessage, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	msg := new(QuarantinedMessage)
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, fmt.Errorf("backendutil: failed to load %v: %v", path, err)
+	}
+	return msg, nil
+}
+
+func sortQuarantined(l []*QuarantinedMessage) {
+	sort.Slice(l, func(i, j int) bool {
+		if !l[i].Time.Equal(l[j].Time) {
+			return l[i].Time.Before(l[j].Time)
+		}
+		return l[i].ID < l[j].ID
+	})
+}
+
+// writeFileAtomic writes a file through a temporary file, so that readers
+// never see partial contents.
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
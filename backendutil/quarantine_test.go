@@ -0,0 +1,109 @@
+package backendutil_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+	"github.com/emersion/go-smtp/sieve"
+)
+
+var (
+	_ backendutil.Quarantine = &backendutil.MemoryQuarantine{}
+	_ backendutil.Quarantine = &backendutil.DirQuarantine{}
+)
+
+func TestQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp-quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, q := range map[string]backendutil.Quarantine{
+		"memory": &backendutil.MemoryQuarantine{},
+		"dir":    &backendutil.DirQuarantine{Dir: dir},
+	} {
+		t.Run(name, func(t *testing.T) {
+			testQuarantine(t, q)
+		})
+	}
+}
+
+func testQuarantine(t *testing.T, q backendutil.Quarantine) {
+	script, err := sieve.Parse(`require ["reject"];
+if header :is "Subject" "Reject" {
+	reject "Not welcome here";
+} elsif header :is "Subject" "Discard" {
+	discard;
+}`)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	inbox := &backendutil.MemoryBackend{AllowAnonymous: true}
+	be := &backendutil.FilterBackend{
+		Backend: inbox,
+		Script: func(rcpt string) (*sieve.Script, error) {
+			if rcpt == "bob@example.org" {
+				return script, nil
+			}
+			return nil, nil
+		},
+		Quarantine: q,
+	}
+
+	to := []string{"alice@example.org", "bob@example.org"}
+	if err := sendMessage(t, be, "eve@example.com", to, "Subject: Discard\n\nHi\n"); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	err = sendMessage(t, be, "eve@example.com", []string{"bob@example.org"}, "Subject: Reject\n\nHi\n")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 550 {
+		t.Errorf("Data: expected rejection, got %v", err)
+	}
+
+	l, err := q.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(l) != 2 {
+		t.Fatalf("expected 2 quarantined messages, got %v", len(l))
+	}
+	var rejected *backendutil.QuarantinedMessage
+	for _, msg := range l {
+		if len(msg.To) != 1 || msg.To[0] != "bob@example.org" || msg.From != "eve@example.com" || msg.Data != nil {
+			t.Errorf("unexpected quarantined message: %+v", msg)
+		}
+		if msg.Verdict == "sieve: reject: Not welcome here" {
+			rejected = msg
+		} else if msg.Verdict != "sieve: discard" {
+			t.Errorf("unexpected verdict: %q", msg.Verdict)
+		}
+	}
+	if rejected == nil {
+		t.Fatal("rejected message not quarantined")
+	}
+
+	msg, err := q.Get(rejected.ID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if string(msg.Data) != "Subject: Reject\n\nHi\n" {
+		t.Errorf("unexpected quarantined data: %q", msg.Data)
+	}
+
+	if err := backendutil.ReleaseQuarantined(q, rejected.ID, inbox); err != nil {
+		t.Fatalf("ReleaseQuarantined: %v", err)
+	}
+	msgs := inbox.Mailbox("bob@example.org")
+	if len(msgs) != 1 || string(msgs[0].Data) != "Subject: Reject\n\nHi\n" {
+		t.Errorf("unexpected released messages: %+v", msgs)
+	}
+	if _, err := q.Get(rejected.ID); err != backendutil.ErrQuarantineNotFound {
+		t.Errorf("Get after release: expected ErrQuarantineNotFound, got %v", err)
+	}
+	if l, _ := q.List(); len(l) != 1 {
+		t.Errorf("expected 1 quarantined message after release, got %v", len(l))
+	}
+}
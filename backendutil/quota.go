@@ -0,0 +1,252 @@
+package backendutil
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// QuotaLimit limits the messages and recipients a user can send over a
+// sliding window.
+type QuotaLimit struct {
+	Window time.Duration
+	// The maximum number of messages sent during the window. Zero means no
+	// limit.
+	Messages int
+	// The maximum number of recipients, summed over all messages sent during
+	// the window. Zero means no limit.
+	Recipients int
+}
+
+// QuotaStore counts the messages sent by users. It must be safe for
+// concurrent use.
+type QuotaStore interface {
+	// Count returns the number of messages and recipients sent by a user
+	// since a time.
+	Count(username string, since time.Time) (messages, recipients int, err error)
+	// Record records a message sent by a user at a time. The record is no
+	// longer needed after expires.
+	Record(username string, t time.Time, recipients int, expires time.Time) error
+}
+
+type quotaRecord struct {
+	t          time.Time
+	recipients int
+	expires    time.Time
+}
+
+// MemoryQuotaStore is a QuotaStore keeping records in memory.
+type MemoryQuotaStore struct {
+	mu        sync.Mutex
+	users     map[string][]quotaRecord
+	nextSweep time.Time
+}
+
+// Count implements QuotaStore.
+func (st *MemoryQuotaStore) Count(username string, since time.Time) (messages, recipients int, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, rec := range st.users[username] {
+		if !rec.t.Before(since) {
+			messages++
+			recipients += rec.recipients
+		}
+	}
+	return messages, recipients, nil
+}
+
+// Record implements QuotaStore.
+func (st *MemoryQuotaStore) Record(username string, t time.Time, recipients int, expires time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.users == nil {
+		st.users = make(map[string][]quotaRecord)
+	}
+	st.users[username] = append(st.users[username], quotaRecord{t, recipients, expires})
+
+	// Drop expired records of idle users once in a while
+	if t.After(st.nextSweep) {
+		for username := range st.users {
+			st.expire(username, t)
+		}
+		st.nextSweep = t.Add(time.Minute)
+	} else {
+		st.expire(username, t)
+	}
+	return nil
+}
+
+func (st *MemoryQuotaStore) expire(username string, now time.Time) {
+	l := st.users[username]
+	n := 0
+	for _, rec := range l {
+		if now.Before(rec.expires) {
+			l[n] = rec
+			n++
+		}
+	}
+	if n == 0 {
+		delete(st.users, username)
+	} else {
+		st.users[username] = l[:n]
+	}
+}
+
+var (
+	errMessageQuota = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Sending quota exceeded",
+	}
+	errRecipientQuota = &smtp.SMTPError{
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+		Message:      "Recipient quota exceeded, try again later",
+	}
+	errQuotaFailed = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Failed to check sending quota",
+	}
+)
+
+// QuotaBackend is a backend limiting the messages and recipients sent by each
+// authenticated user, to contain compromised accounts on submission servers.
+// Anonymous sessions aren't limited.
+//
+// Once a message limit is reached, MAIL is rejected with a 554 error. Once a
+// recipient limit is reached, RCPT is rejected with a 452 error, so that
+// clients can retry the remaining recipients later. Messages are counted when
+// they are accepted by the underlying backend.
+type QuotaBackend struct {
+	Backend smtp.Backend
+	// Limits applies to all users, unless they are listed in UserLimits.
+	Limits     []QuotaLimit
+	UserLimits map[string][]QuotaLimit
+	// Store counts the messages sent. If nil, a MemoryQuotaStore is used.
+	Store QuotaStore
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+
+	storeOnce sync.Once
+	store     QuotaStore
+}
+
+// Login implements the smtp.Backend interface.
+func (be *QuotaBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	s, err := be.Backend.Login(state, username, password)
+	if err != nil {
+		return nil, err
+	}
+	limits, ok := be.UserLimits[username]
+	if !ok {
+		limits = be.Limits
+	}
+	if len(limits) == 0 {
+		return s, nil
+	}
+	return &quotaSession{Session: s, be: be, username: username, limits: limits}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *QuotaBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return be.Backend.AnonymousLogin(state)
+}
+
+// Usage returns the number of messages and recipients sent by a user during
+// a window.
+func (be *QuotaBackend) Usage(username string, window time.Duration) (messages, recipients int, err error) {
+	return be.quotaStore().Count(username, be.now().Add(-window))
+}
+
+func (be *QuotaBackend) quotaStore() QuotaStore {
+	be.storeOnce.Do(func() {
+		be.store = be.Store
+		if be.store == nil {
+			be.store = &MemoryQuotaStore{}
+		}
+	})
+	return be.store
+}
+
+func (be *QuotaBackend) now() time.Time {
+	if be.Now != nil {
+		return be.Now()
+	}
+	return time.Now()
+}
+
+type quotaSession struct {
+	smtp.Session
+
+	be       *QuotaBackend
+	username string
+	limits   []QuotaLimit
+	rcpts    int
+}
+
+// check returns an error if sending one more message, or one more recipient
+// for the current message, would exceed a limit.
+func (s *quotaSession) check(rcpt bool) error {
+	now := s.be.now()
+	for _, limit := range s.limits {
+		messages, recipients, err := s.be.quotaStore().Count(s.username, now.Add(-limit.Window))
+		if err != nil {
+			return errQuotaFailed
+		}
+		if !rcpt && limit.Messages > 0 && messages >= limit.Messages {
+			return errMessageQuota
+		}
+		if rcpt && limit.Recipients > 0 && recipients+s.rcpts >= limit.Recipients {
+			return errRecipientQuota
+		}
+	}
+	return nil
+}
+
+func (s *quotaSession) Reset() {
+	s.rcpts = 0
+	s.Session.Reset()
+}
+
+func (s *quotaSession) Mail(from string) error {
+	s.rcpts = 0
+	if err := s.check(false); err != nil {
+		return err
+	}
+	return s.Session.Mail(from)
+}
+
+func (s *quotaSession) Rcpt(to string) error {
+	if err := s.check(true); err != nil {
+		return err
+	}
+	if err := s.Session.Rcpt(to); err != nil {
+		return err
+	}
+	s.rcpts++
+	return nil
+}
+
+func (s *quotaSession) Data(r io.Reader) error {
+	if err := s.Session.Data(r); err != nil {
+		return err
+	}
+
+	var window time.Duration
+	for _, limit := range s.limits {
+		if limit.Window > window {
+			window = limit.Window
+		}
+	}
+	now := s.be.now()
+	// The message has been accepted, failing to record it mustn't fail the
+	// transaction
+	s.be.quotaStore().Record(s.username, now, s.rcpts, now.Add(window))
+	s.rcpts = 0
+	return nil
+}
@@ -0,0 +1,95 @@
+package backendutil_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.QuotaBackend{}
+
+func TestQuotaBackend(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	be := &backendutil.QuotaBackend{
+		Backend: &backendutil.MemoryBackend{
+			Auth:           backendutil.UserMap{"alice": "secret", "bob": "secret"}.Auth,
+			AllowAnonymous: true,
+		},
+		Limits: []backendutil.QuotaLimit{
+			{Window: time.Minute, Messages: 2},
+			{Window: time.Hour, Recipients: 3},
+		},
+		UserLimits: map[string][]backendutil.QuotaLimit{"bob": nil},
+		Now:        func() time.Time { return now },
+	}
+
+	s, err := be.Login(nil, "alice", "secret")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	send := func(to ...string) error {
+		if err := s.Mail("alice@example.org"); err != nil {
+			return err
+		}
+		for _, rcpt := range to {
+			if err := s.Rcpt(rcpt); err != nil {
+				s.Reset()
+				return err
+			}
+		}
+		return s.Data(strings.NewReader("Hello!"))
+	}
+
+	if err := send("bob@example.org"); err != nil {
+		t.Fatalf("first message: %v", err)
+	}
+	if err := send("carol@example.org"); err != nil {
+		t.Fatalf("second message: %v", err)
+	}
+	err = send("dave@example.org")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 554 {
+		t.Fatalf("third message: expected 554 error, got %v", err)
+	}
+
+	// The message window slides, the recipient limit still applies
+	now = now.Add(2 * time.Minute)
+	if err := s.Mail("alice@example.org"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := s.Rcpt("dave@example.org"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	err = s.Rcpt("erin@example.org")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 452 {
+		t.Fatalf("Rcpt: expected 452 error, got %v", err)
+	}
+	if err := s.Data(strings.NewReader("Hello!")); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	if messages, recipients, _ := be.Usage("alice", time.Hour); messages != 3 || recipients != 3 {
+		t.Errorf("Usage: got %v messages and %v recipients", messages, recipients)
+	}
+
+	now = now.Add(time.Hour)
+	if err := send("erin@example.org"); err != nil {
+		t.Fatalf("message after the window: %v", err)
+	}
+
+	// Users without limits and anonymous sessions aren't limited
+	for _, login := range []func() (smtp.Session, error){
+		func() (smtp.Session, error) { return be.Login(nil, "bob", "secret") },
+		func() (smtp.Session, error) { return be.AnonymousLogin(nil) },
+	} {
+		if s, err = login(); err != nil {
+			t.Fatalf("Login: %v", err)
+		}
+		for i := 0; i < 5; i++ {
+			if err := send("alice@example.org", "carol@example.org"); err != nil {
+				t.Fatalf("unlimited message: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package backendutil
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedisTable is a table stored in a Redis server, each key being looked up
+// with a GET command.
+//
+// Connections are kept open and reused.
+type RedisTable struct {
+	// Network is "tcp" or "unix", Addr is the server address or socket path.
+	Network string
+	Addr    string
+	// If not empty, the connections are authenticated with the AUTH command.
+	Username string
+	Password string
+	// DB is the database number, selected with the SELECT command.
+	DB int
+	// Prefix is prepended to the looked up keys.
+	Prefix string
+	// Timeout is the timeout of each lookup. Zero means no timeout.
+	Timeout time.Duration
+
+	pool connPool
+}
+
+// errRedisNil is the reply of a GET command for a missing key.
+var errRedisNil = errors.New("nil reply")
+
+// Lookup implements Table.
+func (t *RedisTable) Lookup(key string) (string, bool, error) {
+	var v string
+	found := true
+	err := t.pool.do(t.dial, func(c *poolConn) error {
+		var err error
+		v, err = redisDo(c, t.Timeout, "GET", t.Prefix+key)
+		if err == errRedisNil {
+			found = false
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("backendutil: Redis lookup failed: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return v, found, nil
+}
+
+// redisDo sends a command and reads a simple or bulk string reply.
+func redisDo(c *poolConn, timeout time.Duration, args ...string) (string, error) {
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%v\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&sb, "$%v\r\n%v\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c, sb.String()); err != nil {
+		return "", err
+	}
+
+	line, err := c.br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", errors.New("malformed reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return "", errors.New(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", errors.New("malformed bulk string length")
+		}
+		if n < 0 {
+			return "", errRedisNil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.br, b); err != nil {
+			return "", err
+		}
+		if string(b[n:]) != "\r\n" {
+			return "", errors.New("malformed bulk string")
+		}
+		return string(b[:n]), nil
+	default:
+		return "", fmt.Errorf("unexpected reply %q", line)
+	}
+}
+
+func (t *RedisTable) dial() (*poolConn, error) {
+	c, err := dialPoolConn(t.Network, t.Addr, t.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("backendutil: failed to connect to Redis server: %v", err)
+	}
+
+	if t.Password != "" {
+		args := []string{"AUTH", t.Password}
+		if t.Username != "" {
+			args = []string{"AUTH", t.Username, t.Password}
+		}
+		if _, err := redisDo(c, t.Timeout, args...); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("backendutil: Redis authentication failed: %v", err)
+		}
+	}
+	if t.DB != 0 {
+		if _, err := redisDo(c, t.Timeout, "SELECT", strconv.Itoa(t.DB)); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("backendutil: failed to select Redis database: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// Close closes the idle connections.
+func (t *RedisTable) Close() error {
+	return t.pool.Close()
+}
@@ -0,0 +1,639 @@
+package backendutil
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/dkim"
+)
+
+// RelayBackend is a backend relaying messages to other SMTP servers.
+//
+// Each recipient is routed to a server address: Routes and RouteTable are
+// looked up first, then Smarthosts or Smarthost are used. If neither applies, the message is
+// delivered to the MX hosts of the recipient domain.
+//
+// Recipients routed to different servers are relayed separately. If one of
+// them fails after another one succeeded, the whole transaction is reported as
+// failed and the client may send duplicates when retrying. In LMTP mode, each
+// recipient gets its own status instead.
+//
+// Temporary failures aren't retried by the backend, the client is expected to
+// retry later. To queue messages instead, use the backend as the Transport of
+// a queue.Queue.
+type RelayBackend struct {
+	// Smarthost is the address ("host:port") of the server all mail is
+	// relayed to, unless a route matches.
+	Smarthost string
+	// Smarthosts replaces Smarthost to relay mail to several servers. Messages
+	// are spread across them by weighted round-robin. A server failing with a
+	// connection error or a temporary error is avoided for SmarthostCooldown
+	// (DefaultSmarthostCooldown if zero), and the next one is tried.
+	Smarthosts        []Smarthost
+	SmarthostCooldown time.Duration
+	// Routes maps recipient addresses or domains to server addresses. Keys are
+	// case-insensitive, full addresses take precedence over domains.
+	Routes map[string]string
+	// If not nil, RouteTable is looked up like Routes for recipients missing
+	// from Routes.
+	RouteTable Table
+	// Port is the port used for MX delivery. If empty, "25" is used.
+	Port string
+	// LookupMX is used for MX delivery. If nil, net.LookupMX is used.
+	LookupMX func(domain string) ([]*net.MX, error)
+
+	// Dialer is used to connect to servers. If nil, a zero Dialer is used.
+	Dialer *smtp.Dialer
+	// Sources maps lower-case sender domains to the local address and HELO
+	// name of the connections relaying their mail, for instance to send mail
+	// of several brands from distinct addresses of a multi-homed host. The
+	// "" key applies to other senders. If SelectSource is not nil, it is
+	// called instead, with the header of the message.
+	Sources      map[string]OutboundSource
+	SelectSource func(from string, header mail.Header) (*OutboundSource, error)
+	// TLSConfig is used for STARTTLS, which is issued if supported by the
+	// server unless the TLS policy of the destination says otherwise.
+	TLSConfig *tls.Config
+	// ClientCertificates maps lower-case server host names to the certificate
+	// presented to them during the TLS handshake, for relays and gateways
+	// requiring mutual TLS. The "" key applies to other servers. It overrides
+	// the certificates of TLSConfig.
+	ClientCertificates map[string]tls.Certificate
+	// TLSPolicies maps lower-case destinations to their TLS security level,
+	// like Postfix's smtp_tls_policy_maps. Destinations are recipient domains
+	// for MX delivery, and server host names for routes and smarthosts. Keys
+	// with a leading dot apply to subdomains. Other destinations use TLSMay.
+	TLSPolicies map[string]TLSLevel
+	// If not nil, TLSPolicyTable is looked up like TLSPolicies, values are
+	// security level names. TLSPolicies takes precedence for a given key.
+	TLSPolicyTable Table
+	// LookupTLSA returns the TLSA records of a server for the TLSDANE level.
+	// Only records validated with DNSSEC must be returned.
+	LookupTLSA func(host, port string) ([]TLSA, error)
+	// DKIM maps sender domains to DKIM signing options. Messages from a
+	// sender whose domain has an entry are signed before being relayed.
+	DKIM dkim.Keys
+	// If not nil, relayed messages are sealed with ARC, preserving the
+	// authentication results of the incoming message for the next hop.
+	ARC *dkim.SealOptions
+	// If not nil, Auth is called to create a SASL client for each connection.
+	Auth func(addr string) sasl.Client
+
+	// UserAuth checks the credentials of clients, e.g. UserMap.Auth. If nil,
+	// authentication is not supported.
+	UserAuth func(username, password string) error
+	// If set, clients can relay mail without authenticating.
+	AllowAnonymous bool
+	// Now returns the current time, used for the smarthost cooldown. If nil,
+	// time.Now is used.
+	Now func() time.Time
+
+	balancerMu sync.Mutex
+	balancer   *smarthostBalancer
+}
+
+// OutboundSource is the local identity of outbound connections.
+type OutboundSource struct {
+	// The local IP address connections are made from. If nil, it is chosen
+	// by the system. It must belong to the address family of the servers.
+	IP net.IP
+	// The name sent with EHLO. If empty, the LocalName of the Dialer is used.
+	Hostname string
+}
+
+var errSourceLookup = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Failed to select outbound source",
+}
+
+// source returns the outbound source of a message, or nil for the defaults.
+func (be *RelayBackend) source(from string, body []byte) (*OutboundSource, error) {
+	if be.SelectSource != nil {
+		var header mail.Header
+		if msg, err := mail.ReadMessage(bytes.NewReader(body)); err == nil {
+			header = msg.Header
+		}
+		src, err := be.SelectSource(from, header)
+		if err != nil {
+			return nil, errSourceLookup
+		}
+		return src, nil
+	}
+
+	domain := ""
+	if i := strings.LastIndexByte(from, '@'); i >= 0 {
+		domain = strings.ToLower(from[i+1:])
+	}
+	if src, ok := be.Sources[domain]; ok {
+		return &src, nil
+	}
+	if src, ok := be.Sources[""]; ok {
+		return &src, nil
+	}
+	return nil, nil
+}
+
+// dial connects to a server from a source, which may be nil.
+func (be *RelayBackend) dial(addr string, src *OutboundSource) (*smtp.Client, error) {
+	d := be.Dialer
+	if d == nil {
+		d = &smtp.Dialer{}
+	}
+	if src != nil && (src.IP != nil || src.Hostname != "") {
+		withSource := *d
+		if src.IP != nil {
+			withSource.NetDialer.LocalAddr = &net.TCPAddr{IP: src.IP}
+		}
+		if src.Hostname != "" {
+			withSource.LocalName = src.Hostname
+		}
+		d = &withSource
+	}
+	return d.Dial(addr)
+}
+
+// Login implements the smtp.Backend interface.
+func (be *RelayBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if err := login(be.UserAuth, username, password); err != nil {
+		return nil, err
+	}
+	return &relaySession{be: be}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *RelayBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	if !be.AllowAnonymous {
+		return nil, smtp.ErrAuthRequired
+	}
+	return &relaySession{be: be}, nil
+}
+
+var errRouteLookup = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Failed to look up route",
+}
+
+// route returns the server address for a recipient, or an empty address and
+// the recipient domain for MX delivery. Both are empty for smarthost
+// delivery.
+func (be *RelayBackend) route(rcpt string) (addr, domain string, err error) {
+	i := strings.LastIndexByte(rcpt, '@')
+	if i < 0 {
+		return "", "", fmt.Errorf("backendutil: missing domain in recipient %q", rcpt)
+	}
+	domain = strings.ToLower(rcpt[i+1:])
+
+	if addr, ok := be.Routes[strings.ToLower(rcpt)]; ok {
+		return addr, "", nil
+	}
+	if addr, ok := be.Routes[domain]; ok {
+		return addr, "", nil
+	}
+	if be.RouteTable != nil {
+		for _, key := range []string{strings.ToLower(rcpt), domain} {
+			addr, ok, err := be.RouteTable.Lookup(key)
+			if err != nil {
+				return "", "", errRouteLookup
+			}
+			if ok {
+				return addr, "", nil
+			}
+		}
+	}
+	if be.smarthosts() != nil {
+		return "", "", nil
+	}
+	return "", domain, nil
+}
+
+// mxAddrs returns the server addresses to try for a domain, by order of
+// preference.
+func (be *RelayBackend) mxAddrs(domain string) ([]string, error) {
+	lookupMX := be.LookupMX
+	if lookupMX == nil {
+		lookupMX = net.LookupMX
+	}
+	port := be.Port
+	if port == "" {
+		port = "25"
+	}
+
+	mxs, err := lookupMX(domain)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		mxs, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(mxs) == 0 {
+		// Implicit MX, see RFC 5321 section 5.1
+		return []string{net.JoinHostPort(domain, port)}, nil
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	addrs := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			// Null MX, see RFC 7505
+			return nil, &smtp.SMTPError{
+				Code:         556,
+				EnhancedCode: smtp.EnhancedCode{5, 1, 10},
+				Message:      "Domain " + domain + " does not accept mail",
+			}
+		}
+		addrs = append(addrs, net.JoinHostPort(host, port))
+	}
+	return addrs, nil
+}
+
+// tlsConfig returns the TLS configuration used with a server.
+func (be *RelayBackend) tlsConfig(addr string) *tls.Config {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	cert, ok := be.ClientCertificates[strings.ToLower(host)]
+	if !ok {
+		cert, ok = be.ClientCertificates[""]
+	}
+	if !ok {
+		return be.TLSConfig
+	}
+
+	config := &tls.Config{}
+	if be.TLSConfig != nil {
+		config = be.TLSConfig.Clone()
+	}
+	config.Certificates = []tls.Certificate{cert}
+	config.GetClientCertificate = nil
+	return config
+}
+
+// send relays a message to a single server. The TLS policy of the
+// destination is applied, or the policy of the server if dest is empty.
+func (be *RelayBackend) send(addr, dest string, src *OutboundSource, from string, to []string, body []byte) error {
+	if dest == "" {
+		dest = addr
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			dest = host
+		}
+	}
+	level, err := be.tlsLevel(dest)
+	if err != nil {
+		return err
+	}
+
+	c, err := be.dial(addr, src)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := be.applyTLSPolicy(c, addr, level); err != nil {
+		return err
+	}
+	if be.Auth != nil {
+		if err := c.Auth(be.Auth(addr)); err != nil {
+			return err
+		}
+	}
+	opts := &smtp.MailOptions{Size: int64(len(body)), UTF8: hasUTF8Header(body)}
+	if err := c.MailWithOptions(from, opts); err != nil {
+		return err
+	}
+	// Rejected recipients don't prevent delivery to the others, their errors
+	// are returned once the message is sent
+	var rcptErrs *smtp.RcptErrors
+	if err := c.RcptAll(to); err != nil {
+		var ok bool
+		if rcptErrs, ok = err.(*smtp.RcptErrors); !ok || len(rcptErrs.Accepted) == 0 {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	c.Quit()
+	if rcptErrs != nil {
+		return rcptErrs
+	}
+	return nil
+}
+
+// hasUTF8Header reports whether the header of a message contains non-ASCII
+// characters, which can only be relayed to servers supporting SMTPUTF8.
+func hasUTF8Header(body []byte) bool {
+	for i, c := range body {
+		if c >= 0x80 {
+			return true
+		}
+		if c == '\n' && (bytes.HasPrefix(body[i+1:], []byte("\n")) || bytes.HasPrefix(body[i+1:], []byte("\r\n"))) {
+			return false
+		}
+	}
+	return false
+}
+
+// deliver relays a message to the first server of addrs accepting it. dest is
+// the recipient domain for MX delivery, and is empty otherwise.
+//
+// Recipients rejected temporarily by a server are tried on the next one,
+// recipients rejected permanently aren't. If some recipients fail, a
+// *smtp.RcptErrors is returned.
+func (be *RelayBackend) deliver(addrs []string, dest string, src *OutboundSource, from string, to []string, body []byte) error {
+	var (
+		err    error
+		failed []*smtp.RcptError
+	)
+	for _, addr := range addrs {
+		err = be.send(addr, dest, src, from, to, body)
+		if b := be.smarthosts(); b != nil {
+			b.record(addr, err, be.now(), be.cooldown())
+		}
+		rcptErrs, ok := err.(*smtp.RcptErrors)
+		if !ok {
+			if err == nil || isPermanent(err) {
+				break
+			}
+			continue
+		}
+
+		to = nil
+		for _, rcptErr := range rcptErrs.Errors {
+			if isPermanent(rcptErr.Err) {
+				failed = append(failed, rcptErr)
+			} else {
+				to = append(to, rcptErr.Rcpt)
+			}
+		}
+		err = nil
+		if len(to) == 0 {
+			break
+		}
+		err = rcptErrs
+	}
+
+	if err == nil && len(failed) == 0 {
+		return nil
+	}
+	// Recipients left are those of the last attempt
+	rcptErrs := &smtp.RcptErrors{Errors: failed}
+	switch e := err.(type) {
+	case nil:
+	case *smtp.RcptErrors:
+		for _, rcptErr := range e.Errors {
+			if !isPermanent(rcptErr.Err) {
+				rcptErrs.Errors = append(rcptErrs.Errors, rcptErr)
+			}
+		}
+	default:
+		if len(failed) == 0 {
+			return err
+		}
+		for _, rcpt := range to {
+			rcptErrs.Errors = append(rcptErrs.Errors, &smtp.RcptError{Rcpt: rcpt, Err: err})
+		}
+	}
+	return rcptErrs
+}
+
+// isPermanent reports whether an error returned by a server is a permanent
+// failure, which must not be retried.
+func isPermanent(err error) bool {
+	switch err := err.(type) {
+	case *smtp.SMTPError:
+		return err.Code/100 == 5
+	case *smtp.HelloError:
+		return isPermanent(err.Err)
+	case *smtp.SMTPUTF8RequiredError:
+		return true
+	case *smtp.RcptErrors:
+		for _, rcptErr := range err.Errors {
+			if !isPermanent(rcptErr.Err) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// relayError converts a delivery error into an error for the client.
+func relayError(err error) error {
+	switch e := err.(type) {
+	case *smtp.SMTPError:
+		if e.Code/100 == 5 {
+			return e
+		}
+	case *smtp.HelloError:
+		if isPermanent(e) {
+			return e.Err
+		}
+	case *smtp.SMTPUTF8RequiredError:
+		return e.SMTPError()
+	case *smtp.RcptErrors:
+		if isPermanent(e) {
+			return relayError(e.Errors[0].Err)
+		}
+	}
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 0},
+		Message:      "Relay failed: " + err.Error(),
+	}
+}
+
+// Deliver relays a message to the servers the recipients are routed to. It
+// can be used as a delivery transport by a queue. Errors returned by servers
+// are returned as-is. If some recipients fail, the message is still delivered
+// to the others and a *smtp.RcptErrors is returned.
+func (be *RelayBackend) Deliver(from string, to []string, r io.Reader) error {
+	body, err := be.readBody(from, r)
+	if err != nil {
+		return err
+	}
+	src, err := be.source(from, body)
+	if err != nil {
+		return err
+	}
+
+	routes := make(map[string][]string)
+	domains := make(map[string][]string)
+	var smarthostRcpts []string
+	for _, rcpt := range to {
+		addr, domain, err := be.route(rcpt)
+		if err != nil {
+			return err
+		}
+		switch {
+		case addr != "":
+			routes[addr] = append(routes[addr], rcpt)
+		case domain != "":
+			domains[domain] = append(domains[domain], rcpt)
+		default:
+			smarthostRcpts = append(smarthostRcpts, rcpt)
+		}
+	}
+
+	rcptErrs := &smtp.RcptErrors{}
+	check := func(err error) error {
+		if e, ok := err.(*smtp.RcptErrors); ok {
+			rcptErrs.Errors = append(rcptErrs.Errors, e.Errors...)
+			return nil
+		}
+		return err
+	}
+
+	if len(smarthostRcpts) > 0 {
+		addrs := be.smarthosts().order(be.now())
+		if err := check(be.deliver(addrs, "", src, from, smarthostRcpts, body)); err != nil {
+			return err
+		}
+	}
+
+	for addr, to := range routes {
+		if err := check(be.deliver([]string{addr}, "", src, from, to, body)); err != nil {
+			return err
+		}
+	}
+	for domain, to := range domains {
+		addrs, err := be.mxAddrs(domain)
+		if err == nil {
+			err = be.deliver(addrs, domain, src, from, to, body)
+		}
+		if err := check(err); err != nil {
+			return err
+		}
+	}
+
+	if len(rcptErrs.Errors) > 0 {
+		return rcptErrs
+	}
+	return nil
+}
+
+// readBody reads a message, and signs it if there are DKIM signing options for
+// the sender domain. If ARC is set, the message is sealed too.
+func (be *RelayBackend) readBody(from string, r io.Reader) ([]byte, error) {
+	options := be.DKIM.ForAddress(from)
+	if options == nil && be.ARC == nil {
+		return ioutil.ReadAll(r)
+	}
+
+	var signer *dkim.Signer
+	var sealer *dkim.Sealer
+	var w []io.Writer
+	if options != nil {
+		var err error
+		if signer, err = dkim.NewSigner(options); err != nil {
+			return nil, err
+		}
+		w = append(w, signer)
+	}
+	if be.ARC != nil {
+		var err error
+		if sealer, err = dkim.NewSealer(be.ARC); err != nil {
+			return nil, err
+		}
+		w = append(w, sealer)
+	}
+
+	body, err := ioutil.ReadAll(io.TeeReader(r, io.MultiWriter(w...)))
+	if err != nil {
+		return nil, err
+	}
+
+	var header string
+	if sealer != nil {
+		if err := sealer.Close(); err != nil {
+			return nil, err
+		}
+		header += sealer.Headers()
+	}
+	if signer != nil {
+		if err := signer.Close(); err != nil {
+			return nil, err
+		}
+		header += signer.Signature()
+	}
+	return append([]byte(header), body...), nil
+}
+
+type relaySession struct {
+	be   *RelayBackend
+	from string
+	to   []string
+}
+
+func (s *relaySession) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *relaySession) Logout() error {
+	return nil
+}
+
+func (s *relaySession) Mail(from string) error {
+	s.Reset()
+	s.from = from
+	return nil
+}
+
+func (s *relaySession) Rcpt(to string) error {
+	if _, _, err := s.be.route(to); err == errRouteLookup {
+		return err
+	} else if err != nil {
+		return &smtp.SMTPError{
+			Code:         501,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+			Message:      "Bad recipient address syntax",
+		}
+	}
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *relaySession) Data(r io.Reader) error {
+	if err := s.be.Deliver(s.from, s.to, r); err != nil {
+		return relayError(err)
+	}
+	return nil
+}
+
+// LMTPData implements the smtp.LMTPSession interface.
+func (s *relaySession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	err := s.be.Deliver(s.from, s.to, r)
+	if rcptErrs, ok := err.(*smtp.RcptErrors); ok {
+		for _, rcptErr := range rcptErrs.Errors {
+			status.SetStatus(rcptErr.Rcpt, relayError(rcptErr.Err))
+		}
+		return nil
+	} else if err != nil {
+		return relayError(err)
+	}
+	return nil
+}
@@ -0,0 +1,446 @@
+package backendutil_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+	"github.com/emersion/go-smtp/dkim"
+	"github.com/emersion/go-smtp/smtptest"
+)
+
+var _ smtp.Backend = &backendutil.RelayBackend{}
+
+func sendMessage(t *testing.T, be smtp.Backend, from string, to []string, data string) error {
+	t.Helper()
+
+	s, err := be.AnonymousLogin(nil)
+	if err != nil {
+		t.Fatalf("AnonymousLogin: %v", err)
+	}
+	if err := s.Mail(from); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	for _, rcpt := range to {
+		if err := s.Rcpt(rcpt); err != nil {
+			t.Fatalf("Rcpt: %v", err)
+		}
+	}
+	return s.Data(strings.NewReader(data))
+}
+
+func TestRelayBackend(t *testing.T) {
+	smarthost := smtptest.NewServer()
+	defer smarthost.Close()
+	routed := smtptest.NewServer()
+	defer routed.Close()
+	mx := smtptest.NewServer()
+	defer mx.Close()
+
+	_, mxPort, _ := net.SplitHostPort(mx.Addr)
+	be := &backendutil.RelayBackend{
+		Smarthost: smarthost.Addr,
+		Routes: map[string]string{
+			"example.net": routed.Addr,
+		},
+		Port: mxPort,
+		LookupMX: func(domain string) ([]*net.MX, error) {
+			if domain != "example.com" {
+				t.Errorf("unexpected MX lookup for %q", domain)
+			}
+			return []*net.MX{{Host: "127.0.0.1.", Pref: 10}}, nil
+		},
+		AllowAnonymous: true,
+	}
+
+	to := []string{"bob@example.org", "carol@EXAMPLE.net", "dave@example.net"}
+	if err := sendMessage(t, be, "alice@example.org", to, "Hello!\n"); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+
+	msgs := smarthost.ExpectMessages(t, 1)
+	if msgs[0].From != "alice@example.org" || len(msgs[0].To) != 1 || msgs[0].To[0] != "bob@example.org" {
+		t.Errorf("smarthost: unexpected envelope %v %v", msgs[0].From, msgs[0].To)
+	}
+	if string(msgs[0].Data) != "Hello!\n" {
+		t.Errorf("smarthost: unexpected data %q", msgs[0].Data)
+	}
+	msgs = routed.ExpectMessages(t, 1)
+	if len(msgs[0].To) != 2 {
+		t.Errorf("route: unexpected recipients %v", msgs[0].To)
+	}
+
+	be.Smarthost = ""
+	if err := sendMessage(t, be, "alice@example.org", []string{"erin@example.com"}, "Hello!\n"); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	msgs = mx.ExpectMessages(t, 1)
+	if len(msgs[0].To) != 1 || msgs[0].To[0] != "erin@example.com" {
+		t.Errorf("MX: unexpected recipients %v", msgs[0].To)
+	}
+}
+
+func TestRelayBackend_sources(t *testing.T) {
+	smarthost := smtptest.NewServer()
+	defer smarthost.Close()
+	host, _, _ := net.SplitHostPort(smarthost.Addr)
+	if host != "127.0.0.1" {
+		t.Skip("IPv4 loopback not available")
+	}
+
+	be := &backendutil.RelayBackend{
+		Smarthost: smarthost.Addr,
+		Sources: map[string]backendutil.OutboundSource{
+			"brand.example": {IP: net.IPv4(127, 0, 0, 2), Hostname: "mta.brand.example"},
+			"":              {Hostname: "mta.example.org"},
+		},
+		AllowAnonymous: true,
+	}
+	for _, from := range []string{"alice@Brand.example", "bob@example.org"} {
+		if err := sendMessage(t, be, from, []string{"carol@example.com"}, "Hello!\n"); err != nil {
+			t.Fatalf("Data: %v", err)
+		}
+	}
+
+	be.SelectSource = func(from string, header mail.Header) (*backendutil.OutboundSource, error) {
+		if header.Get("X-Brand") == "other" {
+			return &backendutil.OutboundSource{Hostname: "mta.other.example"}, nil
+		}
+		return nil, nil
+	}
+	for _, msg := range []string{"X-Brand: other\n\nHello!\n", "Hello!\n"} {
+		if err := sendMessage(t, be, "bob@example.org", []string{"carol@example.com"}, msg); err != nil {
+			t.Fatalf("Data: %v", err)
+		}
+	}
+
+	msgs := smarthost.ExpectMessages(t, 4)
+	for i, want := range []string{"mta.brand.example", "mta.example.org", "mta.other.example", smtp.DefaultLocalName()} {
+		if msgs[i].Hostname != want {
+			t.Errorf("message %v: expected HELO %q, got %q", i, want, msgs[i].Hostname)
+		}
+	}
+	if addr, ok := msgs[0].RemoteAddr.(*net.TCPAddr); !ok || !addr.IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Errorf("expected a connection from 127.0.0.2, got %v", msgs[0].RemoteAddr)
+	}
+}
+
+func TestRelayBackend_clientCertificates(t *testing.T) {
+	smarthost := smtptest.NewUnstartedServer()
+	smarthost.Server.TLSConfig = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	smarthost.StartTLS()
+	defer smarthost.Close()
+	host, _, _ := net.SplitHostPort(smarthost.Addr)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mta.example.org"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(smarthost.Certificate())
+	be := &backendutil.RelayBackend{
+		Smarthost:      smarthost.Addr,
+		TLSConfig:      &tls.Config{RootCAs: roots},
+		AllowAnonymous: true,
+	}
+	if err := sendMessage(t, be, "alice@example.org", []string{"bob@example.org"}, "Hello!\n"); err == nil {
+		t.Fatal("Data: expected an error without client certificate")
+	}
+
+	be.ClientCertificates = map[string]tls.Certificate{
+		host: {Certificate: [][]byte{der}, PrivateKey: priv},
+	}
+	if err := sendMessage(t, be, "alice@example.org", []string{"bob@example.org"}, "Hello!\n"); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	msgs := smarthost.ExpectMessages(t, 1)
+	if msgs[0].TLS == nil || len(msgs[0].TLS.PeerCertificates) != 1 || !bytes.Equal(msgs[0].TLS.PeerCertificates[0].Raw, der) {
+		t.Errorf("client certificate not presented to %v", host)
+	}
+}
+
+func TestRelayBackend_smtputf8(t *testing.T) {
+	smarthost := smtptest.NewServer()
+	defer smarthost.Close()
+
+	be := &backendutil.RelayBackend{
+		Smarthost:      smarthost.Addr,
+		AllowAnonymous: true,
+	}
+	if err := sendMessage(t, be, "alice@example.org", []string{"bob@bücher.example"}, "Hello!\n"); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	msgs := smarthost.ExpectMessages(t, 1)
+	if len(msgs[0].To) != 1 || msgs[0].To[0] != "bob@xn--bcher-kva.example" {
+		t.Errorf("unexpected recipients %v", msgs[0].To)
+	}
+
+	err := sendMessage(t, be, "alice@example.org", []string{"bob@example.org"}, "Subject: Grüße\n\nHello!\n")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 554 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 6, 9}) {
+		t.Errorf("Data: expected a 554 5.6.9 error, got %v", err)
+	}
+}
+
+func TestRelayBackend_rejected(t *testing.T) {
+	smarthost := smtptest.NewUnstartedServer()
+	smarthost.AuthRequired = true
+	smarthost.Start()
+	defer smarthost.Close()
+
+	be := &backendutil.RelayBackend{
+		Smarthost:      smarthost.Addr,
+		AllowAnonymous: true,
+	}
+	err := sendMessage(t, be, "alice@example.org", []string{"bob@example.org"}, "Hello!\n")
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatalf("Data: expected SMTP error, got %v", err)
+	}
+	if smtpErr.Code/100 != 5 {
+		t.Errorf("Data: expected permanent error, got %v", smtpErr)
+	}
+}
+
+func TestRelayBackend_dkim(t *testing.T) {
+	smarthost := smtptest.NewServer()
+	defer smarthost.Close()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := &backendutil.RelayBackend{
+		Smarthost: smarthost.Addr,
+		DKIM: dkim.Keys{
+			"example.org": {Domain: "example.org", Selector: "mail", Signer: key},
+		},
+		AllowAnonymous: true,
+	}
+
+	msg := "From: <alice@example.org>\nSubject: Hi\n\nHello!\n"
+	for _, from := range []string{"alice@example.org", "alice@example.net"} {
+		if err := sendMessage(t, be, from, []string{"bob@example.com"}, msg); err != nil {
+			t.Fatalf("Data: %v", err)
+		}
+	}
+
+	msgs := smarthost.ExpectMessages(t, 2)
+	signed := string(msgs[0].Data)
+	if !strings.HasPrefix(signed, "DKIM-Signature: v=1; a=ed25519-sha256;") || !strings.HasSuffix(signed, msg) {
+		t.Errorf("expected a signed message, got %q", signed)
+	}
+	if !strings.Contains(signed, "d=example.org;") || !strings.Contains(signed, "s=mail;") {
+		t.Errorf("unexpected signature: %q", signed)
+	}
+	if string(msgs[1].Data) != msg {
+		t.Errorf("expected an unsigned message, got %q", msgs[1].Data)
+	}
+}
+
+func TestRelayBackend_arc(t *testing.T) {
+	smarthost := smtptest.NewServer()
+	defer smarthost.Close()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := &backendutil.RelayBackend{
+		Smarthost: smarthost.Addr,
+		ARC: &dkim.SealOptions{
+			Domain:     "example.net",
+			Selector:   "arc",
+			Signer:     key,
+			AuthServID: "mx.example.net",
+		},
+		AllowAnonymous: true,
+	}
+
+	msg := "Authentication-Results: mx.example.net; spf=pass smtp.mailfrom=example.org\n" +
+		"From: <alice@example.org>\nSubject: Hi\n\nHello!\n"
+	if err := sendMessage(t, be, "alice@example.org", []string{"bob@example.com"}, msg); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+
+	data := string(smarthost.ExpectMessages(t, 1)[0].Data)
+	if !strings.HasPrefix(data, "ARC-Seal: i=1;") || !strings.HasSuffix(data, msg) {
+		t.Errorf("expected a sealed message, got %q", data)
+	}
+	if !strings.Contains(data, "ARC-Authentication-Results: i=1; mx.example.net; spf=pass smtp.mailfrom=example.org\n") {
+		t.Errorf("missing authentication results: %q", data)
+	}
+}
+
+func TestRelayBackend_smarthosts(t *testing.T) {
+	a := smtptest.NewServer()
+	defer a.Close()
+	b := smtptest.NewServer()
+	defer b.Close()
+
+	be := &backendutil.RelayBackend{
+		Smarthosts: []backendutil.Smarthost{
+			{Addr: a.Addr, Weight: 2},
+			{Addr: b.Addr},
+		},
+		AllowAnonymous: true,
+	}
+	for i := 0; i < 6; i++ {
+		if err := sendMessage(t, be, "alice@example.org", []string{"bob@example.com"}, "Hello!\n"); err != nil {
+			t.Fatalf("Data: %v", err)
+		}
+	}
+	a.ExpectMessages(t, 4)
+	b.ExpectMessages(t, 2)
+}
+
+func TestRelayBackend_smarthostFailover(t *testing.T) {
+	up := smtptest.NewServer()
+	defer up.Close()
+
+	// Reserve an address nobody listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	be := &backendutil.RelayBackend{
+		Smarthosts: []backendutil.Smarthost{
+			{Addr: down},
+			{Addr: up.Addr},
+		},
+		AllowAnonymous: true,
+	}
+	for i := 0; i < 2; i++ {
+		if err := sendMessage(t, be, "alice@example.org", []string{"bob@example.com"}, "Hello!\n"); err != nil {
+			t.Fatalf("Data: %v", err)
+		}
+	}
+	up.ExpectMessages(t, 2)
+
+	be.CheckSmarthosts()
+	status := be.SmarthostStatus()
+	if len(status) != 2 || status[0].Healthy || status[0].Err == nil || !status[1].Healthy {
+		t.Errorf("unexpected smarthost status: %+v", status)
+	}
+}
+
+func TestRelayBackend_smarthostCooldown(t *testing.T) {
+	up := smtptest.NewServer()
+	defer up.Close()
+
+	// Reserve an address nobody listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	be := &backendutil.RelayBackend{
+		Smarthosts:        []backendutil.Smarthost{{Addr: down}, {Addr: up.Addr}},
+		SmarthostCooldown: time.Minute,
+		AllowAnonymous:    true,
+		Now:               func() time.Time { return now },
+	}
+	if err := sendMessage(t, be, "alice@example.org", []string{"bob@example.com"}, "Hello!\n"); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	up.ExpectMessages(t, 1)
+
+	now = now.Add(59 * time.Second)
+	if status := be.SmarthostStatus(); status[0].Healthy {
+		t.Errorf("expected the failing smarthost to be avoided during the cooldown: %+v", status)
+	}
+	now = now.Add(time.Second)
+	if status := be.SmarthostStatus(); !status[0].Healthy {
+		t.Errorf("expected the failing smarthost to be tried again after the cooldown: %+v", status)
+	}
+}
+
+// rcptRejecter is a backend rejecting some recipients.
+type rcptRejecter struct {
+	smtp.Backend
+	errs map[string]error
+}
+
+func (be *rcptRejecter) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	s, err := be.Backend.AnonymousLogin(state)
+	if err != nil {
+		return nil, err
+	}
+	return &rcptRejecterSession{s, be.errs}, nil
+}
+
+type rcptRejecterSession struct {
+	smtp.Session
+	errs map[string]error
+}
+
+func (s *rcptRejecterSession) Rcpt(to string) error {
+	if err := s.errs[to]; err != nil {
+		return err
+	}
+	return s.Session.Rcpt(to)
+}
+
+func TestRelayBackend_rcptErrors(t *testing.T) {
+	rejecting := smtptest.NewUnstartedServer()
+	rejecting.Server.Backend = &rcptRejecter{
+		Backend: rejecting.Server.Backend,
+		errs: map[string]error{
+			"carol@example.com": &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"},
+			"dave@example.com":  &smtp.SMTPError{Code: 450, EnhancedCode: smtp.EnhancedCode{4, 2, 1}, Message: "Try again later"},
+		},
+	}
+	rejecting.Start()
+	defer rejecting.Close()
+	accepting := smtptest.NewServer()
+	defer accepting.Close()
+
+	be := &backendutil.RelayBackend{
+		Smarthosts: []backendutil.Smarthost{
+			{Addr: rejecting.Addr},
+			{Addr: accepting.Addr},
+		},
+	}
+	to := []string{"bob@example.com", "carol@example.com", "dave@example.com"}
+	err := be.Deliver("alice@example.org", to, strings.NewReader("Hello!\n"))
+	rcptErrs, ok := err.(*smtp.RcptErrors)
+	if !ok || len(rcptErrs.Errors) != 1 || rcptErrs.Errors[0].Rcpt != "carol@example.com" {
+		t.Fatalf("Deliver: expected carol to be rejected, got %v", err)
+	}
+
+	// The permanently rejected recipient isn't tried on the next server
+	if msgs := rejecting.ExpectMessages(t, 1); len(msgs[0].To) != 1 || msgs[0].To[0] != "bob@example.com" {
+		t.Errorf("unexpected recipients on the first server: %v", msgs[0].To)
+	}
+	if msgs := accepting.ExpectMessages(t, 1); len(msgs[0].To) != 1 || msgs[0].To[0] != "dave@example.com" {
+		t.Errorf("unexpected recipients on the second server: %v", msgs[0].To)
+	}
+}
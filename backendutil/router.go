@@ -0,0 +1,236 @@
+package backendutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Domain holds the policy of a domain served by a RouterBackend.
+type Domain struct {
+	// Backend handles messages for the domain. If nil, recipients of the
+	// domain are rejected.
+	Backend smtp.Backend
+	// The maximum number of recipients of the domain per message. Zero means
+	// no limit.
+	MaxRecipients int
+	// The maximum size of a message, in bytes. Zero means no limit.
+	MaxMessageBytes int64
+	// If set, recipients of the domain are only accepted over TLS.
+	RequireTLS bool
+	// If set, recipients of the domain are only accepted from authenticated
+	// clients.
+	RequireAuth bool
+	// Login opens the session of an authenticated client on Backend, e.g.
+	// when the domain backend shares the user database of the router. If
+	// nil, Backend.AnonymousLogin is used, the client having already been
+	// authenticated by RouterBackend.Auth.
+	Login func(state *smtp.ConnectionState, username, password string) (smtp.Session, error)
+}
+
+// RouterBackend is a backend routing recipients to a backend depending on
+// their domain, allowing a single server to host many domains.
+//
+// A session is opened on a domain's backend when the first recipient of that
+// domain is accepted, see Domain.Login. Since
+// recipients of several domains share a single DATA command, a delivery
+// failure for one domain fails the whole message, even if other domains
+// already accepted it.
+type RouterBackend struct {
+	// Domains maps lower-case domains to their policy.
+	Domains map[string]*Domain
+	// Default is used for domains missing from Domains. If nil, their
+	// recipients are rejected.
+	Default *Domain
+	// Auth checks credentials. If nil, authentication is not supported.
+	Auth func(username, password string) error
+}
+
+// Login implements the smtp.Backend interface.
+func (be *RouterBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if be.Auth == nil {
+		return nil, smtp.ErrAuthUnsupported
+	}
+	if err := be.Auth(username, password); err != nil {
+		return nil, err
+	}
+	return &routerSession{
+		be:       be,
+		state:    state,
+		username: username,
+		password: password,
+		subs:     make(map[*Domain]*routerSub),
+	}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *RouterBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return &routerSession{
+		be:    be,
+		state: state,
+		subs:  make(map[*Domain]*routerSub),
+	}, nil
+}
+
+func (be *RouterBackend) domain(rcpt string) *Domain {
+	if i := strings.LastIndexByte(rcpt, '@'); i >= 0 {
+		if d, ok := be.Domains[strings.ToLower(rcpt[i+1:])]; ok {
+			return d
+		}
+	}
+	return be.Default
+}
+
+var (
+	errRelayDenied = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Relay access denied",
+	}
+	errTLSRequired = &smtp.SMTPError{
+		Code:         530,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+		Message:      "Must issue a STARTTLS command first",
+	}
+	errAuthRequired = &smtp.SMTPError{
+		Code:         530,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+		Message:      "Authentication required",
+	}
+)
+
+// routerSub is a session opened on a domain backend.
+type routerSub struct {
+	session smtp.Session
+	// Whether MAIL has been issued for the current transaction
+	active bool
+	rcpts  int
+}
+
+type routerSession struct {
+	be                 *RouterBackend
+	state              *smtp.ConnectionState
+	username, password string
+	from               string
+	subs               map[*Domain]*routerSub
+	order              []*Domain
+}
+
+func (s *routerSession) Reset() {
+	s.from = ""
+	for _, sub := range s.subs {
+		if sub.active {
+			sub.session.Reset()
+		}
+		sub.active = false
+		sub.rcpts = 0
+	}
+	s.order = nil
+}
+
+func (s *routerSession) Logout() error {
+	var err error
+	for _, sub := range s.subs {
+		if logoutErr := sub.session.Logout(); err == nil {
+			err = logoutErr
+		}
+	}
+	s.subs = make(map[*Domain]*routerSub)
+	return err
+}
+
+func (s *routerSession) Mail(from string) error {
+	s.Reset()
+	s.from = from
+	return nil
+}
+
+func (s *routerSession) Rcpt(to string) error {
+	d := s.be.domain(to)
+	if d == nil || d.Backend == nil {
+		return errRelayDenied
+	}
+	if d.RequireTLS && (s.state == nil || !s.state.TLS.HandshakeComplete) {
+		return errTLSRequired
+	}
+	if d.RequireAuth && s.username == "" {
+		return errAuthRequired
+	}
+
+	sub, ok := s.subs[d]
+	if !ok {
+		var session smtp.Session
+		var err error
+		if s.username != "" && d.Login != nil {
+			session, err = d.Login(s.state, s.username, s.password)
+		} else {
+			session, err = d.Backend.AnonymousLogin(s.state)
+		}
+		if err == smtp.ErrAuthRequired {
+			return errAuthRequired
+		} else if err != nil {
+			return err
+		}
+		sub = &routerSub{session: session}
+		s.subs[d] = sub
+	}
+
+	if d.MaxRecipients > 0 && sub.rcpts >= d.MaxRecipients {
+		return &smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+			Message:      fmt.Sprintf("Maximum limit of %v recipients reached for this domain", d.MaxRecipients),
+		}
+	}
+
+	if !sub.active {
+		if err := sub.session.Mail(s.from); err != nil {
+			return err
+		}
+		sub.active = true
+		s.order = append(s.order, d)
+	}
+	if err := sub.session.Rcpt(to); err != nil {
+		return err
+	}
+	sub.rcpts++
+	return nil
+}
+
+func (s *routerSession) Data(r io.Reader) error {
+	var domains []*Domain
+	for _, d := range s.order {
+		if s.subs[d].rcpts > 0 {
+			domains = append(domains, d)
+		}
+	}
+	if len(domains) == 0 {
+		return errors.New("backendutil: no valid recipients")
+	}
+
+	// Avoid buffering the message if there is a single domain
+	if len(domains) == 1 && domains[0].MaxMessageBytes == 0 {
+		return s.subs[domains[0]].session.Data(r)
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	for _, d := range domains {
+		if d.MaxMessageBytes > 0 && int64(len(b)) > d.MaxMessageBytes {
+			return errMessageTooLarge
+		}
+	}
+	for _, d := range domains {
+		if err := s.subs[d].session.Data(bytes.NewReader(b)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
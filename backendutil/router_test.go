@@ -0,0 +1,134 @@
+package backendutil_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.RouterBackend{}
+
+func TestRouterBackend(t *testing.T) {
+	org := &backendutil.MemoryBackend{AllowAnonymous: true}
+	net := &backendutil.MemoryBackend{AllowAnonymous: true}
+	be := &backendutil.RouterBackend{
+		Domains: map[string]*backendutil.Domain{
+			"example.org":  {Backend: org, MaxRecipients: 2},
+			"example.net":  {Backend: net, MaxMessageBytes: 16},
+			"secure.test":  {Backend: org, RequireTLS: true},
+			"private.test": {Backend: org, RequireAuth: true},
+			"closed.test":  {},
+		},
+	}
+
+	s, err := be.AnonymousLogin(&smtp.ConnectionState{})
+	if err != nil {
+		t.Fatalf("AnonymousLogin: %v", err)
+	}
+	if err := s.Mail("alice@example.com"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	for _, rcpt := range []string{"bob@example.org", "carol@EXAMPLE.org", "dave@example.net"} {
+		if err := s.Rcpt(rcpt); err != nil {
+			t.Fatalf("Rcpt(%q): %v", rcpt, err)
+		}
+	}
+	for _, rcpt := range []string{"erin@example.org", "frank@unknown.test", "grace@closed.test", "heidi@secure.test", "ivan@private.test"} {
+		if err := s.Rcpt(rcpt); err == nil {
+			t.Errorf("Rcpt(%q): expected error", rcpt)
+		}
+	}
+	if err := s.Data(strings.NewReader("Hello!\n")); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+
+	if n := len(org.Mailbox("bob@example.org")); n != 1 {
+		t.Errorf("expected 1 message for bob@example.org, got %v", n)
+	}
+	if n := len(net.Mailbox("dave@example.net")); n != 1 {
+		t.Errorf("expected 1 message for dave@example.net, got %v", n)
+	}
+	if l := net.Mailboxes(); len(l) != 1 {
+		t.Errorf("unexpected mailboxes in example.net backend: %v", l)
+	}
+
+	// Limits are per transaction
+	if err := s.Mail("alice@example.com"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := s.Rcpt("dave@example.net"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	if err := s.Data(strings.NewReader("This message is too large\n")); err == nil {
+		t.Error("Data: expected error for message exceeding domain limit")
+	}
+
+	s, err = be.AnonymousLogin(&smtp.ConnectionState{TLS: tls.ConnectionState{HandshakeComplete: true}})
+	if err != nil {
+		t.Fatalf("AnonymousLogin: %v", err)
+	}
+	if err := s.Mail("alice@example.com"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := s.Rcpt("heidi@secure.test"); err != nil {
+		t.Errorf("Rcpt: %v", err)
+	}
+}
+
+func TestRouterBackend_auth(t *testing.T) {
+	// Domain backends don't need to know the users of the router
+	org := &backendutil.MemoryBackend{AllowAnonymous: true}
+	var logins []string
+	net := &backendutil.MemoryBackend{AllowAnonymous: true}
+	be := &backendutil.RouterBackend{
+		Domains: map[string]*backendutil.Domain{
+			"example.org": {Backend: org, RequireAuth: true},
+			"example.net": {
+				Backend: net,
+				Login: func(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+					logins = append(logins, username)
+					return net.AnonymousLogin(state)
+				},
+			},
+		},
+		Auth: func(username, password string) error {
+			if username != "alice" || password != "secret" {
+				return errors.New("Invalid username or password")
+			}
+			return nil
+		},
+	}
+
+	if _, err := be.Login(&smtp.ConnectionState{}, "alice", "wrong"); err == nil {
+		t.Error("Login: expected error for invalid password")
+	}
+	s, err := be.Login(&smtp.ConnectionState{}, "alice", "secret")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if err := s.Mail("alice@example.com"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	for _, rcpt := range []string{"bob@example.org", "carol@example.net"} {
+		if err := s.Rcpt(rcpt); err != nil {
+			t.Fatalf("Rcpt(%q): %v", rcpt, err)
+		}
+	}
+	if err := s.Data(strings.NewReader("Hello!\n")); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+
+	if n := len(org.Mailbox("bob@example.org")); n != 1 {
+		t.Errorf("expected 1 message for bob@example.org, got %v", n)
+	}
+	if n := len(net.Mailbox("carol@example.net")); n != 1 {
+		t.Errorf("expected 1 message for carol@example.net, got %v", n)
+	}
+	if len(logins) != 1 || logins[0] != "alice" {
+		t.Errorf("unexpected domain logins %v", logins)
+	}
+}
@@ -0,0 +1,465 @@
+package backendutil
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ScoreRequest is the message scored by a ScoreCheck.
+type ScoreRequest struct {
+	State  *smtp.ConnectionState
+	From   string
+	To     []string
+	Header mail.Header
+}
+
+// remoteIP returns the IP address of the client, or nil if unknown.
+func (req *ScoreRequest) remoteIP() net.IP {
+	if req.State == nil || req.State.RemoteAddr == nil {
+		return nil
+	}
+	switch addr := req.State.RemoteAddr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(req.State.RemoteAddr.String())
+	if err != nil {
+		host = req.State.RemoteAddr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// ScoreCheck computes a score for a message. Scores are usually between 0,
+// for a check which passed, and 1, for a check which failed. They are
+// multiplied by the weight of their ScoreRule.
+type ScoreCheck interface {
+	Score(ctx context.Context, req *ScoreRequest) (float64, error)
+}
+
+// ScoreCheckFunc is a function implementing ScoreCheck, for custom checks.
+type ScoreCheckFunc func(ctx context.Context, req *ScoreRequest) (float64, error)
+
+// Score implements ScoreCheck.
+func (f ScoreCheckFunc) Score(ctx context.Context, req *ScoreRequest) (float64, error) {
+	return f(ctx, req)
+}
+
+// ScoreRule is a weighted check. Negative weights can be used for checks
+// indicating legitimate mail.
+type ScoreRule struct {
+	// The name of the rule, reported in the X-Spam-Status header field.
+	Name   string
+	Check  ScoreCheck
+	Weight float64
+}
+
+// DNSBLCheck scores 1 if the client IP address is listed in a DNS blocklist
+// zone, such as "zen.spamhaus.org", and 0 otherwise.
+type DNSBLCheck struct {
+	Zone string
+	// If nil, net.DefaultResolver is used.
+	Resolver Resolver
+}
+
+// Score implements ScoreCheck.
+func (c *DNSBLCheck) Score(ctx context.Context, req *ScoreRequest) (float64, error) {
+	ip := req.remoteIP()
+	if ip == nil {
+		return 0, nil
+	}
+
+	var labels []string
+	if ip4 := ip.To4(); ip4 != nil {
+		labels = strings.Split(ip4.String(), ".")
+	} else {
+		labels = ipv6Nibbles(ip)
+	}
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	name := strings.Join(labels, ".") + "." + strings.TrimSuffix(c.Zone, ".")
+
+	addrs, err := resolverOrDefault(c.Resolver).LookupHost(ctx, name)
+	if isNotFound(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	// Listed addresses are in 127.0.0.0/8, other replies are usually errors
+	// such as blocked queries
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr).To4(); ip != nil && ip[0] == 127 {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// ReverseDNSCheck scores 1 if the client IP address has no reverse DNS name
+// resolving back to it, and 0 otherwise.
+type ReverseDNSCheck struct {
+	// If nil, net.DefaultResolver is used.
+	Resolver Resolver
+}
+
+// Score implements ScoreCheck.
+func (c *ReverseDNSCheck) Score(ctx context.Context, req *ScoreRequest) (float64, error) {
+	ip := req.remoteIP()
+	if ip == nil {
+		return 0, nil
+	}
+
+	r := resolverOrDefault(c.Resolver)
+	names, err := r.LookupAddr(ctx, ip.String())
+	if isNotFound(err) {
+		return 1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		addrs, err := r.LookupHost(ctx, strings.TrimSuffix(name, "."))
+		if err != nil && !isNotFound(err) {
+			return 0, err
+		}
+		for _, addr := range addrs {
+			if ip.Equal(net.ParseIP(addr)) {
+				return 0, nil
+			}
+		}
+	}
+	return 1, nil
+}
+
+// HeloCheck scores 1 if the HELO name of the client is missing, is an
+// address literal or isn't a fully qualified domain name. If Resolver is set,
+// it also scores 1 if the name doesn't resolve. Otherwise, it scores 0.
+type HeloCheck struct {
+	Resolver Resolver
+}
+
+// Score implements ScoreCheck.
+func (c *HeloCheck) Score(ctx context.Context, req *ScoreRequest) (float64, error) {
+	if req.State == nil {
+		return 0, nil
+	}
+	name := strings.TrimSuffix(req.State.Hostname, ".")
+	if name == "" || strings.HasPrefix(name, "[") || net.ParseIP(name) != nil || !strings.Contains(name, ".") {
+		return 1, nil
+	}
+	if c.Resolver == nil {
+		return 0, nil
+	}
+	if _, err := c.Resolver.LookupHost(ctx, name); isNotFound(err) {
+		return 1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// SPFCheck scores 1 if the client isn't allowed to send mail for the sender
+// according to its SPF policy, 0.5 for soft failures and invalid policies,
+// and 0 otherwise. See CheckSPF.
+type SPFCheck struct {
+	// If nil, net.DefaultResolver is used.
+	Resolver Resolver
+}
+
+// Score implements ScoreCheck.
+func (c *SPFCheck) Score(ctx context.Context, req *ScoreRequest) (float64, error) {
+	ip := req.remoteIP()
+	if ip == nil {
+		return 0, nil
+	}
+	switch CheckSPF(ctx, c.Resolver, ip, req.State.Hostname, req.From) {
+	case SPFFail:
+		return 1, nil
+	case SPFSoftFail, SPFPermError:
+		return 0.5, nil
+	case SPFTempError:
+		return 0, fmt.Errorf("backendutil: temporary SPF error for %q", req.From)
+	default:
+		return 0, nil
+	}
+}
+
+// ScoreBackend is a backend scoring messages with weighted checks, such as
+// DNS blocklists, SPF or custom checks, and acting on the total score.
+//
+// The checks are run concurrently when the message header has been
+// received. Failing checks contribute nothing to the score, so that DNS
+// outages don't cause mail to be rejected. Then, the first matching action is
+// applied:
+//
+//   - At or above RejectThreshold, the message is rejected.
+//   - At or above GreylistThreshold, the message is temporarily rejected
+//     unless it was already attempted more than GreylistDelay ago, from the
+//     same network with the same sender and recipients.
+//   - At or above TagThreshold, X-Spam-Flag and X-Spam-Status header fields
+//     are added.
+//
+// A threshold of zero disables the action. If Quarantine is set, rejected
+// messages are stored there.
+type ScoreBackend struct {
+	Backend smtp.Backend
+	Rules   []ScoreRule
+
+	TagThreshold      float64
+	GreylistThreshold float64
+	RejectThreshold   float64
+
+	// The minimum delay before a greylisted message is accepted. If zero, 5
+	// minutes are used.
+	GreylistDelay time.Duration
+	// The maximum duration of all checks of a message. If zero, 30 seconds
+	// are used.
+	Timeout time.Duration
+	// Quarantine stores rejected messages. It may be nil.
+	Quarantine Quarantine
+	// Now returns the current time, used for greylisting. If nil, time.Now
+	// is used.
+	Now func() time.Time
+
+	mu        sync.Mutex
+	greylist  map[string]time.Time
+	nextSweep time.Time
+}
+
+// greylistExpiry is the duration greylisted attempts are remembered.
+const greylistExpiry = 24 * time.Hour
+
+// ScoreResult is the result of the checks of a message.
+type ScoreResult struct {
+	Score float64
+	// The names of the rules which contributed to the score.
+	Rules []string
+}
+
+// String formats the result as in the X-Spam-Status header field, for
+// instance "score=4.5 tests=dnsbl,spf".
+func (res *ScoreResult) String() string {
+	s := "score=" + strconv.FormatFloat(res.Score, 'f', 1, 64)
+	if len(res.Rules) > 0 {
+		s += " tests=" + strings.Join(res.Rules, ",")
+	}
+	return s
+}
+
+// Score runs the checks of a message and returns the total score.
+func (be *ScoreBackend) Score(ctx context.Context, req *ScoreRequest) *ScoreResult {
+	timeout := be.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	scores := make([]float64, len(be.Rules))
+	var wg sync.WaitGroup
+	for i, rule := range be.Rules {
+		wg.Add(1)
+		go func(i int, rule ScoreRule) {
+			defer wg.Done()
+			if score, err := rule.Check.Score(ctx, req); err == nil {
+				scores[i] = score * rule.Weight
+			}
+		}(i, rule)
+	}
+	wg.Wait()
+
+	res := &ScoreResult{}
+	for i, score := range scores {
+		if score != 0 {
+			res.Score += score
+			res.Rules = append(res.Rules, be.Rules[i].Name)
+		}
+	}
+	return res
+}
+
+func (be *ScoreBackend) now() time.Time {
+	if be.Now != nil {
+		return be.Now()
+	}
+	return time.Now()
+}
+
+// greylisted reports whether a message attempt must be temporarily
+// rejected, and records it.
+func (be *ScoreBackend) greylisted(key string, now time.Time) bool {
+	delay := be.GreylistDelay
+	if delay == 0 {
+		delay = 5 * time.Minute
+	}
+
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	if be.greylist == nil {
+		be.greylist = make(map[string]time.Time)
+	}
+	if now.After(be.nextSweep) {
+		for k, t := range be.greylist {
+			if now.Sub(t) > greylistExpiry {
+				delete(be.greylist, k)
+			}
+		}
+		be.nextSweep = now.Add(time.Minute)
+	}
+
+	first, ok := be.greylist[key]
+	if !ok {
+		be.greylist[key] = now
+		return true
+	}
+	return now.Sub(first) < delay
+}
+
+// Login implements the smtp.Backend interface.
+func (be *ScoreBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	s, err := be.Backend.Login(state, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &scoreSession{Session: s, be: be, state: state}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *ScoreBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	s, err := be.Backend.AnonymousLogin(state)
+	if err != nil {
+		return nil, err
+	}
+	return &scoreSession{Session: s, be: be, state: state}, nil
+}
+
+var (
+	errScoreReject = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Message rejected as spam",
+	}
+	errScoreQuarantine = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Failed to quarantine message",
+	}
+	errScoreGreylist = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Greylisted, please try again later",
+	}
+)
+
+type scoreSession struct {
+	smtp.Session
+
+	be    *ScoreBackend
+	state *smtp.ConnectionState
+	from  string
+	to    []string
+}
+
+func (s *scoreSession) Reset() {
+	s.from = ""
+	s.to = nil
+	s.Session.Reset()
+}
+
+func (s *scoreSession) Mail(from string) error {
+	s.from = ""
+	s.to = nil
+	if err := s.Session.Mail(from); err != nil {
+		return err
+	}
+	s.from = from
+	return nil
+}
+
+func (s *scoreSession) Rcpt(to string) error {
+	if err := s.Session.Rcpt(to); err != nil {
+		return err
+	}
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *scoreSession) Data(r io.Reader) error {
+	br := bufio.NewReader(r)
+	fields, eol, err := readHeaderFields(br)
+	if err != nil {
+		return err
+	}
+	raw := strings.Join(fields, "") + eol
+
+	req := &ScoreRequest{State: s.state, From: s.from, To: s.to}
+	if msg, err := mail.ReadMessage(strings.NewReader(raw)); err == nil {
+		req.Header = msg.Header
+	}
+	res := s.be.Score(context.Background(), req)
+
+	switch {
+	case s.be.RejectThreshold > 0 && res.Score >= s.be.RejectThreshold:
+		if s.be.Quarantine != nil {
+			return s.quarantine(res, io.MultiReader(strings.NewReader(raw), br))
+		}
+		return errScoreReject
+	case s.be.GreylistThreshold > 0 && res.Score >= s.be.GreylistThreshold:
+		if s.be.greylisted(s.greylistKey(req), s.be.now()) {
+			return errScoreGreylist
+		}
+	}
+
+	if s.be.TagThreshold > 0 && res.Score >= s.be.TagThreshold {
+		nl := "\n"
+		if strings.HasSuffix(eol, "\r\n") {
+			nl = "\r\n"
+		}
+		raw = "X-Spam-Flag: YES" + nl + "X-Spam-Status: Yes, " + res.String() + nl + raw
+	}
+
+	return s.Session.Data(io.MultiReader(strings.NewReader(raw), br))
+}
+
+// quarantine stores a rejected message.
+func (s *scoreSession) quarantine(res *ScoreResult, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	msg := newQuarantinedMessage(s.state, s.from, s.to, "spam: "+res.String(), b)
+	if err := s.be.Quarantine.Put(msg); err != nil {
+		return errScoreQuarantine
+	}
+	return errScoreReject
+}
+
+// greylistKey returns the greylisting key of a message: the client network,
+// the sender and the recipients.
+func (s *scoreSession) greylistKey(req *ScoreRequest) string {
+	var network string
+	if ip := req.remoteIP(); ip.To4() != nil {
+		network = ip.To4().Mask(net.CIDRMask(24, 32)).String()
+	} else if ip != nil {
+		network = ip.Mask(net.CIDRMask(64, 128)).String()
+	}
+
+	to := make([]string, len(req.To))
+	for i, addr := range req.To {
+		to[i] = strings.ToLower(addr)
+	}
+	sort.Strings(to)
+	return network + " " + strings.ToLower(req.From) + " " + strings.Join(to, ",")
+}
@@ -0,0 +1,124 @@
+package backendutil_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.ScoreBackend{}
+
+func TestScoreBackend(t *testing.T) {
+	r := &testResolver{
+		ptr: map[string][]string{
+			"192.0.2.10":  {"mail.example.org."},
+			"203.0.113.1": {"forged.example.org."},
+		},
+		host: map[string][]string{
+			"mail.example.org":         {"192.0.2.10"},
+			"66.100.51.198.bl.example": {"127.0.0.2"},
+		},
+		txt: map[string][]string{
+			"example.org": {"v=spf1 a:mail.example.org -all"},
+		},
+	}
+	inbox := &backendutil.MemoryBackend{AllowAnonymous: true}
+	quarantine := &backendutil.MemoryQuarantine{}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	be := &backendutil.ScoreBackend{
+		Backend: inbox,
+		Rules: []backendutil.ScoreRule{
+			{Name: "dnsbl", Check: &backendutil.DNSBLCheck{Zone: "bl.example", Resolver: r}, Weight: 5},
+			{Name: "rdns", Check: &backendutil.ReverseDNSCheck{Resolver: r}, Weight: 1},
+			{Name: "helo", Check: &backendutil.HeloCheck{}, Weight: 1},
+			{Name: "spf", Check: &backendutil.SPFCheck{Resolver: r}, Weight: 2},
+			{Name: "subject", Check: backendutil.ScoreCheckFunc(func(ctx context.Context, req *backendutil.ScoreRequest) (float64, error) {
+				if strings.Contains(req.Header.Get("Subject"), "Cheap") {
+					return 1, nil
+				}
+				return 0, nil
+			}), Weight: 1},
+		},
+		TagThreshold:      1,
+		GreylistThreshold: 3,
+		RejectThreshold:   5,
+		GreylistDelay:     5 * time.Minute,
+		Quarantine:        quarantine,
+		Now:               func() time.Time { return now },
+	}
+
+	send := func(ip, helo, subject string) error {
+		state := &smtp.ConnectionState{
+			Hostname:   helo,
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25},
+		}
+		s, err := be.AnonymousLogin(state)
+		if err != nil {
+			return err
+		}
+		if err := s.Mail("alice@example.org"); err != nil {
+			return err
+		}
+		if err := s.Rcpt("bob@example.org"); err != nil {
+			return err
+		}
+		return s.Data(strings.NewReader("Subject: " + subject + "\r\n\r\nHi!\r\n"))
+	}
+	lastMessage := func() string {
+		msgs := inbox.Mailbox("bob@example.org")
+		if len(msgs) == 0 {
+			return ""
+		}
+		return string(msgs[len(msgs)-1].Data)
+	}
+
+	if err := send("192.0.2.10", "mail.example.org", "Hello"); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	if got := lastMessage(); got != "Subject: Hello\r\n\r\nHi!\r\n" {
+		t.Errorf("unexpected clean message: %q", got)
+	}
+
+	if err := send("192.0.2.10", "mail.example.org", "Cheap watches"); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	want := "X-Spam-Flag: YES\r\nX-Spam-Status: Yes, score=1.0 tests=subject\r\nSubject: Cheap watches\r\n\r\nHi!\r\n"
+	if got := lastMessage(); got != want {
+		t.Errorf("unexpected tagged message: %q", got)
+	}
+
+	// Forged reverse DNS, bad HELO and SPF failure: greylisted, then
+	// accepted once the delay is over
+	err := send("203.0.113.1", "localhost", "Hello")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 451 {
+		t.Fatalf("Data: expected a 451 error, got %v", err)
+	}
+	now = now.Add(time.Minute)
+	err = send("203.0.113.1", "localhost", "Hello")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 451 {
+		t.Fatalf("Data before the greylisting delay: expected a 451 error, got %v", err)
+	}
+	now = now.Add(5 * time.Minute)
+	if err := send("203.0.113.1", "localhost", "Hello"); err != nil {
+		t.Fatalf("Data after greylisting: %v", err)
+	}
+	if got := lastMessage(); !strings.Contains(got, "X-Spam-Status: Yes, score=4.0 tests=rdns,helo,spf\r\n") {
+		t.Errorf("unexpected greylisted message: %q", got)
+	}
+
+	err = send("198.51.100.66", "mail.example.org", "Hello")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 550 {
+		t.Errorf("Data: expected a 550 error, got %v", err)
+	}
+	if n := len(inbox.Mailbox("bob@example.org")); n != 3 {
+		t.Errorf("expected 3 delivered messages, got %v", n)
+	}
+	if l, _ := quarantine.List(); len(l) != 1 || l[0].Verdict != "spam: score=8.0 tests=dnsbl,rdns,spf" || l[0].RemoteAddr != "198.51.100.66:25" {
+		t.Errorf("unexpected quarantined messages: %v", l)
+	}
+}
@@ -0,0 +1,231 @@
+package backendutil
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultSmarthostCooldown is the time a failing smarthost is avoided for, if
+// RelayBackend.SmarthostCooldown is zero.
+const DefaultSmarthostCooldown = 30 * time.Second
+
+// Smarthost is a server mail can be relayed to.
+type Smarthost struct {
+	// Addr is the server address ("host:port").
+	Addr string
+	// Weight is the relative share of messages relayed to this server. Zero
+	// means 1.
+	Weight int
+}
+
+// SmarthostStatus is the health of a smarthost.
+type SmarthostStatus struct {
+	Smarthost
+	// Healthy is false if the last delivery or health check failed less than
+	// the cooldown ago.
+	Healthy bool
+	// The last error, if the smarthost isn't healthy.
+	Err error
+}
+
+type smarthostState struct {
+	Smarthost
+	current   int // smooth weighted round-robin counter
+	downUntil time.Time
+	err       error
+}
+
+func (sh *smarthostState) weight() int {
+	if sh.Weight <= 0 {
+		return 1
+	}
+	return sh.Weight
+}
+
+// smarthostBalancer spreads messages across smarthosts with smooth weighted
+// round-robin, skipping unhealthy ones.
+type smarthostBalancer struct {
+	mu    sync.Mutex
+	hosts []*smarthostState
+	index map[string]*smarthostState
+}
+
+func newSmarthostBalancer(hosts []Smarthost) *smarthostBalancer {
+	b := &smarthostBalancer{index: make(map[string]*smarthostState)}
+	for _, h := range hosts {
+		state := &smarthostState{Smarthost: h}
+		b.hosts = append(b.hosts, state)
+		b.index[h.Addr] = state
+	}
+	return b
+}
+
+// configured reports whether the balancer was created for hosts.
+func (b *smarthostBalancer) configured(hosts []Smarthost) bool {
+	if len(hosts) != len(b.hosts) {
+		return false
+	}
+	for i, h := range hosts {
+		if b.hosts[i].Smarthost != h {
+			return false
+		}
+	}
+	return true
+}
+
+// order returns the smarthost addresses to try for a message: the next one
+// picked by weighted round-robin, the other healthy ones, then the unhealthy
+// ones as a last resort.
+func (b *smarthostBalancer) order(now time.Time) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var healthy, unhealthy []*smarthostState
+	for _, sh := range b.hosts {
+		if now.Before(sh.downUntil) {
+			unhealthy = append(unhealthy, sh)
+		} else {
+			healthy = append(healthy, sh)
+		}
+	}
+
+	addrs := make([]string, 0, len(b.hosts))
+	if len(healthy) > 0 {
+		var best *smarthostState
+		total := 0
+		for _, sh := range healthy {
+			sh.current += sh.weight()
+			total += sh.weight()
+			if best == nil || sh.current > best.current {
+				best = sh
+			}
+		}
+		best.current -= total
+
+		addrs = append(addrs, best.Addr)
+		for _, sh := range healthy {
+			if sh != best {
+				addrs = append(addrs, sh.Addr)
+			}
+		}
+	}
+	for _, sh := range unhealthy {
+		addrs = append(addrs, sh.Addr)
+	}
+	return addrs
+}
+
+// record updates the health of a smarthost after a delivery or a health
+// check. Addresses which aren't smarthosts are ignored.
+func (b *smarthostBalancer) record(addr string, err error, now time.Time, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sh, ok := b.index[addr]
+	if !ok {
+		return
+	}
+	if err == nil || isPermanent(err) {
+		// Permanent errors are caused by the message, not the server
+		sh.downUntil = time.Time{}
+		sh.err = nil
+		return
+	}
+	sh.downUntil = now.Add(cooldown)
+	sh.err = err
+}
+
+func (b *smarthostBalancer) status(now time.Time) []SmarthostStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	l := make([]SmarthostStatus, len(b.hosts))
+	for i, sh := range b.hosts {
+		healthy := !now.Before(sh.downUntil)
+		l[i] = SmarthostStatus{Smarthost: sh.Smarthost, Healthy: healthy}
+		if !healthy {
+			l[i].Err = sh.err
+		}
+	}
+	return l
+}
+
+// smarthosts returns the smarthost balancer, or nil if no smarthost is
+// configured. The balancer is re-created if the configuration changes.
+func (be *RelayBackend) smarthosts() *smarthostBalancer {
+	hosts := be.Smarthosts
+	if len(hosts) == 0 && be.Smarthost != "" {
+		hosts = []Smarthost{{Addr: be.Smarthost}}
+	}
+
+	be.balancerMu.Lock()
+	defer be.balancerMu.Unlock()
+
+	if len(hosts) == 0 {
+		be.balancer = nil
+	} else if be.balancer == nil || !be.balancer.configured(hosts) {
+		be.balancer = newSmarthostBalancer(hosts)
+	}
+	return be.balancer
+}
+
+func (be *RelayBackend) cooldown() time.Duration {
+	if be.SmarthostCooldown > 0 {
+		return be.SmarthostCooldown
+	}
+	return DefaultSmarthostCooldown
+}
+
+func (be *RelayBackend) now() time.Time {
+	if be.Now != nil {
+		return be.Now()
+	}
+	return time.Now()
+}
+
+// SmarthostStatus returns the health of the smarthosts.
+func (be *RelayBackend) SmarthostStatus() []SmarthostStatus {
+	b := be.smarthosts()
+	if b == nil {
+		return nil
+	}
+	return b.status(be.now())
+}
+
+// CheckSmarthosts connects to each smarthost and updates its health. It can
+// be called periodically to detect failures and recoveries without waiting
+// for messages to be relayed.
+func (be *RelayBackend) CheckSmarthosts() {
+	b := be.smarthosts()
+	if b == nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, sh := range b.hosts {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			b.record(addr, be.check(addr), be.now(), be.cooldown())
+		}(sh.Addr)
+	}
+	wg.Wait()
+}
+
+// check opens a session with a server and closes it.
+func (be *RelayBackend) check(addr string) error {
+	var src *OutboundSource
+	if s, ok := be.Sources[""]; ok {
+		src = &s
+	}
+	c, err := be.dial(addr, src)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Noop(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,100 @@
+package backendutil
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxNetstringLen is the maximum length of a socketmap reply, as in Postfix.
+const maxNetstringLen = 100000
+
+// SocketmapTable is a table queried with the socketmap protocol, as supported
+// by Postfix and Sendmail. See http://www.postfix.org/socketmap_table.5.html.
+//
+// Connections are kept open and reused.
+type SocketmapTable struct {
+	// Network is "tcp" or "unix", Addr is the server address or socket path.
+	Network string
+	Addr    string
+	// Name is the name of the map on the server.
+	Name string
+	// Timeout is the timeout of each lookup. Zero means no timeout.
+	Timeout time.Duration
+
+	pool connPool
+}
+
+// Lookup implements Table.
+func (t *SocketmapTable) Lookup(key string) (string, bool, error) {
+	var reply string
+	err := t.pool.do(t.dial, func(c *poolConn) error {
+		var err error
+		if reply, err = socketmapQuery(c, t.Name+" "+key, t.Timeout); err != nil {
+			return fmt.Errorf("backendutil: socketmap lookup failed: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	status, value := reply, ""
+	if i := strings.IndexByte(reply, ' '); i >= 0 {
+		status, value = reply[:i], reply[i+1:]
+	}
+	switch status {
+	case "OK":
+		return value, true, nil
+	case "NOTFOUND":
+		return "", false, nil
+	default:
+		return "", false, fmt.Errorf("backendutil: socketmap lookup failed: %v", reply)
+	}
+}
+
+func (t *SocketmapTable) dial() (*poolConn, error) {
+	c, err := dialPoolConn(t.Network, t.Addr, t.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("backendutil: failed to connect to socketmap server: %v", err)
+	}
+	return c, nil
+}
+
+func socketmapQuery(c *poolConn, req string, timeout time.Duration) (string, error) {
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+	if _, err := fmt.Fprintf(c, "%v:%v,", len(req), req); err != nil {
+		return "", err
+	}
+	return readNetstring(c.br)
+}
+
+func readNetstring(br *bufio.Reader) (string, error) {
+	s, err := br.ReadString(':')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(s, ":"))
+	if err != nil || n < 0 || n > maxNetstringLen {
+		return "", errors.New("malformed netstring length")
+	}
+	b := make([]byte, n+1)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return "", err
+	}
+	if b[n] != ',' {
+		return "", errors.New("malformed netstring")
+	}
+	return string(b[:n]), nil
+}
+
+// Close closes the idle connections.
+func (t *SocketmapTable) Close() error {
+	return t.pool.Close()
+}
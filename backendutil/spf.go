@@ -0,0 +1,432 @@
+package backendutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Resolver resolves DNS records. *net.Resolver implements it.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+func resolverOrDefault(r Resolver) Resolver {
+	if r != nil {
+		return r
+	}
+	return net.DefaultResolver
+}
+
+// isNotFound reports whether a DNS error means that the name or record
+// doesn't exist.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// SPFResult is the result of a SPF check, as defined in RFC 7208 section 2.6.
+type SPFResult string
+
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+// spfMaxLookups is the maximum number of mechanisms and modifiers causing DNS
+// lookups, see RFC 7208 section 4.6.4.
+const spfMaxLookups = 10
+
+// CheckSPF checks whether a client is allowed to send mail for a sender, as
+// defined in RFC 7208. The policy of the sender domain is evaluated, or the
+// policy of the HELO name for the null sender. If r is nil,
+// net.DefaultResolver is used.
+//
+// The "exp" modifier is ignored, as well as the "ptr" mechanism, which never
+// matches.
+func CheckSPF(ctx context.Context, r Resolver, ip net.IP, helo, sender string) SPFResult {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	at := strings.LastIndexByte(sender, '@')
+	if at < 0 {
+		sender = "postmaster@" + sender
+		at = len("postmaster")
+	}
+	c := &spfChecker{
+		ctx:    ctx,
+		r:      resolverOrDefault(r),
+		ip:     ip,
+		helo:   helo,
+		sender: sender,
+		local:  sender[:at],
+		domain: sender[at+1:],
+	}
+	return c.check(c.domain)
+}
+
+type spfChecker struct {
+	ctx     context.Context
+	r       Resolver
+	ip      net.IP
+	helo    string
+	sender  string
+	local   string
+	domain  string
+	lookups int
+}
+
+// record returns the SPF record of a domain.
+func (c *spfChecker) record(domain string) (string, SPFResult) {
+	txts, err := c.r.LookupTXT(c.ctx, domain)
+	if isNotFound(err) {
+		return "", SPFNone
+	} else if err != nil {
+		return "", SPFTempError
+	}
+
+	var record string
+	n := 0
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || (len(txt) > 7 && strings.EqualFold(txt[:7], "v=spf1 ")) {
+			record = txt
+			n++
+		}
+	}
+	switch n {
+	case 0:
+		return "", SPFNone
+	case 1:
+		return record, ""
+	default:
+		return "", SPFPermError
+	}
+}
+
+func (c *spfChecker) check(domain string) SPFResult {
+	record, res := c.record(domain)
+	if res != "" {
+		return res
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		// Modifiers are name=value, mechanisms may contain "=" after ":"
+		if i := strings.IndexAny(term, "=:/"); i > 0 && term[i] == '=' {
+			if strings.EqualFold(term[:i], "redirect") {
+				redirect = term[i+1:]
+			}
+			continue
+		}
+
+		qualifier := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = SPFFail, term[1:]
+		case '~':
+			qualifier, term = SPFSoftFail, term[1:]
+		case '?':
+			qualifier, term = SPFNeutral, term[1:]
+		}
+
+		name, arg := term, ""
+		if i := strings.IndexAny(term, ":/"); i >= 0 {
+			name, arg = term[:i], term[i:]
+			arg = strings.TrimPrefix(arg, ":")
+		}
+		match, res := c.mechanism(strings.ToLower(name), arg, domain)
+		if res != "" {
+			return res
+		}
+		if match {
+			return qualifier
+		}
+	}
+
+	if redirect != "" {
+		if !c.lookup() {
+			return SPFPermError
+		}
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return SPFPermError
+		}
+		res := c.check(target)
+		if res == SPFNone {
+			return SPFPermError
+		}
+		return res
+	}
+	return SPFNeutral
+}
+
+// lookup counts a term causing DNS lookups, and reports whether the limit
+// isn't exceeded.
+func (c *spfChecker) lookup() bool {
+	c.lookups++
+	return c.lookups <= spfMaxLookups
+}
+
+// mechanism reports whether a mechanism matches. An error result is returned
+// if the evaluation fails.
+func (c *spfChecker) mechanism(name, arg, domain string) (bool, SPFResult) {
+	switch name {
+	case "all":
+		return true, ""
+	case "ip4", "ip6":
+		if !strings.Contains(arg, "/") {
+			if name == "ip4" {
+				arg += "/32"
+			} else {
+				arg += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(arg)
+		if err != nil {
+			return false, SPFPermError
+		}
+		return n.Contains(c.ip), ""
+	case "ptr":
+		if !c.lookup() {
+			return false, SPFPermError
+		}
+		return false, ""
+	}
+
+	if !c.lookup() {
+		return false, SPFPermError
+	}
+	spec, v4, v6, err := splitSPFCIDR(arg)
+	if err != nil {
+		return false, SPFPermError
+	}
+	target := domain
+	if spec != "" {
+		if target, err = c.expand(spec, domain); err != nil {
+			return false, SPFPermError
+		}
+	} else if name == "include" || name == "exists" {
+		return false, SPFPermError
+	}
+
+	switch name {
+	case "include":
+		switch c.check(target) {
+		case SPFPass:
+			return true, ""
+		case SPFFail, SPFSoftFail, SPFNeutral:
+			return false, ""
+		case SPFTempError:
+			return false, SPFTempError
+		default:
+			return false, SPFPermError
+		}
+	case "exists":
+		addrs, err := c.r.LookupHost(c.ctx, target)
+		if err != nil && !isNotFound(err) {
+			return false, SPFTempError
+		}
+		return len(addrs) > 0, ""
+	case "a":
+		return c.matchHost(target, v4, v6)
+	case "mx":
+		mxs, err := c.r.LookupMX(c.ctx, target)
+		if isNotFound(err) {
+			return false, ""
+		} else if err != nil {
+			return false, SPFTempError
+		}
+		if len(mxs) > spfMaxLookups {
+			return false, SPFPermError
+		}
+		for _, mx := range mxs {
+			if match, res := c.matchHost(strings.TrimSuffix(mx.Host, "."), v4, v6); match || res != "" {
+				return match, res
+			}
+		}
+		return false, ""
+	default:
+		return false, SPFPermError
+	}
+}
+
+// matchHost reports whether the addresses of a host contain the client IP,
+// with the given prefix lengths.
+func (c *spfChecker) matchHost(host string, v4, v6 int) (bool, SPFResult) {
+	addrs, err := c.r.LookupHost(c.ctx, host)
+	if isNotFound(err) {
+		return false, ""
+	} else if err != nil {
+		return false, SPFTempError
+	}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		bits, size := v6, 128
+		if ip.To4() != nil {
+			ip, bits, size = ip.To4(), v4, 32
+		}
+		if (ip.To4() == nil) != (c.ip.To4() == nil) {
+			continue
+		}
+		if (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, size)}).Contains(c.ip) {
+			return true, ""
+		}
+	}
+	return false, ""
+}
+
+// splitSPFCIDR splits the argument of the "a" and "mx" mechanisms into a
+// domain spec and IPv4 and IPv6 prefix lengths, as in "example.org/24//64".
+func splitSPFCIDR(arg string) (spec string, v4, v6 int, err error) {
+	v4, v6 = 32, 128
+	spec = arg
+	if i := strings.Index(arg, "//"); i >= 0 {
+		spec = arg[:i]
+		if v6, err = strconv.Atoi(arg[i+2:]); err != nil || v6 < 0 || v6 > 128 {
+			return "", 0, 0, fmt.Errorf("backendutil: invalid SPF IPv6 prefix length in %q", arg)
+		}
+	}
+	if i := strings.IndexByte(spec, '/'); i >= 0 {
+		var n int
+		if n, err = strconv.Atoi(spec[i+1:]); err != nil || n < 0 || n > 32 {
+			return "", 0, 0, fmt.Errorf("backendutil: invalid SPF IPv4 prefix length in %q", arg)
+		}
+		spec, v4 = spec[:i], n
+	}
+	return spec, v4, v6, nil
+}
+
+// expand expands the macros of a domain spec, see RFC 7208 section 7.
+func (c *spfChecker) expand(spec, domain string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return spec, nil
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			sb.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", fmt.Errorf("backendutil: invalid SPF macro in %q", spec)
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			sb.WriteByte('%')
+			continue
+		case '_':
+			sb.WriteByte(' ')
+			continue
+		case '-':
+			sb.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", fmt.Errorf("backendutil: invalid SPF macro in %q", spec)
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", fmt.Errorf("backendutil: invalid SPF macro in %q", spec)
+		}
+		v, err := c.macro(spec[i+1:i+end], domain)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(v)
+		i += end
+	}
+	return sb.String(), nil
+}
+
+// macro expands a single macro, such as "ir" or "d2".
+func (c *spfChecker) macro(m, domain string) (string, error) {
+	var v string
+	switch m[0] {
+	case 's', 'S':
+		v = c.sender
+	case 'l', 'L':
+		v = c.local
+	case 'o', 'O':
+		v = c.domain
+	case 'd', 'D':
+		v = domain
+	case 'h', 'H':
+		v = c.helo
+	case 'i', 'I':
+		if ip4 := c.ip.To4(); ip4 != nil {
+			v = ip4.String()
+		} else {
+			v = strings.Join(ipv6Nibbles(c.ip), ".")
+		}
+	case 'v', 'V':
+		v = "in-addr"
+		if c.ip.To4() == nil {
+			v = "ip6"
+		}
+	default:
+		return "", fmt.Errorf("backendutil: unsupported SPF macro %q", m)
+	}
+
+	// Transformers: an optional number of parts, "r" to reverse and
+	// delimiters
+	m = m[1:]
+	n := 0
+	for len(m) > 0 && m[0] >= '0' && m[0] <= '9' {
+		n = n*10 + int(m[0]-'0')
+		m = m[1:]
+	}
+	reverse := false
+	if len(m) > 0 && (m[0] == 'r' || m[0] == 'R') {
+		reverse, m = true, m[1:]
+	}
+	delims := m
+	if delims == "" {
+		delims = "."
+	} else if strings.Trim(delims, ".-+,/_=") != "" {
+		return "", fmt.Errorf("backendutil: invalid SPF macro delimiters %q", delims)
+	}
+	if n == 0 && !reverse && m == "" {
+		return v, nil
+	}
+
+	parts := strings.FieldsFunc(v, func(r rune) bool {
+		return strings.ContainsRune(delims, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if n > 0 && n < len(parts) {
+		parts = parts[len(parts)-n:]
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// ipv6Nibbles returns the hexadecimal nibbles of an IPv6 address.
+func ipv6Nibbles(ip net.IP) []string {
+	ip = ip.To16()
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip {
+		nibbles = append(nibbles, strconv.FormatUint(uint64(b>>4), 16), strconv.FormatUint(uint64(b&0xf), 16))
+	}
+	return nibbles
+}
@@ -0,0 +1,105 @@
+package backendutil_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+// testResolver is a Resolver answering from static records.
+type testResolver struct {
+	ptr  map[string][]string
+	host map[string][]string
+	txt  map[string][]string
+	mx   map[string][]*net.MX
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *testResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if l, ok := r.ptr[addr]; ok {
+		return l, nil
+	}
+	return nil, notFound(addr)
+}
+
+func (r *testResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if l, ok := r.host[host]; ok {
+		return l, nil
+	}
+	return nil, notFound(host)
+}
+
+func (r *testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if l, ok := r.txt[name]; ok {
+		return l, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *testResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if l, ok := r.mx[name]; ok {
+		return l, nil
+	}
+	return nil, notFound(name)
+}
+
+var _ backendutil.Resolver = &net.Resolver{}
+
+func TestCheckSPF(t *testing.T) {
+	r := &testResolver{
+		host: map[string][]string{
+			"mail.example.org":       {"192.0.2.10"},
+			"mx.example.org":         {"192.0.2.20", "2001:db8::20"},
+			"198.51.100.1.allow.org": {"127.0.0.2"},
+		},
+		txt: map[string][]string{
+			"example.org":      {"google-site-verification=abc", "v=spf1 ip4:198.51.100.0/24 a:mail.example.org mx include:_spf.example.org -all"},
+			"_spf.example.org": {"v=spf1 ip6:2001:db8:1::/48 ~all"},
+			"soft.org":         {"v=spf1 a:mail.example.org/24 ~all"},
+			"redirect.org":     {"v=spf1 redirect=example.org"},
+			"macro.org":        {"v=spf1 exists:%{i}.allow.org -all"},
+			"dup.org":          {"v=spf1 -all", "v=spf1 +all"},
+			"loop.org":         {"v=spf1 include:loop.org -all"},
+			"neutral.org":      {"v=spf1 ?all"},
+			"bad.org":          {"v=spf1 foo:bar -all"},
+		},
+		mx: map[string][]*net.MX{
+			"example.org": {{Host: "mx.example.org.", Pref: 10}},
+		},
+	}
+
+	tests := []struct {
+		ip     string
+		sender string
+		want   backendutil.SPFResult
+	}{
+		{"198.51.100.7", "alice@example.org", backendutil.SPFPass},
+		{"192.0.2.10", "alice@example.org", backendutil.SPFPass},
+		{"2001:db8::20", "alice@example.org", backendutil.SPFPass},
+		{"2001:db8:1::1", "alice@example.org", backendutil.SPFPass},
+		{"203.0.113.1", "alice@example.org", backendutil.SPFFail},
+		{"192.0.2.99", "alice@soft.org", backendutil.SPFPass},
+		{"203.0.113.1", "alice@soft.org", backendutil.SPFSoftFail},
+		{"198.51.100.7", "alice@redirect.org", backendutil.SPFPass},
+		{"203.0.113.1", "alice@redirect.org", backendutil.SPFFail},
+		{"198.51.100.1", "alice@macro.org", backendutil.SPFPass},
+		{"198.51.100.2", "alice@macro.org", backendutil.SPFFail},
+		{"203.0.113.1", "alice@dup.org", backendutil.SPFPermError},
+		{"203.0.113.1", "alice@loop.org", backendutil.SPFPermError},
+		{"203.0.113.1", "alice@neutral.org", backendutil.SPFNeutral},
+		{"203.0.113.1", "alice@bad.org", backendutil.SPFPermError},
+		{"203.0.113.1", "alice@unknown.org", backendutil.SPFNone},
+		{"198.51.100.7", "", backendutil.SPFPass},
+	}
+	for _, tc := range tests {
+		got := backendutil.CheckSPF(context.Background(), r, net.ParseIP(tc.ip), "example.org", tc.sender)
+		if got != tc.want {
+			t.Errorf("CheckSPF(%v, %q) = %v, want %v", tc.ip, tc.sender, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package backendutil
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// compareDummyHash hashes a password when a user doesn't exist, so that
+// unknown and known users take the same time to be rejected.
+func compareDummyHash(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// SQLCredentials validates credentials against password hashes stored in a
+// SQL database. Its Auth method can be used as RouterBackend.Auth.
+//
+// Hashes must use bcrypt ("$2a$", "$2b$" or "$2y$" prefix) or argon2i or
+// argon2id in the PHC string format, e.g.
+// "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>".
+type SQLCredentials struct {
+	DB *sql.DB
+	// Query selects the password hash of a user, given the username as the
+	// only argument, e.g. "SELECT password FROM users WHERE username = ?".
+	// Placeholders depend on the database driver.
+	Query string
+	// CacheTTL is how long successful logins are cached, to avoid querying
+	// the database and hashing the password on each login. Zero disables
+	// caching.
+	CacheTTL time.Duration
+
+	cacheMu  sync.Mutex
+	cache    map[string]credentialsCacheEntry
+	cacheKey []byte
+}
+
+type credentialsCacheEntry struct {
+	mac     []byte
+	expires time.Time
+}
+
+// Auth checks a username and password.
+func (c *SQLCredentials) Auth(username, password string) error {
+	if c.cached(username, password) {
+		return nil
+	}
+
+	var hash string
+	err := c.DB.QueryRow(c.Query, username).Scan(&hash)
+	if err == sql.ErrNoRows {
+		compareDummyHash(password)
+		return errInvalidCredentials
+	} else if err != nil {
+		return fmt.Errorf("backendutil: failed to query credentials: %v", err)
+	}
+
+	ok, err := checkPasswordHash(hash, password)
+	if err != nil {
+		return fmt.Errorf("backendutil: invalid password hash for %q: %v", username, err)
+	}
+	if !ok {
+		return errInvalidCredentials
+	}
+
+	c.store(username, password)
+	return nil
+}
+
+// Invalidate removes a user from the cache, e.g. after a password change.
+func (c *SQLCredentials) Invalidate(username string) {
+	c.cacheMu.Lock()
+	delete(c.cache, username)
+	c.cacheMu.Unlock()
+}
+
+// mac returns a MAC of a password keyed with a random secret, so that the
+// cache doesn't hold passwords.
+func (c *SQLCredentials) mac(password string) []byte {
+	h := hmac.New(sha256.New, c.cacheKey)
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
+
+func (c *SQLCredentials) cached(username, password string) bool {
+	if c.CacheTTL <= 0 {
+		return false
+	}
+
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	entry, ok := c.cache[username]
+	if !ok {
+		return false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.cache, username)
+		return false
+	}
+	return hmac.Equal(entry.mac, c.mac(password))
+}
+
+func (c *SQLCredentials) store(username, password string) {
+	if c.CacheTTL <= 0 {
+		return
+	}
+
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	if c.cacheKey == nil {
+		c.cacheKey = make([]byte, 32)
+		if _, err := rand.Read(c.cacheKey); err != nil {
+			c.cacheKey = nil
+			return
+		}
+	}
+	if c.cache == nil {
+		c.cache = make(map[string]credentialsCacheEntry)
+	}
+
+	now := time.Now()
+	for k, entry := range c.cache {
+		if now.After(entry.expires) {
+			delete(c.cache, k)
+		}
+	}
+	c.cache[username] = credentialsCacheEntry{
+		mac:     c.mac(password),
+		expires: now.Add(c.CacheTTL),
+	}
+}
+
+// checkPasswordHash checks a password against a bcrypt or argon2 hash.
+func checkPasswordHash(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$argon2"):
+		return checkArgon2(hash, password)
+	default:
+		return false, errors.New("unsupported hash format")
+	}
+}
+
+func checkArgon2(hash, password string) (bool, error) {
+	// $argon2id$v=19$m=65536,t=3,p=4$salt$hash
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, errors.New("malformed argon2 hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, errors.New("malformed argon2 version")
+	}
+	if version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version %v", version)
+	}
+
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil || iterations == 0 || threads == 0 {
+		return false, errors.New("malformed argon2 parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errors.New("malformed argon2 salt")
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false, errors.New("malformed argon2 key")
+	}
+
+	var got []byte
+	switch parts[1] {
+	case "argon2id":
+		got = argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(want)))
+	case "argon2i":
+		got = argon2.Key([]byte(password), salt, iterations, memory, threads, uint32(len(want)))
+	default:
+		return false, fmt.Errorf("unsupported algorithm %q", parts[1])
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
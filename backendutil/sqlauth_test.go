@@ -0,0 +1,171 @@
+package backendutil_test
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp/backendutil"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fakeDB is a database/sql driver answering any query with the password
+// hash of the user given as argument.
+type fakeDB struct {
+	mu      sync.Mutex
+	hashes  map[string]string
+	queries int
+}
+
+func (db *fakeDB) Open(name string) (driver.Conn, error) {
+	return fakeConn{db}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt(c), nil
+}
+
+func (c fakeConn) Close() error {
+	return nil
+}
+
+func (c fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+
+type fakeStmt struct {
+	db *fakeDB
+}
+
+func (s fakeStmt) Close() error {
+	return nil
+}
+
+func (s fakeStmt) NumInput() int {
+	return 1
+}
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("exec not supported")
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.db.queries++
+	rows := &fakeRows{}
+	if hash, ok := s.db.hashes[args[0].(string)]; ok {
+		rows.values = []string{hash}
+	}
+	return rows, nil
+}
+
+type fakeRows struct {
+	values []string
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"password"}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0] = r.values[0]
+	r.values = r.values[1:]
+	return nil
+}
+
+var fakeDriver = &fakeDB{}
+
+func init() {
+	sql.Register("backendutil-fake", fakeDriver)
+}
+
+func argon2idHash(password string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	key := argon2.IDKey([]byte(password), salt, 1, 1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%v$%v", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestSQLCredentials(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeDriver.mu.Lock()
+	fakeDriver.hashes = map[string]string{
+		"alice": string(bcryptHash),
+		"bob":   argon2idHash("correct horse"),
+		"eve":   "plaintext",
+	}
+	fakeDriver.queries = 0
+	fakeDriver.mu.Unlock()
+
+	db, err := sql.Open("backendutil-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	creds := &backendutil.SQLCredentials{
+		DB:       db,
+		Query:    "SELECT password FROM users WHERE username = ?",
+		CacheTTL: time.Minute,
+	}
+	for _, test := range []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"alice", "hunter2", true},
+		{"alice", "hunter3", false},
+		{"bob", "correct horse", true},
+		{"bob", "battery staple", false},
+		{"mallory", "hunter2", false},
+		{"eve", "plaintext", false},
+	} {
+		err := creds.Auth(test.username, test.password)
+		if (err == nil) != test.ok {
+			t.Errorf("Auth(%q, %q) = %v, want ok = %v", test.username, test.password, err, test.ok)
+		}
+	}
+
+	fakeDriver.mu.Lock()
+	queries := fakeDriver.queries
+	fakeDriver.mu.Unlock()
+	if err := creds.Auth("alice", "hunter2"); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if err := creds.Auth("alice", "hunter3"); err == nil {
+		t.Error("Auth: expected an error with a wrong password and a cached login")
+	}
+	fakeDriver.mu.Lock()
+	if fakeDriver.queries != queries+1 {
+		t.Errorf("expected the successful login to be cached, got %v queries", fakeDriver.queries-queries)
+	}
+	fakeDriver.mu.Unlock()
+
+	creds.Invalidate("alice")
+	if err := creds.Auth("alice", "hunter2"); err != nil {
+		t.Fatalf("Auth after Invalidate: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package backendutil
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// SubmissionBackend completes the header of messages submitted by
+// authenticated users, as RFC 6409 section 8 permits message submission
+// agents to. Messages missing a Date, Message-ID or From header field are
+// fixed if the matching option is set, and rejected with 554 5.6.0 otherwise.
+// Anonymous sessions are passed through.
+//
+// Only the header is buffered, the body is streamed.
+type SubmissionBackend struct {
+	Backend smtp.Backend
+	// If set, a missing Date field is added with the current time.
+	AddDate bool
+	// If set, a missing Message-ID field is added with a random identifier.
+	AddMessageID bool
+	// If set, a missing From field is added with the envelope sender.
+	// Messages with a null sender are still rejected.
+	AddFrom bool
+	// The host name used in generated message IDs. If empty, os.Hostname is
+	// used.
+	Hostname string
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// Login implements the smtp.Backend interface.
+func (be *SubmissionBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	s, err := be.Backend.Login(state, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &submissionSession{Session: s, be: be}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *SubmissionBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return be.Backend.AnonymousLogin(state)
+}
+
+func (be *SubmissionBackend) hostname() string {
+	if be.Hostname != "" {
+		return be.Hostname
+	}
+	if name, err := os.Hostname(); err == nil {
+		return name
+	}
+	return "localhost"
+}
+
+func (be *SubmissionBackend) now() time.Time {
+	if be.Now != nil {
+		return be.Now()
+	}
+	return time.Now()
+}
+
+func missingFieldError(name string) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      "Message has no " + name + " header field",
+	}
+}
+
+type submissionSession struct {
+	smtp.Session
+
+	be   *SubmissionBackend
+	from string
+}
+
+func (s *submissionSession) Reset() {
+	s.from = ""
+	s.Session.Reset()
+}
+
+func (s *submissionSession) Mail(from string) error {
+	if err := s.Session.Mail(from); err != nil {
+		return err
+	}
+	s.from = from
+	return nil
+}
+
+func (s *submissionSession) Data(r io.Reader) error {
+	br := bufio.NewReader(r)
+	fields, eol, err := readHeaderFields(br)
+	if err != nil {
+		return err
+	}
+
+	var hasDate, hasMessageID, hasFrom bool
+	for _, field := range fields {
+		switch strings.ToLower(fieldName(field)) {
+		case "date":
+			hasDate = true
+		case "message-id":
+			hasMessageID = true
+		case "from":
+			hasFrom = true
+		}
+	}
+
+	var header bytes.Buffer
+	for _, field := range fields {
+		header.WriteString(field)
+	}
+	if !hasFrom {
+		if !s.be.AddFrom || s.from == "" {
+			return missingFieldError("From")
+		}
+		fmt.Fprintf(&header, "From: <%v>%v", s.from, eol)
+	}
+	if !hasDate {
+		if !s.be.AddDate {
+			return missingFieldError("Date")
+		}
+		fmt.Fprintf(&header, "Date: %v%v", s.be.now().Format(time.RFC1123Z), eol)
+	}
+	if !hasMessageID {
+		if !s.be.AddMessageID {
+			return missingFieldError("Message-ID")
+		}
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return err
+		}
+		fmt.Fprintf(&header, "Message-ID: <%v@%v>%v", hex.EncodeToString(b[:]), s.be.hostname(), eol)
+	}
+	header.WriteString(eol)
+
+	return s.Session.Data(io.MultiReader(&header, br))
+}
@@ -0,0 +1,82 @@
+package backendutil_test
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.SubmissionBackend{}
+
+func TestSubmissionBackend(t *testing.T) {
+	mem := &backendutil.MemoryBackend{
+		Auth:           backendutil.UserMap{"alice": "secret"}.Auth,
+		AllowAnonymous: true,
+	}
+	be := &backendutil.SubmissionBackend{
+		Backend:  mem,
+		Hostname: "mx.example.org",
+		Now:      func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) },
+	}
+
+	send := func(s smtp.Session, from, msg string) error {
+		if err := s.Mail(from); err != nil {
+			return err
+		}
+		if err := s.Rcpt("bob@example.org"); err != nil {
+			return err
+		}
+		return s.Data(strings.NewReader(msg))
+	}
+
+	s, err := be.Login(nil, "alice", "secret")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	complete := "From: alice@example.org\r\nDate: Tue, 2 Jan 2024 03:04:05 +0000\r\nMessage-ID: <1@example.org>\r\n\r\nHi\r\n"
+	if err := send(s, "alice@example.org", complete); err != nil {
+		t.Fatalf("complete message: %v", err)
+	}
+
+	// Missing fields are rejected by default
+	err = send(s, "alice@example.org", "Subject: Hi\r\n\r\nHi\r\n")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 554 || smtpErr.Message != "Message has no From header field" {
+		t.Errorf("incomplete message: expected a 554 error, got %v", err)
+	}
+
+	be.AddFrom = true
+	be.AddDate = true
+	be.AddMessageID = true
+	if err := send(s, "alice@example.org", "Subject: Hi\r\n\r\nHi\r\n"); err != nil {
+		t.Fatalf("fixed message: %v", err)
+	}
+	// A null sender can't be used as From
+	if err := send(s, "", "Subject: Hi\r\n\r\nHi\r\n"); err == nil {
+		t.Error("message without From and with a null sender: expected an error")
+	}
+
+	msgs := mem.Mailbox("bob@example.org")
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %v", len(msgs))
+	}
+	if string(msgs[0].Data) != complete {
+		t.Errorf("complete message changed:\n%v", string(msgs[0].Data))
+	}
+	re := regexp.MustCompile("^Subject: Hi\r\nFrom: <alice@example.org>\r\nDate: Tue, 02 Jan 2024 03:04:05 \\+0000\r\nMessage-ID: <[0-9a-f]{32}@mx.example.org>\r\n\r\nHi\r\n$")
+	if !re.Match(msgs[1].Data) {
+		t.Errorf("unexpected fixed message:\n%v", string(msgs[1].Data))
+	}
+
+	// Anonymous sessions aren't submissions
+	s, err = be.AnonymousLogin(nil)
+	if err != nil {
+		t.Fatalf("AnonymousLogin: %v", err)
+	}
+	if err := send(s, "carol@example.net", "Subject: Hi\r\n\r\nHi\r\n"); err != nil {
+		t.Fatalf("anonymous message: %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package backendutil
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Table is a lookup table, similar to Postfix lookup tables. It is used to
+// store aliases, routes and access rules outside of the program, for instance
+// to reuse existing Postfix maps.
+//
+// Keys are looked up in lower-case. Implementations must be safe for
+// concurrent use.
+type Table interface {
+	// Lookup returns the value of a key. ok is false if the key is missing.
+	// Errors are temporary failures, e.g. when a server can't be reached.
+	Lookup(key string) (value string, ok bool, err error)
+}
+
+// MapTable is a static in-memory table.
+type MapTable map[string]string
+
+// Lookup implements Table.
+func (t MapTable) Lookup(key string) (string, bool, error) {
+	v, ok := t[key]
+	return v, ok, nil
+}
+
+// LoadTable reads a table in the Postfix text format. Each line contains a
+// key and a value separated by whitespace. Lines starting with whitespace
+// continue the previous line. Empty lines and lines starting with "#" are
+// ignored. Keys are converted to lower-case.
+func LoadTable(r io.Reader) (MapTable, error) {
+	t := make(MapTable)
+	var key string
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if key == "" {
+				return nil, fmt.Errorf("backendutil: table line %v: continuation without a key", lineno)
+			}
+			t[key] += " " + trimmed
+			continue
+		}
+
+		i := strings.IndexAny(trimmed, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("backendutil: table line %v: missing value", lineno)
+		}
+		key = strings.ToLower(trimmed[:i])
+		t[key] = strings.TrimSpace(trimmed[i+1:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// OpenTable opens a table described by a Postfix-like "type:name" string:
+//
+//	static:value                  always returns value
+//	texthash:/path                a text file, see LoadTable
+//	cdb:/path                     a CDB file, see OpenCDBTable
+//	socketmap:inet:host:port:name a socketmap server, see SocketmapTable
+//	socketmap:unix:/path:name
+//	redis:host:port[/db]          a Redis server, see RedisTable
+//
+// timeout is used for network tables. Zero means no timeout.
+func OpenTable(spec string, timeout time.Duration) (Table, error) {
+	i := strings.IndexByte(spec, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("backendutil: invalid table %q: missing type", spec)
+	}
+	typ, name := spec[:i], spec[i+1:]
+
+	switch typ {
+	case "static":
+		return staticTable(name), nil
+	case "texthash":
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return LoadTable(f)
+	case "cdb":
+		return OpenCDBTable(name)
+	case "socketmap":
+		// The map name follows the last colon, the address may contain colons
+		j := strings.LastIndexByte(name, ':')
+		k := strings.IndexByte(name, ':')
+		if j < 0 || k == j {
+			return nil, fmt.Errorf("backendutil: invalid socketmap table %q", spec)
+		}
+		network, addr := name[:k], name[k+1:j]
+		if network == "inet" {
+			network = "tcp"
+		}
+		if network != "tcp" && network != "unix" {
+			return nil, fmt.Errorf("backendutil: invalid socketmap network %q", network)
+		}
+		return &SocketmapTable{
+			Network: network,
+			Addr:    addr,
+			Name:    name[j+1:],
+			Timeout: timeout,
+		}, nil
+	case "redis":
+		t := &RedisTable{Network: "tcp", Addr: name, Timeout: timeout}
+		if j := strings.IndexByte(name, '/'); j >= 0 {
+			t.Addr = name[:j]
+			if _, err := fmt.Sscanf(name[j+1:], "%d", &t.DB); err != nil {
+				return nil, fmt.Errorf("backendutil: invalid Redis database in %q", spec)
+			}
+		}
+		return t, nil
+	default:
+		return nil, fmt.Errorf("backendutil: unknown table type %q", typ)
+	}
+}
+
+type staticTable string
+
+func (t staticTable) Lookup(key string) (string, bool, error) {
+	return string(t), true, nil
+}
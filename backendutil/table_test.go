@@ -0,0 +1,343 @@
+package backendutil_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var (
+	_ backendutil.Table = backendutil.MapTable{}
+	_ backendutil.Table = &backendutil.CDBTable{}
+	_ backendutil.Table = &backendutil.SocketmapTable{}
+	_ backendutil.Table = &backendutil.RedisTable{}
+	_ smtp.Backend      = &backendutil.AccessBackend{}
+)
+
+func testLookup(t *testing.T, table backendutil.Table, want map[string]string, missing ...string) {
+	t.Helper()
+	for key, v := range want {
+		got, ok, err := table.Lookup(key)
+		if err != nil || !ok || got != v {
+			t.Errorf("Lookup(%q) = %q, %v, %v, want %q", key, got, ok, err, v)
+		}
+	}
+	for _, key := range missing {
+		if _, ok, err := table.Lookup(key); ok || err != nil {
+			t.Errorf("Lookup(%q): expected a missing key, got %v, %v", key, ok, err)
+		}
+	}
+}
+
+func TestLoadTable(t *testing.T) {
+	table, err := backendutil.LoadTable(strings.NewReader(`# Routes
+Example.org   [mx.example.org]:25
+example.net   long
+  value
+`))
+	if err != nil {
+		t.Fatalf("LoadTable: %v", err)
+	}
+	testLookup(t, table, map[string]string{
+		"example.org": "[mx.example.org]:25",
+		"example.net": "long value",
+	}, "example.com")
+
+	for _, src := range []string{"key", "  continuation"} {
+		if _, err := backendutil.LoadTable(strings.NewReader(src)); err == nil {
+			t.Errorf("LoadTable(%q): expected an error", src)
+		}
+	}
+}
+
+// writeCDB writes a CDB file, see https://cr.yp.to/cdb/cdb.txt.
+func writeCDB(w io.Writer, m map[string]string) {
+	type slot struct{ h, pos uint32 }
+	var buckets [256][]slot
+	var records bytes.Buffer
+	pos := uint32(2048)
+	put := func(b []byte, a, c uint32) {
+		binary.LittleEndian.PutUint32(b, a)
+		binary.LittleEndian.PutUint32(b[4:], c)
+	}
+	for k, v := range m {
+		h := uint32(5381)
+		for _, c := range []byte(k) {
+			h = ((h << 5) + h) ^ uint32(c)
+		}
+		buckets[h%256] = append(buckets[h%256], slot{h, pos})
+		var hdr [8]byte
+		put(hdr[:], uint32(len(k)), uint32(len(v)))
+		records.Write(hdr[:])
+		records.WriteString(k + v)
+		pos += uint32(8 + len(k) + len(v))
+	}
+
+	header := make([]byte, 2048)
+	var tables bytes.Buffer
+	for i, bucket := range buckets {
+		n := uint32(2 * len(bucket))
+		put(header[i*8:], pos+uint32(tables.Len()), n)
+		slots := make([]slot, n)
+		for _, s := range bucket {
+			j := (s.h >> 8) % n
+			for slots[j].pos != 0 {
+				j = (j + 1) % n
+			}
+			slots[j] = s
+		}
+		for _, s := range slots {
+			var b [8]byte
+			put(b[:], s.h, s.pos)
+			tables.Write(b[:])
+		}
+	}
+	w.Write(header)
+	w.Write(records.Bytes())
+	w.Write(tables.Bytes())
+}
+
+func TestCDBTable(t *testing.T) {
+	m := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		m[fmt.Sprintf("user%v@example.org", i)] = fmt.Sprintf("target%v@example.net", i)
+	}
+	m["nul@example.org\x00"] = "postfix@example.net\x00"
+
+	dir, err := ioutil.TempDir("", "backendutil-cdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "aliases.cdb")
+	var buf bytes.Buffer
+	writeCDB(&buf, m)
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := backendutil.OpenTable("cdb:"+path, 0)
+	if err != nil {
+		t.Fatalf("OpenTable: %v", err)
+	}
+	defer table.(*backendutil.CDBTable).Close()
+	testLookup(t, table, map[string]string{
+		"user0@example.org":   "target0@example.net",
+		"user999@example.org": "target999@example.net",
+		"nul@example.org":     "postfix@example.net",
+	}, "user1000@example.org", "")
+}
+
+func TestSocketmapTable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		br := bufio.NewReader(c)
+		for {
+			s, err := br.ReadString(':')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSuffix(s, ":"))
+			b := make([]byte, n+1)
+			if _, err := io.ReadFull(br, b); err != nil {
+				return
+			}
+			var reply string
+			switch string(b[:n]) {
+			case "virtual alice@example.org":
+				reply = "OK alice@mail.example.org"
+			case "virtual broken@example.org":
+				reply = "TEMP database unavailable"
+			default:
+				reply = "NOTFOUND "
+			}
+			fmt.Fprintf(c, "%v:%v,", len(reply), reply)
+		}
+	}()
+
+	table, err := backendutil.OpenTable("socketmap:inet:"+l.Addr().String()+":virtual", 0)
+	if err != nil {
+		t.Fatalf("OpenTable: %v", err)
+	}
+	defer table.(*backendutil.SocketmapTable).Close()
+	testLookup(t, table, map[string]string{"alice@example.org": "alice@mail.example.org"}, "bob@example.org")
+	if _, _, err := table.Lookup("broken@example.org"); err == nil {
+		t.Error("Lookup: expected an error for a TEMP reply")
+	}
+}
+
+func TestRedisTable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var (
+		mu       sync.Mutex
+		commands []string
+	)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		br := bufio.NewReader(c)
+		for {
+			var args []string
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			for i := 0; i < n; i++ {
+				br.ReadString('\n')
+				arg, _ := br.ReadString('\n')
+				args = append(args, strings.TrimSpace(arg))
+			}
+			mu.Lock()
+			commands = append(commands, strings.Join(args, " "))
+			mu.Unlock()
+			switch {
+			case args[0] != "GET":
+				io.WriteString(c, "+OK\r\n")
+			case args[1] == "route:example.org":
+				io.WriteString(c, "$19\r\n[mx.example.org]:25\r\n")
+			default:
+				io.WriteString(c, "$-1\r\n")
+			}
+		}
+	}()
+
+	table := &backendutil.RedisTable{
+		Network:  "tcp",
+		Addr:     l.Addr().String(),
+		Password: "secret",
+		DB:       2,
+		Prefix:   "route:",
+	}
+	defer table.Close()
+	testLookup(t, table, map[string]string{"example.org": "[mx.example.org]:25"}, "example.net")
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"AUTH secret", "SELECT 2", "GET route:example.org", "GET route:example.net"}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("unexpected commands: %q", commands)
+	}
+}
+
+func TestOpenTable(t *testing.T) {
+	table, err := backendutil.OpenTable("static:smtp.example.org:587", 0)
+	if err != nil {
+		t.Fatalf("OpenTable: %v", err)
+	}
+	testLookup(t, table, map[string]string{"anything": "smtp.example.org:587"})
+
+	redis, err := backendutil.OpenTable("redis:127.0.0.1:6379/3", 0)
+	if err != nil {
+		t.Fatalf("OpenTable: %v", err)
+	}
+	if rt := redis.(*backendutil.RedisTable); rt.Addr != "127.0.0.1:6379" || rt.DB != 3 {
+		t.Errorf("unexpected Redis table: %+v", rt)
+	}
+
+	for _, spec := range []string{"aliases", "hash:/etc/postfix/aliases", "socketmap:inet:127.0.0.1", "socketmap:udp:127.0.0.1:1:map", "redis:127.0.0.1:6379/db"} {
+		if _, err := backendutil.OpenTable(spec, 0); err == nil {
+			t.Errorf("OpenTable(%q): expected an error", spec)
+		}
+	}
+}
+
+func TestAliasMap_table(t *testing.T) {
+	m := &backendutil.AliasMap{
+		Aliases: map[string][]string{"postmaster@example.org": {"abuse@example.org"}},
+		Table: backendutil.MapTable{
+			"abuse@example.org": "alice@example.org, bob@example.org",
+			"@example.net":      "catch-all@example.org",
+		},
+	}
+	for rcpt, want := range map[string][]string{
+		"postmaster@example.org": {"alice@example.org", "bob@example.org"},
+		"Anyone@example.net":     {"catch-all@example.org"},
+		"carol@example.org":      {"carol@example.org"},
+	} {
+		got, err := m.Rewrite(rcpt)
+		if err != nil {
+			t.Errorf("Rewrite(%q): %v", rcpt, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("Rewrite(%q) = %v, want %v", rcpt, got, want)
+		}
+	}
+}
+
+func TestAccessBackend(t *testing.T) {
+	be := &backendutil.AccessBackend{
+		Backend: &backendutil.MemoryBackend{AllowAnonymous: true},
+		Clients: backendutil.MapTable{"198.51.100": "REJECT Blocked network"},
+		Senders: backendutil.MapTable{
+			"spam.example":     "REJECT",
+			"<>":               "DEFER No bounces today",
+			"vip@spam.example": "OK",
+		},
+		Recipients: backendutil.MapTable{
+			"postmaster@": "OK",
+			"example.org": "550 5.1.1 Unknown user",
+		},
+	}
+
+	session := func(ip net.IP) smtp.Session {
+		s, err := be.AnonymousLogin(&smtp.ConnectionState{RemoteAddr: &net.TCPAddr{IP: ip, Port: 25}})
+		if err != nil {
+			t.Fatalf("AnonymousLogin: %v", err)
+		}
+		return s
+	}
+	code := func(err error) int {
+		if smtpErr, ok := err.(*smtp.SMTPError); ok {
+			return smtpErr.Code
+		} else if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		return 0
+	}
+
+	if c := code(session(net.IPv4(198, 51, 100, 7)).Mail("alice@example.com")); c != 554 {
+		t.Errorf("Mail from a blocked client: got %v, want 554", c)
+	}
+
+	s := session(net.IPv4(192, 0, 2, 1))
+	for from, want := range map[string]int{"mallory@mx.spam.example": 554, "": 450, "vip@spam.example": 0} {
+		if c := code(s.Mail(from)); c != want {
+			t.Errorf("Mail(%q): got %v, want %v", from, c, want)
+		}
+	}
+	for to, want := range map[string]int{"bob@example.org": 550, "postmaster@example.org": 550, "bob@example.com": 0} {
+		if c := code(s.Rcpt(to)); c != want {
+			t.Errorf("Rcpt(%q): got %v, want %v", to, c, want)
+		}
+	}
+}
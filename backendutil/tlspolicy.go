@@ -0,0 +1,240 @@
+package backendutil
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// TLSLevel is the TLS security level of outbound connections to a
+// destination, named after Postfix's smtp_tls_security_level.
+type TLSLevel string
+
+const (
+	// TLSNone never issues STARTTLS.
+	TLSNone TLSLevel = "none"
+	// TLSMay issues STARTTLS if the server supports it, and delivers in
+	// plaintext otherwise. This is the default.
+	TLSMay TLSLevel = "may"
+	// TLSEncrypt requires STARTTLS, but doesn't verify the server
+	// certificate.
+	TLSEncrypt TLSLevel = "encrypt"
+	// TLSVerify requires STARTTLS and a valid certificate for the server
+	// host name.
+	TLSVerify TLSLevel = "verify"
+	// TLSDANE authenticates the server with its DNSSEC-signed TLSA records,
+	// as specified in RFC 7672. Without usable records, it behaves like
+	// TLSMay.
+	TLSDANE TLSLevel = "dane"
+)
+
+// ParseTLSLevel parses a TLS security level.
+func ParseTLSLevel(s string) (TLSLevel, error) {
+	switch level := TLSLevel(strings.ToLower(s)); level {
+	case TLSNone, TLSMay, TLSEncrypt, TLSVerify, TLSDANE:
+		return level, nil
+	}
+	return "", fmt.Errorf("backendutil: unknown TLS security level %q", s)
+}
+
+// TLSA is a TLSA DNS record, see RFC 6698.
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// TLSA certificate usages, selectors and matching types.
+const (
+	tlsaUsageDANETA = 2
+	tlsaUsageDANEEE = 3
+
+	tlsaSelectorCert = 0
+	tlsaSelectorSPKI = 1
+
+	tlsaMatchingFull   = 0
+	tlsaMatchingSHA256 = 1
+	tlsaMatchingSHA512 = 2
+)
+
+var errTLSPolicyLookup = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Failed to look up TLS policy",
+}
+
+// tlsLevel returns the TLS security level of a destination, which is either
+// a recipient domain or a server host name. Parent domains are looked up
+// with a leading dot: ".example.org" applies to all subdomains of
+// example.org.
+func (be *RelayBackend) tlsLevel(dest string) (TLSLevel, error) {
+	dest = strings.ToLower(strings.TrimSuffix(dest, "."))
+	keys := []string{dest}
+	for s := dest; ; {
+		i := strings.IndexByte(s, '.')
+		if i < 0 {
+			break
+		}
+		s = s[i+1:]
+		keys = append(keys, "."+s)
+	}
+
+	for _, key := range keys {
+		if level, ok := be.TLSPolicies[key]; ok {
+			return level, nil
+		}
+		if be.TLSPolicyTable == nil {
+			continue
+		}
+		v, ok, err := be.TLSPolicyTable.Lookup(key)
+		if err != nil {
+			return "", errTLSPolicyLookup
+		}
+		if ok {
+			level, err := ParseTLSLevel(strings.TrimSpace(v))
+			if err != nil {
+				return "", errTLSPolicyLookup
+			}
+			return level, nil
+		}
+	}
+	return TLSMay, nil
+}
+
+// applyTLSPolicy configures STARTTLS for a connection to a server according
+// to a TLS security level.
+func (be *RelayBackend) applyTLSPolicy(c *smtp.Client, addr string, level TLSLevel) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "25"
+	}
+
+	config := be.tlsConfig(addr)
+	switch level {
+	case TLSNone:
+		c.StartTLSPolicy = smtp.StartTLSDisabled
+		return nil
+	case TLSEncrypt:
+		config = cloneTLSConfig(config)
+		config.InsecureSkipVerify = true
+	case TLSVerify:
+		// The default configuration verifies the certificate
+	case TLSDANE:
+		if be.LookupTLSA == nil {
+			return errors.New("backendutil: DANE requires LookupTLSA")
+		}
+		records, err := be.LookupTLSA(host, port)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			level = TLSMay
+			break
+		}
+		config = cloneTLSConfig(config)
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyTLSA(records, host, cs.PeerCertificates)
+		}
+	default:
+		level = TLSMay
+	}
+
+	c.TLSConfig = config
+	if level == TLSMay {
+		c.StartTLSPolicy = smtp.StartTLSOpportunistic
+	} else {
+		c.StartTLSPolicy = smtp.StartTLSRequired
+	}
+	return nil
+}
+
+func cloneTLSConfig(config *tls.Config) *tls.Config {
+	if config == nil {
+		return &tls.Config{}
+	}
+	return config.Clone()
+}
+
+// verifyTLSA checks a certificate chain against TLSA records, see RFC 7672
+// section 3.1. Records with PKIX usages are unusable for SMTP: if there are
+// only such records, the connection is encrypted but not authenticated.
+func verifyTLSA(records []TLSA, host string, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("backendutil: no server certificate")
+	}
+
+	usable := false
+	for _, r := range records {
+		switch r.Usage {
+		case tlsaUsageDANEEE:
+			usable = true
+			if matchTLSA(r, certs[0]) {
+				return nil
+			}
+		case tlsaUsageDANETA:
+			usable = true
+			for _, ta := range certs[1:] {
+				if matchTLSA(r, ta) && verifyTrustAnchor(ta, host, certs) {
+					return nil
+				}
+			}
+		}
+	}
+	if !usable {
+		return nil
+	}
+	return fmt.Errorf("backendutil: server certificate for %q doesn't match TLSA records", host)
+}
+
+// matchTLSA checks whether a certificate matches a TLSA record.
+func matchTLSA(r TLSA, cert *x509.Certificate) bool {
+	var data []byte
+	switch r.Selector {
+	case tlsaSelectorCert:
+		data = cert.Raw
+	case tlsaSelectorSPKI:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+
+	switch r.MatchingType {
+	case tlsaMatchingFull:
+	case tlsaMatchingSHA256:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case tlsaMatchingSHA512:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(data, r.Data)
+}
+
+// verifyTrustAnchor checks that the server certificate is issued by a trust
+// anchor for the server host name. Expiration dates are still checked.
+func verifyTrustAnchor(ta *x509.Certificate, host string, certs []*x509.Certificate) bool {
+	roots := x509.NewCertPool()
+	roots.AddCert(ta)
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err == nil
+}
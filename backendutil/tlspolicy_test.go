@@ -0,0 +1,118 @@
+package backendutil_test
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp/backendutil"
+	"github.com/emersion/go-smtp/smtptest"
+)
+
+func TestParseTLSLevel(t *testing.T) {
+	if level, err := backendutil.ParseTLSLevel("Verify"); err != nil || level != backendutil.TLSVerify {
+		t.Errorf("ParseTLSLevel(Verify) = %q, %v", level, err)
+	}
+	if _, err := backendutil.ParseTLSLevel("secure"); err == nil {
+		t.Error("ParseTLSLevel(secure): expected an error")
+	}
+}
+
+func TestRelayBackend_tlsPolicy(t *testing.T) {
+	mx := smtptest.NewUnstartedServer()
+	mx.StartTLS()
+	defer mx.Close()
+	plain := smtptest.NewServer()
+	defer plain.Close()
+
+	_, port, _ := net.SplitHostPort(mx.Addr)
+	_, plainPort, _ := net.SplitHostPort(plain.Addr)
+	roots := x509.NewCertPool()
+	roots.AddCert(mx.Certificate())
+	spki := sha256.Sum256(mx.Certificate().RawSubjectPublicKeyInfo)
+
+	newBackend := func(level backendutil.TLSLevel) *backendutil.RelayBackend {
+		return &backendutil.RelayBackend{
+			Port: port,
+			LookupMX: func(domain string) ([]*net.MX, error) {
+				return []*net.MX{{Host: "127.0.0.1.", Pref: 10}}, nil
+			},
+			TLSPolicies: map[string]backendutil.TLSLevel{
+				".example.org": level,
+			},
+			AllowAnonymous: true,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		level   backendutil.TLSLevel
+		roots   bool
+		tlsa    []backendutil.TLSA
+		wantTLS bool
+		wantErr bool
+	}{
+		{name: "none", level: backendutil.TLSNone},
+		{name: "may", level: backendutil.TLSMay, roots: true, wantTLS: true},
+		{name: "encrypt", level: backendutil.TLSEncrypt, wantTLS: true},
+		{name: "verify", level: backendutil.TLSVerify, roots: true, wantTLS: true},
+		{name: "verify untrusted", level: backendutil.TLSVerify, wantErr: true},
+		{
+			name:    "dane",
+			level:   backendutil.TLSDANE,
+			tlsa:    []backendutil.TLSA{{Usage: 3, Selector: 1, MatchingType: 1, Data: spki[:]}},
+			wantTLS: true,
+		},
+		{
+			name:    "dane mismatch",
+			level:   backendutil.TLSDANE,
+			roots:   true,
+			tlsa:    []backendutil.TLSA{{Usage: 3, Selector: 1, MatchingType: 1, Data: make([]byte, 32)}},
+			wantErr: true,
+		},
+		{name: "dane without records", level: backendutil.TLSDANE, roots: true, wantTLS: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			be := newBackend(tc.level)
+			if tc.roots {
+				be.TLSConfig = &tls.Config{RootCAs: roots}
+			}
+			be.LookupTLSA = func(host, port string) ([]backendutil.TLSA, error) {
+				if host != "127.0.0.1" {
+					t.Errorf("unexpected TLSA lookup for %q", host)
+				}
+				return tc.tlsa, nil
+			}
+
+			err := sendMessage(t, be, "alice@example.com", []string{"bob@mail.example.org"}, "Hello!\n")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Data: expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("Data: %v", err)
+			}
+			msgs := mx.ExpectMessages(t, 1)
+			mx.Reset()
+			if gotTLS := msgs[0].TLS != nil; gotTLS != tc.wantTLS {
+				t.Errorf("message relayed with TLS = %v, want %v", gotTLS, tc.wantTLS)
+			}
+		})
+	}
+
+	// A server without STARTTLS can't be used with a mandatory level
+	be := newBackend(backendutil.TLSEncrypt)
+	be.Port = plainPort
+	if err := sendMessage(t, be, "alice@example.com", []string{"bob@example.org"}, "Hello!\n"); err != nil {
+		t.Fatalf("Data for an unlisted domain: %v", err)
+	}
+	plain.ExpectMessages(t, 1)
+	be.TLSPolicyTable = backendutil.MapTable{"example.org": "encrypt"}
+	if err := sendMessage(t, be, "alice@example.com", []string{"bob@example.org"}, "Hello!\n"); err == nil {
+		t.Error("Data: expected an error without STARTTLS")
+	}
+}
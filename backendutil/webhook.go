@@ -0,0 +1,261 @@
+package backendutil
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// WebhookFormat is the format of the requests sent by a WebhookBackend.
+type WebhookFormat int
+
+const (
+	// WebhookRaw sends the message as the request body, with the
+	// message/rfc822 media type. The envelope is sent as JSON in the
+	// X-Smtp-Envelope header field.
+	WebhookRaw WebhookFormat = iota
+	// WebhookMultipart sends a multipart/form-data request body, with an
+	// "envelope" JSON part and a "message" message/rfc822 part.
+	WebhookMultipart
+)
+
+// WebhookEnvelope is the envelope of a message posted by a WebhookBackend.
+type WebhookEnvelope struct {
+	From       string    `json:"from"`
+	To         []string  `json:"to"`
+	Username   string    `json:"username,omitempty"`
+	Hostname   string    `json:"hostname,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Received   time.Time `json:"received"`
+}
+
+// WebhookBackend is a backend posting each message to an HTTP endpoint.
+//
+// If Secret is set, requests carry an X-Smtp-Timestamp header field holding
+// the Unix time at which the request was signed, and an X-Smtp-Signature
+// header field in the form "sha256=<hex>", computed with WebhookSignature.
+//
+// A 2xx response accepts the message. Other 4xx responses reject it
+// permanently, while network errors, 429 and 5xx responses are retried before
+// failing temporarily.
+type WebhookBackend struct {
+	// The URL messages are posted to.
+	URL    string
+	Format WebhookFormat
+	// The HTTP client used to post messages. If nil, http.DefaultClient is
+	// used.
+	HTTPClient *http.Client
+	// The key used to sign requests with HMAC-SHA256. If empty, requests are
+	// not signed.
+	Secret []byte
+	// The number of times a failed request is retried, and the delay between
+	// attempts.
+	Retries    int
+	RetryDelay time.Duration
+
+	// Auth checks credentials, e.g. UserMap.Auth. If nil, authentication is
+	// not supported.
+	Auth func(username, password string) error
+	// If set, clients can send mail without authenticating.
+	AllowAnonymous bool
+}
+
+// WebhookSignature computes the signature of a request sent by a
+// WebhookBackend. The signed payload is the timestamp, the envelope JSON and
+// the raw message, separated by line feeds.
+func WebhookSignature(secret []byte, timestamp string, envelope, message []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	io.WriteString(mac, timestamp)
+	mac.Write([]byte{'\n'})
+	mac.Write(envelope)
+	mac.Write([]byte{'\n'})
+	mac.Write(message)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Login implements the smtp.Backend interface.
+func (be *WebhookBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if err := login(be.Auth, username, password); err != nil {
+		return nil, err
+	}
+	return &webhookSession{be: be, state: state, username: username}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *WebhookBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	if !be.AllowAnonymous {
+		return nil, smtp.ErrAuthRequired
+	}
+	return &webhookSession{be: be, state: state}, nil
+}
+
+func (be *WebhookBackend) newRequest(envelope, message []byte) (*http.Request, error) {
+	var body bytes.Buffer
+	var contentType string
+	switch be.Format {
+	case WebhookRaw:
+		body.Write(message)
+		contentType = "message/rfc822"
+	case WebhookMultipart:
+		mw := multipart.NewWriter(&body)
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="envelope"`)
+		h.Set("Content-Type", "application/json")
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			return nil, err
+		}
+		w.Write(envelope)
+
+		h = make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="message"; filename="message.eml"`)
+		h.Set("Content-Type", "message/rfc822")
+		if w, err = mw.CreatePart(h); err != nil {
+			return nil, err
+		}
+		w.Write(message)
+
+		if err := mw.Close(); err != nil {
+			return nil, err
+		}
+		contentType = mw.FormDataContentType()
+	default:
+		return nil, fmt.Errorf("backendutil: unknown webhook format %v", be.Format)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, be.URL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if be.Format == WebhookRaw {
+		req.Header.Set("X-Smtp-Envelope", string(envelope))
+	}
+	if len(be.Secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Smtp-Timestamp", timestamp)
+		req.Header.Set("X-Smtp-Signature", WebhookSignature(be.Secret, timestamp, envelope, message))
+	}
+	return req, nil
+}
+
+// post sends a message to the endpoint once. The returned bool reports
+// whether the failure is temporary.
+func (be *WebhookBackend) post(envelope, message []byte) (bool, error) {
+	req, err := be.newRequest(envelope, message)
+	if err != nil {
+		return false, err
+	}
+
+	client := be.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5:
+		return true, fmt.Errorf("backendutil: webhook returned %v", resp.Status)
+	default:
+		return false, fmt.Errorf("backendutil: webhook returned %v", resp.Status)
+	}
+}
+
+func (be *WebhookBackend) deliver(envelope, message []byte) error {
+	var err error
+	for attempt := 0; attempt <= be.Retries; attempt++ {
+		if attempt > 0 && be.RetryDelay > 0 {
+			time.Sleep(be.RetryDelay)
+		}
+		var temporary bool
+		temporary, err = be.post(envelope, message)
+		if err == nil {
+			return nil
+		}
+		if !temporary {
+			return &smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 3, 0},
+				Message:      "Message rejected",
+			}
+		}
+	}
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Delivery failed, try again later",
+	}
+}
+
+type webhookSession struct {
+	be       *WebhookBackend
+	state    *smtp.ConnectionState
+	username string
+	from     string
+	to       []string
+}
+
+func (s *webhookSession) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *webhookSession) Logout() error {
+	return nil
+}
+
+func (s *webhookSession) Mail(from string) error {
+	s.Reset()
+	s.from = from
+	return nil
+}
+
+func (s *webhookSession) Rcpt(to string) error {
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *webhookSession) Data(r io.Reader) error {
+	message, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	env := WebhookEnvelope{
+		From:     s.from,
+		To:       s.to,
+		Username: s.username,
+		Received: time.Now().UTC(),
+	}
+	if s.state != nil {
+		env.Hostname = s.state.Hostname
+		if s.state.RemoteAddr != nil {
+			env.RemoteAddr = s.state.RemoteAddr.String()
+		}
+	}
+	envelope, err := json.Marshal(&env)
+	if err != nil {
+		return err
+	}
+
+	return s.be.deliver(envelope, message)
+}
@@ -0,0 +1,84 @@
+package backendutil_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.WebhookBackend{}
+
+func TestWebhookBackend(t *testing.T) {
+	secret := []byte("secret")
+	failures := 1
+	var envelope backendutil.WebhookEnvelope
+	var message []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if failures > 0 {
+			failures--
+			http.Error(w, "Try again", http.StatusServiceUnavailable)
+			return
+		}
+
+		if ct := req.Header.Get("Content-Type"); ct != "message/rfc822" {
+			t.Errorf("unexpected Content-Type %q", ct)
+		}
+		rawEnvelope := req.Header.Get("X-Smtp-Envelope")
+		if err := json.Unmarshal([]byte(rawEnvelope), &envelope); err != nil {
+			t.Errorf("invalid envelope: %v", err)
+		}
+		message, _ = ioutil.ReadAll(req.Body)
+
+		sig := backendutil.WebhookSignature(secret, req.Header.Get("X-Smtp-Timestamp"), []byte(rawEnvelope), message)
+		if got := req.Header.Get("X-Smtp-Signature"); got != sig {
+			t.Errorf("X-Smtp-Signature = %q, want %q", got, sig)
+		}
+	}))
+	defer ts.Close()
+
+	be := &backendutil.WebhookBackend{
+		URL:            ts.URL,
+		Secret:         secret,
+		Retries:        1,
+		AllowAnonymous: true,
+	}
+	if err := sendMessage(t, be, "alice@example.org", []string{"bob@example.org"}, "Hello!\n"); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	if envelope.From != "alice@example.org" || len(envelope.To) != 1 || envelope.To[0] != "bob@example.org" {
+		t.Errorf("unexpected envelope %+v", envelope)
+	}
+	if string(message) != "Hello!\n" {
+		t.Errorf("unexpected message %q", message)
+	}
+}
+
+func TestWebhookBackend_multipart(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("ParseMultipartForm: %v", err)
+			return
+		}
+		if req.MultipartForm.Value["envelope"] == nil || req.MultipartForm.File["message"] == nil {
+			t.Errorf("missing multipart fields")
+		}
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	be := &backendutil.WebhookBackend{
+		URL:            ts.URL,
+		Format:         backendutil.WebhookMultipart,
+		Retries:        3,
+		AllowAnonymous: true,
+	}
+	err := sendMessage(t, be, "alice@example.org", []string{"bob@example.org"}, "Hello!\n")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 554 {
+		t.Errorf("Data: expected permanent SMTP error, got %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// benchmarkSession runs sessions sending n messages against a server, each
+// session on a new connection.
+func benchmarkSession(b *testing.B, n int) {
+	body := strings.Repeat("Lorem ipsum dolor sit amet, consectetur adipiscing elit.\r\n", 64)
+	var sb strings.Builder
+	sb.WriteString("EHLO localhost\r\n")
+	for i := 0; i < n; i++ {
+		sb.WriteString("MAIL FROM:<alice@example.org>\r\n")
+		sb.WriteString("RCPT TO:<bob@example.org>\r\n")
+		sb.WriteString("DATA\r\n")
+		sb.WriteString(body)
+		sb.WriteString(".\r\n")
+	}
+	sb.WriteString("QUIT\r\n")
+	input := []byte(sb.String())
+
+	s := NewServer(fuzzBackend{})
+	s.Domain = "localhost"
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sc, cc := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			io.Copy(ioutil.Discard, cc)
+			close(done)
+		}()
+		go cc.Write(input)
+
+		s.handleConn(newConn(sc, s))
+		cc.Close()
+		<-done
+	}
+}
+
+func BenchmarkServer_session(b *testing.B) {
+	benchmarkSession(b, 1)
+}
+
+func BenchmarkServer_session10(b *testing.B) {
+	benchmarkSession(b, 10)
+}
+
+func BenchmarkConn_WriteResponse(b *testing.B) {
+	s := NewServer(fuzzBackend{})
+	c := newConn(nopConn{}, s)
+	caps := []string{"Hello localhost", "PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES", "AUTH PLAIN", "SIZE 10240000"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.WriteResponse(250, NoEnhancedCode, caps...)
+		c.WriteResponse(250, EnhancedCode{2, 0, 0}, "OK: queued")
+	}
+}
+
+// nopConn is a net.Conn discarding writes.
+type nopConn struct {
+	net.Conn
+}
+
+func (nopConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// BenchmarkServer_mailRcpt measures the throughput of MAIL and RCPT commands.
+func BenchmarkConn_Session(b *testing.B) {
+	c := newConn(nopConn{}, NewServer(fuzzBackend{}))
+	defer c.releaseBuffers()
+	c.SetSession(&fuzzSession{})
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if c.Session() == nil {
+				b.Fatal("missing session")
+			}
+		}
+	})
+}
+
+func BenchmarkServer_mailRcpt(b *testing.B) {
+	cmds := []byte("MAIL FROM:<alice@example.org> SIZE=1024 BODY=8BITMIME\r\n" +
+		"RCPT TO:<bob@example.org>\r\n" +
+		"RCPT TO:<carol@example.org>\r\n" +
+		"RSET\r\n")
+
+	s := NewServer(fuzzBackend{})
+	s.Domain = "localhost"
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	go io.Copy(ioutil.Discard, cc)
+	go s.handleConn(newConn(sc, s))
+	io.WriteString(cc, "EHLO localhost\r\n")
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(cmds)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cc.Write(cmds)
+	}
+}
+
+// benchmarkServer starts a server on a loopback address.
+func benchmarkServer(b *testing.B) (*Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := NewServer(fuzzBackend{})
+	s.Domain = "localhost"
+	go s.Serve(l)
+	return s, l.Addr().String()
+}
+
+// BenchmarkServer_commands measures the number of commands per second over a
+// TCP connection, without pipelining.
+func BenchmarkServer_commands(b *testing.B) {
+	s, addr := benchmarkServer(b)
+	defer s.Close()
+
+	c, err := Dial(addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("localhost"); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.Noop(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "cmds/s")
+}
+
+func sendBenchmarkMessage(c *Client, body []byte) error {
+	if err := c.Mail("alice@example.org"); err != nil {
+		return err
+	}
+	if err := c.Rcpt("bob@example.org"); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// BenchmarkServer_messages measures the number of messages per second over a
+// TCP connection, for various message sizes.
+func BenchmarkServer_messages(b *testing.B) {
+	for _, size := range []int{1 << 10, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%vKiB", size>>10), func(b *testing.B) {
+			s, addr := benchmarkServer(b)
+			defer s.Close()
+
+			c, err := Dial(addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+
+			body := bytes.Repeat([]byte(strings.Repeat("x", 78)+"\r\n"), size/80)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := sendBenchmarkMessage(c, body); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
+
+// BenchmarkServer_concurrent measures the number of messages per second with
+// concurrent connections, each sending 1KiB messages.
+func BenchmarkServer_concurrent(b *testing.B) {
+	for _, conns := range []int{10, 100} {
+		b.Run(fmt.Sprintf("%vconns", conns), func(b *testing.B) {
+			s, addr := benchmarkServer(b)
+			defer s.Close()
+
+			body := bytes.Repeat([]byte(strings.Repeat("x", 78)+"\r\n"), 1<<10/80)
+			clients := make(chan *Client, conns)
+			for i := 0; i < conns; i++ {
+				c, err := Dial(addr)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer c.Close()
+				clients <- c
+			}
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			b.SetParallelism((conns + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				c := <-clients
+				defer func() { clients <- c }()
+				for pb.Next() {
+					if err := sendBenchmarkMessage(c, body); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
@@ -5,16 +5,25 @@
 package smtp
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/mail"
 	"net/textproto"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp/parse"
 )
 
 // A Client represents a client connection to an SMTP server.
@@ -22,6 +31,35 @@ type Client struct {
 	// Text is the textproto.Conn used by the Client. It is exported to allow for
 	// clients to add extensions.
 	Text *textproto.Conn
+
+	// TLSConfig is used for STARTTLS when no configuration is passed to
+	// StartTLS, and when the client upgrades the connection on its own
+	// according to StartTLSPolicy. If nil, the default configuration is used,
+	// which verifies the server certificate against the system roots. Servers
+	// requiring mutual TLS are presented the certificate set in Certificates
+	// or returned by GetClientCertificate.
+	TLSConfig *tls.Config
+	// StartTLSPolicy controls whether the client automatically issues
+	// STARTTLS after the first EHLO.
+	StartTLSPolicy StartTLSPolicy
+	// Timeouts bounds the time spent waiting for the server.
+	Timeouts Timeouts
+	// DataProgress, if set, is called while message data is written after a
+	// call to Data, at most once per DataProgressInterval, and a last time
+	// when the transfer completes.
+	DataProgress         func(stats TransferStats)
+	DataProgressInterval time.Duration
+	// DebugWriter, if set, receives a copy of the protocol exchange.
+	// Credentials sent during AUTH are redacted.
+	DebugWriter io.Writer
+	// TLSSessionCache is used for TLS session resumption if the TLS
+	// configuration doesn't specify a cache. Sessions are keyed by server
+	// name, so sharing a cache between clients speeds up reconnections to
+	// the same destination.
+	TLSSessionCache tls.ClientSessionCache
+	// Hooks intercepts the commands sent to the server.
+	Hooks ClientHooks
+
 	// keep a reference to the connection so it can be used to create a TLS
 	// connection later
 	conn net.Conn
@@ -33,10 +71,210 @@ type Client struct {
 	ext map[string]string
 	// supported auth mechanisms
 	auth        []string
-	localName   string // the name to use in HELO/EHLO/LHLO
-	didHello    bool   // whether we've said HELO/EHLO/LHLO
-	helloError  error  // the error from the hello
-	rcptToCount int    // number of recipients
+	localName   string    // the name to use in HELO/EHLO/LHLO
+	didHello    bool      // whether we've said HELO/EHLO/LHLO
+	helloError  error     // the error from the hello
+	rcptToCount int       // number of recipients
+	utf8        bool      // whether the transaction uses SMTPUTF8
+	start       time.Time // when the connection was established
+	redact      bool      // whether outgoing lines are redacted in debug logs
+	dataStats   TransferStats
+}
+
+// ClientHooks intercepts the commands of a Client, for instance to collect
+// metrics, log the protocol exchange or inject faults in tests. It is the
+// client counterpart of Server.StageHook.
+type ClientHooks struct {
+	// BeforeCommand, if set, is called before a command is sent, with the
+	// command line without the trailing CRLF. Credentials sent during AUTH
+	// are redacted. If it returns an error, the command isn't sent and the
+	// error is returned instead.
+	BeforeCommand func(cmd string) error
+	// AfterResponse, if set, is called once the reply to a command has been
+	// read, or when sending the command or reading the reply failed. The
+	// error it returns replaces the error of the command, it must return
+	// res.Err to leave it unchanged.
+	AfterResponse func(res *CommandResult) error
+}
+
+// CommandResult describes the outcome of a command, see
+// ClientHooks.AfterResponse.
+type CommandResult struct {
+	// Command is the command line, as passed to BeforeCommand. It is empty
+	// for the server greeting, and "." for the replies to message data.
+	Command string
+	// The reply of the server, zero values if it wasn't received.
+	Code    int
+	Message string
+	// Err is the error of the command, nil if it succeeded.
+	Err error
+	// Elapsed is the time spent sending the command and waiting for the
+	// reply.
+	Elapsed time.Duration
+}
+
+// StartTLSPolicy controls whether a Client upgrades plaintext connections to
+// TLS with STARTTLS.
+type StartTLSPolicy int
+
+const (
+	// StartTLSDisabled doesn't issue STARTTLS automatically. Callers can
+	// still call StartTLS explicitly. This is the default.
+	StartTLSDisabled StartTLSPolicy = iota
+	// StartTLSOpportunistic issues STARTTLS if the server advertises it, and
+	// continues in plaintext otherwise.
+	StartTLSOpportunistic
+	// StartTLSRequired issues STARTTLS and fails with ErrStartTLSUnsupported
+	// if the server doesn't advertise it.
+	StartTLSRequired
+)
+
+// HelloError is returned when the server rejects the HELO, EHLO or LHLO
+// greeting. Many servers reject generic or unresolvable names, LocalName is
+// the name the client introduced itself with.
+type HelloError struct {
+	LocalName string
+	Err       error
+}
+
+func (err *HelloError) Error() string {
+	return fmt.Sprintf("smtp: greeting as %q rejected: %v", err.LocalName, err.Err)
+}
+
+// Unwrap returns the error replied by the server.
+func (err *HelloError) Unwrap() error {
+	return err.Err
+}
+
+// ErrStartTLSUnsupported is returned when STARTTLS is required but not
+// advertised by the server.
+var ErrStartTLSUnsupported = errors.New("smtp: server doesn't support STARTTLS")
+
+// Timeouts contains client timeouts, named after RFC 5321 section 4.5.3.2. A
+// zero duration disables the corresponding timeout.
+type Timeouts struct {
+	// Greeting is the maximum time to wait for the server greeting.
+	Greeting time.Duration
+	// Hello applies to EHLO, HELO and LHLO.
+	Hello time.Duration
+	// Command applies to MAIL, RCPT and all other commands not covered by a
+	// more specific timeout.
+	Command time.Duration
+	// DataInit applies to the DATA command, until the 354 reply is received.
+	DataInit time.Duration
+	// DataBlock is the maximum time a single write of message data can take.
+	// It protects against servers that stop reading mid-transfer.
+	DataBlock time.Duration
+	// DataTermination is the maximum time to wait for the final reply once
+	// the message has been sent.
+	DataTermination time.Duration
+	// Total bounds the whole connection lifetime. It takes precedence over
+	// the other timeouts.
+	Total time.Duration
+}
+
+// RecommendedTimeouts contains the minimum timeouts recommended by RFC 5321.
+var RecommendedTimeouts = Timeouts{
+	Greeting:        5 * time.Minute,
+	Hello:           5 * time.Minute,
+	Command:         5 * time.Minute,
+	DataInit:        2 * time.Minute,
+	DataBlock:       3 * time.Minute,
+	DataTermination: 10 * time.Minute,
+}
+
+// A Dialer contains options for connecting to an SMTP server.
+type Dialer struct {
+	// NetDialer is used to establish connections.
+	NetDialer net.Dialer
+	// Timeouts is set on the returned clients.
+	Timeouts Timeouts
+	// DebugWriter is set on the returned clients. Setting it here allows the
+	// server greeting to be logged as well.
+	DebugWriter io.Writer
+	// TLSSessionCache is set on the returned clients, and used for implicit
+	// TLS connections.
+	TLSSessionCache tls.ClientSessionCache
+	// AttemptDelay enables Happy Eyeballs (RFC 8305) for host names
+	// resolving to multiple addresses: IPv6 and IPv4 addresses are tried
+	// alternately, and a new connection attempt is started every
+	// AttemptDelay (or as soon as the previous one fails) until one succeeds.
+	// RFC 8305 recommends 250ms. If zero, NetDialer is used as-is.
+	AttemptDelay time.Duration
+	// LocalName is the name the returned clients introduce themselves with
+	// in HELO, EHLO and LHLO commands. It must be a domain name or an address
+	// literal such as "[192.0.2.1]". If empty, DefaultLocalName is used.
+	LocalName string
+	// Hooks is set on the returned clients. Setting it here allows the server
+	// greeting to be intercepted as well.
+	Hooks ClientHooks
+}
+
+var (
+	defaultLocalNameOnce sync.Once
+	defaultLocalName     string
+)
+
+// DefaultLocalName returns the host name of the machine, if it is a valid
+// domain name, or "localhost" otherwise. Receiving servers often reject
+// names which aren't fully qualified or don't resolve, so setting an explicit
+// name is recommended.
+func DefaultLocalName() string {
+	defaultLocalNameOnce.Do(func() {
+		defaultLocalName = "localhost"
+		if name, err := os.Hostname(); err == nil && parse.Domain(name) == nil {
+			defaultLocalName = name
+		}
+	})
+	return defaultLocalName
+}
+
+// validateLocalName checks a name used in HELO, EHLO and LHLO commands.
+func validateLocalName(name string) error {
+	if err := validateLine(name); err != nil {
+		return err
+	}
+	if err := parse.Host(name); err != nil {
+		return fmt.Errorf("smtp: invalid local name %q: %v", name, err)
+	}
+	return nil
+}
+
+// Dial returns a new Client connected to an SMTP server at addr.
+func (d *Dialer) Dial(addr string) (*Client, error) {
+	conn, err := d.dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	return newClient(conn, host, d)
+}
+
+// DialTLS returns a new Client connected to an SMTP server via TLS at addr.
+func (d *Dialer) DialTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	tlsConfig = withSessionCache(tlsConfig, d.TLSSessionCache)
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	conn, err := d.dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.NetDialer.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.NetDialer.Timeout))
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return newClient(tlsConn, host, d)
 }
 
 // Dial returns a new Client connected to an SMTP server at addr.
@@ -61,17 +299,95 @@ func DialTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
 	return NewClient(conn, host)
 }
 
-// NewClient returns a new Client using an existing connection and host as a
-// server name to be used when authenticating.
-func NewClient(conn net.Conn, host string) (*Client, error) {
-	text := textproto.NewConn(conn)
-	_, _, err := text.ReadResponse(220)
+// DialStartTLS returns a new Client connected to an SMTP server at addr. The
+// connection is upgraded to TLS with STARTTLS before any other command is
+// sent, and an error is returned if the server doesn't support it.
+// The addr must include a port, as in "mail.example.com:submission".
+//
+// A nil tlsConfig is equivalent to a zero tls.Config.
+func DialStartTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
+	c, err := Dial(addr)
 	if err != nil {
-		text.Close()
 		return nil, err
 	}
+	c.TLSConfig = tlsConfig
+	c.StartTLSPolicy = StartTLSRequired
+	if err := c.hello(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialLMTP returns a new LMTP Client (as defined in RFC 2033) connected to the
+// server at addr. The network must be "unix" or "tcp". For unix sockets, addr
+// is the socket path, as in "/var/run/dovecot/lmtp".
+func DialLMTP(network, addr string) (*Client, error) {
+	return (&Dialer{}).DialLMTP(network, addr)
+}
+
+// DialLMTP returns a new LMTP Client connected to the server at addr. See the
+// DialLMTP function.
+func (d *Dialer) DialLMTP(network, addr string) (*Client, error) {
+	conn, err := d.dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	host := "localhost"
+	if network != "unix" {
+		host, _, _ = net.SplitHostPort(addr)
+	}
+	c, err := newClient(conn, host, d)
+	if err != nil {
+		return nil, err
+	}
+	c.lmtp = true
+	return c, nil
+}
+
+// NewClient returns a new Client using an existing connection and host as a
+// server name to be used when authenticating. The client introduces itself
+// with DefaultLocalName, unless Hello is called.
+func NewClient(conn net.Conn, host string) (*Client, error) {
+	return newClient(conn, host, nil)
+}
+
+// newClient creates a client and reads the server greeting. The options of d
+// are applied, if not nil.
+func newClient(conn net.Conn, host string, d *Dialer) (*Client, error) {
+	localName := DefaultLocalName()
+	if d != nil && d.LocalName != "" {
+		localName = d.LocalName
+		if err := validateLocalName(localName); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
 	_, isTLS := conn.(*tls.Conn)
-	c := &Client{Text: text, conn: conn, serverName: host, localName: "localhost", tls: isTLS}
+	c := &Client{
+		conn:       conn,
+		serverName: host,
+		localName:  localName,
+		tls:        isTLS,
+		start:      time.Now(),
+	}
+	if d != nil {
+		c.Timeouts = d.Timeouts
+		c.DebugWriter = d.DebugWriter
+		c.TLSSessionCache = d.TLSSessionCache
+		c.Hooks = d.Hooks
+	}
+	c.Text = textproto.NewConn(debugConn{c})
+	if err := c.setTimeout(c.Timeouts.Greeting); err != nil {
+		c.Text.Close()
+		return nil, err
+	}
+	code, msg, err := c.Text.ReadResponse(220)
+	if err := c.afterResponse("", c.start, code, msg, toSMTPErr(err)); err != nil {
+		c.Text.Close()
+		return nil, err
+	}
 	return c, nil
 }
 
@@ -96,20 +412,87 @@ func (c *Client) hello() error {
 	if !c.didHello {
 		c.didHello = true
 		err := c.ehlo()
-		if err != nil {
-			c.helloError = c.helo()
+		if err != nil && !c.lmtp {
+			err = c.helo()
+		}
+		if _, ok := err.(*SMTPError); ok {
+			err = &HelloError{LocalName: c.localName, Err: err}
+		}
+		c.helloError = err
+		if c.helloError == nil {
+			c.helloError = c.autoStartTLS()
 		}
 	}
 	return c.helloError
 }
 
-// Hello sends a HELO or EHLO to the server as the given host name.
-// Calling this method is only necessary if the client needs control
-// over the host name used. The client will introduce itself as "localhost"
-// automatically otherwise. If Hello is called, it must be called before
-// any of the other methods.
+// autoStartTLS issues STARTTLS according to StartTLSPolicy.
+func (c *Client) autoStartTLS() error {
+	if c.tls || c.StartTLSPolicy == StartTLSDisabled {
+		return nil
+	}
+	if _, ok := c.ext["STARTTLS"]; !ok {
+		if c.StartTLSPolicy == StartTLSRequired {
+			return ErrStartTLSUnsupported
+		}
+		return nil
+	}
+	return c.startTLS(c.TLSConfig)
+}
+
+// debugConn copies the traffic of a client connection to its DebugWriter.
+type debugConn struct {
+	c *Client
+}
+
+func (dc debugConn) Read(b []byte) (int, error) {
+	n, err := dc.c.conn.Read(b)
+	if w := dc.c.DebugWriter; w != nil && n > 0 {
+		w.Write(b[:n])
+	}
+	return n, err
+}
+
+func (dc debugConn) Write(b []byte) (int, error) {
+	if w := dc.c.DebugWriter; w != nil {
+		if dc.c.redact {
+			w.Write(redactAuthLine(b))
+		} else {
+			w.Write(b)
+		}
+	}
+	return dc.c.conn.Write(b)
+}
+
+func (dc debugConn) Close() error {
+	return dc.c.conn.Close()
+}
+
+// redactAuthLine hides credentials from a line sent during an AUTH exchange.
+// The mechanism name of the AUTH command is kept.
+func redactAuthLine(b []byte) []byte {
+	line := strings.TrimRight(string(b), "\r\n")
+	if fields := strings.Fields(line); len(fields) >= 2 && strings.EqualFold(fields[0], "AUTH") {
+		line = fields[0] + " " + fields[1]
+		if len(fields) > 2 {
+			line += " <redacted>"
+		}
+	} else if line != "*" {
+		line = "<redacted>"
+	}
+	return []byte(line + "\r\n")
+}
+
+// Hello sends a HELO or EHLO to the server as the given host name, which must
+// be a domain name or an address literal. Calling this method is only
+// necessary if the client needs control over the host name used. The client
+// will introduce itself with Dialer.LocalName, or DefaultLocalName if it's
+// empty, automatically otherwise. If Hello is called, it must be called
+// before any of the other methods.
+//
+// If the server rejects the greeting, a *HelloError is returned.
 func (c *Client) Hello(localName string) error {
-	if err := validateLine(localName); err != nil {
+	if err := validateLocalName(localName); err != nil {
 		return err
 	}
 	if c.didHello {
@@ -119,23 +502,81 @@ func (c *Client) Hello(localName string) error {
 	return c.hello()
 }
 
+// setTimeout sets the connection deadline for the next operation. Timeouts.Total
+// is taken into account.
+func (c *Client) setTimeout(timeout time.Duration) error {
+	if c.conn == nil {
+		return nil
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if c.Timeouts.Total > 0 && !c.start.IsZero() {
+		total := c.start.Add(c.Timeouts.Total)
+		if deadline.IsZero() || total.Before(deadline) {
+			deadline = total
+		}
+	}
+	return c.conn.SetDeadline(deadline)
+}
+
 // cmd is a convenience function that sends a command and returns the response
 func (c *Client) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
-	id, err := c.Text.Cmd(format, args...)
-	if err != nil {
+	return c.cmdTimeout(c.Timeouts.Command, expectCode, format, args...)
+}
+
+// cmdTimeout is like cmd, but uses the provided timeout instead of
+// Timeouts.Command.
+func (c *Client) cmdTimeout(timeout time.Duration, expectCode int, format string, args ...interface{}) (int, string, error) {
+	if err := c.setTimeout(timeout); err != nil {
 		return 0, "", err
 	}
+	line := fmt.Sprintf(format, args...)
+	if c.Hooks.BeforeCommand != nil {
+		if err := c.Hooks.BeforeCommand(c.hookLine(line)); err != nil {
+			return 0, "", err
+		}
+	}
+	start := time.Now()
+	id, err := c.Text.Cmd("%s", line)
+	if err != nil {
+		return 0, "", c.afterResponse(line, start, 0, "", err)
+	}
 	c.Text.StartResponse(id)
 	defer c.Text.EndResponse(id)
 	code, msg, err := c.Text.ReadResponse(expectCode)
-	return code, msg, err
+	return code, msg, c.afterResponse(line, start, code, msg, toSMTPErr(err))
+}
+
+// hookLine returns a command line as passed to hooks.
+func (c *Client) hookLine(line string) string {
+	if c.redact {
+		line = strings.TrimSuffix(string(redactAuthLine([]byte(line))), "\r\n")
+	}
+	return line
+}
+
+// afterResponse calls the AfterResponse hook, and returns the error of the
+// command.
+func (c *Client) afterResponse(line string, start time.Time, code int, msg string, err error) error {
+	if c.Hooks.AfterResponse == nil {
+		return err
+	}
+	return c.Hooks.AfterResponse(&CommandResult{
+		Command: c.hookLine(line),
+		Code:    code,
+		Message: msg,
+		Err:     err,
+		Elapsed: time.Since(start),
+	})
 }
 
 // helo sends the HELO greeting to the server. It should be used only when the
 // server does not support ehlo.
 func (c *Client) helo() error {
 	c.ext = nil
-	_, _, err := c.cmd(250, "HELO %s", c.localName)
+	_, _, err := c.cmdTimeout(c.Timeouts.Hello, 250, "HELO %s", c.localName)
 	return err
 }
 
@@ -146,7 +587,7 @@ func (c *Client) ehlo() error {
 	if c.lmtp {
 		cmd = "LHLO"
 	}
-	_, msg, err := c.cmd(250, "%s %s", cmd, c.localName)
+	_, msg, err := c.cmdTimeout(c.Timeouts.Hello, 250, "%s %s", cmd, c.localName)
 	if err != nil {
 		return err
 	}
@@ -156,15 +597,17 @@ func (c *Client) ehlo() error {
 		extList = extList[1:]
 		for _, line := range extList {
 			args := strings.SplitN(line, " ", 2)
+			keyword := strings.ToUpper(args[0])
 			if len(args) > 1 {
-				ext[args[0]] = args[1]
+				ext[keyword] = args[1]
 			} else {
-				ext[args[0]] = ""
+				ext[keyword] = ""
 			}
 		}
 	}
+	c.auth = nil
 	if mechs, ok := ext["AUTH"]; ok {
-		c.auth = strings.Split(mechs, " ")
+		c.auth = strings.Fields(mechs)
 	}
 	c.ext = ext
 	return err
@@ -172,10 +615,19 @@ func (c *Client) ehlo() error {
 
 // StartTLS sends the STARTTLS command and encrypts all further communication.
 // Only servers that advertise the STARTTLS extension support this function.
+//
+// If config is nil, c.TLSConfig is used.
 func (c *Client) StartTLS(config *tls.Config) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
+	if config == nil {
+		config = c.TLSConfig
+	}
+	return c.startTLS(config)
+}
+
+func (c *Client) startTLS(config *tls.Config) error {
 	_, _, err := c.cmd(220, "STARTTLS")
 	if err != nil {
 		return err
@@ -188,11 +640,12 @@ func (c *Client) StartTLS(config *tls.Config) error {
 		config = config.Clone()
 		config.ServerName = c.serverName
 	}
+	config = withSessionCache(config, c.TLSSessionCache)
 	if testHookStartTLS != nil {
 		testHookStartTLS(config)
 	}
 	c.conn = tls.Client(c.conn, config)
-	c.Text = textproto.NewConn(c.conn)
+	c.Text = textproto.NewConn(debugConn{c})
 	c.tls = true
 	return c.ehlo()
 }
@@ -208,6 +661,70 @@ func (c *Client) TLSConnectionState() (state tls.ConnectionState, ok bool) {
 	return tc.ConnectionState(), true
 }
 
+// withSessionCache returns a TLS configuration using cache, unless config
+// already specifies a session cache. The argument is never modified.
+func withSessionCache(config *tls.Config, cache tls.ClientSessionCache) *tls.Config {
+	if cache == nil || (config != nil && config.ClientSessionCache != nil) {
+		return config
+	}
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	config.ClientSessionCache = cache
+	return config
+}
+
+// TLSInfo contains the parameters of a TLS connection, suitable for logging.
+type TLSInfo struct {
+	Version     string
+	CipherSuite string
+	ServerName  string
+	// Resumed is true if the session was resumed from a previous connection.
+	Resumed bool
+	// PeerFingerprint is the SHA-256 fingerprint of the server certificate.
+	PeerFingerprint [sha256.Size]byte
+	// VerifiedChains contains the verified certificate chains. It is empty
+	// if certificate verification was skipped.
+	VerifiedChains [][]*x509.Certificate
+}
+
+// TLSInfo returns the parameters of the TLS connection. ok is false if the
+// connection doesn't use TLS.
+func (c *Client) TLSInfo() (info *TLSInfo, ok bool) {
+	cs, ok := c.TLSConnectionState()
+	if !ok {
+		return nil, false
+	}
+	info = &TLSInfo{
+		Version:        tlsVersionName(cs.Version),
+		CipherSuite:    tls.CipherSuiteName(cs.CipherSuite),
+		ServerName:     cs.ServerName,
+		Resumed:        cs.DidResume,
+		VerifiedChains: cs.VerifiedChains,
+	}
+	if len(cs.PeerCertificates) > 0 {
+		info.PeerFingerprint = sha256.Sum256(cs.PeerCertificates[0].Raw)
+	}
+	return info, true
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04X", version)
+	}
+}
+
 // Verify checks the validity of an email address on the server.
 // If Verify returns nil, the address is valid. A non-nil return
 // does not necessarily indicate an invalid address. Many servers
@@ -223,22 +740,125 @@ func (c *Client) Verify(addr string) error {
 	return err
 }
 
+// VerifyAddress issues a VRFY command and returns the mailbox reported by the
+// server. A nil mailbox with a nil error means that the server cannot verify
+// the address but will attempt delivery (252 reply).
+func (c *Client) VerifyAddress(addr string) (*mail.Address, error) {
+	if err := validateLine(addr); err != nil {
+		return nil, err
+	}
+	if err := c.hello(); err != nil {
+		return nil, err
+	}
+	code, msg, err := c.cmd(25, "VRFY %s", addr)
+	if err != nil {
+		return nil, err
+	}
+	if code == 252 {
+		return nil, nil
+	}
+	return parseMailboxLine(msg), nil
+}
+
+// Expand issues an EXPN command and returns the members of the mailing list.
+func (c *Client) Expand(list string) ([]*mail.Address, error) {
+	if err := validateLine(list); err != nil {
+		return nil, err
+	}
+	if err := c.hello(); err != nil {
+		return nil, err
+	}
+	_, msg, err := c.cmd(250, "EXPN %s", list)
+	if err != nil {
+		return nil, err
+	}
+	var l []*mail.Address
+	for _, line := range strings.Split(msg, "\n") {
+		l = append(l, parseMailboxLine(line))
+	}
+	return l, nil
+}
+
+// Help issues a HELP command, with an optional topic, and returns the help
+// text.
+func (c *Client) Help(topic string) (string, error) {
+	if err := validateLine(topic); err != nil {
+		return "", err
+	}
+	if err := c.hello(); err != nil {
+		return "", err
+	}
+	cmdStr := "HELP"
+	if topic != "" {
+		cmdStr += " " + topic
+	}
+	_, msg, err := c.cmd(21, "%s", cmdStr)
+	return msg, err
+}
+
+// parseMailboxLine parses a mailbox returned by VRFY or EXPN, such as
+// "Fred Smith <fred@example.org>" or "<fred@example.org>". The enhanced status
+// code is stripped, if any. If the line cannot be parsed, the whole text is
+// used as the address.
+func parseMailboxLine(line string) *mail.Address {
+	if parts := strings.SplitN(line, " ", 2); len(parts) == 2 {
+		if _, err := parseEnhancedCode(parts[0]); err == nil {
+			line = parts[1]
+		}
+	}
+	if addr, err := mail.ParseAddress(line); err == nil {
+		return addr
+	}
+	if i, j := strings.IndexByte(line, '<'), strings.LastIndexByte(line, '>'); i >= 0 && j > i {
+		return &mail.Address{
+			Name:    strings.TrimSpace(line[:i]),
+			Address: line[i+1 : j],
+		}
+	}
+	return &mail.Address{Address: strings.TrimSpace(line)}
+}
+
 // Auth authenticates a client using the provided authentication mechanism.
 // A failed authentication closes the connection.
 // Only servers that advertise the AUTH extension support this function.
+//
+// If a is an *OAuthClient and the server rejects the access token, a fresh
+// token is requested and authentication is attempted once more.
 func (c *Client) Auth(a sasl.Client) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
+	err := c.authenticateRetry(a)
+	if err != nil {
+		c.Quit()
+	}
+	return err
+}
+
+// authenticateRetry authenticates, retrying once with a fresh token if an
+// OAuth token is rejected.
+func (c *Client) authenticateRetry(a sasl.Client) error {
+	err := c.authenticate(a)
+	if oa, ok := a.(*OAuthClient); ok && err != nil && oa.rejected {
+		err = c.authenticate(a)
+	}
+	return err
+}
+
+func (c *Client) authenticate(a sasl.Client) error {
+	c.redact = true
+	defer func() {
+		c.redact = false
+	}()
+
 	encoding := base64.StdEncoding
 	mech, resp, err := a.Start()
 	if err != nil {
-		c.Quit()
 		return err
 	}
 	resp64 := make([]byte, encoding.EncodedLen(len(resp)))
 	encoding.Encode(resp64, resp)
-	code, msg64, err := c.cmd(0, strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, resp64)))
+	code, msg64, err := c.cmd(0, "%s", strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, resp64)))
 	for err == nil {
 		var msg []byte
 		switch code {
@@ -248,7 +868,7 @@ func (c *Client) Auth(a sasl.Client) error {
 			// the last message isn't base64 because it isn't a challenge
 			msg = []byte(msg64)
 		default:
-			err = &textproto.Error{Code: code, Msg: msg64}
+			err = toSMTPErr(&textproto.Error{Code: code, Msg: msg64})
 		}
 		if err == nil {
 			if code == 334 {
@@ -260,7 +880,6 @@ func (c *Client) Auth(a sasl.Client) error {
 		if err != nil {
 			// abort the AUTH
 			c.cmd(501, "*")
-			c.Quit()
 			break
 		}
 		if resp == nil {
@@ -268,7 +887,7 @@ func (c *Client) Auth(a sasl.Client) error {
 		}
 		resp64 = make([]byte, encoding.EncodedLen(len(resp)))
 		encoding.Encode(resp64, resp)
-		code, msg64, err = c.cmd(0, string(resp64))
+		code, msg64, err = c.cmd(0, "%s", resp64)
 	}
 	return err
 }
@@ -277,30 +896,168 @@ func (c *Client) Auth(a sasl.Client) error {
 // If the server supports the 8BITMIME extension, Mail adds the BODY=8BITMIME
 // parameter.
 // This initiates a mail transaction and is followed by one or more Rcpt calls.
+//
+// Internationalized addresses are sent with the SMTPUTF8 parameter if the
+// server supports it. Otherwise, their domain is converted to its ASCII form,
+// and a *SMTPUTF8RequiredError is returned if their local part isn't ASCII.
 func (c *Client) Mail(from string) error {
+	return c.MailWithOptions(from, nil)
+}
+
+// MailOptions contains parameters for the MAIL command.
+type MailOptions struct {
+	// Size is the declared message size in bytes, zero if unknown. If the
+	// server advertises a SIZE limit, messages exceeding it are rejected
+	// locally with a *MessageTooLargeError before anything is sent.
+	Size int64
+	// UTF8 indicates that the message header contains UTF-8, as allowed by
+	// RFC 6532. If the server doesn't support SMTPUTF8, a
+	// *SMTPUTF8RequiredError is returned and the caller can downgrade the
+	// message or bounce it.
+	UTF8 bool
+}
+
+// SMTPUTF8RequiredError is returned when a transaction requires the SMTPUTF8
+// extension defined in RFC 6531, but the server doesn't support it.
+type SMTPUTF8RequiredError struct {
+	// Addr is the address which couldn't be converted to ASCII, empty if the
+	// message header requires SMTPUTF8.
+	Addr string
+}
+
+func (err *SMTPUTF8RequiredError) Error() string {
+	if err.Addr == "" {
+		return "smtp: server doesn't support SMTPUTF8, required by the message header"
+	}
+	return fmt.Sprintf("smtp: server doesn't support SMTPUTF8, required by <%v>", err.Addr)
+}
+
+// SMTPError returns the error to reply to a client whose message couldn't be
+// relayed, with the status codes of RFC 6531 section 3.7.5.
+func (err *SMTPUTF8RequiredError) SMTPError() *SMTPError {
+	if err.Addr == "" {
+		return &SMTPError{
+			Code:         554,
+			EnhancedCode: EnhancedCode{5, 6, 9},
+			Message:      "UTF-8 header message cannot be transferred to one or more recipients",
+		}
+	}
+	return &SMTPError{
+		Code:         553,
+		EnhancedCode: EnhancedCode{5, 6, 7},
+		Message:      "Non-ASCII addresses not permitted for <" + err.Addr + ">",
+	}
+}
+
+// downgradeAddress converts an internationalized address to ASCII for
+// servers which don't support SMTPUTF8.
+func downgradeAddress(addr string) (string, error) {
+	if isASCII(addr) {
+		return addr, nil
+	}
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 || !isASCII(addr[:i]) {
+		return "", &SMTPUTF8RequiredError{Addr: addr}
+	}
+	domain, err := parse.DomainToASCII(addr[i+1:])
+	if err != nil {
+		return "", &SMTPUTF8RequiredError{Addr: addr}
+	}
+	return addr[:i+1] + domain, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// MailWithOptions is like Mail, but allows additional parameters to be
+// specified. opts can be nil.
+func (c *Client) MailWithOptions(from string, opts *MailOptions) error {
 	if err := validateLine(from); err != nil {
 		return err
 	}
 	if err := c.hello(); err != nil {
 		return err
 	}
+	if opts == nil {
+		opts = &MailOptions{}
+	}
 	cmdStr := "MAIL FROM:<%s>"
 	if c.ext != nil {
 		if _, ok := c.ext["8BITMIME"]; ok {
 			cmdStr += " BODY=8BITMIME"
 		}
+		if _, ok := c.ext["SIZE"]; ok && opts.Size > 0 {
+			if limit := c.maxMessageSize(); limit > 0 && opts.Size > limit {
+				return &MessageTooLargeError{Size: opts.Size, Limit: limit}
+			}
+			cmdStr += " SIZE=" + strconv.FormatInt(opts.Size, 10)
+		}
 	}
-	_, _, err := c.cmd(250, cmdStr, from)
-	return err
+	_, smtputf8 := c.ext["SMTPUTF8"]
+	utf8 := false
+	if opts.UTF8 || !isASCII(from) {
+		if smtputf8 {
+			cmdStr += " SMTPUTF8"
+			utf8 = true
+		} else if opts.UTF8 {
+			return &SMTPUTF8RequiredError{}
+		} else {
+			var err error
+			if from, err = downgradeAddress(from); err != nil {
+				return err
+			}
+		}
+	}
+	if _, _, err := c.cmd(250, cmdStr, from); err != nil {
+		return err
+	}
+	c.utf8 = utf8
+	return nil
+}
+
+// MessageTooLargeError is returned when a message exceeds the maximum size
+// advertised by the server.
+type MessageTooLargeError struct {
+	// Size is the declared size, or the number of bytes written so far if the
+	// limit was exceeded while streaming the message.
+	Size  int64
+	Limit int64
+}
+
+func (err *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("smtp: message size (%v bytes) exceeds the server limit (%v bytes)", err.Size, err.Limit)
+}
+
+// maxMessageSize returns the SIZE limit advertised by the server, or zero.
+func (c *Client) maxMessageSize() int64 {
+	size, err := strconv.ParseInt(c.ext["SIZE"], 10, 64)
+	if err != nil || size < 0 {
+		return 0
+	}
+	return size
 }
 
 // Rcpt issues a RCPT command to the server using the provided email address.
 // A call to Rcpt must be preceded by a call to Mail and may be followed by
 // a Data call or another Rcpt call.
+//
+// Internationalized addresses are handled as described in Mail.
 func (c *Client) Rcpt(to string) error {
 	if err := validateLine(to); err != nil {
 		return err
 	}
+	if !c.utf8 {
+		var err error
+		if to, err = downgradeAddress(to); err != nil {
+			return err
+		}
+	}
 	if _, _, err := c.cmd(25, "RCPT TO:<%s>", to); err != nil {
 		return err
 	}
@@ -308,37 +1065,184 @@ func (c *Client) Rcpt(to string) error {
 	return nil
 }
 
+// RcptError describes a recipient rejected by the server.
+type RcptError struct {
+	Rcpt string
+	// Err is the error returned by the server.
+	Err error
+}
+
+func (err *RcptError) Error() string {
+	return fmt.Sprintf("smtp: recipient <%v> rejected: %v", err.Rcpt, err.Err)
+}
+
+func (err *RcptError) Unwrap() error {
+	return err.Err
+}
+
+// RcptErrors is returned by RcptAll when some recipients are rejected.
+type RcptErrors struct {
+	// Errors lists the rejected recipients, in order.
+	Errors []*RcptError
+	// Accepted lists the recipients accepted by the server.
+	Accepted []string
+}
+
+func (err *RcptErrors) Error() string {
+	if len(err.Errors) == 1 {
+		return err.Errors[0].Error()
+	}
+	rcpts := make([]string, len(err.Errors))
+	for i, rcptErr := range err.Errors {
+		rcpts[i] = "<" + rcptErr.Rcpt + ">"
+	}
+	return fmt.Sprintf("smtp: %v recipients rejected: %v", len(err.Errors), strings.Join(rcpts, ", "))
+}
+
+// RcptAll issues a RCPT command for each recipient. Unlike calling Rcpt in a
+// loop, it doesn't stop at the first rejected recipient.
+//
+// If some recipients are rejected, or require SMTPUTF8 which the server
+// doesn't support, a *RcptErrors is returned. The transaction can still
+// proceed with the accepted subset by calling Data, or be aborted with Reset.
+// Errors unrelated to a single recipient, such as I/O errors, are returned
+// as-is.
+func (c *Client) RcptAll(to []string) error {
+	rcptErrs := &RcptErrors{}
+	for _, rcpt := range to {
+		err := c.Rcpt(rcpt)
+		if err == nil {
+			rcptErrs.Accepted = append(rcptErrs.Accepted, rcpt)
+			continue
+		}
+		switch err.(type) {
+		case *SMTPError, *SMTPUTF8RequiredError:
+		default:
+			return err
+		}
+		rcptErrs.Errors = append(rcptErrs.Errors, &RcptError{Rcpt: rcpt, Err: err})
+	}
+	if len(rcptErrs.Errors) > 0 {
+		return rcptErrs
+	}
+	return nil
+}
+
 type dataCloser struct {
 	c *Client
 	io.WriteCloser
+
+	n            int64     // bytes written
+	limit        int64     // maximum message size, zero if unlimited
+	err          error     // sticky error preventing the message from being sent
+	start        time.Time // when DATA was accepted
+	lastProgress time.Time // last DataProgress call
+}
+
+func (d *dataCloser) Write(b []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.limit > 0 && d.n+int64(len(b)) > d.limit {
+		d.err = &MessageTooLargeError{Size: d.n + int64(len(b)), Limit: d.limit}
+		return 0, d.err
+	}
+	if err := d.c.setTimeout(d.c.Timeouts.DataBlock); err != nil {
+		return 0, err
+	}
+	n, err := d.WriteCloser.Write(b)
+	d.n += int64(n)
+	d.progress(false)
+	return n, err
+}
+
+// progress updates the transfer statistics and calls DataProgress. Unless
+// final is set, calls are rate-limited by DataProgressInterval.
+func (d *dataCloser) progress(final bool) {
+	now := time.Now()
+	d.c.dataStats = TransferStats{Bytes: d.n, Elapsed: now.Sub(d.start)}
+	if d.c.DataProgress == nil || (!final && now.Sub(d.lastProgress) < d.c.DataProgressInterval) {
+		return
+	}
+	d.lastProgress = now
+	d.c.DataProgress(d.c.dataStats)
 }
 
 func (d *dataCloser) Close() error {
+	defer d.progress(true)
+	if d.err != nil {
+		// The only way to abort a DATA transfer is to drop the connection,
+		// terminating it would send a truncated message.
+		d.c.Text.Close()
+		return d.err
+	}
+	if err := d.c.setTimeout(d.c.Timeouts.DataBlock); err != nil {
+		return err
+	}
 	d.WriteCloser.Close()
+	if err := d.c.setTimeout(d.c.Timeouts.DataTermination); err != nil {
+		return err
+	}
+	start := time.Now()
 	if d.c.lmtp {
 		for d.c.rcptToCount > 0 {
-			if _, _, err := d.c.Text.ReadResponse(250); err != nil {
+			code, msg, err := d.c.Text.ReadResponse(250)
+			if err := d.c.afterResponse(".", start, code, msg, toSMTPErr(err)); err != nil {
 				return err
 			}
 			d.c.rcptToCount--
 		}
 		return nil
 	} else {
-		_, _, err := d.c.Text.ReadResponse(250)
-		return err
+		code, msg, err := d.c.Text.ReadResponse(250)
+		return d.c.afterResponse(".", start, code, msg, toSMTPErr(err))
+	}
+}
+
+// TransferStats contains statistics about a message data transfer.
+type TransferStats struct {
+	// Bytes is the number of bytes written, before dot-stuffing.
+	Bytes int64
+	// Elapsed is the time spent since the server accepted the DATA command.
+	// Once the transfer is complete, it includes the time spent waiting for
+	// the final reply.
+	Elapsed time.Duration
+}
+
+// Rate returns the average throughput in bytes per second.
+func (stats TransferStats) Rate() float64 {
+	if stats.Elapsed <= 0 {
+		return 0
 	}
+	return float64(stats.Bytes) / stats.Elapsed.Seconds()
+}
+
+// DataStats returns the statistics of the current or last message data
+// transfer.
+func (c *Client) DataStats() TransferStats {
+	return c.dataStats
 }
 
 // Data issues a DATA command to the server and returns a writer that
 // can be used to write the mail headers and body. The caller should
 // close the writer before calling any more methods on c. A call to
 // Data must be preceded by one or more calls to Rcpt.
+//
+// If the server advertises a SIZE limit and the message exceeds it, writes
+// fail with a *MessageTooLargeError and closing the writer closes the
+// connection, since a DATA transfer cannot be aborted otherwise.
 func (c *Client) Data() (io.WriteCloser, error) {
-	_, _, err := c.cmd(354, "DATA")
+	_, _, err := c.cmdTimeout(c.Timeouts.DataInit, 354, "DATA")
 	if err != nil {
 		return nil, err
 	}
-	return &dataCloser{c, c.Text.DotWriter()}, nil
+	c.dataStats = TransferStats{}
+	return &dataCloser{
+		c:           c,
+		WriteCloser: c.Text.DotWriter(),
+		limit:       c.maxMessageSize(),
+		start:       time.Now(),
+	}, nil
 }
 
 var testHookStartTLS func(*tls.Config) // nil, except for tests
@@ -349,7 +1253,8 @@ var testHookStartTLS func(*tls.Config) // nil, except for tests
 // message r.
 // The addr must include a port, as in "mail.example.com:smtp".
 //
-// The addresses in the to parameter are the SMTP RCPT addresses.
+// The addresses in the to parameter are the SMTP RCPT addresses. If some of
+// them are rejected, no message is sent and a *RcptErrors is returned.
 //
 // The r parameter should be an RFC 822-style email with headers
 // first, a blank line, and then the message body. The lines of r
@@ -358,62 +1263,197 @@ var testHookStartTLS func(*tls.Config) // nil, except for tests
 // messages is accomplished by including an email address in the to
 // parameter but not including it in the r headers.
 //
-// The SendMail function and the net/smtp package are low-level
-// mechanisms and provide no support for DKIM signing, MIME
-// attachments (see the mime/multipart package), or other mail
-// functionality. Higher-level packages exist outside of the standard
-// library.
+// The SendMail function is a low-level mechanism and provides no
+// support for MIME attachments (see the mime/multipart package), or
+// other mail functionality. Messages can be signed with DKIM by passing a
+// dkim.Reader as r.
+//
+// SendMail sends the message in plaintext if the server doesn't support
+// STARTTLS, SendMailContext should be preferred.
 func SendMail(addr string, a sasl.Client, from string, to []string, r io.Reader) error {
-	if err := validateLine(from); err != nil {
+	c, err := dialSendMail(addr, from, to)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return unwrapSendError(c.sendMail(a, from, to, r, readerSize(r), false))
+}
+
+// SendOptions contains options for SendMailContext.
+type SendOptions struct {
+	// Dialer is used to connect to the server. If nil, a zero Dialer is used.
+	Dialer *Dialer
+	// TLSConfig is used for STARTTLS. If nil, the default configuration is
+	// used, which verifies the server certificate against the system roots.
+	TLSConfig *tls.Config
+	// AllowPlaintext allows the message to be sent without TLS when the
+	// server doesn't support STARTTLS. By default, STARTTLS is required.
+	AllowPlaintext bool
+}
+
+// SendError is returned by SendMailContext when sending a message fails.
+type SendError struct {
+	// Stage is the step which failed: "dial", "hello", "starttls", "auth",
+	// "mail", "rcpt", "data" or "quit". When the transaction fails at the
+	// "quit" stage, the message has been accepted by the server.
+	Stage string
+	// Err is the underlying error, for instance a *SMTPError replied by the
+	// server, a *RcptErrors, a TLS verification error or the context error.
+	Err error
+}
+
+func (err *SendError) Error() string {
+	return fmt.Sprintf("smtp: %v failed: %v", err.Stage, err.Err)
+}
+
+// Unwrap returns the underlying error.
+func (err *SendError) Unwrap() error {
+	return err.Err
+}
+
+// unwrapSendError returns the underlying error of a *SendError, for callers
+// predating SendError.
+func unwrapSendError(err error) error {
+	if sendErr, ok := err.(*SendError); ok {
+		return sendErr.Err
+	}
+	return err
+}
+
+// SendMailContext is like SendMail, but with safer defaults: STARTTLS is
+// required and the server certificate is verified, unless configured
+// otherwise in opts. The context bounds the whole transaction, from the
+// connection to QUIT. opts can be nil.
+//
+// Errors are returned as a *SendError.
+func SendMailContext(ctx context.Context, addr string, a sasl.Client, from string, to []string, r io.Reader, opts *SendOptions) error {
+	if opts == nil {
+		opts = &SendOptions{}
+	}
+	if err := validateEnvelope(from, to); err != nil {
 		return err
 	}
+	size := readerSize(r)
+
+	d := opts.Dialer
+	if d == nil {
+		d = &Dialer{}
+	}
+	conn, err := d.dialContext(ctx, "tcp", addr)
+	if err != nil {
+		return &SendError{Stage: "dial", Err: err}
+	}
+	// Cancelling the context aborts the transaction
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := newClient(conn, host, d)
+	if err == nil {
+		defer c.Close()
+		c.TLSConfig = opts.TLSConfig
+		err = c.sendMail(a, from, to, r, size, !opts.AllowPlaintext)
+	} else {
+		err = &SendError{Stage: "dial", Err: err}
+	}
+	if sendErr, ok := err.(*SendError); ok && ctx.Err() != nil {
+		sendErr.Err = ctx.Err()
+	}
+	return err
+}
+
+// validateEnvelope checks the addresses passed to the SendMail functions.
+// Errors are returned as a *SendError.
+func validateEnvelope(from string, to []string) error {
+	if err := validateLine(from); err != nil {
+		return &SendError{Stage: "mail", Err: err}
+	}
 	for _, recp := range to {
 		if err := validateLine(recp); err != nil {
-			return err
+			return &SendError{Stage: "rcpt", Err: err}
 		}
 	}
-	c, err := Dial(addr)
-	if err != nil {
-		return err
+	return nil
+}
+
+func dialSendMail(addr, from string, to []string) (*Client, error) {
+	if err := validateEnvelope(from, to); err != nil {
+		return nil, unwrapSendError(err)
 	}
-	defer c.Close()
-	if err = c.hello(); err != nil {
-		return err
+	return Dial(addr)
+}
+
+// sendMail sends a message for the SendMail functions. Errors are returned
+// as a *SendError.
+func (c *Client) sendMail(a sasl.Client, from string, to []string, r io.Reader, size int64, requireTLS bool) error {
+	if err := c.hello(); err != nil {
+		return &SendError{Stage: "hello", Err: err}
 	}
 	if ok, _ := c.Extension("STARTTLS"); ok {
-		if err = c.StartTLS(nil); err != nil {
-			return err
+		if err := c.StartTLS(nil); err != nil {
+			return &SendError{Stage: "starttls", Err: err}
 		}
+	} else if requireTLS && !c.tls {
+		return &SendError{Stage: "starttls", Err: ErrStartTLSUnsupported}
 	}
 	if a != nil && c.ext != nil {
 		if _, ok := c.ext["AUTH"]; !ok {
-			return errors.New("smtp: server doesn't support AUTH")
+			return &SendError{Stage: "auth", Err: errors.New("smtp: server doesn't support AUTH")}
 		}
-		if err = c.Auth(a); err != nil {
-			return err
+		if err := c.Auth(a); err != nil {
+			return &SendError{Stage: "auth", Err: err}
 		}
 	}
-	if err = c.Mail(from); err != nil {
-		return err
+	if err := c.MailWithOptions(from, &MailOptions{Size: size}); err != nil {
+		return &SendError{Stage: "mail", Err: err}
 	}
-	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
-			return err
-		}
+	if err := c.RcptAll(to); err != nil {
+		return &SendError{Stage: "rcpt", Err: err}
 	}
 	w, err := c.Data()
 	if err != nil {
-		return err
+		return &SendError{Stage: "data", Err: err}
 	}
-	_, err = io.Copy(w, r)
-	if err != nil {
-		return err
+	if _, err := io.Copy(w, r); err != nil {
+		return &SendError{Stage: "data", Err: err}
 	}
-	err = w.Close()
-	if err != nil {
-		return err
+	if err := w.Close(); err != nil {
+		return &SendError{Stage: "data", Err: err}
+	}
+	if err := c.Quit(); err != nil {
+		return &SendError{Stage: "quit", Err: err}
 	}
-	return c.Quit()
+	return nil
+}
+
+// readerSize returns the number of bytes remaining in r if it can be
+// determined without consuming it, or zero.
+func readerSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case io.Seeker:
+		cur, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0
+		}
+		if _, err := r.Seek(cur, io.SeekStart); err != nil {
+			return 0
+		}
+		return end - cur
+	}
+	return 0
 }
 
 // Extension reports whether an extension is support by the server.
@@ -432,6 +1472,58 @@ func (c *Client) Extension(ext string) (bool, string) {
 	return ok, param
 }
 
+// Capabilities describes the extensions advertised by the server.
+type Capabilities struct {
+	// Extensions maps upper-case extension keywords to their parameters.
+	Extensions map[string]string
+	// Size is the maximum message size in bytes advertised with the SIZE
+	// extension. It is zero if the server doesn't advertise a limit.
+	Size int64
+	// AuthMechanisms lists the SASL mechanisms supported by the server.
+	AuthMechanisms []string
+}
+
+// Has reports whether an extension is advertised. The extension name is
+// case-insensitive.
+func (caps *Capabilities) Has(ext string) bool {
+	_, ok := caps.Extensions[strings.ToUpper(ext)]
+	return ok
+}
+
+// HasAuth reports whether a SASL mechanism is supported. The mechanism name is
+// case-insensitive.
+func (caps *Capabilities) HasAuth(mech string) bool {
+	for _, m := range caps.AuthMechanisms {
+		if strings.EqualFold(m, mech) {
+			return true
+		}
+	}
+	return false
+}
+
+// Capabilities returns the extensions advertised by the server in its last
+// EHLO response. If the server doesn't support EHLO, an empty set is returned.
+func (c *Client) Capabilities() (*Capabilities, error) {
+	if err := c.hello(); err != nil {
+		return nil, err
+	}
+	caps := &Capabilities{Extensions: make(map[string]string, len(c.ext))}
+	for k, v := range c.ext {
+		caps.Extensions[k] = v
+	}
+	if v, ok := c.ext["SIZE"]; ok && v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("smtp: invalid SIZE parameter: %q", v)
+		}
+		caps.Size = size
+	}
+	if _, ok := c.ext["AUTH"]; ok {
+		caps.AuthMechanisms = append([]string(nil), c.auth...)
+	}
+	return caps, nil
+}
+
 // Reset sends the RSET command to the server, aborting the current mail
 // transaction.
 func (c *Client) Reset() error {
@@ -445,6 +1537,29 @@ func (c *Client) Reset() error {
 	return nil
 }
 
+// Etrn sends the ETRN command to the server, asking it to start processing its
+// queue for the given domain, as defined in RFC 1985. The domain may be
+// prefixed with "@" to include subdomains, or with "#" to name a queue.
+//
+// A server replying that there are no messages queued for the domain is not
+// considered an error.
+func (c *Client) Etrn(domain string) error {
+	if err := validateLine(domain); err != nil {
+		return err
+	}
+	if domain == "" {
+		return errors.New("smtp: empty ETRN domain")
+	}
+	if err := c.hello(); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("ETRN"); !ok {
+		return errors.New("smtp: server doesn't support ETRN")
+	}
+	_, _, err := c.cmd(25, "ETRN %s", domain)
+	return err
+}
+
 // Noop sends the NOOP command to the server. It does nothing but check
 // that the connection to the server is okay.
 func (c *Client) Noop() error {
@@ -7,17 +7,27 @@ package smtp
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp/dkim"
 )
 
 // Issue 17794: don't send a trailing space on AUTH command when there's no password.
@@ -60,6 +70,15 @@ func (toServerEmptyAuth) Next(fromServer []byte) (toServer []byte, err error) {
 	panic("unexpected call")
 }
 
+func TestMain(m *testing.M) {
+	// Client transcripts expect "localhost", whatever the host name of the
+	// machine running the tests
+	defaultLocalNameOnce.Do(func() {
+		defaultLocalName = "localhost"
+	})
+	os.Exit(m.Run())
+}
+
 type faker struct {
 	io.ReadWriter
 }
@@ -232,6 +251,33 @@ func TestNewClient(t *testing.T) {
 	}
 }
 
+func TestNewClient_defaultLocalName(t *testing.T) {
+	defaultLocalName = "mta.example.org"
+	defer func() {
+		defaultLocalName = "localhost"
+	}()
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader("220 hello world\r\n250 mx.google.com at your service\r\n"),
+		&wrote,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := c.hello(); err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+	if got, want := wrote.String(), "EHLO mta.example.org\r\n"; got != want {
+		t.Errorf("wrote %q; want %q", got, want)
+	}
+}
+
 var newClientServer = `220 hello world
 250-mx.google.com at your service
 250-SIZE 35651584
@@ -244,6 +290,435 @@ var newClientClient = `EHLO localhost
 QUIT
 `
 
+func TestClientCapabilities(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250-mx.google.com at your service\r\n" +
+		"250-SIZE 35882577\r\n" +
+		"250-8bitmime\r\n" +
+		"250 AUTH LOGIN PLAIN XOAUTH2\r\n"
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		ioutil.Discard,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	caps, err := c.Capabilities()
+	if err != nil {
+		t.Fatalf("Capabilities: %v", err)
+	}
+	if caps.Size != 35882577 {
+		t.Errorf("Size = %v, want 35882577", caps.Size)
+	}
+	if !caps.Has("8BITMIME") || caps.Has("PIPELINING") {
+		t.Errorf("Extensions = %v", caps.Extensions)
+	}
+	if !caps.HasAuth("plain") || caps.HasAuth("CRAM-MD5") || len(caps.AuthMechanisms) != 3 {
+		t.Errorf("AuthMechanisms = %v", caps.AuthMechanisms)
+	}
+}
+
+func TestClientSizeLimit(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250-mx.google.com at your service\r\n" +
+		"250 SIZE 10\r\n" +
+		"250 Sender OK\r\n" +
+		"250 Receiver OK\r\n" +
+		"354 Go ahead\r\n"
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	err = c.MailWithOptions("user@example.com", &MailOptions{Size: 11})
+	if tooLarge, ok := err.(*MessageTooLargeError); !ok || tooLarge.Limit != 10 {
+		t.Fatalf("MailWithOptions: got %v, want a MessageTooLargeError", err)
+	}
+	if err := c.MailWithOptions("user@example.com", &MailOptions{Size: 5}); err != nil {
+		t.Fatalf("MailWithOptions: %v", err)
+	}
+	if err := c.Rcpt("other@example.com"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	if _, err := io.WriteString(w, "01234"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := io.WriteString(w, "56789A"); err == nil {
+		t.Fatal("Write: expected an error")
+	}
+	if _, ok := w.Close().(*MessageTooLargeError); !ok {
+		t.Fatal("Close: expected a MessageTooLargeError")
+	}
+
+	want := "EHLO localhost\r\n" +
+		"MAIL FROM:<user@example.com> SIZE=5\r\n" +
+		"RCPT TO:<other@example.com>\r\n" +
+		"DATA\r\n"
+	if got := wrote.String(); got != want {
+		t.Errorf("wrote %q; want %q", got, want)
+	}
+}
+
+func TestClientRcptAll(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250 mx.google.com at your service\r\n" +
+		"250 Sender OK\r\n" +
+		"250 Receiver OK\r\n" +
+		"550 5.1.1 No such user\r\n" +
+		"250 Receiver OK\r\n" +
+		"354 Go ahead\r\n"
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		ioutil.Discard,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	if err := c.Mail("user@example.com"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	err = c.RcptAll([]string{"a@example.com", "b@example.com", "c@example.com"})
+	rcptErrs, ok := err.(*RcptErrors)
+	if !ok {
+		t.Fatalf("RcptAll: got %v, want a *RcptErrors", err)
+	}
+	if len(rcptErrs.Errors) != 1 || rcptErrs.Errors[0].Rcpt != "b@example.com" {
+		t.Errorf("Errors = %v, want b@example.com", rcptErrs.Errors)
+	}
+	if len(rcptErrs.Accepted) != 2 || rcptErrs.Accepted[0] != "a@example.com" || rcptErrs.Accepted[1] != "c@example.com" {
+		t.Errorf("Accepted = %v, want a@example.com and c@example.com", rcptErrs.Accepted)
+	}
+	if _, err := c.Data(); err != nil {
+		t.Errorf("Data: %v", err)
+	}
+}
+
+func TestClientSMTPUTF8(t *testing.T) {
+	for _, supported := range []bool{true, false} {
+		server := "220 hello world\r\n" +
+			"250-mx.google.com at your service\r\n" +
+			"250 8BITMIME\r\n"
+		if supported {
+			server = "220 hello world\r\n" +
+				"250-mx.google.com at your service\r\n" +
+				"250 SMTPUTF8\r\n"
+		}
+		server += "250 Sender OK\r\n" +
+			"250 Receiver OK\r\n" +
+			"250 Receiver OK\r\n"
+		var wrote bytes.Buffer
+		var fake faker
+		fake.ReadWriter = struct {
+			io.Reader
+			io.Writer
+		}{
+			strings.NewReader(server),
+			&wrote,
+		}
+		c, err := NewClient(fake, "fake.host")
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+
+		if !supported {
+			err := c.MailWithOptions("user@example.com", &MailOptions{UTF8: true})
+			if _, ok := err.(*SMTPUTF8RequiredError); !ok {
+				t.Fatalf("MailWithOptions: got %v, want a *SMTPUTF8RequiredError", err)
+			}
+		}
+		if err := c.Mail("user@bücher.example"); err != nil {
+			t.Fatalf("Mail: %v", err)
+		}
+		err = c.RcptAll([]string{"δοκιμή@παράδειγμα.example", "rcpt@παράδειγμα.example"})
+		if supported {
+			if err != nil {
+				t.Fatalf("RcptAll: %v", err)
+			}
+		} else {
+			rcptErrs, ok := err.(*RcptErrors)
+			if !ok || len(rcptErrs.Errors) != 1 || len(rcptErrs.Accepted) != 1 {
+				t.Fatalf("RcptAll: got %v, want a rejected recipient", err)
+			}
+			if utf8Err, ok := rcptErrs.Errors[0].Err.(*SMTPUTF8RequiredError); !ok || utf8Err.Addr != "δοκιμή@παράδειγμα.example" {
+				t.Errorf("RcptAll: got %v, want a *SMTPUTF8RequiredError", rcptErrs.Errors[0].Err)
+			}
+		}
+
+		want := "EHLO localhost\r\n" +
+			"MAIL FROM:<user@bücher.example> SMTPUTF8\r\n" +
+			"RCPT TO:<δοκιμή@παράδειγμα.example>\r\n" +
+			"RCPT TO:<rcpt@παράδειγμα.example>\r\n"
+		if !supported {
+			want = "EHLO localhost\r\n" +
+				"MAIL FROM:<user@xn--bcher-kva.example> BODY=8BITMIME\r\n" +
+				"RCPT TO:<rcpt@xn--hxajbheg2az3al.example>\r\n"
+		}
+		if got := wrote.String(); got != want {
+			t.Errorf("wrote %q; want %q", got, want)
+		}
+	}
+}
+
+func TestClientSMTPError(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250 mx.google.com at your service\r\n" +
+		"250 Sender OK\r\n" +
+		"550-5.1.1 The email account that you tried to reach does not exist.\r\n" +
+		"550 5.1.1 Please try double-checking the recipient's email address.\r\n"
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		ioutil.Discard,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	if err := c.Mail("user@example.com"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	err = c.Rcpt("nobody@example.com")
+	smtpErr, ok := err.(*SMTPError)
+	if !ok {
+		t.Fatalf("Rcpt: got %v, want a *SMTPError", err)
+	}
+	if smtpErr.Code != 550 {
+		t.Errorf("Code = %v, want 550", smtpErr.Code)
+	}
+	if smtpErr.EnhancedCode != (EnhancedCode{5, 1, 1}) {
+		t.Errorf("EnhancedCode = %v, want 5.1.1", smtpErr.EnhancedCode)
+	}
+	wantMsg := "The email account that you tried to reach does not exist.\n" +
+		"Please try double-checking the recipient's email address."
+	if smtpErr.Message != wantMsg {
+		t.Errorf("Message = %q, want %q", smtpErr.Message, wantMsg)
+	}
+}
+
+func TestClientDataProgress(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250 mx.google.com at your service\r\n" +
+		"250 Sender OK\r\n" +
+		"250 Receiver OK\r\n" +
+		"354 Go ahead\r\n" +
+		"250 Queued\r\n"
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		ioutil.Discard,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	var progress []int64
+	c.DataProgress = func(stats TransferStats) {
+		progress = append(progress, stats.Bytes)
+	}
+
+	if err := c.Mail("user@example.com"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := c.Rcpt("other@example.com"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	io.WriteString(w, "Subject: test\r\n")
+	io.WriteString(w, "\r\nhowdy!\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if len(progress) != 3 || progress[0] != 15 || progress[1] != 25 || progress[2] != 25 {
+		t.Errorf("progress = %v, want [15 25 25]", progress)
+	}
+	if stats := c.DataStats(); stats.Bytes != 25 || stats.Elapsed <= 0 {
+		t.Errorf("DataStats() = %+v", stats)
+	}
+}
+
+func TestClientXClient(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250-mx.google.com at your service\r\n" +
+		"250 XCLIENT NAME ADDR HELO\r\n" +
+		"220 hello again\r\n" +
+		"250 mx.google.com at your service\r\n" +
+		"250 Sender OK\r\n"
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	if err := c.XClient(map[string]string{XClientLogin: "user"}); err == nil {
+		t.Error("XClient: expected an error for an unsupported attribute")
+	}
+	err = c.XClient(map[string]string{
+		XClientAddr: "192.0.2.1",
+		XClientName: XClientUnavailable,
+		XClientHelo: "spike+1 example",
+	})
+	if err != nil {
+		t.Fatalf("XClient: %v", err)
+	}
+	if err := c.Mail("user@example.com"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+
+	want := "EHLO localhost\r\n" +
+		"XCLIENT ADDR=192.0.2.1 HELO=spike+2B1+20example NAME=[UNAVAILABLE]\r\n" +
+		"EHLO localhost\r\n" +
+		"MAIL FROM:<user@example.com>\r\n"
+	if got := wrote.String(); got != want {
+		t.Errorf("wrote %q; want %q", got, want)
+	}
+}
+
+func TestClientVerifyExpandHelp(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250 mx.google.com at your service\r\n" +
+		"250 2.1.5 Fred Smith <fred@example.org>\r\n" +
+		"252 2.1.5 Cannot VRFY user\r\n" +
+		"250-Jon Postel <postel@example.org>\r\n" +
+		"250-<sam@example.org>\r\n" +
+		"250 jane@example.org\r\n" +
+		"214-Commands:\r\n" +
+		"214 HELO EHLO MAIL RCPT DATA\r\n"
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	addr, err := c.VerifyAddress("fred")
+	if err != nil {
+		t.Fatalf("VerifyAddress: %v", err)
+	}
+	if addr == nil || addr.Name != "Fred Smith" || addr.Address != "fred@example.org" {
+		t.Errorf("VerifyAddress = %v, want Fred Smith <fred@example.org>", addr)
+	}
+	if addr, err := c.VerifyAddress("sam"); addr != nil || err != nil {
+		t.Errorf("VerifyAddress = %v, %v, want nil, nil", addr, err)
+	}
+
+	list, err := c.Expand("staff")
+	if err != nil {
+		t.Fatalf("Expand: %v", err)
+	}
+	want := []string{"postel@example.org", "sam@example.org", "jane@example.org"}
+	if len(list) != len(want) {
+		t.Fatalf("Expand = %v, want %v", list, want)
+	}
+	for i := range want {
+		if list[i].Address != want[i] {
+			t.Errorf("Expand[%v] = %v, want %v", i, list[i].Address, want[i])
+		}
+	}
+
+	help, err := c.Help("")
+	if err != nil {
+		t.Fatalf("Help: %v", err)
+	}
+	if help != "Commands:\nHELO EHLO MAIL RCPT DATA" {
+		t.Errorf("Help = %q", help)
+	}
+
+	wantCmds := "EHLO localhost\r\nVRFY fred\r\nVRFY sam\r\nEXPN staff\r\nHELP\r\n"
+	if got := wrote.String(); got != wantCmds {
+		t.Errorf("wrote %q; want %q", got, wantCmds)
+	}
+}
+
+func TestClientEtrn(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250-mx.google.com at your service\r\n" +
+		"250 ETRN\r\n" +
+		"250 OK, queuing for node example.org started\r\n" +
+		"251 OK, no messages waiting for node example.net\r\n" +
+		"458 Unable to queue messages for node example.com\r\n"
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	if err := c.Etrn("example.org"); err != nil {
+		t.Errorf("Etrn(example.org): %v", err)
+	}
+	if err := c.Etrn("@example.net"); err != nil {
+		t.Errorf("Etrn(@example.net): %v", err)
+	}
+	if err := c.Etrn("example.com"); err == nil {
+		t.Errorf("Etrn(example.com): expected error")
+	} else if smtpErr, ok := err.(*SMTPError); !ok || smtpErr.Code != 458 {
+		t.Errorf("Etrn(example.com): unexpected error %v", err)
+	}
+
+	wantCmds := "EHLO localhost\r\nETRN example.org\r\nETRN @example.net\r\nETRN example.com\r\n"
+	if got := wrote.String(); got != wantCmds {
+		t.Errorf("wrote %q; want %q", got, wantCmds)
+	}
+}
+
 func TestNewClient2(t *testing.T) {
 	server := strings.Join(strings.Split(newClient2Server, "\n"), "\r\n")
 	client := strings.Join(strings.Split(newClient2Client, "\n"), "\r\n")
@@ -423,10 +898,10 @@ func TestSendMail(t *testing.T) {
 
 		tc := textproto.NewConn(conn)
 		for i := 0; i < len(data) && data[i] != ""; i++ {
-			tc.PrintfLine(data[i])
+			tc.PrintfLine("%s", data[i])
 			for len(data[i]) >= 4 && data[i][3] == '-' {
 				i++
-				tc.PrintfLine(data[i])
+				tc.PrintfLine("%s", data[i])
 			}
 			if data[i] == "221 Goodbye" {
 				return
@@ -542,25 +1017,185 @@ SendMail is working for me.
 	wg.Wait()
 }
 
-func TestAuthFailed(t *testing.T) {
-	server := strings.Join(strings.Split(authFailedServer, "\n"), "\r\n")
-	client := strings.Join(strings.Split(authFailedClient, "\n"), "\r\n")
-	var cmdbuf bytes.Buffer
-	bcmdbuf := bufio.NewWriter(&cmdbuf)
-	var fake faker
-	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
-	c, err := NewClient(fake, "fake.host")
+func TestSendMail_dkim(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		t.Fatalf("NewClient: %v", err)
+		t.Fatalf("Unable to create listener: %v", err)
 	}
-	defer c.Close()
-
-	c.tls = true
-	c.serverName = "smtp.google.com"
-	err = c.Auth(sasl.NewPlainClient("", "user", "pass"))
+	defer l.Close()
 
-	if err == nil {
-		t.Error("Auth: expected error; got none")
+	var data []byte
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			t.Errorf("Accept error: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		tc := textproto.NewConn(conn)
+		tc.PrintfLine("220 hello world")
+		for {
+			msg, err := tc.ReadLine()
+			if err != nil {
+				t.Errorf("Read error: %v", err)
+				return
+			}
+			switch {
+			case msg == "DATA":
+				tc.PrintfLine("354 Go ahead")
+				data, err = tc.ReadDotBytes()
+				if err != nil {
+					t.Errorf("Read error: %v", err)
+					return
+				}
+				tc.PrintfLine("250 OK")
+			case msg == "QUIT":
+				tc.PrintfLine("221 Goodbye")
+				return
+			default:
+				tc.PrintfLine("250 OK")
+			}
+		}
+	}()
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	msg := "From: test@example.com\r\nTo: other@example.com\r\n\r\nHello\r\n"
+	r, err := dkim.NewReader(strings.NewReader(msg), &dkim.SignOptions{
+		Domain:   "example.com",
+		Selector: "mail",
+		Signer:   key,
+	})
+	if err != nil {
+		t.Fatalf("dkim.NewReader: %v", err)
+	}
+	err = SendMail(l.Addr().String(), nil, "test@example.com", []string{"other@example.com"}, r)
+	if err != nil {
+		t.Fatalf("SendMail: %v", err)
+	}
+	<-done
+
+	got := strings.Replace(string(data), "\n", "\r\n", -1)
+	if !strings.HasPrefix(got, "DKIM-Signature: ") || !strings.HasSuffix(got, msg) {
+		t.Errorf("Expected a signed message, got %q", got)
+	}
+}
+
+// startSendMailServer starts a server accepting all messages, supporting
+// STARTTLS if withTLS is set. If silent is set, the server never replies.
+func startSendMailServer(t *testing.T, withTLS, silent bool) net.Listener {
+	keypair, err := tls.X509KeyPair(localhostCert, localhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{keypair}}
+
+	ln := newLocalListener(t)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if silent {
+					ioutil.ReadAll(conn)
+					return
+				}
+				tc := textproto.NewConn(conn)
+				tc.PrintfLine("220 localhost ESMTP ready")
+				for {
+					line, err := tc.ReadLine()
+					if err != nil {
+						return
+					}
+					switch {
+					case strings.HasPrefix(line, "EHLO") && withTLS:
+						tc.PrintfLine("250-localhost")
+						tc.PrintfLine("250 STARTTLS")
+					case line == "STARTTLS":
+						tc.PrintfLine("220 Go ahead")
+						tc = textproto.NewConn(tls.Server(conn, serverConfig))
+					case line == "DATA":
+						tc.PrintfLine("354 Go ahead")
+						tc.ReadDotLines()
+						tc.PrintfLine("250 OK")
+					case line == "QUIT":
+						tc.PrintfLine("221 Bye")
+						return
+					default:
+						tc.PrintfLine("250 OK")
+					}
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestSendMailContext(t *testing.T) {
+	send := func(ctx context.Context, ln net.Listener, opts *SendOptions) error {
+		return SendMailContext(ctx, ln.Addr().String(), nil, "alice@example.org", []string{"bob@example.org"}, strings.NewReader("Hello!\r\n"), opts)
+	}
+	expectStage := func(err error, stage string) *SendError {
+		t.Helper()
+		sendErr, ok := err.(*SendError)
+		if !ok || sendErr.Stage != stage {
+			t.Fatalf("SendMailContext: got %v, want a %q *SendError", err, stage)
+		}
+		return sendErr
+	}
+
+	plain := startSendMailServer(t, false, false)
+	defer plain.Close()
+	err := send(context.Background(), plain, nil)
+	if sendErr := expectStage(err, "starttls"); sendErr.Err != ErrStartTLSUnsupported {
+		t.Errorf("SendMailContext: got %v, want ErrStartTLSUnsupported", sendErr.Err)
+	}
+	if err := send(context.Background(), plain, &SendOptions{AllowPlaintext: true}); err != nil {
+		t.Errorf("SendMailContext with AllowPlaintext: %v", err)
+	}
+
+	withTLS := startSendMailServer(t, true, false)
+	defer withTLS.Close()
+	if err := send(context.Background(), withTLS, nil); err != nil {
+		t.Errorf("SendMailContext with TLS: %v", err)
+	}
+	// The test certificate isn't valid for this name
+	tlsConfig := &tls.Config{ServerName: "mx.example.org"}
+	expectStage(send(context.Background(), withTLS, &SendOptions{TLSConfig: tlsConfig}), "starttls")
+
+	silent := startSendMailServer(t, false, true)
+	defer silent.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if sendErr := expectStage(send(ctx, silent, nil), "dial"); sendErr.Err != context.DeadlineExceeded {
+		t.Errorf("SendMailContext: got %v, want context.DeadlineExceeded", sendErr.Err)
+	}
+}
+
+func TestAuthFailed(t *testing.T) {
+	server := strings.Join(strings.Split(authFailedServer, "\n"), "\r\n")
+	client := strings.Join(strings.Split(authFailedClient, "\n"), "\r\n")
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	c.tls = true
+	c.serverName = "smtp.google.com"
+	err = c.Auth(sasl.NewPlainClient("", "user", "pass"))
+
+	if err == nil {
+		t.Error("Auth: expected error; got none")
 	} else if err.Error() != "535 Invalid credentials\nplease see www.example.com" {
 		t.Errorf("Auth: got error: %v, want: %s", err, "535 Invalid credentials\nplease see www.example.com")
 	}
@@ -586,6 +1221,193 @@ AUTH PLAIN AHVzZXIAcGFzcw==
 QUIT
 `
 
+func TestAuthOAuthRefresh(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250-mx.google.com at your service\r\n" +
+		"250 AUTH XOAUTH2\r\n" +
+		"334 eyJzdGF0dXMiOiI0MDEifQ==\r\n" +
+		"501 Aborted\r\n" +
+		"235 Accepted\r\n"
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	c.tls = true
+
+	var refreshes []bool
+	a := NewXOAuth2Client("user", func(refresh bool) (string, error) {
+		refreshes = append(refreshes, refresh)
+		if refresh {
+			return "new", nil
+		}
+		return "old", nil
+	})
+	if err := c.Auth(a); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if len(refreshes) != 2 || refreshes[0] || !refreshes[1] {
+		t.Errorf("token callback called with %v, want [false true]", refreshes)
+	}
+
+	want := "EHLO localhost\r\n" +
+		"AUTH XOAUTH2 dXNlcj11c2VyAWF1dGg9QmVhcmVyIG9sZAEB\r\n" +
+		"*\r\n" +
+		"AUTH XOAUTH2 dXNlcj11c2VyAWF1dGg9QmVhcmVyIG5ldwEB\r\n"
+	if got := wrote.String(); got != want {
+		t.Errorf("wrote %q; want %q", got, want)
+	}
+}
+
+func TestClientDebugWriter(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250-mx.google.com at your service\r\n" +
+		"250 AUTH PLAIN\r\n" +
+		"334 \r\n" +
+		"235 Accepted\r\n" +
+		"250 Sender OK\r\n"
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		ioutil.Discard,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	c.tls = true
+	var debug bytes.Buffer
+	c.DebugWriter = &debug
+
+	if err := c.Auth(&delayedPlainAuth{sasl.NewPlainClient("", "user", "pass")}); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if err := c.Mail("user@example.com"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+
+	// The fake server replies are all read at once, before DebugWriter is
+	// set: only the client commands are logged.
+	want := "EHLO localhost\r\n" +
+		"AUTH PLAIN\r\n" +
+		"<redacted>\r\n" +
+		"MAIL FROM:<user@example.com>\r\n"
+	if got := debug.String(); got != want {
+		t.Errorf("debug output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestClientHooks(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250-mx.google.com at your service\r\n" +
+		"250 AUTH PLAIN\r\n" +
+		"235 Accepted\r\n" +
+		"250 Sender OK\r\n" +
+		"250 Receiver OK\r\n" +
+		"250 Receiver OK\r\n"
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	c.tls = true
+
+	var before, after []string
+	injected := &SMTPError{Code: 452, Message: "Injected failure"}
+	c.Hooks = ClientHooks{
+		BeforeCommand: func(cmd string) error {
+			before = append(before, cmd)
+			if cmd == "DATA" {
+				return errors.New("DATA refused")
+			}
+			return nil
+		},
+		AfterResponse: func(res *CommandResult) error {
+			after = append(after, fmt.Sprintf("%v %v %v", res.Command, res.Code, res.Err))
+			if res.Command == "RCPT TO:<a@example.com>" {
+				return injected
+			}
+			return res.Err
+		},
+	}
+
+	if err := c.Auth(sasl.NewPlainClient("", "user", "pass")); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if err := c.Mail("user@example.com"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := c.Rcpt("a@example.com"); err != injected {
+		t.Errorf("Rcpt: got %v, want the injected error", err)
+	}
+	if err := c.Rcpt("b@example.com"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	if _, err := c.Data(); err == nil || err.Error() != "DATA refused" {
+		t.Errorf("Data: got %v, want the BeforeCommand error", err)
+	}
+
+	wantBefore := []string{
+		"EHLO localhost",
+		"AUTH PLAIN <redacted>",
+		"MAIL FROM:<user@example.com>",
+		"RCPT TO:<a@example.com>",
+		"RCPT TO:<b@example.com>",
+		"DATA",
+	}
+	if !reflect.DeepEqual(before, wantBefore) {
+		t.Errorf("BeforeCommand calls = %q, want %q", before, wantBefore)
+	}
+	wantAfter := []string{
+		"EHLO localhost 250 <nil>",
+		"AUTH PLAIN <redacted> 235 <nil>",
+		"MAIL FROM:<user@example.com> 250 <nil>",
+		"RCPT TO:<a@example.com> 250 <nil>",
+		"RCPT TO:<b@example.com> 250 <nil>",
+	}
+	if !reflect.DeepEqual(after, wantAfter) {
+		t.Errorf("AfterResponse calls = %q, want %q", after, wantAfter)
+	}
+	if strings.Contains(wrote.String(), "DATA") {
+		t.Error("DATA sent despite the BeforeCommand error")
+	}
+}
+
+// delayedPlainAuth sends the PLAIN credentials in response to the first
+// challenge instead of as an initial response.
+type delayedPlainAuth struct {
+	sasl.Client
+}
+
+func (a *delayedPlainAuth) Start() (string, []byte, error) {
+	mech, _, err := a.Client.Start()
+	return mech, nil, err
+}
+
+func (a *delayedPlainAuth) Next(challenge []byte) ([]byte, error) {
+	_, ir, err := a.Client.Start()
+	return ir, err
+}
+
 func TestTLSClient(t *testing.T) {
 	ln := newLocalListener(t)
 	defer ln.Close()
@@ -650,6 +1472,215 @@ func TestTLSConnState(t *testing.T) {
 	<-serverDone
 }
 
+func TestDialStartTLS(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+	serverDone := make(chan bool)
+	go func() {
+		defer close(serverDone)
+		c, err := ln.Accept()
+		if err != nil {
+			t.Errorf("Server accept: %v", err)
+			return
+		}
+		defer c.Close()
+		if err := serverHandle(c, t); err != nil {
+			t.Errorf("server error: %v", err)
+		}
+	}()
+
+	c, err := DialStartTLS(ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("DialStartTLS: %v", err)
+	}
+	if _, ok := c.TLSConnectionState(); !ok {
+		t.Errorf("TLSConnectionState returned ok == false; want true")
+	}
+	if err := c.Quit(); err != nil {
+		t.Errorf("Quit: %v", err)
+	}
+	<-serverDone
+}
+
+func TestTLSSessionResumption(t *testing.T) {
+	keypair, err := tls.X509KeyPair(localhostCert, localhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{keypair}}
+
+	ln := newLocalListener(t)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tc := textproto.NewConn(conn)
+				tc.PrintfLine("220 localhost ESMTP ready")
+				tc.ReadLine()
+				tc.PrintfLine("250-localhost")
+				tc.PrintfLine("250 STARTTLS")
+				tc.ReadLine()
+				tc.PrintfLine("220 Go ahead")
+				tc = textproto.NewConn(tls.Server(conn, serverConfig))
+				for {
+					line, err := tc.ReadLine()
+					if err != nil {
+						return
+					}
+					if line == "QUIT" {
+						tc.PrintfLine("221 Bye")
+						return
+					}
+					tc.PrintfLine("250 OK")
+				}
+			}()
+		}
+	}()
+
+	d := &Dialer{TLSSessionCache: tls.NewLRUClientSessionCache(0)}
+	for i := 0; i < 2; i++ {
+		c, err := d.Dial(ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		if err := c.StartTLS(nil); err != nil {
+			t.Fatalf("StartTLS: %v", err)
+		}
+		if err := c.Noop(); err != nil {
+			t.Fatalf("Noop: %v", err)
+		}
+		info, ok := c.TLSInfo()
+		if !ok {
+			t.Fatal("TLSInfo returned ok == false; want true")
+		}
+		if info.Resumed != (i > 0) {
+			t.Errorf("connection %v: Resumed = %v", i, info.Resumed)
+		}
+		if info.Version == "" || info.CipherSuite == "" || len(info.VerifiedChains) == 0 {
+			t.Errorf("connection %v: TLSInfo = %+v", i, info)
+		}
+		c.Quit()
+	}
+}
+
+func TestStartTLSRequired(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250-mx.google.com at your service\r\n" +
+		"250 8BITMIME\r\n"
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	c.StartTLSPolicy = StartTLSRequired
+	if err := c.Mail("user@gmail.com"); err != ErrStartTLSUnsupported {
+		t.Errorf("Mail: got %v, want %v", err, ErrStartTLSUnsupported)
+	}
+	if got, want := wrote.String(), "EHLO localhost\r\n"; got != want {
+		t.Errorf("wrote %q; want %q", got, want)
+	}
+}
+
+func TestClientHelloError(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"550 5.7.1 Generic host names are not accepted\r\n" +
+		"550 5.7.1 Generic host names are not accepted\r\n"
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	if err := c.Hello("mta example"); err == nil {
+		t.Error("Hello: expected error for an invalid name")
+	}
+	err = c.Hello("mta.example.org")
+	helloErr, ok := err.(*HelloError)
+	if !ok {
+		t.Fatalf("Hello: expected a HelloError, got %v", err)
+	}
+	if smtpErr, ok := helloErr.Err.(*SMTPError); !ok || smtpErr.Code != 550 || helloErr.LocalName != "mta.example.org" {
+		t.Errorf("Hello: unexpected error %+v", helloErr)
+	}
+	if got, want := wrote.String(), "EHLO mta.example.org\r\nHELO mta.example.org\r\n"; got != want {
+		t.Errorf("wrote %q; want %q", got, want)
+	}
+
+	if name := DefaultLocalName(); name == "" {
+		t.Error("DefaultLocalName: empty name")
+	}
+	d := &Dialer{LocalName: "[192.0.2.300]"}
+	ln := newLocalListener(t)
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			io.WriteString(c, "220 hello world\r\n")
+			c.Close()
+		}
+	}()
+	if _, err := d.Dial(ln.Addr().String()); err == nil {
+		t.Error("Dial: expected error for an invalid local name")
+	}
+}
+
+func TestClientTimeouts(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+	go func() {
+		for i := 0; ; i++ {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			if i > 0 {
+				// Greet, but never reply to EHLO
+				io.WriteString(c, "220 hello world\r\n")
+			}
+		}
+	}()
+
+	d := &Dialer{Timeouts: Timeouts{Greeting: 50 * time.Millisecond}}
+	if _, err := d.Dial(ln.Addr().String()); err == nil {
+		t.Fatal("Dial: expected greeting timeout")
+	} else if neterr, ok := err.(net.Error); !ok || !neterr.Timeout() {
+		t.Fatalf("Dial: expected a timeout error, got %v", err)
+	}
+
+	d.Timeouts.Hello = 50 * time.Millisecond
+	c, err := d.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	if err := c.Hello("localhost"); err == nil {
+		t.Fatal("Hello: expected timeout")
+	} else if neterr, ok := err.(net.Error); !ok || !neterr.Timeout() {
+		t.Fatalf("Hello: expected a timeout error, got %v", err)
+	}
+}
+
 func newLocalListener(t *testing.T) net.Listener {
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -826,6 +1857,54 @@ Goodbye.`
 	}
 }
 
+func TestDialLMTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lmtp.sock")
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets not supported: %v", err)
+	}
+	defer ln.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Errorf("Accept: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		tc := textproto.NewConn(conn)
+		tc.PrintfLine("220 localhost LMTP ready")
+		for _, reply := range []string{"250 localhost", "221 Bye"} {
+			if _, err := tc.ReadLine(); err != nil {
+				t.Errorf("ReadLine: %v", err)
+				return
+			}
+			tc.PrintfLine("%s", reply)
+		}
+	}()
+
+	c, err := DialLMTP("unix", path)
+	if err != nil {
+		t.Fatalf("DialLMTP: %v", err)
+	}
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatalf("Quit: %v", err)
+	}
+	<-done
+}
+
 var lmtpServer = `250-localhost at your service
 250-SIZE 35651584
 250 8BITMIME
@@ -850,3 +1929,107 @@ Goodbye.
 .
 QUIT
 `
+
+type testSASLClient struct {
+	mech string
+}
+
+func (a *testSASLClient) Start() (string, []byte, error) {
+	return a.mech, nil, nil
+}
+
+func (a *testSASLClient) Next(challenge []byte) ([]byte, error) {
+	return nil, errors.New("unexpected challenge")
+}
+
+func TestClientAuthAny(t *testing.T) {
+	mechs := append([]AuthMechanism{{
+		Name: "SCRAM-SHA-256",
+		Client: func() sasl.Client {
+			return &testSASLClient{"SCRAM-SHA-256"}
+		},
+	}}, PasswordAuthMechanisms("user", "pass")...)
+
+	tests := []struct {
+		name     string
+		tls      bool
+		server   string
+		wantMech string
+		wantErr  bool
+		wrote    string
+	}{
+		{
+			name: "fallback",
+			tls:  true,
+			server: "250 AUTH SCRAM-SHA-256 LOGIN PLAIN\r\n" +
+				"504 5.5.4 Unrecognized authentication type\r\n" +
+				"501 5.5.2 Syntax error\r\n" +
+				"235 2.7.0 Authentication successful\r\n",
+			wantMech: "PLAIN",
+			wrote: "AUTH SCRAM-SHA-256\r\n" +
+				"*\r\n" +
+				"AUTH PLAIN AHVzZXIAcGFzcw==\r\n",
+		},
+		{
+			name: "login",
+			tls:  true,
+			server: "250 AUTH LOGIN\r\n" +
+				"334 VXNlcm5hbWU6\r\n" +
+				"334 UGFzc3dvcmQ6\r\n" +
+				"235 2.7.0 Authentication successful\r\n",
+			wantMech: "LOGIN",
+			wrote: "AUTH LOGIN\r\n" +
+				"dXNlcg==\r\n" +
+				"cGFzcw==\r\n",
+		},
+		{
+			name:    "plaintext",
+			server:  "250 AUTH LOGIN PLAIN\r\n" + "221 Bye\r\n",
+			wantErr: true,
+			wrote:   "QUIT\r\n",
+		},
+		{
+			name: "invalid credentials",
+			tls:  true,
+			server: "250 AUTH LOGIN PLAIN\r\n" +
+				"535 5.7.8 Authentication credentials invalid\r\n" +
+				"501 5.5.2 Syntax error\r\n" +
+				"221 Bye\r\n",
+			wantErr: true,
+			wrote: "AUTH PLAIN AHVzZXIAcGFzcw==\r\n" +
+				"*\r\n" +
+				"QUIT\r\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var wrote bytes.Buffer
+			var fake faker
+			fake.ReadWriter = struct {
+				io.Reader
+				io.Writer
+			}{
+				strings.NewReader("220 hello world\r\n" + "250-mx.example.org\r\n" + tc.server),
+				&wrote,
+			}
+			c, err := NewClient(fake, "fake.host")
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+			c.tls = tc.tls
+
+			mech, err := c.AuthAny(mechs)
+			if tc.wantErr && err == nil {
+				t.Errorf("AuthAny: expected an error")
+			} else if !tc.wantErr && err != nil {
+				t.Errorf("AuthAny: %v", err)
+			}
+			if mech != tc.wantMech {
+				t.Errorf("AuthAny = %q, want %q", mech, tc.wantMech)
+			}
+			if want := "EHLO localhost\r\n" + tc.wrote; wrote.String() != want {
+				t.Errorf("wrote %q; want %q", wrote.String(), want)
+			}
+		})
+	}
+}
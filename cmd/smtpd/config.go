@@ -0,0 +1,1861 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+	"github.com/emersion/go-smtp/dkim"
+	"github.com/emersion/go-smtp/queue"
+)
+
+type listenerConfig struct {
+	Address string
+	// One of "smtp", "smtps" or "lmtp"
+	Protocol string
+	// Commands rejected on this listener
+	DisabledCommands []string
+	AuthPolicies     []authPolicyConfig
+	// One of "cannot_verify", "backend" or "disabled"
+	Vrfy string
+	// Reject HELO, clients must use EHLO
+	RequireEHLO bool
+	// Reject clients pipelining commands when not allowed to
+	RejectUnauthPipelining bool
+	// Reject message data with bare LF line endings
+	RejectBareLF bool
+}
+
+type authPolicyConfig struct {
+	// A SASL mechanism name, e.g. "PLAIN"
+	Mechanism     string
+	AllowInsecure bool
+	// CIDR networks the mechanism is offered to, all if empty
+	Networks []string
+}
+
+type backendConfig struct {
+	// One of "maildir", "relay", "webhook", "queue" or "proxy"
+	Type string
+
+	// maildir
+	Root string
+	// relay and queue
+	Smarthost  string
+	Smarthosts []smarthostConfig
+	// How long a failing smarthost is avoided for
+	SmarthostCooldown time.Duration
+	// Interval between smarthost health checks, zero disables them
+	HealthCheck time.Duration
+	Port        string
+	// Local addresses and HELO names by sender domain
+	Sources []sourceConfig
+	// Certificates presented to servers requiring mutual TLS
+	ClientCerts []clientCertConfig
+	// TLS security levels by destination, and a lookup table of them
+	TLSPolicies    []tlsPolicyConfig
+	TLSPolicyTable string
+	// A lookup table routing recipient addresses or domains to servers
+	RouteTable string
+	// A lookup table of virtual aliases, applied to all backends
+	Aliases string
+	// webhook
+	URL    string
+	Secret string
+	// queue
+	Dir string
+	// Delivery limits per recipient domain, see queue.Queue
+	DomainConcurrency  int
+	DomainRate         int
+	DomainRateInterval time.Duration
+	DomainLimits       []domainLimitConfig
+	// How long undelivered messages are retried for, and retry schedules
+	// by recipient domain
+	MaxAge         time.Duration
+	RetrySchedules []retryScheduleConfig
+	// Keep expired messages in a dead-letter store
+	DeadLetter bool
+	// Address of the queue administration HTTP API
+	Admin string
+}
+
+type retryScheduleConfig struct {
+	// Lower-case recipient domains
+	Domains   []string
+	Intervals []time.Duration
+	MaxAge    time.Duration
+}
+
+type domainLimitConfig struct {
+	// A lower-case recipient domain
+	Domain       string
+	Concurrency  int
+	Rate         int
+	RateInterval time.Duration
+}
+
+// accessConfig holds lookup tables of access rules, see
+// backendutil.AccessBackend.
+type accessConfig struct {
+	Clients    string
+	Senders    string
+	Recipients string
+	// Defer policy rejections of senders and recipients until after DATA
+	DelayReject bool
+}
+
+type sourceConfig struct {
+	// A lower-case sender domain, empty for other senders
+	Domain   string
+	Address  string
+	Hostname string
+}
+
+type clientCertConfig struct {
+	// A lower-case server host name, empty for other servers
+	Server string
+	// Paths to PEM-encoded files
+	Cert string
+	Key  string
+}
+
+type tlsPolicyConfig struct {
+	// A lower-case recipient domain or server host name, ".example.org" for
+	// subdomains
+	Destination string
+	// One of "none", "may", "encrypt" or "verify"
+	Level string
+}
+
+type smarthostConfig struct {
+	Address string
+	Weight  int
+}
+
+type domainConfig struct {
+	// A lower-case domain, or "*" for all other domains
+	Name            string
+	Reject          bool
+	RequireTLS      bool
+	RequireAuth     bool
+	MaxRecipients   int
+	MaxMessageBytes int64
+}
+
+type headersConfig struct {
+	Remove       []string
+	Add          map[string]string
+	Rewrite      []headerRewriteConfig
+	MaskReceived bool
+	// CIDR networks masked in Received header fields
+	InternalNetworks []string
+	Disclaimer       string
+}
+
+// mimeConfig enables the rejection of messages with a malformed MIME
+// structure.
+type mimeConfig struct {
+	MaxDepth int
+}
+
+// submissionConfig completes or rejects messages submitted by authenticated
+// users without a Date, Message-ID or From header field.
+type submissionConfig struct {
+	AddDate      bool
+	AddMessageID bool
+	AddFrom      bool
+}
+
+// alignmentConfig rejects messages submitted by authenticated users with
+// sender addresses they don't own.
+type alignmentConfig struct {
+	// A lookup table of the users owning sender addresses or domains
+	Owners string
+	Exempt []string
+	// "none" (the default), "relaxed" or "strict"
+	Header string
+}
+
+func (a *alignmentConfig) headerAlignment() (backendutil.HeaderAlignment, error) {
+	if a.Header == "" {
+		return backendutil.AlignmentNone, nil
+	}
+	alignment, err := backendutil.ParseHeaderAlignment(a.Header)
+	if err != nil {
+		return 0, fmt.Errorf("alignment: %v", err)
+	}
+	return alignment, nil
+}
+
+type attachmentsConfig struct {
+	ContentTypes []string
+	Extensions   []string
+	// "reject" (the default) or "strip"
+	Action string
+}
+
+func (a *attachmentsConfig) policy() (*backendutil.AttachmentPolicy, error) {
+	p := &backendutil.AttachmentPolicy{
+		ContentTypes: a.ContentTypes,
+		Extensions:   a.Extensions,
+	}
+	if a.Action != "" {
+		action, err := backendutil.ParseAttachmentAction(a.Action)
+		if err != nil {
+			return nil, fmt.Errorf("attachments: %v", err)
+		}
+		p.Action = action
+	}
+	return p, nil
+}
+
+type headerRewriteConfig struct {
+	Name        string
+	Pattern     string
+	Replacement string
+}
+
+type quotaConfig struct {
+	Window     time.Duration
+	Messages   int
+	Recipients int
+	// Limited users, all users if empty
+	Users []string
+}
+
+type policyConfig struct {
+	// "tcp" or "unix"
+	Network string
+	Address string
+	Timeout time.Duration
+	// SMTP stages the policy service is consulted at: "MAIL", "RCPT" and
+	// "DATA". Defaults to "RCPT".
+	States   []string
+	FailOpen bool
+}
+
+type postmasterConfig struct {
+	// The destination of mail to postmaster
+	Address string
+	// The destination of mail to abuse, not redirected if empty
+	Abuse string
+}
+
+type scoreConfig struct {
+	// Score thresholds, zero disables the action
+	Tag      float64
+	Greylist float64
+	Reject   float64
+
+	GreylistDelay time.Duration
+	Timeout       time.Duration
+	// Directory where rejected messages are kept for review
+	Quarantine string
+	Rules      []scoreRuleConfig
+}
+
+type scoreRuleConfig struct {
+	// "dnsbl", "rdns", "helo" or "spf"
+	Type string
+	// Defaults to the type, or to "dnsbl:zone" for DNS blocklists
+	Name   string
+	Zone   string
+	Weight float64
+}
+
+type dkimConfig struct {
+	// A lower-case sender domain
+	Domain   string
+	Selector string
+	// Path to a PEM-encoded RSA or Ed25519 private key
+	Key string
+	// "header/body" canonicalization, e.g. "relaxed/simple"
+	Canonicalization string
+	Headers          []string
+}
+
+type arcConfig struct {
+	Domain   string
+	Selector string
+	// Path to a PEM-encoded RSA or Ed25519 private key
+	Key string
+	// Defaults to the hostname
+	AuthServID string
+}
+
+type config struct {
+	Hostname  string
+	Listeners []listenerConfig
+
+	LogFile string
+	Debug   bool
+	Pprof   string
+
+	TLSCert string
+	TLSKey  string
+
+	Users          map[string]string
+	AllowAnonymous bool
+	AllowInsecure  bool
+
+	MaxRecipients     int
+	MaxMessageBytes   int
+	MaxLineLength     int
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	MaxConnections    int
+	ConnectionWait    time.Duration
+	ReadBuffer        int
+	WriteBuffer       int
+	DataBuffer        int
+	DataStall         time.Duration
+	DataStallPolicy   string
+	MaxRcptFailures   int
+	RcptFailureWindow time.Duration
+
+	Backend backendConfig
+	Domains []domainConfig
+	Quotas  []quotaConfig
+	Policy  *policyConfig
+	Access  accessConfig
+	// Postmaster redirects mail to the postmaster and abuse addresses
+	Postmaster  *postmasterConfig
+	Score       *scoreConfig
+	Headers     *headersConfig
+	MIME        *mimeConfig
+	Attachments *attachmentsConfig
+	Submission  *submissionConfig
+	Alignment   *alignmentConfig
+	DKIM        []dkimConfig
+	ARC         *arcConfig
+}
+
+// section decodes a configuration table, recording the first error.
+type section struct {
+	name string
+	t    table
+	seen map[string]bool
+	err  *error
+}
+
+func (s *section) get(key string) interface{} {
+	s.seen[key] = true
+	return s.t[key]
+}
+
+func (s *section) fail(key, format string, v ...interface{}) {
+	if *s.err == nil {
+		name := key
+		if s.name != "" {
+			name = s.name + "." + key
+		}
+		*s.err = fmt.Errorf("%v: %v", name, fmt.Sprintf(format, v...))
+	}
+}
+
+func (s *section) string(key string, v *string) {
+	switch raw := s.get(key).(type) {
+	case nil:
+	case string:
+		*v = raw
+	default:
+		s.fail(key, "expected a string")
+	}
+}
+
+func (s *section) int64(key string, v *int64) {
+	switch raw := s.get(key).(type) {
+	case nil:
+	case int64:
+		*v = raw
+	default:
+		s.fail(key, "expected an integer")
+	}
+}
+
+func (s *section) int(key string, v *int) {
+	n := int64(*v)
+	s.int64(key, &n)
+	*v = int(n)
+}
+
+func (s *section) float64(key string, v *float64) {
+	switch raw := s.get(key).(type) {
+	case nil:
+	case float64:
+		*v = raw
+	case int64:
+		*v = float64(raw)
+	default:
+		s.fail(key, "expected a number")
+	}
+}
+
+func (s *section) bool(key string, v *bool) {
+	switch raw := s.get(key).(type) {
+	case nil:
+	case bool:
+		*v = raw
+	default:
+		s.fail(key, "expected a boolean")
+	}
+}
+
+func (s *section) duration(key string, v *time.Duration) {
+	var raw string
+	s.string(key, &raw)
+	if raw == "" {
+		return
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		s.fail(key, "%v", err)
+		return
+	}
+	*v = d
+}
+
+func (s *section) durations(key string, v *[]time.Duration) {
+	var raw []string
+	s.strings(key, &raw)
+	if raw == nil {
+		return
+	}
+	l := make([]time.Duration, len(raw))
+	for i, str := range raw {
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			s.fail(key, "%v", err)
+			return
+		}
+		l[i] = d
+	}
+	*v = l
+}
+
+func (s *section) strings(key string, v *[]string) {
+	switch raw := s.get(key).(type) {
+	case nil:
+	case []interface{}:
+		l := make([]string, len(raw))
+		for i, item := range raw {
+			str, ok := item.(string)
+			if !ok {
+				s.fail(key, "expected an array of strings")
+				return
+			}
+			l[i] = str
+		}
+		*v = l
+	default:
+		s.fail(key, "expected an array of strings")
+	}
+}
+
+func (s *section) stringMap(key string, v *map[string]string) {
+	sub := s.table(key)
+	if sub == nil {
+		return
+	}
+	m := make(map[string]string, len(sub.t))
+	for k := range sub.t {
+		var value string
+		sub.string(k, &value)
+		m[k] = value
+	}
+	*v = m
+}
+
+func (s *section) table(key string) *section {
+	switch raw := s.get(key).(type) {
+	case nil:
+	case table:
+		return s.sub(key, raw)
+	default:
+		s.fail(key, "expected a table")
+	}
+	return nil
+}
+
+func (s *section) tables(key string) []*section {
+	switch raw := s.get(key).(type) {
+	case nil:
+	case []table:
+		l := make([]*section, len(raw))
+		for i, t := range raw {
+			l[i] = s.sub(fmt.Sprintf("%v[%v]", key, i), t)
+		}
+		return l
+	default:
+		s.fail(key, "expected an array of tables")
+	}
+	return nil
+}
+
+func (s *section) sub(key string, t table) *section {
+	name := key
+	if s.name != "" {
+		name = s.name + "." + key
+	}
+	return &section{name: name, t: t, seen: make(map[string]bool), err: s.err}
+}
+
+// done reports keys which have not been decoded.
+func (s *section) done() {
+	if s == nil {
+		return
+	}
+	var unknown []string
+	for k := range s.t {
+		if !s.seen[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	if len(unknown) > 0 {
+		s.fail(unknown[0], "unknown key")
+	}
+}
+
+// parseConfig reads a configuration file.
+func parseConfig(r io.Reader) (*config, error) {
+	t, err := parseTOML(r)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config{
+		MaxRecipients:   100,
+		MaxMessageBytes: 25 * 1024 * 1024,
+		ReadTimeout:     5 * time.Minute,
+		WriteTimeout:    5 * time.Minute,
+	}
+	root := &section{t: t, seen: make(map[string]bool), err: &err}
+	root.string("hostname", &cfg.Hostname)
+
+	for _, s := range root.tables("listener") {
+		l := listenerConfig{Protocol: "smtp"}
+		s.string("address", &l.Address)
+		s.string("protocol", &l.Protocol)
+		s.strings("disabled_commands", &l.DisabledCommands)
+		s.string("vrfy", &l.Vrfy)
+		s.bool("require_ehlo", &l.RequireEHLO)
+		s.bool("reject_unauth_pipelining", &l.RejectUnauthPipelining)
+		s.bool("reject_bare_lf", &l.RejectBareLF)
+		for _, s := range s.tables("auth_policy") {
+			var p authPolicyConfig
+			s.string("mechanism", &p.Mechanism)
+			s.bool("allow_insecure", &p.AllowInsecure)
+			s.strings("networks", &p.Networks)
+			s.done()
+			p.Mechanism = strings.ToUpper(p.Mechanism)
+			l.AuthPolicies = append(l.AuthPolicies, p)
+		}
+		s.done()
+		cfg.Listeners = append(cfg.Listeners, l)
+	}
+
+	if s := root.table("log"); s != nil {
+		s.string("file", &cfg.LogFile)
+		s.bool("debug", &cfg.Debug)
+		s.string("pprof", &cfg.Pprof)
+		s.done()
+	}
+
+	if s := root.table("tls"); s != nil {
+		s.string("cert", &cfg.TLSCert)
+		s.string("key", &cfg.TLSKey)
+		s.done()
+	}
+
+	if s := root.table("auth"); s != nil {
+		s.stringMap("users", &cfg.Users)
+		s.bool("allow_anonymous", &cfg.AllowAnonymous)
+		s.bool("allow_insecure", &cfg.AllowInsecure)
+		s.done()
+	}
+
+	if s := root.table("limits"); s != nil {
+		s.int("max_recipients", &cfg.MaxRecipients)
+		s.int("max_message_bytes", &cfg.MaxMessageBytes)
+		s.int("max_line_length", &cfg.MaxLineLength)
+		s.duration("read_timeout", &cfg.ReadTimeout)
+		s.duration("write_timeout", &cfg.WriteTimeout)
+		s.int("max_connections", &cfg.MaxConnections)
+		s.duration("connection_wait", &cfg.ConnectionWait)
+		s.int("read_buffer", &cfg.ReadBuffer)
+		s.int("write_buffer", &cfg.WriteBuffer)
+		s.int("data_buffer", &cfg.DataBuffer)
+		s.duration("data_stall_timeout", &cfg.DataStall)
+		s.string("data_stall_policy", &cfg.DataStallPolicy)
+		s.int("max_rcpt_failures", &cfg.MaxRcptFailures)
+		s.duration("rcpt_failure_window", &cfg.RcptFailureWindow)
+		s.done()
+	}
+
+	if s := root.table("backend"); s != nil {
+		b := &cfg.Backend
+		s.string("type", &b.Type)
+		s.string("root", &b.Root)
+		s.string("smarthost", &b.Smarthost)
+		for _, s := range s.tables("smarthosts") {
+			var sh smarthostConfig
+			s.string("address", &sh.Address)
+			s.int("weight", &sh.Weight)
+			s.done()
+			b.Smarthosts = append(b.Smarthosts, sh)
+		}
+		for _, s := range s.tables("source") {
+			var src sourceConfig
+			s.string("domain", &src.Domain)
+			s.string("address", &src.Address)
+			s.string("hostname", &src.Hostname)
+			s.done()
+			src.Domain = strings.ToLower(src.Domain)
+			b.Sources = append(b.Sources, src)
+		}
+		for _, s := range s.tables("client_cert") {
+			var cc clientCertConfig
+			s.string("server", &cc.Server)
+			s.string("cert", &cc.Cert)
+			s.string("key", &cc.Key)
+			s.done()
+			cc.Server = strings.ToLower(cc.Server)
+			b.ClientCerts = append(b.ClientCerts, cc)
+		}
+		for _, s := range s.tables("tls_policy") {
+			var p tlsPolicyConfig
+			s.string("destination", &p.Destination)
+			s.string("level", &p.Level)
+			s.done()
+			p.Destination = strings.ToLower(p.Destination)
+			b.TLSPolicies = append(b.TLSPolicies, p)
+		}
+		s.duration("smarthost_cooldown", &b.SmarthostCooldown)
+		s.duration("health_check", &b.HealthCheck)
+		s.string("port", &b.Port)
+		s.string("route_table", &b.RouteTable)
+		s.string("tls_policy_table", &b.TLSPolicyTable)
+		s.string("aliases", &b.Aliases)
+		s.string("url", &b.URL)
+		s.string("secret", &b.Secret)
+		s.string("dir", &b.Dir)
+		s.int("domain_concurrency", &b.DomainConcurrency)
+		s.int("domain_rate", &b.DomainRate)
+		s.duration("domain_rate_interval", &b.DomainRateInterval)
+		for _, s := range s.tables("domain_limit") {
+			var l domainLimitConfig
+			s.string("domain", &l.Domain)
+			s.int("concurrency", &l.Concurrency)
+			s.int("rate", &l.Rate)
+			s.duration("rate_interval", &l.RateInterval)
+			s.done()
+			l.Domain = strings.ToLower(l.Domain)
+			b.DomainLimits = append(b.DomainLimits, l)
+		}
+		s.duration("max_age", &b.MaxAge)
+		for _, s := range s.tables("retry_schedule") {
+			var r retryScheduleConfig
+			s.strings("domains", &r.Domains)
+			s.durations("intervals", &r.Intervals)
+			s.duration("max_age", &r.MaxAge)
+			s.done()
+			for i, domain := range r.Domains {
+				r.Domains[i] = strings.ToLower(domain)
+			}
+			b.RetrySchedules = append(b.RetrySchedules, r)
+		}
+		s.bool("dead_letter", &b.DeadLetter)
+		s.string("admin", &b.Admin)
+		s.done()
+	}
+
+	for _, s := range root.tables("domain") {
+		var d domainConfig
+		s.string("name", &d.Name)
+		s.bool("reject", &d.Reject)
+		s.bool("require_tls", &d.RequireTLS)
+		s.bool("require_auth", &d.RequireAuth)
+		s.int("max_recipients", &d.MaxRecipients)
+		s.int64("max_message_bytes", &d.MaxMessageBytes)
+		s.done()
+		d.Name = strings.ToLower(d.Name)
+		cfg.Domains = append(cfg.Domains, d)
+	}
+
+	if s := root.table("headers"); s != nil {
+		h := &headersConfig{}
+		s.strings("remove", &h.Remove)
+		s.stringMap("add", &h.Add)
+		for _, s := range s.tables("rewrite") {
+			var rw headerRewriteConfig
+			s.string("name", &rw.Name)
+			s.string("pattern", &rw.Pattern)
+			s.string("replacement", &rw.Replacement)
+			s.done()
+			h.Rewrite = append(h.Rewrite, rw)
+		}
+		s.bool("mask_received", &h.MaskReceived)
+		s.strings("internal_networks", &h.InternalNetworks)
+		s.string("disclaimer", &h.Disclaimer)
+		s.done()
+		cfg.Headers = h
+	}
+
+	if s := root.table("mime"); s != nil {
+		m := &mimeConfig{}
+		s.int("max_depth", &m.MaxDepth)
+		s.done()
+		cfg.MIME = m
+	}
+
+	if s := root.table("attachments"); s != nil {
+		a := &attachmentsConfig{}
+		s.strings("content_types", &a.ContentTypes)
+		s.strings("extensions", &a.Extensions)
+		s.string("action", &a.Action)
+		s.done()
+		cfg.Attachments = a
+	}
+
+	if s := root.table("submission"); s != nil {
+		sub := &submissionConfig{}
+		s.bool("add_date", &sub.AddDate)
+		s.bool("add_message_id", &sub.AddMessageID)
+		s.bool("add_from", &sub.AddFrom)
+		s.done()
+		cfg.Submission = sub
+	}
+
+	if s := root.table("alignment"); s != nil {
+		a := &alignmentConfig{}
+		s.string("owners", &a.Owners)
+		s.strings("exempt", &a.Exempt)
+		s.string("header", &a.Header)
+		s.done()
+		cfg.Alignment = a
+	}
+
+	for _, s := range root.tables("quota") {
+		var q quotaConfig
+		s.duration("window", &q.Window)
+		s.int("messages", &q.Messages)
+		s.int("recipients", &q.Recipients)
+		s.strings("users", &q.Users)
+		s.done()
+		cfg.Quotas = append(cfg.Quotas, q)
+	}
+
+	if s := root.table("access"); s != nil {
+		s.string("clients", &cfg.Access.Clients)
+		s.string("senders", &cfg.Access.Senders)
+		s.string("recipients", &cfg.Access.Recipients)
+		s.bool("delay_reject", &cfg.Access.DelayReject)
+		s.done()
+	}
+
+	if s := root.table("policy"); s != nil {
+		p := &policyConfig{Network: "tcp"}
+		s.string("network", &p.Network)
+		s.string("address", &p.Address)
+		s.duration("timeout", &p.Timeout)
+		s.strings("states", &p.States)
+		s.bool("fail_open", &p.FailOpen)
+		s.done()
+		for i, state := range p.States {
+			p.States[i] = strings.ToUpper(state)
+		}
+		cfg.Policy = p
+	}
+
+	if s := root.table("postmaster"); s != nil {
+		p := &postmasterConfig{}
+		s.string("address", &p.Address)
+		s.string("abuse", &p.Abuse)
+		s.done()
+		cfg.Postmaster = p
+	}
+
+	if s := root.table("score"); s != nil {
+		sc := &scoreConfig{}
+		s.float64("tag", &sc.Tag)
+		s.float64("greylist", &sc.Greylist)
+		s.float64("reject", &sc.Reject)
+		s.duration("greylist_delay", &sc.GreylistDelay)
+		s.duration("timeout", &sc.Timeout)
+		s.string("quarantine", &sc.Quarantine)
+		for _, s := range s.tables("rule") {
+			var r scoreRuleConfig
+			s.string("type", &r.Type)
+			s.string("name", &r.Name)
+			s.string("zone", &r.Zone)
+			s.float64("weight", &r.Weight)
+			s.done()
+			sc.Rules = append(sc.Rules, r)
+		}
+		s.done()
+		cfg.Score = sc
+	}
+
+	for _, s := range root.tables("dkim") {
+		var d dkimConfig
+		s.string("domain", &d.Domain)
+		s.string("selector", &d.Selector)
+		s.string("key", &d.Key)
+		s.string("canonicalization", &d.Canonicalization)
+		s.strings("headers", &d.Headers)
+		s.done()
+		d.Domain = strings.ToLower(d.Domain)
+		cfg.DKIM = append(cfg.DKIM, d)
+	}
+
+	if s := root.table("arc"); s != nil {
+		cfg.ARC = &arcConfig{}
+		s.string("domain", &cfg.ARC.Domain)
+		s.string("selector", &cfg.ARC.Selector)
+		s.string("key", &cfg.ARC.Key)
+		s.string("authserv_id", &cfg.ARC.AuthServID)
+		s.done()
+	}
+
+	root.done()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, cfg.validate()
+}
+
+func (cfg *config) validate() error {
+	if len(cfg.Listeners) == 0 {
+		return fmt.Errorf("no listener configured")
+	}
+	for _, l := range cfg.Listeners {
+		if l.Address == "" {
+			return fmt.Errorf("listener: missing address")
+		}
+		switch l.Protocol {
+		case "smtp", "lmtp":
+		case "smtps":
+			if cfg.TLSCert == "" {
+				return fmt.Errorf("listener %v: smtps requires a TLS certificate", l.Address)
+			}
+		default:
+			return fmt.Errorf("listener %v: unknown protocol %q", l.Address, l.Protocol)
+		}
+		if _, err := l.authPolicies(); err != nil {
+			return err
+		}
+		if _, err := l.vrfyMode(); err != nil {
+			return err
+		}
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return fmt.Errorf("tls: both cert and key must be set")
+	}
+	for _, d := range cfg.Domains {
+		if d.Name == "" {
+			return fmt.Errorf("domain: missing name")
+		}
+	}
+	if cfg.Headers != nil {
+		if _, err := cfg.Headers.pipeline(); err != nil {
+			return err
+		}
+	}
+	if cfg.MIME != nil && cfg.MIME.MaxDepth < 0 {
+		return fmt.Errorf("mime: invalid max_depth %v", cfg.MIME.MaxDepth)
+	}
+	if cfg.Attachments != nil {
+		if _, err := cfg.Attachments.policy(); err != nil {
+			return err
+		}
+	}
+	if a := cfg.Alignment; a != nil {
+		if _, err := a.headerAlignment(); err != nil {
+			return err
+		}
+		for _, username := range a.Exempt {
+			if _, ok := cfg.Users[username]; !ok {
+				return fmt.Errorf("alignment: unknown user %q", username)
+			}
+		}
+	}
+	for _, q := range cfg.Quotas {
+		if q.Window <= 0 {
+			return fmt.Errorf("quota: missing window")
+		}
+		if q.Messages <= 0 && q.Recipients <= 0 {
+			return fmt.Errorf("quota: messages or recipients is required")
+		}
+		for _, username := range q.Users {
+			if _, ok := cfg.Users[username]; !ok {
+				return fmt.Errorf("quota: unknown user %q", username)
+			}
+		}
+	}
+	if cfg.Backend.RouteTable != "" && cfg.Backend.Type != "relay" && cfg.Backend.Type != "queue" {
+		return fmt.Errorf("backend: route_table requires the relay or queue backend")
+	}
+	if cfg.Backend.TLSPolicyTable != "" && cfg.Backend.Type != "relay" && cfg.Backend.Type != "queue" {
+		return fmt.Errorf("backend: tls_policy_table requires the relay or queue backend")
+	}
+	if b := cfg.Backend; b.DomainConcurrency != 0 || b.DomainRate != 0 || b.DomainRateInterval != 0 || len(b.DomainLimits) > 0 {
+		if b.Type != "queue" {
+			return fmt.Errorf("backend: domain limits require the queue backend")
+		}
+		if b.DomainConcurrency < 0 || b.DomainRate < 0 || b.DomainRateInterval < 0 {
+			return fmt.Errorf("backend: invalid domain limits")
+		}
+		for _, l := range b.DomainLimits {
+			if l.Domain == "" {
+				return fmt.Errorf("backend: domain_limit: missing domain")
+			}
+			if l.Concurrency < 0 || l.Rate < 0 || l.RateInterval < 0 {
+				return fmt.Errorf("backend: domain_limit: invalid limits for %v", l.Domain)
+			}
+		}
+	}
+	if cfg.Backend.Admin != "" && cfg.Backend.Type != "queue" {
+		return fmt.Errorf("backend: admin requires the queue backend")
+	}
+	if b := cfg.Backend; b.MaxAge != 0 || len(b.RetrySchedules) > 0 || b.DeadLetter {
+		if b.Type != "queue" {
+			return fmt.Errorf("backend: retry settings require the queue backend")
+		}
+		if b.MaxAge < 0 {
+			return fmt.Errorf("backend: invalid max_age %v", b.MaxAge)
+		}
+		seen := make(map[string]bool)
+		for _, r := range b.RetrySchedules {
+			if len(r.Domains) == 0 {
+				return fmt.Errorf("backend: retry_schedule: missing domains")
+			}
+			for _, domain := range r.Domains {
+				if seen[domain] {
+					return fmt.Errorf("backend: retry_schedule: duplicate domain %v", domain)
+				}
+				seen[domain] = true
+			}
+			for _, d := range r.Intervals {
+				if d <= 0 {
+					return fmt.Errorf("backend: retry_schedule: invalid interval %v", d)
+				}
+			}
+			if r.MaxAge < 0 {
+				return fmt.Errorf("backend: retry_schedule: invalid max_age %v", r.MaxAge)
+			}
+		}
+	}
+	if p := cfg.Postmaster; p != nil && p.Address == "" {
+		return fmt.Errorf("postmaster: missing address")
+	}
+	if sc := cfg.Score; sc != nil {
+		if _, err := sc.backend(nil); err != nil {
+			return err
+		}
+	}
+	if p := cfg.Policy; p != nil {
+		if p.Network != "tcp" && p.Network != "unix" {
+			return fmt.Errorf("policy: unknown network %q", p.Network)
+		}
+		if p.Address == "" {
+			return fmt.Errorf("policy: missing address")
+		}
+		for _, state := range p.States {
+			switch state {
+			case backendutil.PolicyStateMail, backendutil.PolicyStateRcpt, backendutil.PolicyStateData:
+			default:
+				return fmt.Errorf("policy: unknown state %q", state)
+			}
+		}
+	}
+	for _, d := range cfg.DKIM {
+		if d.Domain == "" || d.Selector == "" || d.Key == "" {
+			return fmt.Errorf("dkim: domain, selector and key are required")
+		}
+		if _, _, err := d.canonicalization(); err != nil {
+			return err
+		}
+	}
+	if len(cfg.DKIM) > 0 && cfg.Backend.Type != "relay" && cfg.Backend.Type != "queue" {
+		return fmt.Errorf("dkim: signing requires the relay or queue backend")
+	}
+	if cfg.ARC != nil {
+		if cfg.ARC.Domain == "" || cfg.ARC.Selector == "" || cfg.ARC.Key == "" {
+			return fmt.Errorf("arc: domain, selector and key are required")
+		}
+		if cfg.ARC.AuthServID == "" && cfg.Hostname == "" {
+			return fmt.Errorf("arc: authserv_id or hostname is required")
+		}
+		if cfg.Backend.Type != "relay" && cfg.Backend.Type != "queue" {
+			return fmt.Errorf("arc: sealing requires the relay or queue backend")
+		}
+	}
+	for _, sh := range cfg.Backend.Smarthosts {
+		if sh.Address == "" {
+			return fmt.Errorf("backend: smarthost address is required")
+		}
+		if sh.Weight < 0 {
+			return fmt.Errorf("backend: smarthost %v: invalid weight %v", sh.Address, sh.Weight)
+		}
+	}
+	if len(cfg.Backend.Smarthosts) > 0 && cfg.Backend.Smarthost != "" {
+		return fmt.Errorf("backend: smarthost and smarthosts are mutually exclusive")
+	}
+	if _, err := cfg.Backend.sources(); err != nil {
+		return err
+	}
+	if _, err := cfg.Backend.tlsPolicies(); err != nil {
+		return err
+	}
+	if len(cfg.Backend.ClientCerts) > 0 && cfg.Backend.Type != "relay" && cfg.Backend.Type != "queue" {
+		return fmt.Errorf("backend: client certificates require the relay or queue backend")
+	}
+	servers := make(map[string]bool)
+	for _, cc := range cfg.Backend.ClientCerts {
+		if cc.Cert == "" || cc.Key == "" {
+			return fmt.Errorf("backend: client certificate %q: cert and key are required", cc.Server)
+		}
+		if servers[cc.Server] {
+			return fmt.Errorf("backend: duplicate client certificate for server %q", cc.Server)
+		}
+		servers[cc.Server] = true
+	}
+	if _, err := cfg.stallPolicy(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *dkimConfig) canonicalization() (header, body dkim.Canonicalization, err error) {
+	if d.Canonicalization == "" {
+		return "", "", nil
+	}
+	parts := strings.SplitN(d.Canonicalization, "/", 2)
+	header = dkim.Canonicalization(parts[0])
+	body = dkim.CanonicalizationSimple
+	if len(parts) == 2 {
+		body = dkim.Canonicalization(parts[1])
+	}
+	for _, c := range []dkim.Canonicalization{header, body} {
+		if c != dkim.CanonicalizationSimple && c != dkim.CanonicalizationRelaxed {
+			return "", "", fmt.Errorf("dkim %v: unknown canonicalization %q", d.Domain, d.Canonicalization)
+		}
+	}
+	return header, body, nil
+}
+
+// dkimKeys loads the DKIM signing keys.
+func (cfg *config) dkimKeys() (dkim.Keys, error) {
+	if len(cfg.DKIM) == 0 {
+		return nil, nil
+	}
+	keys := make(dkim.Keys)
+	for _, d := range cfg.DKIM {
+		signer, err := loadPrivateKey(d.Key)
+		if err != nil {
+			return nil, fmt.Errorf("dkim %v: %v", d.Domain, err)
+		}
+		header, body, _ := d.canonicalization()
+		keys[d.Domain] = &dkim.SignOptions{
+			Domain:                 d.Domain,
+			Selector:               d.Selector,
+			Signer:                 signer,
+			HeaderCanonicalization: header,
+			BodyCanonicalization:   body,
+			HeaderKeys:             d.Headers,
+		}
+	}
+	return keys, nil
+}
+
+// arcOptions loads the ARC sealing options.
+func (cfg *config) arcOptions() (*dkim.SealOptions, error) {
+	if cfg.ARC == nil {
+		return nil, nil
+	}
+	signer, err := loadPrivateKey(cfg.ARC.Key)
+	if err != nil {
+		return nil, fmt.Errorf("arc: %v", err)
+	}
+	authServID := cfg.ARC.AuthServID
+	if authServID == "" {
+		authServID = cfg.Hostname
+	}
+	return &dkim.SealOptions{
+		Domain:     cfg.ARC.Domain,
+		Selector:   cfg.ARC.Selector,
+		Signer:     signer,
+		AuthServID: authServID,
+	}, nil
+}
+
+// loadPrivateKey reads a PEM-encoded PKCS #8 or PKCS #1 private key.
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%v: no PEM data found", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%v: unsupported key type %T", path, key)
+	}
+	return signer, nil
+}
+
+func (cfg *config) stallPolicy() (smtp.DataStallPolicy, error) {
+	switch cfg.DataStallPolicy {
+	case "", "wait":
+		return smtp.DataStallWait, nil
+	case "abort":
+		return smtp.DataStallAbort, nil
+	default:
+		return 0, fmt.Errorf("limits: unknown data stall policy %q", cfg.DataStallPolicy)
+	}
+}
+
+func (b *backendConfig) smarthosts() []backendutil.Smarthost {
+	var l []backendutil.Smarthost
+	for _, sh := range b.Smarthosts {
+		l = append(l, backendutil.Smarthost{Addr: sh.Address, Weight: sh.Weight})
+	}
+	return l
+}
+
+// clientCertificates loads the certificates presented by the relay and queue
+// backends.
+func (b *backendConfig) clientCertificates() (map[string]tls.Certificate, error) {
+	if len(b.ClientCerts) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]tls.Certificate)
+	for _, cc := range b.ClientCerts {
+		cert, err := tls.LoadX509KeyPair(cc.Cert, cc.Key)
+		if err != nil {
+			return nil, fmt.Errorf("backend: client certificate %q: %v", cc.Server, err)
+		}
+		m[cc.Server] = cert
+	}
+	return m, nil
+}
+
+// sources returns the outbound sources of the relay and queue backends.
+func (b *backendConfig) sources() (map[string]backendutil.OutboundSource, error) {
+	if len(b.Sources) == 0 {
+		return nil, nil
+	}
+	if b.Type != "relay" && b.Type != "queue" {
+		return nil, fmt.Errorf("backend: sources require the relay or queue backend")
+	}
+	m := make(map[string]backendutil.OutboundSource)
+	for _, src := range b.Sources {
+		if _, ok := m[src.Domain]; ok {
+			return nil, fmt.Errorf("backend: duplicate source for domain %q", src.Domain)
+		}
+		var ip net.IP
+		if src.Address != "" {
+			if ip = net.ParseIP(src.Address); ip == nil {
+				return nil, fmt.Errorf("backend: source %q: invalid address %q", src.Domain, src.Address)
+			}
+		}
+		m[src.Domain] = backendutil.OutboundSource{IP: ip, Hostname: src.Hostname}
+	}
+	return m, nil
+}
+
+// tlsPolicies returns the TLS security levels of the relay and queue backends.
+func (b *backendConfig) tlsPolicies() (map[string]backendutil.TLSLevel, error) {
+	if len(b.TLSPolicies) == 0 {
+		return nil, nil
+	}
+	if b.Type != "relay" && b.Type != "queue" {
+		return nil, fmt.Errorf("backend: TLS policies require the relay or queue backend")
+	}
+	m := make(map[string]backendutil.TLSLevel)
+	for _, p := range b.TLSPolicies {
+		if p.Destination == "" {
+			return nil, fmt.Errorf("backend: TLS policy: missing destination")
+		}
+		if _, ok := m[p.Destination]; ok {
+			return nil, fmt.Errorf("backend: duplicate TLS policy for %q", p.Destination)
+		}
+		level, err := backendutil.ParseTLSLevel(p.Level)
+		if err != nil {
+			return nil, fmt.Errorf("backend: TLS policy %q: %v", p.Destination, err)
+		}
+		if level == backendutil.TLSDANE {
+			// There is no DNSSEC-validating resolver to look up TLSA records
+			return nil, fmt.Errorf("backend: TLS policy %q: DANE is not supported", p.Destination)
+		}
+		m[p.Destination] = level
+	}
+	return m, nil
+}
+
+// startHealthCheck periodically checks the smarthosts of a relay, queue or
+// proxy backend. The returned function stops the checks.
+func (b *backendConfig) startHealthCheck(check func()) func() error {
+	if b.HealthCheck <= 0 || (len(b.Smarthosts) == 0 && b.Smarthost == "") {
+		return func() error { return nil }
+	}
+
+	ticker := time.NewTicker(b.HealthCheck)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				check()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() error {
+		ticker.Stop()
+		close(done)
+		return nil
+	}
+}
+
+// tableTimeout is the timeout of lookups in network tables.
+const tableTimeout = 10 * time.Second
+
+// newBackend creates the configured backend. The returned function must be
+// called to release its resources.
+func (cfg *config) newBackend(logger smtp.Logger) (smtp.Backend, func() error, error) {
+	b := &cfg.Backend
+	closeFunc := func() error { return nil }
+
+	dkimKeys, err := cfg.dkimKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	arcOptions, err := cfg.arcOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+	clientCerts, err := b.clientCertificates()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Tables are opened upfront and closed with the backend
+	var closers []io.Closer
+	openTable := func(spec string) (backendutil.Table, error) {
+		if spec == "" {
+			return nil, nil
+		}
+		t, err := backendutil.OpenTable(spec, tableTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := t.(io.Closer); ok {
+			closers = append(closers, c)
+		}
+		return t, nil
+	}
+	routeTable, err := openTable(b.RouteTable)
+	if err != nil {
+		return nil, nil, fmt.Errorf("backend: route_table: %v", err)
+	}
+	tlsPolicyTable, err := openTable(b.TLSPolicyTable)
+	if err != nil {
+		return nil, nil, fmt.Errorf("backend: tls_policy_table: %v", err)
+	}
+	aliases, err := openTable(b.Aliases)
+	if err != nil {
+		return nil, nil, fmt.Errorf("backend: aliases: %v", err)
+	}
+	var owners backendutil.Table
+	if cfg.Alignment != nil {
+		if owners, err = openTable(cfg.Alignment.Owners); err != nil {
+			return nil, nil, fmt.Errorf("alignment: owners: %v", err)
+		}
+	}
+	access := &backendutil.AccessBackend{}
+	for _, t := range []struct {
+		name, spec string
+		table      *backendutil.Table
+	}{
+		{"clients", cfg.Access.Clients, &access.Clients},
+		{"senders", cfg.Access.Senders, &access.Senders},
+		{"recipients", cfg.Access.Recipients, &access.Recipients},
+	} {
+		if *t.table, err = openTable(t.spec); err != nil {
+			return nil, nil, fmt.Errorf("access: %v: %v", t.name, err)
+		}
+	}
+
+	// Sources and TLS policies are checked by validate
+	sources, _ := b.sources()
+	tlsPolicies, _ := b.tlsPolicies()
+	// Relayed mail is introduced with the server host name
+	var dialer *smtp.Dialer
+	if cfg.Hostname != "" {
+		dialer = &smtp.Dialer{LocalName: cfg.Hostname}
+	}
+
+	var be smtp.Backend
+	switch b.Type {
+	case "maildir":
+		if b.Root == "" {
+			return nil, nil, fmt.Errorf("backend: maildir requires root")
+		}
+		be = &backendutil.MaildirBackend{
+			Root:           b.Root,
+			Hostname:       cfg.Hostname,
+			Auth:           cfg.auth(),
+			AllowAnonymous: cfg.AllowAnonymous,
+		}
+	case "relay":
+		relay := &backendutil.RelayBackend{
+			Smarthost:          b.Smarthost,
+			Smarthosts:         b.smarthosts(),
+			SmarthostCooldown:  b.SmarthostCooldown,
+			RouteTable:         routeTable,
+			Port:               b.Port,
+			Dialer:             dialer,
+			Sources:            sources,
+			ClientCertificates: clientCerts,
+			TLSPolicies:        tlsPolicies,
+			TLSPolicyTable:     tlsPolicyTable,
+			DKIM:               dkimKeys,
+			ARC:                arcOptions,
+			UserAuth:           cfg.auth(),
+			AllowAnonymous:     cfg.AllowAnonymous,
+		}
+		closeFunc = b.startHealthCheck(relay.CheckSmarthosts)
+		be = relay
+	case "webhook":
+		if b.URL == "" {
+			return nil, nil, fmt.Errorf("backend: webhook requires url")
+		}
+		be = &backendutil.WebhookBackend{
+			URL:            b.URL,
+			Secret:         []byte(b.Secret),
+			Auth:           cfg.auth(),
+			AllowAnonymous: cfg.AllowAnonymous,
+		}
+	case "queue":
+		if b.Dir == "" {
+			return nil, nil, fmt.Errorf("backend: queue requires dir")
+		}
+		relay := &backendutil.RelayBackend{
+			Smarthost:          b.Smarthost,
+			Smarthosts:         b.smarthosts(),
+			SmarthostCooldown:  b.SmarthostCooldown,
+			RouteTable:         routeTable,
+			Port:               b.Port,
+			Dialer:             dialer,
+			Sources:            sources,
+			ClientCertificates: clientCerts,
+			TLSPolicies:        tlsPolicies,
+			TLSPolicyTable:     tlsPolicyTable,
+			DKIM:               dkimKeys,
+			ARC:                arcOptions,
+		}
+		q, err := queue.Open(b.Dir, relay)
+		if err != nil {
+			return nil, nil, err
+		}
+		q.Hostname = cfg.Hostname
+		q.ErrorLog = logger
+		if b.DomainConcurrency > 0 {
+			q.DomainConcurrency = b.DomainConcurrency
+		}
+		q.DomainRate = b.DomainRate
+		q.DomainRateInterval = b.DomainRateInterval
+		if len(b.DomainLimits) > 0 {
+			q.DomainLimits = make(map[string]queue.DomainLimit, len(b.DomainLimits))
+			for _, l := range b.DomainLimits {
+				q.DomainLimits[l.Domain] = queue.DomainLimit{
+					Concurrency:  l.Concurrency,
+					Rate:         l.Rate,
+					RateInterval: l.RateInterval,
+				}
+			}
+		}
+		if b.MaxAge > 0 {
+			q.MaxAge = b.MaxAge
+		}
+		if len(b.RetrySchedules) > 0 {
+			// Domains sharing a schedule form a destination class
+			classes := make(map[string]string)
+			q.RetrySchedules = make(map[string]queue.RetrySchedule, len(b.RetrySchedules))
+			for i, r := range b.RetrySchedules {
+				class := fmt.Sprintf("retry_schedule[%v]", i)
+				for _, domain := range r.Domains {
+					classes[domain] = class
+				}
+				q.RetrySchedules[class] = queue.RetrySchedule{Intervals: r.Intervals, MaxAge: r.MaxAge}
+			}
+			q.DestinationClass = func(domain string) string {
+				return classes[domain]
+			}
+		}
+		q.DeadLetter = b.DeadLetter
+		var admin *http.Server
+		if b.Admin != "" {
+			ln, err := net.Listen("tcp", b.Admin)
+			if err != nil {
+				return nil, nil, fmt.Errorf("backend: admin: %v", err)
+			}
+			admin = &http.Server{Handler: &queue.Handler{Queue: q}}
+			go func() {
+				if err := admin.Serve(ln); err != http.ErrServerClosed {
+					logger.Printf("queue admin server failed: %v", err)
+				}
+			}()
+		}
+		q.Start()
+		be = &queue.Backend{
+			Queue:          q,
+			Auth:           cfg.auth(),
+			AllowAnonymous: cfg.AllowAnonymous,
+		}
+		stopHealthCheck := b.startHealthCheck(relay.CheckSmarthosts)
+		closeFunc = func() error {
+			stopHealthCheck()
+			if admin != nil {
+				admin.Close()
+			}
+			return q.Close()
+		}
+	case "proxy":
+		upstreams := b.smarthosts()
+		if len(upstreams) == 0 && b.Smarthost != "" {
+			upstreams = []backendutil.Smarthost{{Addr: b.Smarthost}}
+		}
+		if len(upstreams) == 0 {
+			return nil, nil, fmt.Errorf("backend: proxy requires smarthost or smarthosts")
+		}
+		proxy := &backendutil.ProxyBackend{
+			Upstreams: upstreams,
+			Cooldown:  b.SmarthostCooldown,
+		}
+		proxy.Auth = cfg.auth()
+		stopHealthCheck := b.startHealthCheck(proxy.CheckUpstreams)
+		closeFunc = func() error {
+			stopHealthCheck()
+			return proxy.Close()
+		}
+		be = proxy
+	case "":
+		return nil, nil, fmt.Errorf("backend: missing type")
+	default:
+		return nil, nil, fmt.Errorf("backend: unknown type %q", b.Type)
+	}
+
+	if cfg.Headers != nil {
+		p, err := cfg.Headers.pipeline()
+		if err != nil {
+			closeFunc()
+			return nil, nil, err
+		}
+		be = &backendutil.TransformBackend{Backend: be, TransformData: p.Transform}
+	}
+	if sub := cfg.Submission; sub != nil {
+		be = &backendutil.SubmissionBackend{
+			Backend:      be,
+			AddDate:      sub.AddDate,
+			AddMessageID: sub.AddMessageID,
+			AddFrom:      sub.AddFrom,
+			Hostname:     cfg.Hostname,
+		}
+	}
+	if a := cfg.Alignment; a != nil {
+		// Checked by validate
+		alignment, _ := a.headerAlignment()
+		be = &backendutil.AlignmentBackend{
+			Backend:         be,
+			Owners:          owners,
+			Exempt:          a.Exempt,
+			HeaderAlignment: alignment,
+		}
+	}
+	if cfg.Attachments != nil {
+		p, err := cfg.Attachments.policy()
+		if err != nil {
+			closeFunc()
+			return nil, nil, err
+		}
+		if cfg.MIME != nil {
+			p.MaxDepth = cfg.MIME.MaxDepth
+		}
+		be = &backendutil.TransformBackend{Backend: be, TransformData: p.Transform}
+	}
+	if cfg.MIME != nil {
+		// Messages are validated before their header is transformed
+		mv := &backendutil.MIMEValidator{MaxDepth: cfg.MIME.MaxDepth}
+		be = &backendutil.TransformBackend{Backend: be, TransformData: mv.Transform}
+	}
+
+	if aliases != nil {
+		be = &backendutil.RewriteBackend{
+			Backend:  be,
+			Rewriter: &backendutil.AliasMap{Table: aliases},
+		}
+	}
+	if access.Clients != nil || access.Senders != nil || access.Recipients != nil {
+		access.Backend = be
+		be = access
+	}
+	if len(closers) > 0 {
+		closeBackend := closeFunc
+		closeFunc = func() error {
+			for _, c := range closers {
+				c.Close()
+			}
+			return closeBackend()
+		}
+	}
+
+	if p := cfg.Policy; p != nil {
+		client := &backendutil.PolicyClient{
+			Network: p.Network,
+			Addr:    p.Address,
+			Timeout: p.Timeout,
+		}
+		be = &backendutil.PolicyBackend{
+			Backend:  be,
+			Client:   client,
+			States:   p.States,
+			FailOpen: p.FailOpen,
+		}
+		closeBackend := closeFunc
+		closeFunc = func() error {
+			client.Close()
+			return closeBackend()
+		}
+	}
+
+	if sc := cfg.Score; sc != nil {
+		score, err := sc.backend(be)
+		if err != nil {
+			closeFunc()
+			return nil, nil, err
+		}
+		be = score
+	}
+
+	if cfg.Access.DelayReject {
+		be = &backendutil.DelayRejectBackend{
+			Backend: be,
+			Report: func(r *backendutil.DelayedRejection) {
+				logger.Printf("session %v: rejected message from <%v> to %v after DATA: %v", r.State.SessionID, r.From, r.To, r.Err)
+			},
+		}
+	}
+
+	if len(cfg.Domains) == 0 {
+		return cfg.withPostmaster(cfg.withQuotas(be)), closeFunc, nil
+	}
+
+	router := &backendutil.RouterBackend{
+		Domains: make(map[string]*backendutil.Domain),
+	}
+	router.Auth = cfg.auth()
+	for _, d := range cfg.Domains {
+		domain := &backendutil.Domain{
+			Backend:         be,
+			RequireTLS:      d.RequireTLS,
+			RequireAuth:     d.RequireAuth,
+			MaxRecipients:   d.MaxRecipients,
+			MaxMessageBytes: d.MaxMessageBytes,
+			// Backends check the same users as the router
+			Login: be.Login,
+		}
+		if d.Reject {
+			domain.Backend = nil
+		}
+		if d.Name == "*" {
+			router.Default = domain
+		} else {
+			router.Domains[d.Name] = domain
+		}
+	}
+	return cfg.withPostmaster(cfg.withQuotas(router)), closeFunc, nil
+}
+
+// backend returns a backend scoring the messages passed to be.
+func (sc *scoreConfig) backend(be smtp.Backend) (*backendutil.ScoreBackend, error) {
+	score := &backendutil.ScoreBackend{
+		Backend:           be,
+		TagThreshold:      sc.Tag,
+		GreylistThreshold: sc.Greylist,
+		RejectThreshold:   sc.Reject,
+		GreylistDelay:     sc.GreylistDelay,
+		Timeout:           sc.Timeout,
+	}
+	if sc.Quarantine != "" {
+		score.Quarantine = &backendutil.DirQuarantine{Dir: sc.Quarantine}
+	}
+	for _, r := range sc.Rules {
+		rule := backendutil.ScoreRule{Name: r.Name, Weight: r.Weight}
+		switch r.Type {
+		case "dnsbl":
+			if r.Zone == "" {
+				return nil, fmt.Errorf("score: dnsbl rule requires a zone")
+			}
+			rule.Check = &backendutil.DNSBLCheck{Zone: r.Zone}
+			if rule.Name == "" {
+				rule.Name = "dnsbl:" + r.Zone
+			}
+		case "rdns":
+			rule.Check = &backendutil.ReverseDNSCheck{}
+		case "helo":
+			rule.Check = &backendutil.HeloCheck{Resolver: net.DefaultResolver}
+		case "spf":
+			rule.Check = &backendutil.SPFCheck{}
+		default:
+			return nil, fmt.Errorf("score: unknown rule type %q", r.Type)
+		}
+		if rule.Name == "" {
+			rule.Name = r.Type
+		}
+		score.Rules = append(score.Rules, rule)
+	}
+	return score, nil
+}
+
+// withPostmaster redirects mail to the postmaster and abuse addresses of the
+// accepted domains, if configured. Redirected mail isn't subject to quotas.
+func (cfg *config) withPostmaster(be smtp.Backend) smtp.Backend {
+	p := cfg.Postmaster
+	if p == nil {
+		return be
+	}
+	pm := &backendutil.PostmasterBackend{
+		Backend:    be,
+		Postmaster: p.Address,
+		Abuse:      p.Abuse,
+	}
+	for _, d := range cfg.Domains {
+		if d.Name != "*" && !d.Reject {
+			pm.Domains = append(pm.Domains, d.Name)
+		}
+	}
+	return pm
+}
+
+// auth returns a function checking credentials against the configured
+// users, or nil if there are none.
+func (cfg *config) auth() func(username, password string) error {
+	if cfg.Users == nil {
+		return nil
+	}
+	return backendutil.UserMap(cfg.Users).Auth
+}
+
+// pipeline creates the header pipeline.
+func (h *headersConfig) pipeline() (*backendutil.HeaderPipeline, error) {
+	p := &backendutil.HeaderPipeline{
+		Remove:       h.Remove,
+		MaskReceived: h.MaskReceived,
+		Disclaimer:   h.Disclaimer,
+	}
+	for _, rw := range h.Rewrite {
+		if rw.Name == "" {
+			return nil, fmt.Errorf("headers: rewrite requires a name")
+		}
+		re, err := regexp.Compile(rw.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("headers: rewrite %v: %v", rw.Name, err)
+		}
+		p.Rewrite = append(p.Rewrite, backendutil.HeaderRewrite{
+			Name:        rw.Name,
+			Pattern:     re,
+			Replacement: rw.Replacement,
+		})
+	}
+	for _, cidr := range h.InternalNetworks {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("headers: %v", err)
+		}
+		p.InternalNetworks = append(p.InternalNetworks, n)
+	}
+	// Maps are unordered, add fields in a stable order
+	names := make([]string, 0, len(h.Add))
+	for name := range h.Add {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p.Add = append(p.Add, backendutil.HeaderField{Name: name, Value: h.Add[name]})
+	}
+	return p, nil
+}
+
+// withQuotas wraps a backend to enforce the sending quotas, if any. Quotas
+// listing users replace the other quotas for these users.
+func (cfg *config) withQuotas(be smtp.Backend) smtp.Backend {
+	if len(cfg.Quotas) == 0 {
+		return be
+	}
+	quota := &backendutil.QuotaBackend{Backend: be}
+	for _, q := range cfg.Quotas {
+		limit := backendutil.QuotaLimit{
+			Window:     q.Window,
+			Messages:   q.Messages,
+			Recipients: q.Recipients,
+		}
+		if len(q.Users) == 0 {
+			quota.Limits = append(quota.Limits, limit)
+			continue
+		}
+		if quota.UserLimits == nil {
+			quota.UserLimits = make(map[string][]backendutil.QuotaLimit)
+		}
+		for _, username := range q.Users {
+			quota.UserLimits[username] = append(quota.UserLimits[username], limit)
+		}
+	}
+	return quota
+}
+
+// authPolicies returns the authentication policies of a listener, by
+// mechanism.
+func (l *listenerConfig) authPolicies() (map[string]smtp.AuthPolicy, error) {
+	policies := make(map[string]smtp.AuthPolicy)
+	for _, p := range l.AuthPolicies {
+		if p.Mechanism == "" {
+			return nil, fmt.Errorf("listener %v: auth policy requires a mechanism", l.Address)
+		}
+		policy := smtp.AuthPolicy{AllowInsecure: p.AllowInsecure}
+		for _, cidr := range p.Networks {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("listener %v: %v", l.Address, err)
+			}
+			policy.Networks = append(policy.Networks, n)
+		}
+		policies[p.Mechanism] = policy
+	}
+	return policies, nil
+}
+
+func (l *listenerConfig) vrfyMode() (smtp.VrfyMode, error) {
+	switch l.Vrfy {
+	case "", "cannot_verify":
+		return smtp.VrfyCannotVerify, nil
+	case "backend":
+		return smtp.VrfyBackend, nil
+	case "disabled":
+		return smtp.VrfyDisabled, nil
+	default:
+		return 0, fmt.Errorf("listener %v: unknown VRFY mode %q", l.Address, l.Vrfy)
+	}
+}
+
+// newServers creates a server for each listener.
+func (cfg *config) newServers(be smtp.Backend, logger smtp.Logger) ([]*smtp.Server, error) {
+	var tlsConfig *tls.Config
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	stallPolicy, err := cfg.stallPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	servers := make([]*smtp.Server, len(cfg.Listeners))
+	for i, l := range cfg.Listeners {
+		opts := []smtp.ServerOption{
+			smtp.WithAddr(l.Address),
+			smtp.WithTLS(tlsConfig),
+			smtp.WithDomain(cfg.Hostname),
+			smtp.WithMaxRecipients(cfg.MaxRecipients),
+			smtp.WithMaxSize(cfg.MaxMessageBytes),
+			smtp.WithMaxLineLength(cfg.MaxLineLength),
+			smtp.WithTimeouts(cfg.ReadTimeout, cfg.WriteTimeout),
+			smtp.WithMaxConnections(cfg.MaxConnections, cfg.ConnectionWait),
+			smtp.WithBufferSizes(cfg.ReadBuffer, cfg.WriteBuffer),
+			smtp.WithDataBuffer(cfg.DataBuffer, cfg.DataStall, stallPolicy),
+			smtp.WithRcptFailureLimit(cfg.MaxRcptFailures, cfg.RcptFailureWindow),
+			smtp.WithLogger(logger),
+			smtp.WithDisabledCommands(l.DisabledCommands...),
+		}
+		if l.Protocol == "lmtp" {
+			opts = append(opts, smtp.WithLMTP())
+		}
+		if l.RequireEHLO {
+			opts = append(opts, smtp.WithRequireESMTP())
+		}
+		if l.RejectUnauthPipelining {
+			opts = append(opts, smtp.WithRejectUnauthPipelining())
+		}
+		if l.RejectBareLF {
+			opts = append(opts, smtp.WithRejectBareLF())
+		}
+		vrfyMode, err := l.vrfyMode()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, smtp.WithVrfyMode(vrfyMode))
+		policies, err := l.authPolicies()
+		if err != nil {
+			return nil, err
+		}
+		for mechanism, policy := range policies {
+			opts = append(opts, smtp.WithAuthPolicy(mechanism, policy))
+		}
+		if cfg.AllowInsecure {
+			opts = append(opts, smtp.WithInsecureAuth())
+		}
+		if cfg.Users == nil {
+			opts = append(opts, smtp.WithAuthDisabled())
+		}
+		if cfg.Debug {
+			opts = append(opts, smtp.WithDebug(os.Stderr))
+		}
+		if cfg.Pprof != "" {
+			opts = append(opts, smtp.WithProfiling(nil))
+		}
+		servers[i] = smtp.NewServer(be, opts...)
+	}
+	return servers, nil
+}
+
+// newLogger creates the logger of the server.
+func (cfg *config) newLogger() (*log.Logger, io.Closer, error) {
+	if cfg.LogFile == "" {
+		return log.New(os.Stderr, "smtpd: ", log.LstdFlags), nil, nil
+	}
+	f, err := os.OpenFile(cfg.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, nil, err
+	}
+	return log.New(f, "smtpd: ", log.LstdFlags), f, nil
+}
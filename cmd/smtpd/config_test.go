@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+	"github.com/emersion/go-smtp/dkim"
+)
+
+func TestParseTOML(t *testing.T) {
+	const src = `
+# comment
+name = "a # b" # trailing comment
+n = 1_000
+f = 2.5
+ok = true
+list = ["x", 'y\z', 2]
+
+[a.b]
+"quoted.key" = -1
+
+[[items]]
+k = "first"
+[[items]]
+k = "second"
+`
+	got, err := parseTOML(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("parseTOML: %v", err)
+	}
+	want := table{
+		"name": "a # b",
+		"n":    int64(1000),
+		"f":    2.5,
+		"ok":   true,
+		"list": []interface{}{"x", `y\z`, int64(2)},
+		"a": table{
+			"b": table{"quoted.key": int64(-1)},
+		},
+		"items": []table{{"k": "first"}, {"k": "second"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTOML = %#v, want %#v", got, want)
+	}
+
+	for _, src := range []string{
+		"a = ",
+		"a = 1\na = 2",
+		"a = \"unterminated",
+		"a = [1, 2",
+		"[table",
+		"a = 1\n[a]",
+		"a = yes",
+	} {
+		if _, err := parseTOML(strings.NewReader(src)); err == nil {
+			t.Errorf("parseTOML(%q): expected error", src)
+		}
+	}
+}
+
+func TestParseConfig_example(t *testing.T) {
+	f, err := os.Open("smtpd.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cfg, err := parseConfig(f)
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if len(cfg.Listeners) != 2 || cfg.Listeners[0].Vrfy != "cannot_verify" || cfg.Listeners[1].Protocol != "smtps" || len(cfg.Listeners[1].DisabledCommands) != 2 || len(cfg.Listeners[1].AuthPolicies) != 1 || cfg.Listeners[0].RequireEHLO || !cfg.Listeners[0].RejectUnauthPipelining || !cfg.Listeners[0].RejectBareLF || !cfg.Listeners[1].RequireEHLO {
+		t.Errorf("unexpected listeners: %+v", cfg.Listeners)
+	}
+	if cfg.Users["alice"] != "correct horse battery staple" {
+		t.Errorf("unexpected users: %v", cfg.Users)
+	}
+	if cfg.MaxMessageBytes != 26214400 || cfg.MaxLineLength != 10000 || cfg.ReadTimeout != 5*time.Minute {
+		t.Errorf("unexpected limits: %v, %v, %v", cfg.MaxMessageBytes, cfg.MaxLineLength, cfg.ReadTimeout)
+	}
+	if cfg.MaxRcptFailures != 20 || cfg.RcptFailureWindow != 10*time.Minute {
+		t.Errorf("unexpected recipient failure limit: %v, %v", cfg.MaxRcptFailures, cfg.RcptFailureWindow)
+	}
+	if len(cfg.Domains) != 3 || !cfg.Domains[1].RequireTLS || !cfg.Domains[2].Reject {
+		t.Errorf("unexpected domains: %+v", cfg.Domains)
+	}
+	if cfg.Headers == nil || !cfg.Headers.MaskReceived || cfg.Headers.Add["X-Relayed-By"] != "mx.example.org" {
+		t.Errorf("unexpected headers: %+v", cfg.Headers)
+	}
+	if cfg.MIME == nil || cfg.MIME.MaxDepth != 10 {
+		t.Errorf("unexpected MIME validation: %+v", cfg.MIME)
+	}
+	if cfg.Attachments == nil || len(cfg.Attachments.Extensions) != 4 || cfg.Attachments.Action != "strip" {
+		t.Errorf("unexpected attachment policy: %+v", cfg.Attachments)
+	}
+	if cfg.Submission == nil || !cfg.Submission.AddDate || !cfg.Submission.AddMessageID || cfg.Submission.AddFrom {
+		t.Errorf("unexpected submission options: %+v", cfg.Submission)
+	}
+	if cfg.Alignment == nil || cfg.Alignment.Header != "relaxed" {
+		t.Errorf("unexpected alignment options: %+v", cfg.Alignment)
+	}
+	if len(cfg.Quotas) != 2 || cfg.Quotas[0].Window != time.Hour || cfg.Quotas[1].Users[0] != "alice" {
+		t.Errorf("unexpected quotas: %+v", cfg.Quotas)
+	}
+	if cfg.Backend.Aliases != "texthash:/etc/smtpd/aliases" || cfg.Access.Senders != "cdb:/etc/smtpd/sender_access.cdb" || !cfg.Access.DelayReject {
+		t.Errorf("unexpected tables: %+v, %+v", cfg.Backend, cfg.Access)
+	}
+	if sc := cfg.Score; sc == nil || sc.Greylist != 4 || sc.GreylistDelay != 5*time.Minute || len(sc.Rules) != 4 || sc.Rules[0].Zone != "zen.spamhaus.org" || sc.Rules[1].Weight != 1.5 || sc.Quarantine != "/var/spool/smtpd/quarantine" {
+		t.Errorf("unexpected score: %+v", cfg.Score)
+	}
+	if cfg.Postmaster == nil || cfg.Postmaster.Address != "ops@example.org" {
+		t.Errorf("unexpected postmaster: %+v", cfg.Postmaster)
+	}
+	if cfg.Policy == nil || cfg.Policy.Address != "127.0.0.1:10040" || cfg.Policy.Timeout != 10*time.Second || cfg.Policy.States[0] != "RCPT" {
+		t.Errorf("unexpected policy: %+v", cfg.Policy)
+	}
+}
+
+func TestParseConfig_invalid(t *testing.T) {
+	for _, src := range []string{
+		``,
+		"[[listener]]\naddress = \":25\"\nprotocol = \"pop3\"",
+		"[[listener]]\naddress = \":25\"\nunknown = 1",
+		"[[listener]]\naddress = \":25\"\n[limits]\nmax_recipients = \"many\"",
+		"[[listener]]\naddress = \":25\"\n[limits]\nread_timeout = \"soon\"",
+		"[[listener]]\naddress = \":465\"\nprotocol = \"smtps\"",
+		"[[listener]]\naddress = \":25\"\ndisabled_commands = [\"VRFY\", 1]",
+		"[[listener]]\naddress = \":25\"\nvrfy = \"always\"",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"relay\"\n[[dkim]]\ndomain = \"example.org\"\nkey = \"k.pem\"",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"relay\"\n[[dkim]]\ndomain = \"example.org\"\nselector = \"s\"\nkey = \"k.pem\"\ncanonicalization = \"loose\"",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"relay\"\n[arc]\ndomain = \"example.org\"",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"maildir\"\n[[dkim]]\ndomain = \"example.org\"\nselector = \"s\"\nkey = \"k.pem\"",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"relay\"\n[[backend.smarthosts]]\nweight = 1",
+		"[[listener]]\naddress = \":25\"\n[[quota]]\nmessages = 10",
+		"[[listener]]\naddress = \":25\"\n[[listener.auth_policy]]\nallow_insecure = true",
+		"[[listener]]\naddress = \":25\"\n[[listener.auth_policy]]\nmechanism = \"PLAIN\"\nnetworks = [\"lan\"]",
+		"[[listener]]\naddress = \":25\"\n[headers]\ninternal_networks = [\"10.0.0.1\"]",
+		"[[listener]]\naddress = \":25\"\n[mime]\nmax_depth = -1",
+		"[[listener]]\naddress = \":25\"\n[attachments]\naction = \"quarantine\"",
+		"[[listener]]\naddress = \":25\"\n[alignment]\nheader = \"loose\"",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"relay\"\ndomain_rate = 10",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"maildir\"\nroot = \"/tmp\"\ndead_letter = true",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"relay\"\nadmin = \"127.0.0.1:8026\"",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"queue\"\ndir = \"/tmp\"\n[[backend.retry_schedule]]\nintervals = [\"1m\"]",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"queue\"\ndir = \"/tmp\"\n[[backend.retry_schedule]]\ndomains = [\"a.example\"]\nintervals = [\"soon\"]",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"queue\"\ndir = \"/tmp\"\n[[backend.domain_limit]]\nrate = 10",
+		"[[listener]]\naddress = \":25\"\n[alignment]\nexempt = [\"mallory\"]",
+		"[[listener]]\naddress = \":25\"\n[[headers.rewrite]]\nname = \"Subject\"\npattern = \"(\"",
+		"[[listener]]\naddress = \":25\"\n[[quota]]\nwindow = \"1h\"\nmessages = 10\nusers = [\"mallory\"]",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"relay\"\nsmarthost = \"a:25\"\n[[backend.smarthosts]]\naddress = \"b:25\"",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"maildir\"\nroute_table = \"static:mx.example.org:25\"",
+		"[[listener]]\naddress = \":25\"\n[access]\nhelo = \"static:OK\"",
+		"[[listener]]\naddress = \":25\"\n[policy]\ntimeout = \"10s\"",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"relay\"\n[[backend.source]]\ndomain = \"example.org\"\naddress = \"mta\"",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"maildir\"\nroot = \"/var/mail\"\n[[backend.source]]\nhostname = \"mta.example.org\"",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"maildir\"\nroot = \"/var/mail\"\n[[backend.client_cert]]\ncert = \"c.pem\"\nkey = \"k.pem\"",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"relay\"\n[[backend.client_cert]]\nserver = \"mx.example.org\"\ncert = \"c.pem\"",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"relay\"\n[[backend.tls_policy]]\ndestination = \"example.org\"\nlevel = \"secure\"",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"relay\"\n[[backend.tls_policy]]\nlevel = \"verify\"",
+		"[[listener]]\naddress = \":25\"\n[backend]\ntype = \"maildir\"\nroot = \"/var/mail\"\ntls_policy_table = \"static:verify\"",
+		"[[listener]]\naddress = \":25\"\n[score]\nreject = \"high\"",
+		"[[listener]]\naddress = \":25\"\n[[score.rule]]\ntype = \"dnsbl\"\nweight = 5",
+		"[[listener]]\naddress = \":25\"\n[[score.rule]]\ntype = \"bayes\"\nweight = 1",
+		"[[listener]]\naddress = \":25\"\n[postmaster]\nabuse = \"abuse@example.org\"",
+		"[[listener]]\naddress = \":25\"\n[policy]\nnetwork = \"udp\"\naddress = \"127.0.0.1:10040\"",
+		"[[listener]]\naddress = \":25\"\n[policy]\naddress = \"127.0.0.1:10040\"\nstates = [\"HELO\"]",
+	} {
+		if _, err := parseConfig(strings.NewReader(src)); err == nil {
+			t.Errorf("parseConfig(%q): expected error", src)
+		}
+	}
+}
+
+func TestConfig_dkimKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp-smtpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "example.org.pem")
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	src := "[[listener]]\naddress = \":25\"\n[backend]\ntype = \"relay\"\n" +
+		"[[dkim]]\ndomain = \"Example.org\"\nselector = \"mail\"\nkey = \"" + keyPath + "\"\ncanonicalization = \"relaxed\"\n"
+	cfg, err := parseConfig(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	keys, err := cfg.dkimKeys()
+	if err != nil {
+		t.Fatalf("dkimKeys: %v", err)
+	}
+	options := keys.ForAddress("alice@example.org")
+	if options == nil || options.Selector != "mail" || options.HeaderCanonicalization != dkim.CanonicalizationRelaxed || options.BodyCanonicalization != dkim.CanonicalizationSimple {
+		t.Errorf("unexpected DKIM options: %+v", options)
+	}
+}
+
+func TestParseConfig_smarthosts(t *testing.T) {
+	src := "[[listener]]\naddress = \":25\"\n[backend]\ntype = \"queue\"\ndir = \"/var/spool/smtpd\"\nhealth_check = \"1m\"\n" +
+		"[[backend.smarthosts]]\naddress = \"relay1.example.net:25\"\nweight = 2\n" +
+		"[[backend.smarthosts]]\naddress = \"relay2.example.net:25\"\n"
+	cfg, err := parseConfig(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	hosts := cfg.Backend.smarthosts()
+	if len(hosts) != 2 || hosts[0].Addr != "relay1.example.net:25" || hosts[0].Weight != 2 || hosts[1].Weight != 0 {
+		t.Errorf("unexpected smarthosts: %+v", hosts)
+	}
+	if cfg.Backend.HealthCheck != time.Minute {
+		t.Errorf("unexpected health check interval: %v", cfg.Backend.HealthCheck)
+	}
+}
+
+func TestParseConfig_queue(t *testing.T) {
+	src := "[[listener]]\naddress = \":25\"\n[backend]\ntype = \"queue\"\ndir = \"/var/spool/smtpd\"\ndomain_rate = 60\n" +
+		"[[backend.domain_limit]]\ndomain = \"Gmail.com\"\nconcurrency = 5\nrate_interval = \"10s\"\n" +
+		"[[backend.retry_schedule]]\ndomains = [\"Partner.example\"]\nintervals = [\"1m\", \"5m\"]\nmax_age = \"24h\"\n"
+	cfg, err := parseConfig(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if cfg.Backend.DomainRate != 60 {
+		t.Errorf("unexpected domain rate: %v", cfg.Backend.DomainRate)
+	}
+	limits := cfg.Backend.DomainLimits
+	if len(limits) != 1 || limits[0].Domain != "gmail.com" || limits[0].Concurrency != 5 || limits[0].RateInterval != 10*time.Second {
+		t.Errorf("unexpected domain limits: %+v", limits)
+	}
+	schedules := cfg.Backend.RetrySchedules
+	if len(schedules) != 1 || schedules[0].Domains[0] != "partner.example" || len(schedules[0].Intervals) != 2 || schedules[0].Intervals[1] != 5*time.Minute || schedules[0].MaxAge != 24*time.Hour {
+		t.Errorf("unexpected retry schedules: %+v", schedules)
+	}
+}
+
+func TestParseConfig_sources(t *testing.T) {
+	src := "[[listener]]\naddress = \":25\"\n[backend]\ntype = \"relay\"\n" +
+		"[[backend.source]]\ndomain = \"Brand.example\"\naddress = \"192.0.2.25\"\nhostname = \"mta.brand.example\"\n" +
+		"[[backend.source]]\nhostname = \"mta.example.org\"\n"
+	cfg, err := parseConfig(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	sources, err := cfg.Backend.sources()
+	if err != nil {
+		t.Fatalf("sources: %v", err)
+	}
+	brand := sources["brand.example"]
+	if len(sources) != 2 || !brand.IP.Equal(net.IPv4(192, 0, 2, 25)) || brand.Hostname != "mta.brand.example" || sources[""].Hostname != "mta.example.org" {
+		t.Errorf("unexpected sources: %+v", sources)
+	}
+}
+
+func TestConfig_proxy(t *testing.T) {
+	src := "[[listener]]\naddress = \":25\"\n[backend]\ntype = \"proxy\"\nsmarthost = \"mx.example.net:25\"\n"
+	cfg, err := parseConfig(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	be, closeBackend, err := cfg.newBackend(nil)
+	if err != nil {
+		t.Fatalf("newBackend: %v", err)
+	}
+	defer closeBackend()
+	proxy, ok := be.(*backendutil.ProxyBackend)
+	if !ok || len(proxy.Upstreams) != 1 || proxy.Upstreams[0].Addr != "mx.example.net:25" {
+		t.Errorf("unexpected backend: %+v", be)
+	}
+
+	cfg.Backend.Smarthost = ""
+	if _, _, err := cfg.newBackend(nil); err == nil {
+		t.Error("newBackend: expected an error without smarthosts")
+	}
+}
+
+func TestConfig_serve(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-smtp-smtpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, rcpt := range []string{"bob@example.org", "carol@example.net"} {
+		for _, sub := range []string{"tmp", "new", "cur"} {
+			if err := os.MkdirAll(filepath.Join(root, rcpt, sub), 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	src := `
+hostname = "mx.example.org"
+
+[[listener]]
+address = "127.0.0.1:0"
+
+[auth]
+allow_anonymous = true
+
+[backend]
+type = "maildir"
+root = "` + root + `"
+
+[[domain]]
+name = "example.org"
+`
+	cfg, err := parseConfig(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	logger, _, err := cfg.newLogger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	be, closeBackend, err := cfg.newBackend(logger)
+	if err != nil {
+		t.Fatalf("newBackend: %v", err)
+	}
+	defer closeBackend()
+	servers, err := cfg.newServers(be, logger)
+	if err != nil {
+		t.Fatalf("newServers: %v", err)
+	}
+
+	l, err := net.Listen("tcp", cfg.Listeners[0].Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := servers[0]
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	if err := c.Mail("alice@example.com"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := c.Rcpt("carol@example.net"); err == nil {
+		t.Error("Rcpt: expected error for unhosted domain")
+	}
+	if err := c.Rcpt("bob@example.org"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	if _, err := w.Write([]byte("Subject: Hi\r\n\r\nHello!\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatalf("Quit: %v", err)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(root, "bob@example.org", "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected 1 delivered message, got %v", len(entries))
+	}
+}
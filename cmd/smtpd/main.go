@@ -0,0 +1,97 @@
+// Command smtpd is an SMTP server configured by a file.
+//
+// The configuration file uses a subset of TOML: tables, arrays of tables and
+// single-line values. See smtpd.toml for an example.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/emersion/go-smtp"
+)
+
+func main() {
+	configPath := flag.String("config", "/etc/smtpd.toml", "configuration file")
+	flag.Parse()
+
+	f, err := os.Open(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg, err := parseConfig(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("failed to parse %v: %v", *configPath, err)
+	}
+
+	logger, logFile, err := cfg.newLogger()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if logFile != nil {
+		defer logFile.Close()
+	}
+
+	be, closeBackend, err := cfg.newBackend(logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	servers, err := cfg.newServers(be, logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	if cfg.Pprof != "" {
+		go func() {
+			logger.Printf("pprof server failed: %v", http.ListenAndServe(cfg.Pprof, nil))
+		}()
+	}
+
+	errCh := make(chan error, len(servers))
+	for i, s := range servers {
+		l := cfg.Listeners[i]
+		ln, err := listen(s, l.Protocol)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("listening on %v (%v)", l.Address, l.Protocol)
+		go func(s *smtp.Server) {
+			errCh <- s.Serve(ln)
+		}(s)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-sigCh:
+		logger.Printf("received %v, shutting down", sig)
+	case err := <-errCh:
+		logger.Printf("server failed: %v", err)
+	}
+
+	for _, s := range servers {
+		s.Close()
+	}
+	if err := closeBackend(); err != nil {
+		logger.Printf("failed to close backend: %v", err)
+	}
+}
+
+func listen(s *smtp.Server, protocol string) (net.Listener, error) {
+	switch protocol {
+	case "smtps":
+		return tls.Listen("tcp", s.Addr, s.TLSConfig)
+	case "lmtp":
+		return net.Listen("unix", s.Addr)
+	default:
+		return net.Listen("tcp", s.Addr)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// table is a parsed TOML table. Values are strings, int64s, float64s, bools,
+// []table or []interface{}.
+type table map[string]interface{}
+
+// parseTOML parses the subset of TOML used by configuration files: tables,
+// arrays of tables, and single-line key/value pairs with string, integer,
+// float, boolean and array values.
+func parseTOML(r io.Reader) (table, error) {
+	root := make(table)
+	cur := root
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		var err error
+		switch {
+		case strings.HasPrefix(line, "[["):
+			if !strings.HasSuffix(line, "]]") {
+				err = fmt.Errorf("missing closing brackets")
+				break
+			}
+			var parts []string
+			if parts, err = splitKey(strings.TrimSpace(line[2 : len(line)-2])); err == nil {
+				cur, err = root.appendTable(parts)
+			}
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") {
+				err = fmt.Errorf("missing closing bracket")
+				break
+			}
+			var parts []string
+			if parts, err = splitKey(strings.TrimSpace(line[1 : len(line)-1])); err == nil {
+				cur, err = root.table(parts)
+			}
+		default:
+			err = cur.parseKeyValue(line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", lineno, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// stripComment removes a trailing comment, ignoring '#' characters in strings.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// splitKey splits a dotted key into its parts.
+func splitKey(key string) ([]string, error) {
+	var parts []string
+	for key != "" {
+		var part string
+		if key[0] == '"' || key[0] == '\'' {
+			v, rest, err := parseString(key)
+			if err != nil {
+				return nil, err
+			}
+			part, key = v, strings.TrimSpace(rest)
+		} else {
+			i := strings.IndexByte(key, '.')
+			if i < 0 {
+				i = len(key)
+			}
+			part, key = strings.TrimSpace(key[:i]), key[i:]
+			if part == "" {
+				return nil, fmt.Errorf("empty key")
+			}
+		}
+		parts = append(parts, part)
+		if key != "" {
+			if key[0] != '.' {
+				return nil, fmt.Errorf("invalid key")
+			}
+			key = strings.TrimSpace(key[1:])
+		}
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("empty key")
+	}
+	return parts, nil
+}
+
+// table returns the table at the path parts, creating it if necessary.
+func (t table) table(parts []string) (table, error) {
+	for _, part := range parts {
+		switch v := t[part].(type) {
+		case nil:
+			child := make(table)
+			t[part] = child
+			t = child
+		case table:
+			t = v
+		case []table:
+			t = v[len(v)-1]
+		default:
+			return nil, fmt.Errorf("key %q is not a table", part)
+		}
+	}
+	return t, nil
+}
+
+// appendTable appends a new table to the array of tables at the path parts.
+func (t table) appendTable(parts []string) (table, error) {
+	parent, err := t.table(parts[:len(parts)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	name := parts[len(parts)-1]
+	child := make(table)
+	switch v := parent[name].(type) {
+	case nil:
+		parent[name] = []table{child}
+	case []table:
+		parent[name] = append(v, child)
+	default:
+		return nil, fmt.Errorf("key %q is not an array of tables", name)
+	}
+	return child, nil
+}
+
+func (t table) parseKeyValue(line string) error {
+	i := strings.IndexByte(line, '=')
+	if i < 0 {
+		return fmt.Errorf("expected key = value")
+	}
+	parts, err := splitKey(strings.TrimSpace(line[:i]))
+	if err != nil {
+		return err
+	}
+	v, rest, err := parseValue(strings.TrimSpace(line[i+1:]))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return fmt.Errorf("unexpected %q after value", rest)
+	}
+
+	if t, err = t.table(parts[:len(parts)-1]); err != nil {
+		return err
+	}
+	name := parts[len(parts)-1]
+	if _, ok := t[name]; ok {
+		return fmt.Errorf("duplicate key %q", name)
+	}
+	t[name] = v
+	return nil
+}
+
+func parseValue(s string) (v interface{}, rest string, err error) {
+	if s == "" {
+		return nil, "", fmt.Errorf("missing value")
+	}
+	switch s[0] {
+	case '"', '\'':
+		return parseString(s)
+	case '[':
+		return parseArray(s)
+	}
+
+	i := strings.IndexAny(s, ",] \t")
+	if i < 0 {
+		i = len(s)
+	}
+	word, rest := s[:i], s[i:]
+	switch word {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+	word = strings.Replace(word, "_", "", -1)
+	if n, err := strconv.ParseInt(word, 0, 64); err == nil {
+		return n, rest, nil
+	}
+	if f, err := strconv.ParseFloat(word, 64); err == nil && strings.ContainsAny(word, ".eE") {
+		return f, rest, nil
+	}
+	return nil, "", fmt.Errorf("invalid value %q", word)
+}
+
+func parseString(s string) (v string, rest string, err error) {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quote == '"' {
+				i++
+			}
+		case quote:
+			if quote == '\'' {
+				return s[1:i], s[i+1:], nil
+			}
+			v, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("invalid string %v", s[:i+1])
+			}
+			return v, s[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+func parseArray(s string) (v []interface{}, rest string, err error) {
+	s = strings.TrimSpace(s[1:])
+	v = []interface{}{}
+	for {
+		if strings.HasPrefix(s, "]") {
+			return v, s[1:], nil
+		}
+		var item interface{}
+		item, s, err = parseValue(s)
+		if err != nil {
+			return nil, "", err
+		}
+		v = append(v, item)
+
+		s = strings.TrimSpace(s)
+		if strings.HasPrefix(s, ",") {
+			s = strings.TrimSpace(s[1:])
+		} else if !strings.HasPrefix(s, "]") {
+			return nil, "", fmt.Errorf("expected ',' or ']' in array")
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+type options struct {
+	Addr string
+	// The number of concurrent connections.
+	Concurrency int
+	// The total number of messages to send. Zero means no limit.
+	Messages int
+	// The maximum duration of the run. Zero means no limit.
+	Duration time.Duration
+	// The number of messages sent per connection before reconnecting. Zero
+	// means connections are kept open.
+	PerConnection int
+
+	// The approximate size of each message, in bytes.
+	Size       int
+	Recipients int
+	From       string
+	// Recipients are generated by replacing "%d" with their index.
+	To string
+
+	StartTLS           bool
+	InsecureSkipVerify bool
+	Username           string
+	Password           string
+}
+
+type result struct {
+	Messages  int64
+	Errors    int64
+	Bytes     int64
+	Elapsed   time.Duration
+	Latencies []time.Duration
+
+	// FirstError is the first error encountered, if any.
+	FirstError error
+}
+
+// message generates a message of approximately size bytes.
+func message(size int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("From: smtpload <load@example.org>\r\n")
+	buf.WriteString("Subject: Load test\r\n")
+	buf.WriteString("\r\n")
+	line := strings.Repeat("x", 76) + "\r\n"
+	for buf.Len() < size {
+		buf.WriteString(line)
+	}
+	return buf.Bytes()
+}
+
+// run sends messages with opts.Concurrency workers until the message count or
+// the duration is reached.
+func run(opts *options) *result {
+	body := message(opts.Size)
+	to := make([]string, opts.Recipients)
+	for i := range to {
+		to[i] = strings.Replace(opts.To, "%d", fmt.Sprint(i), -1)
+	}
+
+	var (
+		remaining = int64(opts.Messages)
+		deadline  time.Time
+		mu        sync.Mutex
+		res       result
+		wg        sync.WaitGroup
+	)
+	if opts.Duration > 0 {
+		deadline = time.Now().Add(opts.Duration)
+	}
+	next := func() bool {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return false
+		}
+		return opts.Messages <= 0 || atomic.AddInt64(&remaining, -1) >= 0
+	}
+	record := func(latency time.Duration, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			res.Errors++
+			if res.FirstError == nil {
+				res.FirstError = err
+			}
+			return
+		}
+		res.Messages++
+		res.Bytes += int64(len(body))
+		res.Latencies = append(res.Latencies, latency)
+	}
+
+	start := time.Now()
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := worker{opts: opts, body: body, to: to}
+			defer w.close()
+			for next() {
+				t := time.Now()
+				err := w.send()
+				record(time.Since(t), err)
+			}
+		}()
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+
+	sort.Slice(res.Latencies, func(i, j int) bool {
+		return res.Latencies[i] < res.Latencies[j]
+	})
+	return &res
+}
+
+// worker sends messages over a connection, reconnecting when needed.
+type worker struct {
+	opts *options
+	body []byte
+	to   []string
+
+	c    *smtp.Client
+	sent int
+}
+
+func (w *worker) connect() error {
+	c, err := smtp.Dial(w.opts.Addr)
+	if err != nil {
+		return err
+	}
+	if w.opts.StartTLS {
+		host, _, _ := net.SplitHostPort(w.opts.Addr)
+		tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: w.opts.InsecureSkipVerify}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return err
+		}
+	}
+	if w.opts.Username != "" {
+		if err := c.Auth(sasl.NewPlainClient("", w.opts.Username, w.opts.Password)); err != nil {
+			c.Close()
+			return err
+		}
+	}
+	w.c = c
+	w.sent = 0
+	return nil
+}
+
+func (w *worker) send() error {
+	if w.c != nil && w.opts.PerConnection > 0 && w.sent >= w.opts.PerConnection {
+		w.close()
+	}
+	if w.c == nil {
+		if err := w.connect(); err != nil {
+			return err
+		}
+	}
+
+	err := w.transaction()
+	if err != nil {
+		// Start over with a new connection, the state of this one is unknown
+		w.c.Close()
+		w.c = nil
+		return err
+	}
+	w.sent++
+	return nil
+}
+
+func (w *worker) transaction() error {
+	if err := w.c.Mail(w.opts.From); err != nil {
+		return err
+	}
+	for _, rcpt := range w.to {
+		if err := w.c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	wc, err := w.c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(w.body); err != nil {
+		return err
+	}
+	return wc.Close()
+}
+
+func (w *worker) close() {
+	if w.c != nil {
+		w.c.Quit()
+		w.c = nil
+	}
+}
+
+func percentile(l []time.Duration, p float64) time.Duration {
+	if len(l) == 0 {
+		return 0
+	}
+	i := int(float64(len(l)-1) * p)
+	return l[i]
+}
+
+// WriteTo writes a human-readable report.
+func (res *result) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	secs := res.Elapsed.Seconds()
+	fmt.Fprintf(&buf, "messages:   %v sent, %v failed in %v\n", res.Messages, res.Errors, res.Elapsed.Round(time.Millisecond))
+	if secs > 0 {
+		fmt.Fprintf(&buf, "throughput: %.1f messages/s, %.2f MB/s\n", float64(res.Messages)/secs, float64(res.Bytes)/secs/1e6)
+	}
+	fmt.Fprintf(&buf, "latency:    p50 %v, p90 %v, p99 %v, max %v\n",
+		percentile(res.Latencies, 0.5).Round(time.Microsecond),
+		percentile(res.Latencies, 0.9).Round(time.Microsecond),
+		percentile(res.Latencies, 0.99).Round(time.Microsecond),
+		percentile(res.Latencies, 1).Round(time.Microsecond))
+	if res.FirstError != nil {
+		fmt.Fprintf(&buf, "first error: %v\n", res.FirstError)
+	}
+	return buf.WriteTo(w)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp/smtptest"
+)
+
+func TestRun(t *testing.T) {
+	s := smtptest.NewServer()
+	defer s.Close()
+
+	res := run(&options{
+		Addr:          s.Addr,
+		Concurrency:   4,
+		Messages:      20,
+		PerConnection: 3,
+		Size:          2048,
+		Recipients:    2,
+		From:          "load@example.org",
+		To:            "rcpt%d@example.org",
+	})
+	if res.FirstError != nil {
+		t.Fatalf("run: %v", res.FirstError)
+	}
+	if res.Messages != 20 || res.Errors != 0 || len(res.Latencies) != 20 {
+		t.Errorf("unexpected result: %v messages, %v errors", res.Messages, res.Errors)
+	}
+
+	msgs := s.ExpectMessages(t, 20)
+	if to := msgs[0].To; len(to) != 2 || to[1] != "rcpt1@example.org" {
+		t.Errorf("unexpected recipients: %v", to)
+	}
+	if n := len(msgs[0].Data); n < 2048 {
+		t.Errorf("message is too small: %v bytes", n)
+	}
+
+	var sb strings.Builder
+	res.WriteTo(&sb)
+	if !strings.Contains(sb.String(), "20 sent, 0 failed") {
+		t.Errorf("unexpected report:\n%v", sb.String())
+	}
+}
+
+func TestRun_duration(t *testing.T) {
+	s := smtptest.NewServer()
+	defer s.Close()
+
+	res := run(&options{
+		Addr:        s.Addr,
+		Concurrency: 2,
+		Duration:    50 * time.Millisecond,
+		Size:        100,
+		Recipients:  1,
+		From:        "load@example.org",
+		To:          "rcpt@example.org",
+	})
+	if res.FirstError != nil {
+		t.Fatalf("run: %v", res.FirstError)
+	}
+	if res.Messages == 0 {
+		t.Error("no message sent")
+	}
+}
@@ -0,0 +1,42 @@
+// Command smtpload is a load generator for SMTP servers.
+//
+// It sends messages over concurrent connections and reports the throughput
+// and latency percentiles, to evaluate the performance of a server.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+)
+
+func main() {
+	opts := &options{}
+	flag.StringVar(&opts.Addr, "addr", "localhost:25", "server address")
+	flag.IntVar(&opts.Concurrency, "c", 10, "number of concurrent connections")
+	flag.IntVar(&opts.Messages, "n", 1000, "number of messages to send, 0 for no limit")
+	flag.DurationVar(&opts.Duration, "d", 0, "maximum duration, 0 for no limit")
+	flag.IntVar(&opts.PerConnection, "per-conn", 0, "messages per connection before reconnecting, 0 to keep connections open")
+	flag.IntVar(&opts.Size, "size", 1024, "message size in bytes")
+	flag.IntVar(&opts.Recipients, "rcpts", 1, "number of recipients per message")
+	flag.StringVar(&opts.From, "from", "load@example.org", "envelope sender")
+	flag.StringVar(&opts.To, "to", "rcpt%d@example.org", "envelope recipient, %d is replaced with the recipient index")
+	flag.BoolVar(&opts.StartTLS, "starttls", false, "use STARTTLS")
+	flag.BoolVar(&opts.InsecureSkipVerify, "insecure", false, "don't verify the server certificate")
+	flag.StringVar(&opts.Username, "user", "", "username for AUTH PLAIN")
+	flag.StringVar(&opts.Password, "password", "", "password for AUTH PLAIN")
+	flag.Parse()
+
+	if opts.Concurrency <= 0 || opts.Recipients <= 0 {
+		log.Fatal("-c and -rcpts must be positive")
+	}
+	if opts.Messages <= 0 && opts.Duration <= 0 {
+		log.Fatal("one of -n or -d must be set")
+	}
+
+	res := run(opts)
+	res.WriteTo(os.Stdout)
+	if res.Messages == 0 {
+		os.Exit(1)
+	}
+}
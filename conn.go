@@ -1,44 +1,81 @@
 package smtp
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/textproto"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-	"log"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/emersion/go-smtp/parse"
 )
 
 type ConnectionState struct {
 	Hostname   string
 	RemoteAddr net.Addr
 	TLS        tls.ConnectionState
+	// SessionID is a random identifier, unique to the connection.
+	SessionID string
 }
 
+// Conn is a connection to a SMTP client.
+//
+// The connection state is owned by the goroutine handling the connection,
+// except for the session which can be accessed concurrently.
 type Conn struct {
+	id        string
 	conn      net.Conn
 	text      *textproto.Conn
+	br        *bufio.Reader
+	bw        *bufio.Writer
+	respBuf   []byte
 	server    *Server
 	helo      string
+	esmtp     bool // Set if the client greeted with EHLO or LHLO
 	nbrErrors int
-	session   Session
-	locker    sync.Mutex
+	session   atomic.Value // sessionHolder
+
+	// Set if profiling labels are enabled
+	profileCtx context.Context
+
+	tx *Transaction // Transaction in progress, nil if none
+
+	rcptFailures []time.Time // Times of rejected recipients, if limited
 
-	fromReceived bool
-	recipients   []string
+	greetingDelay time.Duration // Delay before the greeting, set by LoadHook
+
+	summary    SessionSummary
+	finishOnce sync.Once
+	replyCode  int   // Code of the last reply
+	dataBytes  int64 // Bytes read by the current data reader
+}
+
+// sessionHolder wraps a Session, so that sessions of different types and nil
+// can be stored in an atomic.Value.
+type sessionHolder struct {
+	Session
 }
 
 func newConn(c net.Conn, s *Server) *Conn {
+	id := newID()
 	sc := &Conn{
-		server: s,
-		conn:   c,
+		id:      id,
+		server:  s,
+		conn:    c,
+		summary: SessionSummary{SessionID: id, Start: time.Now()},
 	}
 
 	sc.init()
@@ -59,7 +96,78 @@ func (c *Conn) init() {
 		}
 	}
 
-	c.text = textproto.NewConn(rwc)
+	// The buffers are pooled, since each connection would otherwise allocate
+	// its own. The textproto.Conn is only used for reading and writing, it
+	// must not be closed.
+	c.releaseBuffers()
+	c.br = newBufioReader(rwc, c.server.ReadBufferSize)
+	c.bw = newBufioWriter(rwc, c.server.WriteBufferSize)
+	c.text = &textproto.Conn{
+		Reader: *textproto.NewReader(c.br),
+		Writer: *textproto.NewWriter(c.bw),
+	}
+}
+
+const (
+	// defaultBufferSize is the size of connection buffers if not configured.
+	defaultBufferSize = 4096
+	// minReadBufferSize is the smallest size supported by bufio.Reader.
+	minReadBufferSize = 16
+)
+
+// Buffer pools, by buffer size
+var (
+	bufioReaderPools sync.Map // int -> *sync.Pool
+	bufioWriterPools sync.Map // int -> *sync.Pool
+)
+
+func bufioPool(pools *sync.Map, size int) *sync.Pool {
+	if v, ok := pools.Load(size); ok {
+		return v.(*sync.Pool)
+	}
+	v, _ := pools.LoadOrStore(size, new(sync.Pool))
+	return v.(*sync.Pool)
+}
+
+func newBufioReader(r io.Reader, size int) *bufio.Reader {
+	if size <= 0 {
+		size = defaultBufferSize
+	} else if size < minReadBufferSize {
+		size = minReadBufferSize
+	}
+	if v := bufioPool(&bufioReaderPools, size).Get(); v != nil {
+		br := v.(*bufio.Reader)
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, size)
+}
+
+func newBufioWriter(w io.Writer, size int) *bufio.Writer {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	if v := bufioPool(&bufioWriterPools, size).Get(); v != nil {
+		bw := v.(*bufio.Writer)
+		bw.Reset(w)
+		return bw
+	}
+	return bufio.NewWriterSize(w, size)
+}
+
+// releaseBuffers returns the connection buffers to the pools. Data buffered
+// but not read yet is discarded.
+func (c *Conn) releaseBuffers() {
+	if c.br != nil {
+		c.br.Reset(nil)
+		bufioPool(&bufioReaderPools, c.br.Size()).Put(c.br)
+		c.br = nil
+	}
+	if c.bw != nil {
+		c.bw.Reset(nil)
+		bufioPool(&bufioWriterPools, c.bw.Size()).Put(c.bw)
+		c.bw = nil
+	}
 }
 
 func (c *Conn) unrecognizedCommand(cmd string) {
@@ -82,7 +190,7 @@ func (c *Conn) handle(cmd string, arg string) {
 			c.Close()
 
 			stack := debug.Stack()
-			c.server.ErrorLog.Printf("panic serving %v: %v\n%s", c.State().RemoteAddr, err, stack)
+			c.server.ErrorLog.Printf("panic serving %v (session %v): %v\n%s", c.State().RemoteAddr, c.id, err, stack)
 		}
 	}()
 
@@ -91,6 +199,15 @@ func (c *Conn) handle(cmd string, arg string) {
 		return
 	}
 	cmd = strings.ToUpper(cmd)
+	if !c.server.commandEnabled(cmd) {
+		c.WriteResponse(502, EnhancedCode{5, 5, 1}, fmt.Sprintf("%v command not implemented", cmd))
+		return
+	}
+	if c.server.RejectUnauthPipelining && c.unauthPipelining(cmd) {
+		c.WriteResponse(554, EnhancedCode{5, 5, 0}, "Improper use of SMTP command pipelining")
+		c.Close()
+		return
+	}
 	switch cmd {
 	case "SEND", "SOML", "SAML", "EXPN", "HELP", "TURN":
 		// These commands are not implemented in any state
@@ -107,29 +224,73 @@ func (c *Conn) handle(cmd string, arg string) {
 		c.handleGreet(enhanced, arg)
 	case "MAIL":
 		c.handleMail(arg)
+		if c.replyCode >= 400 {
+			c.summary.RejectedMail++
+			c.server.counters.update(func(stats *Stats) {
+				stats.RejectedMail++
+			})
+		}
 	case "RCPT":
 		c.handleRcpt(arg)
+		if c.replyCode >= 400 {
+			c.summary.RejectedRcpt++
+			c.server.counters.update(func(stats *Stats) {
+				stats.RejectedRcpt++
+			})
+		}
+		if c.replyCode >= 500 {
+			c.rcptFailed()
+		}
 	case "VRFY":
-		c.WriteResponse(252, EnhancedCode{2, 5, 0}, "Cannot VRFY user, but will accept message")
+		c.handleVrfy(arg)
 	case "NOOP":
+		if c.server.CommandHook != nil && c.server.CommandHook(c, cmd, arg) {
+			return
+		}
 		c.WriteResponse(250, EnhancedCode{2, 0, 0}, "I have sucessfully done nothing")
 	case "RSET": // Reset session
-		c.reset()
+		if err := c.abortReset(AbortReset); err != nil {
+			c.WriteResponse(resetReply(err))
+			return
+		}
 		c.WriteResponse(250, EnhancedCode{2, 0, 0}, "Session reset")
 	case "DATA":
-		c.handleData(arg)
+		messages := c.summary.Messages
+		err := c.handleData(arg)
+		if c.summary.Messages == messages {
+			c.summary.RejectedData++
+			c.server.counters.update(func(stats *Stats) {
+				stats.RejectedData++
+			})
+		}
+		if err != nil {
+			// The rest of the message would be parsed as commands
+			c.Close()
+		}
 	case "QUIT":
 		c.WriteResponse(221, EnhancedCode{2, 0, 0}, "Goodnight and good luck")
+		c.summary.Quit = true
 		c.Close()
 	case "AUTH":
 		if c.server.AuthDisabled {
 			c.unrecognizedCommand(cmd)
 		} else {
 			c.handleAuth(arg)
+			succeeded := c.replyCode == 235
+			c.server.counters.update(func(stats *Stats) {
+				if succeeded {
+					stats.AuthSuccesses++
+				} else {
+					stats.AuthFailures++
+				}
+			})
 		}
 	case "STARTTLS":
 		c.handleStartTLS()
 	default:
+		if c.server.CommandHook != nil && c.server.CommandHook(c, cmd, arg) {
+			return
+		}
 		c.unrecognizedCommand(cmd)
 	}
 }
@@ -138,22 +299,28 @@ func (c *Conn) Server() *Server {
 	return c.server
 }
 
+// SessionID returns the identifier of the connection, see
+// ConnectionState.SessionID.
+func (c *Conn) SessionID() string {
+	return c.id
+}
+
 func (c *Conn) Session() Session {
-	c.locker.Lock()
-	defer c.locker.Unlock()
-	return c.session
+	h, _ := c.session.Load().(sessionHolder)
+	return h.Session
 }
 
 // Setting the user resets any message being generated
 func (c *Conn) SetSession(session Session) {
-	c.locker.Lock()
-	defer c.locker.Unlock()
-	c.session = session
+	c.session.Store(sessionHolder{session})
 }
 
 func (c *Conn) Close() error {
+	c.finish()
 	if session := c.Session(); session != nil {
-		session.Logout()
+		if err := session.Logout(); err != nil {
+			c.server.ErrorLog.Printf("failed to logout session of %v (session %v): %v", c.conn.RemoteAddr(), c.id, err)
+		}
 	}
 
 	return c.conn.Close()
@@ -178,50 +345,117 @@ func (c *Conn) State() ConnectionState {
 
 	state.Hostname = c.helo
 	state.RemoteAddr = c.conn.RemoteAddr()
+	state.SessionID = c.id
 
 	return state
 }
 
-func (c *Conn) authAllowed() bool {
+// authMechanism checks whether an authentication mechanism can be used on
+// the connection. It returns the reply to send otherwise.
+func (c *Conn) authMechanism(name string) *SMTPError {
+	if _, ok := c.server.auths[name]; !ok || c.server.AuthDisabled || !c.server.commandEnabled("AUTH") {
+		return &SMTPError{504, EnhancedCode{5, 7, 4}, "Unsupported authentication mechanism"}
+	}
+
 	_, isTLS := c.TLSConnectionState()
-	return !c.server.AuthDisabled && (isTLS || c.server.AllowInsecureAuth)
+	policy, ok := c.server.AuthPolicies[name]
+	if !ok {
+		if !isTLS && !c.server.AllowInsecureAuth {
+			return &SMTPError{538, EnhancedCode{5, 7, 11}, "Encryption required for requested authentication mechanism"}
+		}
+		return nil
+	}
+
+	if !isTLS && !policy.AllowInsecure {
+		return &SMTPError{538, EnhancedCode{5, 7, 11}, "Encryption required for requested authentication mechanism"}
+	}
+	if len(policy.Networks) > 0 {
+		var ip net.IP
+		if addr, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok {
+			ip = addr.IP
+		}
+		allowed := false
+		for _, n := range policy.Networks {
+			if ip != nil && n.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &SMTPError{504, EnhancedCode{5, 7, 4}, "Unsupported authentication mechanism"}
+		}
+	}
+	return nil
+}
+
+// authMechanisms returns the sorted list of authentication mechanisms which
+// can be used on the connection.
+func (c *Conn) authMechanisms() []string {
+	var l []string
+	for name := range c.server.auths {
+		if c.authMechanism(name) == nil {
+			l = append(l, name)
+		}
+	}
+	sort.Strings(l)
+	return l
 }
 
 // GREET state -> waiting for HELO
 func (c *Conn) handleGreet(enhanced bool, arg string) {
 	if !enhanced {
-		domain, err := parseHelloArgument(arg)
+		if c.server.RequireESMTP {
+			c.WriteResponse(502, EnhancedCode{5, 5, 1}, "HELO not accepted, use EHLO")
+			return
+		}
+		domain, err := parse.Hello(arg)
 		if err != nil {
 			c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Domain/address argument required for HELO")
 			return
 		}
+		if !c.checkHello(domain, false) {
+			return
+		}
 		c.helo = domain
+		c.esmtp = false
+		c.resetHello()
 
 		c.WriteResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("Hello %s", domain))
 	} else {
-		domain, err := parseHelloArgument(arg)
+		domain, err := parse.Hello(arg)
 		if err != nil {
 			c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Domain/address argument required for EHLO")
 			return
 		}
+		if !c.checkHello(domain, true) {
+			return
+		}
 
 		c.helo = domain
+		c.esmtp = true
+		c.resetHello()
 
 		caps := []string{}
-		caps = append(caps, c.server.caps...)
-		if _, isTLS := c.TLSConnectionState(); c.server.TLSConfig != nil && !isTLS {
+		for _, ext := range c.server.caps {
+			if ext == "ENHANCEDSTATUSCODES" && c.server.DisableEnhancedCodes {
+				continue
+			}
+			caps = append(caps, ext)
+		}
+		if _, isTLS := c.TLSConnectionState(); c.server.TLSConfig != nil && !isTLS && c.server.commandEnabled("STARTTLS") {
 			caps = append(caps, "STARTTLS")
 		}
-		if c.authAllowed() {
-			authCap := "AUTH"
-			for name := range c.server.auths {
-				authCap += " " + name
-			}
-
-			caps = append(caps, authCap)
+		if c.server.EnableSMTPUTF8 {
+			caps = append(caps, "SMTPUTF8")
 		}
-		if c.server.MaxMessageBytes > 0 {
-			caps = append(caps, fmt.Sprintf("SIZE %v", c.server.MaxMessageBytes))
+		if mechanisms := c.authMechanisms(); len(mechanisms) > 0 {
+			caps = append(caps, "AUTH "+strings.Join(mechanisms, " "))
+		}
+		if max := c.maxMessageBytes(); max > 0 {
+			caps = append(caps, fmt.Sprintf("SIZE %v", max))
+		}
+		if c.server.CapabilityHook != nil {
+			caps = c.server.CapabilityHook(c, caps)
 		}
 
 		args := []string{"Hello " + domain}
@@ -230,6 +464,54 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 	}
 }
 
+// unauthPipelining reports whether the client sent more input after a
+// command without waiting for its reply, although PIPELINING doesn't allow
+// it. With PIPELINING, only RSET, MAIL and RCPT can be followed by other
+// commands, see RFC 2920 section 3.1. Without it, no command can.
+func (c *Conn) unauthPipelining(cmd string) bool {
+	if cmd == "QUIT" || c.br.Buffered() == 0 {
+		return false
+	}
+	if !c.esmtp {
+		return true
+	}
+	switch cmd {
+	case "RSET", "MAIL", "RCPT":
+		return false
+	}
+	return true
+}
+
+// maxMessageBytes returns the maximum message size of the session, zero if
+// there is no limit.
+func (c *Conn) maxMessageBytes() int {
+	if limiter, ok := c.Session().(SizeLimiter); ok {
+		return limiter.MaxMessageBytes()
+	}
+	return c.server.MaxMessageBytes
+}
+
+// checkHello submits a greeting to the backend, if it implements
+// HelloChecker. It returns false if the greeting has been rejected.
+func (c *Conn) checkHello(domain string, esmtp bool) bool {
+	checker, ok := c.server.Backend.(HelloChecker)
+	if !ok {
+		return true
+	}
+
+	state := c.State()
+	state.Hostname = domain
+	if err := checker.CheckHello(&state, domain, esmtp); err != nil {
+		if smtpErr, ok := err.(*SMTPError); ok {
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+		} else {
+			c.WriteResponse(451, EnhancedCode{4, 0, 0}, err.Error())
+		}
+		return false
+	}
+	return true
+}
+
 // READY state -> waiting for MAIL
 func (c *Conn) handleMail(arg string) {
 	if c.helo == "" {
@@ -252,81 +534,202 @@ func (c *Conn) handleMail(arg string) {
 		c.SetSession(session)
 	}
 
-	if len(arg) < 6 || strings.ToUpper(arg[0:5]) != "FROM:" {
+	if len(arg) < 6 || !strings.EqualFold(arg[0:5], "FROM:") {
 		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Was expecting MAIL arg syntax of FROM:<address>")
 		return
 	}
-	fromArgs := strings.Split(strings.Trim(arg[5:], " "), " ")
+	var from, params string
 	if c.server.Strict {
-		if !strings.HasPrefix(fromArgs[0], "<") || !strings.HasSuffix(fromArgs[0], ">") {
+		var err error
+		if from, params, err = parse.ReversePath(arg[5:]); err != nil {
 			c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Was expecting MAIL arg syntax of FROM:<address>")
 			return
 		}
+	} else {
+		from, params = splitPath(arg[5:])
 	}
-	from := strings.Trim(fromArgs[0], "<> ")
 	if from == "" {
 		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Was expecting MAIL arg syntax of FROM:<address>")
 		return
 	}
 
-	// This is where the Conn may put BODY=8BITMIME, but we already
-	// read the DATA as bytes, so it does not effect our processing.
-	if len(fromArgs) > 1 {
-		args, err := parseArgs(fromArgs[1:])
+	// Parameters are scanned one at a time rather than collected in a map, to
+	// avoid allocations
+	tx := &Transaction{From: from}
+	var seen struct{ size, body, auth, utf8 bool }
+	for params != "" {
+		k, v, rest, err := parse.NextParam(params)
 		if err != nil {
-			log.Println("Recv MAIL(%s) err:%s",arg,err)
 			c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Unable to parse MAIL ESMTP parameters")
 			return
 		}
-
-		if args["SIZE"] != "" {
-			size, err := strconv.ParseInt(args["SIZE"], 10, 32)
+		params = rest
+
+		var dup bool
+		switch k = strings.ToUpper(k); k {
+		case "":
+			continue
+		case "SIZE":
+			dup, seen.size = seen.size, true
+			size, err := strconv.ParseInt(v, 10, 32)
 			if err != nil {
 				c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Unable to parse SIZE as an integer")
 				return
 			}
 
-			if c.server.MaxMessageBytes > 0 && int(size) > c.server.MaxMessageBytes {
+			if max := c.maxMessageBytes(); max > 0 && int(size) > max {
 				c.WriteResponse(552, EnhancedCode{5, 3, 4}, "Max message size exceeded")
 				return
 			}
+			tx.Size = size
+		case "BODY":
+			dup, seen.body = seen.body, true
+			// We read the DATA as bytes, so the body type does not affect
+			// our processing.
+			tx.Body = strings.ToUpper(v)
+		case "AUTH":
+			dup, seen.auth = seen.auth, true
+			// The submitter identity is only informative, see RFC 4954
+			// section 5
+			tx.Auth = v
+		case "SMTPUTF8":
+			if !c.server.EnableSMTPUTF8 {
+				if c.server.RejectUnknownParams {
+					c.WriteResponse(555, EnhancedCode{5, 5, 4}, "Unsupported MAIL parameter "+k)
+					return
+				}
+				continue
+			}
+			if v != "" {
+				c.WriteResponse(501, EnhancedCode{5, 5, 4}, "SMTPUTF8 parameter doesn't take a value")
+				return
+			}
+			dup, seen.utf8 = seen.utf8, true
+			tx.SMTPUTF8 = true
+		default:
+			if c.server.RejectUnknownParams {
+				c.WriteResponse(555, EnhancedCode{5, 5, 4}, "Unsupported MAIL parameter "+k)
+				return
+			}
+			continue
+		}
+		if dup {
+			c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Duplicate MAIL parameter "+k)
+			return
 		}
 	}
-
+	// The transaction starts before Mail is called, so that replies may
+	// contain UTF-8 as soon as the client requested SMTPUTF8
+	tx.ID = newID()
+	tx.SessionID = c.id
+	tx.Start = time.Now()
+	c.tx = tx
+	if session, ok := c.Session().(TransactionSession); ok {
+		session.BeginTransaction(tx)
+	}
 	if err := c.Session().Mail(from); err != nil {
 		if smtpErr, ok := err.(*SMTPError); ok {
 			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
-			return
+		} else {
+			c.WriteResponse(451, EnhancedCode{4, 0, 0}, err.Error())
 		}
-		c.WriteResponse(451, EnhancedCode{4, 0, 0}, err.Error())
+		c.tx = nil
 		return
 	}
 
-	c.WriteResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("Roger, accepting mail from <%v>", from))
-	c.fromReceived = true
+	c.WriteResponse(250, EnhancedCode{2, 0, 0}, "Roger, accepting mail from <"+from+">")
 }
 
 // MAIL state -> waiting for RCPTs followed by DATA
 func (c *Conn) handleRcpt(arg string) {
-	if !c.fromReceived {
+	if c.tx == nil {
 		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "Missing MAIL FROM command.")
 		return
 	}
 
-	if (len(arg) < 4) || (strings.ToUpper(arg[0:3]) != "TO:") {
+	if (len(arg) < 4) || !strings.EqualFold(arg[0:3], "TO:") {
 		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Was expecting RCPT arg syntax of TO:<address>")
 		return
 	}
 
-	// TODO: This trim is probably too forgiving
-	recipient := strings.Trim(arg[3:], "<> ")
+	// RCPT parameters, such as DSN's NOTIFY, aren't supported and are
+	// ignored
+	var recipient string
+	if c.server.Strict {
+		var err error
+		if recipient, _, err = parse.Path(arg[3:]); err != nil {
+			c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Was expecting RCPT arg syntax of TO:<address>")
+			return
+		}
+	} else {
+		recipient, _ = splitPath(arg[3:])
+	}
+	if recipient == "" {
+		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Was expecting RCPT arg syntax of TO:<address>")
+		return
+	}
 
-	if c.server.MaxRecipients > 0 && len(c.recipients) >= c.server.MaxRecipients {
+	if c.server.MaxRecipients > 0 && len(c.tx.Recipients) >= c.server.MaxRecipients {
 		c.WriteResponse(552, EnhancedCode{5, 5, 3}, fmt.Sprintf("Maximum limit of %v recipients reached", c.server.MaxRecipients))
 		return
 	}
 
-	if err := c.Session().Rcpt(recipient); err != nil {
+	if limiter, ok := c.Session().(RcptLimiter); ok {
+		if max := limiter.RcptLimit(); max > 0 && len(c.tx.Recipients) >= max {
+			c.WriteResponse(452, EnhancedCode{4, 5, 3}, fmt.Sprintf("Maximum limit of %v recipients reached for this transaction", max))
+			return
+		}
+	}
+
+	original := recipient
+	if c.server.RcptNormalization != nil {
+		recipient = c.server.RcptNormalization.Normalize(recipient)
+	}
+
+	var err error
+	if session, ok := c.Session().(PostmasterSession); ok && strings.EqualFold(original, "postmaster") {
+		err = session.RcptPostmaster(recipient)
+	} else if session, ok := c.Session().(NormalizedRcptSession); ok && c.server.RcptNormalization != nil {
+		err = session.RcptNormalized(recipient, original)
+	} else {
+		err = c.Session().Rcpt(recipient)
+	}
+	if err != nil {
+		if smtpErr, ok := err.(*SMTPError); ok {
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+			return
+		}
+		if code, enhancedCode, ok := quotaReply(err); ok {
+			c.WriteResponse(code, enhancedCode, err.Error())
+			return
+		}
+		c.WriteResponse(451, EnhancedCode{4, 0, 0}, err.Error())
+		return
+	}
+	c.tx.Recipients = append(c.tx.Recipients, recipient)
+	c.WriteResponse(250, EnhancedCode{2, 0, 0}, "I'll make sure <"+original+"> gets this")
+}
+
+func (c *Conn) handleVrfy(arg string) {
+	if c.server.VrfyMode == VrfyDisabled {
+		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "VRFY command disabled")
+		return
+	}
+
+	verifier, ok := c.server.Backend.(Verifier)
+	if c.server.VrfyMode != VrfyBackend || !ok {
+		c.WriteResponse(252, EnhancedCode{2, 5, 0}, "Cannot VRFY user, but will accept message")
+		return
+	}
+
+	addr := strings.Trim(arg, "<> ")
+	if addr == "" {
+		c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Was expecting VRFY arg syntax of <address>")
+		return
+	}
+
+	state := c.State()
+	if err := verifier.Verify(&state, addr); err != nil {
 		if smtpErr, ok := err.(*SMTPError); ok {
 			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
 			return
@@ -334,8 +737,30 @@ func (c *Conn) handleRcpt(arg string) {
 		c.WriteResponse(451, EnhancedCode{4, 0, 0}, err.Error())
 		return
 	}
-	c.recipients = append(c.recipients, recipient)
-	c.WriteResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("I'll make sure <%v> gets this", recipient))
+	c.WriteResponse(250, EnhancedCode{2, 1, 5}, "<"+addr+">")
+}
+
+// rcptFailed records a rejected recipient, and closes the connection if too
+// many recipients have been rejected.
+func (c *Conn) rcptFailed() {
+	if c.server.MaxRcptFailures <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if window := c.server.RcptFailureWindow; window > 0 {
+		i := 0
+		for i < len(c.rcptFailures) && now.Sub(c.rcptFailures[i]) >= window {
+			i++
+		}
+		c.rcptFailures = c.rcptFailures[i:]
+	}
+	c.rcptFailures = append(c.rcptFailures, now)
+
+	if len(c.rcptFailures) > c.server.MaxRcptFailures {
+		c.WriteResponse(421, EnhancedCode{4, 7, 0}, "Too many rejected recipients, closing connection")
+		c.Close()
+	}
 }
 
 func (c *Conn) handleAuth(arg string) {
@@ -362,11 +787,11 @@ func (c *Conn) handleAuth(arg string) {
 		}
 	}
 
-	newSasl, ok := c.server.auths[mechanism]
-	if !ok {
-		c.WriteResponse(504, EnhancedCode{5, 7, 4}, "Unsupported authentication mechanism")
+	if err := c.authMechanism(mechanism); err != nil {
+		c.WriteResponse(err.Code, err.EnhancedCode, err.Message)
 		return
 	}
+	newSasl := c.server.auths[mechanism]
 
 	sasl := newSasl(c)
 
@@ -434,51 +859,62 @@ func (c *Conn) handleStartTLS() {
 	c.init()
 
 	// Reset envelope as a new EHLO/HELO is required after STARTTLS
-	c.reset()
+	c.abortReset(AbortStartTLS)
 }
 
 // DATA
-func (c *Conn) handleData(arg string) {
+//
+// handleData returns an error if the end of the message data couldn't be
+// found, in which case the connection must be closed.
+func (c *Conn) handleData(arg string) error {
 	if arg != "" {
 		c.WriteResponse(501, EnhancedCode{5, 5, 4}, "DATA command should not have any arguments")
-		return
+		return nil
 	}
 
-	if !c.fromReceived || len(c.recipients) == 0 {
+	if c.tx == nil || len(c.tx.Recipients) == 0 {
 		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "Missing RCPT TO command.")
-		return
+		return nil
 	}
 
 	// We have recipients, go to accept data
+	c.tx.DataStart = time.Now()
 	c.WriteResponse(354, EnhancedCode{2, 0, 0}, "Go ahead. End your data with <CR><LF>.<CR><LF>")
 
-	var (
-		code         int
-		enhancedCode EnhancedCode
-		msg          string
-	)
-	r := newDataReader(c)
-	err := c.Session().Data(r)
-	io.Copy(ioutil.Discard, r) // Make sure all the data has been consumed
-	if err != nil {
-		if smtperr, ok := err.(*SMTPError); ok {
-			code = smtperr.Code
-			enhancedCode = smtperr.EnhancedCode
-			msg = smtperr.Message
-		} else {
-			code = 554
-			enhancedCode = EnhancedCode{5, 0, 0}
-			msg = "Error: transaction failed, blame it on the weather: " + err.Error()
+	c.dataBytes = 0
+	r, finish := c.newDataSource()
+	if session, ok := c.Session().(LMTPSession); ok && c.server.LMTP {
+		status := newStatusCollector(c.tx.Recipients)
+		err := session.LMTPData(r, status)
+		if finishErr := finish(); finishErr != nil {
+			c.dataFailed(finishErr)
+			return finishErr
 		}
-	} else {
-		code = 250
-		enhancedCode = EnhancedCode{2, 0, 0}
-		msg = "OK: queued"
+		accepted := false
+		for i, err := range status.close(err) {
+			code, enhancedCode, msg := dataReply(err, c.tx.ID)
+			c.WriteResponse(code, enhancedCode, "<"+c.tx.Recipients[i]+"> "+msg)
+			accepted = accepted || err == nil
+		}
+		if accepted {
+			c.accepted()
+		}
+		c.reset()
+		return nil
+	}
+
+	err := c.Session().Data(r)
+	if finishErr := finish(); finishErr != nil {
+		c.dataFailed(finishErr)
+		return finishErr
+	}
+	code, enhancedCode, msg := dataReply(err, c.tx.ID)
+	if err == nil {
+		c.accepted()
 	}
 
 	if c.server.LMTP {
-		// TODO: support per-recipient responses
-		for _, rcpt := range c.recipients {
+		for _, rcpt := range c.tx.Recipients {
 			c.WriteResponse(code, enhancedCode, "<"+rcpt+"> "+msg)
 		}
 	} else {
@@ -486,6 +922,61 @@ func (c *Conn) handleData(arg string) {
 	}
 
 	c.reset()
+	return nil
+}
+
+// dataFailed replies to message data whose end couldn't be found, for all
+// recipients in LMTP mode. Other errors than SMTPError are I/O errors, which
+// can't be replied to.
+func (c *Conn) dataFailed(err error) {
+	smtpErr, ok := err.(*SMTPError)
+	if !ok {
+		return
+	}
+	if c.server.LMTP {
+		for _, rcpt := range c.tx.Recipients {
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, "<"+rcpt+"> "+smtpErr.Message)
+		}
+	} else {
+		c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+	}
+}
+
+// accepted records an accepted message in the session summary.
+func (c *Conn) accepted() {
+	c.summary.Messages++
+	c.summary.Bytes += c.dataBytes
+	n := c.dataBytes
+	c.server.counters.update(func(stats *Stats) {
+		stats.Messages++
+		stats.Bytes += uint64(n)
+	})
+}
+
+// quotaReply returns the reply to ErrOverQuota and ErrMailboxFull.
+func quotaReply(err error) (code int, enhancedCode EnhancedCode, ok bool) {
+	switch {
+	case errors.Is(err, ErrOverQuota):
+		return 452, EnhancedCode{4, 2, 2}, true
+	case errors.Is(err, ErrMailboxFull):
+		return 552, EnhancedCode{5, 2, 2}, true
+	}
+	return 0, EnhancedCode{}, false
+}
+
+// dataReply returns the reply to the end of the message data. Accepted
+// messages are replied with the transaction ID, so that clients can report it.
+func dataReply(err error, txID string) (code int, enhancedCode EnhancedCode, msg string) {
+	if err == nil {
+		return 250, EnhancedCode{2, 0, 0}, "OK: queued as " + txID
+	}
+	if smtperr, ok := err.(*SMTPError); ok {
+		return smtperr.Code, smtperr.EnhancedCode, smtperr.Message
+	}
+	if code, enhancedCode, ok := quotaReply(err); ok {
+		return code, enhancedCode, err.Error()
+	}
+	return 554, EnhancedCode{5, 0, 0}, "Error: transaction failed, blame it on the weather: " + err.Error()
 }
 
 func (c *Conn) Reject() {
@@ -499,13 +990,16 @@ func (c *Conn) greet() {
 
 func (c *Conn) WriteResponse(code int, enhCode EnhancedCode, text ...string) {
 	// TODO: error handling
+	c.replyCode = code
 	if c.server.WriteTimeout != 0 {
 		c.conn.SetWriteDeadline(time.Now().Add(c.server.WriteTimeout))
 	}
 
 	// All responses must include an enhanced code, if it is missing - use
 	// a generic code X.0.0.
-	if enhCode == EnhancedCodeNotSet {
+	if c.server.DisableEnhancedCodes {
+		enhCode = NoEnhancedCode
+	} else if enhCode == EnhancedCodeNotSet {
 		cat := code / 100
 		switch cat {
 		case 2, 4, 5:
@@ -515,14 +1009,64 @@ func (c *Conn) WriteResponse(code int, enhCode EnhancedCode, text ...string) {
 		}
 	}
 
-	for i := 0; i < len(text)-1; i++ {
-		c.text.PrintfLine("%v-%v", code, text[i])
+	// The reply is built in a reused buffer and written at once, so that
+	// multi-line replies are sent in a single segment. The enhanced code is
+	// repeated on each line, as required by RFC 2034 section 4.
+	buf := c.respBuf[:0]
+	for i, line := range text {
+		buf = strconv.AppendInt(buf, int64(code), 10)
+		if i < len(text)-1 {
+			buf = append(buf, '-')
+		} else {
+			buf = append(buf, ' ')
+		}
+		if enhCode != NoEnhancedCode {
+			buf = strconv.AppendInt(buf, int64(enhCode[0]), 10)
+			buf = append(buf, '.')
+			buf = strconv.AppendInt(buf, int64(enhCode[1]), 10)
+			buf = append(buf, '.')
+			buf = strconv.AppendInt(buf, int64(enhCode[2]), 10)
+			buf = append(buf, ' ')
+		}
+		buf = appendReplyText(buf, line, c.tx != nil && c.tx.SMTPUTF8)
+		buf = append(buf, '\r', '\n')
 	}
-	if enhCode == NoEnhancedCode {
-		c.text.PrintfLine("%v %v", code, text[len(text)-1])
-	} else {
-		c.text.PrintfLine("%v %v.%v.%v %v", code, enhCode[0], enhCode[1], enhCode[2], text[len(text)-1])
+	c.respBuf = buf
+
+	c.bw.Write(buf)
+	c.bw.Flush()
+}
+
+// appendReplyText appends the text of a reply line to buf. Control characters
+// and invalid UTF-8 are escaped, as well as non-ASCII characters unless utf8
+// is set, so that text coming from backends never produces an illegal reply.
+func appendReplyText(buf []byte, text string, utf8Allowed bool) []byte {
+	for i := 0; i < len(text); i++ {
+		if c := text[i]; c < 0x20 || c >= 0x7f {
+			return appendEscapedText(buf, text, utf8Allowed)
+		}
+	}
+	return append(buf, text...)
+}
+
+func appendEscapedText(buf []byte, text string, utf8Allowed bool) []byte {
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		switch {
+		case r == utf8.RuneError && size <= 1:
+			buf = append(buf, fmt.Sprintf("\\x%02x", text[i])...)
+		case r < 0x20 || r == 0x7f:
+			buf = append(buf, fmt.Sprintf("\\x%02x", r)...)
+		case r < 0x80 || (utf8Allowed && unicode.IsPrint(r)):
+			buf = append(buf, text[i:i+size]...)
+		case r <= 0xffff:
+			buf = append(buf, fmt.Sprintf("\\u%04x", r)...)
+		default:
+			buf = append(buf, fmt.Sprintf("\\U%08x", r)...)
+		}
+		i += size
 	}
+	return buf
 }
 
 // Reads a line of input
@@ -536,13 +1080,84 @@ func (c *Conn) ReadLine() (string, error) {
 	return c.text.ReadLine()
 }
 
-func (c *Conn) reset() {
-	c.locker.Lock()
-	defer c.locker.Unlock()
+// resetHello resets the transaction in progress, if any, as HELO and EHLO
+// imply RSET (RFC 5321 section 4.1.4).
+func (c *Conn) resetHello() {
+	if c.tx != nil {
+		c.abortReset(AbortHello)
+	}
+}
+
+// finish aborts the transaction in progress, if any, and sends the summary of
+// the connection to the session. It is called once by Close, before the
+// session is logged out.
+func (c *Conn) finish() {
+	c.finishOnce.Do(func() {
+		c.abort(AbortDisconnect)
+		if session, ok := c.Session().(SessionFinalizer); ok {
+			summary := c.summary
+			summary.Duration = time.Since(summary.Start)
+			session.Finalize(summary)
+		}
+	})
+}
+
+// abort notifies the session that the transaction in progress, if any, is
+// aborted.
+func (c *Conn) abort(reason AbortReason) {
+	if c.tx == nil {
+		return
+	}
+	c.tx = nil
+	if session, ok := c.Session().(TransactionAborter); ok {
+		session.Abort(reason)
+	}
+}
+
+// abortReset aborts the transaction in progress, if any, and resets the
+// session.
+func (c *Conn) abortReset(reason AbortReason) error {
+	// abort clears the transaction, keep its ID for the reset log
+	var txID string
+	if c.tx != nil {
+		txID = c.tx.ID
+	}
+	c.abort(reason)
+	return c.resetSession(txID)
+}
+
+// reset discards the current transaction. Errors returned by the session are
+// logged.
+func (c *Conn) reset() error {
+	var txID string
+	if c.tx != nil {
+		txID = c.tx.ID
+	}
+	return c.resetSession(txID)
+}
+
+// resetSession resets the session, logging errors with the ID of the
+// discarded transaction.
+func (c *Conn) resetSession(txID string) error {
+	var err error
+	if session, ok := c.Session().(TryResetter); ok {
+		err = session.TryReset()
+	} else if session := c.Session(); session != nil {
+		session.Reset()
+	}
+	c.tx = nil
+
+	if err != nil {
+		c.server.ErrorLog.Printf("failed to reset session of %v (session %v, transaction %v): %v", c.conn.RemoteAddr(), c.id, txID, err)
+	}
+	return err
+}
 
-	if c.session != nil {
-		c.session.Reset()
+// resetReply returns the reply to a failed RSET command. It is always
+// temporary, as RSET can't fail permanently.
+func resetReply(err error) (code int, enhancedCode EnhancedCode, msg string) {
+	if smtpErr, ok := err.(*SMTPError); ok && smtpErr.Code/100 == 4 {
+		return smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message
 	}
-	c.fromReceived = false
-	c.recipients = nil
+	return 451, EnhancedCode{4, 3, 0}, "Failed to reset session"
 }
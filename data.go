@@ -1,12 +1,24 @@
 package smtp
 
 import (
+	"bufio"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync/atomic"
 )
 
 type EnhancedCode [3]int
 
-// SMTPError specifies the error code and message that needs to be returned to the client
+// SMTPError specifies the error code and message that needs to be returned to
+// the client.
+//
+// The client also returns SMTPError values for error replies sent by the
+// server. In that case, Message contains all the lines of the reply separated
+// by "\n", with the enhanced status code stripped.
 type SMTPError struct {
 	Code         int
 	EnhancedCode EnhancedCode
@@ -27,7 +39,73 @@ var NoEnhancedCode = EnhancedCode{-1, -1, -1}
 var EnhancedCodeNotSet = EnhancedCode{0, 0, 0}
 
 func (err *SMTPError) Error() string {
-	return err.Message
+	if err.Code == 0 {
+		return err.Message
+	}
+	if err.EnhancedCode == EnhancedCodeNotSet || err.EnhancedCode == NoEnhancedCode {
+		return fmt.Sprintf("%03d %v", err.Code, err.Message)
+	}
+	return fmt.Sprintf("%03d %v %v", err.Code, err.EnhancedCode, err.Message)
+}
+
+func (code EnhancedCode) String() string {
+	return fmt.Sprintf("%v.%v.%v", code[0], code[1], code[2])
+}
+
+// parseEnhancedCode parses a X.Y.Z enhanced status code.
+func parseEnhancedCode(s string) (EnhancedCode, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return EnhancedCode{}, fmt.Errorf("smtp: wrong amount of enhanced code parts")
+	}
+
+	var code EnhancedCode
+	for i, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil || num < 0 || len(part) > 3 {
+			return EnhancedCode{}, fmt.Errorf("smtp: invalid enhanced code part: %q", part)
+		}
+		code[i] = num
+	}
+	switch code[0] {
+	case 2, 4, 5:
+	default:
+		return EnhancedCode{}, fmt.Errorf("smtp: invalid enhanced code class: %v", code[0])
+	}
+	return code, nil
+}
+
+// toSMTPErr converts a *textproto.Error to a *SMTPError, parsing the enhanced
+// status code if any. Other errors are returned as-is.
+func toSMTPErr(err error) error {
+	protoErr, ok := err.(*textproto.Error)
+	if !ok {
+		return err
+	}
+
+	smtpErr := &SMTPError{
+		Code:    protoErr.Code,
+		Message: protoErr.Msg,
+	}
+
+	parts := strings.SplitN(protoErr.Msg, " ", 2)
+	if len(parts) != 2 {
+		return smtpErr
+	}
+	enhancedCode, err := parseEnhancedCode(parts[0])
+	if err != nil || enhancedCode[0] != protoErr.Code/100 {
+		return smtpErr
+	}
+
+	// Per RFC 2034, the enhanced code is prepended to each line
+	lines := strings.Split(parts[1], "\n")
+	for i := 1; i < len(lines); i++ {
+		lines[i] = strings.TrimPrefix(lines[i], parts[0]+" ")
+	}
+
+	smtpErr.EnhancedCode = enhancedCode
+	smtpErr.Message = strings.Join(lines, "\n")
+	return smtpErr
 }
 
 var ErrDataTooLarge = &SMTPError{
@@ -36,21 +114,201 @@ var ErrDataTooLarge = &SMTPError{
 	Message:      "Maximum message size exceeded",
 }
 
+// ErrDataLineTooLong is returned by the message reader passed to Session.Data
+// when a line is longer than Server.MaxLineLength. The rest of the message is
+// discarded.
+var ErrDataLineTooLong = &SMTPError{
+	Code:         500,
+	EnhancedCode: EnhancedCode{5, 5, 2},
+	Message:      "Line too long",
+}
+
+// ErrDataBareLF is returned by the message reader passed to Session.Data when
+// a line ends with a bare LF instead of CRLF and Server.RejectBareLF is set.
+// Since the end of the message can't be found reliably, the connection is
+// closed: otherwise, a message hidden after a "\n.\n" sequence could be
+// smuggled.
+var ErrDataBareLF = &SMTPError{
+	Code:         500,
+	EnhancedCode: EnhancedCode{5, 5, 2},
+	Message:      "Bare LF received, lines must end with CRLF",
+}
+
+// DataCounter is implemented by the reader passed to Session.Data and
+// LMTPSession.LMTPData, to account for the size of the message.
+type DataCounter interface {
+	// WireBytes returns the number of bytes of message data received from
+	// the client so far, as sent on the wire: with CRLF line endings and
+	// dot-stuffing, but without the final ".\r\n" line.
+	WireBytes() int64
+	// DecodedBytes returns the number of bytes of message data decoded so
+	// far, with LF line endings.
+	DecodedBytes() int64
+}
+
+// dotReader decodes message data, as defined in RFC 5321 section 4.5.2:
+// leading dots are removed, CRLF line endings are converted to LF, and the
+// message ends with a line containing a single dot.
+//
+// Like textproto.DotReader, a bare LF ends lines too, unless rejectBareLF is
+// set, in which case it is rejected with ErrDataBareLF. Bare CR characters
+// are kept as-is.
+type dotReader struct {
+	r            *bufio.Reader
+	maxLine      int
+	rejectBareLF bool
+
+	state   int
+	lineLen int
+	err     error // Sticky error
+
+	wire, decoded int64 // Accessed atomically
+}
+
+const (
+	dotBeginLine = iota
+	dotDot       // Read "." at the beginning of a line
+	dotDotCR     // Read ".\r" at the beginning of a line
+	dotCR        // Read "\r"
+	dotData
+)
+
+func newDotReader(r *bufio.Reader, maxLine int, rejectBareLF bool) *dotReader {
+	return &dotReader{r: r, maxLine: maxLine, rejectBareLF: rejectBareLF}
+}
+
+func (r *dotReader) Read(b []byte) (n int, err error) {
+	var wire int64
+	for n < len(b) && r.err == nil {
+		var c byte
+		c, err = r.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			r.err = err
+			break
+		}
+		wire++
+
+		switch r.state {
+		case dotBeginLine:
+			r.lineLen = 0
+			switch c {
+			case '.':
+				r.state = dotDot
+				r.lineLen++
+				continue
+			case '\r':
+				r.state = dotCR
+				continue
+			}
+		case dotDot:
+			if c == '\r' {
+				r.state = dotDotCR
+				continue
+			}
+			if c == '\n' && !r.rejectBareLF {
+				// The final ".\n" line isn't part of the message
+				wire -= 2
+				r.err = io.EOF
+				continue
+			}
+		case dotDotCR:
+			if c == '\n' {
+				// The final ".\r\n" line isn't part of the message
+				wire -= 3
+				r.err = io.EOF
+				continue
+			}
+			// A bare CR after the leading dot is data
+			r.r.UnreadByte()
+			wire--
+			c = '\r'
+		case dotCR:
+			if c == '\n' {
+				r.state = dotBeginLine
+				b[n] = '\n'
+				n++
+				continue
+			}
+			r.r.UnreadByte()
+			wire--
+			c = '\r'
+		case dotData:
+			if c == '\r' {
+				r.state = dotCR
+				continue
+			}
+		}
+
+		if c == '\n' {
+			if r.rejectBareLF {
+				r.err = ErrDataBareLF
+				break
+			}
+			r.state = dotBeginLine
+			b[n] = c
+			n++
+			continue
+		}
+		r.state = dotData
+		r.lineLen++
+		if r.maxLine > 0 && r.lineLen > r.maxLine {
+			r.err = ErrDataLineTooLong
+			break
+		}
+		b[n] = c
+		n++
+	}
+
+	atomic.AddInt64(&r.wire, wire)
+	atomic.AddInt64(&r.decoded, int64(n))
+	if n > 0 {
+		return n, nil
+	}
+	return 0, r.err
+}
+
+// discard skips the rest of the message, so that the next command can be
+// read. Lines longer than the limit are skipped too. A non-nil error is
+// returned if the end of the message couldn't be found, in which case the
+// connection can't be used anymore.
+func (r *dotReader) discard() error {
+	if r.err == ErrDataLineTooLong {
+		r.err = nil
+		r.maxLine = 0
+	}
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
+
+func (r *dotReader) WireBytes() int64 {
+	return atomic.LoadInt64(&r.wire)
+}
+
+func (r *dotReader) DecodedBytes() int64 {
+	return atomic.LoadInt64(&r.decoded)
+}
+
 type dataReader struct {
-	r io.Reader
+	r *dotReader
 
 	limited bool
 	n       int64 // Maximum bytes remaining
+
+	read *int64 // Bytes read, if not nil
 }
 
-func newDataReader(c *Conn) io.Reader {
+func newDataReader(c *Conn) *dataReader {
 	dr := &dataReader{
-		r: c.text.DotReader(),
+		r:    newDotReader(c.text.R, c.server.MaxLineLength, c.server.RejectBareLF),
+		read: &c.dataBytes,
 	}
 
-	if c.server.MaxMessageBytes > 0 {
+	if max := c.maxMessageBytes(); max > 0 {
 		dr.limited = true
-		dr.n = int64(c.server.MaxMessageBytes)
+		dr.n = int64(max)
 	}
 
 	return dr
@@ -71,5 +329,16 @@ func (r *dataReader) Read(b []byte) (n int, err error) {
 	if r.limited {
 		r.n -= int64(n)
 	}
+	if r.read != nil {
+		*r.read += int64(n)
+	}
 	return
 }
+
+func (r *dataReader) WireBytes() int64 {
+	return r.r.WireBytes()
+}
+
+func (r *dataReader) DecodedBytes() int64 {
+	return r.r.DecodedBytes()
+}
@@ -0,0 +1,261 @@
+package dkim
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChainValidation is the result of the validation of the existing ARC chain
+// of a message (cv= tag), see RFC 8617 section 4.4.
+type ChainValidation string
+
+const (
+	ChainValidationNone ChainValidation = "none"
+	ChainValidationPass ChainValidation = "pass"
+	ChainValidationFail ChainValidation = "fail"
+)
+
+// maxARCInstance is the maximum number of ARC sets in a message.
+const maxARCInstance = 50
+
+// SealOptions contains options for adding an ARC set to a message, as defined
+// in RFC 8617.
+type SealOptions struct {
+	// The sealing domain, selector and private key, see SignOptions.
+	Domain   string
+	Selector string
+	Signer   crypto.Signer
+
+	// The authentication service identifier of the sealing server. The
+	// results of the topmost Authentication-Results header field with this
+	// identifier are copied to the ARC-Authentication-Results header field,
+	// unless Results is set.
+	AuthServID string
+	// The authentication results of the message, e.g.
+	// "spf=pass smtp.mailfrom=example.org; dkim=pass header.d=example.org".
+	Results string
+	// The validation result of the existing ARC chain. If empty, the arc
+	// result of the authentication results is used. It must be
+	// ChainValidationNone if the message has no ARC set.
+	ChainValidation ChainValidation
+
+	// The header fields signed by the ARC-Message-Signature, see
+	// SignOptions.HeaderKeys.
+	HeaderKeys []string
+	// Now returns the sealing time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// Sealer adds an ARC set to a message written to it. The message must be
+// written in full, then Close must be called before Headers.
+type Sealer struct {
+	options SealOptions
+	signer  *Signer
+
+	headers string
+}
+
+// NewSealer creates a new sealer.
+func NewSealer(options *SealOptions) (*Sealer, error) {
+	if options.AuthServID == "" {
+		return nil, errors.New("dkim: missing authserv-id")
+	}
+	for _, k := range options.HeaderKeys {
+		if strings.EqualFold(k, "ARC-Seal") {
+			return nil, errors.New("dkim: ARC-Seal must not be signed")
+		}
+	}
+
+	signer, err := NewSigner(&SignOptions{
+		Domain:     options.Domain,
+		Selector:   options.Selector,
+		Signer:     options.Signer,
+		HeaderKeys: options.HeaderKeys,
+		Now:        options.Now,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{options: *options, signer: signer}, nil
+}
+
+// Write implements io.Writer.
+func (s *Sealer) Write(p []byte) (int, error) {
+	return s.signer.Write(p)
+}
+
+// Close finishes sealing the message.
+func (s *Sealer) Close() error {
+	if s.signer.closed {
+		return nil
+	}
+	fields, err := s.signer.finish()
+	if err != nil {
+		return err
+	}
+
+	sets, err := arcSets(fields)
+	if err != nil {
+		return err
+	}
+	instance := len(sets) + 1
+	if instance > maxARCInstance {
+		return errors.New("dkim: too many ARC sets")
+	}
+
+	results := s.options.Results
+	if results == "" {
+		results = authResults(fields, s.options.AuthServID)
+	}
+	if results == "" {
+		results = "none"
+	}
+
+	cv := s.options.ChainValidation
+	if cv == "" {
+		cv = ChainValidation(resultValue(results, "arc"))
+	}
+	switch {
+	case len(sets) == 0:
+		cv = ChainValidationNone
+	case cv != ChainValidationPass:
+		cv = ChainValidationFail
+	}
+
+	aar := "ARC-Authentication-Results: i=" + strconv.Itoa(instance) + "; " + s.options.AuthServID + "; " + results + "\r\n"
+
+	s.signer.arcInstance = instance
+	ams, err := s.signer.sign(fields)
+	if err != nil {
+		return err
+	}
+
+	// The seal covers all ARC sets, or only the new one if the chain failed
+	var signed []string
+	if cv != ChainValidationFail {
+		for _, set := range sets {
+			signed = append(signed, set[:]...)
+		}
+	}
+	signed = append(signed, aar, ams)
+
+	tags := []string{
+		"i=" + strconv.Itoa(instance),
+		"a=" + s.signer.algorithm,
+		"cv=" + string(cv),
+		"d=" + s.options.Domain,
+		"s=" + s.options.Selector,
+		"t=" + strconv.FormatInt(s.signer.options.Now().Unix(), 10),
+	}
+	seal, err := signHeader("ARC-Seal", tags, signed, CanonicalizationRelaxed, s.options.Signer)
+	if err != nil {
+		return err
+	}
+
+	s.headers = seal + ams + aar
+	return nil
+}
+
+// Headers returns the ARC-Seal, ARC-Message-Signature and
+// ARC-Authentication-Results header fields to prepend to the message,
+// including their trailing CRLF. It must be called after Close.
+func (s *Sealer) Headers() string {
+	return s.headers
+}
+
+// arcSets returns the existing ARC sets of a message, ordered by instance.
+// Each set contains the ARC-Authentication-Results, ARC-Message-Signature and
+// ARC-Seal header fields.
+func arcSets(fields []string) ([][3]string, error) {
+	var sets [][3]string
+	for _, field := range fields {
+		var idx int
+		switch strings.ToLower(fieldName(field)) {
+		case "arc-authentication-results":
+			idx = 0
+		case "arc-message-signature":
+			idx = 1
+		case "arc-seal":
+			idx = 2
+		default:
+			continue
+		}
+
+		i, err := arcInstance(field)
+		if err != nil {
+			return nil, err
+		}
+		if i > maxARCInstance {
+			return nil, fmt.Errorf("dkim: invalid ARC instance %v", i)
+		}
+		for len(sets) < i {
+			sets = append(sets, [3]string{})
+		}
+		if sets[i-1][idx] != "" {
+			return nil, fmt.Errorf("dkim: duplicate %v for ARC instance %v", fieldName(field), i)
+		}
+		sets[i-1][idx] = field
+	}
+
+	for i, set := range sets {
+		for _, field := range set {
+			if field == "" {
+				return nil, fmt.Errorf("dkim: incomplete ARC set %v", i+1)
+			}
+		}
+	}
+	return sets, nil
+}
+
+// arcInstance returns the value of the i= tag of an ARC header field.
+func arcInstance(field string) (int, error) {
+	value := field[strings.IndexByte(field, ':')+1:]
+	for _, tag := range strings.Split(value, ";") {
+		tag = strings.TrimSpace(tag)
+		if !strings.HasPrefix(tag, "i=") {
+			continue
+		}
+		i, err := strconv.Atoi(strings.TrimSpace(tag[2:]))
+		if err != nil || i < 1 {
+			break
+		}
+		return i, nil
+	}
+	return 0, fmt.Errorf("dkim: missing or invalid ARC instance in %v", fieldName(field))
+}
+
+// authResults returns the results of the topmost Authentication-Results
+// header field added by authServID.
+func authResults(fields []string, authServID string) string {
+	for _, field := range fields {
+		if !strings.EqualFold(fieldName(field), "Authentication-Results") {
+			continue
+		}
+		value := strings.Replace(field[strings.IndexByte(field, ':')+1:], "\r\n", "", -1)
+		parts := strings.SplitN(value, ";", 2)
+		id := strings.Fields(parts[0])
+		if len(id) == 0 || !strings.EqualFold(id[0], authServID) || len(parts) < 2 {
+			continue
+		}
+		return strings.Join(strings.Fields(parts[1]), " ")
+	}
+	return ""
+}
+
+// resultValue returns the result of a method in authentication results.
+func resultValue(results, method string) string {
+	for _, res := range strings.Split(results, ";") {
+		res = strings.TrimSpace(res)
+		if len(res) <= len(method) || !strings.EqualFold(res[:len(method)+1], method+"=") {
+			continue
+		}
+		if v := strings.Fields(res[len(method)+1:]); len(v) > 0 {
+			return strings.ToLower(v[0])
+		}
+	}
+	return ""
+}
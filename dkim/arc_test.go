@@ -0,0 +1,114 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+const forwardedMessage = "Authentication-Results: mx.example.net; spf=pass smtp.mailfrom=football.example.com;\n" +
+	" dkim=pass header.d=football.example.com\n" +
+	"Authentication-Results: attacker.example; dkim=pass\n" +
+	testMessage
+
+func seal(t *testing.T, msg string, options *SealOptions) string {
+	s, err := NewSealer(options)
+	if err != nil {
+		t.Fatalf("NewSealer: %v", err)
+	}
+	s.Write([]byte(msg))
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return s.Headers() + msg
+}
+
+// verifyARC checks the last ARC set of a message and returns its tags.
+func verifyARC(t *testing.T, msg string, pub crypto.PublicKey) (aar string, ams, as map[string]string) {
+	end := headerEnd([]byte(msg), 0)
+	fields := parseHeader([]byte(msg[:end]))
+	sets, err := arcSets(fields)
+	if err != nil {
+		t.Fatalf("arcSets: %v", err)
+	}
+	set := sets[len(sets)-1]
+
+	ams = fieldTags(set[1])
+	checkBodyHash(t, ams, msg[end:])
+	checkSignature(t, set[1], selectHeaders(fields, strings.Split(ams["h"], ":")), CanonicalizationRelaxed, pub)
+
+	as = fieldTags(set[2])
+	var signed []string
+	if as["cv"] != "fail" {
+		for _, prev := range sets[:len(sets)-1] {
+			signed = append(signed, prev[:]...)
+		}
+	}
+	signed = append(signed, set[0], set[1])
+	checkSignature(t, set[2], signed, CanonicalizationRelaxed, pub)
+
+	return set[0], ams, as
+}
+
+func TestSealer(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	options := &SealOptions{
+		Domain:     "example.net",
+		Selector:   "arc",
+		Signer:     key,
+		AuthServID: "mx.example.net",
+	}
+
+	sealed := seal(t, forwardedMessage, options)
+	if !strings.HasPrefix(sealed, "ARC-Seal: i=1;") {
+		t.Fatalf("Missing ARC-Seal:\n%v", sealed)
+	}
+	aar, ams, as := verifyARC(t, sealed, key.Public())
+	want := "ARC-Authentication-Results: i=1; mx.example.net; spf=pass smtp.mailfrom=football.example.com; dkim=pass header.d=football.example.com\r\n"
+	if aar != want {
+		t.Errorf("Invalid ARC-Authentication-Results: got %q, want %q", aar, want)
+	}
+	if ams["i"] != "1" || ams["d"] != "example.net" || ams["h"] != "From:Subject:Date:To:Message-ID" {
+		t.Errorf("Invalid ARC-Message-Signature tags: %v", ams)
+	}
+	if _, ok := ams["v"]; ok {
+		t.Errorf("ARC-Message-Signature must not have a version tag")
+	}
+	if as["i"] != "1" || as["cv"] != "none" {
+		t.Errorf("Invalid ARC-Seal tags: %v", as)
+	}
+
+	// A second hop validated the chain
+	options.Results = "arc=pass; dkim=fail"
+	sealed = seal(t, sealed, options)
+	_, ams, as = verifyARC(t, sealed, key.Public())
+	if ams["i"] != "2" || as["i"] != "2" || as["cv"] != "pass" {
+		t.Errorf("Invalid ARC tags: %v %v", ams, as)
+	}
+
+	// A third one didn't
+	options.Results = ""
+	options.ChainValidation = ChainValidationFail
+	sealed = seal(t, sealed, options)
+	if _, _, as = verifyARC(t, sealed, key.Public()); as["i"] != "3" || as["cv"] != "fail" {
+		t.Errorf("Invalid ARC-Seal tags: %v", as)
+	}
+}
+
+func TestSealer_errors(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := NewSealer(&SealOptions{Domain: "example.net", Selector: "arc", Signer: key}); err == nil {
+		t.Error("Expected an error without authserv-id")
+	}
+
+	s, err := NewSealer(&SealOptions{Domain: "example.net", Selector: "arc", Signer: key, AuthServID: "mx.example.net"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("ARC-Seal: i=2; cv=none\r\n" + testMessage))
+	if err := s.Close(); err == nil {
+		t.Error("Expected an error with an incomplete ARC set")
+	}
+}
@@ -0,0 +1,139 @@
+package dkim
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// Canonicalization is a canonicalization algorithm, see RFC 6376 section 3.4.
+type Canonicalization string
+
+const (
+	// CanonicalizationSimple tolerates almost no modification of the message.
+	CanonicalizationSimple Canonicalization = "simple"
+	// CanonicalizationRelaxed tolerates common modifications such as
+	// whitespace replacement and header field line rewrapping.
+	CanonicalizationRelaxed Canonicalization = "relaxed"
+)
+
+func (c Canonicalization) valid() bool {
+	return c == CanonicalizationSimple || c == CanonicalizationRelaxed
+}
+
+func isWSP(b byte) bool {
+	return b == ' ' || b == '\t'
+}
+
+// compressWSP replaces runs of whitespace with a single space.
+func compressWSP(s []byte) []byte {
+	out := s[:0]
+	space := false
+	for _, b := range s {
+		if isWSP(b) {
+			space = true
+			continue
+		}
+		if space {
+			out = append(out, ' ')
+			space = false
+		}
+		out = append(out, b)
+	}
+	if space {
+		out = append(out, ' ')
+	}
+	return out
+}
+
+// canonicalizeHeader canonicalizes a header field. The field includes its
+// trailing CRLF.
+func canonicalizeHeader(field string, c Canonicalization) string {
+	if c == CanonicalizationSimple {
+		return field
+	}
+
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return field
+	}
+	name := strings.ToLower(strings.TrimRight(field[:i], " \t"))
+
+	value := strings.Replace(field[i+1:], "\r\n", "", -1)
+	value = string(compressWSP([]byte(value)))
+	value = strings.Trim(value, " ")
+	return name + ":" + value + "\r\n"
+}
+
+// bodyCanonicalizer canonicalizes a message body written to it, and writes
+// the result to w. Bare LF line endings are handled as CRLF. Close must be
+// called at the end of the body.
+type bodyCanonicalizer struct {
+	w       io.Writer
+	relaxed bool
+
+	line    []byte
+	crlfs   int // pending empty lines
+	written bool
+}
+
+func newBodyCanonicalizer(w io.Writer, c Canonicalization) *bodyCanonicalizer {
+	return &bodyCanonicalizer{w: w, relaxed: c == CanonicalizationRelaxed}
+}
+
+func (bc *bodyCanonicalizer) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			bc.line = append(bc.line, p...)
+			break
+		}
+		bc.line = append(bc.line, p[:i]...)
+		if err := bc.writeLine(); err != nil {
+			return 0, err
+		}
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+func (bc *bodyCanonicalizer) writeLine() error {
+	line := bytes.TrimSuffix(bc.line, []byte("\r"))
+	bc.line = bc.line[:0]
+
+	if bc.relaxed {
+		line = bytes.TrimRight(compressWSP(line), " ")
+	}
+	if len(line) == 0 {
+		// Empty lines at the end of the body are ignored
+		bc.crlfs++
+		return nil
+	}
+
+	for ; bc.crlfs > 0; bc.crlfs-- {
+		if _, err := io.WriteString(bc.w, "\r\n"); err != nil {
+			return err
+		}
+	}
+	bc.written = true
+	if _, err := bc.w.Write(line); err != nil {
+		return err
+	}
+	_, err := io.WriteString(bc.w, "\r\n")
+	return err
+}
+
+func (bc *bodyCanonicalizer) Close() error {
+	if len(bc.line) > 0 {
+		if err := bc.writeLine(); err != nil {
+			return err
+		}
+	}
+	if !bc.written && !bc.relaxed {
+		// An empty body is canonicalized as a single CRLF
+		_, err := io.WriteString(bc.w, "\r\n")
+		return err
+	}
+	return nil
+}
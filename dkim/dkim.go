@@ -0,0 +1,420 @@
+// Package dkim implements DomainKeys Identified Mail signing, as defined in
+// RFC 6376.
+//
+// Messages are signed with a Signer, which hashes the message while it is
+// written and returns a DKIM-Signature header field to prepend to it, or with
+// a Reader, which prepends the field to the message it reads. RSA (rsa-sha256)
+// and Ed25519 (ed25519-sha256, RFC 8463) keys are supported.
+//
+// Forwarded messages can be sealed with a Sealer, which adds an Authenticated
+// Received Chain (ARC) set as defined in RFC 8617.
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultHeaderKeys is the list of header fields signed by default, when
+// present in the message.
+var DefaultHeaderKeys = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Resent-Date", "Resent-From", "Resent-To", "Resent-Cc",
+	"In-Reply-To", "References", "Message-ID",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+	"List-Id", "List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// SignOptions contains options for signing a message.
+type SignOptions struct {
+	// The signing domain (d= tag) and the selector (s= tag). The public key
+	// is published in DNS at selector._domainkey.domain.
+	Domain   string
+	Selector string
+	// The private key, either a *rsa.PrivateKey or an ed25519.PrivateKey.
+	Signer crypto.Signer
+
+	// The canonicalization algorithms. If empty, relaxed is used.
+	HeaderCanonicalization Canonicalization
+	BodyCanonicalization   Canonicalization
+
+	// The header fields to sign. If nil, the fields of DefaultHeaderKeys
+	// present in the message are signed. Listing a field more times than it
+	// appears in the message prevents new instances from being added. From
+	// must be included.
+	HeaderKeys []string
+
+	// If not zero, signatures expire after this duration (x= tag).
+	Expiration time.Duration
+	// Now returns the signing time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// algorithm returns the signing algorithm name for the key.
+func (options *SignOptions) algorithm() (string, error) {
+	switch options.Signer.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	default:
+		return "", fmt.Errorf("dkim: unsupported key type %T", options.Signer.Public())
+	}
+}
+
+// Keys maps domains to signing options. Domains are lower-case.
+type Keys map[string]*SignOptions
+
+// ForAddress returns the signing options for the domain of an address, or nil
+// if there are none.
+func (keys Keys) ForAddress(addr string) *SignOptions {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return nil
+	}
+	return keys[strings.ToLower(addr[i+1:])]
+}
+
+// Signer signs a message written to it. The message must be written in full,
+// then Close must be called before Signature.
+type Signer struct {
+	options   SignOptions
+	algorithm string
+
+	header   []byte
+	inBody   bool
+	bodyHash hash.Hash
+	body     *bodyCanonicalizer
+
+	signature string
+	closed    bool
+
+	// If not zero, an ARC-Message-Signature is generated for this ARC
+	// instance instead of a DKIM-Signature
+	arcInstance int
+}
+
+// NewSigner creates a new signer.
+func NewSigner(options *SignOptions) (*Signer, error) {
+	if options.Domain == "" || options.Selector == "" {
+		return nil, errors.New("dkim: missing domain or selector")
+	}
+	if options.Signer == nil {
+		return nil, errors.New("dkim: missing signer")
+	}
+	algorithm, err := options.algorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Signer{options: *options, algorithm: algorithm}
+	if s.options.HeaderCanonicalization == "" {
+		s.options.HeaderCanonicalization = CanonicalizationRelaxed
+	}
+	if s.options.BodyCanonicalization == "" {
+		s.options.BodyCanonicalization = CanonicalizationRelaxed
+	}
+	if !s.options.HeaderCanonicalization.valid() || !s.options.BodyCanonicalization.valid() {
+		return nil, errors.New("dkim: unknown canonicalization")
+	}
+	if s.options.HeaderKeys != nil && !hasKey(s.options.HeaderKeys, "From") {
+		return nil, errors.New("dkim: the From header field must be signed")
+	}
+	if s.options.Now == nil {
+		s.options.Now = time.Now
+	}
+
+	s.bodyHash = sha256.New()
+	s.body = newBodyCanonicalizer(s.bodyHash, s.options.BodyCanonicalization)
+	return s, nil
+}
+
+func hasKey(keys []string, k string) bool {
+	for _, key := range keys {
+		if strings.EqualFold(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write implements io.Writer.
+func (s *Signer) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("dkim: write to closed signer")
+	}
+	if s.inBody {
+		return s.body.Write(p)
+	}
+
+	// Look for the blank line ending the header
+	start := len(s.header) - 2
+	if start < 0 {
+		start = 0
+	}
+	s.header = append(s.header, p...)
+	end := headerEnd(s.header, start)
+	if end < 0 {
+		return len(p), nil
+	}
+
+	body := s.header[end:]
+	s.header = s.header[:end]
+	s.inBody = true
+	if _, err := s.body.Write(body); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// headerEnd returns the offset of the body in a message, or -1 if the end of
+// the header hasn't been found. The search starts at offset start.
+func headerEnd(b []byte, start int) int {
+	if start == 0 && len(b) > 0 && b[0] == '\n' {
+		return 1
+	}
+	if start == 0 && bytes.HasPrefix(b, []byte("\r\n")) {
+		return 2
+	}
+	for i := start; i < len(b); i++ {
+		if b[i] != '\n' {
+			continue
+		}
+		switch {
+		case i+1 < len(b) && b[i+1] == '\n':
+			return i + 2
+		case i+2 < len(b) && b[i+1] == '\r' && b[i+2] == '\n':
+			return i + 3
+		}
+	}
+	return -1
+}
+
+// Close finishes signing the message.
+func (s *Signer) Close() error {
+	if s.closed {
+		return nil
+	}
+	fields, err := s.finish()
+	if err != nil {
+		return err
+	}
+	sig, err := s.sign(fields)
+	if err != nil {
+		return err
+	}
+	s.signature = sig
+	return nil
+}
+
+// finish ends the message body and returns the header fields.
+func (s *Signer) finish() ([]string, error) {
+	s.closed = true
+	if err := s.body.Close(); err != nil {
+		return nil, err
+	}
+	return parseHeader(s.header), nil
+}
+
+// Signature returns the DKIM-Signature header field, including its trailing
+// CRLF. It must be called after Close.
+func (s *Signer) Signature() string {
+	return s.signature
+}
+
+// parseHeader splits a message header into fields. Line endings are
+// normalized to CRLF, and each field includes its trailing CRLF.
+func parseHeader(b []byte) []string {
+	var fields []string
+	var cur strings.Builder
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		if isWSP(line[0]) && cur.Len() > 0 {
+			cur.WriteString(line)
+			cur.WriteString("\r\n")
+			continue
+		}
+		if cur.Len() > 0 {
+			fields = append(fields, cur.String())
+			cur.Reset()
+		}
+		cur.WriteString(line)
+		cur.WriteString("\r\n")
+	}
+	if cur.Len() > 0 {
+		fields = append(fields, cur.String())
+	}
+	return fields
+}
+
+func fieldName(field string) string {
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimRight(field[:i], " \t")
+}
+
+// selectHeaders returns the header fields to sign for keys, see RFC 6376
+// section 5.4.2: for each key, the last instance not selected yet is used.
+func selectHeaders(fields []string, keys []string) []string {
+	used := make([]bool, len(fields))
+	var selected []string
+	for _, key := range keys {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fieldName(fields[i]), key) {
+				used[i] = true
+				selected = append(selected, fields[i])
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// headerKeys returns the header keys to sign.
+func (s *Signer) headerKeys(fields []string) []string {
+	if s.options.HeaderKeys != nil {
+		return s.options.HeaderKeys
+	}
+	defaultKeys := DefaultHeaderKeys
+	if s.arcInstance > 0 {
+		defaultKeys = append(defaultKeys[:len(defaultKeys):len(defaultKeys)], "DKIM-Signature")
+	}
+	var keys []string
+	for _, key := range defaultKeys {
+		for _, field := range fields {
+			if strings.EqualFold(fieldName(field), key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+func (s *Signer) sign(fields []string) (string, error) {
+	keys := s.headerKeys(fields)
+	if !hasKey(keys, "From") {
+		return "", errors.New("dkim: message has no From header field")
+	}
+
+	name, version := "DKIM-Signature", "v=1"
+	if s.arcInstance > 0 {
+		name, version = "ARC-Message-Signature", "i="+strconv.Itoa(s.arcInstance)
+	}
+
+	now := s.options.Now()
+	tags := []string{
+		version,
+		"a=" + s.algorithm,
+		"c=" + string(s.options.HeaderCanonicalization) + "/" + string(s.options.BodyCanonicalization),
+		"d=" + s.options.Domain,
+		"s=" + s.options.Selector,
+		"t=" + strconv.FormatInt(now.Unix(), 10),
+	}
+	if s.options.Expiration > 0 {
+		tags = append(tags, "x="+strconv.FormatInt(now.Add(s.options.Expiration).Unix(), 10))
+	}
+	tags = append(tags,
+		"h="+strings.Join(keys, ":"),
+		"bh="+base64.StdEncoding.EncodeToString(s.bodyHash.Sum(nil)),
+	)
+
+	return signHeader(name, tags, selectHeaders(fields, keys), s.options.HeaderCanonicalization, s.options.Signer)
+}
+
+// signHeader formats a signature header field with tags and an empty b= tag,
+// hashes the signed header fields followed by this field, and returns the
+// field with the b= tag filled in.
+func signHeader(name string, tags []string, signed []string, c Canonicalization, signer crypto.Signer) (string, error) {
+	field := foldTags(name, append(tags, "b="))
+
+	h := sha256.New()
+	for _, f := range signed {
+		io.WriteString(h, canonicalizeHeader(f, c))
+	}
+	io.WriteString(h, strings.TrimSuffix(canonicalizeHeader(field, c), "\r\n"))
+	hashed := h.Sum(nil)
+
+	var sig []byte
+	var err error
+	switch signer.Public().(type) {
+	case ed25519.PublicKey:
+		sig, err = signer.Sign(rand.Reader, hashed, crypto.Hash(0))
+	default:
+		sig, err = signer.Sign(rand.Reader, hashed, crypto.SHA256)
+	}
+	if err != nil {
+		return "", fmt.Errorf("dkim: failed to sign: %v", err)
+	}
+
+	return strings.TrimSuffix(field, "\r\n") + foldValue(base64.StdEncoding.EncodeToString(sig)) + "\r\n", nil
+}
+
+// maxLineLen is the line length after which header fields are folded.
+const maxLineLen = 76
+
+// foldTags formats a header field from tags, folding lines between tags.
+func foldTags(name string, tags []string) string {
+	var sb strings.Builder
+	sb.WriteString(name)
+	sb.WriteString(":")
+	lineLen := sb.Len()
+	for i, tag := range tags {
+		if i > 0 {
+			sb.WriteString(";")
+			lineLen++
+		}
+		if lineLen+1+len(tag) > maxLineLen {
+			sb.WriteString("\r\n")
+			lineLen = 0
+		}
+		sb.WriteString(" ")
+		sb.WriteString(tag)
+		lineLen += 1 + len(tag)
+	}
+	sb.WriteString("\r\n")
+	return sb.String()
+}
+
+// foldValue folds a base64 value on several lines. Whitespace in the b= tag is
+// ignored by verifiers.
+func foldValue(v string) string {
+	var sb strings.Builder
+	for len(v) > 0 {
+		n := maxLineLen - 1
+		if n > len(v) {
+			n = len(v)
+		}
+		sb.WriteString("\r\n ")
+		sb.WriteString(v[:n])
+		v = v[n:]
+	}
+	return sb.String()
+}
+
+// Sign reads a message from r, and writes it to w with a DKIM-Signature
+// header field prepended.
+func Sign(w io.Writer, r io.Reader, options *SignOptions) error {
+	sr, err := NewReader(r, options)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, sr)
+	return err
+}
@@ -0,0 +1,264 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Example from RFC 6376 section 3.4.5
+const canonicalizationMessage = "A: X\r\n" +
+	"B : Y\t\r\n" +
+	"\tZ  \r\n" +
+	"\r\n" +
+	" C \r\n" +
+	"D \t E\r\n" +
+	"\r\n" +
+	"\r\n"
+
+func TestCanonicalization(t *testing.T) {
+	end := headerEnd([]byte(canonicalizationMessage), 0)
+	fields := parseHeader([]byte(canonicalizationMessage[:end]))
+	body := canonicalizationMessage[end:]
+
+	tests := []struct {
+		c            Canonicalization
+		header, body string
+	}{
+		{CanonicalizationRelaxed, "a:X\r\nb:Y Z\r\n", " C\r\nD E\r\n"},
+		{CanonicalizationSimple, "A: X\r\nB : Y\t\r\n\tZ  \r\n", " C \r\nD \t E\r\n"},
+	}
+	for _, test := range tests {
+		var header string
+		for _, f := range fields {
+			header += canonicalizeHeader(f, test.c)
+		}
+		if header != test.header {
+			t.Errorf("%v header: got %q, want %q", test.c, header, test.header)
+		}
+
+		var buf bytes.Buffer
+		bc := newBodyCanonicalizer(&buf, test.c)
+		// Write byte by byte to exercise line buffering
+		for i := 0; i < len(body); i++ {
+			bc.Write([]byte{body[i]})
+		}
+		bc.Close()
+		if buf.String() != test.body {
+			t.Errorf("%v body: got %q, want %q", test.c, buf.String(), test.body)
+		}
+	}
+}
+
+func TestCanonicalization_emptyBody(t *testing.T) {
+	tests := []struct {
+		c          Canonicalization
+		body, want string
+	}{
+		{CanonicalizationSimple, "", "\r\n"},
+		{CanonicalizationSimple, "\n\n  \n", "\r\n\r\n  \r\n"},
+		{CanonicalizationRelaxed, "", ""},
+		{CanonicalizationRelaxed, "\n\n  \n", ""},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		bc := newBodyCanonicalizer(&buf, test.c)
+		bc.Write([]byte(test.body))
+		bc.Close()
+		if buf.String() != test.want {
+			t.Errorf("%v %q: got %q, want %q", test.c, test.body, buf.String(), test.want)
+		}
+	}
+}
+
+const testMessage = "From: Joe SixPack <joe@football.example.com>\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\n" +
+	"Subject: Is dinner ready?\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\n" +
+	"\n" +
+	"Hi.\n" +
+	"\n" +
+	"We lost the game. Are you hungry yet?\n" +
+	"\n" +
+	"Joe.\n"
+
+var tagRegexp = regexp.MustCompile(`([a-z]+)=([^;]*)`)
+
+// fieldTags parses the tags of a signature header field.
+func fieldTags(field string) map[string]string {
+	tags := make(map[string]string)
+	unfolded := strings.Replace(field[strings.IndexByte(field, ':')+1:], "\r\n", "", -1)
+	for _, m := range tagRegexp.FindAllStringSubmatch(unfolded, -1) {
+		tags[m[1]] = strings.Join(strings.Fields(m[2]), "")
+	}
+	return tags
+}
+
+// checkBodyHash checks the bh= tag of a signature.
+func checkBodyHash(t *testing.T, tags map[string]string, body string) {
+	var buf bytes.Buffer
+	bc := newBodyCanonicalizer(&buf, Canonicalization(strings.SplitN(tags["c"], "/", 2)[1]))
+	bc.Write([]byte(body))
+	bc.Close()
+	bh := sha256.Sum256(buf.Bytes())
+	if got := base64.StdEncoding.EncodeToString(bh[:]); got != tags["bh"] {
+		t.Fatalf("Invalid body hash: got %v, want %v", tags["bh"], got)
+	}
+}
+
+// checkSignature checks the b= tag of a signature header field over signed
+// header fields.
+func checkSignature(t *testing.T, field string, signed []string, c Canonicalization, pub crypto.PublicKey) {
+	h := sha256.New()
+	for _, f := range signed {
+		h.Write([]byte(canonicalizeHeader(f, c)))
+	}
+	i := strings.Index(field, "b=\r\n")
+	h.Write([]byte(strings.TrimSuffix(canonicalizeHeader(field[:i+2]+"\r\n", c), "\r\n")))
+	hashed := h.Sum(nil)
+
+	sig, err := base64.StdEncoding.DecodeString(fieldTags(field)["b"])
+	if err != nil {
+		t.Fatalf("Invalid signature encoding: %v", err)
+	}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed, sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, hashed, sig) {
+			err = rsa.ErrVerification
+		}
+	}
+	if err != nil {
+		t.Fatalf("Invalid %v: %v", fieldName(field), err)
+	}
+}
+
+// verify checks a signed message, using the package canonicalization
+// functions.
+func verify(t *testing.T, signed string, pub crypto.PublicKey) map[string]string {
+	end := headerEnd([]byte(signed), 0)
+	fields := parseHeader([]byte(signed[:end]))
+	sigField := fields[0]
+	if fieldName(sigField) != "DKIM-Signature" {
+		t.Fatalf("Missing DKIM-Signature: %q", sigField)
+	}
+
+	tags := fieldTags(sigField)
+	checkBodyHash(t, tags, signed[end:])
+	c := Canonicalization(strings.SplitN(tags["c"], "/", 2)[0])
+	checkSignature(t, sigField, selectHeaders(fields[1:], strings.Split(tags["h"], ":")), c, pub)
+	return tags
+}
+
+func TestSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1424197300, 0)
+
+	for _, signer := range []crypto.Signer{rsaKey, edKey} {
+		for _, c := range []Canonicalization{CanonicalizationSimple, CanonicalizationRelaxed} {
+			options := &SignOptions{
+				Domain:                 "football.example.com",
+				Selector:               "brisbane",
+				Signer:                 signer,
+				HeaderCanonicalization: c,
+				BodyCanonicalization:   c,
+				Expiration:             time.Hour,
+				Now:                    func() time.Time { return now },
+			}
+
+			var buf bytes.Buffer
+			if err := Sign(&buf, strings.NewReader(testMessage), options); err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+			if !strings.HasSuffix(buf.String(), testMessage) {
+				t.Fatalf("Message modified:\n%v", buf.String())
+			}
+			sig := strings.TrimSuffix(buf.String(), testMessage)
+			for _, line := range strings.Split(sig, "\r\n") {
+				if len(line) > 78 {
+					t.Errorf("Line too long: %q", line)
+				}
+			}
+
+			tags := verify(t, buf.String(), signer.Public())
+			if tags["h"] != "From:Subject:Date:To:Message-ID" {
+				t.Errorf("Invalid signed header fields: %v", tags["h"])
+			}
+			if tags["t"] != "1424197300" || tags["x"] != "1424200900" {
+				t.Errorf("Invalid timestamps: t=%v x=%v", tags["t"], tags["x"])
+			}
+			if tags["c"] != string(c)+"/"+string(c) {
+				t.Errorf("Invalid canonicalization: %v", tags["c"])
+			}
+		}
+	}
+}
+
+func TestSigner_streaming(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	s, err := NewSigner(&SignOptions{
+		Domain:     "football.example.com",
+		Selector:   "brisbane",
+		Signer:     key,
+		HeaderKeys: []string{"From", "Subject", "Subject"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Split the header/body separator across writes
+	for _, chunk := range strings.SplitAfter(testMessage, "\n") {
+		s.Write([]byte(chunk))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tags := verify(t, s.Signature()+testMessage, key.Public())
+	if tags["h"] != "From:Subject:Subject" {
+		t.Errorf("Invalid signed header fields: %v", tags["h"])
+	}
+}
+
+func TestSigner_errors(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := NewSigner(&SignOptions{Domain: "example.org", Selector: "s", Signer: key, HeaderKeys: []string{"To"}}); err == nil {
+		t.Error("Expected an error when From isn't signed")
+	}
+	if _, err := NewSigner(&SignOptions{Domain: "example.org", Signer: key}); err == nil {
+		t.Error("Expected an error without a selector")
+	}
+
+	var buf bytes.Buffer
+	err := Sign(&buf, strings.NewReader("Subject: hi\r\n\r\nHello\r\n"), &SignOptions{Domain: "example.org", Selector: "s", Signer: key})
+	if err == nil {
+		t.Error("Expected an error without a From header field")
+	}
+}
+
+func TestKeys_ForAddress(t *testing.T) {
+	options := &SignOptions{Domain: "example.org"}
+	keys := Keys{"example.org": options}
+	if keys.ForAddress("alice@Example.ORG") != options {
+		t.Error("Expected options for example.org")
+	}
+	if keys.ForAddress("alice@example.com") != nil || keys.ForAddress("") != nil {
+		t.Error("Expected no options")
+	}
+}
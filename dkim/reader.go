@@ -0,0 +1,95 @@
+package dkim
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// Reader reads a message prefixed with its DKIM-Signature header field.
+//
+// The signature covers the whole message, so the message is signed on the
+// first call to Read or Len. If the underlying reader is an io.Seeker, such
+// as an *os.File, the message is read twice. Otherwise, it is held in memory.
+type Reader struct {
+	r      io.Reader
+	signer *Signer
+
+	signed bool
+	err    error
+	mr     io.Reader
+	left   int64
+}
+
+// NewReader creates a reader signing the message read from r.
+func NewReader(r io.Reader, options *SignOptions) (*Reader, error) {
+	signer, err := NewSigner(options)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: r, signer: signer}, nil
+}
+
+func (r *Reader) sign() error {
+	if r.signed {
+		return r.err
+	}
+	r.signed = true
+
+	body, size, err := r.readBody()
+	if err == nil {
+		err = r.signer.Close()
+	}
+	if err != nil {
+		r.err = err
+		return err
+	}
+
+	sig := r.signer.Signature()
+	r.mr = io.MultiReader(strings.NewReader(sig), body)
+	r.left = int64(len(sig)) + size
+	return nil
+}
+
+// readBody writes the message to the signer, and returns a reader for the
+// message and its size.
+func (r *Reader) readBody() (io.Reader, int64, error) {
+	if seeker, ok := r.r.(io.Seeker); ok {
+		// Pipes implement io.Seeker but fail to seek
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			size, err := io.Copy(r.signer, r.r)
+			if err != nil {
+				return nil, 0, err
+			}
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, 0, err
+			}
+			return r.r, size, nil
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(io.MultiWriter(&buf, r.signer), r.r); err != nil {
+		return nil, 0, err
+	}
+	return &buf, int64(buf.Len()), nil
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	if err := r.sign(); err != nil {
+		return 0, err
+	}
+	n, err := r.mr.Read(p)
+	r.left -= int64(n)
+	return n, err
+}
+
+// Len returns the number of bytes left to read, or zero if signing failed.
+// The error is returned by Read.
+func (r *Reader) Len() int {
+	if err := r.sign(); err != nil {
+		return 0
+	}
+	return int(r.left)
+}
@@ -0,0 +1,92 @@
+package dkim
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	options := &SignOptions{
+		Domain:   "football.example.com",
+		Selector: "brisbane",
+		Signer:   key,
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "msg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := io.WriteString(f, "Prefix\r\n"+testMessage); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(int64(len("Prefix\r\n")), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		r    io.Reader
+	}{
+		{"seeker", f},
+		{"buffered", ioutil.NopCloser(strings.NewReader(testMessage))},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewReader(tc.r, options)
+			if err != nil {
+				t.Fatalf("NewReader: %v", err)
+			}
+			n := r.Len()
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			if n != len(b) {
+				t.Errorf("Len() = %v, but read %v bytes", n, len(b))
+			}
+			if r.Len() != 0 {
+				t.Errorf("Len() = %v after reading the message", r.Len())
+			}
+			if !strings.HasSuffix(string(b), "\r\n"+testMessage) {
+				t.Fatalf("Message modified:\n%v", string(b))
+			}
+			verify(t, string(b), pub)
+		})
+	}
+}
+
+func TestReader_errors(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := NewReader(strings.NewReader(testMessage), &SignOptions{Signer: key}); err == nil {
+		t.Error("Expected an error without domain and selector")
+	}
+
+	r, err := NewReader(&errReader{}, &SignOptions{
+		Domain:   "football.example.com",
+		Selector: "brisbane",
+		Signer:   key,
+	})
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if r.Len() != 0 {
+		t.Errorf("Len() = %v, want 0", r.Len())
+	}
+	if _, err := r.Read(make([]byte, 1)); err != io.ErrUnexpectedEOF {
+		t.Errorf("Read: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
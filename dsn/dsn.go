@@ -0,0 +1,276 @@
+// Package dsn generates delivery status notifications, as defined in RFC 3464.
+package dsn
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Action is the action performed for a recipient.
+type Action string
+
+// Actions, see RFC 3464 section 2.3.3.
+const (
+	ActionFailed    Action = "failed"
+	ActionDelayed   Action = "delayed"
+	ActionDelivered Action = "delivered"
+	ActionRelayed   Action = "relayed"
+	ActionExpanded  Action = "expanded"
+)
+
+// Recipient holds the per-recipient fields of a report.
+type Recipient struct {
+	FinalRecipient    string
+	OriginalRecipient string
+	Action            Action
+	// Status is the enhanced status code. If not set, X.0.0 is used, with X
+	// derived from Action.
+	Status smtp.EnhancedCode
+	// RemoteMTA is the host name of the server which reported the status.
+	RemoteMTA string
+	// DiagnosticCode is the reply received from RemoteMTA, if any.
+	DiagnosticCode string
+	LastAttempt    time.Time
+	WillRetryUntil time.Time
+}
+
+// RecipientFromError returns the report fields of a recipient for which
+// delivery failed with err. The status and diagnostic code are extracted from
+// *smtp.SMTPError values.
+func RecipientFromError(rcpt string, action Action, err error) Recipient {
+	r := Recipient{
+		FinalRecipient: rcpt,
+		Action:         action,
+		LastAttempt:    time.Now(),
+	}
+	if rcptErr, ok := err.(*smtp.RcptError); ok {
+		err = rcptErr.Err
+	}
+	if smtpErr, ok := err.(*smtp.SMTPError); ok && smtpErr.Code != 0 {
+		r.Status = smtpErr.EnhancedCode
+		if r.Status == smtp.NoEnhancedCode || r.Status == smtp.EnhancedCodeNotSet {
+			r.Status = smtp.EnhancedCode{smtpErr.Code / 100, 0, 0}
+		}
+		r.DiagnosticCode = strings.Replace(smtpErr.Error(), "\n", " ", -1)
+	}
+	return r
+}
+
+func (r *Recipient) status() smtp.EnhancedCode {
+	if r.Status != smtp.EnhancedCodeNotSet && r.Status != smtp.NoEnhancedCode {
+		return r.Status
+	}
+	switch r.Action {
+	case ActionFailed:
+		return smtp.EnhancedCode{5, 0, 0}
+	case ActionDelayed:
+		return smtp.EnhancedCode{4, 0, 0}
+	default:
+		return smtp.EnhancedCode{2, 0, 0}
+	}
+}
+
+// Report is a delivery status notification.
+type Report struct {
+	// ReportingMTA is the host name of the server generating the report.
+	ReportingMTA string
+	// To is the address the report is sent to, usually the envelope sender of
+	// the original message.
+	To string
+	// EnvelopeID is the ENVID parameter of the original message, if any.
+	EnvelopeID  string
+	ArrivalDate time.Time
+	Recipients  []Recipient
+
+	// Original is the original message, if available.
+	Original io.Reader
+	// If set, only the header of the original message is included.
+	HeadersOnly bool
+}
+
+func (r *Report) subject() string {
+	action := ActionFailed
+	if len(r.Recipients) > 0 {
+		action = r.Recipients[0].Action
+	}
+	switch action {
+	case ActionFailed:
+		return "Undelivered Mail Returned to Sender"
+	case ActionDelayed:
+		return "Delayed Mail (still being retried)"
+	default:
+		return "Successful Mail Delivery Report"
+	}
+}
+
+func (r *Report) writeText(w io.Writer) {
+	fmt.Fprintf(w, "This is the mail system at host %v.\r\n\r\n", r.ReportingMTA)
+
+	groups := []struct {
+		action Action
+		text   string
+	}{
+		{ActionFailed, "Your message could not be delivered to the following recipients:"},
+		{ActionDelayed, "Your message could not be delivered yet to the following recipients. Delivery will be retried:"},
+		{ActionDelivered, "Your message was successfully delivered to the following recipients:"},
+		{ActionRelayed, "Your message was relayed to the following recipients:"},
+		{ActionExpanded, "Your message was delivered to the following mailing lists:"},
+	}
+	for _, g := range groups {
+		first := true
+		for _, rcpt := range r.Recipients {
+			if rcpt.Action != g.action {
+				continue
+			}
+			if first {
+				fmt.Fprintf(w, "%v\r\n\r\n", g.text)
+				first = false
+			}
+			fmt.Fprintf(w, "<%v>", rcpt.FinalRecipient)
+			if rcpt.DiagnosticCode != "" {
+				fmt.Fprintf(w, ": %v", rcpt.DiagnosticCode)
+			}
+			io.WriteString(w, "\r\n")
+		}
+		if !first {
+			io.WriteString(w, "\r\n")
+		}
+	}
+}
+
+func (r *Report) writeStatus(w io.Writer) {
+	fmt.Fprintf(w, "Reporting-MTA: dns; %v\r\n", r.ReportingMTA)
+	if r.EnvelopeID != "" {
+		fmt.Fprintf(w, "Original-Envelope-Id: %v\r\n", r.EnvelopeID)
+	}
+	if !r.ArrivalDate.IsZero() {
+		fmt.Fprintf(w, "Arrival-Date: %v\r\n", r.ArrivalDate.Format(time.RFC1123Z))
+	}
+
+	for _, rcpt := range r.Recipients {
+		io.WriteString(w, "\r\n")
+		if rcpt.OriginalRecipient != "" {
+			fmt.Fprintf(w, "Original-Recipient: rfc822; %v\r\n", rcpt.OriginalRecipient)
+		}
+		fmt.Fprintf(w, "Final-Recipient: rfc822; %v\r\n", rcpt.FinalRecipient)
+		fmt.Fprintf(w, "Action: %v\r\n", rcpt.Action)
+		fmt.Fprintf(w, "Status: %v\r\n", rcpt.status())
+		if rcpt.RemoteMTA != "" {
+			fmt.Fprintf(w, "Remote-MTA: dns; %v\r\n", rcpt.RemoteMTA)
+		}
+		if rcpt.DiagnosticCode != "" {
+			fmt.Fprintf(w, "Diagnostic-Code: smtp; %v\r\n", rcpt.DiagnosticCode)
+		}
+		if !rcpt.LastAttempt.IsZero() {
+			fmt.Fprintf(w, "Last-Attempt-Date: %v\r\n", rcpt.LastAttempt.Format(time.RFC1123Z))
+		}
+		if !rcpt.WillRetryUntil.IsZero() {
+			fmt.Fprintf(w, "Will-Retry-Until: %v\r\n", rcpt.WillRetryUntil.Format(time.RFC1123Z))
+		}
+	}
+}
+
+// writeOriginal copies the original message, or only its header.
+func (r *Report) writeOriginal(w io.Writer) error {
+	if !r.HeadersOnly {
+		_, err := io.Copy(w, r.Original)
+		return err
+	}
+
+	br := bufio.NewReader(r.Original)
+	for {
+		line, err := br.ReadString('\n')
+		if line == "\n" || line == "\r\n" {
+			return nil
+		}
+		if _, werr := io.WriteString(w, line); werr != nil {
+			return werr
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+// WriteTo writes the report as a multipart/report message.
+func (r *Report) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	mw := multipart.NewWriter(cw)
+
+	var id [12]byte
+	rand.Read(id[:])
+
+	var h strings.Builder
+	fmt.Fprintf(&h, "From: Mail Delivery System <MAILER-DAEMON@%v>\r\n", r.ReportingMTA)
+	fmt.Fprintf(&h, "To: <%v>\r\n", r.To)
+	fmt.Fprintf(&h, "Subject: %v\r\n", r.subject())
+	fmt.Fprintf(&h, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&h, "Message-Id: <%v@%v>\r\n", hex.EncodeToString(id[:]), r.ReportingMTA)
+	h.WriteString("Auto-Submitted: auto-replied\r\n")
+	h.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&h, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%v\"\r\n", mw.Boundary())
+	h.WriteString("\r\n")
+	if _, err := io.WriteString(cw, h.String()); err != nil {
+		return cw.n, err
+	}
+
+	pw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"text/plain; charset=utf-8"},
+		"Content-Description": {"Notification"},
+	})
+	if err != nil {
+		return cw.n, err
+	}
+	r.writeText(pw)
+
+	pw, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"message/delivery-status"},
+		"Content-Description": {"Delivery report"},
+	})
+	if err != nil {
+		return cw.n, err
+	}
+	r.writeStatus(pw)
+
+	if r.Original != nil {
+		contentType := "message/rfc822"
+		if r.HeadersOnly {
+			contentType = "text/rfc822-headers"
+		}
+		pw, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":        {contentType},
+			"Content-Description": {"Undelivered message"},
+		})
+		if err != nil {
+			return cw.n, err
+		}
+		if err := r.writeOriginal(pw); err != nil {
+			return cw.n, err
+		}
+	}
+
+	err = mw.Close()
+	return cw.n, err
+}
@@ -0,0 +1,85 @@
+package dsn_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/dsn"
+)
+
+func TestReport(t *testing.T) {
+	smtpErr := &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "No such user",
+	}
+	rcpt := dsn.RecipientFromError("bob@example.org", dsn.ActionFailed, smtpErr)
+	rcpt.RemoteMTA = "mx.example.org"
+
+	report := &dsn.Report{
+		ReportingMTA: "mail.example.com",
+		To:           "alice@example.com",
+		Recipients: []dsn.Recipient{
+			rcpt,
+			{FinalRecipient: "carol@example.org", Action: dsn.ActionDelayed},
+		},
+		Original:    strings.NewReader("Subject: Hi\r\n\r\nHello!\r\n"),
+		HeadersOnly: true,
+	}
+
+	var b bytes.Buffer
+	if _, err := report.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	msg, err := mail.ReadMessage(&b)
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if subject := msg.Header.Get("Subject"); subject != "Undelivered Mail Returned to Sender" {
+		t.Errorf("Subject = %q", subject)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("ParseMediaType: %v", err)
+	}
+	if mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Errorf("unexpected Content-Type %q", msg.Header.Get("Content-Type"))
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	var parts []string
+	var bodies []string
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(p)
+		parts = append(parts, p.Header.Get("Content-Type"))
+		bodies = append(bodies, string(body))
+	}
+	if len(parts) != 3 || parts[1] != "message/delivery-status" || parts[2] != "text/rfc822-headers" {
+		t.Fatalf("unexpected parts %v", parts)
+	}
+
+	status := bodies[1]
+	for _, want := range []string{
+		"Reporting-MTA: dns; mail.example.com\r\n",
+		"Final-Recipient: rfc822; bob@example.org\r\nAction: failed\r\nStatus: 5.1.1\r\nRemote-MTA: dns; mx.example.org\r\nDiagnostic-Code: smtp; 550 5.1.1 No such user\r\n",
+		"Final-Recipient: rfc822; carol@example.org\r\nAction: delayed\r\nStatus: 4.0.0\r\n",
+	} {
+		if !strings.Contains(status, want) {
+			t.Errorf("delivery status doesn't contain %q:\n%v", want, status)
+		}
+	}
+	if bodies[2] != "Subject: Hi\r\n" {
+		t.Errorf("unexpected original headers %q", bodies[2])
+	}
+}
@@ -5,6 +5,7 @@
 package smtp_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -61,7 +62,7 @@ var (
 	recipients = []string{"foo@example.com"}
 )
 
-func ExampleSendMail_PlainAuth() {
+func ExampleSendMail_plainAuth() {
 	// hostname is used by PlainAuth to validate the TLS certificate.
 	hostname := "mail.example.com"
 	auth := sasl.NewPlainClient("", "user@example.com", "password")
@@ -89,6 +90,20 @@ func ExampleSendMail() {
 	}
 }
 
+func ExampleSendMailContext() {
+	auth := sasl.NewPlainClient("", "user@example.com", "password")
+
+	// The transaction fails if it takes more than a minute, or if the server
+	// doesn't support STARTTLS
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := smtp.SendMailContext(ctx, "mail.example.com:587", auth, from, recipients, msg, nil)
+	var sendErr *smtp.SendError
+	if errors.As(err, &sendErr) {
+		log.Fatalf("failed to send message at stage %v: %v", sendErr.Stage, sendErr.Err)
+	}
+}
+
 // The Backend implements SMTP server methods.
 type Backend struct{}
 
@@ -151,3 +166,21 @@ func ExampleNewServer() {
 		log.Fatal(err)
 	}
 }
+
+func ExampleNewServer_options() {
+	be := &Backend{}
+
+	s := smtp.NewServer(be,
+		smtp.WithAddr(":1025"),
+		smtp.WithDomain("localhost"),
+		smtp.WithTimeouts(10*time.Second, 10*time.Second),
+		smtp.WithMaxSize(1024*1024),
+		smtp.WithMaxRecipients(50),
+		smtp.WithInsecureAuth(),
+	)
+
+	log.Println("Starting server at", s.Addr)
+	if err := s.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
+}
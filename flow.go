@@ -0,0 +1,281 @@
+package smtp
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// DataStallPolicy defines what happens when the backend consumes message data
+// slower than the client sends it and the data buffer stays full for longer
+// than Server.DataStallTimeout.
+type DataStallPolicy int
+
+const (
+	// DataStallWait stops reading from the client until the backend catches
+	// up. TCP flow control then slows down the client.
+	DataStallWait DataStallPolicy = iota
+	// DataStallAbort aborts the transaction: the backend reader returns
+	// ErrDataStalled and the rest of the message is discarded.
+	DataStallAbort
+)
+
+// ErrDataStalled is returned by the message reader passed to Session.Data
+// when the transaction is aborted because the backend is too slow.
+var ErrDataStalled = &SMTPError{
+	Code:         451,
+	EnhancedCode: EnhancedCode{4, 3, 0},
+	Message:      "Message processing too slow, try again later",
+}
+
+// DataFlowStats contains statistics about message data buffering.
+type DataFlowStats struct {
+	// The number of times reading from the client has been paused because the
+	// data buffer was full.
+	Stalls uint64
+	// The total time spent waiting for the backend while the buffer was full.
+	StallTime time.Duration
+	// The number of transactions aborted because of DataStallAbort.
+	Aborts uint64
+	// The largest number of bytes held in a data buffer.
+	MaxBuffered int
+}
+
+type dataFlowCounters struct {
+	mu    sync.Mutex
+	stats DataFlowStats
+}
+
+func (fc *dataFlowCounters) add(stalls uint64, stallTime time.Duration, aborted bool, maxBuffered int) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.stats.Stalls += stalls
+	fc.stats.StallTime += stallTime
+	if aborted {
+		fc.stats.Aborts++
+	}
+	if maxBuffered > fc.stats.MaxBuffered {
+		fc.stats.MaxBuffered = maxBuffered
+	}
+}
+
+func (fc *dataFlowCounters) get() DataFlowStats {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.stats
+}
+
+// flowBuffer is a bounded pipe between the goroutine reading message data from
+// the client and the backend.
+type flowBuffer struct {
+	mu       sync.Mutex
+	readable *sync.Cond
+	writable *sync.Cond
+
+	buf  []byte // ring buffer
+	r, n int
+
+	stallTimeout time.Duration
+	policy       DataStallPolicy
+
+	werr    error // set when the writer is done
+	aborted bool
+	rclosed bool
+	stalled bool
+	// stallGen identifies the current wait, so that the stall timer of a
+	// previous wait doesn't mark the current one as stalled
+	stallGen uint64
+
+	stalls      uint64
+	stallTime   time.Duration
+	maxBuffered int
+}
+
+func newFlowBuffer(size int, stallTimeout time.Duration, policy DataStallPolicy) *flowBuffer {
+	fb := &flowBuffer{
+		buf:          make([]byte, size),
+		stallTimeout: stallTimeout,
+		policy:       policy,
+	}
+	fb.readable = sync.NewCond(&fb.mu)
+	fb.writable = sync.NewCond(&fb.mu)
+	return fb
+}
+
+// waitWritable waits until the buffer has room, the reader is gone or the
+// stall policy aborts the transaction. fb.mu must be held.
+func (fb *flowBuffer) waitWritable() {
+	if fb.n < len(fb.buf) || fb.rclosed || fb.aborted {
+		return
+	}
+
+	fb.stalls++
+	start := time.Now()
+	var timer *time.Timer
+	if fb.stallTimeout > 0 {
+		fb.stalled = false
+		fb.stallGen++
+		gen := fb.stallGen
+		timer = time.AfterFunc(fb.stallTimeout, func() {
+			fb.mu.Lock()
+			// The timer may fire after Stop, while a later wait runs
+			if fb.stallGen == gen {
+				fb.stalled = true
+				fb.writable.Broadcast()
+			}
+			fb.mu.Unlock()
+		})
+	}
+
+	for fb.n == len(fb.buf) && !fb.rclosed {
+		if fb.stalled && fb.policy == DataStallAbort {
+			fb.aborted = true
+			fb.readable.Broadcast()
+			break
+		}
+		fb.writable.Wait()
+	}
+
+	if timer != nil {
+		timer.Stop()
+		fb.stallGen++
+	}
+	fb.stallTime += time.Since(start)
+}
+
+// Write copies p into the buffer, blocking while it is full. Data is
+// discarded once the reader is closed or the transaction is aborted.
+func (fb *flowBuffer) Write(p []byte) (int, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	written := len(p)
+	for len(p) > 0 {
+		fb.waitWritable()
+		if fb.rclosed || fb.aborted {
+			break
+		}
+
+		w := (fb.r + fb.n) % len(fb.buf)
+		end := len(fb.buf)
+		if w < fb.r {
+			end = fb.r
+		}
+		if free := len(fb.buf) - fb.n; end-w > free {
+			end = w + free
+		}
+		k := copy(fb.buf[w:end], p)
+		fb.n += k
+		p = p[k:]
+
+		if fb.n > fb.maxBuffered {
+			fb.maxBuffered = fb.n
+		}
+		fb.readable.Signal()
+	}
+	return written, nil
+}
+
+// closeWrite marks the end of the data. err is returned to the reader once
+// the buffer is drained; nil means io.EOF.
+func (fb *flowBuffer) closeWrite(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	fb.werr = err
+	fb.readable.Broadcast()
+}
+
+// Read implements io.Reader.
+func (fb *flowBuffer) Read(p []byte) (int, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	for fb.n == 0 && fb.werr == nil && !fb.aborted {
+		fb.readable.Wait()
+	}
+	if fb.aborted {
+		return 0, ErrDataStalled
+	}
+	if fb.n == 0 {
+		return 0, fb.werr
+	}
+
+	end := fb.r + fb.n
+	if end > len(fb.buf) {
+		end = len(fb.buf)
+	}
+	k := copy(p, fb.buf[fb.r:end])
+	fb.r = (fb.r + k) % len(fb.buf)
+	fb.n -= k
+	fb.writable.Signal()
+	return k, nil
+}
+
+// closeRead discards buffered data and makes further writes no-ops.
+func (fb *flowBuffer) closeRead() {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	fb.rclosed = true
+	fb.n = 0
+	fb.writable.Broadcast()
+}
+
+// newDataSource returns the reader passed to the backend for message data, and
+// a function to call once the backend is done with it. The function discards
+// any unread data and returns once the whole message has been read from the
+// client. It returns an error if the end of the message couldn't be found.
+//
+// If Server.DataBufferSize is set, message data is read from the client in a
+// separate goroutine and buffered up to that size.
+func (c *Conn) newDataSource() (io.Reader, func() error) {
+	r := newDataReader(c)
+	if c.server.DataBufferSize <= 0 {
+		return r, r.r.discard
+	}
+
+	fb := newFlowBuffer(c.server.DataBufferSize, c.server.DataStallTimeout, c.server.DataStallPolicy)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := io.Copy(fb, r)
+		fb.closeWrite(err)
+	}()
+
+	return &countedFlowBuffer{fb, r}, func() error {
+		fb.closeRead()
+		<-done
+
+		fb.mu.Lock()
+		c.server.dataFlow.add(fb.stalls, fb.stallTime, fb.aborted, fb.maxBuffered)
+		fb.mu.Unlock()
+
+		return r.r.discard()
+	}
+}
+
+// countedFlowBuffer is a flowBuffer implementing DataCounter.
+type countedFlowBuffer struct {
+	*flowBuffer
+	counter DataCounter
+}
+
+func (cfb *countedFlowBuffer) WireBytes() int64 {
+	return cfb.counter.WireBytes()
+}
+
+func (cfb *countedFlowBuffer) DecodedBytes() int64 {
+	return cfb.counter.DecodedBytes()
+}
+
+// DataFlowStats returns statistics about message data buffering, see
+// DataBufferSize.
+func (s *Server) DataFlowStats() DataFlowStats {
+	return s.dataFlow.get()
+}
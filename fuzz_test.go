@@ -0,0 +1,166 @@
+package smtp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func FuzzParseCmd(f *testing.F) {
+	for _, line := range []string{
+		"EHLO mx.example.org\r\n",
+		"MAIL FROM:<alice@example.org> SIZE=1024 BODY=8BITMIME\r\n",
+		"RCPT TO:<bob@example.org>\r\n",
+		"DATA\r\n",
+		"STARTTLS\r\n",
+		"QUIT",
+		"AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n",
+		"XYZ",
+		"HELO",
+		"",
+	} {
+		f.Add(line)
+	}
+
+	f.Fuzz(func(t *testing.T, line string) {
+		cmd, arg, err := parseCmd(line)
+		if err != nil {
+			return
+		}
+		if cmd != strings.ToUpper(cmd) {
+			t.Errorf("parseCmd(%q): command %q is not upper-case", line, cmd)
+		}
+		if strings.ContainsAny(arg, "\r\n") && !strings.ContainsAny(strings.TrimRight(line, "\r\n"), "\r\n") {
+			t.Errorf("parseCmd(%q): argument %q contains a line break", line, arg)
+		}
+	})
+}
+
+func FuzzDataReader(f *testing.F) {
+	f.Add([]byte("Subject: Hi\r\n\r\nHello!\r\n.\r\n"), 0)
+	f.Add([]byte("..leading dot\r\n.\r\n"), 0)
+	f.Add([]byte("bare LF\n.\n"), 4)
+	f.Add([]byte("no terminator\r\n"), 0)
+	f.Add([]byte(".\r\n"), 1)
+	f.Add([]byte("\r\n.\r\n"), 1)
+
+	f.Fuzz(func(t *testing.T, data []byte, limit int) {
+		if limit < 0 {
+			limit = -limit
+		}
+
+		c := &Conn{
+			text:   textproto.NewConn(nopCloser{bytes.NewReader(data)}),
+			server: &Server{MaxMessageBytes: limit},
+		}
+		b, err := ioutil.ReadAll(newDataReader(c))
+		if limit > 0 && len(b) > limit {
+			t.Errorf("read %v bytes, limit is %v", len(b), limit)
+		}
+		if err == nil && len(b) > len(data) {
+			t.Errorf("read %v bytes from %v bytes of input", len(b), len(data))
+		}
+	})
+}
+
+type nopCloser struct {
+	io.Reader
+}
+
+func (nopCloser) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// fuzzBackend accepts everything, and authenticates "username" with
+// "password".
+type fuzzBackend struct{}
+
+func (fuzzBackend) Login(state *ConnectionState, username, password string) (Session, error) {
+	if username != "username" || password != "password" {
+		return nil, errors.New("Invalid username or password")
+	}
+	return fuzzSession{}, nil
+}
+
+func (fuzzBackend) AnonymousLogin(state *ConnectionState) (Session, error) {
+	return fuzzSession{}, nil
+}
+
+type fuzzSession struct{}
+
+func (fuzzSession) Reset()                 {}
+func (fuzzSession) Logout() error          { return nil }
+func (fuzzSession) Mail(from string) error { return nil }
+func (fuzzSession) Rcpt(to string) error   { return nil }
+func (fuzzSession) Data(r io.Reader) error {
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// fuzzLogger fails the test when the server reports an internal error, such
+// as a recovered panic.
+type fuzzLogger struct {
+	t *testing.T
+}
+
+func (l fuzzLogger) Printf(format string, v ...interface{}) {
+	l.t.Errorf(format, v...)
+}
+
+func (l fuzzLogger) Println(v ...interface{}) {
+	l.t.Error(fmt.Sprintln(v...))
+}
+
+func FuzzServer(f *testing.F) {
+	f.Add([]byte("EHLO localhost\r\n" +
+		"AUTH PLAIN\r\n" +
+		"AHVzZXJuYW1lAHBhc3N3b3Jk\r\n" +
+		"MAIL FROM:<root@nsa.gov> SIZE=12\r\n" +
+		"RCPT TO:<root@gchq.gov.uk>\r\n" +
+		"DATA\r\n" +
+		"Hey <3\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	f.Add([]byte("HELO localhost\r\nAUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\nNOOP\r\nRSET\r\nVRFY root\r\n"))
+	f.Add([]byte("EHLO localhost\r\nAUTH PLAIN\r\n*\r\nAUTH PLAIN !!!\r\nAUTH LOGIN\r\n"))
+	f.Add([]byte("LHLO localhost\r\nMAIL FROM:<>\r\nRCPT TO:<>\r\nDATA\r\n"))
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		s := NewServer(fuzzBackend{})
+		s.Domain = "localhost"
+		s.AllowInsecureAuth = true
+		s.MaxMessageBytes = 1024
+		s.MaxRecipients = 10
+		s.ErrorLog = fuzzLogger{t}
+
+		sc, cc := net.Pipe()
+		go io.Copy(ioutil.Discard, cc)
+		go func() {
+			cc.Write(input)
+			cc.Close()
+		}()
+
+		done := make(chan struct{})
+		go func() {
+			s.handleConn(newConn(sc, s))
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("server didn't return after the end of input")
+		}
+	})
+}
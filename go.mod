@@ -1,3 +1,10 @@
 module github.com/emersion/go-smtp
 
-require github.com/emersion/go-sasl v0.0.0-20190704090222-36b50694675c
+go 1.17
+
+require (
+	github.com/emersion/go-sasl v0.0.0-20190704090222-36b50694675c
+	golang.org/x/crypto v0.14.0
+)
+
+require golang.org/x/sys v0.13.0 // indirect
@@ -0,0 +1,134 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// dial opens a connection with the Dialer's settings. TCP connections to host
+// names use Happy Eyeballs if AttemptDelay is set.
+func (d *Dialer) dial(network, addr string) (net.Conn, error) {
+	return d.dialContext(context.Background(), network, addr)
+}
+
+// dialContext is like dial, but the context can cancel the connection.
+func (d *Dialer) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.AttemptDelay <= 0 || network != "tcp" {
+		return d.NetDialer.DialContext(ctx, network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.NetDialer.DialContext(ctx, network, addr)
+	}
+
+	if d.NetDialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.NetDialer.Timeout)
+		defer cancel()
+	}
+
+	resolver := d.NetDialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.dialParallel(ctx, interleaveAddrs(ips), port)
+}
+
+// interleaveAddrs sorts addresses by alternating address families, starting
+// with IPv6, as described in RFC 8305 section 4.
+func interleaveAddrs(ips []net.IPAddr) []net.IPAddr {
+	var v6, v4 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	l := make([]net.IPAddr, 0, len(ips))
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			l = append(l, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			l = append(l, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	return l
+}
+
+// dialParallel starts a connection attempt to each address in turn, waiting
+// AttemptDelay between attempts unless the previous one fails first. The
+// first successful connection is returned, the others are closed.
+func (d *Dialer) dialParallel(ctx context.Context, addrs []net.IPAddr, port string) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("smtp: no address to dial")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+
+	next, pending := 0, 0
+	var attemptTimer <-chan time.Time
+	start := func() {
+		addr := net.JoinHostPort(addrs[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.NetDialer.DialContext(ctx, "tcp", addr)
+			results <- result{conn, err}
+		}()
+		attemptTimer = time.After(d.AttemptDelay)
+	}
+
+	start()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// Close connections established by concurrent attempts
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next < len(addrs) {
+				start()
+			}
+		case <-attemptTimer:
+			if next < len(addrs) {
+				start()
+			}
+		}
+	}
+	return nil, firstErr
+}
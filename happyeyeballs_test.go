@@ -0,0 +1,72 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInterleaveAddrs(t *testing.T) {
+	ips := []net.IPAddr{
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("192.0.2.2")},
+		{IP: net.ParseIP("2001:db8::1")},
+		{IP: net.ParseIP("192.0.2.3")},
+		{IP: net.ParseIP("2001:db8::2")},
+	}
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}
+
+	got := interleaveAddrs(ips)
+	if len(got) != len(want) {
+		t.Fatalf("interleaveAddrs() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Errorf("interleaveAddrs()[%v] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestDialParallel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// The first address is blackholed (TEST-NET-1 is not routable), the
+	// second attempt must start after AttemptDelay and win
+	d := &Dialer{AttemptDelay: 50 * time.Millisecond}
+	addrs := []net.IPAddr{
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("127.0.0.1")},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := d.dialParallel(ctx, addrs, port)
+	if err != nil {
+		t.Fatalf("dialParallel: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != ln.Addr().String() {
+		t.Errorf("connected to %v, want %v", got, ln.Addr())
+	}
+}
+
+func TestDialParallel_noAddrs(t *testing.T) {
+	d := &Dialer{AttemptDelay: 50 * time.Millisecond}
+	if _, err := d.dialParallel(context.Background(), nil, "25"); err == nil {
+		t.Error("dialParallel: expected an error without addresses")
+	}
+}
@@ -0,0 +1,275 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidCredentials is returned by Authenticator.Auth when the username
+// or password is wrong, or when the user isn't authorized.
+var ErrInvalidCredentials = errors.New("Invalid username or password")
+
+// Authenticator checks credentials by binding to an LDAP directory as the
+// user. Its Auth method can be used as backendutil.RouterBackend.Auth, so
+// that the PLAIN and LOGIN SASL mechanisms are checked against the
+// directory.
+//
+// Users are found either with a DN template, or by searching the directory
+// with a filter. Connections are kept open and reused.
+type Authenticator struct {
+	// URL is the directory address, e.g. "ldap://ldap.example.org" or
+	// "ldaps://dc.example.org:636".
+	URL string
+	// If set, "ldap" connections are upgraded with StartTLS.
+	StartTLS  bool
+	TLSConfig *tls.Config
+
+	// UserDN is the DN of users, "%s" being replaced with the escaped
+	// username, e.g. "uid=%s,ou=people,dc=example,dc=org". For Active
+	// Directory, a user principal name such as "%s@example.org" can be used.
+	// It is ignored if Filter is set.
+	UserDN string
+
+	// Filter searches the user entry, "%s" being replaced with the escaped
+	// username, e.g. "(&(objectClass=user)(sAMAccountName=%s))". It must
+	// match exactly one entry under BaseDN.
+	Filter string
+	BaseDN string
+	// The credentials used to search the directory. If empty, searches are
+	// anonymous.
+	BindDN       string
+	BindPassword string
+
+	// If not empty, users must be a member of one of these group DNs, as
+	// listed by the GroupAttribute attribute of their entry. It requires
+	// Filter.
+	Groups []string
+	// The attribute listing the groups of a user. If empty, "memberOf" is
+	// used.
+	GroupAttribute string
+
+	// Timeout is the timeout of connections and requests. Zero means no
+	// timeout.
+	Timeout time.Duration
+	// The maximum number of idle connections kept open. If zero, 2 is used.
+	MaxIdle int
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+// Auth checks a username and password.
+func (a *Authenticator) Auth(username, password string) error {
+	// An empty password is an unauthenticated bind, which always succeeds,
+	// see RFC 4513 section 5.1.2
+	if username == "" || password == "" {
+		return ErrInvalidCredentials
+	}
+	if len(a.Groups) > 0 && a.Filter == "" {
+		return errors.New("ldap: groups require a filter")
+	}
+
+	c, err := a.get()
+	if err != nil {
+		return err
+	}
+	err = a.auth(c, username, password)
+	var ldapErr *Error
+	a.put(c, err == nil || err == ErrInvalidCredentials || errors.As(err, &ldapErr))
+	return err
+}
+
+func (a *Authenticator) auth(c *conn, username, password string) error {
+	dn := strings.Replace(a.UserDN, "%s", EscapeDN(username), -1)
+	var groups []string
+	if a.Filter != "" {
+		if !c.bound || c.bindDN != a.BindDN {
+			if err := c.Bind(a.BindDN, a.BindPassword); err != nil {
+				return fmt.Errorf("ldap: failed to bind as %q: %v", a.BindDN, err)
+			}
+		}
+
+		groupAttr := a.groupAttribute()
+		filter := strings.Replace(a.Filter, "%s", EscapeFilter(username), -1)
+		entries, err := c.Search(a.BaseDN, scopeWholeSubtree, filter, []string{groupAttr})
+		if err != nil {
+			return err
+		}
+		if len(entries) != 1 {
+			return ErrInvalidCredentials
+		}
+		dn = entries[0].DN
+		groups = entries[0].Attributes[strings.ToLower(groupAttr)]
+	}
+
+	if err := c.Bind(dn, password); err != nil {
+		if ldapErr, ok := err.(*Error); ok && ldapErr.Code == ResultInvalidCredentials {
+			return ErrInvalidCredentials
+		}
+		return err
+	}
+
+	if len(a.Groups) > 0 && !memberOf(groups, a.Groups) {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+func (a *Authenticator) groupAttribute() string {
+	if a.GroupAttribute != "" {
+		return a.GroupAttribute
+	}
+	return "memberOf"
+}
+
+func memberOf(groups, allowed []string) bool {
+	for _, g := range groups {
+		for _, want := range allowed {
+			if equalDN(g, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// equalDN compares two DNs, ignoring case and spaces around separators.
+func equalDN(a, b string) bool {
+	return strings.EqualFold(normalizeDN(a), normalizeDN(b))
+}
+
+func normalizeDN(dn string) string {
+	rdns := strings.Split(dn, ",")
+	for i, rdn := range rdns {
+		parts := strings.SplitN(rdn, "=", 2)
+		for j := range parts {
+			parts[j] = strings.TrimSpace(parts[j])
+		}
+		rdns[i] = strings.Join(parts, "=")
+	}
+	return strings.Join(rdns, ",")
+}
+
+// EscapeDN escapes a value to be used in a DN, as defined in RFC 4514
+// section 2.4.
+func EscapeDN(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ',' || c == '+' || c == '"' || c == '\\' || c == '<' || c == '>' || c == ';' || c == '=':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c == 0:
+			sb.WriteString("\\00")
+		case (c == ' ' || c == '#') && i == 0, c == ' ' && i == len(s)-1:
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// Close closes the idle connections.
+func (a *Authenticator) Close() error {
+	a.mu.Lock()
+	idle := a.idle
+	a.idle = nil
+	a.closed = true
+	a.mu.Unlock()
+
+	for _, c := range idle {
+		c.Close()
+	}
+	return nil
+}
+
+func (a *Authenticator) get() (*conn, error) {
+	a.mu.Lock()
+	if n := len(a.idle); n > 0 {
+		c := a.idle[n-1]
+		a.idle = a.idle[:n-1]
+		a.mu.Unlock()
+		return c, nil
+	}
+	a.mu.Unlock()
+	return a.dial()
+}
+
+// put returns a connection to the pool, or closes it if it can't be reused.
+func (a *Authenticator) put(c *conn, reuse bool) {
+	maxIdle := a.MaxIdle
+	if maxIdle == 0 {
+		maxIdle = 2
+	}
+
+	a.mu.Lock()
+	if reuse && !a.closed && len(a.idle) < maxIdle {
+		a.idle = append(a.idle, c)
+		c = nil
+	}
+	a.mu.Unlock()
+
+	if c != nil {
+		c.Close()
+	}
+}
+
+func (a *Authenticator) dial() (*conn, error) {
+	u, err := url.Parse(a.URL)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: invalid URL: %v", err)
+	}
+
+	host := u.Host
+	var port string
+	switch u.Scheme {
+	case "ldap":
+		port = "389"
+	case "ldaps":
+		port = "636"
+	default:
+		return nil, fmt.Errorf("ldap: unsupported URL scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	tlsConfig := a.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	d := net.Dialer{Timeout: a.Timeout}
+	var nc net.Conn
+	if u.Scheme == "ldaps" {
+		nc, err = tls.DialWithDialer(&d, "tcp", host, tlsConfig)
+	} else {
+		nc, err = d.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := newConn(nc, a.Timeout)
+	if a.StartTLS && u.Scheme == "ldap" {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("ldap: StartTLS failed: %v", err)
+		}
+	}
+	return c, nil
+}
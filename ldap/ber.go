@@ -0,0 +1,192 @@
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxPacketSize is the maximum size of a message received from the server.
+const maxPacketSize = 1 << 20
+
+// Identifier octets, see X.690 section 8.1.2.
+const (
+	classUniversal   = 0x00
+	classApplication = 0x40
+	classContext     = 0x80
+	constructed      = 0x20
+
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = constructed | 0x10
+	tagSet         = constructed | 0x11
+)
+
+// packet is a BER-encoded value. Only single-octet identifiers are
+// supported, which is enough for LDAP.
+type packet struct {
+	tag      byte
+	value    []byte // primitive values only
+	children []*packet
+}
+
+func (p *packet) constructed() bool {
+	return p.tag&constructed != 0
+}
+
+func newSequence(tag byte, children ...*packet) *packet {
+	return &packet{tag: tag, children: children}
+}
+
+func newString(tag byte, s string) *packet {
+	return &packet{tag: tag, value: []byte(s)}
+}
+
+func newInt(tag byte, n int64) *packet {
+	// Two's complement, minimal length
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		if (n < 128 && n >= -128) || len(b) == 8 {
+			break
+		}
+		n >>= 8
+	}
+	return &packet{tag: tag, value: b}
+}
+
+func newBool(v bool) *packet {
+	if v {
+		return &packet{tag: tagBoolean, value: []byte{0xff}}
+	}
+	return &packet{tag: tagBoolean, value: []byte{0}}
+}
+
+func (p *packet) int() (int64, error) {
+	if p.constructed() || len(p.value) == 0 || len(p.value) > 8 {
+		return 0, errors.New("ldap: malformed integer")
+	}
+	n := int64(int8(p.value[0]))
+	for _, b := range p.value[1:] {
+		n = n<<8 | int64(b)
+	}
+	return n, nil
+}
+
+func (p *packet) string() string {
+	return string(p.value)
+}
+
+func appendLength(b []byte, n int) []byte {
+	if n < 128 {
+		return append(b, byte(n))
+	}
+	var l []byte
+	for ; n > 0; n >>= 8 {
+		l = append([]byte{byte(n)}, l...)
+	}
+	b = append(b, 0x80|byte(len(l)))
+	return append(b, l...)
+}
+
+// bytes encodes a packet.
+func (p *packet) bytes() []byte {
+	value := p.value
+	if p.constructed() {
+		value = nil
+		for _, child := range p.children {
+			value = append(value, child.bytes()...)
+		}
+	}
+	b := appendLength([]byte{p.tag}, len(value))
+	return append(b, value...)
+}
+
+// readPacket reads a packet from a stream.
+func readPacket(br *bufio.Reader) (*packet, error) {
+	tag, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	n, err := br.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	length := int(n)
+	if n&0x80 != 0 {
+		size := int(n &^ 0x80)
+		if size == 0 || size > 4 {
+			return nil, fmt.Errorf("ldap: unsupported BER length")
+		}
+		length = 0
+		for i := 0; i < size; i++ {
+			b, err := br.ReadByte()
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxPacketSize {
+		return nil, fmt.Errorf("ldap: packet too large")
+	}
+
+	value := make([]byte, length)
+	if _, err := io.ReadFull(br, value); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return decodeValue(tag, value)
+}
+
+// parsePacket decodes a single packet.
+func parsePacket(b []byte) (*packet, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, errors.New("ldap: truncated packet")
+	}
+	tag := b[0]
+	length := int(b[1])
+	b = b[2:]
+	if length&0x80 != 0 {
+		size := length &^ 0x80
+		if size == 0 || size > 4 || len(b) < size {
+			return nil, nil, errors.New("ldap: malformed BER length")
+		}
+		length = 0
+		for _, c := range b[:size] {
+			length = length<<8 | int(c)
+		}
+		b = b[size:]
+	}
+	if length < 0 || length > len(b) {
+		return nil, nil, errors.New("ldap: truncated packet")
+	}
+	p, err := decodeValue(tag, b[:length])
+	return p, b[length:], err
+}
+
+func decodeValue(tag byte, value []byte) (*packet, error) {
+	p := &packet{tag: tag}
+	if !p.constructed() {
+		p.value = value
+		return p, nil
+	}
+	for len(value) > 0 {
+		child, rest, err := parsePacket(value)
+		if err != nil {
+			return nil, err
+		}
+		p.children = append(p.children, child)
+		value = rest
+	}
+	return p, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
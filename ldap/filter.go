@@ -0,0 +1,178 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Filter choices, see RFC 4511 section 4.5.1.
+const (
+	filterAnd            = classContext | constructed | 0
+	filterOr             = classContext | constructed | 1
+	filterNot            = classContext | constructed | 2
+	filterEquality       = classContext | constructed | 3
+	filterSubstrings     = classContext | constructed | 4
+	filterGreaterOrEqual = classContext | constructed | 5
+	filterLessOrEqual    = classContext | constructed | 6
+	filterPresent        = classContext | 7
+	filterApprox         = classContext | constructed | 8
+
+	substringInitial = classContext | 0
+	substringAny     = classContext | 1
+	substringFinal   = classContext | 2
+)
+
+// EscapeFilter escapes a value to be used in a search filter, as defined in
+// RFC 4515 section 3.
+func EscapeFilter(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&sb, "\\%02x", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// parseFilter parses a search filter in its string representation, as
+// defined in RFC 4515. Extensible matches aren't supported.
+func parseFilter(s string) (*packet, error) {
+	p, rest, err := parseFilterItem(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: invalid filter %q: %v", s, err)
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("ldap: invalid filter %q: trailing data", s)
+	}
+	return p, nil
+}
+
+func parseFilterItem(s string) (*packet, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", fmt.Errorf("expected '('")
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, "", fmt.Errorf("unexpected end")
+	}
+
+	switch s[0] {
+	case '&', '|', '!':
+		tag := byte(filterAnd)
+		switch s[0] {
+		case '|':
+			tag = filterOr
+		case '!':
+			tag = filterNot
+		}
+		p := newSequence(tag)
+		s = s[1:]
+		for strings.HasPrefix(s, "(") {
+			child, rest, err := parseFilterItem(s)
+			if err != nil {
+				return nil, "", err
+			}
+			p.children = append(p.children, child)
+			s = rest
+		}
+		if len(p.children) == 0 || (tag == filterNot && len(p.children) != 1) {
+			return nil, "", fmt.Errorf("invalid number of sub-filters")
+		}
+		if !strings.HasPrefix(s, ")") {
+			return nil, "", fmt.Errorf("expected ')'")
+		}
+		return p, s[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", fmt.Errorf("expected ')'")
+	}
+	p, err := parseSimpleFilter(s[:end])
+	return p, s[end+1:], err
+}
+
+func parseSimpleFilter(s string) (*packet, error) {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return nil, fmt.Errorf("missing '='")
+	}
+	attr, value := s[:i], s[i+1:]
+
+	tag := byte(filterEquality)
+	switch attr[len(attr)-1] {
+	case '>':
+		tag = filterGreaterOrEqual
+	case '<':
+		tag = filterLessOrEqual
+	case '~':
+		tag = filterApprox
+	case ':':
+		return nil, fmt.Errorf("extensible matches aren't supported")
+	}
+	if tag != filterEquality {
+		attr = attr[:len(attr)-1]
+	}
+	if attr == "" {
+		return nil, fmt.Errorf("missing attribute")
+	}
+
+	if tag == filterEquality && value == "*" {
+		return newString(filterPresent, attr), nil
+	}
+	if tag == filterEquality && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		subs := newSequence(tagSequence)
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			v, err := unescapeFilter(part)
+			if err != nil {
+				return nil, err
+			}
+			subTag := byte(substringAny)
+			switch i {
+			case 0:
+				subTag = substringInitial
+			case len(parts) - 1:
+				subTag = substringFinal
+			}
+			subs.children = append(subs.children, newString(subTag, v))
+		}
+		return newSequence(filterSubstrings, newString(tagOctetString, attr), subs), nil
+	}
+
+	v, err := unescapeFilter(value)
+	if err != nil {
+		return nil, err
+	}
+	return newSequence(tag, newString(tagOctetString, attr), newString(tagOctetString, v)), nil
+}
+
+func unescapeFilter(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", fmt.Errorf("truncated escape sequence")
+		}
+		b, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape sequence")
+		}
+		sb.Write(b)
+		i += 2
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,261 @@
+// Package ldap implements authentication against an LDAP directory, such as
+// OpenLDAP or Active Directory.
+//
+// It contains a minimal LDAPv3 client (RFC 4511) supporting simple binds,
+// searches and StartTLS, which is all an Authenticator needs.
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Protocol operations, see RFC 4511 section 4.2.
+const (
+	opBindRequest           = classApplication | constructed | 0
+	opBindResponse          = classApplication | constructed | 1
+	opUnbindRequest         = classApplication | 2
+	opSearchRequest         = classApplication | constructed | 3
+	opSearchResultEntry     = classApplication | constructed | 4
+	opSearchResultDone      = classApplication | constructed | 5
+	opSearchResultReference = classApplication | constructed | 19
+	opExtendedRequest       = classApplication | constructed | 23
+	opExtendedResponse      = classApplication | constructed | 24
+
+	authSimple         = classContext | 0
+	extendedName       = classContext | 0
+	oidStartTLS        = "1.3.6.1.4.1.1466.20037"
+	scopeBaseObject    = 0
+	scopeWholeSubtree  = 2
+	derefNever         = 0
+	protocolVersion    = 3
+	unsolicitedMessage = 0
+)
+
+// Result codes, see RFC 4511 appendix A.
+const (
+	ResultSuccess            = 0
+	ResultInvalidCredentials = 49
+)
+
+// Error is an error result returned by the server.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (err *Error) Error() string {
+	if err.Message == "" {
+		return fmt.Sprintf("ldap: result code %v", err.Code)
+	}
+	return fmt.Sprintf("ldap: result code %v: %v", err.Code, err.Message)
+}
+
+// entry is a search result entry.
+type entry struct {
+	DN         string
+	Attributes map[string][]string // keys are lower-case
+}
+
+// conn is a connection to an LDAP server.
+type conn struct {
+	nc      net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+	msgID   int64
+
+	// bindDN is the identity the connection is bound as
+	bindDN string
+	bound  bool
+}
+
+func newConn(nc net.Conn, timeout time.Duration) *conn {
+	return &conn{nc: nc, br: bufio.NewReader(nc), timeout: timeout}
+}
+
+func (c *conn) Close() error {
+	c.nc.SetWriteDeadline(time.Now().Add(time.Second))
+	c.send(newString(opUnbindRequest, ""))
+	return c.nc.Close()
+}
+
+func (c *conn) setDeadline() {
+	if c.timeout > 0 {
+		c.nc.SetDeadline(time.Now().Add(c.timeout))
+	} else {
+		c.nc.SetDeadline(time.Time{})
+	}
+}
+
+// send sends a request and returns its message ID.
+func (c *conn) send(op *packet) (int64, error) {
+	c.msgID++
+	msg := newSequence(tagSequence, newInt(tagInteger, c.msgID), op)
+	_, err := c.nc.Write(msg.bytes())
+	return c.msgID, err
+}
+
+// recv reads the next response to a request.
+func (c *conn) recv(id int64) (*packet, error) {
+	for {
+		msg, err := readPacket(c.br)
+		if err != nil {
+			return nil, err
+		}
+		if msg.tag != tagSequence || len(msg.children) < 2 {
+			return nil, errors.New("ldap: malformed message")
+		}
+		msgID, err := msg.children[0].int()
+		if err != nil {
+			return nil, err
+		}
+		op := msg.children[1]
+		if msgID == unsolicitedMessage {
+			// Notice of disconnection, see RFC 4511 section 4.4.1
+			if err := parseResult(op); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("ldap: unsolicited notification")
+		}
+		if msgID == id {
+			return op, nil
+		}
+	}
+}
+
+// parseResult returns the error of an LDAPResult, if any.
+func parseResult(op *packet) error {
+	if len(op.children) < 3 {
+		return errors.New("ldap: malformed result")
+	}
+	code, err := op.children[0].int()
+	if err != nil {
+		return err
+	}
+	if code != ResultSuccess {
+		return &Error{Code: int(code), Message: op.children[2].string()}
+	}
+	return nil
+}
+
+// roundTrip sends a request and returns the result.
+func (c *conn) roundTrip(op *packet, respTag byte) error {
+	c.setDeadline()
+	id, err := c.send(op)
+	if err != nil {
+		return err
+	}
+	resp, err := c.recv(id)
+	if err != nil {
+		return err
+	}
+	if resp.tag != respTag {
+		return fmt.Errorf("ldap: unexpected response tag 0x%02x", resp.tag)
+	}
+	return parseResult(resp)
+}
+
+// StartTLS upgrades the connection to TLS, see RFC 4511 section 4.14.
+func (c *conn) StartTLS(config *tls.Config) error {
+	req := newSequence(opExtendedRequest, newString(extendedName, oidStartTLS))
+	if err := c.roundTrip(req, opExtendedResponse); err != nil {
+		return err
+	}
+	tc := tls.Client(c.nc, config)
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	c.nc = tc
+	c.br = bufio.NewReader(tc)
+	return nil
+}
+
+// Bind authenticates with a DN and a password.
+func (c *conn) Bind(dn, password string) error {
+	c.bound = false
+	req := newSequence(opBindRequest,
+		newInt(tagInteger, protocolVersion),
+		newString(tagOctetString, dn),
+		newString(authSimple, password),
+	)
+	if err := c.roundTrip(req, opBindResponse); err != nil {
+		return err
+	}
+	c.bindDN = dn
+	c.bound = true
+	return nil
+}
+
+// Search returns the entries matching a filter.
+func (c *conn) Search(base string, scope int, filter string, attrs []string) ([]entry, error) {
+	f, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	attrList := newSequence(tagSequence)
+	for _, attr := range attrs {
+		attrList.children = append(attrList.children, newString(tagOctetString, attr))
+	}
+	req := newSequence(opSearchRequest,
+		newString(tagOctetString, base),
+		newInt(tagEnumerated, int64(scope)),
+		newInt(tagEnumerated, derefNever),
+		newInt(tagInteger, 0),
+		newInt(tagInteger, 0),
+		newBool(false),
+		f,
+		attrList,
+	)
+
+	c.setDeadline()
+	id, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	var entries []entry
+	for {
+		resp, err := c.recv(id)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.tag {
+		case opSearchResultEntry:
+			e, err := parseEntry(resp)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		case opSearchResultReference:
+			// Referrals aren't followed
+		case opSearchResultDone:
+			return entries, parseResult(resp)
+		default:
+			return nil, fmt.Errorf("ldap: unexpected response tag 0x%02x", resp.tag)
+		}
+	}
+}
+
+func parseEntry(op *packet) (entry, error) {
+	if len(op.children) != 2 {
+		return entry{}, errors.New("ldap: malformed search result entry")
+	}
+	e := entry{
+		DN:         op.children[0].string(),
+		Attributes: make(map[string][]string),
+	}
+	for _, attr := range op.children[1].children {
+		if len(attr.children) != 2 {
+			return entry{}, errors.New("ldap: malformed attribute")
+		}
+		name := strings.ToLower(attr.children[0].string())
+		for _, v := range attr.children[1].children {
+			e.Attributes[name] = append(e.Attributes[name], v.string())
+		}
+	}
+	return e, nil
+}
@@ -0,0 +1,313 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testUser struct {
+	dn, password string
+	attrs        map[string][]string
+}
+
+// testServer is a fake LDAP directory.
+type testServer struct {
+	l         net.Listener
+	tlsConfig *tls.Config
+
+	mu    sync.Mutex
+	users []testUser
+	binds []string
+	conns int
+}
+
+func newTestServer(t *testing.T, users []testUser) *testServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{l: l, users: users, tlsConfig: testTLSConfig(t)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) Close() {
+	s.l.Close()
+}
+
+func (s *testServer) URL() string {
+	return "ldap://" + s.l.Addr().String()
+}
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func (s *testServer) reply(c net.Conn, id int64, op *packet) {
+	c.Write(newSequence(tagSequence, newInt(tagInteger, id), op).bytes())
+}
+
+func result(tag byte, code int) *packet {
+	return newSequence(tag,
+		newInt(tagEnumerated, int64(code)),
+		newString(tagOctetString, ""),
+		newString(tagOctetString, ""),
+	)
+}
+
+func (s *testServer) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for {
+		msg, err := readPacket(br)
+		if err != nil {
+			return
+		}
+		id, _ := msg.children[0].int()
+		op := msg.children[1]
+		switch op.tag {
+		case opUnbindRequest:
+			return
+		case opExtendedRequest:
+			s.reply(c, id, result(opExtendedResponse, ResultSuccess))
+			tc := tls.Server(c, s.tlsConfig)
+			c, br = tc, bufio.NewReader(tc)
+		case opBindRequest:
+			dn, password := op.children[1].string(), op.children[2].string()
+			s.mu.Lock()
+			s.binds = append(s.binds, dn)
+			s.mu.Unlock()
+			code := ResultInvalidCredentials
+			if dn == "" && password == "" {
+				code = ResultSuccess
+			}
+			for _, u := range s.users {
+				if u.dn == dn && u.password == password {
+					code = ResultSuccess
+				}
+			}
+			s.reply(c, id, result(opBindResponse, code))
+		case opSearchRequest:
+			for _, u := range s.users {
+				if !matchFilter(op.children[6], u.attrs) {
+					continue
+				}
+				attrs := newSequence(tagSequence)
+				for k, vals := range u.attrs {
+					set := newSequence(tagSet)
+					for _, v := range vals {
+						set.children = append(set.children, newString(tagOctetString, v))
+					}
+					attrs.children = append(attrs.children, newSequence(tagSequence, newString(tagOctetString, k), set))
+				}
+				s.reply(c, id, newSequence(opSearchResultEntry, newString(tagOctetString, u.dn), attrs))
+			}
+			s.reply(c, id, result(opSearchResultDone, ResultSuccess))
+		}
+	}
+}
+
+// matchFilter supports the and, equality and present filters.
+func matchFilter(f *packet, attrs map[string][]string) bool {
+	switch f.tag {
+	case filterAnd:
+		for _, child := range f.children {
+			if !matchFilter(child, attrs) {
+				return false
+			}
+		}
+		return true
+	case filterEquality:
+		for _, v := range attrs[f.children[0].string()] {
+			if v == f.children[1].string() {
+				return true
+			}
+		}
+	case filterPresent:
+		return len(attrs[f.string()]) > 0
+	}
+	return false
+}
+
+func TestParseFilter(t *testing.T) {
+	for _, test := range []struct {
+		filter string
+		want   *packet
+	}{
+		{"(uid=alice)", newSequence(filterEquality, newString(tagOctetString, "uid"), newString(tagOctetString, "alice"))},
+		{"(objectClass=*)", newString(filterPresent, "objectClass")},
+		{"(cn=a\\2ab)", newSequence(filterEquality, newString(tagOctetString, "cn"), newString(tagOctetString, "a*b"))},
+		{"(!(age>=18))", newSequence(filterNot, newSequence(filterGreaterOrEqual, newString(tagOctetString, "age"), newString(tagOctetString, "18")))},
+		{"(cn=a*b*c)", newSequence(filterSubstrings, newString(tagOctetString, "cn"), newSequence(tagSequence,
+			newString(substringInitial, "a"), newString(substringAny, "b"), newString(substringFinal, "c")))},
+		{"(&(a=1)(|(b=2)(c=3)))", newSequence(filterAnd,
+			newSequence(filterEquality, newString(tagOctetString, "a"), newString(tagOctetString, "1")),
+			newSequence(filterOr,
+				newSequence(filterEquality, newString(tagOctetString, "b"), newString(tagOctetString, "2")),
+				newSequence(filterEquality, newString(tagOctetString, "c"), newString(tagOctetString, "3"))))},
+	} {
+		got, err := parseFilter(test.filter)
+		if err != nil {
+			t.Errorf("parseFilter(%q): %v", test.filter, err)
+			continue
+		}
+		if !bytes.Equal(got.bytes(), test.want.bytes()) {
+			t.Errorf("parseFilter(%q) = %x, want %x", test.filter, got.bytes(), test.want.bytes())
+		}
+	}
+
+	for _, filter := range []string{"", "uid=alice", "(uid=alice", "(&)", "(!(a=1)(b=2))", "(=a)", "(cn=\\2)", "(a=1)(b=2)"} {
+		if _, err := parseFilter(filter); err == nil {
+			t.Errorf("parseFilter(%q): expected an error", filter)
+		}
+	}
+}
+
+func TestPacket(t *testing.T) {
+	for _, n := range []int64{0, 1, 127, 128, 255, 256, -1, -128, -129, 1 << 40} {
+		p, rest, err := parsePacket(newInt(tagInteger, n).bytes())
+		if err != nil || len(rest) != 0 {
+			t.Fatalf("parsePacket: %v", err)
+		}
+		if got, _ := p.int(); got != n {
+			t.Errorf("int: got %v, want %v", got, n)
+		}
+	}
+
+	long := newString(tagOctetString, strings.Repeat("a", 300))
+	p, err := readPacket(bufio.NewReader(bytes.NewReader(newSequence(tagSequence, long).bytes())))
+	if err != nil {
+		t.Fatalf("readPacket: %v", err)
+	}
+	if len(p.children) != 1 || p.children[0].string() != long.string() {
+		t.Errorf("readPacket: unexpected packet %+v", p)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	if got := EscapeFilter("a*(b)\\"); got != "a\\2a\\28b\\29\\5c" {
+		t.Errorf("EscapeFilter: got %q", got)
+	}
+	if got := EscapeDN(" a,b+c "); got != "\\ a\\,b\\+c\\ " {
+		t.Errorf("EscapeDN: got %q", got)
+	}
+}
+
+func TestAuthenticator_userDN(t *testing.T) {
+	s := newTestServer(t, []testUser{{dn: "uid=alice,ou=people,dc=example,dc=org", password: "secret"}})
+	defer s.Close()
+
+	a := &Authenticator{URL: s.URL(), UserDN: "uid=%s,ou=people,dc=example,dc=org", Timeout: 5 * time.Second}
+	defer a.Close()
+
+	if err := a.Auth("alice", "secret"); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	for _, creds := range [][2]string{{"alice", "wrong"}, {"alice", ""}, {"bob", "secret"}} {
+		if err := a.Auth(creds[0], creds[1]); err != ErrInvalidCredentials {
+			t.Errorf("Auth(%q, %q): got %v, want ErrInvalidCredentials", creds[0], creds[1], err)
+		}
+	}
+	if err := a.Auth("alice,ou=admins", "secret"); err != ErrInvalidCredentials {
+		t.Errorf("Auth with a DN injection: got %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns != 1 {
+		t.Errorf("expected connections to be reused, got %v connections", s.conns)
+	}
+}
+
+func TestAuthenticator_filter(t *testing.T) {
+	s := newTestServer(t, []testUser{
+		{
+			dn:       "cn=svc,dc=example,dc=org",
+			password: "svc-secret",
+		},
+		{
+			dn:       "cn=Alice,ou=people,dc=example,dc=org",
+			password: "secret",
+			attrs: map[string][]string{
+				"sAMAccountName": {"alice"},
+				"memberOf":       {"CN=Mail Users, DC=example, DC=org"},
+			},
+		},
+		{
+			dn:       "cn=Bob,ou=people,dc=example,dc=org",
+			password: "secret",
+			attrs:    map[string][]string{"sAMAccountName": {"bob"}},
+		},
+	})
+	defer s.Close()
+
+	a := &Authenticator{
+		URL:          s.URL(),
+		StartTLS:     true,
+		TLSConfig:    &tls.Config{InsecureSkipVerify: true},
+		Filter:       "(sAMAccountName=%s)",
+		BaseDN:       "dc=example,dc=org",
+		BindDN:       "cn=svc,dc=example,dc=org",
+		BindPassword: "svc-secret",
+		Groups:       []string{"cn=mail users,dc=example,dc=org"},
+		Timeout:      5 * time.Second,
+	}
+	defer a.Close()
+
+	if err := a.Auth("alice", "secret"); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if err := a.Auth("bob", "secret"); err != ErrInvalidCredentials {
+		t.Errorf("Auth for a user outside of the groups: got %v", err)
+	}
+	if err := a.Auth("*", "secret"); err != ErrInvalidCredentials {
+		t.Errorf("Auth with a filter injection: got %v", err)
+	}
+	if err := a.Auth("alice", "secret"); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.binds[0] != a.BindDN || s.binds[1] != "cn=Alice,ou=people,dc=example,dc=org" {
+		t.Errorf("unexpected binds: %v", s.binds)
+	}
+}
@@ -0,0 +1,57 @@
+package smtp
+
+import (
+	"sync"
+)
+
+// statusCollector collects the statuses of the recipients of an LMTP
+// transaction. Replies are written in recipient order once the backend is
+// done, whatever the order SetStatus is called in.
+type statusCollector struct {
+	mu       sync.Mutex
+	rcpts    []string
+	statuses []error
+	set      []bool
+	closed   bool
+}
+
+func newStatusCollector(rcpts []string) *statusCollector {
+	return &statusCollector{
+		rcpts:    rcpts,
+		statuses: make([]error, len(rcpts)),
+		set:      make([]bool, len(rcpts)),
+	}
+}
+
+func (s *statusCollector) SetStatus(rcptTo string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	// Recipients can appear multiple times, set the first one without a
+	// status
+	for i, rcpt := range s.rcpts {
+		if rcpt == rcptTo && !s.set[i] {
+			s.statuses[i] = err
+			s.set[i] = true
+			return
+		}
+	}
+}
+
+// close sets the status of the remaining recipients to err, and returns the
+// statuses of all recipients. Further calls to SetStatus are ignored.
+func (s *statusCollector) close(err error) []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for i := range s.statuses {
+		if !s.set[i] {
+			s.statuses[i] = err
+		}
+	}
+	return s.statuses
+}
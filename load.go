@@ -0,0 +1,64 @@
+package smtp
+
+import (
+	"net"
+	"runtime"
+	"runtime/metrics"
+	"time"
+)
+
+// Load describes the load of a server when a connection is accepted, see
+// LoadHook.
+type Load struct {
+	// RemoteAddr is the address of the new connection.
+	RemoteAddr net.Addr
+	// ActiveConnections is the number of connections being handled, not
+	// counting the new one.
+	ActiveConnections int
+	// Goroutines is the number of goroutines of the process.
+	Goroutines int
+	// HeapBytes is the memory occupied by heap objects, including objects
+	// which haven't been collected yet. TotalMemory is all the memory mapped
+	// by the Go runtime.
+	HeapBytes   uint64
+	TotalMemory uint64
+}
+
+// LoadHook is called before serving each connection, with the current load.
+// It returns whether the connection is accepted, and a delay before the
+// greeting is sent. Rejected connections are replied with 421 and closed, as
+// when MaxConnections is reached. This allows shedding connections when
+// services running on the same host are under pressure.
+//
+// The hook is called concurrently.
+type LoadHook func(load *Load) (accept bool, greetingDelay time.Duration)
+
+var loadMetrics = []string{
+	"/memory/classes/heap/objects:bytes",
+	"/memory/classes/total:bytes",
+}
+
+// load returns the current load of the server.
+func (s *Server) load(remoteAddr net.Addr) *Load {
+	samples := make([]metrics.Sample, len(loadMetrics))
+	for i, name := range loadMetrics {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+
+	load := &Load{
+		RemoteAddr: remoteAddr,
+		Goroutines: runtime.NumGoroutine(),
+	}
+	if v := samples[0].Value; v.Kind() == metrics.KindUint64 {
+		load.HeapBytes = v.Uint64()
+	}
+	if v := samples[1].Value; v.Kind() == metrics.KindUint64 {
+		load.TotalMemory = v.Uint64()
+	}
+
+	s.locker.Lock()
+	load.ActiveConnections = len(s.conns)
+	s.locker.Unlock()
+	return load
+}
@@ -0,0 +1,183 @@
+package mtasts
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPolicySize is the maximum size of a policy file.
+const maxPolicySize = 64 * 1024
+
+type cachedPolicy struct {
+	id      string
+	policy  *Policy
+	expires time.Time
+}
+
+// Cache fetches and caches MTA-STS policies. It is safe to use from multiple
+// goroutines.
+type Cache struct {
+	// HTTPClient is used to fetch policies. If nil, a client with a 60 seconds
+	// timeout is used.
+	HTTPClient *http.Client
+	// LookupTXT resolves TXT records. If nil, net.LookupTXT is used.
+	LookupTXT func(name string) ([]string, error)
+
+	locker   sync.Mutex
+	policies map[string]*cachedPolicy
+}
+
+// Get returns the policy for a recipient domain. If the domain doesn't publish
+// a policy, a nil policy and a nil error are returned.
+//
+// Fetch and parse failures are returned as *Error. A previously cached policy
+// which hasn't expired yet is returned instead if the refresh fails.
+func (c *Cache) Get(domain string) (*Policy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	now := time.Now()
+
+	c.locker.Lock()
+	cached := c.policies[domain]
+	c.locker.Unlock()
+	if cached != nil && now.After(cached.expires) {
+		cached = nil
+	}
+
+	id, err := c.lookupID(domain)
+	if err != nil {
+		if cached != nil {
+			return cached.policy, nil
+		}
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, &Error{Type: ResultSTSPolicyFetchError, Domain: domain, Err: err}
+	} else if id == "" {
+		if cached != nil {
+			return cached.policy, nil
+		}
+		return nil, nil
+	}
+
+	if cached != nil && cached.id == id {
+		return cached.policy, nil
+	}
+
+	policy, err := c.fetch(domain)
+	if err != nil {
+		if cached != nil {
+			return cached.policy, nil
+		}
+		return nil, err
+	}
+
+	c.locker.Lock()
+	if c.policies == nil {
+		c.policies = make(map[string]*cachedPolicy)
+	}
+	c.policies[domain] = &cachedPolicy{
+		id:      id,
+		policy:  policy,
+		expires: now.Add(policy.MaxAge),
+	}
+	c.locker.Unlock()
+
+	return policy, nil
+}
+
+// lookupID fetches the policy ID from the _mta-sts TXT record. An empty ID is
+// returned if no MTA-STS record is found.
+func (c *Cache) lookupID(domain string) (string, error) {
+	lookupTXT := c.LookupTXT
+	if lookupTXT == nil {
+		lookupTXT = net.LookupTXT
+	}
+
+	records, err := lookupTXT("_mta-sts." + domain)
+	if err != nil {
+		return "", err
+	}
+
+	var id string
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=STSv1") {
+			continue
+		}
+		if id != "" {
+			return "", errors.New("multiple MTA-STS records")
+		}
+		id, err = parseRecord(record)
+		if err != nil {
+			return "", err
+		}
+	}
+	return id, nil
+}
+
+func parseRecord(record string) (string, error) {
+	var id string
+	for _, field := range strings.Split(record, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return "", fmt.Errorf("malformed MTA-STS record: %q", record)
+		}
+		if kv[0] == "id" {
+			id = kv[1]
+		}
+	}
+	if id == "" {
+		return "", fmt.Errorf("MTA-STS record has no id: %q", record)
+	}
+	return id, nil
+}
+
+func (c *Cache) fetch(domain string) (*Policy, error) {
+	client := c.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 60 * time.Second}
+	}
+	// Redirects must not be followed
+	noRedirect := *client
+	noRedirect.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	newError := func(typ string, err error) *Error {
+		return &Error{Type: typ, Domain: domain, Err: err}
+	}
+
+	resp, err := noRedirect.Get("https://mta-sts." + domain + "/.well-known/mta-sts.txt")
+	if err != nil {
+		var certErr *tls.CertificateVerificationError
+		if errors.As(err, &certErr) {
+			return nil, newError(ResultSTSWebPKIInvalid, err)
+		}
+		return nil, newError(ResultSTSPolicyFetchError, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError(ResultSTSPolicyFetchError, fmt.Errorf("HTTP status: %v", resp.Status))
+	}
+	if t := resp.Header.Get("Content-Type"); !strings.HasPrefix(t, "text/plain") {
+		return nil, newError(ResultSTSPolicyInvalid, fmt.Errorf("invalid content type: %q", t))
+	}
+
+	policy, err := ParsePolicy(io.LimitReader(resp.Body, maxPolicySize))
+	if err != nil {
+		return nil, newError(ResultSTSPolicyInvalid, err)
+	}
+	return policy, nil
+}
@@ -0,0 +1,259 @@
+// Package mtasts implements SMTP MTA Strict Transport Security, as defined in
+// RFC 8461.
+//
+// A sending MTA fetches the policy of the recipient domain with a Cache, then
+// upgrades its connection to each MX host with Policy.StartTLS. Failures are
+// reported as *Error values carrying a TLS-RPT (RFC 8460) result type.
+package mtasts
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Mode is the policy mode.
+type Mode string
+
+const (
+	// ModeEnforce requires TLS with a valid certificate for a matching MX.
+	ModeEnforce Mode = "enforce"
+	// ModeTesting reports failures but still delivers the message.
+	ModeTesting Mode = "testing"
+	// ModeNone indicates that the domain has no active policy.
+	ModeNone Mode = "none"
+)
+
+// maxMaxAge is the upper bound of the max_age policy field.
+const maxMaxAge = 31557600 * time.Second
+
+// Result types, as defined in RFC 8460 section 4.3.
+const (
+	ResultSTARTTLSNotSupported    = "starttls-not-supported"
+	ResultCertificateHostMismatch = "certificate-host-mismatch"
+	ResultCertificateExpired      = "certificate-expired"
+	ResultCertificateNotTrusted   = "certificate-not-trusted"
+	ResultValidationFailure       = "validation-failure"
+	ResultSTSPolicyFetchError     = "sts-policy-fetch-error"
+	ResultSTSPolicyInvalid        = "sts-policy-invalid"
+	ResultSTSWebPKIInvalid        = "sts-webpki-invalid"
+)
+
+// Error is a policy fetch or validation failure.
+type Error struct {
+	// Result type, one of the Result* constants.
+	Type string
+	// Policy domain.
+	Domain string
+	// MX host, empty for policy fetch errors.
+	MX string
+	// Whether the failure prevents delivery. This is false for policies in
+	// testing mode: the failure must be reported, but the message can still be
+	// sent.
+	Enforced bool
+	// Underlying error, if any.
+	Err error
+}
+
+func (err *Error) Error() string {
+	s := fmt.Sprintf("mta-sts: %v for %v", err.Type, err.Domain)
+	if err.MX != "" {
+		s += " (MX " + err.MX + ")"
+	}
+	if err.Err != nil {
+		s += ": " + err.Err.Error()
+	}
+	return s
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+// A Policy is a MTA-STS policy.
+type Policy struct {
+	Version string
+	Mode    Mode
+	MX      []string
+	MaxAge  time.Duration
+}
+
+// ParsePolicy parses a policy file.
+func ParsePolicy(r io.Reader) (*Policy, error) {
+	p := &Policy{}
+	hasMaxAge := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t")
+		if line == "" {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("mta-sts: malformed policy line: %q", line)
+		}
+		k, v := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+
+		switch k {
+		case "version":
+			p.Version = v
+		case "mode":
+			p.Mode = Mode(v)
+		case "mx":
+			p.MX = append(p.MX, strings.ToLower(v))
+		case "max_age":
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("mta-sts: invalid max_age: %v", err)
+			}
+			p.MaxAge = time.Duration(n) * time.Second
+			hasMaxAge = true
+		default:
+			// Unknown fields must be ignored
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if p.Version != "STSv1" {
+		return nil, fmt.Errorf("mta-sts: unsupported policy version: %q", p.Version)
+	}
+	switch p.Mode {
+	case ModeEnforce, ModeTesting:
+		if len(p.MX) == 0 {
+			return nil, errors.New("mta-sts: policy has no mx field")
+		}
+	case ModeNone:
+	default:
+		return nil, fmt.Errorf("mta-sts: invalid policy mode: %q", p.Mode)
+	}
+	if !hasMaxAge {
+		return nil, errors.New("mta-sts: policy has no max_age field")
+	}
+	if p.MaxAge > maxMaxAge {
+		p.MaxAge = maxMaxAge
+	}
+
+	return p, nil
+}
+
+// MatchMX checks whether the MX host name matches the policy. Wildcard
+// patterns only match a single left-most label.
+func (p *Policy) MatchMX(mx string) bool {
+	mx = strings.ToLower(strings.TrimSuffix(mx, "."))
+	for _, pattern := range p.MX {
+		if strings.HasPrefix(pattern, "*.") {
+			i := strings.IndexByte(mx, '.')
+			if i > 0 && mx[i+1:] == pattern[2:] {
+				return true
+			}
+		} else if mx == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// StartTLS upgrades the client connection to the MX host mx according to the
+// policy of domain.
+//
+// In enforce mode, a non-nil error means that the message must not be sent
+// via this MX. In testing mode, errors have Enforced set to false: they should
+// be reported, but the connection remains usable. With ModeNone, the policy
+// doesn't apply and StartTLS is a no-op.
+//
+// The config argument can be nil. Certificate verification is always
+// performed against the system roots or config.RootCAs.
+func (p *Policy) StartTLS(c *smtp.Client, domain, mx string, config *tls.Config) error {
+	if p.Mode == ModeNone {
+		return nil
+	}
+
+	enforce := p.Mode == ModeEnforce
+	newError := func(typ string, err error) *Error {
+		return &Error{Type: typ, Domain: domain, MX: mx, Enforced: enforce, Err: err}
+	}
+
+	if !p.MatchMX(mx) {
+		return newError(ResultValidationFailure, errors.New("MX host doesn't match policy"))
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		return newError(ResultSTARTTLSNotSupported, nil)
+	}
+
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	config.ServerName = strings.TrimSuffix(mx, ".")
+
+	// Verification is done by hand so that the connection can still be used
+	// in testing mode.
+	var verifyErr *Error
+	roots := config.RootCAs
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if err := verifyCertificate(cs, roots); err != nil {
+			verifyErr = newError(certificateResultType(err), err)
+			if enforce {
+				return verifyErr
+			}
+		}
+		return nil
+	}
+
+	if err := c.StartTLS(config); err != nil {
+		if verifyErr != nil {
+			return verifyErr
+		}
+		return newError(ResultValidationFailure, err)
+	}
+	if verifyErr != nil {
+		return verifyErr
+	}
+	return nil
+}
+
+func verifyCertificate(cs tls.ConnectionState, roots *x509.CertPool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no peer certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+func certificateResultType(err error) string {
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var authorityErr x509.UnknownAuthorityError
+	switch {
+	case errors.As(err, &hostErr):
+		return ResultCertificateHostMismatch
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return ResultCertificateExpired
+	case errors.As(err, &authorityErr):
+		return ResultCertificateNotTrusted
+	default:
+		return ResultValidationFailure
+	}
+}
@@ -0,0 +1,117 @@
+package mtasts
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPolicy = `version: STSv1
+mode: enforce
+mx: mail.example.com
+mx: *.example.net
+max_age: 86400
+`
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy(strings.NewReader(strings.Replace(testPolicy, "\n", "\r\n", -1)))
+	if err != nil {
+		t.Fatalf("ParsePolicy() = %v", err)
+	}
+	if p.Mode != ModeEnforce {
+		t.Errorf("Mode = %q, want %q", p.Mode, ModeEnforce)
+	}
+	if p.MaxAge != 24*time.Hour {
+		t.Errorf("MaxAge = %v, want 24h", p.MaxAge)
+	}
+
+	matches := map[string]bool{
+		"mail.example.com":    true,
+		"MAIL.example.com.":   true,
+		"mx1.example.net":     true,
+		"a.mx1.example.net":   false,
+		"example.net":         false,
+		"other.example.com":   false,
+		"mail.example.com.au": false,
+	}
+	for mx, want := range matches {
+		if got := p.MatchMX(mx); got != want {
+			t.Errorf("MatchMX(%q) = %v, want %v", mx, got, want)
+		}
+	}
+
+	invalid := []string{
+		"mode: enforce\nmx: a\nmax_age: 1\n",
+		"version: STSv1\nmode: nope\nmx: a\nmax_age: 1\n",
+		"version: STSv1\nmode: enforce\nmax_age: 1\n",
+		"version: STSv1\nmode: enforce\nmx: a\n",
+	}
+	for _, s := range invalid {
+		if _, err := ParsePolicy(strings.NewReader(s)); err == nil {
+			t.Errorf("ParsePolicy(%q) = nil, want an error", s)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	fetches := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Host != "mta-sts.example.com" || req.URL.Path != "/.well-known/mta-sts.txt" {
+			http.NotFound(w, req)
+			return
+		}
+		fetches++
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(testPolicy))
+	}))
+	defer srv.Close()
+
+	client := srv.Client()
+	transport := client.Transport.(*http.Transport)
+	transport.TLSClientConfig.ServerName = "example.com"
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial(network, srv.Listener.Addr().String())
+	}
+
+	id := "1"
+	c := &Cache{
+		HTTPClient: client,
+		LookupTXT: func(name string) ([]string, error) {
+			switch name {
+			case "_mta-sts.example.com":
+				return []string{"v=STSv1; id=" + id + ";"}, nil
+			default:
+				return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+			}
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		p, err := c.Get("example.com")
+		if err != nil {
+			t.Fatalf("Get() = %v", err)
+		}
+		if p == nil || p.Mode != ModeEnforce {
+			t.Fatalf("Get() = %+v, want an enforced policy", p)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("policy fetched %v times, want 1", fetches)
+	}
+
+	id = "2"
+	if _, err := c.Get("example.com"); err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	if fetches != 2 {
+		t.Errorf("policy fetched %v times after ID change, want 2", fetches)
+	}
+
+	if p, err := c.Get("example.org"); p != nil || err != nil {
+		t.Errorf("Get() = %v, %v, want no policy", p, err)
+	}
+}
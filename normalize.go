@@ -0,0 +1,50 @@
+package smtp
+
+import (
+	"strings"
+)
+
+// AddressNormalization defines how recipient addresses are normalized before
+// being passed to the session, see Server.RcptNormalization.
+type AddressNormalization struct {
+	// If set, domains are lower-cased.
+	LowerDomain bool
+	// If set, local parts are lower-cased. Local parts are case-sensitive
+	// per RFC 5321, but most systems ignore case.
+	LowerLocalPart bool
+	// If not empty, the part of local parts starting with the first of these
+	// characters is removed, e.g. "+" turns "user+tag@example.org" into
+	// "user@example.org".
+	TagSeparators string
+	// If set, source routes such as "@relay.example.org:" are removed. They
+	// are always removed when Server.Strict is set.
+	StripSourceRoute bool
+}
+
+// Normalize returns the normalized form of an address.
+func (n *AddressNormalization) Normalize(addr string) string {
+	if n.StripSourceRoute && strings.HasPrefix(addr, "@") {
+		if i := strings.IndexByte(addr, ':'); i >= 0 {
+			addr = addr[i+1:]
+		}
+	}
+
+	localPart, domain := addr, ""
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		localPart, domain = addr[:i], addr[i:]
+	}
+	// Quoted local parts are left alone, separators may be part of the quoted
+	// string
+	if n.TagSeparators != "" && !strings.HasPrefix(localPart, "\"") {
+		if i := strings.IndexAny(localPart, n.TagSeparators); i > 0 {
+			localPart = localPart[:i]
+		}
+	}
+	if n.LowerLocalPart {
+		localPart = strings.ToLower(localPart)
+	}
+	if n.LowerDomain {
+		domain = strings.ToLower(domain)
+	}
+	return localPart + domain
+}
@@ -0,0 +1,33 @@
+package smtp_test
+
+import (
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestAddressNormalization(t *testing.T) {
+	n := &smtp.AddressNormalization{
+		LowerDomain:      true,
+		TagSeparators:    "+-",
+		StripSourceRoute: true,
+	}
+	for addr, want := range map[string]string{
+		"User@Example.ORG":                      "User@example.org",
+		"user+tag@example.org":                  "user@example.org",
+		"user-tag+more@example.org":             "user@example.org",
+		"+user@example.org":                     "+user@example.org",
+		"\"us+er\"@example.org":                 "\"us+er\"@example.org",
+		"@relay1.example,@relay2.example:u@EX.": "u@ex.",
+		"Postmaster":                            "Postmaster",
+	} {
+		if got := n.Normalize(addr); got != want {
+			t.Errorf("Normalize(%q) = %q, want %q", addr, got, want)
+		}
+	}
+
+	n = &smtp.AddressNormalization{LowerLocalPart: true}
+	if got := n.Normalize("@relay.example:User+Tag@Example.ORG"); got != "@relay.example:user+tag@Example.ORG" {
+		t.Errorf("Normalize() = %q", got)
+	}
+}
@@ -0,0 +1,265 @@
+// Package ntlm implements the NTLM SASL mechanism, for legacy submission
+// servers such as Microsoft Exchange which only offer NTLM authentication.
+//
+// Only NTLMv2 responses are supported: LM and NTLMv1, which can be cracked
+// easily, are never sent. The mechanism isn't enabled by the smtp package, it
+// must be used explicitly:
+//
+//	c.Auth(ntlm.NewClient("EXAMPLE", "alice", "password"))
+//
+// NTLM doesn't protect the connection, which should use TLS.
+package ntlm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/emersion/go-sasl"
+	"golang.org/x/crypto/md4"
+)
+
+// Mechanism is the name of the NTLM SASL mechanism.
+const Mechanism = "NTLM"
+
+var signature = []byte("NTLMSSP\x00")
+
+const (
+	typeNegotiate    = 1
+	typeChallenge    = 2
+	typeAuthenticate = 3
+)
+
+// Negotiation flags, see MS-NLMP section 2.2.2.5.
+const (
+	flagUnicode                 = 0x00000001
+	flagRequestTarget           = 0x00000004
+	flagNTLM                    = 0x00000200
+	flagAlwaysSign              = 0x00008000
+	flagExtendedSessionSecurity = 0x00080000
+	flagTargetInfo              = 0x00800000
+	flag128                     = 0x20000000
+	flag56                      = 0x80000000
+
+	negotiateFlags = flagUnicode | flagRequestTarget | flagNTLM | flagAlwaysSign |
+		flagExtendedSessionSecurity | flag128 | flag56
+)
+
+// Target information pair IDs, see MS-NLMP section 2.2.2.1.
+const (
+	avIDEOL       = 0
+	avIDTimestamp = 7
+)
+
+const (
+	challengeHeaderLen    = 48
+	authenticateHeaderLen = 64
+	maxTargetInfoLen      = 64 * 1024
+	// The difference between the Windows and Unix epochs, in 100ns units
+	windowsEpochOffset = 116444736000000000
+)
+
+// ErrInvalidChallenge is returned when the server sends a malformed or
+// unsupported challenge.
+var ErrInvalidChallenge = errors.New("ntlm: invalid challenge")
+
+// Client is an NTLM SASL client.
+type Client struct {
+	// Domain is the NetBIOS or DNS domain of the account, it may be empty
+	// when Username is a user principal name ("alice@example.org").
+	Domain   string
+	Username string
+	Password string
+	// Workstation is the name of the client machine, it is optional.
+	Workstation string
+
+	negotiated bool
+
+	// For tests
+	rand io.Reader
+	now  func() time.Time
+}
+
+var _ sasl.Client = (*Client)(nil)
+
+// NewClient returns an NTLM client. A username of the form "DOMAIN\user" is
+// split into the domain and the user name.
+func NewClient(domain, username, password string) *Client {
+	if i := strings.IndexByte(username, '\\'); i >= 0 && domain == "" {
+		domain, username = username[:i], username[i+1:]
+	}
+	return &Client{Domain: domain, Username: username, Password: password}
+}
+
+// Start implements sasl.Client. The NEGOTIATE message is sent as the initial
+// response.
+func (a *Client) Start() (mech string, ir []byte, err error) {
+	a.negotiated = true
+
+	b := make([]byte, 32)
+	copy(b, signature)
+	binary.LittleEndian.PutUint32(b[8:], typeNegotiate)
+	binary.LittleEndian.PutUint32(b[12:], negotiateFlags)
+	// The domain and workstation fields are left empty
+	return Mechanism, b, nil
+}
+
+// Next implements sasl.Client. It answers the CHALLENGE message with an
+// AUTHENTICATE message.
+func (a *Client) Next(challenge []byte) (response []byte, err error) {
+	if !a.negotiated {
+		return nil, sasl.ErrUnexpectedServerChallenge
+	}
+	a.negotiated = false
+
+	c, err := parseChallenge(challenge)
+	if err != nil {
+		return nil, err
+	}
+	return a.authenticate(c)
+}
+
+type challengeMessage struct {
+	flags      uint32
+	challenge  []byte
+	targetInfo []byte
+}
+
+// parseChallenge parses a CHALLENGE message, see MS-NLMP section 2.2.1.2.
+func parseChallenge(b []byte) (*challengeMessage, error) {
+	if len(b) < challengeHeaderLen || !bytes.Equal(b[:8], signature) || binary.LittleEndian.Uint32(b[8:]) != typeChallenge {
+		return nil, ErrInvalidChallenge
+	}
+	c := &challengeMessage{
+		flags:     binary.LittleEndian.Uint32(b[20:]),
+		challenge: b[24:32],
+	}
+	if c.flags&flagUnicode == 0 || c.flags&flagNTLM == 0 {
+		// OEM strings and NTLM-less negotiation aren't supported
+		return nil, ErrInvalidChallenge
+	}
+	if c.flags&flagTargetInfo != 0 {
+		l := int(binary.LittleEndian.Uint16(b[40:]))
+		off := int(binary.LittleEndian.Uint32(b[44:]))
+		if l > maxTargetInfoLen || off > len(b) || l > len(b)-off {
+			return nil, ErrInvalidChallenge
+		}
+		c.targetInfo = b[off : off+l]
+	}
+	return c, nil
+}
+
+// timestamp returns the MsvAvTimestamp pair of target information, if any.
+func timestamp(targetInfo []byte) ([]byte, bool) {
+	for len(targetInfo) >= 4 {
+		id := binary.LittleEndian.Uint16(targetInfo)
+		l := int(binary.LittleEndian.Uint16(targetInfo[2:]))
+		if id == avIDEOL || l > len(targetInfo)-4 {
+			break
+		}
+		if id == avIDTimestamp && l == 8 {
+			return targetInfo[4:12], true
+		}
+		targetInfo = targetInfo[4+l:]
+	}
+	return nil, false
+}
+
+// authenticate builds an AUTHENTICATE message with NTLMv2 responses, see
+// MS-NLMP sections 2.2.1.3 and 3.3.2.
+func (a *Client) authenticate(c *challengeMessage) ([]byte, error) {
+	r := a.rand
+	if r == nil {
+		r = rand.Reader
+	}
+	clientChallenge := make([]byte, 8)
+	if _, err := io.ReadFull(r, clientChallenge); err != nil {
+		return nil, err
+	}
+
+	// The server timestamp is preferred, to avoid clock skew issues. When
+	// present, the LMv2 response must not be sent.
+	ts, hasTimestamp := timestamp(c.targetInfo)
+	if !hasTimestamp {
+		now := time.Now
+		if a.now != nil {
+			now = a.now
+		}
+		t := now()
+		ts = make([]byte, 8)
+		binary.LittleEndian.PutUint64(ts, uint64(t.Unix()*1e7+int64(t.Nanosecond()/100)+windowsEpochOffset))
+	}
+
+	key := responseKey(a.Domain, a.Username, a.Password)
+
+	temp := make([]byte, 0, 32+len(c.targetInfo))
+	temp = append(temp, 1, 1, 0, 0, 0, 0, 0, 0)
+	temp = append(temp, ts...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, c.targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+	ntResponse := append(hmacMD5(key, c.challenge, temp), temp...)
+
+	lmResponse := make([]byte, 24)
+	if !hasTimestamp {
+		lmResponse = append(hmacMD5(key, c.challenge, clientChallenge), clientChallenge...)
+	}
+
+	fields := [][]byte{
+		lmResponse,
+		ntResponse,
+		encodeString(a.Domain),
+		encodeString(a.Username),
+		encodeString(a.Workstation),
+		nil, // EncryptedRandomSessionKey
+	}
+	b := make([]byte, authenticateHeaderLen)
+	copy(b, signature)
+	binary.LittleEndian.PutUint32(b[8:], typeAuthenticate)
+	for i, field := range fields {
+		putField(b[12+8*i:], len(field), len(b))
+		b = append(b, field...)
+	}
+	binary.LittleEndian.PutUint32(b[60:], c.flags&negotiateFlags)
+	return b, nil
+}
+
+// putField writes the length, maximum length and offset of a payload field.
+func putField(b []byte, l, off int) {
+	binary.LittleEndian.PutUint16(b, uint16(l))
+	binary.LittleEndian.PutUint16(b[2:], uint16(l))
+	binary.LittleEndian.PutUint32(b[4:], uint32(off))
+}
+
+// responseKey computes NTOWFv2, see MS-NLMP section 3.3.2.
+func responseKey(domain, username, password string) []byte {
+	h := md4.New()
+	h.Write(encodeString(password))
+	return hmacMD5(h.Sum(nil), encodeString(strings.ToUpper(username)+domain))
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, b := range data {
+		mac.Write(b)
+	}
+	return mac.Sum(nil)
+}
+
+// encodeString encodes a string as UTF-16LE.
+func encodeString(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
@@ -0,0 +1,131 @@
+package ntlm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// testChallenge builds a CHALLENGE message with the values of the NTLMv2
+// example of MS-NLMP section 4.2.4.
+func testChallenge(targetInfo []byte) []byte {
+	b := make([]byte, challengeHeaderLen)
+	copy(b, signature)
+	binary.LittleEndian.PutUint32(b[8:], typeChallenge)
+	binary.LittleEndian.PutUint32(b[20:], negotiateFlags|flagTargetInfo)
+	copy(b[24:], []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef})
+	putField(b[40:], len(targetInfo), len(b))
+	return append(b, targetInfo...)
+}
+
+func avPair(id uint16, value []byte) []byte {
+	b := make([]byte, 4, 4+len(value))
+	binary.LittleEndian.PutUint16(b, id)
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(value)))
+	return append(b, value...)
+}
+
+// field returns a payload field of an AUTHENTICATE message.
+func field(t *testing.T, msg []byte, i int) []byte {
+	l := int(binary.LittleEndian.Uint16(msg[12+8*i:]))
+	off := int(binary.LittleEndian.Uint32(msg[12+8*i+4:]))
+	if off+l > len(msg) {
+		t.Fatalf("field %v out of bounds", i)
+	}
+	return msg[off : off+l]
+}
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestClient(t *testing.T) {
+	a := NewClient("Domain", "User", "Password")
+	a.rand = bytes.NewReader(bytes.Repeat([]byte{0xaa}, 8))
+	a.now = func() time.Time { return time.Unix(-windowsEpochOffset/1e7, 0) }
+
+	mech, ir, err := a.Start()
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if mech != Mechanism || !bytes.Equal(ir[:8], signature) || binary.LittleEndian.Uint32(ir[8:]) != typeNegotiate {
+		t.Fatalf("unexpected NEGOTIATE message %x", ir)
+	}
+
+	var targetInfo []byte
+	targetInfo = append(targetInfo, avPair(2, encodeString("Domain"))...)
+	targetInfo = append(targetInfo, avPair(1, encodeString("Server"))...)
+	targetInfo = append(targetInfo, avPair(avIDEOL, nil)...)
+	msg, err := a.Next(testChallenge(targetInfo))
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if !bytes.Equal(msg[:8], signature) || binary.LittleEndian.Uint32(msg[8:]) != typeAuthenticate {
+		t.Fatalf("unexpected AUTHENTICATE message %x", msg)
+	}
+
+	wantLM := mustDecodeHex("86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa")
+	if lm := field(t, msg, 0); !bytes.Equal(lm, wantLM) {
+		t.Errorf("LMv2 response = %x, want %x", lm, wantLM)
+	}
+	wantProof := mustDecodeHex("68cd0ab851e51c96aabc927bebef6a1c")
+	if nt := field(t, msg, 1); len(nt) < 16 || !bytes.Equal(nt[:16], wantProof) {
+		t.Errorf("NTProofStr = %x, want %x", nt, wantProof)
+	}
+	if domain := field(t, msg, 2); !bytes.Equal(domain, encodeString("Domain")) {
+		t.Errorf("domain = %x", domain)
+	}
+	if user := field(t, msg, 3); !bytes.Equal(user, encodeString("User")) {
+		t.Errorf("user = %x", user)
+	}
+
+	if _, err := a.Next(testChallenge(targetInfo)); err == nil {
+		t.Error("Next: expected an error for a second challenge")
+	}
+}
+
+func TestClient_timestamp(t *testing.T) {
+	a := NewClient("", `Domain\User`, "Password")
+	if a.Domain != "Domain" || a.Username != "User" {
+		t.Fatalf("unexpected domain %q and username %q", a.Domain, a.Username)
+	}
+	a.Start()
+
+	ts := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	targetInfo := append(avPair(avIDTimestamp, ts), avPair(avIDEOL, nil)...)
+	msg, err := a.Next(testChallenge(targetInfo))
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if lm := field(t, msg, 0); !bytes.Equal(lm, make([]byte, 24)) {
+		t.Errorf("LMv2 response sent with a server timestamp: %x", lm)
+	}
+	if nt := field(t, msg, 1); len(nt) < 32 || !bytes.Equal(nt[24:32], ts) {
+		t.Errorf("server timestamp not used: %x", nt)
+	}
+}
+
+func TestClient_invalidChallenge(t *testing.T) {
+	for _, challenge := range [][]byte{
+		nil,
+		[]byte("NTLMSSP\x00"),
+		testChallenge(nil)[:challengeHeaderLen-1],
+		func() []byte {
+			b := testChallenge(nil)
+			binary.LittleEndian.PutUint16(b[40:], 100)
+			return b
+		}(),
+	} {
+		a := NewClient("Domain", "User", "Password")
+		a.Start()
+		if _, err := a.Next(challenge); err != ErrInvalidChallenge {
+			t.Errorf("Next(%x) = %v, want ErrInvalidChallenge", challenge, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package smtp
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/emersion/go-sasl"
+)
+
+// OAuthTokenFunc returns an OAuth 2.0 access token. If refresh is true, the
+// previously returned token has been rejected by the server and a new one must
+// be obtained instead of returning a cached value.
+type OAuthTokenFunc func(refresh bool) (token string, err error)
+
+// OAuthError is returned when the server rejects an OAuth access token.
+type OAuthError struct {
+	Status  string `json:"status"`
+	Schemes string `json:"schemes"`
+	Scope   string `json:"scope"`
+}
+
+func (err *OAuthError) Error() string {
+	return "smtp: OAuth authentication error (" + err.Status + ")"
+}
+
+// OAuthClient is a SASL client for the OAUTHBEARER (RFC 7628) and XOAUTH2
+// mechanisms. Access tokens are obtained with a callback, so that expired
+// tokens can be refreshed.
+//
+// When passed to Client.Auth, a rejected token is refreshed and
+// authentication is retried once on the same connection.
+type OAuthClient struct {
+	// Mechanism is either sasl.OAuthBearer or sasl.Xoauth2.
+	Mechanism string
+	Username  string
+	// Host and Port are sent to the server with OAUTHBEARER, they are
+	// optional.
+	Host string
+	Port int
+	// Token fetches the access token.
+	Token OAuthTokenFunc
+
+	rejected bool
+}
+
+var _ sasl.Client = (*OAuthClient)(nil)
+
+// NewOAuthBearerClient returns an OAUTHBEARER client.
+func NewOAuthBearerClient(username string, token OAuthTokenFunc) *OAuthClient {
+	return &OAuthClient{Mechanism: sasl.OAuthBearer, Username: username, Token: token}
+}
+
+// NewXOAuth2Client returns an XOAUTH2 client.
+func NewXOAuth2Client(username string, token OAuthTokenFunc) *OAuthClient {
+	return &OAuthClient{Mechanism: sasl.Xoauth2, Username: username, Token: token}
+}
+
+// Start implements sasl.Client.
+func (a *OAuthClient) Start() (mech string, ir []byte, err error) {
+	if a.Token == nil {
+		return "", nil, errors.New("smtp: missing OAuth token callback")
+	}
+	token, err := a.Token(a.rejected)
+	if err != nil {
+		return "", nil, err
+	}
+	a.rejected = false
+
+	switch a.Mechanism {
+	case sasl.OAuthBearer:
+		s := "n,a=" + a.Username + ","
+		if a.Host != "" {
+			s += "\x01host=" + a.Host
+		}
+		if a.Port != 0 {
+			s += "\x01port=" + strconv.Itoa(a.Port)
+		}
+		s += "\x01auth=Bearer " + token + "\x01\x01"
+		return a.Mechanism, []byte(s), nil
+	case sasl.Xoauth2:
+		s := "user=" + a.Username + "\x01auth=Bearer " + token + "\x01\x01"
+		return a.Mechanism, []byte(s), nil
+	default:
+		return "", nil, errors.New("smtp: unsupported OAuth mechanism: " + a.Mechanism)
+	}
+}
+
+// Next implements sasl.Client. The server only sends a challenge to report an
+// error.
+func (a *OAuthClient) Next(challenge []byte) ([]byte, error) {
+	a.rejected = true
+	oauthErr := &OAuthError{}
+	if err := json.Unmarshal(challenge, oauthErr); err != nil {
+		return nil, err
+	}
+	return nil, oauthErr
+}
@@ -0,0 +1,240 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"io"
+	"time"
+)
+
+// A ServerOption configures a Server created by NewServer.
+type ServerOption func(*Server)
+
+// WithAddr sets the TCP or Unix address to listen on.
+func WithAddr(addr string) ServerOption {
+	return func(s *Server) {
+		s.Addr = addr
+	}
+}
+
+// WithDomain sets the domain name announced by the server.
+func WithDomain(domain string) ServerOption {
+	return func(s *Server) {
+		s.Domain = domain
+	}
+}
+
+// WithTLS sets the TLS configuration, used for STARTTLS and implicit TLS.
+func WithTLS(config *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.TLSConfig = config
+	}
+}
+
+// WithLMTP enables LMTP mode, as defined in RFC 2033.
+func WithLMTP() ServerOption {
+	return func(s *Server) {
+		s.LMTP = true
+	}
+}
+
+// WithMaxSize sets the maximum size of a message, in bytes.
+func WithMaxSize(n int) ServerOption {
+	return func(s *Server) {
+		s.MaxMessageBytes = n
+	}
+}
+
+// WithMaxLineLength sets the maximum length of message data lines, in bytes,
+// excluding CRLF.
+func WithMaxLineLength(n int) ServerOption {
+	return func(s *Server) {
+		s.MaxLineLength = n
+	}
+}
+
+// WithRejectBareLF rejects message data lines ending with a bare LF.
+func WithRejectBareLF() ServerOption {
+	return func(s *Server) {
+		s.RejectBareLF = true
+	}
+}
+
+// WithMaxRecipients sets the maximum number of recipients of a message.
+func WithMaxRecipients(n int) ServerOption {
+	return func(s *Server) {
+		s.MaxRecipients = n
+	}
+}
+
+// WithTimeouts sets the read and write timeouts of connections.
+func WithTimeouts(read, write time.Duration) ServerOption {
+	return func(s *Server) {
+		s.ReadTimeout = read
+		s.WriteTimeout = write
+	}
+}
+
+// WithMaxConnections limits the number of connections handled concurrently.
+// New connections wait up to wait for a slot before being rejected.
+func WithMaxConnections(n int, wait time.Duration) ServerOption {
+	return func(s *Server) {
+		s.MaxConnections = n
+		s.ConnectionWaitTimeout = wait
+	}
+}
+
+// WithLoadHook sets a hook deciding whether each connection is served, and
+// how long its greeting is delayed, depending on the load.
+func WithLoadHook(hook LoadHook) ServerOption {
+	return func(s *Server) {
+		s.LoadHook = hook
+	}
+}
+
+// WithRcptFailureLimit closes connections when more than n recipients are
+// rejected within window. A zero window means the whole connection.
+func WithRcptFailureLimit(n int, window time.Duration) ServerOption {
+	return func(s *Server) {
+		s.MaxRcptFailures = n
+		s.RcptFailureWindow = window
+	}
+}
+
+// WithBufferSizes sets the sizes of the buffers used to read from and write to
+// connections.
+func WithBufferSizes(read, write int) ServerOption {
+	return func(s *Server) {
+		s.ReadBufferSize = read
+		s.WriteBufferSize = write
+	}
+}
+
+// WithDataBuffer buffers up to size bytes of message data ahead of the
+// backend, and applies policy when the buffer stays full for stallTimeout.
+func WithDataBuffer(size int, stallTimeout time.Duration, policy DataStallPolicy) ServerOption {
+	return func(s *Server) {
+		s.DataBufferSize = size
+		s.DataStallTimeout = stallTimeout
+		s.DataStallPolicy = policy
+	}
+}
+
+// WithProfiling tags goroutines handling connections with pprof labels, and
+// sets a hook called around the handling of each command. hook may be nil.
+func WithProfiling(hook StageHook) ServerOption {
+	return func(s *Server) {
+		s.ProfilingLabels = true
+		s.StageHook = hook
+	}
+}
+
+// WithAuthMechanism enables an authentication mechanism. It can also be used
+// to replace the built-in PLAIN mechanism.
+func WithAuthMechanism(name string, f SaslServerFactory) ServerOption {
+	return func(s *Server) {
+		s.EnableAuth(name, f)
+	}
+}
+
+// WithInsecureAuth allows authentication over connections without TLS.
+func WithInsecureAuth() ServerOption {
+	return func(s *Server) {
+		s.AllowInsecureAuth = true
+	}
+}
+
+// WithAuthPolicy restricts an authentication mechanism to some connections.
+func WithAuthPolicy(mechanism string, policy AuthPolicy) ServerOption {
+	return func(s *Server) {
+		if s.AuthPolicies == nil {
+			s.AuthPolicies = make(map[string]AuthPolicy)
+		}
+		s.AuthPolicies[mechanism] = policy
+	}
+}
+
+// WithRejectUnauthPipelining rejects clients sending commands or message data
+// without waiting for replies when PIPELINING doesn't allow it.
+func WithRejectUnauthPipelining() ServerOption {
+	return func(s *Server) {
+		s.RejectUnauthPipelining = true
+	}
+}
+
+// WithRequireESMTP rejects HELO, clients must use EHLO.
+func WithRequireESMTP() ServerOption {
+	return func(s *Server) {
+		s.RequireESMTP = true
+	}
+}
+
+// WithRejectUnknownParams rejects MAIL commands with unsupported parameters.
+func WithRejectUnknownParams() ServerOption {
+	return func(s *Server) {
+		s.RejectUnknownParams = true
+	}
+}
+
+// WithAuthDisabled disables authentication.
+func WithAuthDisabled() ServerOption {
+	return func(s *Server) {
+		s.AuthDisabled = true
+	}
+}
+
+// WithRcptNormalization normalizes recipient addresses before passing them to
+// sessions.
+func WithRcptNormalization(n AddressNormalization) ServerOption {
+	return func(s *Server) {
+		s.RcptNormalization = &n
+	}
+}
+
+// WithVrfyMode sets how VRFY commands are replied.
+func WithVrfyMode(mode VrfyMode) ServerOption {
+	return func(s *Server) {
+		s.VrfyMode = mode
+	}
+}
+
+// WithSMTPUTF8 enables the SMTPUTF8 extension, defined in RFC 6531.
+func WithSMTPUTF8() ServerOption {
+	return func(s *Server) {
+		s.EnableSMTPUTF8 = true
+	}
+}
+
+// WithEnhancedCodesDisabled removes enhanced status codes from replies.
+func WithEnhancedCodesDisabled() ServerOption {
+	return func(s *Server) {
+		s.DisableEnhancedCodes = true
+	}
+}
+
+// WithDisabledCommands rejects the listed commands.
+func WithDisabledCommands(cmds ...string) ServerOption {
+	return func(s *Server) {
+		s.DisabledCommands = append(s.DisabledCommands, cmds...)
+	}
+}
+
+// WithAllowedCommands rejects commands which are not listed.
+func WithAllowedCommands(cmds ...string) ServerOption {
+	return func(s *Server) {
+		s.AllowedCommands = append(s.AllowedCommands, cmds...)
+	}
+}
+
+// WithLogger sets the logger used to report unexpected internal errors.
+func WithLogger(l Logger) ServerOption {
+	return func(s *Server) {
+		s.ErrorLog = l
+	}
+}
+
+// WithDebug sets a writer receiving a copy of the protocol traffic.
+func WithDebug(w io.Writer) ServerOption {
+	return func(s *Server) {
+		s.Debug = w
+	}
+}
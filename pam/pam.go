@@ -0,0 +1,42 @@
+// Package pam checks credentials with PAM (Pluggable Authentication
+// Modules), so that Unix system accounts can authenticate.
+//
+// PAM support requires cgo, the PAM development headers and the "pam" build
+// tag:
+//
+//	go build -tags pam
+//
+// Without it, Authenticator.Auth always fails with ErrUnsupported.
+package pam
+
+import (
+	"errors"
+)
+
+var (
+	// ErrInvalidCredentials is returned by Authenticator.Auth when the
+	// username or password is wrong, or when the account can't be used.
+	ErrInvalidCredentials = errors.New("Invalid username or password")
+	// ErrUnsupported is returned by Authenticator.Auth when PAM support isn't
+	// built in.
+	ErrUnsupported = errors.New("pam: not supported, build with the pam tag")
+)
+
+// Authenticator checks credentials with PAM. Its Auth method can be used as
+// backendutil.RouterBackend.Auth.
+//
+// Password prompts are answered with the password, other prompts with the
+// username. The account is checked as well, so that expired or locked
+// accounts are rejected.
+type Authenticator struct {
+	// Service is the PAM service name, which selects the configuration file
+	// in /etc/pam.d. If empty, "smtp" is used.
+	Service string
+}
+
+func (a *Authenticator) service() string {
+	if a.Service != "" {
+		return a.Service
+	}
+	return "smtp"
+}
@@ -0,0 +1,113 @@
+//go:build pam && cgo
+
+package pam
+
+/*
+#cgo LDFLAGS: -lpam
+#include <security/pam_appl.h>
+#include <stdlib.h>
+#include <string.h>
+
+struct credentials {
+	const char *username;
+	const char *password;
+};
+
+static int conversation(int num_msg, const struct pam_message **msg, struct pam_response **resp, void *appdata_ptr) {
+	struct credentials *creds = appdata_ptr;
+	struct pam_response *r;
+	int i;
+
+	if (num_msg <= 0) {
+		return PAM_CONV_ERR;
+	}
+	r = calloc(num_msg, sizeof(struct pam_response));
+	if (r == NULL) {
+		return PAM_BUF_ERR;
+	}
+	for (i = 0; i < num_msg; i++) {
+		const char *value;
+		switch (msg[i]->msg_style) {
+		case PAM_PROMPT_ECHO_OFF:
+			value = creds->password;
+			break;
+		case PAM_PROMPT_ECHO_ON:
+			value = creds->username;
+			break;
+		case PAM_ERROR_MSG:
+		case PAM_TEXT_INFO:
+			continue;
+		default:
+			goto fail;
+		}
+		r[i].resp = strdup(value);
+		if (r[i].resp == NULL) {
+			goto fail;
+		}
+	}
+	*resp = r;
+	return PAM_SUCCESS;
+
+fail:
+	for (i = 0; i < num_msg; i++) {
+		if (r[i].resp != NULL) {
+			memset(r[i].resp, 0, strlen(r[i].resp));
+			free(r[i].resp);
+		}
+	}
+	free(r);
+	return PAM_CONV_ERR;
+}
+
+static int authenticate(const char *service, const char *username, const char *password) {
+	struct credentials creds = { username, password };
+	struct pam_conv conv = { conversation, &creds };
+	pam_handle_t *handle = NULL;
+	int ret;
+
+	ret = pam_start(service, username, &conv, &handle);
+	if (ret != PAM_SUCCESS) {
+		return ret;
+	}
+	ret = pam_authenticate(handle, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+	if (ret == PAM_SUCCESS) {
+		ret = pam_acct_mgmt(handle, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+	}
+	pam_end(handle, ret);
+	return ret;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// Auth checks a username and password.
+func (a *Authenticator) Auth(username, password string) error {
+	if username == "" || password == "" || strings.ContainsRune(username+password, 0) {
+		return ErrInvalidCredentials
+	}
+
+	cService := C.CString(a.service())
+	defer C.free(unsafe.Pointer(cService))
+	cUsername := C.CString(username)
+	defer C.free(unsafe.Pointer(cUsername))
+	cPassword := C.CString(password)
+	defer func() {
+		C.memset(unsafe.Pointer(cPassword), 0, C.size_t(len(password)))
+		C.free(unsafe.Pointer(cPassword))
+	}()
+
+	switch ret := C.authenticate(cService, cUsername, cPassword); ret {
+	case C.PAM_SUCCESS:
+		return nil
+	case C.PAM_AUTH_ERR, C.PAM_USER_UNKNOWN, C.PAM_MAXTRIES, C.PAM_ACCT_EXPIRED,
+		C.PAM_PERM_DENIED, C.PAM_NEW_AUTHTOK_REQD, C.PAM_CRED_INSUFFICIENT:
+		return ErrInvalidCredentials
+	default:
+		return fmt.Errorf("pam: %v", C.GoString(C.pam_strerror(nil, ret)))
+	}
+}
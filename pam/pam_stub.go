@@ -0,0 +1,8 @@
+//go:build !pam || !cgo
+
+package pam
+
+// Auth checks a username and password.
+func (a *Authenticator) Auth(username, password string) error {
+	return ErrUnsupported
+}
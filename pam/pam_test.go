@@ -0,0 +1,21 @@
+package pam
+
+import (
+	"testing"
+)
+
+func TestAuthenticator_service(t *testing.T) {
+	if s := (&Authenticator{}).service(); s != "smtp" {
+		t.Errorf("service() = %q, want smtp", s)
+	}
+	if s := (&Authenticator{Service: "submission"}).service(); s != "submission" {
+		t.Errorf("service() = %q, want submission", s)
+	}
+}
+
+func TestAuthenticator_emptyPassword(t *testing.T) {
+	a := &Authenticator{}
+	if err := a.Auth("root", ""); err == nil {
+		t.Error("Auth: expected an error with an empty password")
+	}
+}
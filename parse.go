@@ -10,7 +10,7 @@ func parseCmd(line string) (cmd string, arg string, err error) {
 
 	l := len(line)
 	switch {
-	case strings.HasPrefix(strings.ToUpper(line), "STARTTLS"):
+	case len(line) >= 8 && strings.EqualFold(line[:8], "STARTTLS"):
 		return "STARTTLS", "", nil
 	case l == 0:
 		return "", "", nil
@@ -34,37 +34,24 @@ func parseCmd(line string) (cmd string, arg string, err error) {
 	return strings.ToUpper(line[0:4]), strings.Trim(line[5:], " \n\r"), nil
 }
 
-// Takes the arguments proceeding a command and files them
-// into a map[string]string after uppercasing each key.  Sample arg
-// string:
-//		" BODY=8BITMIME SIZE=1024"
-// The leading space is mandatory.
-func parseArgs(args []string) (map[string]string, error) {
-	argMap := map[string]string{}
-	for _, arg := range args {
-		if arg == "" {
-			continue
-		}
-		m := strings.Split(arg, "=")
-		arg_len := len(m)
-		if arg_len > 2 {
-			return nil, fmt.Errorf("Failed to parse arg string: %q", arg)
-		}else if arg_len == 1 {
-			argMap[strings.ToUpper(arg)] = "1"
-		}else{
-			argMap[strings.ToUpper(m[0])] = m[1]
-		}
+// splitCmd splits a command line which parseCmd rejected into an upper-case
+// command name and an argument.
+func splitCmd(line string) (cmd string, arg string) {
+	line = strings.TrimRight(line, "\r\n")
+	cmd = line
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		cmd, arg = line[:i], strings.Trim(line[i+1:], " ")
 	}
-	return argMap, nil
+	return strings.ToUpper(cmd), arg
 }
 
-func parseHelloArgument(arg string) (string, error) {
-	domain := arg
-	if idx := strings.IndexRune(arg, ' '); idx >= 0 {
-		domain = arg[:idx]
-	}
-	if domain == "" {
-		return "", fmt.Errorf("Invalid domain")
+// splitPath splits a MAIL or RCPT argument into a path and parameters,
+// without validating them. Angle brackets around the path are optional.
+func splitPath(s string) (path, params string) {
+	s = strings.Trim(s, " ")
+	path = s
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		path, params = s[:i], s[i+1:]
 	}
-	return domain, nil
+	return strings.Trim(path, "<> "), params
 }
@@ -0,0 +1,88 @@
+package parse_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp/parse"
+)
+
+func FuzzParams(f *testing.F) {
+	for _, s := range []string{
+		"SIZE=1024 BODY=8BITMIME",
+		"SMTPUTF8",
+		"AUTH=<> RET=HDRS ENVID=QQ314159",
+		"NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;bob@example.org",
+		"SIZE=1=2",
+		"",
+	} {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		params, err := parse.Params(s)
+		if err != nil {
+			return
+		}
+		for k, v := range params {
+			if k != strings.ToUpper(k) {
+				t.Errorf("Params(%q): keyword %q is not upper-case", s, k)
+			}
+			if strings.ContainsAny(v, " =") {
+				t.Errorf("Params(%q): invalid value %q", s, v)
+			}
+		}
+	})
+}
+
+func FuzzPath(f *testing.F) {
+	for _, tc := range pathTests {
+		f.Add(tc.in)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		if mailbox, _, err := parse.Path(s); err == nil && !strings.EqualFold(mailbox, "postmaster") {
+			if _, _, err := parse.Mailbox(mailbox); err != nil {
+				t.Errorf("Path(%q) returned invalid mailbox %q: %v", s, mailbox, err)
+			}
+		}
+		if mailbox, params, err := parse.ReversePath(s); err == nil {
+			if mailbox != "" {
+				if _, _, err := parse.Mailbox(mailbox); err != nil {
+					t.Errorf("ReversePath(%q) returned invalid mailbox %q: %v", s, mailbox, err)
+				}
+			}
+			if params != strings.TrimSpace(params) {
+				t.Errorf("ReversePath(%q) returned untrimmed parameters %q", s, params)
+			}
+		}
+	})
+}
+
+func FuzzMailbox(f *testing.F) {
+	for _, s := range []string{
+		"alice@example.org",
+		"\"alice smith\"@example.org",
+		"alice@[192.0.2.1]",
+		"alice@[IPv6:2001:db8::1]",
+		"élodie@exemple.fr",
+		"alice",
+	} {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		localPart, domain, err := parse.Mailbox(s)
+		if err != nil {
+			return
+		}
+		if localPart+"@"+domain != s {
+			t.Errorf("Mailbox(%q) = %q, %q", s, localPart, domain)
+		}
+		if !strings.HasPrefix(domain, "[") {
+			if err := parse.Domain(domain); err != nil {
+				t.Errorf("Mailbox(%q) returned invalid domain %q: %v", s, domain, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,321 @@
+// Package parse implements parsing of SMTP command arguments, as defined in
+// RFC 5321 section 4.1.2.
+//
+// The server uses this package to parse the arguments of the HELO, MAIL and
+// RCPT commands. Backends and tools can use it to validate addresses the same
+// way.
+package parse
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Hello parses the argument of a HELO, EHLO or LHLO command and returns the
+// client domain or address literal. Anything after the first space is
+// ignored, and the domain isn't validated since many clients send invalid
+// ones.
+func Hello(arg string) (string, error) {
+	domain := arg
+	if i := strings.IndexByte(arg, ' '); i >= 0 {
+		domain = arg[:i]
+	}
+	if domain == "" {
+		return "", errors.New("parse: missing domain")
+	}
+	return domain, nil
+}
+
+// Params parses ESMTP parameters, such as "SIZE=1024 BODY=8BITMIME".
+// Keywords are upper-cased. Keywords without a value are mapped to an empty
+// string.
+func Params(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	for s != "" {
+		k, v, rest, err := NextParam(s)
+		if err != nil {
+			return nil, err
+		}
+		s = rest
+		if k == "" {
+			break
+		}
+
+		k = strings.ToUpper(k)
+		if _, ok := params[k]; ok {
+			return nil, fmt.Errorf("parse: duplicate parameter %q", k)
+		}
+		params[k] = v
+	}
+	return params, nil
+}
+
+// NextParam parses the first ESMTP parameter of s and returns its keyword,
+// its value and the remaining parameters. The keyword is empty if there are
+// no more parameters. Unlike Params, it doesn't allocate and the keyword case
+// is preserved.
+func NextParam(s string) (keyword, value, rest string, err error) {
+	s = strings.TrimLeft(s, " ")
+	if s == "" {
+		return "", "", "", nil
+	}
+	param := s
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		param, rest = s[:i], s[i+1:]
+	}
+
+	keyword = param
+	if i := strings.IndexByte(param, '='); i >= 0 {
+		keyword, value = param[:i], param[i+1:]
+		if !isParamValue(value) {
+			return "", "", "", fmt.Errorf("parse: invalid value for parameter %q", keyword)
+		}
+	}
+	if !isKeyword(keyword) {
+		return "", "", "", fmt.Errorf("parse: invalid parameter keyword %q", keyword)
+	}
+	return keyword, value, rest, nil
+}
+
+// isKeyword reports whether s is an esmtp-keyword.
+func isKeyword(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !isAlphaNum(c) && (c != '-' || i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// isParamValue reports whether s is an esmtp-value. UTF-8 is allowed, as
+// specified in RFC 6531.
+func isParamValue(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '=' || c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// ReversePath parses the argument of a MAIL command following "FROM:". It
+// returns the mailbox, which is empty for the null reverse path "<>", and the
+// unparsed parameters.
+func ReversePath(s string) (mailbox, params string, err error) {
+	mailbox, params, err = path(s)
+	if err != nil || mailbox == "" {
+		return mailbox, params, err
+	}
+	if _, _, err := Mailbox(mailbox); err != nil {
+		return "", "", err
+	}
+	return mailbox, params, nil
+}
+
+// Path parses the argument of a RCPT command following "TO:". It returns the
+// mailbox and the unparsed parameters. The special "<Postmaster>" path is
+// returned as "Postmaster".
+func Path(s string) (mailbox, params string, err error) {
+	mailbox, params, err = path(s)
+	if err != nil {
+		return "", "", err
+	}
+	if strings.EqualFold(mailbox, "postmaster") {
+		return mailbox, params, nil
+	}
+	if mailbox == "" {
+		return "", "", errors.New("parse: empty path")
+	}
+	if _, _, err := Mailbox(mailbox); err != nil {
+		return "", "", err
+	}
+	return mailbox, params, nil
+}
+
+// path splits a path between angle brackets from the following parameters,
+// and strips source routes.
+func path(s string) (mailbox, params string, err error) {
+	s = strings.TrimLeft(s, " ")
+	if !strings.HasPrefix(s, "<") {
+		return "", "", errors.New("parse: missing '<' in path")
+	}
+
+	end := -1
+	quoted := false
+	for i := 1; i < len(s) && end < 0; i++ {
+		switch s[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case '>':
+			if !quoted {
+				end = i
+			}
+		}
+	}
+	if end < 0 {
+		return "", "", errors.New("parse: missing '>' in path")
+	}
+	mailbox, params = s[1:end], s[end+1:]
+	if params != "" && params[0] != ' ' {
+		return "", "", errors.New("parse: missing space after path")
+	}
+
+	// Source routes must be accepted and ignored, see RFC 5321 section 4.1.2
+	if strings.HasPrefix(mailbox, "@") {
+		i := strings.IndexByte(mailbox, ':')
+		if i < 0 {
+			return "", "", errors.New("parse: missing ':' after source route")
+		}
+		route := mailbox[:i]
+		for route != "" {
+			hop := route
+			if j := strings.IndexByte(route, ','); j >= 0 {
+				hop, route = route[:j], route[j+1:]
+			} else {
+				route = ""
+			}
+			if !strings.HasPrefix(hop, "@") || Domain(hop[1:]) != nil {
+				return "", "", fmt.Errorf("parse: invalid source route %q", mailbox[:i])
+			}
+		}
+		mailbox = mailbox[i+1:]
+	}
+
+	return mailbox, strings.TrimSpace(params), nil
+}
+
+// Mailbox parses a mailbox, such as "user@example.org", and returns its local
+// part and domain. The domain can be an address literal, such as
+// "[192.0.2.1]". Internationalized mailboxes are allowed, as specified in
+// RFC 6531.
+func Mailbox(s string) (localPart, domain string, err error) {
+	var i int
+	if strings.HasPrefix(s, "\"") {
+		i, err = quotedStringEnd(s)
+		if err != nil {
+			return "", "", err
+		}
+	} else {
+		i = strings.LastIndexByte(s, '@')
+		if i < 0 {
+			return "", "", fmt.Errorf("parse: missing '@' in mailbox %q", s)
+		}
+		if !isDotString(s[:i]) {
+			return "", "", fmt.Errorf("parse: invalid local part in mailbox %q", s)
+		}
+	}
+	if i >= len(s) || s[i] != '@' {
+		return "", "", fmt.Errorf("parse: missing '@' in mailbox %q", s)
+	}
+
+	localPart, domain = s[:i], s[i+1:]
+	if err := Host(domain); err != nil {
+		return "", "", err
+	}
+	return localPart, domain, nil
+}
+
+// Host checks that s is a valid domain name or address literal, as used in
+// mailboxes and in the HELO and EHLO commands.
+func Host(s string) error {
+	if strings.HasPrefix(s, "[") {
+		return addressLiteral(s)
+	}
+	return Domain(s)
+}
+
+// quotedStringEnd returns the index following a quoted string.
+func quotedStringEnd(s string) (int, error) {
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+			if i >= len(s) || s[i] < ' ' || s[i] == 0x7f {
+				return 0, errors.New("parse: invalid quoted pair in local part")
+			}
+		case c == '"':
+			return i + 1, nil
+		case c < ' ' || c == 0x7f:
+			return 0, errors.New("parse: invalid character in quoted local part")
+		}
+	}
+	return 0, errors.New("parse: unterminated quoted local part")
+}
+
+func isDotString(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '.' {
+			// Dots must separate non-empty atoms
+			if i == 0 || i == len(s)-1 || s[i-1] == '.' {
+				return false
+			}
+		} else if !isAtext(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isAtext(c byte) bool {
+	return isAlphaNum(c) || strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0 || c >= 0x80
+}
+
+func isAlphaNum(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// Domain checks that s is a valid domain name. Internationalized domain names
+// are allowed, as specified in RFC 6531.
+func Domain(s string) error {
+	if s == "" {
+		return errors.New("parse: empty domain")
+	}
+	start := 0
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) && s[i] != '.' {
+			if c := s[i]; !isAlphaNum(c) && c != '-' && c < 0x80 {
+				return fmt.Errorf("parse: invalid domain %q", s)
+			}
+			continue
+		}
+		// Labels must be non-empty and can't start or end with a hyphen
+		label := s[start:i]
+		if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("parse: invalid domain %q", s)
+		}
+		start = i + 1
+	}
+	return nil
+}
+
+// addressLiteral checks that s is an IPv4 or IPv6 address literal.
+func addressLiteral(s string) error {
+	if !strings.HasSuffix(s, "]") {
+		return fmt.Errorf("parse: unterminated address literal %q", s)
+	}
+	lit := s[1 : len(s)-1]
+	if strings.HasPrefix(lit, "IPv6:") {
+		if ip := net.ParseIP(lit[5:]); ip != nil && strings.Contains(lit[5:], ":") {
+			return nil
+		}
+	} else if ip := net.ParseIP(lit); ip != nil && ip.To4() != nil && !strings.Contains(lit, ":") {
+		return nil
+	}
+	return fmt.Errorf("parse: invalid address literal %q", s)
+}
@@ -0,0 +1,157 @@
+package parse_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp/parse"
+)
+
+func TestParams(t *testing.T) {
+	params, err := parse.Params("size=1024  BODY=8BITMIME SMTPUTF8")
+	if err != nil {
+		t.Fatalf("Params: %v", err)
+	}
+	want := map[string]string{"SIZE": "1024", "BODY": "8BITMIME", "SMTPUTF8": ""}
+	if !reflect.DeepEqual(params, want) {
+		t.Errorf("Params = %v, want %v", params, want)
+	}
+
+	for _, s := range []string{"SIZE=1=2", "-SIZE=1", "SIZE=", "SI_ZE=1", "SIZE=1 size=2"} {
+		if _, err := parse.Params(s); err == nil {
+			t.Errorf("Params(%q): expected error", s)
+		}
+	}
+}
+
+func TestNextParam(t *testing.T) {
+	k, v, rest, err := parse.NextParam(" size=1024  BODY=8BITMIME")
+	if err != nil || k != "size" || v != "1024" || rest != " BODY=8BITMIME" {
+		t.Errorf("NextParam = %q, %q, %q, %v", k, v, rest, err)
+	}
+	k, v, rest, err = parse.NextParam(rest)
+	if err != nil || k != "BODY" || v != "8BITMIME" || rest != "" {
+		t.Errorf("NextParam = %q, %q, %q, %v", k, v, rest, err)
+	}
+	if k, _, _, err := parse.NextParam("  "); err != nil || k != "" {
+		t.Errorf("NextParam on blank string = %q, %v", k, err)
+	}
+}
+
+func TestHello(t *testing.T) {
+	if domain, err := parse.Hello("mx.example.org extra"); err != nil || domain != "mx.example.org" {
+		t.Errorf("Hello = %q, %v", domain, err)
+	}
+	if _, err := parse.Hello(""); err == nil {
+		t.Error("Hello: expected error for empty argument")
+	}
+}
+
+func TestHost(t *testing.T) {
+	for _, s := range []string{"mx.example.org", "localhost", "[192.0.2.1]", "[IPv6:2001:db8::1]"} {
+		if err := parse.Host(s); err != nil {
+			t.Errorf("Host(%q) = %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "mx..example.org", "-mx.example.org", "mx example.org", "[192.0.2.1", "[2001:db8::1]"} {
+		if err := parse.Host(s); err == nil {
+			t.Errorf("Host(%q): expected error", s)
+		}
+	}
+}
+
+func TestDomainToASCII(t *testing.T) {
+	for in, want := range map[string]string{
+		"mx.example.org":    "mx.example.org",
+		"bücher.example":    "xn--bcher-kva.example",
+		"MÜNCHEN.de":        "xn--mnchen-3ya.de",
+		"例え.テスト":            "xn--r8jz45g.xn--zckzah",
+		"ليهمابتكلموشعربي؟": "xn--egbpdaj6bu4bxfgehfvwxn",
+	} {
+		if got, err := parse.DomainToASCII(in); err != nil || got != want {
+			t.Errorf("DomainToASCII(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	for _, s := range []string{"bü..example", "bü cher.example", strings.Repeat("ü", 64) + ".example"} {
+		if _, err := parse.DomainToASCII(s); err == nil {
+			t.Errorf("DomainToASCII(%q): expected error", s)
+		}
+	}
+}
+
+var pathTests = []struct {
+	in      string
+	mailbox string
+	params  string
+	reverse bool
+	ok      bool
+}{
+	{"<alice@example.org>", "alice@example.org", "", false, true},
+	{"<alice@example.org> SIZE=1024", "alice@example.org", "SIZE=1024", false, true},
+	{"<@a.example,@b.example:alice@example.org>", "alice@example.org", "", false, true},
+	{"<\"alice smith\"@example.org>", "\"alice smith\"@example.org", "", false, true},
+	{"<\"a>b\"@example.org>", "\"a>b\"@example.org", "", false, true},
+	{"<alice@[192.0.2.1]>", "alice@[192.0.2.1]", "", false, true},
+	{"<alice@[IPv6:2001:db8::1]>", "alice@[IPv6:2001:db8::1]", "", false, true},
+	{"<élodie@exemple.fr>", "élodie@exemple.fr", "", false, true},
+	{"<Postmaster>", "Postmaster", "", false, true},
+	{"<>", "", "", true, true},
+	{"<> BODY=8BITMIME", "", "BODY=8BITMIME", true, true},
+	{"<>", "", "", false, false},
+	{"alice@example.org", "", "", false, false},
+	{"<alice@example.org", "", "", false, false},
+	{"<alice@example.org>SIZE=1", "", "", false, false},
+	{"<alice>", "", "", false, false},
+	{"<alice..smith@example.org>", "", "", false, false},
+	{"<alice@-example.org>", "", "", false, false},
+	{"<alice@example..org>", "", "", false, false},
+	{"<alice@[192.0.2.256]>", "", "", false, false},
+	{"<@a.example:>", "", "", false, false},
+	{"<Postmaster>", "", "", true, false},
+}
+
+func TestPath(t *testing.T) {
+	for _, tc := range pathTests {
+		f := parse.Path
+		if tc.reverse {
+			f = parse.ReversePath
+		}
+		mailbox, params, err := f(tc.in)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("path(%q) (reverse=%v): expected error", tc.in, tc.reverse)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("path(%q) (reverse=%v): %v", tc.in, tc.reverse, err)
+		} else if mailbox != tc.mailbox || params != tc.params {
+			t.Errorf("path(%q) (reverse=%v) = %q, %q, want %q, %q", tc.in, tc.reverse, mailbox, params, tc.mailbox, tc.params)
+		}
+	}
+}
+
+func TestMailbox(t *testing.T) {
+	localPart, domain, err := parse.Mailbox("alice+tag@Example.org")
+	if err != nil {
+		t.Fatalf("Mailbox: %v", err)
+	}
+	if localPart != "alice+tag" || domain != "Example.org" {
+		t.Errorf("Mailbox = %q, %q", localPart, domain)
+	}
+}
+
+func BenchmarkParams(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		parse.Params("SIZE=1024 BODY=8BITMIME")
+	}
+}
+
+func BenchmarkPath(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		parse.Path("<bob@example.org> NOTIFY=NEVER")
+	}
+}
@@ -0,0 +1,148 @@
+package parse
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Punycode parameters, see RFC 3492 section 5.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// DomainToASCII converts an internationalized domain name to its ASCII form,
+// by encoding each non-ASCII label with Punycode as an A-label ("xn--..."),
+// as specified in RFC 5891. Labels are lower-cased, but not normalized: the
+// domain must already be in Unicode Normalization Form C. ASCII domains are
+// returned unchanged.
+func DomainToASCII(s string) (string, error) {
+	if isASCII(s) {
+		return s, nil
+	}
+	labels := strings.Split(s, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		enc, err := punycodeEncode(strings.ToLower(label))
+		if err != nil {
+			return "", fmt.Errorf("parse: invalid domain %q: %v", s, err)
+		}
+		labels[i] = "xn--" + enc
+	}
+	ascii := strings.Join(labels, ".")
+	if err := Domain(ascii); err != nil {
+		return "", err
+	}
+	for _, label := range labels {
+		if len(label) > 63 {
+			return "", fmt.Errorf("parse: label too long in domain %q", s)
+		}
+	}
+	return ascii, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// punycodeEncode encodes a label with Punycode, see RFC 3492 section 6.3.
+func punycodeEncode(s string) (string, error) {
+	if !utf8.ValidString(s) {
+		return "", errors.New("invalid UTF-8")
+	}
+	runes := []rune(s)
+
+	var out []byte
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for h := basic; h < len(runes); {
+		// Find the smallest code point not handled yet
+		m := rune(utf8.MaxRune)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		if int(m-n) > (1<<30)/(h+1) {
+			return "", errors.New("label too long")
+		}
+		delta += int(m-n) * (h + 1)
+		n = m
+
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punycodeDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punycodeDigit(q))
+			bias = punycodeAdapt(delta, h+1, h == basic)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return 'a' + byte(d)
+	}
+	return '0' + byte(d-26)
+}
+
+// punycodeAdapt is the bias adaptation function of RFC 3492 section 6.1.
+func punycodeAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
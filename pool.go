@@ -0,0 +1,152 @@
+package smtp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned by Pool.Get after Pool.Close has been called.
+var ErrPoolClosed = errors.New("smtp: pool closed")
+
+// A Pool keeps idle client connections to a server for reuse.
+//
+// Idle connections are checked with NOOP before being handed out, and
+// optionally at a regular interval, so that connections timed out by the
+// server are transparently replaced by new ones.
+//
+// A Pool is safe to use from multiple goroutines.
+type Pool struct {
+	// Dial opens a new connection. It should perform any required STARTTLS
+	// and authentication.
+	Dial func() (*Client, error)
+	// MaxIdle is the maximum number of idle connections. Zero means no
+	// limit.
+	MaxIdle int
+	// KeepAlive is the interval at which NOOP is sent on idle connections.
+	// Zero disables keepalives.
+	KeepAlive time.Duration
+
+	locker  sync.Mutex
+	idle    []*pooledClient
+	closed  bool
+	started bool
+	done    chan struct{}
+}
+
+type pooledClient struct {
+	c        *Client
+	lastUsed time.Time
+}
+
+// Get returns a live connection, either an idle one or a new one.
+func (p *Pool) Get() (*Client, error) {
+	for {
+		p.locker.Lock()
+		if p.closed {
+			p.locker.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if len(p.idle) == 0 {
+			p.locker.Unlock()
+			return p.Dial()
+		}
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.locker.Unlock()
+
+		if err := pc.c.Noop(); err != nil {
+			pc.c.Close()
+			continue
+		}
+		return pc.c, nil
+	}
+}
+
+// Put returns a connection to the pool. The current mail transaction, if any,
+// is aborted. Connections which fail to reset are closed.
+func (p *Pool) Put(c *Client) {
+	if err := c.Reset(); err != nil {
+		c.Close()
+		return
+	}
+
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if p.closed || (p.MaxIdle > 0 && len(p.idle) >= p.MaxIdle) {
+		c.Quit()
+		return
+	}
+	p.idle = append(p.idle, &pooledClient{c: c, lastUsed: time.Now()})
+
+	if p.KeepAlive > 0 && !p.started {
+		p.started = true
+		p.done = make(chan struct{})
+		go p.keepAlive(p.done)
+	}
+}
+
+// Close closes all idle connections. Connections currently in use are closed
+// when put back.
+func (p *Pool) Close() error {
+	p.locker.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	if p.done != nil {
+		close(p.done)
+	}
+	p.locker.Unlock()
+
+	for _, pc := range idle {
+		pc.c.Quit()
+	}
+	return nil
+}
+
+func (p *Pool) keepAlive(done <-chan struct{}) {
+	ticker := time.NewTicker(p.KeepAlive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		// Take the connections needing a keepalive out of the pool, so that
+		// Get doesn't block while they're being checked
+		now := time.Now()
+		var check []*pooledClient
+		p.locker.Lock()
+		idle := p.idle[:0]
+		for _, pc := range p.idle {
+			if now.Sub(pc.lastUsed) >= p.KeepAlive {
+				check = append(check, pc)
+			} else {
+				idle = append(idle, pc)
+			}
+		}
+		p.idle = idle
+		p.locker.Unlock()
+
+		for _, pc := range check {
+			if err := pc.c.Noop(); err != nil {
+				pc.c.Close()
+				continue
+			}
+			pc.lastUsed = time.Now()
+
+			p.locker.Lock()
+			if p.closed || (p.MaxIdle > 0 && len(p.idle) >= p.MaxIdle) {
+				p.locker.Unlock()
+				pc.c.Quit()
+				continue
+			}
+			p.idle = append(p.idle, pc)
+			p.locker.Unlock()
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package smtp
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// serveNoop handles a connection, replying to EHLO, NOOP, RSET and QUIT. It
+// returns after n commands.
+func serveNoop(conn net.Conn, n int) {
+	defer conn.Close()
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 localhost ESMTP ready")
+	for i := 0; i < n; i++ {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		if strings.ToUpper(line) == "QUIT" {
+			tc.PrintfLine("221 Bye")
+			return
+		}
+		tc.PrintfLine("250 OK")
+	}
+}
+
+func TestPool(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if i == 0 {
+				// EHLO and RSET, then time out
+				go serveNoop(conn, 2)
+			} else {
+				go serveNoop(conn, 100)
+			}
+		}
+	}()
+
+	dials := 0
+	p := &Pool{
+		Dial: func() (*Client, error) {
+			dials++
+			return Dial(ln.Addr().String())
+		},
+	}
+	defer p.Close()
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	p.Put(c)
+
+	// The first connection has been closed by the server: Get must notice
+	// and dial again
+	c, err = p.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if dials != 2 {
+		t.Errorf("dialed %v times, want 2", dials)
+	}
+	if err := c.Noop(); err != nil {
+		t.Errorf("Noop: %v", err)
+	}
+	p.Put(c)
+}
@@ -0,0 +1,52 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime/pprof"
+)
+
+// Labels set on goroutines handling connections, see Server.ProfilingLabels.
+const (
+	LabelRemote  = "smtp.remote"
+	LabelBackend = "smtp.backend"
+	LabelSession = "smtp.session"
+	LabelCommand = "smtp.command"
+)
+
+// StageHook is called when the server starts handling a protocol stage of a
+// connection. The stage is the name of the command being handled, e.g.
+// "MAIL" or "DATA". If the returned function is not nil, it is called when
+// the stage is done.
+type StageHook func(c *Conn, stage string) (done func())
+
+// profileLabels returns the pprof labels for a connection.
+func (s *Server) profileLabels(c *Conn) pprof.LabelSet {
+	remote := c.conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	return pprof.Labels(LabelRemote, remote, LabelBackend, fmt.Sprintf("%T", s.Backend), LabelSession, c.id)
+}
+
+// handleStage handles a command, running the stage hook and tagging the
+// goroutine with the command name if profiling is enabled.
+func (c *Conn) handleStage(cmd, arg string) {
+	if c.profileCtx == nil {
+		c.runStage(cmd, arg)
+		return
+	}
+	pprof.Do(c.profileCtx, pprof.Labels(LabelCommand, cmd), func(context.Context) {
+		c.runStage(cmd, arg)
+	})
+}
+
+func (c *Conn) runStage(cmd, arg string) {
+	if c.server.StageHook != nil {
+		if done := c.server.StageHook(c, cmd); done != nil {
+			defer done()
+		}
+	}
+	c.handle(cmd, arg)
+}
@@ -0,0 +1,703 @@
+// Backend service for go-smtp.
+//
+// This service mirrors the smtp.Backend and smtp.Session interfaces, so that
+// business logic can run in a separate process, possibly written in another
+// language, while go-smtp handles the SMTP protocol.
+//
+// A session is identified by the session_id returned by Login or
+// AnonymousLogin. The message data is streamed in chunks.
+//
+// Go stubs are generated in the backendpb package of the
+// github.com/emersion/go-smtp/proto module, which is separate to keep gRPC out
+// of the dependencies of go-smtp. The grpcbackend package adapts them to
+// smtp.Backend.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.9
+// 	protoc        (unknown)
+// source: backend.proto
+
+package backendpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type ConnectionState struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Hostname      string                 `protobuf:"bytes,1,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	RemoteAddr    string                 `protobuf:"bytes,2,opt,name=remote_addr,json=remoteAddr,proto3" json:"remote_addr,omitempty"`
+	Tls           bool                   `protobuf:"varint,3,opt,name=tls,proto3" json:"tls,omitempty"`
+	TlsServerName string                 `protobuf:"bytes,4,opt,name=tls_server_name,json=tlsServerName,proto3" json:"tls_server_name,omitempty"`
+	SessionId     string                 `protobuf:"bytes,5,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConnectionState) Reset() {
+	*x = ConnectionState{}
+	mi := &file_backend_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConnectionState) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConnectionState) ProtoMessage() {}
+
+func (x *ConnectionState) ProtoReflect() protoreflect.Message {
+	mi := &file_backend_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConnectionState.ProtoReflect.Descriptor instead.
+func (*ConnectionState) Descriptor() ([]byte, []int) {
+	return file_backend_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ConnectionState) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+func (x *ConnectionState) GetRemoteAddr() string {
+	if x != nil {
+		return x.RemoteAddr
+	}
+	return ""
+}
+
+func (x *ConnectionState) GetTls() bool {
+	if x != nil {
+		return x.Tls
+	}
+	return false
+}
+
+func (x *ConnectionState) GetTlsServerName() string {
+	if x != nil {
+		return x.TlsServerName
+	}
+	return ""
+}
+
+func (x *ConnectionState) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+// SMTPError mirrors smtp.SMTPError. Responses without error mean success. A
+// zero code is used for errors which aren't SMTP errors, such as
+// smtp.ErrAuthUnsupported.
+type SMTPError struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Code          int32                  `protobuf:"varint,1,opt,name=code,proto3" json:"code,omitempty"`
+	EnhancedCode  []int32                `protobuf:"varint,2,rep,packed,name=enhanced_code,json=enhancedCode,proto3" json:"enhanced_code,omitempty"`
+	Message       string                 `protobuf:"bytes,3,opt,name=message,proto3" json:"message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SMTPError) Reset() {
+	*x = SMTPError{}
+	mi := &file_backend_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SMTPError) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SMTPError) ProtoMessage() {}
+
+func (x *SMTPError) ProtoReflect() protoreflect.Message {
+	mi := &file_backend_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SMTPError.ProtoReflect.Descriptor instead.
+func (*SMTPError) Descriptor() ([]byte, []int) {
+	return file_backend_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *SMTPError) GetCode() int32 {
+	if x != nil {
+		return x.Code
+	}
+	return 0
+}
+
+func (x *SMTPError) GetEnhancedCode() []int32 {
+	if x != nil {
+		return x.EnhancedCode
+	}
+	return nil
+}
+
+func (x *SMTPError) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+type LoginRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	State         *ConnectionState       `protobuf:"bytes,1,opt,name=state,proto3" json:"state,omitempty"`
+	Username      string                 `protobuf:"bytes,2,opt,name=username,proto3" json:"username,omitempty"`
+	Password      string                 `protobuf:"bytes,3,opt,name=password,proto3" json:"password,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LoginRequest) Reset() {
+	*x = LoginRequest{}
+	mi := &file_backend_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LoginRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LoginRequest) ProtoMessage() {}
+
+func (x *LoginRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_backend_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LoginRequest.ProtoReflect.Descriptor instead.
+func (*LoginRequest) Descriptor() ([]byte, []int) {
+	return file_backend_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *LoginRequest) GetState() *ConnectionState {
+	if x != nil {
+		return x.State
+	}
+	return nil
+}
+
+func (x *LoginRequest) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *LoginRequest) GetPassword() string {
+	if x != nil {
+		return x.Password
+	}
+	return ""
+}
+
+type AnonymousLoginRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	State         *ConnectionState       `protobuf:"bytes,1,opt,name=state,proto3" json:"state,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AnonymousLoginRequest) Reset() {
+	*x = AnonymousLoginRequest{}
+	mi := &file_backend_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AnonymousLoginRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AnonymousLoginRequest) ProtoMessage() {}
+
+func (x *AnonymousLoginRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_backend_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AnonymousLoginRequest.ProtoReflect.Descriptor instead.
+func (*AnonymousLoginRequest) Descriptor() ([]byte, []int) {
+	return file_backend_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *AnonymousLoginRequest) GetState() *ConnectionState {
+	if x != nil {
+		return x.State
+	}
+	return nil
+}
+
+type LoginResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	SessionId     string                 `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	Error         *SMTPError             `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LoginResponse) Reset() {
+	*x = LoginResponse{}
+	mi := &file_backend_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LoginResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LoginResponse) ProtoMessage() {}
+
+func (x *LoginResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_backend_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LoginResponse.ProtoReflect.Descriptor instead.
+func (*LoginResponse) Descriptor() ([]byte, []int) {
+	return file_backend_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *LoginResponse) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+func (x *LoginResponse) GetError() *SMTPError {
+	if x != nil {
+		return x.Error
+	}
+	return nil
+}
+
+type SessionRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	SessionId     string                 `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SessionRequest) Reset() {
+	*x = SessionRequest{}
+	mi := &file_backend_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SessionRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SessionRequest) ProtoMessage() {}
+
+func (x *SessionRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_backend_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SessionRequest.ProtoReflect.Descriptor instead.
+func (*SessionRequest) Descriptor() ([]byte, []int) {
+	return file_backend_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *SessionRequest) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+type SessionResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Error         *SMTPError             `protobuf:"bytes,1,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SessionResponse) Reset() {
+	*x = SessionResponse{}
+	mi := &file_backend_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SessionResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SessionResponse) ProtoMessage() {}
+
+func (x *SessionResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_backend_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SessionResponse.ProtoReflect.Descriptor instead.
+func (*SessionResponse) Descriptor() ([]byte, []int) {
+	return file_backend_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *SessionResponse) GetError() *SMTPError {
+	if x != nil {
+		return x.Error
+	}
+	return nil
+}
+
+type MailRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	SessionId     string                 `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	From          string                 `protobuf:"bytes,2,opt,name=from,proto3" json:"from,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MailRequest) Reset() {
+	*x = MailRequest{}
+	mi := &file_backend_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MailRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MailRequest) ProtoMessage() {}
+
+func (x *MailRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_backend_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MailRequest.ProtoReflect.Descriptor instead.
+func (*MailRequest) Descriptor() ([]byte, []int) {
+	return file_backend_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *MailRequest) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+func (x *MailRequest) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+type RcptRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	SessionId     string                 `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	To            string                 `protobuf:"bytes,2,opt,name=to,proto3" json:"to,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RcptRequest) Reset() {
+	*x = RcptRequest{}
+	mi := &file_backend_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RcptRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RcptRequest) ProtoMessage() {}
+
+func (x *RcptRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_backend_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RcptRequest.ProtoReflect.Descriptor instead.
+func (*RcptRequest) Descriptor() ([]byte, []int) {
+	return file_backend_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *RcptRequest) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+func (x *RcptRequest) GetTo() string {
+	if x != nil {
+		return x.To
+	}
+	return ""
+}
+
+type DataRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	SessionId     string                 `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	Chunk         []byte                 `protobuf:"bytes,2,opt,name=chunk,proto3" json:"chunk,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DataRequest) Reset() {
+	*x = DataRequest{}
+	mi := &file_backend_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DataRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DataRequest) ProtoMessage() {}
+
+func (x *DataRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_backend_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DataRequest.ProtoReflect.Descriptor instead.
+func (*DataRequest) Descriptor() ([]byte, []int) {
+	return file_backend_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *DataRequest) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+func (x *DataRequest) GetChunk() []byte {
+	if x != nil {
+		return x.Chunk
+	}
+	return nil
+}
+
+var File_backend_proto protoreflect.FileDescriptor
+
+const file_backend_proto_rawDesc = "" +
+	"\n" +
+	"\rbackend.proto\x12\x15emersion.smtp.backend\"\xa7\x01\n" +
+	"\x0fConnectionState\x12\x1a\n" +
+	"\bhostname\x18\x01 \x01(\tR\bhostname\x12\x1f\n" +
+	"\vremote_addr\x18\x02 \x01(\tR\n" +
+	"remoteAddr\x12\x10\n" +
+	"\x03tls\x18\x03 \x01(\bR\x03tls\x12&\n" +
+	"\x0ftls_server_name\x18\x04 \x01(\tR\rtlsServerName\x12\x1d\n" +
+	"\n" +
+	"session_id\x18\x05 \x01(\tR\tsessionId\"^\n" +
+	"\tSMTPError\x12\x12\n" +
+	"\x04code\x18\x01 \x01(\x05R\x04code\x12#\n" +
+	"\renhanced_code\x18\x02 \x03(\x05R\fenhancedCode\x12\x18\n" +
+	"\amessage\x18\x03 \x01(\tR\amessage\"\x84\x01\n" +
+	"\fLoginRequest\x12<\n" +
+	"\x05state\x18\x01 \x01(\v2&.emersion.smtp.backend.ConnectionStateR\x05state\x12\x1a\n" +
+	"\busername\x18\x02 \x01(\tR\busername\x12\x1a\n" +
+	"\bpassword\x18\x03 \x01(\tR\bpassword\"U\n" +
+	"\x15AnonymousLoginRequest\x12<\n" +
+	"\x05state\x18\x01 \x01(\v2&.emersion.smtp.backend.ConnectionStateR\x05state\"f\n" +
+	"\rLoginResponse\x12\x1d\n" +
+	"\n" +
+	"session_id\x18\x01 \x01(\tR\tsessionId\x126\n" +
+	"\x05error\x18\x02 \x01(\v2 .emersion.smtp.backend.SMTPErrorR\x05error\"/\n" +
+	"\x0eSessionRequest\x12\x1d\n" +
+	"\n" +
+	"session_id\x18\x01 \x01(\tR\tsessionId\"I\n" +
+	"\x0fSessionResponse\x126\n" +
+	"\x05error\x18\x01 \x01(\v2 .emersion.smtp.backend.SMTPErrorR\x05error\"@\n" +
+	"\vMailRequest\x12\x1d\n" +
+	"\n" +
+	"session_id\x18\x01 \x01(\tR\tsessionId\x12\x12\n" +
+	"\x04from\x18\x02 \x01(\tR\x04from\"<\n" +
+	"\vRcptRequest\x12\x1d\n" +
+	"\n" +
+	"session_id\x18\x01 \x01(\tR\tsessionId\x12\x0e\n" +
+	"\x02to\x18\x02 \x01(\tR\x02to\"B\n" +
+	"\vDataRequest\x12\x1d\n" +
+	"\n" +
+	"session_id\x18\x01 \x01(\tR\tsessionId\x12\x14\n" +
+	"\x05chunk\x18\x02 \x01(\fR\x05chunk2\xf2\x04\n" +
+	"\aBackend\x12R\n" +
+	"\x05Login\x12#.emersion.smtp.backend.LoginRequest\x1a$.emersion.smtp.backend.LoginResponse\x12d\n" +
+	"\x0eAnonymousLogin\x12,.emersion.smtp.backend.AnonymousLoginRequest\x1a$.emersion.smtp.backend.LoginResponse\x12V\n" +
+	"\x05Reset\x12%.emersion.smtp.backend.SessionRequest\x1a&.emersion.smtp.backend.SessionResponse\x12W\n" +
+	"\x06Logout\x12%.emersion.smtp.backend.SessionRequest\x1a&.emersion.smtp.backend.SessionResponse\x12R\n" +
+	"\x04Mail\x12\".emersion.smtp.backend.MailRequest\x1a&.emersion.smtp.backend.SessionResponse\x12R\n" +
+	"\x04Rcpt\x12\".emersion.smtp.backend.RcptRequest\x1a&.emersion.smtp.backend.SessionResponse\x12T\n" +
+	"\x04Data\x12\".emersion.smtp.backend.DataRequest\x1a&.emersion.smtp.backend.SessionResponse(\x01B-Z+github.com/emersion/go-smtp/proto/backendpbb\x06proto3"
+
+var (
+	file_backend_proto_rawDescOnce sync.Once
+	file_backend_proto_rawDescData []byte
+)
+
+func file_backend_proto_rawDescGZIP() []byte {
+	file_backend_proto_rawDescOnce.Do(func() {
+		file_backend_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_backend_proto_rawDesc), len(file_backend_proto_rawDesc)))
+	})
+	return file_backend_proto_rawDescData
+}
+
+var file_backend_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
+var file_backend_proto_goTypes = []any{
+	(*ConnectionState)(nil),       // 0: emersion.smtp.backend.ConnectionState
+	(*SMTPError)(nil),             // 1: emersion.smtp.backend.SMTPError
+	(*LoginRequest)(nil),          // 2: emersion.smtp.backend.LoginRequest
+	(*AnonymousLoginRequest)(nil), // 3: emersion.smtp.backend.AnonymousLoginRequest
+	(*LoginResponse)(nil),         // 4: emersion.smtp.backend.LoginResponse
+	(*SessionRequest)(nil),        // 5: emersion.smtp.backend.SessionRequest
+	(*SessionResponse)(nil),       // 6: emersion.smtp.backend.SessionResponse
+	(*MailRequest)(nil),           // 7: emersion.smtp.backend.MailRequest
+	(*RcptRequest)(nil),           // 8: emersion.smtp.backend.RcptRequest
+	(*DataRequest)(nil),           // 9: emersion.smtp.backend.DataRequest
+}
+var file_backend_proto_depIdxs = []int32{
+	0,  // 0: emersion.smtp.backend.LoginRequest.state:type_name -> emersion.smtp.backend.ConnectionState
+	0,  // 1: emersion.smtp.backend.AnonymousLoginRequest.state:type_name -> emersion.smtp.backend.ConnectionState
+	1,  // 2: emersion.smtp.backend.LoginResponse.error:type_name -> emersion.smtp.backend.SMTPError
+	1,  // 3: emersion.smtp.backend.SessionResponse.error:type_name -> emersion.smtp.backend.SMTPError
+	2,  // 4: emersion.smtp.backend.Backend.Login:input_type -> emersion.smtp.backend.LoginRequest
+	3,  // 5: emersion.smtp.backend.Backend.AnonymousLogin:input_type -> emersion.smtp.backend.AnonymousLoginRequest
+	5,  // 6: emersion.smtp.backend.Backend.Reset:input_type -> emersion.smtp.backend.SessionRequest
+	5,  // 7: emersion.smtp.backend.Backend.Logout:input_type -> emersion.smtp.backend.SessionRequest
+	7,  // 8: emersion.smtp.backend.Backend.Mail:input_type -> emersion.smtp.backend.MailRequest
+	8,  // 9: emersion.smtp.backend.Backend.Rcpt:input_type -> emersion.smtp.backend.RcptRequest
+	9,  // 10: emersion.smtp.backend.Backend.Data:input_type -> emersion.smtp.backend.DataRequest
+	4,  // 11: emersion.smtp.backend.Backend.Login:output_type -> emersion.smtp.backend.LoginResponse
+	4,  // 12: emersion.smtp.backend.Backend.AnonymousLogin:output_type -> emersion.smtp.backend.LoginResponse
+	6,  // 13: emersion.smtp.backend.Backend.Reset:output_type -> emersion.smtp.backend.SessionResponse
+	6,  // 14: emersion.smtp.backend.Backend.Logout:output_type -> emersion.smtp.backend.SessionResponse
+	6,  // 15: emersion.smtp.backend.Backend.Mail:output_type -> emersion.smtp.backend.SessionResponse
+	6,  // 16: emersion.smtp.backend.Backend.Rcpt:output_type -> emersion.smtp.backend.SessionResponse
+	6,  // 17: emersion.smtp.backend.Backend.Data:output_type -> emersion.smtp.backend.SessionResponse
+	11, // [11:18] is the sub-list for method output_type
+	4,  // [4:11] is the sub-list for method input_type
+	4,  // [4:4] is the sub-list for extension type_name
+	4,  // [4:4] is the sub-list for extension extendee
+	0,  // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_backend_proto_init() }
+func file_backend_proto_init() {
+	if File_backend_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_backend_proto_rawDesc), len(file_backend_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   10,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_backend_proto_goTypes,
+		DependencyIndexes: file_backend_proto_depIdxs,
+		MessageInfos:      file_backend_proto_msgTypes,
+	}.Build()
+	File_backend_proto = out.File
+	file_backend_proto_goTypes = nil
+	file_backend_proto_depIdxs = nil
+}
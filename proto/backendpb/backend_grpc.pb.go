@@ -0,0 +1,373 @@
+// Backend service for go-smtp.
+//
+// This service mirrors the smtp.Backend and smtp.Session interfaces, so that
+// business logic can run in a separate process, possibly written in another
+// language, while go-smtp handles the SMTP protocol.
+//
+// A session is identified by the session_id returned by Login or
+// AnonymousLogin. The message data is streamed in chunks.
+//
+// Go stubs are generated in the backendpb package of the
+// github.com/emersion/go-smtp/proto module, which is separate to keep gRPC out
+// of the dependencies of go-smtp. The grpcbackend package adapts them to
+// smtp.Backend.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: backend.proto
+
+package backendpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Backend_Login_FullMethodName          = "/emersion.smtp.backend.Backend/Login"
+	Backend_AnonymousLogin_FullMethodName = "/emersion.smtp.backend.Backend/AnonymousLogin"
+	Backend_Reset_FullMethodName          = "/emersion.smtp.backend.Backend/Reset"
+	Backend_Logout_FullMethodName         = "/emersion.smtp.backend.Backend/Logout"
+	Backend_Mail_FullMethodName           = "/emersion.smtp.backend.Backend/Mail"
+	Backend_Rcpt_FullMethodName           = "/emersion.smtp.backend.Backend/Rcpt"
+	Backend_Data_FullMethodName           = "/emersion.smtp.backend.Backend/Data"
+)
+
+// BackendClient is the client API for Backend service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type BackendClient interface {
+	// Authenticate a user.
+	Login(ctx context.Context, in *LoginRequest, opts ...grpc.CallOption) (*LoginResponse, error)
+	// Called if the client attempts to send mail without logging in first.
+	AnonymousLogin(ctx context.Context, in *AnonymousLoginRequest, opts ...grpc.CallOption) (*LoginResponse, error)
+	// Discard currently processed message.
+	Reset(ctx context.Context, in *SessionRequest, opts ...grpc.CallOption) (*SessionResponse, error)
+	// Free all resources associated with session.
+	Logout(ctx context.Context, in *SessionRequest, opts ...grpc.CallOption) (*SessionResponse, error)
+	// Set return path for currently processed message.
+	Mail(ctx context.Context, in *MailRequest, opts ...grpc.CallOption) (*SessionResponse, error)
+	// Add recipient for currently processed message.
+	Rcpt(ctx context.Context, in *RcptRequest, opts ...grpc.CallOption) (*SessionResponse, error)
+	// Set currently processed message contents and send it. The first
+	// request carries the session ID, the following ones the message data.
+	Data(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[DataRequest, SessionResponse], error)
+}
+
+type backendClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewBackendClient(cc grpc.ClientConnInterface) BackendClient {
+	return &backendClient{cc}
+}
+
+func (c *backendClient) Login(ctx context.Context, in *LoginRequest, opts ...grpc.CallOption) (*LoginResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(LoginResponse)
+	err := c.cc.Invoke(ctx, Backend_Login_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *backendClient) AnonymousLogin(ctx context.Context, in *AnonymousLoginRequest, opts ...grpc.CallOption) (*LoginResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(LoginResponse)
+	err := c.cc.Invoke(ctx, Backend_AnonymousLogin_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *backendClient) Reset(ctx context.Context, in *SessionRequest, opts ...grpc.CallOption) (*SessionResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SessionResponse)
+	err := c.cc.Invoke(ctx, Backend_Reset_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *backendClient) Logout(ctx context.Context, in *SessionRequest, opts ...grpc.CallOption) (*SessionResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SessionResponse)
+	err := c.cc.Invoke(ctx, Backend_Logout_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *backendClient) Mail(ctx context.Context, in *MailRequest, opts ...grpc.CallOption) (*SessionResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SessionResponse)
+	err := c.cc.Invoke(ctx, Backend_Mail_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *backendClient) Rcpt(ctx context.Context, in *RcptRequest, opts ...grpc.CallOption) (*SessionResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SessionResponse)
+	err := c.cc.Invoke(ctx, Backend_Rcpt_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *backendClient) Data(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[DataRequest, SessionResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Backend_ServiceDesc.Streams[0], Backend_Data_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[DataRequest, SessionResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Backend_DataClient = grpc.ClientStreamingClient[DataRequest, SessionResponse]
+
+// BackendServer is the server API for Backend service.
+// All implementations must embed UnimplementedBackendServer
+// for forward compatibility.
+type BackendServer interface {
+	// Authenticate a user.
+	Login(context.Context, *LoginRequest) (*LoginResponse, error)
+	// Called if the client attempts to send mail without logging in first.
+	AnonymousLogin(context.Context, *AnonymousLoginRequest) (*LoginResponse, error)
+	// Discard currently processed message.
+	Reset(context.Context, *SessionRequest) (*SessionResponse, error)
+	// Free all resources associated with session.
+	Logout(context.Context, *SessionRequest) (*SessionResponse, error)
+	// Set return path for currently processed message.
+	Mail(context.Context, *MailRequest) (*SessionResponse, error)
+	// Add recipient for currently processed message.
+	Rcpt(context.Context, *RcptRequest) (*SessionResponse, error)
+	// Set currently processed message contents and send it. The first
+	// request carries the session ID, the following ones the message data.
+	Data(grpc.ClientStreamingServer[DataRequest, SessionResponse]) error
+	mustEmbedUnimplementedBackendServer()
+}
+
+// UnimplementedBackendServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedBackendServer struct{}
+
+func (UnimplementedBackendServer) Login(context.Context, *LoginRequest) (*LoginResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Login not implemented")
+}
+func (UnimplementedBackendServer) AnonymousLogin(context.Context, *AnonymousLoginRequest) (*LoginResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AnonymousLogin not implemented")
+}
+func (UnimplementedBackendServer) Reset(context.Context, *SessionRequest) (*SessionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reset not implemented")
+}
+func (UnimplementedBackendServer) Logout(context.Context, *SessionRequest) (*SessionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Logout not implemented")
+}
+func (UnimplementedBackendServer) Mail(context.Context, *MailRequest) (*SessionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Mail not implemented")
+}
+func (UnimplementedBackendServer) Rcpt(context.Context, *RcptRequest) (*SessionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Rcpt not implemented")
+}
+func (UnimplementedBackendServer) Data(grpc.ClientStreamingServer[DataRequest, SessionResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Data not implemented")
+}
+func (UnimplementedBackendServer) mustEmbedUnimplementedBackendServer() {}
+func (UnimplementedBackendServer) testEmbeddedByValue()                 {}
+
+// UnsafeBackendServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to BackendServer will
+// result in compilation errors.
+type UnsafeBackendServer interface {
+	mustEmbedUnimplementedBackendServer()
+}
+
+func RegisterBackendServer(s grpc.ServiceRegistrar, srv BackendServer) {
+	// If the following call pancis, it indicates UnimplementedBackendServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Backend_ServiceDesc, srv)
+}
+
+func _Backend_Login_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LoginRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BackendServer).Login(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Backend_Login_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BackendServer).Login(ctx, req.(*LoginRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Backend_AnonymousLogin_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AnonymousLoginRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BackendServer).AnonymousLogin(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Backend_AnonymousLogin_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BackendServer).AnonymousLogin(ctx, req.(*AnonymousLoginRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Backend_Reset_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BackendServer).Reset(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Backend_Reset_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BackendServer).Reset(ctx, req.(*SessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Backend_Logout_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BackendServer).Logout(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Backend_Logout_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BackendServer).Logout(ctx, req.(*SessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Backend_Mail_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MailRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BackendServer).Mail(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Backend_Mail_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BackendServer).Mail(ctx, req.(*MailRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Backend_Rcpt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RcptRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BackendServer).Rcpt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Backend_Rcpt_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BackendServer).Rcpt(ctx, req.(*RcptRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Backend_Data_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(BackendServer).Data(&grpc.GenericServerStream[DataRequest, SessionResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Backend_DataServer = grpc.ClientStreamingServer[DataRequest, SessionResponse]
+
+// Backend_ServiceDesc is the grpc.ServiceDesc for Backend service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Backend_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "emersion.smtp.backend.Backend",
+	HandlerType: (*BackendServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Login",
+			Handler:    _Backend_Login_Handler,
+		},
+		{
+			MethodName: "AnonymousLogin",
+			Handler:    _Backend_AnonymousLogin_Handler,
+		},
+		{
+			MethodName: "Reset",
+			Handler:    _Backend_Reset_Handler,
+		},
+		{
+			MethodName: "Logout",
+			Handler:    _Backend_Logout_Handler,
+		},
+		{
+			MethodName: "Mail",
+			Handler:    _Backend_Mail_Handler,
+		},
+		{
+			MethodName: "Rcpt",
+			Handler:    _Backend_Rcpt_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Data",
+			Handler:       _Backend_Data_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "backend.proto",
+}
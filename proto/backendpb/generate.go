@@ -0,0 +1,4 @@
+// Package backendpb contains the Go stubs generated from backend.proto.
+package backendpb
+
+//go:generate protoc -I.. --go_out=. --go_opt=module=github.com/emersion/go-smtp/proto/backendpb --go-grpc_out=. --go-grpc_opt=module=github.com/emersion/go-smtp/proto/backendpb backend.proto
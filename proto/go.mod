@@ -0,0 +1,20 @@
+module github.com/emersion/go-smtp/proto
+
+go 1.25.0
+
+require (
+	github.com/emersion/go-smtp v0.0.0
+	google.golang.org/grpc v1.82.1
+	google.golang.org/protobuf v1.36.11
+)
+
+require (
+	github.com/emersion/go-sasl v0.0.0-20190704090222-36b50694675c // indirect
+	golang.org/x/crypto v0.54.0 // indirect
+	golang.org/x/net v0.56.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260414002931-afd174a4e478 // indirect
+)
+
+replace github.com/emersion/go-smtp => ../
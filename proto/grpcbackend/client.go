@@ -0,0 +1,109 @@
+package grpcbackend
+
+import (
+	"context"
+	"io"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/proto/backendpb"
+	"google.golang.org/grpc"
+)
+
+// Backend is a smtp.Backend which forwards calls to a gRPC service, such as
+// one created with NewServer.
+type Backend struct {
+	client backendpb.BackendClient
+}
+
+var _ smtp.Backend = (*Backend)(nil)
+
+// NewBackend creates a backend using a gRPC connection.
+func NewBackend(cc grpc.ClientConnInterface) *Backend {
+	return &Backend{client: backendpb.NewBackendClient(cc)}
+}
+
+func (be *Backend) session(resp *backendpb.LoginResponse, err error) (smtp.Session, error) {
+	if err != nil {
+		return nil, err
+	}
+	if err := errorFromProto(resp.Error); err != nil {
+		return nil, err
+	}
+	return &session{client: be.client, id: resp.SessionId}, nil
+}
+
+func (be *Backend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	return be.session(be.client.Login(context.Background(), &backendpb.LoginRequest{
+		State:    stateToProto(state),
+		Username: username,
+		Password: password,
+	}))
+}
+
+func (be *Backend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return be.session(be.client.AnonymousLogin(context.Background(), &backendpb.AnonymousLoginRequest{
+		State: stateToProto(state),
+	}))
+}
+
+type session struct {
+	client backendpb.BackendClient
+	id     string
+}
+
+func sessionError(resp *backendpb.SessionResponse, err error) error {
+	if err != nil {
+		return err
+	}
+	return errorFromProto(resp.Error)
+}
+
+func (s *session) Reset() {
+	s.client.Reset(context.Background(), &backendpb.SessionRequest{SessionId: s.id})
+}
+
+func (s *session) Logout() error {
+	return sessionError(s.client.Logout(context.Background(), &backendpb.SessionRequest{SessionId: s.id}))
+}
+
+func (s *session) Mail(from string) error {
+	return sessionError(s.client.Mail(context.Background(), &backendpb.MailRequest{SessionId: s.id, From: from}))
+}
+
+func (s *session) Rcpt(to string) error {
+	return sessionError(s.client.Rcpt(context.Background(), &backendpb.RcptRequest{SessionId: s.id, To: to}))
+}
+
+func (s *session) Data(r io.Reader) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := s.client.Data(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&backendpb.DataRequest{SessionId: s.id}); err != nil && err != io.EOF {
+		return err
+	}
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			// io.EOF means the server closed the stream, its response is
+			// returned by CloseAndRecv
+			if err := stream.Send(&backendpb.DataRequest{Chunk: buf[:n]}); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			return rerr
+		}
+	}
+
+	return sessionError(stream.CloseAndRecv())
+}
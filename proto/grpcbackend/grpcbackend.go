@@ -0,0 +1,122 @@
+// Package grpcbackend adapts the Backend gRPC service to smtp.Backend, so that
+// the business logic of a server can run in a separate process.
+//
+// NewServer exposes a smtp.Backend as a gRPC service, and Backend implements
+// smtp.Backend with a client of the service.
+package grpcbackend
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/proto/backendpb"
+)
+
+// chunkSize is the size of the message chunks sent by Data.
+const chunkSize = 32 * 1024
+
+// knownErrors are the errors of the smtp package which aren't SMTP errors,
+// but which the server replies to specifically.
+var knownErrors = []error{
+	smtp.ErrAuthRequired,
+	smtp.ErrAuthUnsupported,
+	smtp.ErrOverQuota,
+	smtp.ErrMailboxFull,
+}
+
+func errorToProto(err error) *backendpb.SMTPError {
+	if err == nil {
+		return nil
+	}
+	if smtpErr, ok := err.(*smtp.SMTPError); ok {
+		return &backendpb.SMTPError{
+			Code:         int32(smtpErr.Code),
+			EnhancedCode: []int32{int32(smtpErr.EnhancedCode[0]), int32(smtpErr.EnhancedCode[1]), int32(smtpErr.EnhancedCode[2])},
+			Message:      smtpErr.Message,
+		}
+	}
+	for _, known := range knownErrors {
+		if errors.Is(err, known) {
+			return &backendpb.SMTPError{Message: known.Error()}
+		}
+	}
+	return &backendpb.SMTPError{Message: err.Error()}
+}
+
+func errorFromProto(pbErr *backendpb.SMTPError) error {
+	if pbErr == nil {
+		return nil
+	}
+	if pbErr.Code == 0 {
+		// Keep the errors the server compares against
+		for _, err := range knownErrors {
+			if pbErr.Message == err.Error() {
+				return err
+			}
+		}
+		return errors.New(pbErr.Message)
+	}
+
+	smtpErr := &smtp.SMTPError{
+		Code:         int(pbErr.Code),
+		EnhancedCode: smtp.NoEnhancedCode,
+		Message:      pbErr.Message,
+	}
+	if len(pbErr.EnhancedCode) == 3 {
+		for i, n := range pbErr.EnhancedCode {
+			smtpErr.EnhancedCode[i] = int(n)
+		}
+	}
+	return smtpErr
+}
+
+func stateToProto(state *smtp.ConnectionState) *backendpb.ConnectionState {
+	if state == nil {
+		return nil
+	}
+	pbState := &backendpb.ConnectionState{
+		Hostname:      state.Hostname,
+		Tls:           state.TLS.HandshakeComplete,
+		TlsServerName: state.TLS.ServerName,
+		SessionId:     state.SessionID,
+	}
+	if state.RemoteAddr != nil {
+		pbState.RemoteAddr = state.RemoteAddr.String()
+	}
+	return pbState
+}
+
+// addr is a network address received from a gRPC client.
+type addr string
+
+func (a addr) Network() string {
+	return "tcp"
+}
+
+func (a addr) String() string {
+	return string(a)
+}
+
+func stateFromProto(pbState *backendpb.ConnectionState) *smtp.ConnectionState {
+	if pbState == nil {
+		return nil
+	}
+	state := &smtp.ConnectionState{
+		Hostname:  pbState.Hostname,
+		SessionID: pbState.SessionId,
+		TLS: tls.ConnectionState{
+			HandshakeComplete: pbState.Tls,
+			ServerName:        pbState.TlsServerName,
+		},
+	}
+	if pbState.RemoteAddr != "" {
+		if tcpAddr, err := net.ResolveTCPAddr("tcp", pbState.RemoteAddr); err == nil {
+			state.RemoteAddr = tcpAddr
+		} else {
+			state.RemoteAddr = addr(pbState.RemoteAddr)
+		}
+	}
+	return state
+}
@@ -0,0 +1,102 @@
+package grpcbackend_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+	"github.com/emersion/go-smtp/proto/backendpb"
+	"github.com/emersion/go-smtp/proto/grpcbackend"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func testBackend(t *testing.T, be smtp.Backend) *grpcbackend.Backend {
+	l := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	backendpb.RegisterBackendServer(s, grpcbackend.NewServer(be))
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	cc, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return grpcbackend.NewBackend(cc)
+}
+
+func TestBackend(t *testing.T) {
+	mem := &backendutil.MemoryBackend{
+		Auth:            backendutil.UserMap{"alice": "secret"}.Auth,
+		MaxMessageBytes: 128 * 1024,
+	}
+	be := testBackend(t, mem)
+
+	if _, err := be.AnonymousLogin(nil); err != smtp.ErrAuthRequired {
+		t.Errorf("AnonymousLogin: expected ErrAuthRequired, got %v", err)
+	}
+	if _, err := be.Login(nil, "alice", "wrong"); err == nil {
+		t.Error("Login: expected an error with invalid credentials")
+	}
+
+	state := &smtp.ConnectionState{
+		Hostname:   "client.example.org",
+		RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25},
+		SessionID:  "abc",
+	}
+	s, err := be.Login(state, "alice", "secret")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if err := s.Mail("alice@example.org"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := s.Rcpt("bob@example.org"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	// Larger than a chunk
+	body := "Subject: Hi\r\n\r\n" + strings.Repeat("Hello world\r\n", 8*1024)
+	if err := s.Data(strings.NewReader(body)); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+
+	msgs := mem.Mailbox("bob@example.org")
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %v", len(msgs))
+	}
+	if msgs[0].Username != "alice" || msgs[0].From != "alice@example.org" {
+		t.Errorf("unexpected message envelope: %+v", msgs[0])
+	}
+	if string(msgs[0].Data) != body {
+		t.Errorf("message data doesn't match")
+	}
+
+	// The session stops reading messages which are too large
+	s.Reset()
+	if err := s.Mail("alice@example.org"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := s.Rcpt("bob@example.org"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	err = s.Data(strings.NewReader(strings.Repeat(body, 4)))
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 552 {
+		t.Errorf("Data: expected a 552 error, got %v", err)
+	}
+
+	if err := s.Logout(); err != nil {
+		t.Errorf("Logout: %v", err)
+	}
+	if err := s.Mail("alice@example.org"); err == nil {
+		t.Error("Mail: expected an error after Logout")
+	}
+}
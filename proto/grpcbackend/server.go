@@ -0,0 +1,155 @@
+package grpcbackend
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/proto/backendpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type server struct {
+	backendpb.UnimplementedBackendServer
+
+	be smtp.Backend
+
+	mu       sync.Mutex
+	sessions map[string]smtp.Session
+}
+
+// NewServer creates a gRPC service backed by a smtp.Backend. It can be
+// registered with backendpb.RegisterBackendServer.
+//
+// Sessions are kept until Logout is called.
+func NewServer(be smtp.Backend) backendpb.BackendServer {
+	return &server{
+		be:       be,
+		sessions: make(map[string]smtp.Session),
+	}
+}
+
+func (s *server) add(session smtp.Session) (string, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b[:])
+
+	s.mu.Lock()
+	s.sessions[id] = session
+	s.mu.Unlock()
+	return id, nil
+}
+
+func (s *server) session(id string) (smtp.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown session %q", id)
+	}
+	return session, nil
+}
+
+func (s *server) loginResponse(session smtp.Session, err error) (*backendpb.LoginResponse, error) {
+	if err != nil {
+		return &backendpb.LoginResponse{Error: errorToProto(err)}, nil
+	}
+	id, err := s.add(session)
+	if err != nil {
+		session.Logout()
+		return nil, status.Errorf(codes.Internal, "failed to generate session ID: %v", err)
+	}
+	return &backendpb.LoginResponse{SessionId: id}, nil
+}
+
+func (s *server) Login(ctx context.Context, req *backendpb.LoginRequest) (*backendpb.LoginResponse, error) {
+	return s.loginResponse(s.be.Login(stateFromProto(req.State), req.Username, req.Password))
+}
+
+func (s *server) AnonymousLogin(ctx context.Context, req *backendpb.AnonymousLoginRequest) (*backendpb.LoginResponse, error) {
+	return s.loginResponse(s.be.AnonymousLogin(stateFromProto(req.State)))
+}
+
+func (s *server) Reset(ctx context.Context, req *backendpb.SessionRequest) (*backendpb.SessionResponse, error) {
+	session, err := s.session(req.SessionId)
+	if err != nil {
+		return nil, err
+	}
+	session.Reset()
+	return &backendpb.SessionResponse{}, nil
+}
+
+func (s *server) Logout(ctx context.Context, req *backendpb.SessionRequest) (*backendpb.SessionResponse, error) {
+	s.mu.Lock()
+	session, ok := s.sessions[req.SessionId]
+	delete(s.sessions, req.SessionId)
+	s.mu.Unlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown session %q", req.SessionId)
+	}
+	return &backendpb.SessionResponse{Error: errorToProto(session.Logout())}, nil
+}
+
+func (s *server) Mail(ctx context.Context, req *backendpb.MailRequest) (*backendpb.SessionResponse, error) {
+	session, err := s.session(req.SessionId)
+	if err != nil {
+		return nil, err
+	}
+	return &backendpb.SessionResponse{Error: errorToProto(session.Mail(req.From))}, nil
+}
+
+func (s *server) Rcpt(ctx context.Context, req *backendpb.RcptRequest) (*backendpb.SessionResponse, error) {
+	session, err := s.session(req.SessionId)
+	if err != nil {
+		return nil, err
+	}
+	return &backendpb.SessionResponse{Error: errorToProto(session.Rcpt(req.To))}, nil
+}
+
+func (s *server) Data(stream backendpb.Backend_DataServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	session, err := s.session(req.SessionId)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := session.Data(pr)
+		// Unblock the stream reader if the session didn't read everything
+		pr.CloseWithError(io.ErrClosedPipe)
+		done <- err
+	}()
+
+	for {
+		if len(req.Chunk) > 0 {
+			if _, err := pw.Write(req.Chunk); err != nil {
+				// The session stopped reading
+				break
+			}
+		}
+
+		req, err = stream.Recv()
+		if err == io.EOF {
+			pw.Close()
+			break
+		} else if err != nil {
+			pw.CloseWithError(err)
+			<-done
+			return err
+		}
+	}
+
+	return stream.SendAndClose(&backendpb.SessionResponse{Error: errorToProto(<-done)})
+}
@@ -0,0 +1,169 @@
+package queue
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ErrActive is returned when an entry can't be changed because it's being
+// delivered.
+var ErrActive = errors.New("queue: entry is being delivered")
+
+// Filter selects queue entries. Empty fields match all entries.
+type Filter struct {
+	// A sender address, or a domain prefixed with "@"
+	From string
+	// A recipient address, or a domain prefixed with "@"
+	To string
+	// If set, only held entries match
+	Held bool
+	// If set, only entries which failed at least once match
+	Deferred bool
+}
+
+func matchAddress(pattern, addr string) bool {
+	if strings.HasPrefix(pattern, "@") {
+		return strings.EqualFold(pattern[1:], domainOf(addr))
+	}
+	return strings.EqualFold(pattern, addr)
+}
+
+func (f *Filter) match(env *Envelope) bool {
+	if f.From != "" && !matchAddress(f.From, env.From) {
+		return false
+	}
+	if f.To != "" {
+		found := false
+		for _, rcpt := range env.To {
+			if matchAddress(f.To, rcpt) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Held && !env.Held {
+		return false
+	}
+	if f.Deferred && env.Attempts == 0 {
+		return false
+	}
+	return true
+}
+
+func (env *Envelope) clone() *Envelope {
+	c := *env
+	c.To = append([]string(nil), env.To...)
+	return &c
+}
+
+// List returns copies of the queue entries matching a filter, oldest first.
+// If f is nil, all entries are returned.
+func (q *Queue) List(f *Filter) []*Envelope {
+	if f == nil {
+		f = &Filter{}
+	}
+
+	q.mu.Lock()
+	var envs []*Envelope
+	for _, env := range q.entries {
+		if f.match(env) {
+			envs = append(envs, env.clone())
+		}
+	}
+	q.mu.Unlock()
+
+	sort.Slice(envs, func(i, j int) bool {
+		if !envs[i].Queued.Equal(envs[j].Queued) {
+			return envs[i].Queued.Before(envs[j].Queued)
+		}
+		return envs[i].ID < envs[j].ID
+	})
+	return envs
+}
+
+// Entry returns a copy of a queue entry.
+func (q *Queue) Entry(id string) (*Envelope, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	env, ok := q.entries[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return env.clone(), nil
+}
+
+// update applies a change to an idle entry and saves it.
+func (q *Queue) update(id string, f func(env *Envelope)) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	env, ok := q.entries[id]
+	if !ok {
+		return ErrNotFound
+	} else if q.inflight[id] {
+		return ErrActive
+	}
+
+	updated := env.clone()
+	f(updated)
+	if err := q.save(updated); err != nil {
+		return err
+	}
+	*env = *updated
+	return nil
+}
+
+// Retry schedules an entry for immediate delivery, like Postfix's
+// postqueue -i. Held entries are delivered once released.
+func (q *Queue) Retry(id string) error {
+	err := q.update(id, func(env *Envelope) {
+		env.NextAttempt = q.now()
+	})
+	if err == nil {
+		q.notify()
+	}
+	return err
+}
+
+// Hold suspends the delivery of an entry until it's released, like
+// Postfix's postsuper -h. Held entries don't expire.
+func (q *Queue) Hold(id string) error {
+	return q.update(id, func(env *Envelope) {
+		env.Held = true
+	})
+}
+
+// Release resumes the delivery of a held entry, and schedules it for
+// immediate delivery.
+func (q *Queue) Release(id string) error {
+	err := q.update(id, func(env *Envelope) {
+		env.Held = false
+		env.NextAttempt = q.now()
+	})
+	if err == nil {
+		q.notify()
+	}
+	return err
+}
+
+// Delete removes an entry from the queue without notifying its sender, like
+// Postfix's postsuper -d.
+func (q *Queue) Delete(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	env, ok := q.entries[id]
+	if !ok {
+		return ErrNotFound
+	} else if q.inflight[id] {
+		return ErrActive
+	}
+	q.remove(env)
+	delete(q.entries, id)
+	return nil
+}
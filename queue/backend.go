@@ -0,0 +1,74 @@
+package queue
+
+import (
+	"io"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Backend is an SMTP backend adding accepted messages to a queue.
+type Backend struct {
+	Queue *Queue
+
+	// Auth checks credentials, e.g. backendutil.UserMap.Auth. If nil,
+	// authentication is not supported.
+	Auth func(username, password string) error
+	// If set, clients can send mail without authenticating.
+	AllowAnonymous bool
+}
+
+// Login implements the smtp.Backend interface.
+func (be *Backend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if be.Auth == nil {
+		return nil, smtp.ErrAuthUnsupported
+	}
+	if err := be.Auth(username, password); err != nil {
+		return nil, err
+	}
+	return &session{be: be}, nil
+}
+
+// AnonymousLogin implements the smtp.Backend interface.
+func (be *Backend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	if !be.AllowAnonymous {
+		return nil, smtp.ErrAuthRequired
+	}
+	return &session{be: be}, nil
+}
+
+type session struct {
+	be   *Backend
+	from string
+	to   []string
+}
+
+func (s *session) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *session) Logout() error {
+	return nil
+}
+
+func (s *session) Mail(from string) error {
+	s.Reset()
+	s.from = from
+	return nil
+}
+
+func (s *session) Rcpt(to string) error {
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	if err := s.be.Queue.Enqueue(s.from, s.to, r); err != nil {
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Failed to queue message",
+		}
+	}
+	return nil
+}
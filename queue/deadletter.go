@@ -0,0 +1,154 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bury moves an expired entry to the dead-letter store.
+func (q *Queue) bury(env *Envelope, to []string, err error, now time.Time) {
+	q.mu.Lock()
+	dead := *env
+	q.mu.Unlock()
+	dead.To = to
+	dead.Attempts++
+	dead.LastError = err.Error()
+	dead.Expired = now
+
+	q.deadMu.Lock()
+	defer q.deadMu.Unlock()
+
+	if err := q.saveDead(&dead); err != nil {
+		q.ErrorLog.Printf("failed to move queue entry %v to the dead-letter store: %v", env.ID, err)
+		q.remove(env)
+		return
+	}
+	if err := os.Remove(q.envelopePath(env.ID)); err != nil && !os.IsNotExist(err) {
+		q.ErrorLog.Printf("failed to remove queue entry %v: %v", env.ID, err)
+	}
+}
+
+// saveDead moves the message of an entry to the dead-letter store, and
+// writes its envelope there.
+func (q *Queue) saveDead(env *Envelope) error {
+	if err := os.MkdirAll(q.deadDir(), 0700); err != nil {
+		return err
+	}
+	dataPath := filepath.Join(q.deadDir(), env.ID+".eml")
+	if err := os.Rename(q.dataPath(env.ID), dataPath); err != nil {
+		return err
+	}
+	b, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(q.deadDir(), env.ID+".json"), strings.NewReader(string(b))); err != nil {
+		os.Rename(dataPath, q.dataPath(env.ID))
+		return err
+	}
+	return nil
+}
+
+// loadDead reads an envelope from the dead-letter store.
+func (q *Queue) loadDead(id string) (*Envelope, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, ErrNotFound
+	}
+	b, err := ioutil.ReadFile(filepath.Join(q.deadDir(), id+".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	env := new(Envelope)
+	if err := json.Unmarshal(b, env); err != nil {
+		return nil, fmt.Errorf("queue: failed to load dead letter %v: %v", id, err)
+	}
+	return env, nil
+}
+
+// DeadLetters lists the entries of the dead-letter store, oldest first.
+func (q *Queue) DeadLetters() ([]*Envelope, error) {
+	q.deadMu.Lock()
+	defer q.deadMu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(q.deadDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	envs := make([]*Envelope, 0, len(paths))
+	for _, path := range paths {
+		env, err := q.loadDead(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		envs = append(envs, env)
+	}
+	sort.Slice(envs, func(i, j int) bool {
+		if !envs[i].Queued.Equal(envs[j].Queued) {
+			return envs[i].Queued.Before(envs[j].Queued)
+		}
+		return envs[i].ID < envs[j].ID
+	})
+	return envs, nil
+}
+
+// RetryDeadLetter moves an entry of the dead-letter store back to the queue.
+// The entry is attempted immediately, and expires after the maximum age
+// again.
+func (q *Queue) RetryDeadLetter(id string) error {
+	q.deadMu.Lock()
+	defer q.deadMu.Unlock()
+
+	env, err := q.loadDead(id)
+	if err != nil {
+		return err
+	}
+	now := q.now()
+	env.Queued = now
+	env.NextAttempt = now
+	env.Attempts = 0
+	env.LastError = ""
+	env.Expired = time.Time{}
+
+	dataPath := filepath.Join(q.deadDir(), id+".eml")
+	if err := os.Rename(dataPath, q.dataPath(id)); err != nil {
+		return err
+	}
+	if err := q.save(env); err != nil {
+		os.Rename(q.dataPath(id), dataPath)
+		return err
+	}
+	if err := os.Remove(filepath.Join(q.deadDir(), id+".json")); err != nil {
+		q.ErrorLog.Printf("failed to remove dead letter %v: %v", id, err)
+	}
+
+	q.mu.Lock()
+	q.entries[env.ID] = env
+	q.mu.Unlock()
+	q.notify()
+	return nil
+}
+
+// DeleteDeadLetter removes an entry from the dead-letter store.
+func (q *Queue) DeleteDeadLetter(id string) error {
+	q.deadMu.Lock()
+	defer q.deadMu.Unlock()
+
+	if _, err := q.loadDead(id); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(q.deadDir(), id+".json")); err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(q.deadDir(), id+".eml"))
+	return nil
+}
@@ -0,0 +1,145 @@
+package queue
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Handler serves an HTTP/JSON administration API for a queue:
+//
+//	GET    /messages               lists entries, filtered by the from, to,
+//	                               held and deferred query parameters
+//	GET    /messages/{id}          returns an entry
+//	POST   /messages/{id}/retry    schedules an entry for immediate delivery
+//	POST   /messages/{id}/hold     holds an entry
+//	POST   /messages/{id}/release  releases a held entry
+//	DELETE /messages/{id}          deletes an entry
+//	GET    /dead                   lists the dead-letter store
+//	POST   /dead/{id}/retry        moves a dead letter back to the queue
+//	DELETE /dead/{id}              deletes a dead letter
+//
+// Entries are encoded as Envelope. Errors are returned as a JSON object with
+// an "error" field. The handler doesn't authenticate clients, and must only
+// be exposed to operators.
+type Handler struct {
+	Queue *Queue
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "messages":
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		query := r.URL.Query()
+		writeJSON(w, http.StatusOK, nonNil(h.Queue.List(&Filter{
+			From:     query.Get("from"),
+			To:       query.Get("to"),
+			Held:     query.Get("held") == "true",
+			Deferred: query.Get("deferred") == "true",
+		})))
+	case len(parts) == 2 && parts[0] == "messages":
+		switch r.Method {
+		case http.MethodGet:
+			env, err := h.Queue.Entry(parts[1])
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, env)
+		case http.MethodDelete:
+			writeResult(w, h.Queue.Delete(parts[1]))
+		default:
+			writeMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		}
+	case len(parts) == 3 && parts[0] == "messages":
+		var action func(id string) error
+		switch parts[2] {
+		case "retry":
+			action = h.Queue.Retry
+		case "hold":
+			action = h.Queue.Hold
+		case "release":
+			action = h.Queue.Release
+		default:
+			writeError(w, ErrNotFound)
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		writeResult(w, action(parts[1]))
+	case len(parts) == 1 && parts[0] == "dead":
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		envs, err := h.Queue.DeadLetters()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, envs)
+	case len(parts) == 2 && parts[0] == "dead":
+		if r.Method != http.MethodDelete {
+			writeMethodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		writeResult(w, h.Queue.DeleteDeadLetter(parts[1]))
+	case len(parts) == 3 && parts[0] == "dead" && parts[2] == "retry":
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		writeResult(w, h.Queue.RetryDeadLetter(parts[1]))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// nonNil encodes empty lists as [] rather than null.
+func nonNil(envs []*Envelope) []*Envelope {
+	if envs == nil {
+		return []*Envelope{}
+	}
+	return envs
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case ErrNotFound:
+		status = http.StatusNotFound
+	case ErrActive:
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, struct {
+		Error string `json:"error"`
+	}{"method not allowed"})
+}
@@ -0,0 +1,818 @@
+// Package queue implements a persistent on-disk delivery queue.
+//
+// Accepted messages are journaled to a directory along with their envelope,
+// then handed to a Transport. Temporary failures are retried with exponential
+// backoff, and messages which cannot be delivered are bounced to their sender.
+//
+// Deliveries are throttled per recipient domain: their concurrency and rate
+// can be limited, and a domain replying 421 or 450 is paused, so that
+// receivers enforcing their own limits aren't hammered.
+//
+// Expired messages can be kept in a dead-letter store, from which operators
+// can retry or delete them.
+package queue
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/dsn"
+)
+
+// Transport delivers messages. backendutil.RelayBackend implements this
+// interface.
+//
+// Errors of type *smtp.SMTPError with a 5xx code, possibly wrapped in a
+// *smtp.HelloError, and errors of type *smtp.SMTPUTF8RequiredError are
+// permanent failures. If a *smtp.RcptErrors is returned, recipients failing
+// permanently are bounced and the others are retried. Any other error is
+// temporary.
+type Transport interface {
+	Deliver(from string, to []string, r io.Reader) error
+}
+
+// Envelope describes a queued message. Each envelope only contains
+// recipients of a single domain.
+type Envelope struct {
+	ID     string    `json:"id"`
+	From   string    `json:"from"`
+	To     []string  `json:"to"`
+	Domain string    `json:"domain"`
+	Queued time.Time `json:"queued"`
+
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	Warned      bool      `json:"warned,omitempty"`
+	// Held entries aren't delivered until released
+	Held bool `json:"held,omitempty"`
+	// The time the entry was moved to the dead-letter store
+	Expired time.Time `json:"expired,omitempty"`
+}
+
+// ErrNotFound is returned when a queue entry doesn't exist.
+var ErrNotFound = errors.New("queue: entry not found")
+
+// RetrySchedule defines when failed deliveries to a destination class are
+// retried. Zero values fall back to the queue settings.
+type RetrySchedule struct {
+	// Intervals lists the delays before each retry, the last one being
+	// repeated.
+	Intervals []time.Duration
+	// MaxAge is the time after which undelivered messages expire.
+	MaxAge time.Duration
+}
+
+// DomainLimit overrides the delivery limits of a queue for a recipient
+// domain. Zero values fall back to the queue limits.
+type DomainLimit struct {
+	// The maximum number of concurrent deliveries.
+	Concurrency int
+	// The maximum number of deliveries started over RateInterval.
+	Rate         int
+	RateInterval time.Duration
+}
+
+// Queue is a persistent delivery queue.
+type Queue struct {
+	// Transport delivers messages.
+	Transport Transport
+	// Hostname is used in bounce messages.
+	Hostname string
+	// The delay before the first retry, doubled after each attempt up to
+	// MaxRetryDelay. Defaults to 5 minutes and 4 hours.
+	MinRetryDelay time.Duration
+	MaxRetryDelay time.Duration
+	// MaxAge is the time after which undelivered messages are bounced.
+	// Defaults to 5 days.
+	MaxAge time.Duration
+	// If non-zero, a delay notification is sent to the sender once a message
+	// has been in the queue for this long.
+	DelayWarning time.Duration
+	// RetrySchedules overrides the retry delays and MaxAge by destination
+	// class. The class of an entry is given by DestinationClass, or is its
+	// lower-case recipient domain if nil.
+	RetrySchedules   map[string]RetrySchedule
+	DestinationClass func(domain string) string
+	// If set, expired messages are moved to a dead-letter store instead of
+	// being dropped, see DeadLetters. Their senders are still notified.
+	DeadLetter bool
+	// The maximum number of concurrent deliveries per recipient domain.
+	// Defaults to 2.
+	DomainConcurrency int
+	// If non-zero, the maximum number of deliveries started per recipient
+	// domain over DomainRateInterval. The interval defaults to 1 minute.
+	DomainRate         int
+	DomainRateInterval time.Duration
+	// DomainLimits overrides the limits above for lower-case recipient
+	// domains, e.g. to respect the published limits of large providers.
+	DomainLimits map[string]DomainLimit
+	// Deliveries to a domain replying 421 or 450 are paused for
+	// MinThrottleDelay, doubled after each consecutive throttling reply up
+	// to MaxThrottleDelay, and a single delivery runs at a time until one
+	// succeeds. Defaults to 1 minute and 1 hour. If zero, domains aren't
+	// paused.
+	MinThrottleDelay time.Duration
+	MaxThrottleDelay time.Duration
+	ErrorLog         smtp.Logger
+	// Now returns the current time, used to date entries and schedule
+	// attempts. If nil, time.Now is used.
+	Now func() time.Time
+	// After is used like time.After to wait for the next scheduled attempt.
+	// If nil, time.After is used.
+	After func(d time.Duration) <-chan time.Time
+	// Rand is the source of randomness of entry IDs. If nil, crypto/rand is
+	// used.
+	Rand io.Reader
+
+	dir string
+	// Serializes the dead-letter store operations
+	deadMu sync.Mutex
+
+	mu       sync.Mutex
+	entries  map[string]*Envelope
+	inflight map[string]bool
+	domains  map[string]*domainState
+	wake     chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Open opens a queue stored in dir, creating the directory if necessary.
+// Messages already present in the queue are loaded. Deliveries don't start
+// until Start is called.
+func Open(dir string, t Transport) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	q := &Queue{
+		Transport:         t,
+		Hostname:          hostname,
+		MinRetryDelay:     5 * time.Minute,
+		MaxRetryDelay:     4 * time.Hour,
+		MaxAge:            5 * 24 * time.Hour,
+		DomainConcurrency: 2,
+		MinThrottleDelay:  time.Minute,
+		MaxThrottleDelay:  time.Hour,
+		ErrorLog:          log.New(os.Stderr, "smtp/queue ", log.LstdFlags),
+		dir:               dir,
+		entries:           make(map[string]*Envelope),
+		inflight:          make(map[string]bool),
+		domains:           make(map[string]*domainState),
+		wake:              make(chan struct{}, 1),
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		env := new(Envelope)
+		if err := json.Unmarshal(b, env); err != nil {
+			return nil, fmt.Errorf("queue: failed to load %v: %v", path, err)
+		}
+		q.entries[env.ID] = env
+	}
+
+	return q, nil
+}
+
+// Start starts delivering queued messages in the background.
+func (q *Queue) Start() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.done != nil {
+		return
+	}
+	q.done = make(chan struct{})
+	q.wg.Add(1)
+	go q.run(q.done)
+}
+
+// Close stops the queue and waits for pending deliveries to complete. Queued
+// messages are kept on disk.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	done := q.done
+	q.done = nil
+	q.mu.Unlock()
+
+	if done != nil {
+		close(done)
+	}
+	q.wg.Wait()
+	return nil
+}
+
+// Enqueue adds a message to the queue. The message is split into one entry
+// per recipient domain. Enqueue returns once the message has been written to
+// disk.
+func (q *Queue) Enqueue(from string, to []string, r io.Reader) error {
+	if len(to) == 0 {
+		return errors.New("queue: no recipients")
+	}
+
+	var domains []string
+	byDomain := make(map[string][]string)
+	for _, rcpt := range to {
+		domain := domainOf(rcpt)
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], rcpt)
+	}
+
+	now := q.now()
+	envs := make([]*Envelope, len(domains))
+	for i, domain := range domains {
+		envs[i] = &Envelope{
+			ID:          q.newID(now),
+			From:        from,
+			To:          byDomain[domain],
+			Domain:      domain,
+			Queued:      now,
+			NextAttempt: now,
+		}
+	}
+
+	// Write the message once, and link it for the other domains
+	if err := writeFile(q.dataPath(envs[0].ID), r); err != nil {
+		return err
+	}
+	for _, env := range envs[1:] {
+		if err := linkOrCopy(q.dataPath(envs[0].ID), q.dataPath(env.ID)); err != nil {
+			q.removeFiles(envs)
+			return err
+		}
+	}
+	for _, env := range envs {
+		if err := q.save(env); err != nil {
+			q.removeFiles(envs)
+			return err
+		}
+	}
+
+	q.mu.Lock()
+	for _, env := range envs {
+		q.entries[env.ID] = env
+	}
+	q.mu.Unlock()
+	q.notify()
+	return nil
+}
+
+// Len returns the number of queued entries.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+func (q *Queue) now() time.Time {
+	if q.Now != nil {
+		return q.Now()
+	}
+	return time.Now()
+}
+
+func (q *Queue) after(d time.Duration) <-chan time.Time {
+	if q.After != nil {
+		return q.After(d)
+	}
+	return time.After(d)
+}
+
+func (q *Queue) dataPath(id string) string {
+	return filepath.Join(q.dir, id+".eml")
+}
+
+func (q *Queue) envelopePath(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+// save atomically writes an envelope to disk.
+func (q *Queue) save(env *Envelope) error {
+	b, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return writeFile(q.envelopePath(env.ID), strings.NewReader(string(b)))
+}
+
+func (q *Queue) deadDir() string {
+	return filepath.Join(q.dir, "dead")
+}
+
+func (q *Queue) remove(env *Envelope) {
+	// Remove the envelope first, so that a crash doesn't leave an entry
+	// without its message
+	if err := os.Remove(q.envelopePath(env.ID)); err != nil && !os.IsNotExist(err) {
+		q.ErrorLog.Printf("failed to remove queue entry %v: %v", env.ID, err)
+	}
+	os.Remove(q.dataPath(env.ID))
+}
+
+func (q *Queue) removeFiles(envs []*Envelope) {
+	for _, env := range envs {
+		q.remove(env)
+	}
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) run(done <-chan struct{}) {
+	defer q.wg.Done()
+
+	for {
+		next := q.dispatch()
+
+		var timer <-chan time.Time
+		if !next.IsZero() {
+			timer = q.after(next.Sub(q.now()))
+		}
+
+		select {
+		case <-q.wake:
+		case <-timer:
+		case <-done:
+			return
+		}
+	}
+}
+
+// dispatch starts deliveries for entries which are due, and returns the time
+// of the next scheduled attempt, if any.
+func (q *Queue) dispatch() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	envs := make([]*Envelope, 0, len(q.entries))
+	for _, env := range q.entries {
+		if !q.inflight[env.ID] && !env.Held {
+			envs = append(envs, env)
+		}
+	}
+	sort.Slice(envs, func(i, j int) bool {
+		return envs[i].NextAttempt.Before(envs[j].NextAttempt)
+	})
+
+	now := q.now()
+	var next time.Time
+	schedule := func(t time.Time) {
+		if !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	for _, env := range envs {
+		if env.NextAttempt.After(now) {
+			schedule(env.NextAttempt)
+			continue
+		}
+		if ok, retry := q.ready(env.Domain, now); !ok {
+			schedule(retry)
+			continue
+		}
+
+		st := q.domain(env.Domain)
+		st.active++
+		if rate, _ := q.rate(env.Domain); rate > 0 {
+			st.starts = append(st.starts, now)
+		}
+		q.inflight[env.ID] = true
+		q.wg.Add(1)
+		go q.deliver(env)
+	}
+
+	q.pruneDomains(now)
+	return next
+}
+
+// domainState tracks the deliveries to a recipient domain.
+type domainState struct {
+	active int
+	// Start times of the deliveries over the rate interval
+	starts []time.Time
+	// The current throttling delay, and the end of the pause
+	backoff time.Duration
+	until   time.Time
+}
+
+// domain returns the state of a domain, creating it if necessary. The
+// queue mutex must be held.
+func (q *Queue) domain(domain string) *domainState {
+	st := q.domains[domain]
+	if st == nil {
+		st = new(domainState)
+		q.domains[domain] = st
+	}
+	return st
+}
+
+func (q *Queue) concurrency(domain string) int {
+	if l, ok := q.DomainLimits[domain]; ok && l.Concurrency > 0 {
+		return l.Concurrency
+	}
+	return q.DomainConcurrency
+}
+
+func (q *Queue) rate(domain string) (rate int, interval time.Duration) {
+	rate, interval = q.DomainRate, q.DomainRateInterval
+	if l, ok := q.DomainLimits[domain]; ok {
+		if l.Rate > 0 {
+			rate = l.Rate
+		}
+		if l.RateInterval > 0 {
+			interval = l.RateInterval
+		}
+	}
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return rate, interval
+}
+
+// ready checks whether a delivery to a domain can start. If not, it returns
+// the time at which it can, if known. The queue mutex must be held.
+func (q *Queue) ready(domain string, now time.Time) (bool, time.Time) {
+	st := q.domains[domain]
+	if st == nil {
+		return true, time.Time{}
+	}
+	if now.Before(st.until) {
+		return false, st.until
+	}
+
+	concurrency := q.concurrency(domain)
+	if st.backoff > 0 {
+		concurrency = 1
+	}
+	if concurrency > 0 && st.active >= concurrency {
+		// Woken up once a delivery completes
+		return false, time.Time{}
+	}
+
+	if rate, interval := q.rate(domain); rate > 0 {
+		st.prune(now, interval)
+		if len(st.starts) >= rate {
+			return false, st.starts[0].Add(interval)
+		}
+	}
+	return true, time.Time{}
+}
+
+// prune forgets the deliveries started before the rate interval.
+func (st *domainState) prune(now time.Time, interval time.Duration) {
+	i := 0
+	for i < len(st.starts) && !st.starts[i].After(now.Add(-interval)) {
+		i++
+	}
+	st.starts = st.starts[i:]
+}
+
+// pruneDomains forgets idle domains. Throttled domains are remembered while
+// they have queued entries. The queue mutex must be held.
+func (q *Queue) pruneDomains(now time.Time) {
+	queued := make(map[string]bool)
+	for _, env := range q.entries {
+		queued[env.Domain] = true
+	}
+	for domain, st := range q.domains {
+		_, interval := q.rate(domain)
+		st.prune(now, interval)
+		if st.active > 0 || len(st.starts) > 0 || now.Before(st.until) {
+			continue
+		}
+		if st.backoff == 0 || !queued[domain] {
+			delete(q.domains, domain)
+		}
+	}
+}
+
+// feedback updates the throttling state of a domain after a delivery.
+func (q *Queue) feedback(domain string, err error) {
+	if q.MinThrottleDelay <= 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	st := q.domain(domain)
+	if err == nil {
+		st.backoff = 0
+		st.until = time.Time{}
+		return
+	}
+	now := q.now()
+	if !isThrottled(err) || now.Before(st.until) {
+		// Concurrent deliveries failing during a pause don't extend it
+		return
+	}
+
+	if st.backoff == 0 {
+		st.backoff = q.MinThrottleDelay
+	} else {
+		st.backoff *= 2
+	}
+	if q.MaxThrottleDelay > 0 && st.backoff > q.MaxThrottleDelay {
+		st.backoff = q.MaxThrottleDelay
+	}
+	st.until = now.Add(st.backoff)
+	q.ErrorLog.Printf("throttling deliveries to %v for %v: %v", domain, st.backoff, err)
+}
+
+// isThrottled checks whether a delivery failed because the server asked to
+// slow down.
+func isThrottled(err error) bool {
+	switch err := err.(type) {
+	case *smtp.HelloError:
+		return isThrottled(err.Err)
+	case *smtp.SMTPError:
+		return err.Code == 421 || err.Code == 450
+	case *smtp.RcptErrors:
+		for _, rcptErr := range err.Errors {
+			if isThrottled(rcptErr.Err) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (q *Queue) deliver(env *Envelope) {
+	defer q.wg.Done()
+
+	err := q.attempt(env)
+
+	q.mu.Lock()
+	q.domain(env.Domain).active--
+	delete(q.inflight, env.ID)
+	// The entry may have been replaced while being buried
+	if err == nil && q.entries[env.ID] == env {
+		delete(q.entries, env.ID)
+	}
+	q.mu.Unlock()
+	q.notify()
+}
+
+// attempt tries to deliver an entry. It returns nil if the entry was removed
+// from the queue, or an error if it must be retried.
+func (q *Queue) attempt(env *Envelope) error {
+	f, err := os.Open(q.dataPath(env.ID))
+	if err != nil {
+		q.ErrorLog.Printf("failed to open queued message %v: %v", env.ID, err)
+		q.remove(env)
+		return nil
+	}
+	err = q.Transport.Deliver(env.From, env.To, f)
+	f.Close()
+	q.feedback(env.Domain, err)
+	if err == nil {
+		q.remove(env)
+		return nil
+	}
+
+	failed, retry := splitFailures(env.To, err)
+	now := q.now()
+	schedule := q.schedule(env.Domain)
+	var expired []string
+	if len(retry) > 0 && now.Sub(env.Queued) >= schedule.MaxAge {
+		for _, rcpt := range retry {
+			failed = append(failed, &smtp.RcptError{Rcpt: rcpt, Err: err})
+		}
+		expired, retry = retry, nil
+	}
+
+	if len(failed) > 0 {
+		rcpts := make([]dsn.Recipient, len(failed))
+		for i, rcptErr := range failed {
+			rcpts[i] = dsn.RecipientFromError(rcptErr.Rcpt, dsn.ActionFailed, rcptErr.Err)
+		}
+		q.notifySender(env, rcpts)
+	}
+	if len(retry) == 0 {
+		if len(expired) > 0 && q.DeadLetter {
+			q.bury(env, expired, err, now)
+		} else {
+			q.remove(env)
+		}
+		return nil
+	}
+
+	warn := q.DelayWarning > 0 && !env.Warned && now.Sub(env.Queued) >= q.DelayWarning
+	if warn {
+		rcpts := make([]dsn.Recipient, len(retry))
+		for i, rcpt := range retry {
+			rcpts[i] = dsn.RecipientFromError(rcpt, dsn.ActionDelayed, err)
+			rcpts[i].WillRetryUntil = env.Queued.Add(schedule.MaxAge)
+		}
+		q.notifySender(env, rcpts)
+	}
+
+	q.mu.Lock()
+	env.To = retry
+	env.Attempts++
+	env.NextAttempt = now.Add(schedule.delay(env.Attempts, q.MinRetryDelay, q.MaxRetryDelay))
+	env.LastError = err.Error()
+	env.Warned = env.Warned || warn
+	q.mu.Unlock()
+
+	if saveErr := q.save(env); saveErr != nil {
+		q.ErrorLog.Printf("failed to update queue entry %v: %v", env.ID, saveErr)
+	}
+	return err
+}
+
+// schedule returns the retry schedule of a recipient domain, with the
+// queue settings filled in.
+func (q *Queue) schedule(domain string) RetrySchedule {
+	class := domain
+	if q.DestinationClass != nil {
+		class = q.DestinationClass(domain)
+	}
+	s := q.RetrySchedules[class]
+	if s.MaxAge <= 0 {
+		s.MaxAge = q.MaxAge
+	}
+	return s
+}
+
+// delay returns the delay before the next attempt. Without intervals, the
+// delay doubles after each attempt from min up to max.
+func (s *RetrySchedule) delay(attempts int, min, max time.Duration) time.Duration {
+	if n := len(s.Intervals); n > 0 {
+		if attempts > n {
+			attempts = n
+		}
+		return s.Intervals[attempts-1]
+	}
+
+	d := min
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	return d
+}
+
+// splitFailures splits recipients into permanently failed ones and ones to
+// retry.
+func splitFailures(to []string, err error) (failed []*smtp.RcptError, retry []string) {
+	switch err := err.(type) {
+	case *smtp.HelloError:
+		return splitFailures(to, err.Err)
+	case *smtp.SMTPUTF8RequiredError:
+		return splitFailures(to, err.SMTPError())
+	case *smtp.SMTPError:
+		if err.Code/100 == 5 {
+			for _, rcpt := range to {
+				failed = append(failed, &smtp.RcptError{Rcpt: rcpt, Err: err})
+			}
+			return failed, nil
+		}
+	case *smtp.RcptErrors:
+		pending := make(map[string]bool, len(to))
+		for _, rcpt := range to {
+			pending[rcpt] = true
+		}
+		rejected := make(map[string]bool)
+		for _, rcptErr := range err.Errors {
+			if !pending[rcptErr.Rcpt] {
+				continue
+			}
+			switch rerr := rcptErr.Err.(type) {
+			case *smtp.SMTPError:
+				if rerr.Code/100 == 5 {
+					failed = append(failed, rcptErr)
+					rejected[rcptErr.Rcpt] = true
+				}
+			case *smtp.SMTPUTF8RequiredError:
+				failed = append(failed, &smtp.RcptError{Rcpt: rcptErr.Rcpt, Err: rerr.SMTPError()})
+				rejected[rcptErr.Rcpt] = true
+			}
+		}
+		for _, rcpt := range to {
+			if !rejected[rcpt] {
+				retry = append(retry, rcpt)
+			}
+		}
+		return failed, retry
+	}
+	return nil, to
+}
+
+// notifySender queues a delivery status notification for the sender of an
+// entry.
+func (q *Queue) notifySender(env *Envelope, rcpts []dsn.Recipient) {
+	if env.From == "" {
+		// Never bounce a bounce
+		return
+	}
+
+	f, err := os.Open(q.dataPath(env.ID))
+	if err != nil {
+		q.ErrorLog.Printf("failed to notify sender of queued message %v: %v", env.ID, err)
+		return
+	}
+	defer f.Close()
+
+	report := &dsn.Report{
+		ReportingMTA: q.Hostname,
+		To:           env.From,
+		ArrivalDate:  env.Queued,
+		Recipients:   rcpts,
+		Original:     f,
+		HeadersOnly:  true,
+	}
+	var b bytes.Buffer
+	if _, err := report.WriteTo(&b); err != nil {
+		q.ErrorLog.Printf("failed to notify sender of queued message %v: %v", env.ID, err)
+		return
+	}
+	if err := q.Enqueue("", []string{env.From}, &b); err != nil {
+		q.ErrorLog.Printf("failed to notify sender of queued message %v: %v", env.ID, err)
+	}
+}
+
+func domainOf(addr string) string {
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		return strings.ToLower(addr[i+1:])
+	}
+	return ""
+}
+
+func (q *Queue) newID(now time.Time) string {
+	r := q.Rand
+	if r == nil {
+		r = rand.Reader
+	}
+	var b [6]byte
+	io.ReadFull(r, b[:])
+	return fmt.Sprintf("%x%v", now.UnixNano(), strings.ToUpper(hex.EncodeToString(b[:])))
+}
+
+// writeFile atomically writes the contents of r to path.
+func writeFile(path string, r io.Reader) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeFile(dst, f)
+}
@@ -0,0 +1,674 @@
+package queue_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/queue"
+)
+
+var _ smtp.Backend = &queue.Backend{}
+
+type delivery struct {
+	From string
+	To   []string
+	Data string
+}
+
+type transport struct {
+	mu         sync.Mutex
+	deliveries []delivery
+	deliver    func(from string, to []string) error
+	delivered  chan struct{}
+}
+
+func newTransport(deliver func(from string, to []string) error) *transport {
+	return &transport{deliver: deliver, delivered: make(chan struct{}, 100)}
+}
+
+func (t *transport) Deliver(from string, to []string, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	err = t.deliver(from, to)
+	if err == nil {
+		t.deliveries = append(t.deliveries, delivery{from, append([]string(nil), to...), string(b)})
+	}
+	t.mu.Unlock()
+
+	if err == nil {
+		t.delivered <- struct{}{}
+	}
+	return err
+}
+
+func (t *transport) wait(tb testing.TB, n int) []delivery {
+	tb.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-t.delivered:
+		case <-time.After(5 * time.Second):
+			tb.Fatalf("timeout waiting for delivery %v", i+1)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]delivery(nil), t.deliveries...)
+}
+
+func openQueue(t *testing.T, tr queue.Transport) (*queue.Queue, string) {
+	dir, err := ioutil.TempDir("", "go-smtp-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := queue.Open(dir, tr)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Open: %v", err)
+	}
+	q.Hostname = "mx.example.org"
+	q.MinRetryDelay = 10 * time.Millisecond
+	q.MaxRetryDelay = 50 * time.Millisecond
+	return q, dir
+}
+
+func TestQueue(t *testing.T) {
+	failures := 1
+	tr := newTransport(func(from string, to []string) error {
+		if to[0] == "bob@example.org" && failures > 0 {
+			failures--
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	q, dir := openQueue(t, tr)
+	defer os.RemoveAll(dir)
+	q.Start()
+	defer q.Close()
+
+	to := []string{"bob@example.org", "carol@example.net", "dave@example.org"}
+	if err := q.Enqueue("alice@example.com", to, strings.NewReader("Hello!\r\n")); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	deliveries := tr.wait(t, 2)
+	byDomain := make(map[string]delivery)
+	for _, d := range deliveries {
+		byDomain[d.To[0][strings.IndexByte(d.To[0], '@')+1:]] = d
+	}
+	if d := byDomain["example.org"]; len(d.To) != 2 || d.Data != "Hello!\r\n" {
+		t.Errorf("unexpected delivery %+v", d)
+	}
+	if d := byDomain["example.net"]; len(d.To) != 1 || d.From != "alice@example.com" {
+		t.Errorf("unexpected delivery %+v", d)
+	}
+
+	for i := 0; i < 100 && q.Len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := q.Len(); n != 0 {
+		t.Errorf("expected empty queue, got %v entries", n)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected empty queue directory, got %v files", len(files))
+	}
+}
+
+func TestQueue_bounce(t *testing.T) {
+	tr := newTransport(func(from string, to []string) error {
+		if from == "" {
+			return nil
+		}
+		return &smtp.RcptErrors{
+			Errors: []*smtp.RcptError{{
+				Rcpt: "bob@example.org",
+				Err:  &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"},
+			}},
+			Accepted: []string{"carol@example.org"},
+		}
+	})
+	q, dir := openQueue(t, tr)
+	defer os.RemoveAll(dir)
+	q.MaxAge = 30 * time.Millisecond
+	q.Start()
+	defer q.Close()
+
+	msg := "Subject: Hi\r\n\r\nHello!\r\n"
+	if err := q.Enqueue("alice@example.com", []string{"bob@example.org", "carol@example.org"}, strings.NewReader(msg)); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	// bob@example.org is bounced immediately, carol@example.org once the
+	// message expires
+	deliveries := tr.wait(t, 2)
+	for _, d := range deliveries {
+		if d.From != "" || len(d.To) != 1 || d.To[0] != "alice@example.com" {
+			t.Errorf("unexpected bounce envelope %+v", d)
+		}
+		if !strings.Contains(d.Data, "Subject: Undelivered Mail Returned to Sender") || !strings.Contains(d.Data, "multipart/report") || !strings.Contains(d.Data, "\r\nSubject: Hi\r\n") {
+			t.Errorf("unexpected bounce message:\n%v", d.Data)
+		}
+	}
+	if !strings.Contains(deliveries[0].Data, "Final-Recipient: rfc822; bob@example.org\r\nAction: failed\r\nStatus: 5.1.1\r\nDiagnostic-Code: smtp; 550 5.1.1 No such user\r\n") {
+		t.Errorf("unexpected bounce message:\n%v", deliveries[0].Data)
+	}
+	if !strings.Contains(deliveries[1].Data, "Final-Recipient: rfc822; carol@example.org\r\nAction: failed\r\n") {
+		t.Errorf("unexpected bounce message:\n%v", deliveries[1].Data)
+	}
+}
+
+func TestQueue_persistence(t *testing.T) {
+	tr := newTransport(func(from string, to []string) error {
+		return nil
+	})
+	q, dir := openQueue(t, tr)
+	defer os.RemoveAll(dir)
+
+	if err := q.Enqueue("alice@example.com", []string{"bob@example.org"}, strings.NewReader("Hello!\r\n")); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	q.Close()
+
+	q, err := queue.Open(dir, tr)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if n := q.Len(); n != 1 {
+		t.Fatalf("expected 1 entry after reopening, got %v", n)
+	}
+	q.Start()
+	defer q.Close()
+
+	deliveries := tr.wait(t, 1)
+	if deliveries[0].To[0] != "bob@example.org" || deliveries[0].Data != "Hello!\r\n" {
+		t.Errorf("unexpected delivery %+v", deliveries[0])
+	}
+}
+
+func TestQueue_delayWarning(t *testing.T) {
+	tr := newTransport(func(from string, to []string) error {
+		if from == "" {
+			return nil
+		}
+		return errors.New("connection refused")
+	})
+	q, dir := openQueue(t, tr)
+	defer os.RemoveAll(dir)
+	q.DelayWarning = time.Millisecond
+	q.Start()
+	defer q.Close()
+
+	if err := q.Enqueue("alice@example.com", []string{"bob@example.org"}, strings.NewReader("Hello!\r\n")); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	deliveries := tr.wait(t, 1)
+	if !strings.Contains(deliveries[0].Data, "Action: delayed\r\nStatus: 4.0.0\r\n") {
+		t.Errorf("unexpected delay notification:\n%v", deliveries[0].Data)
+	}
+
+	// Only a single notification is sent
+	time.Sleep(100 * time.Millisecond)
+	if n := len(tr.wait(t, 0)); n != 1 {
+		t.Errorf("expected 1 notification, got %v", n)
+	}
+}
+
+// fakeClock is a clock which only advances when told to.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+	// Receives the duration of each timer
+	started chan time.Duration
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:     time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		started: make(chan time.Duration, 100),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, fakeTimer{c.now.Add(d), ch})
+	c.mu.Unlock()
+	c.started <- d
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		if t.deadline.After(c.now) {
+			timers = append(timers, t)
+		} else {
+			t.ch <- c.now
+		}
+	}
+	c.timers = timers
+}
+
+// countingReader returns consecutive byte values.
+type countingReader struct {
+	n byte
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = r.n
+		r.n++
+	}
+	return len(b), nil
+}
+
+func TestQueue_clock(t *testing.T) {
+	failures := 2
+	tr := newTransport(func(from string, to []string) error {
+		if failures > 0 {
+			failures--
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	q, dir := openQueue(t, tr)
+	defer os.RemoveAll(dir)
+	clock := newFakeClock()
+	q.Now, q.After = clock.Now, clock.After
+	q.Rand = &countingReader{}
+	q.MinRetryDelay = 5 * time.Minute
+	q.MaxRetryDelay = time.Hour
+
+	if err := q.Enqueue("alice@example.com", []string{"bob@example.org"}, strings.NewReader("Hello!\r\n")); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 || files[0].Name() != "15e59a35b98a0000000102030405.eml" {
+		t.Fatalf("unexpected queue files %v", files)
+	}
+
+	q.Start()
+	defer q.Close()
+
+	// The retry delay is doubled after each attempt. The queue may schedule
+	// the same attempt several times when woken up.
+	var prev time.Duration
+	for _, want := range []time.Duration{5 * time.Minute, 10 * time.Minute} {
+		for d := prev; d != want; {
+			select {
+			case d = <-clock.started:
+				if d != want && d != prev {
+					t.Fatalf("next attempt scheduled in %v, want %v", d, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for the next attempt to be scheduled")
+			}
+		}
+		clock.Advance(want)
+		prev = want
+	}
+
+	deliveries := tr.wait(t, 1)
+	if deliveries[0].To[0] != "bob@example.org" {
+		t.Errorf("unexpected delivery %+v", deliveries[0])
+	}
+}
+
+// drainTimers discards the durations of the timers started by a fake clock.
+func drainTimers(c *fakeClock) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-c.started:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func TestQueue_domainRate(t *testing.T) {
+	clock := newFakeClock()
+	var times []time.Time
+	tr := newTransport(func(from string, to []string) error {
+		times = append(times, clock.Now())
+		return nil
+	})
+	q, dir := openQueue(t, tr)
+	defer os.RemoveAll(dir)
+	q.Now, q.After = clock.Now, clock.After
+	q.DomainRate = 10
+	q.DomainLimits = map[string]queue.DomainLimit{
+		"example.org": {Rate: 1, RateInterval: time.Minute},
+	}
+	defer drainTimers(clock)()
+
+	for _, rcpt := range []string{"bob@example.org", "carol@example.org", "dave@example.net", "erin@example.net"} {
+		if err := q.Enqueue("alice@example.com", []string{rcpt}, strings.NewReader("Hello!\r\n")); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+	q.Start()
+	defer q.Close()
+
+	tr.wait(t, 3)
+	time.Sleep(50 * time.Millisecond)
+	if n := q.Len(); n != 1 {
+		t.Fatalf("expected 1 rate-limited entry, got %v", n)
+	}
+
+	clock.Advance(time.Minute)
+	tr.wait(t, 1)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if last := times[len(times)-1]; !last.Equal(start.Add(time.Minute)) {
+		t.Errorf("rate-limited delivery at %v, want %v", last, start.Add(time.Minute))
+	}
+}
+
+func TestQueue_throttle(t *testing.T) {
+	clock := newFakeClock()
+	attempted := make(chan struct{}, 10)
+	throttled := true
+	tr := newTransport(func(from string, to []string) error {
+		defer func() { attempted <- struct{}{} }()
+		if throttled {
+			throttled = false
+			return &smtp.SMTPError{
+				Code:         421,
+				EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+				Message:      "Try again later",
+			}
+		}
+		return nil
+	})
+	q, dir := openQueue(t, tr)
+	defer os.RemoveAll(dir)
+	q.Now, q.After = clock.Now, clock.After
+	q.ErrorLog = log.New(ioutil.Discard, "", 0)
+	q.MinRetryDelay = time.Minute
+	q.MinThrottleDelay = 10 * time.Minute
+	defer drainTimers(clock)()
+	q.Start()
+	defer q.Close()
+
+	if err := q.Enqueue("alice@example.com", []string{"bob@example.org"}, strings.NewReader("Hello!\r\n")); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	select {
+	case <-attempted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the first attempt")
+	}
+
+	// The domain is paused, even for new messages and due retries
+	if err := q.Enqueue("alice@example.com", []string{"carol@example.org"}, strings.NewReader("Hello!\r\n")); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	clock.Advance(5 * time.Minute)
+	time.Sleep(50 * time.Millisecond)
+	if n := len(tr.wait(t, 0)); n != 0 {
+		t.Fatalf("expected no delivery while throttled, got %v", n)
+	}
+
+	clock.Advance(5 * time.Minute)
+	tr.wait(t, 2)
+}
+
+func TestQueue_retrySchedule(t *testing.T) {
+	failures := 3
+	tr := newTransport(func(from string, to []string) error {
+		if failures > 0 {
+			failures--
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	q, dir := openQueue(t, tr)
+	defer os.RemoveAll(dir)
+	clock := newFakeClock()
+	q.Now, q.After = clock.Now, clock.After
+	q.RetrySchedules = map[string]queue.RetrySchedule{
+		"slow": {Intervals: []time.Duration{time.Minute, 3 * time.Minute}},
+	}
+	q.DestinationClass = func(domain string) string {
+		if domain == "example.org" {
+			return "slow"
+		}
+		return ""
+	}
+
+	if err := q.Enqueue("alice@example.com", []string{"bob@example.org"}, strings.NewReader("Hello!\r\n")); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	q.Start()
+	defer q.Close()
+
+	// The last interval is repeated
+	var prev time.Duration
+	for _, want := range []time.Duration{time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		for d := time.Duration(-1); d != want; {
+			select {
+			case d = <-clock.started:
+				if d != want && d != prev {
+					t.Fatalf("next attempt scheduled in %v, want %v", d, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for the next attempt to be scheduled")
+			}
+		}
+		clock.Advance(want)
+		prev = want
+	}
+	tr.wait(t, 1)
+}
+
+func TestQueue_deadLetter(t *testing.T) {
+	accept := false
+	tr := newTransport(func(from string, to []string) error {
+		if from == "" || accept {
+			return nil
+		}
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 4, 1}, Message: "No answer"}
+	})
+	q, dir := openQueue(t, tr)
+	defer os.RemoveAll(dir)
+	q.MaxAge = 30 * time.Millisecond
+	q.DeadLetter = true
+	q.Start()
+	defer q.Close()
+
+	if err := q.Enqueue("alice@example.com", []string{"bob@example.org"}, strings.NewReader("Hello!\r\n")); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	// The sender is notified, and the message is kept
+	if d := tr.wait(t, 1)[0]; d.To[0] != "alice@example.com" {
+		t.Errorf("unexpected bounce envelope %+v", d)
+	}
+	var dead []*queue.Envelope
+	for i := 0; i < 100 && len(dead) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		var err error
+		if dead, err = q.DeadLetters(); err != nil {
+			t.Fatalf("DeadLetters: %v", err)
+		}
+	}
+	if len(dead) != 1 || dead[0].To[0] != "bob@example.org" || dead[0].Expired.IsZero() || !strings.Contains(dead[0].LastError, "No answer") {
+		t.Fatalf("unexpected dead letters %+v", dead)
+	}
+
+	tr.mu.Lock()
+	accept = true
+	tr.mu.Unlock()
+	if err := q.RetryDeadLetter(dead[0].ID); err != nil {
+		t.Fatalf("RetryDeadLetter: %v", err)
+	}
+	if d := tr.wait(t, 1)[1]; d.To[0] != "bob@example.org" || d.Data != "Hello!\r\n" {
+		t.Errorf("unexpected delivery %+v", d)
+	}
+	if dead, err := q.DeadLetters(); err != nil || len(dead) != 0 {
+		t.Errorf("DeadLetters() = %v, %v, want none", dead, err)
+	}
+
+	if err := q.RetryDeadLetter(dead[0].ID); err != queue.ErrNotFound {
+		t.Errorf("RetryDeadLetter: expected ErrNotFound, got %v", err)
+	}
+	if err := q.DeleteDeadLetter("../" + dead[0].ID); err != queue.ErrNotFound {
+		t.Errorf("DeleteDeadLetter: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestQueue_admin(t *testing.T) {
+	accept := false
+	tr := newTransport(func(from string, to []string) error {
+		if accept {
+			return nil
+		}
+		return errors.New("connection refused")
+	})
+	q, dir := openQueue(t, tr)
+	defer os.RemoveAll(dir)
+	clock := newFakeClock()
+	q.Now, q.After = clock.Now, clock.After
+	q.Rand = &countingReader{}
+	q.MinRetryDelay = time.Hour
+	defer drainTimers(clock)()
+
+	// Entries queued at the same time are sorted by ID
+	for _, rcpt := range []string{"bob@example.org", "dave@example.net", "erin@example.net"} {
+		if err := q.Enqueue("alice@example.com", []string{rcpt}, strings.NewReader("Hello!\r\n")); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+	envs := q.List(nil)
+	if len(envs) != 3 {
+		t.Fatalf("expected 3 entries, got %v", len(envs))
+	}
+	bob, dave, erin := envs[0].ID, envs[1].ID, envs[2].ID
+	if env, err := q.Entry(dave); err != nil || env.To[0] != "dave@example.net" {
+		t.Errorf("Entry() = %+v, %v", env, err)
+	}
+	if envs := q.List(&queue.Filter{To: "@Example.NET", From: "alice@example.com"}); len(envs) != 2 {
+		t.Errorf("expected 2 entries to example.net, got %v", len(envs))
+	}
+
+	if err := q.Delete(erin); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := q.Entry(erin); err != queue.ErrNotFound {
+		t.Errorf("Entry: expected ErrNotFound after Delete, got %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 4 {
+		t.Errorf("expected 4 queue files after Delete, got %v", len(files))
+	}
+
+	if err := q.Hold(bob); err != nil {
+		t.Fatalf("Hold: %v", err)
+	}
+	if envs := q.List(&queue.Filter{Held: true}); len(envs) != 1 || envs[0].ID != bob {
+		t.Errorf("unexpected held entries %+v", envs)
+	}
+
+	q.Start()
+	defer q.Close()
+
+	// dave@example.net fails and is retried in an hour, bob@example.org is
+	// held
+	for i := 0; i < 100 && len(q.List(&queue.Filter{Deferred: true})) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if envs := q.List(&queue.Filter{Deferred: true}); len(envs) != 1 || envs[0].ID != dave {
+		t.Fatalf("unexpected deferred entries %+v", envs)
+	}
+
+	tr.mu.Lock()
+	accept = true
+	tr.mu.Unlock()
+	if err := q.Retry(dave); err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	if d := tr.wait(t, 1); len(d) != 1 || d[0].To[0] != "dave@example.net" {
+		t.Fatalf("unexpected deliveries %+v", d)
+	}
+
+	if err := q.Release(bob); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if d := tr.wait(t, 1); len(d) != 2 || d[1].To[0] != "bob@example.org" {
+		t.Fatalf("unexpected deliveries %+v", d)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tr := newTransport(func(from string, to []string) error {
+		return nil
+	})
+	q, dir := openQueue(t, tr)
+	defer os.RemoveAll(dir)
+	if err := q.Enqueue("alice@example.com", []string{"bob@example.org"}, strings.NewReader("Hello!\r\n")); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	id := q.List(nil)[0].ID
+	h := &queue.Handler{Queue: q}
+
+	tests := []struct {
+		method, path string
+		status       int
+		body         string
+	}{
+		{"GET", "/messages?to=@example.org", http.StatusOK, `"id":"` + id + `"`},
+		{"GET", "/messages?held=true", http.StatusOK, "[]"},
+		{"GET", "/messages/" + id, http.StatusOK, `"to":["bob@example.org"]`},
+		{"POST", "/messages/" + id + "/hold", http.StatusNoContent, ""},
+		{"GET", "/messages?held=true", http.StatusOK, `"held":true`},
+		{"GET", "/messages/" + id + "/release", http.StatusMethodNotAllowed, "method not allowed"},
+		{"POST", "/messages/" + id + "/release", http.StatusNoContent, ""},
+		{"DELETE", "/messages/" + id, http.StatusNoContent, ""},
+		{"GET", "/messages/" + id, http.StatusNotFound, "entry not found"},
+		{"POST", "/messages/" + id + "/retry", http.StatusNotFound, "entry not found"},
+		{"GET", "/dead", http.StatusOK, "[]"},
+		{"DELETE", "/dead/" + id, http.StatusNotFound, "entry not found"},
+		{"GET", "/", http.StatusNotFound, ""},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.status || !strings.Contains(w.Body.String(), tc.body) {
+			t.Errorf("%v %v: got %v %q, want %v with %q", tc.method, tc.path, w.Code, w.Body.String(), tc.status, tc.body)
+		}
+	}
+	if n := q.Len(); n != 0 {
+		t.Errorf("expected empty queue, got %v entries", n)
+	}
+}
@@ -1,23 +1,62 @@
 package smtp
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"io"
 	"log"
 	"net"
 	"os"
+	"runtime/pprof"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/emersion/go-sasl"
 )
 
+// rejectTimeout is the write timeout for rejected connections.
+const rejectTimeout = 10 * time.Second
+
+// maxRejecters limits the number of connections being rejected concurrently.
+// Beyond it, connections are closed without a reply, so that a flood of
+// connections can't pile up goroutines.
+const maxRejecters = 64
+
 var errTCPAndLMTP = errors.New("smtp: cannot start LMTP server listening on a TCP socket")
 
 // A function that creates SASL servers.
 type SaslServerFactory func(conn *Conn) sasl.Server
 
+// CommandHook is called for NOOP and unrecognized commands, with the command
+// name in upper case and its raw argument. Malformed command lines, such as
+// commands which aren't 4 letters long, are split on the first space. If it
+// returns true, the command is handled and the hook must have replied with
+// Conn.WriteResponse, for instance to implement a diagnostics command.
+// Otherwise, the server replies as usual.
+type CommandHook func(c *Conn, cmd, arg string) (handled bool)
+
+// CapabilityHook is called for each EHLO and LHLO command with the
+// capabilities about to be advertised, and returns the capabilities to
+// advertise instead. It is evaluated again for each greeting, so the result
+// can depend on the session, for instance after AUTH.
+type CapabilityHook func(c *Conn, caps []string) []string
+
+// VrfyMode defines how a server replies to VRFY commands.
+type VrfyMode int
+
+const (
+	// VrfyCannotVerify replies with 252 to all VRFY commands, without
+	// disclosing whether addresses exist.
+	VrfyCannotVerify VrfyMode = iota
+	// VrfyBackend asks the backend to verify addresses, if it implements
+	// Verifier. Otherwise, VRFY is replied with 252.
+	VrfyBackend
+	// VrfyDisabled rejects VRFY commands with 502.
+	VrfyDisabled
+)
+
 // Logger interface is used by Server to report unexpected internal errors.
 type Logger interface {
 	Printf(format string, v ...interface{})
@@ -44,9 +83,112 @@ type Server struct {
 	ReadTimeout       time.Duration
 	WriteTimeout      time.Duration
 
+	// If not nil, recipient addresses are normalized before being passed to
+	// the session. Sessions implementing NormalizedRcptSession receive the
+	// original address too.
+	RcptNormalization *AddressNormalization
+
+	// VrfyMode defines how VRFY commands are replied. Servers exposed to the
+	// internet usually don't verify addresses, to prevent address harvesting.
+	VrfyMode VrfyMode
+
+	// If set, the SMTPUTF8 extension defined in RFC 6531 is advertised. Once
+	// a client requests it for a transaction, replies may contain UTF-8.
+	// Otherwise, non-ASCII characters in replies are escaped.
+	EnableSMTPUTF8 bool
+
+	// If set, clients sending commands ahead of replies when PIPELINING
+	// doesn't allow it are rejected with 554 5.5.0 and disconnected, like
+	// Postfix's reject_unauth_pipelining. This includes message data sent
+	// before the 354 reply to DATA, and any command pipelined before EHLO
+	// or after HELO. Spam bots often don't wait for replies.
+	RejectUnauthPipelining bool
+
+	// If set, HELO is rejected with 502 and clients must use EHLO. All
+	// submission clients support ESMTP, HELO is mostly used by spam bots.
+	RequireESMTP bool
+
+	// If set, MAIL commands with a parameter the server doesn't support are
+	// rejected with 555 5.5.4, as RFC 5321 section 4.1.1.11 requires, so
+	// that clients don't believe an extension such as DSN was honored. By
+	// default, such parameters are ignored.
+	RejectUnknownParams bool
+
+	// If set, replies don't include enhanced status codes and the
+	// ENHANCEDSTATUSCODES extension isn't advertised, for legacy clients
+	// which fail to parse them.
+	DisableEnhancedCodes bool
+
 	// If set, the AUTH command will not be advertised and authentication
 	// attempts will be rejected. This setting overrides AllowInsecureAuth.
 	AuthDisabled bool
+	// AuthPolicies restricts authentication mechanisms to some connections,
+	// by mechanism name. Mechanisms without a policy are offered over TLS, or
+	// to all connections if AllowInsecureAuth is set.
+	AuthPolicies map[string]AuthPolicy
+
+	// Commands listed in DisabledCommands are rejected as not implemented,
+	// and the matching capabilities are not advertised. If AllowedCommands is
+	// not nil, commands missing from it are rejected too. QUIT is always
+	// allowed. Commands are case-insensitive.
+	DisabledCommands []string
+	AllowedCommands  []string
+
+	// MaxConnections limits the number of connections handled concurrently.
+	// When the limit is reached, up to MaxConnections new connections wait
+	// up to ConnectionWaitTimeout for another connection to finish, then are
+	// rejected with a 421 reply. Other connections are rejected immediately.
+	// Zero means no limit.
+	MaxConnections        int
+	ConnectionWaitTimeout time.Duration
+	// If not nil, LoadHook is called before serving each connection, to
+	// reject it or delay its greeting depending on the load.
+	LoadHook LoadHook
+
+	// If MaxRcptFailures is set, connections are closed with a 421 reply when
+	// more than MaxRcptFailures RCPT commands are permanently rejected within
+	// RcptFailureWindow, or within the whole connection if it is zero. Many
+	// rejected recipients are usually a sign of address harvesting.
+	MaxRcptFailures   int
+	RcptFailureWindow time.Duration
+
+	// The sizes of the buffers used to read from and write to connections. If
+	// zero, 4096 bytes are used. Larger buffers reduce the number of system
+	// calls when receiving large messages.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// If DataBufferSize is set, message data is read from the client ahead of
+	// the backend and buffered up to this many bytes. When the buffer stays
+	// full for longer than DataStallTimeout, DataStallPolicy is applied.
+	// Statistics are available with DataFlowStats.
+	DataBufferSize   int
+	DataStallTimeout time.Duration
+	DataStallPolicy  DataStallPolicy
+
+	// If set, message data lines longer than MaxLineLength bytes, excluding
+	// CRLF, are rejected with ErrDataLineTooLong. RFC 5321 section 4.5.3.1.6
+	// limits lines to 998 bytes. Zero means no limit.
+	MaxLineLength int
+
+	// If set, message data lines ending with a bare LF instead of CRLF are
+	// rejected with ErrDataBareLF and the connection is closed. This prevents
+	// SMTP smuggling, where a message is hidden after a "\n.\n" sequence that
+	// other servers don't consider as the end of the data. By default, bare LF
+	// ends lines like CRLF.
+	RejectBareLF bool
+
+	// If ProfilingLabels is set, goroutines handling connections are tagged
+	// with pprof labels: the remote IP address, the backend type and the
+	// command being handled. See LabelRemote, LabelBackend and LabelCommand.
+	ProfilingLabels bool
+	// If not nil, StageHook is called around the handling of each command.
+	StageHook StageHook
+	// If not nil, CommandHook is called for NOOP and unrecognized commands.
+	CommandHook CommandHook
+	// If not nil, CapabilityHook is called to change the capabilities
+	// advertised in reply to EHLO and LHLO.
+	CapabilityHook CapabilityHook
 
 	// The server backend.
 	Backend Backend
@@ -57,11 +199,20 @@ type Server struct {
 
 	locker sync.Mutex
 	conns  map[*Conn]struct{}
+
+	connSlotsOnce sync.Once
+	connSlots     chan struct{}
+	connWaiters   chan struct{}
+	rejecters     chan struct{}
+
+	dataFlow dataFlowCounters
+	counters statsCounters
 }
 
-// New creates a new SMTP server.
-func NewServer(be Backend) *Server {
-	return &Server{
+// NewServer creates a new SMTP server. Options are applied in order, after
+// the defaults are set.
+func NewServer(be Backend, opts ...ServerOption) *Server {
+	s := &Server{
 		Backend:  be,
 		ErrorLog: log.New(os.Stderr, "smtp/server ", log.LstdFlags),
 		caps:     []string{"PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES"},
@@ -85,6 +236,10 @@ func NewServer(be Backend) *Server {
 		},
 		conns: make(map[*Conn]struct{}),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 // Serve accepts incoming connections on the Listener l.
@@ -98,14 +253,111 @@ func (s *Server) Serve(l net.Listener) error {
 			return err
 		}
 
-		go s.handleConn(newConn(c, s))
+		// Waiting for a slot happens in the connection goroutine, so that
+		// it doesn't block the accept loop
+		go s.serveConn(c)
+	}
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	if !s.acquireConnSlot() {
+		s.reject(c)
+		return
+	}
+	defer s.releaseConnSlot()
+
+	var delay time.Duration
+	if s.LoadHook != nil {
+		var accept bool
+		if accept, delay = s.LoadHook(s.load(c.RemoteAddr())); !accept {
+			s.reject(c)
+			return
+		}
 	}
+	conn := newConn(c, s)
+	conn.greetingDelay = delay
+	s.handleConn(conn)
+}
+
+func (s *Server) initConnSlots() {
+	s.connSlotsOnce.Do(func() {
+		if s.MaxConnections > 0 {
+			s.connSlots = make(chan struct{}, s.MaxConnections)
+			s.connWaiters = make(chan struct{}, s.MaxConnections)
+		}
+		s.rejecters = make(chan struct{}, maxRejecters)
+	})
+}
+
+// acquireConnSlot reserves a slot for a new connection, waiting up to
+// ConnectionWaitTimeout if MaxConnections is reached.
+func (s *Server) acquireConnSlot() bool {
+	if s.MaxConnections <= 0 {
+		return true
+	}
+	s.initConnSlots()
+
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	default:
+	}
+	if s.ConnectionWaitTimeout <= 0 {
+		return false
+	}
+
+	// Bound the number of waiting connections
+	select {
+	case s.connWaiters <- struct{}{}:
+		defer func() { <-s.connWaiters }()
+	default:
+		return false
+	}
+
+	timer := time.NewTimer(s.ConnectionWaitTimeout)
+	defer timer.Stop()
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (s *Server) releaseConnSlot() {
+	if s.connSlots != nil {
+		<-s.connSlots
+	}
+}
+
+// reject rejects a connection because too many connections are opened.
+func (s *Server) reject(c net.Conn) {
+	s.counters.update(func(stats *Stats) {
+		stats.RejectedConnections++
+	})
+
+	s.initConnSlots()
+	select {
+	case s.rejecters <- struct{}{}:
+		defer func() { <-s.rejecters }()
+	default:
+		c.Close()
+		return
+	}
+
+	c.SetWriteDeadline(time.Now().Add(rejectTimeout))
+	conn := newConn(c, s)
+	conn.Reject()
+	conn.releaseBuffers()
 }
 
 func (s *Server) handleConn(c *Conn) error {
 	s.locker.Lock()
 	s.conns[c] = struct{}{}
 	s.locker.Unlock()
+	s.counters.update(func(stats *Stats) {
+		stats.Connections++
+	})
 
 	defer func() {
 		c.Close()
@@ -113,21 +365,39 @@ func (s *Server) handleConn(c *Conn) error {
 		s.locker.Lock()
 		delete(s.conns, c)
 		s.locker.Unlock()
+
+		c.releaseBuffers()
 	}()
 
+	if s.ProfilingLabels {
+		c.profileCtx = pprof.WithLabels(context.Background(), s.profileLabels(c))
+		pprof.SetGoroutineLabels(c.profileCtx)
+		defer pprof.SetGoroutineLabels(context.Background())
+	}
+
+	if c.greetingDelay > 0 {
+		time.Sleep(c.greetingDelay)
+	}
 	c.greet()
 
 	for {
 		line, err := c.ReadLine()
 		if err == nil {
 			cmd, arg, err := parseCmd(line)
+			if err != nil && s.CommandHook != nil {
+				// Commands which aren't 4 letters long are unrecognized too
+				cmd, arg = splitCmd(line)
+				if s.CommandHook(c, cmd, arg) {
+					continue
+				}
+			}
 			if err != nil {
 				c.nbrErrors++
 				c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Bad command")
 				continue
 			}
 
-			c.handle(cmd, arg)
+			c.handleStage(cmd, arg)
 		} else {
 			if err == io.EOF {
 				return nil
@@ -201,6 +471,38 @@ func (s *Server) Close() {
 	}
 }
 
+// commandEnabled reports whether a command is allowed by DisabledCommands
+// and AllowedCommands.
+func (s *Server) commandEnabled(cmd string) bool {
+	if cmd == "QUIT" {
+		return true
+	}
+	for _, disabled := range s.DisabledCommands {
+		if strings.EqualFold(cmd, disabled) {
+			return false
+		}
+	}
+	if s.AllowedCommands == nil {
+		return true
+	}
+	for _, allowed := range s.AllowedCommands {
+		if strings.EqualFold(cmd, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthPolicy restricts an authentication mechanism to some connections.
+type AuthPolicy struct {
+	// If set, the mechanism is offered on connections without TLS. Otherwise
+	// it requires TLS, regardless of Server.AllowInsecureAuth.
+	AllowInsecure bool
+	// If not empty, the mechanism is only offered to clients connecting from
+	// these networks.
+	Networks []*net.IPNet
+}
+
 // EnableAuth enables an authentication mechanism on this server.
 //
 // This function should not be called directly, it must only be used by
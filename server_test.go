@@ -2,14 +2,21 @@ package smtp_test
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"reflect"
+	"runtime/pprof"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 )
 
@@ -17,6 +24,14 @@ type message struct {
 	From string
 	To   []string
 	Data []byte
+
+	// Original recipient addresses, if normalized
+	OriginalTo []string
+	// The transaction maintained by the server
+	Tx *smtp.Transaction
+	// The size of the message data, before and after decoding
+	WireBytes    int64
+	DecodedBytes int64
 }
 
 type backend struct {
@@ -25,6 +40,27 @@ type backend struct {
 
 	panicOnMail bool
 	userErr     error
+	// If set, sessions wait before reading message data
+	dataDelay time.Duration
+	// If not nil, sessions implement LMTPSession and report these statuses
+	lmtpStatus map[string]error
+	// Errors returned by Rcpt, by recipient
+	rcptErr map[string]error
+	// The limit returned by RcptLimit
+	rcptLimit int
+	// If not nil, sessions report aborted transactions
+	aborts chan smtp.AbortReason
+	// The error returned by TryReset
+	resetErr error
+	// If not nil, sessions report their summary
+	summaries chan smtp.SessionSummary
+	// If not nil, sessions report when they are logged out
+	logouts chan struct{}
+	// Errors returned by CheckHello, by hostname, and the greetings checked
+	helloErr map[string]error
+	hellos   []string
+	// If set, authenticated sessions implement SizeLimiter with this limit
+	userMaxBytes int
 }
 
 func (be *backend) Login(_ *smtp.ConnectionState, username, password string) (smtp.Session, error) {
@@ -35,14 +71,36 @@ func (be *backend) Login(_ *smtp.ConnectionState, username, password string) (sm
 	if username != "username" || password != "password" {
 		return nil, errors.New("Invalid username or password")
 	}
+	if be.userMaxBytes != 0 {
+		return &sizeLimitedSession{&session{backend: be}}, nil
+	}
 	return &session{backend: be}, nil
 }
 
+func (be *backend) Verify(_ *smtp.ConnectionState, addr string) error {
+	return be.rcptErr[addr]
+}
+
+func (be *backend) CheckHello(_ *smtp.ConnectionState, hostname string, esmtp bool) error {
+	if be.helloErr == nil {
+		return nil
+	}
+	cmd := "HELO"
+	if esmtp {
+		cmd = "EHLO"
+	}
+	be.hellos = append(be.hellos, cmd+" "+hostname)
+	return be.helloErr[hostname]
+}
+
 func (be *backend) AnonymousLogin(_ *smtp.ConnectionState) (smtp.Session, error) {
 	if be.userErr != nil {
 		return &session{}, be.userErr
 	}
 
+	if be.lmtpStatus != nil {
+		return &lmtpSession{&session{backend: be, anonymous: true}}, nil
+	}
 	return &session{backend: be, anonymous: true}, nil
 }
 
@@ -51,16 +109,33 @@ type session struct {
 	anonymous bool
 
 	msg *message
+	tx  *smtp.Transaction
 }
 
 func (s *session) Reset() {
 	s.msg = &message{}
 }
 
+func (s *session) TryReset() error {
+	s.Reset()
+	return s.backend.resetErr
+}
+
 func (s *session) Logout() error {
+	if s.backend != nil && s.backend.logouts != nil {
+		// Sessions may be logged out more than once
+		select {
+		case s.backend.logouts <- struct{}{}:
+		default:
+		}
+	}
 	return nil
 }
 
+func (s *session) BeginTransaction(tx *smtp.Transaction) {
+	s.tx = tx
+}
+
 func (s *session) Mail(from string) error {
 	if s.backend.panicOnMail {
 		panic("Everything is on fire!")
@@ -71,15 +146,53 @@ func (s *session) Mail(from string) error {
 }
 
 func (s *session) Rcpt(to string) error {
+	if err := s.backend.rcptErr[to]; err != nil {
+		return err
+	}
 	s.msg.To = append(s.msg.To, to)
 	return nil
 }
 
+func (s *session) RcptNormalized(to, original string) error {
+	if err := s.Rcpt(to); err != nil {
+		return err
+	}
+	s.msg.OriginalTo = append(s.msg.OriginalTo, original)
+	return nil
+}
+
+func (s *session) RcptPostmaster(to string) error {
+	s.msg.To = append(s.msg.To, "postmaster@localhost")
+	return nil
+}
+
+func (s *session) RcptLimit() int {
+	return s.backend.rcptLimit
+}
+
+func (s *session) Abort(reason smtp.AbortReason) {
+	if s.backend.aborts != nil {
+		s.backend.aborts <- reason
+	}
+}
+
+func (s *session) Finalize(summary smtp.SessionSummary) {
+	if s.backend.summaries != nil {
+		s.backend.summaries <- summary
+	}
+}
+
 func (s *session) Data(r io.Reader) error {
+	time.Sleep(s.backend.dataDelay)
 	if b, err := ioutil.ReadAll(r); err != nil {
 		return err
 	} else {
 		s.msg.Data = b
+		s.msg.Tx = s.tx
+		if dc, ok := r.(smtp.DataCounter); ok {
+			s.msg.WireBytes = dc.WireBytes()
+			s.msg.DecodedBytes = dc.DecodedBytes()
+		}
 		if s.anonymous {
 			s.backend.anonmsgs = append(s.backend.anonmsgs, s.msg)
 		} else {
@@ -89,6 +202,32 @@ func (s *session) Data(r io.Reader) error {
 	return nil
 }
 
+type sizeLimitedSession struct {
+	*session
+}
+
+func (s *sizeLimitedSession) MaxMessageBytes() int {
+	return s.backend.userMaxBytes
+}
+
+type lmtpSession struct {
+	*session
+}
+
+func (s *lmtpSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	if err := s.Data(r); err != nil {
+		return err
+	}
+	// Report statuses in reverse order, the server must reorder them
+	for i := len(s.msg.To) - 1; i >= 0; i-- {
+		rcpt := s.msg.To[i]
+		if err, ok := s.backend.lmtpStatus[rcpt]; ok {
+			status.SetStatus(rcpt, err)
+		}
+	}
+	return nil
+}
+
 type serverConfigureFunc func(*smtp.Server)
 
 var (
@@ -181,8 +320,8 @@ func TestServer_helo(t *testing.T) {
 	}
 }
 
-func testServerAuthenticated(t *testing.T) (be *backend, s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
-	be, s, c, scanner, caps := testServerEhlo(t)
+func testServerAuthenticated(t *testing.T, fn ...serverConfigureFunc) (be *backend, s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
+	be, s, c, scanner, caps := testServerEhlo(t, fn...)
 
 	if _, ok := caps["AUTH PLAIN"]; !ok {
 		t.Fatal("AUTH PLAIN capability is missing when auth is enabled")
@@ -250,7 +389,9 @@ func TestServerPanicRecover(t *testing.T) {
 }
 
 func TestServerBadESMTPVar(t *testing.T) {
-	_, s, c, scanner := testServerAuthenticated(t)
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.RejectUnknownParams = true
+	})
 	defer s.Close()
 	defer c.Close()
 
@@ -263,6 +404,63 @@ func TestServerBadESMTPVar(t *testing.T) {
 	return
 }
 
+func TestServerUnknownESMTPVar(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	// Unknown parameters are ignored by default
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> RET=HDRS ENVID=QQ314159\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServerParams(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> BODY=8BITMIME\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> BODY=7BIT body=8BITMIME\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 ") {
+		t.Fatal("Invalid MAIL response with duplicate parameter:", scanner.Text())
+	}
+
+	// Unknown body types and RCPT parameters are ignored
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> BODY=BINARYMIME\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response with unknown body type:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<bob@wonderland.book> NOTIFY=NEVER\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	if len(be.messages) != 1 || len(be.messages[0].To) != 1 || be.messages[0].To[0] != "bob@wonderland.book" {
+		t.Fatal("Invalid recipients:", be.messages)
+	}
+}
+
 func TestServerBadSize(t *testing.T) {
 	_, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -373,20 +571,117 @@ func TestServer_authDisabled(t *testing.T) {
 	}
 }
 
-func TestServer_otherCommands(t *testing.T) {
-	_, s, c, scanner := testServerAuthenticated(t)
+func TestServer_authPolicies(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("10.0.0.0/8")
+	noAuth := func(c *smtp.Conn) sasl.Server {
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			return errors.New("Invalid credentials")
+		})
+	}
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.EnableAuth("LAN", noAuth)
+		s.EnableAuth("REMOTE", noAuth)
+		s.AuthPolicies = map[string]smtp.AuthPolicy{
+			sasl.Plain: {},
+			"LAN":      {AllowInsecure: true, Networks: []*net.IPNet{lan}},
+			"REMOTE":   {AllowInsecure: true, Networks: []*net.IPNet{other}},
+		}
+	})
 	defer s.Close()
+	defer c.Close()
 
-	io.WriteString(c, "HELP\r\n")
-	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "502 ") {
-		t.Fatal("Invalid HELP response:", scanner.Text())
+	if !caps["AUTH LAN"] {
+		t.Fatal("Expected only the LAN mechanism to be advertised, got:", caps)
 	}
 
-	io.WriteString(c, "VRFY\r\n")
+	io.WriteString(c, "AUTH PLAIN\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "252 ") {
-		t.Fatal("Invalid VRFY response:", scanner.Text())
+	if !strings.HasPrefix(scanner.Text(), "538 5.7.11 ") {
+		t.Fatal("Invalid AUTH response without TLS:", scanner.Text())
+	}
+	io.WriteString(c, "AUTH REMOTE\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "504 5.7.4 ") {
+		t.Fatal("Invalid AUTH response from another network:", scanner.Text())
+	}
+	io.WriteString(c, "AUTH LAN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "454 ") {
+		t.Fatal("Invalid AUTH response for an allowed mechanism:", scanner.Text())
+	}
+}
+
+func TestNewServer_options(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	s := smtp.NewServer(new(backend),
+		smtp.WithAddr("127.0.0.1:0"),
+		smtp.WithDomain("example.org"),
+		smtp.WithMaxSize(1024),
+		smtp.WithMaxRecipients(10),
+		smtp.WithTimeouts(time.Second, 2*time.Second),
+		smtp.WithLogger(logger),
+		smtp.WithInsecureAuth(),
+		smtp.WithEnhancedCodesDisabled(),
+		smtp.WithSMTPUTF8(),
+		smtp.WithVrfyMode(smtp.VrfyDisabled),
+		smtp.WithRcptFailureLimit(20, time.Minute),
+		smtp.WithRcptNormalization(smtp.AddressNormalization{LowerDomain: true}),
+	)
+
+	if s.Addr != "127.0.0.1:0" || s.Domain != "example.org" {
+		t.Errorf("unexpected address or domain: %q, %q", s.Addr, s.Domain)
+	}
+	if s.MaxMessageBytes != 1024 || s.MaxRecipients != 10 {
+		t.Errorf("unexpected limits: %v, %v", s.MaxMessageBytes, s.MaxRecipients)
+	}
+	if s.ReadTimeout != time.Second || s.WriteTimeout != 2*time.Second {
+		t.Errorf("unexpected timeouts: %v, %v", s.ReadTimeout, s.WriteTimeout)
+	}
+	if s.ErrorLog != logger || !s.AllowInsecureAuth {
+		t.Error("logger or insecure auth option not applied")
+	}
+	if !s.DisableEnhancedCodes || !s.EnableSMTPUTF8 || s.VrfyMode != smtp.VrfyDisabled {
+		t.Error("enhanced codes, SMTPUTF8 or VRFY option not applied")
+	}
+	if s.MaxRcptFailures != 20 || s.RcptFailureWindow != time.Minute {
+		t.Errorf("unexpected recipient failure limit: %v, %v", s.MaxRcptFailures, s.RcptFailureWindow)
+	}
+	if s.RcptNormalization == nil || !s.RcptNormalization.LowerDomain {
+		t.Error("recipient normalization option not applied")
+	}
+}
+
+func TestNewServer_authMechanism(t *testing.T) {
+	opt := smtp.WithAuthMechanism("XTEST", func(conn *smtp.Conn) sasl.Server {
+		return nil
+	})
+	_, s, c, _, caps := testServerEhlo(t, serverConfigureFunc(opt))
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["AUTH PLAIN XTEST"] && !caps["AUTH XTEST PLAIN"] {
+		t.Errorf("XTEST mechanism not advertised: %v", caps)
+	}
+}
+
+func TestServer_disabledCommands(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.DisabledCommands = []string{"vrfy", "AUTH"}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if _, ok := caps["AUTH PLAIN"]; ok {
+		t.Fatal("AUTH PLAIN capability is present when AUTH is disabled")
+	}
+
+	for _, cmd := range []string{"VRFY root", "AUTH PLAIN"} {
+		io.WriteString(c, cmd+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "502 5.5.1 ") {
+			t.Fatalf("Invalid response to %v: %v", cmd, scanner.Text())
+		}
 	}
 
 	io.WriteString(c, "NOOP\r\n")
@@ -394,11 +689,19 @@ func TestServer_otherCommands(t *testing.T) {
 	if !strings.HasPrefix(scanner.Text(), "250 ") {
 		t.Fatal("Invalid NOOP response:", scanner.Text())
 	}
+}
 
-	io.WriteString(c, "RSET\r\n")
+func TestServer_allowedCommands(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.AllowedCommands = []string{"EHLO", "MAIL", "RCPT", "DATA", "RSET"}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "NOOP\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid RSET response:", scanner.Text())
+	if !strings.HasPrefix(scanner.Text(), "502 5.5.1 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
 	}
 
 	io.WriteString(c, "QUIT\r\n")
@@ -408,217 +711,1612 @@ func TestServer_otherCommands(t *testing.T) {
 	}
 }
 
-func TestServer_tooManyInvalidCommands(t *testing.T) {
-	_, s, c, scanner := testServerAuthenticated(t)
+func TestServer_maxConnections(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.MaxConnections = 1
+		s.ConnectionWaitTimeout = 50 * time.Millisecond
+	})
 	defer s.Close()
 
-	// Let's assume XXXX is a non-existing command
-	for i := 0; i < 4; i++ {
-		io.WriteString(c, "XXXX\r\n")
-		scanner.Scan()
-		if !strings.HasPrefix(scanner.Text(), "500 ") {
-			t.Fatal("Invalid invalid command response:", scanner.Text())
-		}
+	c2, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+	scanner2.Scan()
+	if !strings.HasPrefix(scanner2.Text(), "421 ") {
+		t.Fatal("Invalid response when too many connections are opened:", scanner2.Text())
 	}
 
+	io.WriteString(c, "QUIT\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "500 ") {
-		t.Fatal("Invalid invalid command response:", scanner.Text())
+	c.Close()
+
+	// The slot is released once the first connection is closed
+	c3, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+	scanner3 := bufio.NewScanner(c3)
+	scanner3.Scan()
+	if scanner3.Text() != "220 localhost ESMTP Service Ready" {
+		t.Fatal("Invalid greeting:", scanner3.Text())
 	}
 }
 
-func TestServer_tooLongMessage(t *testing.T) {
-	be, s, c, scanner := testServerAuthenticated(t)
+func TestServer_maxConnectionsWaiters(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.MaxConnections = 1
+		s.ConnectionWaitTimeout = time.Minute
+	})
 	defer s.Close()
 
-	s.MaxMessageBytes = 50
-
-	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
-	scanner.Scan()
-	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
-	scanner.Scan()
-	io.WriteString(c, "DATA\r\n")
-	scanner.Scan()
+	// The second connection waits for a slot
+	c2, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+
+	// The accept loop isn't blocked by the waiting connection, and the
+	// third connection is rejected right away since as many connections
+	// are waiting as MaxConnections
+	time.Sleep(50 * time.Millisecond)
+	c3, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+	c3.SetReadDeadline(time.Now().Add(5 * time.Second))
+	scanner3 := bufio.NewScanner(c3)
+	scanner3.Scan()
+	if !strings.HasPrefix(scanner3.Text(), "421 ") {
+		t.Fatal("Invalid response when too many connections are waiting:", scanner3.Text())
+	}
 
-	io.WriteString(c, "This is a very long message.\r\n")
-	io.WriteString(c, "Much longer than you can possibly imagine.\r\n")
-	io.WriteString(c, "And much longer than the server's MaxMessageBytes.\r\n")
-	io.WriteString(c, ".\r\n")
+	io.WriteString(c, "QUIT\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "552 ") {
-		t.Fatal("Invalid DATA response, expected an error but got:", scanner.Text())
-	}
+	c.Close()
 
-	if len(be.messages) != 0 || len(be.anonmsgs) != 0 {
-		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	scanner2.Scan()
+	if scanner2.Text() != "220 localhost ESMTP Service Ready" {
+		t.Fatal("Invalid greeting:", scanner2.Text())
 	}
 }
 
-func TestServer_anonymousUserError(t *testing.T) {
-	be, s, c, scanner, _ := testServerEhlo(t)
+func TestServer_loadHook(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		loads []*smtp.Load
+	)
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.LoadHook = func(load *smtp.Load) (bool, time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			loads = append(loads, load)
+			switch len(loads) {
+			case 1:
+				return true, 0
+			case 2:
+				return false, 0
+			default:
+				return true, 100 * time.Millisecond
+			}
+		}
+	})
 	defer s.Close()
-	defer c.Close()
 
-	be.userErr = smtp.ErrAuthRequired
+	mu.Lock()
+	load := loads[0]
+	mu.Unlock()
+	if load.RemoteAddr == nil || load.ActiveConnections != 0 || load.Goroutines == 0 || load.HeapBytes == 0 || load.TotalMemory == 0 {
+		t.Errorf("Invalid load for the first connection: %+v", load)
+	}
 
-	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
-	scanner.Scan()
-	if scanner.Text() != "502 5.7.0 Please authenticate first" {
-		t.Fatal("Backend refused anonymous mail but client was permitted:", scanner.Text())
+	c2, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+	scanner2.Scan()
+	if !strings.HasPrefix(scanner2.Text(), "421 ") {
+		t.Fatal("Invalid response when the connection is shed:", scanner2.Text())
+	}
+
+	start := time.Now()
+	c3, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+	scanner3 := bufio.NewScanner(c3)
+	scanner3.Scan()
+	if scanner3.Text() != "220 localhost ESMTP Service Ready" {
+		t.Fatal("Invalid greeting:", scanner3.Text())
 	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("Greeting sent after %v, want a delay of at least 100ms", d)
+	}
+
+	mu.Lock()
+	load = loads[2]
+	mu.Unlock()
+	if load.ActiveConnections != 1 {
+		t.Errorf("ActiveConnections = %v, want 1", load.ActiveConnections)
+	}
+	if stats := s.Stats(); stats.RejectedConnections != 1 {
+		t.Errorf("RejectedConnections = %v, want 1", stats.RejectedConnections)
+	}
+
+	io.WriteString(c, "QUIT\r\n")
+	scanner.Scan()
 }
 
-func TestServer_anonymousUserOK(t *testing.T) {
-	be, s, c, scanner, _ := testServerEhlo(t)
+func TestServer_bufferSizes(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.ReadBufferSize = 16
+		s.WriteBufferSize = 16
+	})
 	defer s.Close()
-	defer c.Close()
 
-	io.WriteString(c, "MAIL FROM: root@nsa.gov\r\n")
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
 	scanner.Scan()
 	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
 	scanner.Scan()
 	io.WriteString(c, "DATA\r\n")
 	scanner.Scan()
-	io.WriteString(c, "Hey <3\r\n")
-	io.WriteString(c, ".\r\n")
+	if scanner.Text() != "354 2.0.0 Go ahead. End your data with <CR><LF>.<CR><LF>" {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	line := strings.Repeat("A", 1000)
+	io.WriteString(c, line+"\r\n.\r\n")
 	scanner.Scan()
-
 	if !strings.HasPrefix(scanner.Text(), "250 ") {
 		t.Fatal("Invalid DATA response:", scanner.Text())
 	}
 
-	if len(be.messages) != 0 || len(be.anonmsgs) != 1 {
-		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	if len(be.messages) != 1 || string(be.messages[0].Data) != line+"\n" {
+		t.Fatal("Invalid message:", be.messages)
 	}
 }
 
-func testStrictServer(t *testing.T) (s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
-	l, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatal(err)
-	}
+func testServerDataFlow(t *testing.T, fn serverConfigureFunc) (be *backend, s *smtp.Server, reply string) {
+	be, s, c, scanner := testServerAuthenticated(t, fn)
+	be.dataDelay = 100 * time.Millisecond
 
-	s = smtp.NewServer(new(backend))
-	s.Domain = "localhost"
-	s.AllowInsecureAuth = true
-	s.AuthDisabled = true
-	s.Strict = true
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	io.WriteString(c, strings.Repeat("Hey <3\r\n", 100)+".\r\n")
+	scanner.Scan()
+	reply = scanner.Text()
+
+	// The connection is still usable
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+	return be, s, reply
+}
+
+func TestServer_dataBuffer(t *testing.T) {
+	be, s, reply := testServerDataFlow(t, func(s *smtp.Server) {
+		s.DataBufferSize = 64
+	})
+	defer s.Close()
+
+	if !strings.HasPrefix(reply, "250 ") {
+		t.Fatal("Invalid DATA response:", reply)
+	}
+	if len(be.messages) != 1 || string(be.messages[0].Data) != strings.Repeat("Hey <3\n", 100) {
+		t.Fatal("Invalid messages:", be.messages)
+	}
+
+	stats := s.DataFlowStats()
+	if stats.Stalls == 0 || stats.StallTime == 0 {
+		t.Error("Expected stalls, got", stats)
+	}
+	if stats.MaxBuffered != 64 {
+		t.Error("Expected a full buffer, got", stats)
+	}
+	if stats.Aborts != 0 {
+		t.Error("Expected no aborts, got", stats)
+	}
+}
+
+func TestServer_dataStallAbort(t *testing.T) {
+	be, s, reply := testServerDataFlow(t, func(s *smtp.Server) {
+		s.DataBufferSize = 64
+		s.DataStallTimeout = 20 * time.Millisecond
+		s.DataStallPolicy = smtp.DataStallAbort
+	})
+	defer s.Close()
+
+	if !strings.HasPrefix(reply, "451 4.3.0 ") {
+		t.Fatal("Invalid DATA response:", reply)
+	}
+	if len(be.messages) != 0 {
+		t.Fatal("Invalid messages:", be.messages)
+	}
+	if stats := s.DataFlowStats(); stats.Aborts != 1 {
+		t.Error("Expected an abort, got", stats)
+	}
+}
+
+func TestServer_profiling(t *testing.T) {
+	var mu sync.Mutex
+	var stages []string
+	var profile string
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.ProfilingLabels = true
+		s.StageHook = func(c *smtp.Conn, stage string) func() {
+			mu.Lock()
+			defer mu.Unlock()
+			stages = append(stages, stage)
+			if stage == "NOOP" {
+				var sb strings.Builder
+				pprof.Lookup("goroutine").WriteTo(&sb, 1)
+				profile = sb.String()
+			}
+			return func() {
+				mu.Lock()
+				stages = append(stages, stage+" done")
+				mu.Unlock()
+			}
+		}
+	})
+	defer s.Close()
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "250 ") {
+	}
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	io.WriteString(c, "QUIT\r\n")
+	scanner.Scan()
+
+	mu.Lock()
+	defer mu.Unlock()
+	// "QUIT done" may not have been recorded yet
+	expected := []string{"EHLO", "EHLO done", "NOOP", "NOOP done", "QUIT"}
+	if len(stages) < len(expected) || strings.Join(stages[:len(expected)], ",") != strings.Join(expected, ",") {
+		t.Fatalf("Invalid stages: got %v, want %v", stages, expected)
+	}
+
+	for _, label := range []string{
+		`"smtp.remote":"127.0.0.1"`,
+		`"smtp.backend":"*smtp_test.backend"`,
+		`"smtp.command":"NOOP"`,
+	} {
+		if !strings.Contains(profile, label) {
+			t.Errorf("Missing label %v in goroutine profile", label)
+		}
+	}
+}
+
+func TestServer_otherCommands(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+
+	io.WriteString(c, "HELP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Fatal("Invalid HELP response:", scanner.Text())
+	}
+
+	io.WriteString(c, "VRFY\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "252 ") {
+		t.Fatal("Invalid VRFY response:", scanner.Text())
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RSET response:", scanner.Text())
+	}
+
+	io.WriteString(c, "QUIT\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "221 ") {
+		t.Fatal("Invalid QUIT response:", scanner.Text())
+	}
+}
+
+func TestServer_tooManyInvalidCommands(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+
+	// Let's assume XXXX is a non-existing command
+	for i := 0; i < 4; i++ {
+		io.WriteString(c, "XXXX\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "500 ") {
+			t.Fatal("Invalid invalid command response:", scanner.Text())
+		}
+	}
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid invalid command response:", scanner.Text())
+	}
+}
+
+func TestServer_tooLongMessage(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+
+	s.MaxMessageBytes = 50
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "This is a very long message.\r\n")
+	io.WriteString(c, "Much longer than you can possibly imagine.\r\n")
+	io.WriteString(c, "And much longer than the server's MaxMessageBytes.\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "552 ") {
+		t.Fatal("Invalid DATA response, expected an error but got:", scanner.Text())
+	}
+
+	// The rest of the message isn't parsed as commands
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+
+	if len(be.messages) != 0 || len(be.anonmsgs) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+}
+
+func TestServer_dataCounters(t *testing.T) {
+	for _, bufferSize := range []int{0, 64} {
+		be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+			s.DataBufferSize = bufferSize
+		})
+
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "DATA\r\n")
+		scanner.Scan()
+		io.WriteString(c, "Hey <3\r\n..\r\n.dot\r\n.\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid DATA response:", scanner.Text())
+		}
+
+		if len(be.messages) != 1 {
+			t.Fatal("Invalid number of sent messages:", be.messages)
+		}
+		msg := be.messages[0]
+		if string(msg.Data) != "Hey <3\n.\ndot\n" {
+			t.Errorf("Invalid message data: %q", msg.Data)
+		}
+		if msg.WireBytes != 18 || msg.DecodedBytes != 13 {
+			t.Errorf("Invalid data counters with a %v bytes buffer: got %v wire and %v decoded bytes, want 18 and 13", bufferSize, msg.WireBytes, msg.DecodedBytes)
+		}
+
+		s.Close()
+		c.Close()
+	}
+}
+
+func TestServer_dataLineTooLong(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.MaxLineLength = 10
+	})
+	defer s.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Short line\r\n")
+	io.WriteString(c, "This line is too long\r\n")
+	io.WriteString(c, "NOOP\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if scanner.Text() != "500 5.5.2 Line too long" {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	if len(be.messages) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+
+	// The rest of the message has been discarded
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RSET response:", scanner.Text())
+	}
+}
+
+func TestServer_dataBareLF(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey\n..\r\n<3\n.\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+	if msg := be.messages[0]; string(msg.Data) != "Hey\n.\n<3\n" {
+		t.Errorf("Invalid message data: %q", msg.Data)
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+}
+
+func TestServer_dataRejectBareLF(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.RejectBareLF = true
+	})
+	defer s.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n\n.\r\n")
+	io.WriteString(c, "MAIL FROM:<admin@nsa.gov>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "500 5.5.2 Bare LF received, lines must end with CRLF" {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	if len(be.messages) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+
+	// The smuggled command isn't handled
+	if scanner.Scan() {
+		t.Fatal("Expected the connection to be closed, got:", scanner.Text())
+	}
+}
+
+func TestServer_rcptQuota(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+
+	be.rcptErr = map[string]error{
+		"over@example.org": fmt.Errorf("%w, try again later", smtp.ErrOverQuota),
+		"full@example.org": smtp.ErrMailboxFull,
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<over@example.org>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "452 4.2.2 Mailbox over quota, try again later" {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<full@example.org>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "552 5.2.2 Mailbox full" {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+}
+
+func TestServer_rcptLimit(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+
+	be.rcptLimit = 2
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	for i := 0; i < 2; i++ {
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid RCPT response:", scanner.Text())
+		}
+	}
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "452 4.5.3 ") {
+		t.Fatal("Invalid RCPT response, expected a recipient limit error but got:", scanner.Text())
+	}
+}
+
+func TestServer_anonymousUserError(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	be.userErr = smtp.ErrAuthRequired
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "502 5.7.0 Please authenticate first" {
+		t.Fatal("Backend refused anonymous mail but client was permitted:", scanner.Text())
+	}
+}
+
+func TestServer_anonymousUserOK(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM: root@nsa.gov\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 0 || len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+}
+
+func testStrictServer(t *testing.T) (s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = smtp.NewServer(new(backend))
+	s.Domain = "localhost"
+	s.AllowInsecureAuth = true
+	s.AuthDisabled = true
+	s.Strict = true
 
 	go s.Serve(l)
 
-	c, err = net.Dial("tcp", l.Addr().String())
-	if err != nil {
-		t.Fatal(err)
+	c, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanner = bufio.NewScanner(c)
+
+	scanner.Scan()
+	if scanner.Text() != "220 localhost ESMTP Service Ready" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+
+	io.WriteString(c, "EHLO localhost\r\n")
+
+	scanner.Scan()
+	if scanner.Text() != "250-Hello localhost" {
+		t.Fatal("Invalid EHLO response:", scanner.Text())
+	}
+
+	expectedCaps := []string{"PIPELINING", "8BITMIME"}
+	caps := make(map[string]bool)
+
+	for scanner.Scan() {
+		s := scanner.Text()
+
+		if strings.HasPrefix(s, "250 ") {
+			caps[strings.TrimPrefix(s, "250 ")] = true
+			break
+		} else {
+			if !strings.HasPrefix(s, "250-") {
+				t.Fatal("Invalid capability response:", s)
+			}
+			caps[strings.TrimPrefix(s, "250-")] = true
+		}
+	}
+
+	for _, cap := range expectedCaps {
+		if !caps[cap] {
+			t.Fatal("Missing capability:", cap)
+		}
+	}
+
+	return
+}
+
+func TestStrictServerGood(t *testing.T) {
+	s, c, scanner := testStrictServer(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestStrictServerBad(t *testing.T) {
+	s, c, scanner := testStrictServer(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM: root@nsa.gov\r\n")
+	scanner.Scan()
+	if strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_lmtpOK(t *testing.T) {
+	be, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.LMTP = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "LHLO localhost\r\n")
+
+	scanner.Scan()
+	if scanner.Text() != "250-Hello localhost" {
+		t.Fatal("Invalid LHLO response:", scanner.Text())
+	}
+
+	for scanner.Scan() {
+		s := scanner.Text()
+
+		if strings.HasPrefix(s, "250 ") {
+			break
+		} else if !strings.HasPrefix(s, "250-") {
+			t.Fatal("Invalid capability response:", s)
+		}
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@bnd.bund.de>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA first response:", scanner.Text())
+	}
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA second response:", scanner.Text())
+	}
+
+	if len(be.messages) != 0 || len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+}
+
+func TestServer_lmtpStatus(t *testing.T) {
+	var txID string
+	be, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.LMTP = true
+		s.StageHook = func(c *smtp.Conn, stage string) func() {
+			if stage == "DATA" {
+				txID = c.Transaction().ID
+			}
+			return nil
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+	be.lmtpStatus = map[string]error{
+		"root@gchq.gov.uk": nil,
+		"root@bnd.bund.de": &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 2, 2},
+			Message:      "Mailbox full",
+		},
+	}
+
+	io.WriteString(c, "LHLO localhost\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "250 ") {
+			break
+		}
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	for _, rcpt := range []string{"root@gchq.gov.uk", "root@bnd.bund.de", "root@dgse.fr"} {
+		io.WriteString(c, "RCPT TO:<"+rcpt+">\r\n")
+		scanner.Scan()
+	}
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+
+	// Replies are in recipient order, recipients without a status succeed
+	for _, want := range []string{
+		"250 2.0.0 <root@gchq.gov.uk> OK: queued as " + txID,
+		"552 5.2.2 <root@bnd.bund.de> Mailbox full",
+		"250 2.0.0 <root@dgse.fr> OK: queued as " + txID,
+	} {
+		scanner.Scan()
+		if scanner.Text() != want {
+			t.Fatalf("Invalid DATA response: got %q, want %q", scanner.Text(), want)
+		}
+	}
+}
+
+func TestServer_abort(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	be.aborts = make(chan smtp.AbortReason, 10)
+
+	expectAbort := func(want smtp.AbortReason) {
+		t.Helper()
+		select {
+		case reason := <-be.aborts:
+			if reason != want {
+				t.Fatalf("Invalid abort reason: got %v, want %v", reason, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Transaction not aborted, want %v", want)
+		}
+	}
+	startTransaction := func() {
+		t.Helper()
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid RCPT response:", scanner.Text())
+		}
+	}
+
+	// Without a transaction, nothing is aborted
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+
+	startTransaction()
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+	expectAbort(smtp.AbortReset)
+
+	startTransaction()
+	io.WriteString(c, "HELO localhost\r\n")
+	scanner.Scan()
+	expectAbort(smtp.AbortHello)
+
+	// A delivered message isn't aborted
+	startTransaction()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	startTransaction()
+	c.Close()
+	expectAbort(smtp.AbortDisconnect)
+
+	select {
+	case reason := <-be.aborts:
+		t.Fatalf("Unexpected abort: %v", reason)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestServer_closeFinish(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t)
+	defer c.Close()
+	be.aborts = make(chan smtp.AbortReason, 1)
+	be.summaries = make(chan smtp.SessionSummary, 1)
+	be.logouts = make(chan struct{}, 1)
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	// Closing the server from another goroutine aborts the transaction and
+	// sends the summary before the session is logged out
+	s.Close()
+	select {
+	case <-be.logouts:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session not logged out")
+	}
+	select {
+	case reason := <-be.aborts:
+		if reason != smtp.AbortDisconnect {
+			t.Errorf("Invalid abort reason: got %v, want %v", reason, smtp.AbortDisconnect)
+		}
+	default:
+		t.Error("Transaction not aborted before logout")
+	}
+	select {
+	case <-be.summaries:
+	default:
+		t.Error("Summary not sent before logout")
+	}
+}
+
+func TestServer_resetError(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+	s.ErrorLog = log.New(ioutil.Discard, "", 0)
+
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{nil, "250 2.0.0 Session reset"},
+		{errors.New("database unavailable"), "451 4.3.0 Failed to reset session"},
+		{&smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+			Message:      "Insufficient system storage",
+		}, "452 4.3.1 Insufficient system storage"},
+		// RSET can't fail permanently
+		{&smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+			Message:      "Nope",
+		}, "451 4.3.0 Failed to reset session"},
+	} {
+		be.resetErr = tc.err
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RSET\r\n")
+		scanner.Scan()
+		if scanner.Text() != tc.want {
+			t.Errorf("Invalid RSET response: got %q, want %q", scanner.Text(), tc.want)
+		}
+	}
+
+	// The transaction is reset anyway
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Errorf("Invalid DATA response after failed reset: %v", scanner.Text())
+	}
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServer_resetErrorLog(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		txID string
+	)
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.StageHook = func(c *smtp.Conn, stage string) func() {
+			mu.Lock()
+			if tx := c.Transaction(); tx != nil {
+				txID = tx.ID
+			}
+			mu.Unlock()
+			return nil
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+	var logs lockedBuffer
+	s.ErrorLog = log.New(&logs, "", 0)
+	be.resetErr = errors.New("database unavailable")
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "451 ") {
+		t.Fatalf("Invalid RSET response: %v", scanner.Text())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if txID == "" {
+		t.Fatal("No transaction started")
+	}
+	if want := "transaction " + txID + ")"; !strings.Contains(logs.String(), want) {
+		t.Errorf("Reset error log doesn't contain %q: %q", want, logs.String())
+	}
+}
+
+func TestServer_summary(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+	be.summaries = make(chan smtp.SessionSummary, 1)
+	be.rcptErr = map[string]error{
+		"root@bnd.bund.de": &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"},
 	}
 
-	scanner = bufio.NewScanner(c)
+	for _, cmd := range []string{
+		"MAIL FROM:<root@nsa.gov> SIZE=rabbit",
+		"MAIL FROM:<root@nsa.gov>",
+		"RCPT TO:<root@bnd.bund.de>",
+		"RCPT TO:<root@gchq.gov.uk>",
+		"DATA",
+		"Hey <3\r\n.",
+		"DATA",
+		"QUIT",
+	} {
+		io.WriteString(c, cmd+"\r\n")
+		scanner.Scan()
+	}
 
-	scanner.Scan()
-	if scanner.Text() != "220 localhost ESMTP Service Ready" {
-		t.Fatal("Invalid greeting:", scanner.Text())
+	var summary smtp.SessionSummary
+	select {
+	case summary = <-be.summaries:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session not finalized")
+	}
+	if !summary.Quit || summary.Messages != 1 || summary.Bytes != int64(len("Hey <3\n")) {
+		t.Errorf("Invalid summary: %+v", summary)
+	}
+	if summary.RejectedMail != 1 || summary.RejectedRcpt != 1 || summary.RejectedData != 1 {
+		t.Errorf("Invalid rejection counts: %+v", summary)
+	}
+	if summary.Start.IsZero() || summary.Duration <= 0 {
+		t.Errorf("Invalid summary times: %+v", summary)
+	}
+}
+
+func TestServer_commandHook(t *testing.T) {
+	type command struct{ cmd, arg string }
+	var (
+		mu   sync.Mutex
+		cmds []command
+	)
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.CommandHook = func(c *smtp.Conn, cmd, arg string) bool {
+			mu.Lock()
+			cmds = append(cmds, command{cmd, arg})
+			mu.Unlock()
+			if cmd == "XDIAG" {
+				c.WriteResponse(250, smtp.EnhancedCode{2, 0, 0}, "All systems nominal")
+				return true
+			}
+			return false
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for _, tc := range []struct {
+		line, want string
+	}{
+		{"NOOP probe 42", "250 2.0.0 "},
+		{"XDIAG queue", "250 2.0.0 All systems nominal"},
+		{"XTST", "500 5.5.2 "},
+		{"GET / HTTP/1.0", "501 5.5.2 "},
+	} {
+		io.WriteString(c, tc.line+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tc.want) {
+			t.Errorf("Invalid response to %q: got %q, want %q", tc.line, scanner.Text(), tc.want)
+		}
 	}
 
-	io.WriteString(c, "EHLO localhost\r\n")
+	mu.Lock()
+	defer mu.Unlock()
+	want := []command{{"NOOP", "probe 42"}, {"XDIAG", "queue"}, {"XTST", ""}, {"GET", "/ HTTP/1.0"}}
+	if !reflect.DeepEqual(cmds, want) {
+		t.Errorf("Invalid commands: got %v, want %v", cmds, want)
+	}
+}
+
+func TestServer_multilineEnhancedCodes(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+			s.DisableEnhancedCodes = disabled
+			s.CommandHook = func(c *smtp.Conn, cmd, arg string) bool {
+				c.WriteResponse(250, smtp.EnhancedCode{2, 0, 0}, "First", "Second", "Last")
+				return true
+			}
+		})
+
+		if caps["ENHANCEDSTATUSCODES"] == disabled {
+			t.Errorf("ENHANCEDSTATUSCODES advertised: %v, disabled: %v", caps["ENHANCEDSTATUSCODES"], disabled)
+		}
+
+		want := []string{"250-2.0.0 First", "250-2.0.0 Second", "250 2.0.0 Last"}
+		if disabled {
+			want = []string{"250-First", "250-Second", "250 Last"}
+		}
+		io.WriteString(c, "NOOP\r\n")
+		for _, line := range want {
+			scanner.Scan()
+			if scanner.Text() != line {
+				t.Errorf("Invalid response line: got %q, want %q", scanner.Text(), line)
+			}
+		}
+
+		// Codes set by the server are suppressed too
+		io.WriteString(c, "RSET\r\n")
+		scanner.Scan()
+		wantReset := "250 2.0.0 Session reset"
+		if disabled {
+			wantReset = "250 Session reset"
+		}
+		if scanner.Text() != wantReset {
+			t.Errorf("Invalid RSET response: got %q, want %q", scanner.Text(), wantReset)
+		}
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestServer_smtputf8(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.EnableSMTPUTF8 = true
+	})
+	defer s.Close()
+	defer c.Close()
+	be.rcptErr = map[string]error{
+		"δοκιμή@παράδειγμα.δοκιμή": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "Unknown user δοκιμή\r\n",
+		},
+	}
+
+	if !caps["SMTPUTF8"] {
+		t.Error("SMTPUTF8 not advertised")
+	}
+
+	for _, tc := range []struct {
+		param, want string
+	}{
+		{"", `550 5.1.1 Unknown user \u03b4\u03bf\u03ba\u03b9\u03bc\u03ae\x0d\x0a`},
+		{" SMTPUTF8", `550 5.1.1 Unknown user δοκιμή\x0d\x0a`},
+	} {
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>"+tc.param+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid MAIL response:", scanner.Text())
+		}
+		io.WriteString(c, "RCPT TO:<δοκιμή@παράδειγμα.δοκιμή>\r\n")
+		scanner.Scan()
+		if scanner.Text() != tc.want {
+			t.Errorf("Invalid RCPT response: got %q, want %q", scanner.Text(), tc.want)
+		}
+		io.WriteString(c, "RSET\r\n")
+		scanner.Scan()
+	}
 
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> SMTPUTF8=yes\r\n")
 	scanner.Scan()
-	if scanner.Text() != "250-Hello localhost" {
-		t.Fatal("Invalid EHLO response:", scanner.Text())
+	if !strings.HasPrefix(scanner.Text(), "501 ") {
+		t.Error("Invalid MAIL response:", scanner.Text())
 	}
+}
 
-	expectedCaps := []string{"PIPELINING", "8BITMIME"}
-	caps := make(map[string]bool)
+func TestServer_smtputf8Disabled(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
 
-	for scanner.Scan() {
-		s := scanner.Text()
+	if caps["SMTPUTF8"] {
+		t.Error("SMTPUTF8 advertised")
+	}
+	// The parameter is ignored, like other unknown parameters
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> SMTPUTF8\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Error("Invalid MAIL response:", scanner.Text())
+	}
+}
 
-		if strings.HasPrefix(s, "250 ") {
-			caps[strings.TrimPrefix(s, "250 ")] = true
-			break
-		} else {
-			if !strings.HasPrefix(s, "250-") {
-				t.Fatal("Invalid capability response:", s)
+func TestServer_vrfyMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode  smtp.VrfyMode
+		lines map[string]string
+	}{
+		{smtp.VrfyCannotVerify, map[string]string{
+			"VRFY <root@gchq.gov.uk>": "252 2.5.0 ",
+			"VRFY <root@bnd.bund.de>": "252 2.5.0 ",
+		}},
+		{smtp.VrfyBackend, map[string]string{
+			"VRFY <root@gchq.gov.uk>": "250 2.1.5 <root@gchq.gov.uk>",
+			"VRFY root@bnd.bund.de":   "550 5.1.1 No such user",
+			"VRFY":                    "501 5.5.4 ",
+		}},
+		{smtp.VrfyDisabled, map[string]string{
+			"VRFY <root@gchq.gov.uk>": "502 5.5.1 ",
+		}},
+	} {
+		be, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+			s.VrfyMode = tc.mode
+		})
+		be.rcptErr = map[string]error{
+			"root@bnd.bund.de": &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+				Message:      "No such user",
+			},
+		}
+
+		for line, want := range tc.lines {
+			io.WriteString(c, line+"\r\n")
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), want) {
+				t.Errorf("Invalid response to %q in mode %v: got %q, want %q", line, tc.mode, scanner.Text(), want)
 			}
-			caps[strings.TrimPrefix(s, "250-")] = true
 		}
+
+		c.Close()
+		s.Close()
 	}
+}
 
-	for _, cap := range expectedCaps {
-		if !caps[cap] {
-			t.Fatal("Missing capability:", cap)
+func TestServer_rcptFailureLimit(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.MaxRcptFailures = 2
+	})
+	defer s.Close()
+	defer c.Close()
+	be.rcptErr = map[string]error{
+		"root@bnd.bund.de": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+		"root@dgse.fr": &smtp.SMTPError{
+			Code:         450,
+			EnhancedCode: smtp.EnhancedCode{4, 2, 1},
+			Message:      "Try again later",
+		},
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	for _, tc := range []struct {
+		rcpt, want string
+	}{
+		{"root@bnd.bund.de", "550 "},
+		{"root@gchq.gov.uk", "250 "},
+		// Temporary failures aren't counted
+		{"root@dgse.fr", "450 "},
+		{"root@bnd.bund.de", "550 "},
+		{"root@bnd.bund.de", "550 "},
+	} {
+		io.WriteString(c, "RCPT TO:<"+tc.rcpt+">\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tc.want) {
+			t.Fatalf("Invalid RCPT response: got %q, want %q", scanner.Text(), tc.want)
 		}
 	}
 
-	return
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "421 4.7.0 ") {
+		t.Fatal("Invalid response after too many failures:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Error("Connection not closed:", scanner.Text())
+	}
 }
 
-func TestStrictServerGood(t *testing.T) {
-	s, c, scanner := testStrictServer(t)
+func TestServer_rcptFailureWindow(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.MaxRcptFailures = 1
+		s.RcptFailureWindow = 50 * time.Millisecond
+	})
 	defer s.Close()
 	defer c.Close()
+	be.rcptErr = map[string]error{
+		"root@bnd.bund.de": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+	}
 
 	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid MAIL response:", scanner.Text())
+	for i := 0; i < 3; i++ {
+		time.Sleep(60 * time.Millisecond)
+		io.WriteString(c, "RCPT TO:<root@bnd.bund.de>\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "550 ") {
+			t.Fatal("Invalid RCPT response:", scanner.Text())
+		}
 	}
 }
 
-func TestStrictServerBad(t *testing.T) {
-	s, c, scanner := testStrictServer(t)
+func TestServer_rcptNormalization(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.RcptNormalization = &smtp.AddressNormalization{
+			LowerDomain:      true,
+			LowerLocalPart:   true,
+			TagSeparators:    "+",
+			StripSourceRoute: true,
+		}
+	})
 	defer s.Close()
 	defer c.Close()
 
-	io.WriteString(c, "MAIL FROM: root@nsa.gov\r\n")
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
 	scanner.Scan()
-	if strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid MAIL response:", scanner.Text())
+	io.WriteString(c, "RCPT TO:<@relay.example:Root+Secret@GCHQ.gov.uk>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 2.0.0 I'll make sure <@relay.example:Root+Secret@GCHQ.gov.uk> gets this" {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.anonmsgs)
+	}
+	msg := be.anonmsgs[0]
+	if len(msg.To) != 1 || msg.To[0] != "root@gchq.gov.uk" {
+		t.Errorf("Invalid normalized recipients: %v", msg.To)
+	}
+	if len(msg.OriginalTo) != 1 || msg.OriginalTo[0] != "@relay.example:Root+Secret@GCHQ.gov.uk" {
+		t.Errorf("Invalid original recipients: %v", msg.OriginalTo)
 	}
 }
 
-func TestServer_lmtpOK(t *testing.T) {
-	be, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
-		s.LMTP = true
+func TestServer_postmaster(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.Strict = true
+	})
+	defer s.Close()
+	defer c.Close()
+	be.rcptErr = map[string]error{
+		"Postmaster": &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Relay access denied",
+		},
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<Postmaster>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+
+	if len(be.anonmsgs) != 1 || len(be.anonmsgs[0].To) != 1 || be.anonmsgs[0].To[0] != "postmaster@localhost" {
+		t.Fatal("Invalid sent messages:", be.anonmsgs)
+	}
+}
+
+func TestServer_transaction(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		txs []*smtp.Transaction
+	)
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.StageHook = func(c *smtp.Conn, stage string) func() {
+			mu.Lock()
+			txs = append(txs, c.Transaction())
+			mu.Unlock()
+			return nil
+		}
 	})
 	defer s.Close()
 	defer c.Close()
 
-	io.WriteString(c, "LHLO localhost\r\n")
+	for _, cmd := range []string{
+		"MAIL FROM:<root@nsa.gov> SIZE=20 BODY=8bitmime AUTH=<>",
+		"RCPT TO:<root@gchq.gov.uk>",
+		"RCPT TO:<root@bnd.bund.de>",
+		"DATA",
+		"Hey <3\r\n.",
+	} {
+		io.WriteString(c, cmd+"\r\n")
+		scanner.Scan()
+	}
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.anonmsgs)
+	}
+	tx := be.anonmsgs[0].Tx
+	if tx == nil || tx.ID == "" || tx.From != "root@nsa.gov" || tx.Size != 20 || tx.Body != "8BITMIME" || tx.Auth != "<>" {
+		t.Fatalf("Invalid transaction: %+v", tx)
+	}
+	if len(tx.Recipients) != 2 || tx.Recipients[1] != "root@bnd.bund.de" {
+		t.Errorf("Invalid transaction recipients: %v", tx.Recipients)
+	}
+	if tx.Start.IsZero() || tx.DataStart.Before(tx.Start) {
+		t.Errorf("Invalid transaction times: %v, %v", tx.Start, tx.DataStart)
+	}
+	if tx.SessionID == "" || tx.SessionID == tx.ID {
+		t.Errorf("Invalid transaction session ID: %q", tx.SessionID)
+	}
+	if want := "250 2.0.0 OK: queued as " + tx.ID; scanner.Text() != want {
+		t.Errorf("Invalid DATA response: got %q, want %q", scanner.Text(), want)
+	}
 
+	// Hooks run before commands: the transaction is visible from the first
+	// RCPT command
+	mu.Lock()
+	if len(txs) != 5 || txs[1] != nil || txs[2] != tx || txs[4] != tx {
+		t.Errorf("Invalid transactions seen by hooks: %v", txs)
+	}
+	mu.Unlock()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
 	scanner.Scan()
-	if scanner.Text() != "250-Hello localhost" {
-		t.Fatal("Invalid LHLO response:", scanner.Text())
+	if tx2 := be.anonmsgs[0].Tx; tx2 != tx {
+		t.Error("Delivered transaction modified")
 	}
+}
 
-	for scanner.Scan() {
-		s := scanner.Text()
+func TestServer_checkHello(t *testing.T) {
+	be, s, c, scanner := testServerGreeted(t)
+	defer s.Close()
+	defer c.Close()
+	be.helloErr = map[string]error{
+		"localhost": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Forged hostname",
+		},
+		"busy.example.org": errors.New("Policy service unavailable"),
+	}
 
-		if strings.HasPrefix(s, "250 ") {
+	for _, tc := range []struct {
+		line, want string
+	}{
+		{"EHLO localhost", "550 5.7.1 Forged hostname"},
+		// A rejected greeting has no effect
+		{"MAIL FROM:<root@nsa.gov>", "502 "},
+		{"HELO busy.example.org", "451 4.0.0 Policy service unavailable"},
+		{"HELO mx.example.org", "250 "},
+		{"MAIL FROM:<root@nsa.gov>", "250 "},
+	} {
+		io.WriteString(c, tc.line+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tc.want) {
+			t.Errorf("Invalid response to %q: got %q, want %q", tc.line, scanner.Text(), tc.want)
+		}
+	}
+
+	want := []string{"EHLO localhost", "HELO busy.example.org", "HELO mx.example.org"}
+	if !reflect.DeepEqual(be.hellos, want) {
+		t.Errorf("CheckHello called with %v, want %v", be.hellos, want)
+	}
+}
+
+func TestServer_capabilitiesAfterAuth(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.Backend.(*backend).userMaxBytes = 100
+		s.MaxMessageBytes = 10
+		s.CapabilityHook = func(c *smtp.Conn, caps []string) []string {
+			if c.Session() != nil {
+				caps = append(caps, "X-AUTHENTICATED")
+			}
+			return caps
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	// The session is created by AUTH, after the first EHLO
+	io.WriteString(c, "EHLO localhost\r\n")
+	caps := make(map[string]bool)
+	for scanner.Scan() {
+		line := scanner.Text()
+		caps[line[4:]] = true
+		if !strings.HasPrefix(line, "250-") {
 			break
-		} else if !strings.HasPrefix(s, "250-") {
-			t.Fatal("Invalid capability response:", s)
 		}
 	}
+	if !caps["SIZE 100"] || caps["SIZE 10"] {
+		t.Errorf("session size limit not advertised: %v", caps)
+	}
+	if !caps["X-AUTHENTICATED"] {
+		t.Errorf("capability hook not evaluated after AUTH: %v", caps)
+	}
 
-	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	for _, tc := range []struct {
+		line, want string
+	}{
+		{"MAIL FROM:<root@nsa.gov> SIZE=200", "552 "},
+		{"MAIL FROM:<root@nsa.gov> SIZE=50", "250 "},
+		{"RCPT TO:<root@gchq.gov.uk>", "250 "},
+		{"DATA", "354 "},
+		{strings.Repeat("a", 50) + "\r\n.", "250 "},
+	} {
+		io.WriteString(c, tc.line+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tc.want) {
+			t.Errorf("Invalid response to %q: got %q, want %q", tc.line, scanner.Text(), tc.want)
+		}
+	}
+}
+
+func TestServer_requireESMTP(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.RequireESMTP = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "HELO localhost\r\n")
 	scanner.Scan()
-	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	if !strings.HasPrefix(scanner.Text(), "502 5.5.1 ") {
+		t.Fatal("Invalid HELO response:", scanner.Text())
+	}
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
 	scanner.Scan()
-	io.WriteString(c, "RCPT TO:<root@bnd.bund.de>\r\n")
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Fatal("MAIL accepted after a rejected HELO:", scanner.Text())
+	}
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	for scanner.Scan() {
+		if !strings.HasPrefix(scanner.Text(), "250-") {
+			break
+		}
+	}
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid EHLO response:", scanner.Text())
+	}
+}
+
+func TestServer_rejectUnauthPipelining(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.RejectUnauthPipelining = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	// MAIL and RCPT can be pipelined
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\nRCPT TO:<root@gchq.gov.uk>\r\n")
+	for i := 0; i < 2; i++ {
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid response to pipelined commands:", scanner.Text())
+		}
+	}
+
+	// Message data must not be sent before the 354 reply
+	io.WriteString(c, "DATA\r\nHey <3\r\n.\r\n")
 	scanner.Scan()
-	io.WriteString(c, "DATA\r\n")
+	if !strings.HasPrefix(scanner.Text(), "554 5.5.0 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Error("Connection not closed:", scanner.Text())
+	}
+
+	_, s, c, scanner = testServerGreeted(t, func(s *smtp.Server) {
+		s.RejectUnauthPipelining = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	// No command can be pipelined without ESMTP
+	io.WriteString(c, "HELO localhost\r\n")
 	scanner.Scan()
-	io.WriteString(c, "Hey <3\r\n")
-	io.WriteString(c, ".\r\n")
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\nRCPT TO:<root@gchq.gov.uk>\r\n")
 	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "554 5.5.0 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
 
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid DATA first response:", scanner.Text())
+func TestServer_stats(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+	be.rcptErr = map[string]error{
+		"root@bnd.bund.de": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
 	}
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid DATA second response:", scanner.Text())
+
+	for _, line := range []string{
+		"AUTH PLAIN AHVzZXJuYW1lAHdyb25n",
+		"MAIL FROM:<root@nsa.gov>",
+		"RCPT TO:<root@bnd.bund.de>",
+		"RCPT TO:<root@gchq.gov.uk>",
+		"DATA",
+		"Hey <3\r\n.",
+	} {
+		io.WriteString(c, line+"\r\n")
+		scanner.Scan()
 	}
 
-	if len(be.messages) != 0 || len(be.anonmsgs) != 1 {
-		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	stats := s.Stats()
+	if stats.Since.IsZero() {
+		t.Error("Stats: missing start time")
+	}
+	stats.Since = time.Time{}
+	want := smtp.Stats{
+		Connections:       1,
+		ActiveConnections: 1,
+		Messages:          1,
+		Bytes:             7,
+		RejectedRcpt:      1,
+		AuthSuccesses:     1,
+		AuthFailures:      1,
+	}
+	if stats != want {
+		t.Errorf("Stats = %+v, want %+v", stats, want)
+	}
+
+	if stats := s.ResetStats(); stats.Messages != 1 {
+		t.Errorf("ResetStats returned %+v", stats)
+	}
+	stats = s.Stats()
+	stats.Since = time.Time{}
+	if want := (smtp.Stats{ActiveConnections: 1}); stats != want {
+		t.Errorf("Stats after reset = %+v, want %+v", stats, want)
 	}
 }
@@ -0,0 +1,333 @@
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenTag
+	tokenString
+	tokenNumber
+	tokenPunct
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	num   int64
+	line  int
+}
+
+// lex splits a script into tokens.
+func lex(src string) ([]token, error) {
+	var tokens []token
+	line := 1
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("sieve: line %v: unterminated comment", line)
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+		case c == '"':
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(src) {
+					return nil, fmt.Errorf("sieve: line %v: unterminated string", line)
+				}
+				if src[i] == '"' {
+					i++
+					break
+				}
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				if src[i] == '\n' {
+					line++
+				}
+				b.WriteByte(src[i])
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenString, value: b.String(), line: line})
+		case c == ':' || isIdentStart(c):
+			start := i
+			i++
+			for i < len(src) && isIdentChar(src[i]) {
+				i++
+			}
+			kind := tokenIdent
+			value := src[start:i]
+			if c == ':' {
+				kind = tokenTag
+				value = value[1:]
+				if value == "" {
+					return nil, fmt.Errorf("sieve: line %v: empty tag", line)
+				}
+			}
+			tokens = append(tokens, token{kind: kind, value: strings.ToLower(value), line: line})
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+				i++
+			}
+			n, err := strconv.ParseInt(src[start:i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("sieve: line %v: %v", line, err)
+			}
+			if i < len(src) {
+				switch unicode.ToUpper(rune(src[i])) {
+				case 'K':
+					n <<= 10
+					i++
+				case 'M':
+					n <<= 20
+					i++
+				case 'G':
+					n <<= 30
+					i++
+				}
+			}
+			tokens = append(tokens, token{kind: tokenNumber, num: n, line: line})
+		case strings.IndexByte(";,()[]{}", c) >= 0:
+			tokens = append(tokens, token{kind: tokenPunct, value: string(c), line: line})
+			i++
+		default:
+			return nil, fmt.Errorf("sieve: line %v: unexpected character %q", line, c)
+		}
+	}
+	tokens = append(tokens, token{kind: tokenEOF, line: line})
+	return tokens, nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+// argument is a positional or tagged argument of a command or test.
+type argument struct {
+	tag     string
+	strings []string
+	num     int64
+	isNum   bool
+}
+
+type test struct {
+	name  string
+	args  []argument
+	tests []*test
+	line  int
+}
+
+type command struct {
+	name  string
+	args  []argument
+	tests []*test
+	block []*command
+	line  int
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isPunct(s string) bool {
+	t := p.peek()
+	return t.kind == tokenPunct && t.value == s
+}
+
+func (p *parser) expectPunct(s string) error {
+	t := p.next()
+	if t.kind != tokenPunct || t.value != s {
+		return fmt.Errorf("sieve: line %v: expected %q", t.line, s)
+	}
+	return nil
+}
+
+func (p *parser) commands(block bool) ([]*command, error) {
+	var cmds []*command
+	for {
+		t := p.peek()
+		if t.kind == tokenEOF {
+			if block {
+				return nil, fmt.Errorf("sieve: line %v: unterminated block", t.line)
+			}
+			return cmds, nil
+		}
+		if block && p.isPunct("}") {
+			p.next()
+			return cmds, nil
+		}
+		cmd, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+}
+
+func (p *parser) command() (*command, error) {
+	t := p.next()
+	if t.kind != tokenIdent {
+		return nil, fmt.Errorf("sieve: line %v: expected command", t.line)
+	}
+	cmd := &command{name: t.value, line: t.line}
+
+	args, err := p.arguments()
+	if err != nil {
+		return nil, err
+	}
+	cmd.args = args
+
+	if p.peek().kind == tokenIdent {
+		tst, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		cmd.tests = []*test{tst}
+	} else if p.isPunct("(") {
+		if cmd.tests, err = p.testList(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.isPunct("{") {
+		p.next()
+		if cmd.block, err = p.commands(true); err != nil {
+			return nil, err
+		}
+		if cmd.block == nil {
+			cmd.block = []*command{}
+		}
+		return cmd, nil
+	}
+	if err := p.expectPunct(";"); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+func (p *parser) arguments() ([]argument, error) {
+	var args []argument
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == tokenTag:
+			p.next()
+			args = append(args, argument{tag: t.value})
+		case t.kind == tokenNumber:
+			p.next()
+			args = append(args, argument{num: t.num, isNum: true})
+		case t.kind == tokenString:
+			p.next()
+			args = append(args, argument{strings: []string{t.value}})
+		case p.isPunct("["):
+			p.next()
+			var l []string
+			for {
+				s := p.next()
+				if s.kind != tokenString {
+					return nil, fmt.Errorf("sieve: line %v: expected string in list", s.line)
+				}
+				l = append(l, s.value)
+				if p.isPunct(",") {
+					p.next()
+					continue
+				}
+				if err := p.expectPunct("]"); err != nil {
+					return nil, err
+				}
+				break
+			}
+			args = append(args, argument{strings: l})
+		default:
+			return args, nil
+		}
+	}
+}
+
+func (p *parser) test() (*test, error) {
+	t := p.next()
+	if t.kind != tokenIdent {
+		return nil, fmt.Errorf("sieve: line %v: expected test", t.line)
+	}
+	tst := &test{name: t.value, line: t.line}
+
+	args, err := p.arguments()
+	if err != nil {
+		return nil, err
+	}
+	tst.args = args
+
+	if p.peek().kind == tokenIdent {
+		sub, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		tst.tests = []*test{sub}
+	} else if p.isPunct("(") {
+		if tst.tests, err = p.testList(); err != nil {
+			return nil, err
+		}
+	}
+	return tst, nil
+}
+
+func (p *parser) testList() ([]*test, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var tests []*test
+	for {
+		tst, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, tst)
+		if p.isPunct(",") {
+			p.next()
+			continue
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+		return tests, nil
+	}
+}
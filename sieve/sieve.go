@@ -0,0 +1,481 @@
+// Package sieve implements a subset of the Sieve mail filtering language, as
+// defined in RFC 5228.
+//
+// The supported commands are require, if/elsif/else, stop, keep, discard,
+// fileinto, redirect and reject. The supported tests are address, allof,
+// anyof, envelope, exists, false, header, not, size and true, with the
+// :is, :contains and :matches match types and the "i;ascii-casemap" and
+// "i;octet" comparators.
+package sieve
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"strings"
+)
+
+// Extensions lists the extensions which can be required by scripts.
+var Extensions = []string{"fileinto", "reject", "envelope"}
+
+// Script is a parsed Sieve script.
+type Script struct {
+	commands []*command
+}
+
+// Parse parses a Sieve script.
+func Parse(src string) (*Script, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	cmds, err := p.commands(false)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &validator{required: make(map[string]bool)}
+	if err := v.commands(cmds, true); err != nil {
+		return nil, err
+	}
+	return &Script{commands: cmds}, nil
+}
+
+// ActionType is the type of an action.
+type ActionType int
+
+const (
+	// ActionKeep delivers the message into the default mailbox.
+	ActionKeep ActionType = iota
+	// ActionFileInto delivers the message into Action.Mailbox.
+	ActionFileInto
+	// ActionRedirect forwards the message to Action.Address.
+	ActionRedirect
+	// ActionReject refuses the message with Action.Reason.
+	ActionReject
+	// ActionDiscard silently drops the message.
+	ActionDiscard
+)
+
+// Action is an action to perform on a message.
+type Action struct {
+	Type    ActionType
+	Mailbox string
+	Address string
+	Reason  string
+}
+
+// Message is a message being filtered.
+type Message struct {
+	// The envelope sender and the recipient the script runs for.
+	From string
+	To   string
+	// The message header.
+	Header mail.Header
+	// The message size in bytes.
+	Size int64
+}
+
+// Execute runs the script against a message and returns the actions to
+// perform. If no action cancels the implicit keep, the result contains an
+// ActionKeep. A discard is only returned if it is the only action.
+func (s *Script) Execute(msg *Message) []Action {
+	st := &state{msg: msg, implicitKeep: true}
+	st.run(s.commands)
+
+	actions := st.actions
+	if st.implicitKeep {
+		actions = append([]Action{{Type: ActionKeep}}, actions...)
+	}
+	if len(actions) == 0 {
+		actions = []Action{{Type: ActionDiscard}}
+	}
+	return actions
+}
+
+type validator struct {
+	required map[string]bool
+}
+
+func (v *validator) commands(cmds []*command, top bool) error {
+	prev := ""
+	for _, cmd := range cmds {
+		if err := v.command(cmd, top, prev); err != nil {
+			return err
+		}
+		prev = cmd.name
+		top = top && cmd.name == "require"
+	}
+	return nil
+}
+
+func (v *validator) command(cmd *command, top bool, prev string) error {
+	errorf := func(format string, args ...interface{}) error {
+		return fmt.Errorf("sieve: line %v: %v", cmd.line, fmt.Sprintf(format, args...))
+	}
+
+	isBlock := cmd.name == "if" || cmd.name == "elsif" || cmd.name == "else"
+	if isBlock != (cmd.block != nil) {
+		if isBlock {
+			return errorf("%v requires a block", cmd.name)
+		}
+		return errorf("unexpected block after %v", cmd.name)
+	}
+
+	switch cmd.name {
+	case "require":
+		if !top {
+			return errorf("require must be at the beginning of the script")
+		}
+		if len(cmd.args) != 1 || cmd.args[0].strings == nil {
+			return errorf("require expects a string list")
+		}
+		for _, ext := range cmd.args[0].strings {
+			supported := false
+			for _, e := range Extensions {
+				if e == ext {
+					supported = true
+				}
+			}
+			if !supported {
+				return errorf("unsupported extension %q", ext)
+			}
+			v.required[ext] = true
+		}
+		return nil
+	case "if", "elsif":
+		if cmd.name == "elsif" && prev != "if" && prev != "elsif" {
+			return errorf("elsif without if")
+		}
+		if len(cmd.args) != 0 || len(cmd.tests) != 1 {
+			return errorf("%v expects a single test", cmd.name)
+		}
+		if err := v.test(cmd.tests[0]); err != nil {
+			return err
+		}
+		return v.commands(cmd.block, false)
+	case "else":
+		if prev != "if" && prev != "elsif" {
+			return errorf("else without if")
+		}
+		if len(cmd.args) != 0 || len(cmd.tests) != 0 {
+			return errorf("else doesn't take arguments")
+		}
+		return v.commands(cmd.block, false)
+	case "stop", "keep", "discard":
+		if len(cmd.args) != 0 || len(cmd.tests) != 0 {
+			return errorf("%v doesn't take arguments", cmd.name)
+		}
+		return nil
+	case "fileinto", "reject", "redirect":
+		if ext := cmd.name; ext != "redirect" && !v.required[ext] {
+			return errorf("%v requires the %q extension", cmd.name, ext)
+		}
+		if len(cmd.args) != 1 || len(cmd.args[0].strings) != 1 || len(cmd.tests) != 0 {
+			return errorf("%v expects a single string", cmd.name)
+		}
+		return nil
+	default:
+		return errorf("unknown command %q", cmd.name)
+	}
+}
+
+func (v *validator) test(t *test) error {
+	errorf := func(format string, args ...interface{}) error {
+		return fmt.Errorf("sieve: line %v: %v", t.line, fmt.Sprintf(format, args...))
+	}
+
+	switch t.name {
+	case "true", "false":
+		if len(t.args) != 0 || len(t.tests) != 0 {
+			return errorf("%v doesn't take arguments", t.name)
+		}
+	case "not":
+		if len(t.args) != 0 || len(t.tests) != 1 {
+			return errorf("not expects a single test")
+		}
+	case "allof", "anyof":
+		if len(t.args) != 0 || len(t.tests) == 0 {
+			return errorf("%v expects a test list", t.name)
+		}
+	case "exists":
+		if len(t.args) != 1 || t.args[0].strings == nil || len(t.tests) != 0 {
+			return errorf("exists expects a string list")
+		}
+	case "size":
+		if len(t.args) != 2 || (t.args[0].tag != "over" && t.args[0].tag != "under") || !t.args[1].isNum {
+			return errorf("size expects :over or :under and a number")
+		}
+	case "header", "address", "envelope":
+		if t.name == "envelope" && !v.required["envelope"] {
+			return errorf("envelope requires the \"envelope\" extension")
+		}
+		if _, err := parseMatchArgs(t); err != nil {
+			return errorf("%v", err)
+		}
+	default:
+		return errorf("unknown test %q", t.name)
+	}
+
+	for _, sub := range t.tests {
+		if err := v.test(sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type matchArgs struct {
+	matchType   string
+	octet       bool
+	addressPart string
+	names, keys []string
+}
+
+func parseMatchArgs(t *test) (*matchArgs, error) {
+	m := &matchArgs{matchType: "is", addressPart: "all"}
+	args := t.args
+	for len(args) > 0 && args[0].tag != "" {
+		switch tag := args[0].tag; tag {
+		case "is", "contains", "matches":
+			m.matchType = tag
+		case "all", "localpart", "domain":
+			if t.name == "header" {
+				return nil, fmt.Errorf("unexpected tag :%v", tag)
+			}
+			m.addressPart = tag
+		case "comparator":
+			if len(args) < 2 || len(args[1].strings) != 1 {
+				return nil, fmt.Errorf(":comparator expects a string")
+			}
+			switch args[1].strings[0] {
+			case "i;ascii-casemap":
+				m.octet = false
+			case "i;octet":
+				m.octet = true
+			default:
+				return nil, fmt.Errorf("unsupported comparator %q", args[1].strings[0])
+			}
+			args = args[1:]
+		default:
+			return nil, fmt.Errorf("unexpected tag :%v", tag)
+		}
+		args = args[1:]
+	}
+	if len(args) != 2 || args[0].strings == nil || args[1].strings == nil || len(t.tests) != 0 {
+		return nil, fmt.Errorf("%v expects two string lists", t.name)
+	}
+	m.names, m.keys = args[0].strings, args[1].strings
+	return m, nil
+}
+
+func (m *matchArgs) match(value string) bool {
+	for _, key := range m.keys {
+		v, k := value, key
+		if !m.octet {
+			v, k = strings.ToLower(v), strings.ToLower(k)
+		}
+		switch m.matchType {
+		case "is":
+			if v == k {
+				return true
+			}
+		case "contains":
+			if strings.Contains(v, k) {
+				return true
+			}
+		case "matches":
+			if globMatch(k, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// globMatch matches a value against a Sieve wildcard pattern, where "*"
+// matches any sequence and "?" a single character.
+func globMatch(pattern, value string) bool {
+	// path.Match treats "/" and brackets specially, escape them
+	var b strings.Builder
+	for _, c := range pattern {
+		switch c {
+		case '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	pattern = strings.Replace(b.String(), "/", "\x00", -1)
+	value = strings.Replace(value, "/", "\x00", -1)
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
+
+func addressPart(addr, part string) string {
+	at := strings.LastIndexByte(addr, '@')
+	switch part {
+	case "localpart":
+		if at < 0 {
+			return addr
+		}
+		return addr[:at]
+	case "domain":
+		if at < 0 {
+			return ""
+		}
+		return addr[at+1:]
+	}
+	return addr
+}
+
+type state struct {
+	msg          *Message
+	actions      []Action
+	implicitKeep bool
+	stopped      bool
+}
+
+func (st *state) run(cmds []*command) {
+	matched := false
+	for _, cmd := range cmds {
+		if st.stopped {
+			return
+		}
+		switch cmd.name {
+		case "if":
+			matched = st.test(cmd.tests[0])
+			if matched {
+				st.run(cmd.block)
+			}
+		case "elsif":
+			if !matched {
+				matched = st.test(cmd.tests[0])
+				if matched {
+					st.run(cmd.block)
+				}
+			}
+		case "else":
+			if !matched {
+				st.run(cmd.block)
+			}
+		case "stop":
+			st.stopped = true
+		case "keep":
+			st.add(Action{Type: ActionKeep})
+		case "discard":
+			st.implicitKeep = false
+		case "fileinto":
+			st.add(Action{Type: ActionFileInto, Mailbox: cmd.args[0].strings[0]})
+		case "redirect":
+			st.add(Action{Type: ActionRedirect, Address: cmd.args[0].strings[0]})
+		case "reject":
+			st.add(Action{Type: ActionReject, Reason: cmd.args[0].strings[0]})
+		}
+	}
+}
+
+func (st *state) add(action Action) {
+	st.implicitKeep = false
+	for _, a := range st.actions {
+		if a == action {
+			return
+		}
+	}
+	st.actions = append(st.actions, action)
+}
+
+func (st *state) test(t *test) bool {
+	switch t.name {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "not":
+		return !st.test(t.tests[0])
+	case "allof":
+		for _, sub := range t.tests {
+			if !st.test(sub) {
+				return false
+			}
+		}
+		return true
+	case "anyof":
+		for _, sub := range t.tests {
+			if st.test(sub) {
+				return true
+			}
+		}
+		return false
+	case "exists":
+		for _, name := range t.args[0].strings {
+			if _, ok := st.msg.Header[textprotoKey(name)]; !ok {
+				return false
+			}
+		}
+		return true
+	case "size":
+		if t.args[0].tag == "over" {
+			return st.msg.Size > t.args[1].num
+		}
+		return st.msg.Size < t.args[1].num
+	}
+
+	m, _ := parseMatchArgs(t)
+	for _, name := range m.names {
+		for _, value := range st.values(t.name, name) {
+			if t.name != "header" {
+				value = addressPart(value, m.addressPart)
+			}
+			if m.match(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// values returns the values to match for a header, address or envelope
+// test.
+func (st *state) values(test, name string) []string {
+	switch test {
+	case "envelope":
+		switch strings.ToLower(name) {
+		case "from":
+			return []string{st.msg.From}
+		case "to":
+			return []string{st.msg.To}
+		}
+		return nil
+	case "address":
+		var l []string
+		for _, v := range st.msg.Header[textprotoKey(name)] {
+			addrs, err := mail.ParseAddressList(v)
+			if err != nil {
+				continue
+			}
+			for _, addr := range addrs {
+				l = append(l, addr.Address)
+			}
+		}
+		return l
+	}
+
+	values := st.msg.Header[textprotoKey(name)]
+	decoded := make([]string, len(values))
+	var dec mime.WordDecoder
+	for i, v := range values {
+		if s, err := dec.DecodeHeader(v); err == nil {
+			decoded[i] = s
+		} else {
+			decoded[i] = v
+		}
+	}
+	return decoded
+}
+
+func textprotoKey(name string) string {
+	return textproto.CanonicalMIMEHeaderKey(name)
+}
@@ -0,0 +1,110 @@
+package sieve_test
+
+import (
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp/sieve"
+)
+
+const testScript = `require ["fileinto", "reject", "envelope"];
+
+# Reject large messages from a specific domain
+if allof (address :domain "from" "spam.example", size :over 10K) {
+	reject "Go away";
+	stop;
+}
+
+if header :contains ["Subject", "X-Spam-Flag"] ["[SPAM]", "YES"] {
+	fileinto "Junk";
+} elsif envelope :localpart :is "to" "bob" {
+	redirect "bob@example.net";
+	keep;
+} elsif header :matches "Subject" "unsubscribe*" {
+	discard;
+}
+`
+
+func TestScript(t *testing.T) {
+	script, err := sieve.Parse(testScript)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		to     string
+		header mail.Header
+		size   int64
+		want   []sieve.Action
+	}{
+		{
+			name:   "implicit keep",
+			to:     "alice@example.org",
+			header: mail.Header{"Subject": {"Hello"}},
+			want:   []sieve.Action{{Type: sieve.ActionKeep}},
+		},
+		{
+			name:   "fileinto",
+			to:     "alice@example.org",
+			header: mail.Header{"Subject": {"Cheap pills [spam]"}},
+			want:   []sieve.Action{{Type: sieve.ActionFileInto, Mailbox: "Junk"}},
+		},
+		{
+			name:   "redirect and keep",
+			to:     "bob@example.org",
+			header: mail.Header{"Subject": {"Hello"}},
+			want:   []sieve.Action{{Type: sieve.ActionRedirect, Address: "bob@example.net"}, {Type: sieve.ActionKeep}},
+		},
+		{
+			name:   "discard",
+			to:     "alice@example.org",
+			header: mail.Header{"Subject": {"=?utf-8?q?Unsubscribe_now?="}},
+			want:   []sieve.Action{{Type: sieve.ActionDiscard}},
+		},
+		{
+			name:   "reject",
+			to:     "alice@example.org",
+			header: mail.Header{"From": {"Spammer <x@spam.example>"}, "Subject": {"[SPAM]"}},
+			size:   20 << 10,
+			want:   []sieve.Action{{Type: sieve.ActionReject, Reason: "Go away"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := script.Execute(&sieve.Message{
+				From:   "sender@example.com",
+				To:     test.to,
+				Header: test.header,
+				Size:   test.size,
+			})
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Execute = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParse_invalid(t *testing.T) {
+	for _, src := range []string{
+		`fileinto "Junk";`,
+		`keep`,
+		`if true keep;`,
+		`else { keep; }`,
+		`require "vacation";`,
+		`keep; require "fileinto";`,
+		`if header :regex "Subject" "x" { keep; }`,
+		`if header "Subject" { keep; }`,
+		`unknown;`,
+		`if true { keep;`,
+		`"unterminated`,
+	} {
+		if _, err := sieve.Parse(src); err == nil {
+			t.Errorf("Parse(%q): expected error", src)
+		} else if !strings.HasPrefix(err.Error(), "sieve: ") {
+			t.Errorf("Parse(%q): unexpected error format: %v", src, err)
+		}
+	}
+}
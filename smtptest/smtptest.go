@@ -0,0 +1,359 @@
+// Package smtptest provides utilities for SMTP testing.
+//
+// It is modelled after net/http/httptest: a Server listens on a loopback
+// address and records every message it accepts, so that tests can send mail
+// with a real client and then inspect what was received.
+//
+// Sessions can also be recorded as transcripts and replayed against a Server,
+// to write regression tests for protocol edge cases.
+package smtptest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/mail"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DefaultTimeout is the time ExpectMessages waits for messages to arrive.
+var DefaultTimeout = 5 * time.Second
+
+// A Message is a message received by a Server.
+type Message struct {
+	// The user the client authenticated as, empty for anonymous sessions.
+	Username string
+	// The HELO name and address of the client.
+	Hostname   string
+	RemoteAddr net.Addr
+	// The TLS connection state, nil if the message wasn't sent over TLS.
+	TLS *tls.ConnectionState
+	// The envelope sender and recipients.
+	From string
+	To   []string
+	// The raw message, as passed to backends after the DATA command.
+	Data []byte
+}
+
+// Parse parses the raw message data.
+func (m *Message) Parse() (*mail.Message, error) {
+	return mail.ReadMessage(bytes.NewReader(m.Data))
+}
+
+// Header parses and returns the message header.
+func (m *Message) Header() (mail.Header, error) {
+	msg, err := m.Parse()
+	if err != nil {
+		return nil, err
+	}
+	return msg.Header, nil
+}
+
+// A Server is an SMTP server listening on a system-chosen port on the local
+// loopback interface, for use in end-to-end tests.
+type Server struct {
+	// Addr is the address the server listens on, in the form "host:port".
+	Addr     string
+	Listener net.Listener
+	// Server is the underlying SMTP server. It may be configured between
+	// NewUnstartedServer and Start.
+	Server *smtp.Server
+
+	// If non-nil, only these username/password pairs are accepted by AUTH.
+	// Otherwise, any credentials are accepted.
+	Users map[string]string
+	// If set, clients must authenticate before sending mail.
+	AuthRequired bool
+
+	certificate *x509.Certificate
+	done        chan struct{}
+
+	mu       sync.Mutex
+	messages []*Message
+	changed  chan struct{}
+}
+
+// NewServer starts and returns a new Server. The caller should call Close when
+// finished, to shut it down.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewTLSServer starts and returns a new Server supporting STARTTLS. The caller
+// should call Close when finished, to shut it down.
+func NewTLSServer() *Server {
+	s := NewUnstartedServer()
+	s.StartTLS()
+	return s
+}
+
+// NewUnstartedServer returns a new Server but doesn't start it.
+//
+// After changing its configuration, the caller should call Start or StartTLS.
+func NewUnstartedServer() *Server {
+	s := &Server{
+		Listener: newLocalListener(),
+		changed:  make(chan struct{}),
+	}
+	s.Server = smtp.NewServer(&backend{s})
+	s.Server.Domain = "localhost"
+	s.Server.AllowInsecureAuth = true
+	s.Server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	return s
+}
+
+func newLocalListener() net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		if l, err = net.Listen("tcp6", "[::1]:0"); err != nil {
+			panic(fmt.Sprintf("smtptest: failed to listen on a port: %v", err))
+		}
+	}
+	return l
+}
+
+// Start starts a server from NewUnstartedServer.
+func (s *Server) Start() {
+	if s.done != nil {
+		panic("smtptest: Server already started")
+	}
+	s.Addr = s.Listener.Addr().String()
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		s.Server.Serve(s.Listener)
+	}()
+}
+
+// StartTLS starts STARTTLS support on a server from NewUnstartedServer, using
+// a freshly generated self-signed certificate. Other settings of
+// Server.TLSConfig, such as ClientAuth, are kept.
+func (s *Server) StartTLS() {
+	cert, err := generateCertificate()
+	if err != nil {
+		panic(fmt.Sprintf("smtptest: failed to generate certificate: %v", err))
+	}
+	s.certificate = cert.Leaf
+	if s.Server.TLSConfig == nil {
+		s.Server.TLSConfig = &tls.Config{}
+	}
+	s.Server.TLSConfig.Certificates = []tls.Certificate{cert}
+	s.Start()
+}
+
+// Close shuts down the server and closes all open connections.
+func (s *Server) Close() {
+	s.Listener.Close()
+	if s.done != nil {
+		<-s.done
+	}
+}
+
+// Certificate returns the certificate used by the server, or nil if the server
+// doesn't use TLS.
+func (s *Server) Certificate() *x509.Certificate {
+	return s.certificate
+}
+
+// Client connects to the server and returns a new client. If the server
+// supports STARTTLS, the client is configured to trust the server certificate.
+func (s *Server) Client() (*smtp.Client, error) {
+	c, err := smtp.Dial(s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.certificate != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(s.certificate)
+		c.TLSConfig = &tls.Config{RootCAs: pool}
+	}
+	return c, nil
+}
+
+// Messages returns the messages received so far.
+func (s *Server) Messages() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Message(nil), s.messages...)
+}
+
+// Reset discards all received messages.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+}
+
+// Wait waits until at least n messages have been received, or until the
+// timeout expires. It returns the messages received so far.
+func (s *Server) Wait(n int, timeout time.Duration) ([]*Message, error) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		msgs := append([]*Message(nil), s.messages...)
+		changed := s.changed
+		s.mu.Unlock()
+
+		if len(msgs) >= n {
+			return msgs, nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return msgs, fmt.Errorf("smtptest: timeout waiting for %v messages, got %v", n, len(msgs))
+		}
+	}
+}
+
+// ExpectMessages waits for exactly n messages and returns them. It fails the
+// test if a different number of messages is received within DefaultTimeout.
+func (s *Server) ExpectMessages(t testing.TB, n int) []*Message {
+	t.Helper()
+
+	msgs, err := s.Wait(n, DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != n {
+		t.Fatalf("smtptest: expected %v messages, got %v", n, len(msgs))
+	}
+	return msgs
+}
+
+func (s *Server) deliver(msg *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+type backend struct {
+	s *Server
+}
+
+func (be *backend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if be.s.Users != nil {
+		if want, ok := be.s.Users[username]; !ok || want != password {
+			return nil, errors.New("Invalid username or password")
+		}
+	}
+	return &session{s: be.s, state: state, username: username}, nil
+}
+
+func (be *backend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	if be.s.AuthRequired {
+		return nil, smtp.ErrAuthRequired
+	}
+	return &session{s: be.s, state: state}, nil
+}
+
+type session struct {
+	s        *Server
+	state    *smtp.ConnectionState
+	username string
+	from     string
+	to       []string
+}
+
+func (s *session) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *session) Logout() error {
+	return nil
+}
+
+func (s *session) Mail(from string) error {
+	s.Reset()
+	s.from = from
+	return nil
+}
+
+func (s *session) Rcpt(to string) error {
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	msg := &Message{
+		Username: s.username,
+		From:     s.from,
+		To:       append([]string(nil), s.to...),
+		Data:     b,
+	}
+	if s.state != nil {
+		msg.Hostname = s.state.Hostname
+		msg.RemoteAddr = s.state.RemoteAddr
+		if s.state.TLS.HandshakeComplete {
+			tlsState := s.state.TLS
+			msg.TLS = &tlsState
+		}
+	}
+	s.s.deliver(msg)
+	return nil
+}
+
+func generateCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"smtptest"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
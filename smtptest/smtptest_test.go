@@ -0,0 +1,101 @@
+package smtptest_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtptest"
+)
+
+func TestServer(t *testing.T) {
+	s := smtptest.NewServer()
+	defer s.Close()
+
+	msg := "Subject: Hello\r\n\r\nHi there!\r\n"
+	err := smtp.SendMail(s.Addr, nil, "alice@example.org", []string{"bob@example.org", "carol@example.org"}, strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("SendMail: %v", err)
+	}
+
+	msgs := s.ExpectMessages(t, 1)
+	m := msgs[0]
+	if m.From != "alice@example.org" {
+		t.Errorf("From = %q, want alice@example.org", m.From)
+	}
+	if len(m.To) != 2 || m.To[0] != "bob@example.org" || m.To[1] != "carol@example.org" {
+		t.Errorf("To = %v, want [bob@example.org carol@example.org]", m.To)
+	}
+	if want := "Subject: Hello\n\nHi there!\n"; string(m.Data) != want {
+		t.Errorf("Data = %q, want %q", m.Data, want)
+	}
+	h, err := m.Header()
+	if err != nil {
+		t.Fatalf("Header: %v", err)
+	}
+	if subject := h.Get("Subject"); subject != "Hello" {
+		t.Errorf("Subject = %q, want Hello", subject)
+	}
+
+	s.Reset()
+	if msgs := s.Messages(); len(msgs) != 0 {
+		t.Errorf("Messages after Reset = %v, want none", msgs)
+	}
+}
+
+func TestServer_auth(t *testing.T) {
+	s := smtptest.NewUnstartedServer()
+	s.Users = map[string]string{"alice": "secret"}
+	s.AuthRequired = true
+	s.StartTLS()
+	defer s.Close()
+
+	c, err := s.Client()
+	if err != nil {
+		t.Fatalf("Client: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("alice@example.org"); err == nil {
+		t.Fatal("Mail: expected error without authentication")
+	}
+	if err := c.StartTLS(nil); err != nil {
+		t.Fatalf("StartTLS: %v", err)
+	}
+	if err := c.Auth(sasl.NewPlainClient("", "alice", "wrong")); err == nil {
+		t.Fatal("Auth: expected error with invalid password")
+	}
+
+	c, err = s.Client()
+	if err != nil {
+		t.Fatalf("Client: %v", err)
+	}
+	defer c.Close()
+	if err := c.StartTLS(nil); err != nil {
+		t.Fatalf("StartTLS: %v", err)
+	}
+	if err := c.Auth(sasl.NewPlainClient("", "alice", "secret")); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if err := c.Mail("alice@example.org"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := c.Rcpt("bob@example.org"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	io.WriteString(w, "Hi\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Data close: %v", err)
+	}
+
+	msgs := s.ExpectMessages(t, 1)
+	if msgs[0].Username != "alice" {
+		t.Errorf("Username = %q, want alice", msgs[0].Username)
+	}
+}
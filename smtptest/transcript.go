@@ -0,0 +1,191 @@
+package smtptest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A TranscriptLine is a line sent by the client or the server, without the
+// line terminator.
+type TranscriptLine struct {
+	Client bool
+	Text   string
+}
+
+// A Transcript is a recorded SMTP session.
+//
+// In its text form, each line is prefixed with "C: " when sent by the client
+// and with "S: " when sent by the server, as in the examples of RFC 5321.
+// Empty lines and lines starting with "#" are ignored.
+type Transcript struct {
+	Lines []TranscriptLine
+}
+
+// ParseTranscript parses a transcript in its text form.
+func ParseTranscript(r io.Reader) (*Transcript, error) {
+	var t Transcript
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var l TranscriptLine
+		switch {
+		case strings.HasPrefix(line, "C: ") || line == "C:":
+			l.Client = true
+		case strings.HasPrefix(line, "S: ") || line == "S:":
+		default:
+			return nil, fmt.Errorf("smtptest: transcript line %v: missing C: or S: prefix", lineno)
+		}
+		if len(line) > 3 {
+			l.Text = line[3:]
+		}
+		t.Lines = append(t.Lines, l)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// WriteTo writes the transcript in its text form.
+func (t *Transcript) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	for _, l := range t.Lines {
+		prefix := "S:"
+		if l.Client {
+			prefix = "C:"
+		}
+		if l.Text != "" {
+			prefix += " "
+		}
+		buf.WriteString(prefix + l.Text + "\n")
+	}
+	return buf.WriteTo(w)
+}
+
+// String returns the transcript in its text form.
+func (t *Transcript) String() string {
+	var sb strings.Builder
+	t.WriteTo(&sb)
+	return sb.String()
+}
+
+// A Recorder is a net.Conn recording the transcript of a connection.
+type Recorder struct {
+	net.Conn
+
+	server bool
+
+	mu      sync.Mutex
+	lines   []TranscriptLine
+	pending [2][]byte // incomplete lines sent by the server and the client
+}
+
+// RecordClient wraps the client side of a connection: data written to the
+// Recorder is recorded as sent by the client, data read as sent by the server.
+func RecordClient(c net.Conn) *Recorder {
+	return &Recorder{Conn: c}
+}
+
+// RecordServer wraps the server side of a connection: data written to the
+// Recorder is recorded as sent by the server, data read as sent by the client.
+// It can be used to record a session accepted by a smtp.Server with a
+// listener wrapping its connections.
+func RecordServer(c net.Conn) *Recorder {
+	return &Recorder{Conn: c, server: true}
+}
+
+func (r *Recorder) record(client bool, b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := 0
+	if client {
+		i = 1
+	}
+	r.pending[i] = append(r.pending[i], b...)
+	for {
+		j := bytes.IndexByte(r.pending[i], '\n')
+		if j < 0 {
+			break
+		}
+		text := strings.TrimSuffix(string(r.pending[i][:j]), "\r")
+		r.lines = append(r.lines, TranscriptLine{Client: client, Text: text})
+		r.pending[i] = r.pending[i][j+1:]
+	}
+}
+
+func (r *Recorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	r.record(r.server, b[:n])
+	return n, err
+}
+
+func (r *Recorder) Write(b []byte) (int, error) {
+	n, err := r.Conn.Write(b)
+	r.record(!r.server, b[:n])
+	return n, err
+}
+
+// Transcript returns the lines recorded so far. Incomplete lines are not
+// included.
+func (r *Recorder) Transcript() *Transcript {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &Transcript{Lines: append([]TranscriptLine(nil), r.lines...)}
+}
+
+// Replay replays a transcript against the server. Client lines are sent and
+// each server line must match the received one. A server line ending with
+// "*" only needs to match the received line up to the "*", which is useful
+// for responses containing unpredictable values.
+//
+// Consecutive client lines are sent without waiting for responses, as with
+// pipelining. STARTTLS cannot be replayed.
+func (s *Server) Replay(t *Transcript) error {
+	conn, err := net.DialTimeout("tcp", s.Addr, DefaultTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	for i, l := range t.Lines {
+		conn.SetDeadline(time.Now().Add(DefaultTimeout))
+
+		if l.Client {
+			if _, err := io.WriteString(conn, l.Text+"\r\n"); err != nil {
+				return fmt.Errorf("smtptest: transcript line %v: %v", i+1, err)
+			}
+			continue
+		}
+
+		got, err := br.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("smtptest: transcript line %v: expected %q, got error: %v", i+1, l.Text, err)
+		}
+		got = strings.TrimSuffix(strings.TrimSuffix(got, "\n"), "\r")
+		if !matchLine(l.Text, got) {
+			return fmt.Errorf("smtptest: transcript line %v: expected %q, got %q", i+1, l.Text, got)
+		}
+	}
+	return nil
+}
+
+func matchLine(pattern, line string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(line, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == line
+}
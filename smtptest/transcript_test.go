@@ -0,0 +1,96 @@
+package smtptest_test
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtptest"
+)
+
+func TestRecorder(t *testing.T) {
+	s := smtptest.NewServer()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := smtptest.RecordClient(conn)
+	c, err := smtp.NewClient(rec, "localhost")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := c.Mail("alice@example.org"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := c.Rcpt("bob@example.org"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	if _, err := w.Write([]byte("Hello!\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatalf("Quit: %v", err)
+	}
+
+	tr := rec.Transcript()
+	if len(tr.Lines) == 0 || tr.Lines[0].Client || tr.Lines[0].Text != "220 localhost ESMTP Service Ready" {
+		t.Fatalf("unexpected transcript:\n%v", tr)
+	}
+
+	// A recorded transcript can be replayed and parsed back, once the
+	// transaction ID which differs for each message is ignored
+	for i, l := range tr.Lines {
+		if !l.Client && strings.HasPrefix(l.Text, "250 2.0.0 OK: queued as ") {
+			tr.Lines[i].Text = "250 2.0.0 OK: queued as *"
+		}
+	}
+	if err := s.Replay(tr); err != nil {
+		t.Errorf("Replay: %v", err)
+	}
+	parsed, err := smtptest.ParseTranscript(strings.NewReader(tr.String()))
+	if err != nil {
+		t.Fatalf("ParseTranscript: %v", err)
+	}
+	if parsed.String() != tr.String() {
+		t.Errorf("ParseTranscript(String()) = \n%v\nwant\n%v", parsed, tr)
+	}
+}
+
+func TestServer_Replay(t *testing.T) {
+	f, err := os.Open("testdata/pipelining.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr, err := smtptest.ParseTranscript(f)
+	if err != nil {
+		t.Fatalf("ParseTranscript: %v", err)
+	}
+
+	s := smtptest.NewServer()
+	defer s.Close()
+
+	if err := s.Replay(tr); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	msgs := s.ExpectMessages(t, 1)
+	if got := string(msgs[0].Data); got != "Subject: Hi\n\n.leading dot\n" {
+		t.Errorf("unexpected message data: %q", got)
+	}
+
+	tr.Lines[0].Text = "220 mx.example.org *"
+	if err := s.Replay(tr); err == nil {
+		t.Error("Replay: expected error for mismatched greeting")
+	}
+}
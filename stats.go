@@ -0,0 +1,82 @@
+package smtp
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats contains cumulative counters of a server, see Server.Stats.
+type Stats struct {
+	// Since is the time counting started: when the first connection was
+	// accepted or when the counters were last reset.
+	Since time.Time
+
+	// The number of accepted connections, and of connections rejected
+	// because MaxConnections was reached.
+	Connections         uint64
+	RejectedConnections uint64
+	// ActiveConnections is the number of connections currently handled. It
+	// isn't affected by resets.
+	ActiveConnections int
+
+	// The number of accepted messages and their total size in bytes. In
+	// LMTP mode, a message is accepted if at least one recipient accepted
+	// it.
+	Messages uint64
+	Bytes    uint64
+	// The number of MAIL, RCPT and DATA commands rejected, either by the
+	// server or by the session.
+	RejectedMail uint64
+	RejectedRcpt uint64
+	RejectedData uint64
+
+	// The number of successful and failed AUTH commands.
+	AuthSuccesses uint64
+	AuthFailures  uint64
+}
+
+type statsCounters struct {
+	mu    sync.Mutex
+	stats Stats
+}
+
+func (sc *statsCounters) update(f func(stats *Stats)) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.stats.Since.IsZero() {
+		sc.stats.Since = time.Now()
+	}
+	f(&sc.stats)
+}
+
+func (sc *statsCounters) get(reset bool) Stats {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	stats := sc.stats
+	if reset {
+		sc.stats = Stats{Since: time.Now()}
+	}
+	return stats
+}
+
+// Stats returns a snapshot of the server counters, for monitoring without
+// an external metrics system.
+func (s *Server) Stats() Stats {
+	return s.stats(false)
+}
+
+// ResetStats resets the server counters, and returns their values before the
+// reset. No event is lost between the snapshot and the reset.
+func (s *Server) ResetStats() Stats {
+	return s.stats(true)
+}
+
+func (s *Server) stats(reset bool) Stats {
+	stats := s.counters.get(reset)
+	s.locker.Lock()
+	stats.ActiveConnections = len(s.conns)
+	s.locker.Unlock()
+	return stats
+}
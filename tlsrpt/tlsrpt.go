@@ -0,0 +1,326 @@
+// Package tlsrpt implements SMTP TLS reporting, as defined in RFC 8460.
+//
+// Senders record the outcome of each TLS negotiation with a Store, and
+// periodically generate aggregate reports with NewReport.
+package tlsrpt
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp/mtasts"
+)
+
+// PolicyType is the type of the policy applied to a session.
+type PolicyType string
+
+const (
+	PolicyTLSA          PolicyType = "tlsa"
+	PolicySTS           PolicyType = "sts"
+	PolicyNoPolicyFound PolicyType = "no-policy-found"
+)
+
+// ResultType describes why a TLS negotiation failed.
+type ResultType string
+
+const (
+	ResultSTARTTLSNotSupported    ResultType = mtasts.ResultSTARTTLSNotSupported
+	ResultCertificateHostMismatch ResultType = mtasts.ResultCertificateHostMismatch
+	ResultCertificateExpired      ResultType = mtasts.ResultCertificateExpired
+	ResultCertificateNotTrusted   ResultType = mtasts.ResultCertificateNotTrusted
+	ResultValidationFailure       ResultType = mtasts.ResultValidationFailure
+	ResultTLSAInvalid             ResultType = "tlsa-invalid"
+	ResultDNSSECInvalid           ResultType = "dnssec-invalid"
+	ResultDANERequired            ResultType = "dane-required"
+	ResultSTSPolicyFetchError     ResultType = mtasts.ResultSTSPolicyFetchError
+	ResultSTSPolicyInvalid        ResultType = mtasts.ResultSTSPolicyInvalid
+	ResultSTSWebPKIInvalid        ResultType = mtasts.ResultSTSWebPKIInvalid
+)
+
+// Policy describes the policy applied to a session.
+type Policy struct {
+	Type   PolicyType `json:"policy-type"`
+	String []string   `json:"policy-string,omitempty"`
+	Domain string     `json:"policy-domain"`
+	MXHost []string   `json:"mx-host,omitempty"`
+}
+
+// STSPolicy returns a Policy describing a MTA-STS policy. If p is nil, a
+// no-policy-found policy is returned.
+func STSPolicy(domain string, p *mtasts.Policy) Policy {
+	if p == nil {
+		return Policy{Type: PolicyNoPolicyFound, Domain: domain}
+	}
+
+	l := []string{
+		"version: " + p.Version,
+		"mode: " + string(p.Mode),
+	}
+	for _, mx := range p.MX {
+		l = append(l, "mx: "+mx)
+	}
+	l = append(l, fmt.Sprintf("max_age: %v", int64(p.MaxAge/time.Second)))
+
+	return Policy{
+		Type:   PolicySTS,
+		String: l,
+		Domain: domain,
+		MXHost: p.MX,
+	}
+}
+
+func (p *Policy) key() string {
+	return string(p.Type) + "\x00" + p.Domain + "\x00" + strings.Join(p.String, "\n")
+}
+
+// Failure contains details about a failed TLS negotiation.
+type Failure struct {
+	ResultType          ResultType
+	SendingMTAIP        string
+	ReceivingMXHostname string
+	ReceivingMXHelo     string
+	ReceivingIP         string
+	AdditionalInfo      string
+	FailureReasonCode   string
+}
+
+// NewFailure creates a Failure from an error. The result type is extracted
+// from *mtasts.Error values and defaults to validation-failure.
+func NewFailure(err error) *Failure {
+	f := &Failure{ResultType: ResultValidationFailure}
+	var stsErr *mtasts.Error
+	if errors.As(err, &stsErr) {
+		f.ResultType = ResultType(stsErr.Type)
+		f.ReceivingMXHostname = stsErr.MX
+		if stsErr.Err != nil {
+			f.FailureReasonCode = stsErr.Err.Error()
+		}
+	} else if err != nil {
+		f.FailureReasonCode = err.Error()
+	}
+	return f
+}
+
+// Result is the outcome of a single TLS negotiation.
+type Result struct {
+	Time   time.Time
+	Policy Policy
+	// Failure is nil if the negotiation succeeded.
+	Failure *Failure
+}
+
+// Store records results. Implementations must be safe to use from multiple
+// goroutines.
+type Store interface {
+	// Add records a result.
+	Add(r *Result) error
+	// Results returns all results recorded in the [start, end) time range.
+	Results(start, end time.Time) ([]Result, error)
+}
+
+// MemoryStore is a Store keeping results in memory.
+type MemoryStore struct {
+	locker  sync.Mutex
+	results []Result
+}
+
+// Add implements Store.
+func (s *MemoryStore) Add(r *Result) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.results = append(s.results, *r)
+	return nil
+}
+
+// Results implements Store.
+func (s *MemoryStore) Results(start, end time.Time) ([]Result, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	var l []Result
+	for _, r := range s.results {
+		if !r.Time.Before(start) && r.Time.Before(end) {
+			l = append(l, r)
+		}
+	}
+	return l, nil
+}
+
+// Prune removes all results recorded before t.
+func (s *MemoryStore) Prune(t time.Time) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	results := s.results[:0]
+	for _, r := range s.results {
+		if !r.Time.Before(t) {
+			results = append(results, r)
+		}
+	}
+	s.results = results
+}
+
+// DateRange is a report time range.
+type DateRange struct {
+	Start time.Time `json:"start-datetime"`
+	End   time.Time `json:"end-datetime"`
+}
+
+// Summary counts sessions for a policy.
+type Summary struct {
+	TotalSuccessfulSessionCount int `json:"total-successful-session-count"`
+	TotalFailureSessionCount    int `json:"total-failure-session-count"`
+}
+
+// FailureDetails aggregates identical failures.
+type FailureDetails struct {
+	ResultType          ResultType `json:"result-type"`
+	SendingMTAIP        string     `json:"sending-mta-ip,omitempty"`
+	ReceivingMXHostname string     `json:"receiving-mx-hostname,omitempty"`
+	ReceivingMXHelo     string     `json:"receiving-mx-helo,omitempty"`
+	ReceivingIP         string     `json:"receiving-ip,omitempty"`
+	FailedSessionCount  int        `json:"failed-session-count"`
+	AdditionalInfo      string     `json:"additional-information,omitempty"`
+	FailureReasonCode   string     `json:"failure-reason-code,omitempty"`
+}
+
+// PolicyReport contains the results for a single policy.
+type PolicyReport struct {
+	Policy         Policy           `json:"policy"`
+	Summary        Summary          `json:"summary"`
+	FailureDetails []FailureDetails `json:"failure-details,omitempty"`
+}
+
+// Report is an aggregate report.
+type Report struct {
+	OrganizationName string         `json:"organization-name"`
+	DateRange        DateRange      `json:"date-range"`
+	ContactInfo      string         `json:"contact-info"`
+	ReportID         string         `json:"report-id"`
+	Policies         []PolicyReport `json:"policies"`
+}
+
+// ReportOptions contains the reporting organization metadata.
+type ReportOptions struct {
+	OrganizationName string
+	ContactInfo      string
+	ReportID         string
+}
+
+// NewReport aggregates the results recorded in store between start and end,
+// for the policy domain domain. opts may be nil.
+func NewReport(store Store, domain string, start, end time.Time, opts *ReportOptions) (*Report, error) {
+	if opts == nil {
+		opts = &ReportOptions{}
+	}
+
+	results, err := store.Results(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		OrganizationName: opts.OrganizationName,
+		DateRange:        DateRange{Start: start.UTC(), End: end.UTC()},
+		ContactInfo:      opts.ContactInfo,
+		ReportID:         opts.ReportID,
+		Policies:         []PolicyReport{},
+	}
+
+	policies := make(map[string]int)
+	failures := make(map[string]map[Failure]int)
+	for i := range results {
+		r := &results[i]
+		if !strings.EqualFold(r.Policy.Domain, domain) {
+			continue
+		}
+
+		k := r.Policy.key()
+		idx, ok := policies[k]
+		if !ok {
+			idx = len(report.Policies)
+			policies[k] = idx
+			failures[k] = make(map[Failure]int)
+			report.Policies = append(report.Policies, PolicyReport{Policy: r.Policy})
+		}
+
+		pr := &report.Policies[idx]
+		if r.Failure == nil {
+			pr.Summary.TotalSuccessfulSessionCount++
+		} else {
+			pr.Summary.TotalFailureSessionCount++
+			failures[k][*r.Failure]++
+		}
+	}
+
+	for i := range report.Policies {
+		pr := &report.Policies[i]
+		for f, n := range failures[pr.Policy.key()] {
+			pr.FailureDetails = append(pr.FailureDetails, FailureDetails{
+				ResultType:          f.ResultType,
+				SendingMTAIP:        f.SendingMTAIP,
+				ReceivingMXHostname: f.ReceivingMXHostname,
+				ReceivingMXHelo:     f.ReceivingMXHelo,
+				ReceivingIP:         f.ReceivingIP,
+				FailedSessionCount:  n,
+				AdditionalInfo:      f.AdditionalInfo,
+				FailureReasonCode:   f.FailureReasonCode,
+			})
+		}
+		sort.Slice(pr.FailureDetails, func(i, j int) bool {
+			return pr.FailureDetails[i].less(&pr.FailureDetails[j])
+		})
+	}
+
+	return report, nil
+}
+
+// less orders failure details by decreasing count, then by their other
+// fields, so that reports don't depend on the map they are built from.
+func (fd *FailureDetails) less(other *FailureDetails) bool {
+	if fd.FailedSessionCount != other.FailedSessionCount {
+		return fd.FailedSessionCount > other.FailedSessionCount
+	}
+	a := [...]string{string(fd.ResultType), fd.SendingMTAIP, fd.ReceivingMXHostname, fd.ReceivingMXHelo, fd.ReceivingIP, fd.AdditionalInfo, fd.FailureReasonCode}
+	b := [...]string{string(other.ResultType), other.SendingMTAIP, other.ReceivingMXHostname, other.ReceivingMXHelo, other.ReceivingIP, other.AdditionalInfo, other.FailureReasonCode}
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// WriteTo writes the report as gzip-compressed JSON, as required for
+// delivery via mail or HTTPS.
+func (r *Report) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	gw := gzip.NewWriter(cw)
+	if err := json.NewEncoder(gw).Encode(r); err != nil {
+		return cw.n, err
+	}
+	err := gw.Close()
+	return cw.n, err
+}
+
+// Filename returns the filename of the report, as defined in RFC 8460 section
+// 5.1.
+func (r *Report) Filename(receiver, submitter string) string {
+	return fmt.Sprintf("%v!%v!%v!%v.json.gz", receiver, submitter, r.DateRange.Start.Unix(), r.DateRange.End.Unix())
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
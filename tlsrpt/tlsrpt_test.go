@@ -0,0 +1,118 @@
+package tlsrpt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp/mtasts"
+)
+
+func TestNewReport(t *testing.T) {
+	start := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+
+	policy := STSPolicy("example.com", &mtasts.Policy{
+		Version: "STSv1",
+		Mode:    mtasts.ModeEnforce,
+		MX:      []string{"mail.example.com"},
+		MaxAge:  time.Hour,
+	})
+	stsErr := &mtasts.Error{
+		Type:   mtasts.ResultCertificateExpired,
+		Domain: "example.com",
+		MX:     "mail.example.com",
+	}
+
+	store := &MemoryStore{}
+	store.Add(&Result{Time: start, Policy: policy})
+	store.Add(&Result{Time: start.Add(time.Hour), Policy: policy})
+	store.Add(&Result{Time: start.Add(2 * time.Hour), Policy: policy, Failure: NewFailure(stsErr)})
+	store.Add(&Result{Time: start.Add(3 * time.Hour), Policy: policy, Failure: NewFailure(stsErr)})
+	store.Add(&Result{Time: end, Policy: policy})
+	store.Add(&Result{Time: start, Policy: STSPolicy("example.org", nil)})
+
+	report, err := NewReport(store, "example.com", start, end, &ReportOptions{
+		OrganizationName: "Example Inc.",
+		ContactInfo:      "tlsrpt@example.net",
+		ReportID:         "1",
+	})
+	if err != nil {
+		t.Fatalf("NewReport() = %v", err)
+	}
+
+	if len(report.Policies) != 1 {
+		t.Fatalf("len(Policies) = %v, want 1", len(report.Policies))
+	}
+	pr := report.Policies[0]
+	if pr.Summary.TotalSuccessfulSessionCount != 2 || pr.Summary.TotalFailureSessionCount != 2 {
+		t.Errorf("Summary = %+v, want 2 successes and 2 failures", pr.Summary)
+	}
+	if len(pr.FailureDetails) != 1 {
+		t.Fatalf("len(FailureDetails) = %v, want 1", len(pr.FailureDetails))
+	}
+	fd := pr.FailureDetails[0]
+	if fd.ResultType != ResultCertificateExpired || fd.FailedSessionCount != 2 || fd.ReceivingMXHostname != "mail.example.com" {
+		t.Errorf("FailureDetails[0] = %+v", fd)
+	}
+
+	var buf bytes.Buffer
+	if _, err := report.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo() = %v", err)
+	}
+	gr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("gzip.NewReader() = %v", err)
+	}
+	var decoded map[string]interface{}
+	if err := json.NewDecoder(gr).Decode(&decoded); err != nil {
+		t.Fatalf("Decode() = %v", err)
+	}
+	if decoded["organization-name"] != "Example Inc." {
+		t.Errorf("organization-name = %v", decoded["organization-name"])
+	}
+}
+
+func TestNewReport_failureOrder(t *testing.T) {
+	start := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+	policy := STSPolicy("example.com", nil)
+
+	store := &MemoryStore{}
+	for _, mx := range []string{"mx3.example.com", "mx1.example.com", "mx2.example.com"} {
+		store.Add(&Result{Time: start, Policy: policy, Failure: &Failure{
+			ResultType:          ResultSTARTTLSNotSupported,
+			ReceivingMXHostname: mx,
+		}})
+	}
+	store.Add(&Result{Time: start, Policy: policy, Failure: &Failure{
+		ResultType:          ResultCertificateExpired,
+		ReceivingMXHostname: "mx4.example.com",
+	}})
+	store.Add(&Result{Time: start, Policy: policy, Failure: &Failure{
+		ResultType:          ResultCertificateExpired,
+		ReceivingMXHostname: "mx4.example.com",
+	}})
+
+	// Options are optional
+	report, err := NewReport(store, "example.com", start, end, nil)
+	if err != nil {
+		t.Fatalf("NewReport() = %v", err)
+	}
+	if len(report.Policies) != 1 {
+		t.Fatalf("len(Policies) = %v, want 1", len(report.Policies))
+	}
+
+	want := []string{"mx4.example.com", "mx1.example.com", "mx2.example.com", "mx3.example.com"}
+	fds := report.Policies[0].FailureDetails
+	if len(fds) != len(want) {
+		t.Fatalf("len(FailureDetails) = %v, want %v", len(fds), len(want))
+	}
+	for i, fd := range fds {
+		if fd.ReceivingMXHostname != want[i] {
+			t.Errorf("FailureDetails[%v].ReceivingMXHostname = %v, want %v", i, fd.ReceivingMXHostname, want[i])
+		}
+	}
+}
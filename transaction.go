@@ -0,0 +1,52 @@
+package smtp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Transaction describes a mail transaction, started by a MAIL command and
+// ended by DATA, RSET or the end of the connection.
+//
+// Transactions are maintained by the server and must not be modified.
+type Transaction struct {
+	// ID is a random identifier, unique to the transaction.
+	ID string
+	// SessionID is the identifier of the connection, see
+	// ConnectionState.SessionID.
+	SessionID string
+	// From is the reverse-path of the MAIL command.
+	From string
+	// Recipients are the recipients accepted so far.
+	Recipients []string
+
+	// Size is the message size declared with the SIZE parameter, or zero.
+	Size int64
+	// Body is the body type declared with the BODY parameter in upper case,
+	// such as "8BITMIME", or empty.
+	Body string
+	// Auth is the submitter identity of the AUTH parameter, or empty.
+	Auth string
+	// SMTPUTF8 is set if the SMTPUTF8 parameter was given.
+	SMTPUTF8 bool
+
+	// Start is the time the MAIL command was received.
+	Start time.Time
+	// DataStart is the time the DATA command was received, or zero.
+	DataStart time.Time
+}
+
+// newID returns a random session or transaction ID.
+func newID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// Transaction returns the transaction in progress, or nil if there is none.
+func (c *Conn) Transaction() *Transaction {
+	return c.tx
+}
@@ -0,0 +1,93 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// XCLIENT attribute names, as defined by Postfix.
+const (
+	XClientName     = "NAME"
+	XClientAddr     = "ADDR"
+	XClientPort     = "PORT"
+	XClientProto    = "PROTO"
+	XClientHelo     = "HELO"
+	XClientLogin    = "LOGIN"
+	XClientDestAddr = "DESTADDR"
+	XClientDestPort = "DESTPORT"
+)
+
+// XClientUnavailable can be used as an attribute value when the information
+// is not available.
+const XClientUnavailable = "[UNAVAILABLE]"
+
+// XClient sends the XCLIENT command, which overrides the client attributes
+// seen by the server. This is used by proxies to forward information about
+// the original client to an upstream server which trusts them.
+//
+// Attributes not advertised by the server are rejected with an error before
+// anything is sent. After a successful XCLIENT command, the server resets the
+// session: the next command sends a new EHLO.
+func (c *Client) XClient(attrs map[string]string) error {
+	if err := c.hello(); err != nil {
+		return err
+	}
+	params, ok := c.ext["XCLIENT"]
+	if !ok {
+		return errors.New("smtp: server doesn't support XCLIENT")
+	}
+	supported := make(map[string]bool)
+	for _, name := range strings.Fields(params) {
+		supported[strings.ToUpper(name)] = true
+	}
+
+	values := make(map[string]string, len(attrs))
+	names := make([]string, 0, len(attrs))
+	for name, value := range attrs {
+		name = strings.ToUpper(name)
+		if !supported[name] {
+			return fmt.Errorf("smtp: server doesn't support XCLIENT attribute %v", name)
+		}
+		if err := validateLine(value); err != nil {
+			return err
+		}
+		values[name] = value
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return errors.New("smtp: no XCLIENT attributes")
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("XCLIENT")
+	for _, name := range names {
+		sb.WriteString(" " + name + "=" + encodeXtext(values[name]))
+	}
+
+	if _, _, err := c.cmd(2, "%s", sb.String()); err != nil {
+		return err
+	}
+
+	c.didHello = false
+	c.helloError = nil
+	c.ext = nil
+	c.auth = nil
+	return nil
+}
+
+// encodeXtext encodes a string as xtext, as defined in RFC 3461 section 4.
+func encodeXtext(raw string) string {
+	var sb strings.Builder
+	for i := 0; i < len(raw); i++ {
+		ch := raw[i]
+		if ch >= '!' && ch <= '~' && ch != '+' && ch != '=' {
+			sb.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&sb, "+%02X", ch)
+		}
+	}
+	return sb.String()
+}